@@ -0,0 +1,182 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// channelEndpointPrefix starts the string form of a ChannelEndpoint, which
+// is followed by its ID in hex.
+const channelEndpointPrefix = "channel:"
+
+// A ChannelEndpoint addresses a peer of a ChannelBind by an opaque ID, which
+// the application maps to a remote address of its platform's networking
+// API. Its string form is "channel:" followed by the ID in 32 hex digits,
+// which is also how it is configured as a peer's endpoint.
+type ChannelEndpoint [16]byte
+
+var _ Endpoint = (*ChannelEndpoint)(nil)
+
+func (*ChannelEndpoint) ClearSrc() {}
+
+func (*ChannelEndpoint) SrcToString() string { return "" }
+
+func (e *ChannelEndpoint) DstToString() string {
+	return channelEndpointPrefix + hex.EncodeToString(e[:])
+}
+
+func (e *ChannelEndpoint) DstToBytes() []byte { return e[:] }
+
+// DstIP returns the ID as an IPv6 address, so that handshakes are rate
+// limited by endpoint.
+func (e *ChannelEndpoint) DstIP() netip.Addr { return netip.AddrFrom16(*e) }
+
+func (*ChannelEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
+
+// A Datagram is a UDP datagram carried by a ChannelBind, to or from the peer
+// at Endpoint.
+type Datagram struct {
+	Endpoint ChannelEndpoint
+	Data     []byte
+}
+
+// ChannelBind is a Bind that sends and receives datagrams over channels,
+// for platforms where the process cannot open UDP sockets itself, such as
+// iOS and macOS network extensions, whose host application owns the
+// connections. The application shuttles datagrams between the channels and
+// whatever API it has.
+//
+// Datagrams that do not fit in the tx channel are dropped and counted, so
+// that a stalled application does not stall the device.
+type ChannelBind struct {
+	tx chan<- Datagram
+	rx <-chan Datagram
+
+	mu      sync.Mutex
+	closing chan struct{}
+
+	dropped atomic.Uint64
+}
+
+var _ Bind = (*ChannelBind)(nil)
+
+// NewChannelBind returns a ChannelBind sending datagrams on tx and
+// receiving them from rx. The Data of a datagram sent on tx belongs to the
+// application; that of a datagram received on rx must not be modified once
+// sent. Closing rx closes the bind's receive function.
+func NewChannelBind(tx chan<- Datagram, rx <-chan Datagram) *ChannelBind {
+	return &ChannelBind{tx: tx, rx: rx}
+}
+
+// Open ignores port, which is reported back, as the application owns the
+// sockets.
+func (b *ChannelBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	b.closing = make(chan struct{})
+	return []ReceiveFunc{b.makeReceive(b.closing)}, port, nil
+}
+
+func (b *ChannelBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing != nil {
+		close(b.closing)
+		b.closing = nil
+	}
+	return nil
+}
+
+// makeReceive returns a ReceiveFunc that waits for a datagram, and then
+// takes those already queued, up to the batch.
+func (b *ChannelBind) makeReceive(closing <-chan struct{}) ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		var datagram Datagram
+		var ok bool
+		select {
+		case datagram, ok = <-b.rx:
+			if !ok {
+				return 0, net.ErrClosed
+			}
+		case <-closing:
+			return 0, net.ErrClosed
+		}
+		n := 0
+		for {
+			sizes[n] = copy(bufs[n], datagram.Data)
+			ep := datagram.Endpoint
+			eps[n] = &ep
+			n++
+			if n == len(bufs) {
+				return n, nil
+			}
+			select {
+			case datagram, ok = <-b.rx:
+				if !ok {
+					return n, nil
+				}
+			default:
+				return n, nil
+			}
+		}
+	}
+}
+
+func (b *ChannelBind) Send(bufs [][]byte, endpoint Endpoint) error {
+	ep, ok := endpoint.(*ChannelEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	b.mu.Lock()
+	closing := b.closing
+	b.mu.Unlock()
+	if closing == nil {
+		return net.ErrClosed
+	}
+	for _, buf := range bufs {
+		select {
+		case b.tx <- Datagram{Endpoint: *ep, Data: append([]byte(nil), buf...)}:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of datagrams dropped because the tx channel
+// was full.
+func (b *ChannelBind) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+func (*ChannelBind) ParseEndpoint(s string) (Endpoint, error) {
+	id, ok := strings.CutPrefix(s, channelEndpointPrefix)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q does not start with %q", ErrInvalidEndpoint, s, channelEndpointPrefix)
+	}
+	var ep ChannelEndpoint
+	if len(id) != hex.EncodedLen(len(ep)) {
+		return nil, fmt.Errorf("%w: %q is not 32 hex digits", ErrInvalidEndpoint, id)
+	}
+	if _, err := hex.Decode(ep[:], []byte(id)); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
+	}
+	return &ep, nil
+}
+
+func (*ChannelBind) SetMark(mark uint32) error { return nil }
+
+func (*ChannelBind) BatchSize() int { return IdealBatchSize }
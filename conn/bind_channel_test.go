@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestChannelBind(t *testing.T) {
+	tx, rx := make(chan Datagram, 2), make(chan Datagram, 4)
+	bind := NewChannelBind(tx, rx)
+	fns, port, err := bind.Open(51820)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 51820 || len(fns) != 1 {
+		t.Fatalf("Open(51820) = %d functions, port %d", len(fns), port)
+	}
+	if _, _, err := bind.Open(0); !errors.Is(err, ErrBindAlreadyOpen) {
+		t.Errorf("second Open = %v, want ErrBindAlreadyOpen", err)
+	}
+
+	const s = "channel:000102030405060708090a0b0c0d0e0f"
+	ep, err := bind.ParseEndpoint(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.DstToString() != s || ep.DstIP().As16()[15] != 15 {
+		t.Errorf("endpoint %s with IP %v, want %s", ep.DstToString(), ep.DstIP(), s)
+	}
+	for _, invalid := range []string{"127.0.0.1:51820", "channel:0001", "channel:" + s[len("channel:"):] + "00", "channel:zz0102030405060708090a0b0c0d0e0f"} {
+		if _, err := bind.ParseEndpoint(invalid); !errors.Is(err, ErrInvalidEndpoint) {
+			t.Errorf("ParseEndpoint(%q) = %v, want ErrInvalidEndpoint", invalid, err)
+		}
+	}
+
+	// Datagrams beyond the capacity of tx are dropped rather than waited for.
+	bufs := [][]byte{{1}, {2}, {3}}
+	if err := bind.Send(bufs, ep); err != nil {
+		t.Fatal(err)
+	}
+	bufs[0][0] = 9
+	if got := <-tx; got.Endpoint != *ep.(*ChannelEndpoint) || got.Data[0] != 1 {
+		t.Errorf("sent %v, want [1] to %v", got, ep)
+	}
+	if got := <-tx; got.Data[0] != 2 {
+		t.Errorf("sent %v, want [2]", got)
+	}
+	if bind.Dropped() != 1 {
+		t.Errorf("Dropped() = %d, want 1", bind.Dropped())
+	}
+
+	// Receiving takes the queued datagrams in batches.
+	for i := range 3 {
+		rx <- Datagram{Endpoint: ChannelEndpoint{byte(i)}, Data: []byte{byte(i), byte(i)}}
+	}
+	recvBufs := [][]byte{make([]byte, 8), make([]byte, 8)}
+	sizes, eps := make([]int, 2), make([]Endpoint, 2)
+	if n, err := fns[0](recvBufs, sizes, eps); err != nil || n != 2 {
+		t.Fatalf("first receive = %d, %v; want 2 datagrams", n, err)
+	}
+	if n, err := fns[0](recvBufs, sizes, eps); err != nil || n != 1 || sizes[0] != 2 || recvBufs[0][0] != 2 || *eps[0].(*ChannelEndpoint) != (ChannelEndpoint{2}) {
+		t.Fatalf("second receive = %d, %v; sizes %v, eps %v", n, err, sizes, eps)
+	}
+
+	bind.Close()
+	if _, err := fns[0](recvBufs, sizes, eps); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after Close = %v, want net.ErrClosed", err)
+	}
+	if err := bind.Send(bufs, ep); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Send after Close = %v, want net.ErrClosed", err)
+	}
+}
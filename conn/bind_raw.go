@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// DefaultRawProtocol is the IP protocol number reserved for experimentation,
+// which carriers treat as unknown traffic, for use with NewRawBind.
+const DefaultRawProtocol = 255
+
+// rawHeaderSize is the size of the header a raw bind puts in front of each
+// message: the IDs of the sending and receiving binds, in network byte
+// order, standing in for UDP ports.
+const rawHeaderSize = 4
+
+// ErrRawBindUnsupported is returned by NewRawBind on platforms without raw
+// IP sockets.
+var ErrRawBindUnsupported = errors.New("raw IP bind not supported on this platform")
+
+// A RawEndpoint addresses a peer of a raw bind by its IP address and the ID
+// of its bind, the port it was opened with. Its string form is host#id, such
+// as 192.0.2.1#51820 or 2001:db8::1#51820, which is also how it is
+// configured as a peer's endpoint.
+type RawEndpoint struct {
+	Addr netip.Addr
+	ID   uint16
+}
+
+var _ Endpoint = (*RawEndpoint)(nil)
+
+func (*RawEndpoint) ClearSrc() {}
+
+func (*RawEndpoint) SrcToString() string { return "" }
+
+func (e *RawEndpoint) DstToString() string {
+	return e.Addr.String() + "#" + strconv.Itoa(int(e.ID))
+}
+
+func (e *RawEndpoint) DstToBytes() []byte {
+	b, _ := e.Addr.MarshalBinary()
+	return binary.BigEndian.AppendUint16(b, e.ID)
+}
+
+func (e *RawEndpoint) DstIP() netip.Addr { return e.Addr }
+
+func (*RawEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
+
+// parseRawEndpoint parses the string form of a RawEndpoint.
+func parseRawEndpoint(s string) (*RawEndpoint, error) {
+	i := strings.LastIndexByte(s, '#')
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %q is not of the form host#id", ErrInvalidEndpoint, s)
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s[:i], "[]"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEndpoint, err)
+	}
+	id, err := strconv.ParseUint(s[i+1:], 10, 16)
+	if err != nil || id == 0 {
+		return nil, fmt.Errorf("%w: invalid bind ID %q", ErrInvalidEndpoint, s[i+1:])
+	}
+	return &RawEndpoint{Addr: addr.Unmap(), ID: uint16(id)}, nil
+}
+
+// checkRawProtocol refuses the protocols the kernel handles itself, whose
+// raw sockets would see copies of all their traffic.
+func checkRawProtocol(protocol int) error {
+	switch protocol {
+	case 1, 6, 17, 58: // ICMP, TCP, UDP, ICMPv6
+		return fmt.Errorf("IP protocol %d is handled by the kernel", protocol)
+	}
+	if protocol <= 0 || protocol > 255 {
+		return fmt.Errorf("invalid IP protocol %d", protocol)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+// NewRawBind returns ErrRawBindUnsupported, as raw IP binds are only
+// implemented on Linux.
+func NewRawBind(protocol int) (Bind, error) {
+	if err := checkRawProtocol(protocol); err != nil {
+		return nil, err
+	}
+	return nil, ErrRawBindUnsupported
+}
@@ -0,0 +1,284 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// RawBind is a Bind that sends WireGuard messages directly as the payload of
+// IP packets of a configurable protocol instead of UDP, for networks that
+// throttle UDP but pass unknown IP protocols. A 4-byte header of bind IDs
+// takes the place of UDP ports, so that several binds, on either end, can
+// share the protocol. The ID of a bind is the port it is opened with.
+//
+// Every raw socket of the protocol receives every packet of it, so packets
+// addressed to other IDs, or too short to carry a message, are dropped. As
+// long as the bind is open, the kernel no longer answers the protocol with
+// ICMP protocol unreachable errors, while it keeps handling ICMP itself.
+//
+// With protocol 255, IPPROTO_RAW, the kernel expects the bind to write the IP
+// headers of the packets it sends, and it does, taking the source addresses
+// of IPv6 packets from the routing table.
+//
+// Opening a RawBind requires CAP_NET_RAW.
+type RawBind struct {
+	protocol int
+
+	mu      sync.Mutex
+	id      uint16
+	mark    uint32
+	ipv4    *net.IPConn
+	ipv6    *net.IPConn
+	sources map[netip.Addr]netip.Addr // IPv6 source by destination, for IPPROTO_RAW
+
+	bufPool sync.Pool
+}
+
+var _ Bind = (*RawBind)(nil)
+
+// NewRawBind returns a RawBind using the IP protocol number protocol, such
+// as DefaultRawProtocol. It refuses the protocols the kernel handles, such
+// as UDP and ICMP.
+func NewRawBind(protocol int) (Bind, error) {
+	if err := checkRawProtocol(protocol); err != nil {
+		return nil, err
+	}
+	return &RawBind{
+		protocol: protocol,
+		bufPool: sync.Pool{
+			New: func() any {
+				b := make([]byte, 0, rawHeaderSize+1500)
+				return &b
+			},
+		},
+	}, nil
+}
+
+// Open opens raw sockets of the protocol, and receives the messages
+// addressed to ID port, or to a random ID if port is zero.
+func (b *RawBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ipv4 != nil || b.ipv6 != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	for port == 0 {
+		port = uint16(rand.Uint32())
+	}
+
+	proto := strconv.Itoa(b.protocol)
+	v4conn, err := net.ListenIP("ip4:"+proto, &net.IPAddr{IP: net.IPv4zero})
+	if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
+		return nil, 0, rawListenError(err)
+	}
+	v6conn, err := net.ListenIP("ip6:"+proto, &net.IPAddr{IP: net.IPv6unspecified})
+	if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
+		if v4conn != nil {
+			v4conn.Close()
+		}
+		return nil, 0, rawListenError(err)
+	}
+
+	b.ipv4, b.ipv6 = v4conn, v6conn
+	var fns []ReceiveFunc
+	for _, c := range []*net.IPConn{v4conn, v6conn} {
+		if c == nil {
+			continue
+		}
+		if b.mark != 0 {
+			if err := setMark(c, b.mark); err != nil {
+				b.closeLocked()
+				return nil, 0, err
+			}
+		}
+		fns = append(fns, b.makeReceive(c, port))
+	}
+	if len(fns) == 0 {
+		return nil, 0, syscall.EAFNOSUPPORT
+	}
+	b.id = port
+	b.sources = make(map[netip.Addr]netip.Addr)
+	return fns, port, nil
+}
+
+func rawListenError(err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return fmt.Errorf("raw IP sockets require CAP_NET_RAW: %w", err)
+	}
+	return err
+}
+
+func (b *RawBind) makeReceive(c *net.IPConn, id uint16) ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
+		for {
+			// The IPv4 header, which the kernel includes, is stripped by
+			// ReadFromIP.
+			size, addr, err := c.ReadFromIP(bufs[0])
+			if err != nil {
+				return 0, err
+			}
+			if size <= rawHeaderSize || binary.BigEndian.Uint16(bufs[0][2:]) != id {
+				continue
+			}
+			ep, ok := rawEndpointFromIP(addr)
+			if !ok {
+				continue
+			}
+			ep.ID = binary.BigEndian.Uint16(bufs[0])
+			sizes[0] = copy(bufs[0], bufs[0][rawHeaderSize:size])
+			eps[0] = ep
+			return 1, nil
+		}
+	}
+}
+
+func rawEndpointFromIP(addr *net.IPAddr) (*RawEndpoint, bool) {
+	if addr == nil {
+		return nil, false
+	}
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return nil, false
+	}
+	ip = ip.Unmap()
+	if addr.Zone != "" {
+		ip = ip.WithZone(addr.Zone)
+	}
+	return &RawEndpoint{Addr: ip}, true
+}
+
+func (b *RawBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closeLocked()
+}
+
+func (b *RawBind) closeLocked() error {
+	var err4, err6 error
+	if b.ipv4 != nil {
+		err4 = b.ipv4.Close()
+		b.ipv4 = nil
+	}
+	if b.ipv6 != nil {
+		err6 = b.ipv6.Close()
+		b.ipv6 = nil
+	}
+	return errors.Join(err4, err6)
+}
+
+func (b *RawBind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mark = mark
+	for _, c := range []*net.IPConn{b.ipv4, b.ipv6} {
+		if c == nil {
+			continue
+		}
+		if err := setMark(c, mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *RawBind) Send(bufs [][]byte, endpoint Endpoint) error {
+	ep, ok := endpoint.(*RawEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	b.mu.Lock()
+	id, c := b.id, b.ipv6
+	if ep.Addr.Is4() {
+		c = b.ipv4
+	}
+	b.mu.Unlock()
+	if c == nil {
+		return syscall.EAFNOSUPPORT
+	}
+
+	var src netip.Addr
+	if b.protocol == syscall.IPPROTO_RAW && !ep.Addr.Is4() {
+		var err error
+		if src, err = b.source6(ep.Addr); err != nil {
+			return err
+		}
+	}
+
+	addr := &net.IPAddr{IP: ep.Addr.AsSlice(), Zone: ep.Addr.Zone()}
+	frame := b.bufPool.Get().(*[]byte)
+	defer b.bufPool.Put(frame)
+	for _, buf := range bufs {
+		*frame = (*frame)[:0]
+		if b.protocol == syscall.IPPROTO_RAW {
+			*frame = appendRawIPHeader(*frame, src, ep.Addr, rawHeaderSize+len(buf))
+		}
+		*frame = binary.BigEndian.AppendUint16(*frame, id)
+		*frame = binary.BigEndian.AppendUint16(*frame, ep.ID)
+		*frame = append(*frame, buf...)
+		if _, err := c.WriteToIP(*frame, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendRawIPHeader appends the header of an IP packet of protocol
+// IPPROTO_RAW from src to dst with a payload of size bytes. The kernel
+// completes IPv4 headers, including the source address; IPv6 headers need
+// src.
+func appendRawIPHeader(b []byte, src, dst netip.Addr, size int) []byte {
+	if dst.Is4() {
+		b = append(b, 0x45, 0) // version 4, 20-byte header
+		b = binary.BigEndian.AppendUint16(b, uint16(20+size))
+		b = append(b, 0, 0, 0, 0, 64, syscall.IPPROTO_RAW, 0, 0, 0, 0, 0, 0) // TTL, protocol; ID, checksum and source filled in
+		return append(b, dst.AsSlice()...)
+	}
+	b = append(b, 0x60, 0, 0, 0) // version 6
+	b = binary.BigEndian.AppendUint16(b, uint16(size))
+	b = append(b, syscall.IPPROTO_RAW, 64) // next header, hop limit
+	b = append(b, src.AsSlice()...)
+	return append(b, dst.AsSlice()...)
+}
+
+// source6 returns the address the routing table picks to send to dst from.
+func (b *RawBind) source6(dst netip.Addr) (netip.Addr, error) {
+	b.mu.Lock()
+	src, ok := b.sources[dst]
+	b.mu.Unlock()
+	if ok {
+		return src, nil
+	}
+	// Connecting a UDP socket sends nothing, but looks up the route.
+	c, err := net.DialUDP("udp6", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 9)))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	src = c.LocalAddr().(*net.UDPAddr).AddrPort().Addr().WithZone("")
+	c.Close()
+	b.mu.Lock()
+	if b.sources != nil {
+		b.sources[dst] = src
+	}
+	b.mu.Unlock()
+	return src, nil
+}
+
+func (b *RawBind) ParseEndpoint(s string) (Endpoint, error) {
+	return parseRawEndpoint(s)
+}
+
+func (b *RawBind) BatchSize() int {
+	return 1
+}
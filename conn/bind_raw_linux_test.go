@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRawEndpoint(t *testing.T) {
+	for s, want := range map[string]RawEndpoint{
+		"192.0.2.1#51820":        {Addr: netip.MustParseAddr("192.0.2.1"), ID: 51820},
+		"2001:db8::1#1":          {Addr: netip.MustParseAddr("2001:db8::1"), ID: 1},
+		"[2001:db8::1]#2":        {Addr: netip.MustParseAddr("2001:db8::1"), ID: 2},
+		"::ffff:192.0.2.1#65535": {Addr: netip.MustParseAddr("192.0.2.1"), ID: 65535},
+		"fe80::1%eth0#51820":     {Addr: netip.MustParseAddr("fe80::1%eth0"), ID: 51820},
+	} {
+		ep, err := parseRawEndpoint(s)
+		if err != nil || *ep != want {
+			t.Errorf("parseRawEndpoint(%q) = %v, %v; want %v", s, ep, err, want)
+		}
+	}
+	for _, invalid := range []string{"192.0.2.1:51820", "192.0.2.1#0", "192.0.2.1#65536", "host#1", "#1"} {
+		if _, err := parseRawEndpoint(invalid); !errors.Is(err, ErrInvalidEndpoint) {
+			t.Errorf("parseRawEndpoint(%q) = %v, want ErrInvalidEndpoint", invalid, err)
+		}
+	}
+
+	for _, protocol := range []int{0, 6, 17, 256} {
+		if _, err := NewRawBind(protocol); err == nil {
+			t.Errorf("NewRawBind(%d) succeeded", protocol)
+		}
+	}
+}
+
+func TestRawBind(t *testing.T) {
+	// IPPROTO_RAW, whose IP headers the bind writes, and a protocol whose
+	// headers the kernel writes.
+	for _, protocol := range []int{DefaultRawProtocol, 253} {
+		t.Run(strconv.Itoa(protocol), func(t *testing.T) { testRawBind(t, protocol) })
+	}
+}
+
+func testRawBind(t *testing.T, protocol int) {
+	var binds [3]Bind
+	var fns [3][]ReceiveFunc
+	for i := range binds {
+		bind, err := NewRawBind(protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fns[i], _, err = bind.Open(uint16(51820 + i))
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			t.Skip("no CAP_NET_RAW:", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bind.Close()
+		binds[i] = bind
+	}
+
+	received := make(chan string, 6)
+	for i := range binds {
+		for _, fn := range fns[i] {
+			go func() {
+				bufs := [][]byte{make([]byte, 1500)}
+				sizes := make([]int, 1)
+				eps := make([]Endpoint, 1)
+				for {
+					if _, err := fn(bufs, sizes, eps); err != nil {
+						return
+					}
+					received <- string(bufs[0][:sizes[0]]) + " from " + eps[0].DstToString()
+				}
+			}()
+		}
+	}
+
+	// Every bind sees the packets, but only the one addressed receives them.
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		ep, err := binds[0].ParseEndpoint(host + "#51821")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := binds[0].Send([][]byte{[]byte("hello")}, ep); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-received:
+			if want := "hello from " + host + "#51820"; got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("nothing received over %s", host)
+		}
+	}
+
+	// The other binds do not return it; closing them ends their receive
+	// functions.
+	binds[0].Close()
+	binds[2].Close()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case got := <-received:
+		t.Errorf("bind with another ID received %q", got)
+	default:
+	}
+	if _, err := fns[2][0]([][]byte{make([]byte, 1500)}, make([]int, 1), make([]Endpoint, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after Close = %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,326 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkit/wireguard/conn/relay"
+)
+
+// Bounds of the backoff between attempts of a RelayBind to reconnect to its
+// relay server over TCP, doubling from relayRedialMin after each failure.
+const (
+	relayRedialMin = 100 * time.Millisecond
+	relayRedialMax = 30 * time.Second
+)
+
+// relayEndpointPrefix starts the string form of a RelayEndpoint, which is
+// followed by the peer's public key in hex.
+const relayEndpointPrefix = "relay:"
+
+// A RelayEndpoint addresses a peer through the relay of a RelayBind, by its
+// public key. Its string form is "relay:" followed by the key in hex, which
+// is also how it is configured as a peer's endpoint.
+type RelayEndpoint struct {
+	Key relay.Key
+}
+
+var _ Endpoint = (*RelayEndpoint)(nil)
+
+func (*RelayEndpoint) ClearSrc() {}
+
+func (*RelayEndpoint) SrcToString() string { return "" }
+
+func (e *RelayEndpoint) DstToString() string {
+	return relayEndpointPrefix + hex.EncodeToString(e.Key[:])
+}
+
+func (e *RelayEndpoint) DstToBytes() []byte { return e.Key[:] }
+
+func (*RelayEndpoint) DstIP() netip.Addr { return netip.Addr{} }
+
+func (*RelayEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
+
+// RelayBind is a Bind that reaches the peers whose endpoint is a
+// RelayEndpoint through a relay server, such as the one in package relay,
+// and all other peers directly through the Bind it wraps. Use it for peers
+// that cannot reach each other directly, for instance because both are
+// behind restrictive NATs.
+//
+// Over UDP, relay frames share the wrapped Bind's sockets with direct
+// traffic. Over TCP, for networks that block UDP altogether, they travel on
+// a connection of their own, which Open establishes, and which is
+// reestablished with exponential backoff whenever it fails.
+type RelayBind struct {
+	Bind
+	self    relay.Key
+	server  string
+	network string
+
+	mu        sync.Mutex
+	serverEP  Endpoint // UDP only
+	tcp       net.Conn
+	closing   chan struct{}
+	framePool sync.Pool
+}
+
+// NewRelayBind returns a RelayBind wrapping bind, which registers with the
+// relay server at address under the public key self. network is "udp" or
+// "tcp".
+func NewRelayBind(bind Bind, self relay.Key, network, address string) *RelayBind {
+	return &RelayBind{
+		Bind:    bind,
+		self:    self,
+		server:  address,
+		network: network,
+		framePool: sync.Pool{
+			New: func() any {
+				b := make([]byte, 0, relay.HeaderSize+1500)
+				return &b
+			},
+		},
+	}
+}
+
+func (b *RelayBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch b.network {
+	case "udp":
+		b.serverEP, err = b.Bind.ParseEndpoint(b.server)
+	case "tcp":
+		b.tcp, err = net.DialTimeout("tcp", b.server, 5*time.Second)
+	default:
+		err = fmt.Errorf("unsupported relay network %q", b.network)
+	}
+	if err != nil {
+		b.Bind.Close()
+		return nil, 0, err
+	}
+
+	var serverAddr string
+	if b.serverEP != nil {
+		serverAddr = b.serverEP.DstToString()
+	}
+	wrapped := make([]ReceiveFunc, 0, len(fns)+1)
+	for _, fn := range fns {
+		wrapped = append(wrapped, b.makeReceive(fn, serverAddr))
+	}
+	b.closing = make(chan struct{})
+	if b.tcp != nil {
+		wrapped = append(wrapped, b.makeReceiveTCP(b.closing))
+	}
+	if err := b.register(); err != nil {
+		b.closeLocked()
+		return nil, 0, err
+	}
+	go b.routineRegister(b.closing)
+	return wrapped, actualPort, nil
+}
+
+func (b *RelayBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closeLocked()
+}
+
+func (b *RelayBind) closeLocked() error {
+	if b.closing != nil {
+		close(b.closing)
+		b.closing = nil
+	}
+	var err error
+	if b.tcp != nil {
+		err = b.tcp.Close()
+		b.tcp = nil
+	}
+	b.serverEP = nil
+	return errors.Join(b.Bind.Close(), err)
+}
+
+// register announces the bind to the relay server. b.mu must be held.
+func (b *RelayBind) register() error {
+	frame := relay.AppendFrame(nil, relay.FrameRegister, b.self, nil)
+	if b.tcp != nil {
+		return relay.WriteStreamFrame(b.tcp, frame)
+	}
+	return b.Bind.Send([][]byte{frame}, b.serverEP)
+}
+
+// routineRegister renews the registration with the relay server until closing is closed.
+func (b *RelayBind) routineRegister(closing chan struct{}) {
+	ticker := time.NewTicker(relay.RegisterInterval)
+	defer ticker.Stop()
+	frame := relay.AppendFrame(nil, relay.FrameRegister, b.self, nil)
+	for {
+		select {
+		case <-closing:
+			return
+		case <-ticker.C:
+		}
+		b.sendFrames([][]byte{frame})
+	}
+}
+
+// sendFrames sends frames to the relay server. It writes without holding
+// b.mu, so that a slow relay connection holds up only the writers waiting on
+// it. A write error closes the TCP connection, for the receive routine to
+// reestablish it.
+func (b *RelayBind) sendFrames(frames [][]byte) error {
+	b.mu.Lock()
+	open, tcp, serverEP := b.closing != nil, b.tcp, b.serverEP
+	b.mu.Unlock()
+	if !open {
+		return net.ErrClosed
+	}
+	if tcp == nil {
+		return b.Bind.Send(frames, serverEP)
+	}
+	// Each frame goes out in a single Write, which a net.Conn does not
+	// interleave with those of other goroutines.
+	for _, frame := range frames {
+		if err := relay.WriteStreamFrame(tcp, frame); err != nil {
+			tcp.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// redial replaces the failed TCP connection old to the relay server, waiting
+// *delay first and doubling it up to relayRedialMax after each attempt, and
+// registers anew. It reports false if closing was closed first.
+func (b *RelayBind) redial(old net.Conn, closing chan struct{}, delay *time.Duration) bool {
+	old.Close()
+	for {
+		timer := time.NewTimer(*delay)
+		select {
+		case <-closing:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		*delay = min(max(2**delay, relayRedialMin), relayRedialMax)
+		c, err := net.DialTimeout("tcp", b.server, 5*time.Second)
+		if err != nil {
+			continue
+		}
+		if err := relay.WriteStreamFrame(c, relay.AppendFrame(nil, relay.FrameRegister, b.self, nil)); err != nil {
+			c.Close()
+			continue
+		}
+		b.mu.Lock()
+		if b.closing != closing {
+			b.mu.Unlock()
+			c.Close()
+			return false
+		}
+		b.tcp = c
+		b.mu.Unlock()
+		return true
+	}
+}
+
+// makeReceive wraps fn, unwrapping the data frames it receives from the relay
+// server at serverAddr and dropping any other frames. With the relay server
+// reached over TCP, serverAddr is empty and all frames are dropped.
+func (b *RelayBind) makeReceive(fn ReceiveFunc, serverAddr string) ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		n, err := fn(packets, sizes, eps)
+		for i := 0; i < n; i++ {
+			packet := packets[i][:sizes[i]]
+			if !relay.IsFrame(packet) {
+				continue
+			}
+			typ, key, payload, ok := relay.ParseFrame(packet)
+			if !ok || typ != relay.FrameData || serverAddr == "" || eps[i].DstToString() != serverAddr {
+				sizes[i] = 0
+				continue
+			}
+			sizes[i] = copy(packets[i], payload)
+			eps[i] = &RelayEndpoint{Key: key}
+		}
+		return n, err
+	}
+}
+
+// makeReceiveTCP returns a ReceiveFunc reading frames from the relay server
+// over the TCP connection, which it reestablishes when it fails, until
+// closing is closed.
+func (b *RelayBind) makeReceiveTCP(closing chan struct{}) ReceiveFunc {
+	buf := make([]byte, relay.MaxFrameSize)
+	var delay time.Duration // before the next redial, reset by each frame read
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		for {
+			b.mu.Lock()
+			c := b.tcp
+			b.mu.Unlock()
+			if c == nil {
+				return 0, net.ErrClosed
+			}
+			frame, err := relay.ReadStreamFrame(c, buf)
+			if err != nil {
+				if !b.redial(c, closing, &delay) {
+					return 0, net.ErrClosed
+				}
+				continue
+			}
+			delay = 0
+			typ, key, payload, ok := relay.ParseFrame(frame)
+			if !ok || typ != relay.FrameData {
+				continue
+			}
+			sizes[0] = copy(packets[0], payload)
+			eps[0] = &RelayEndpoint{Key: key}
+			return 1, nil
+		}
+	}
+}
+
+func (b *RelayBind) Send(bufs [][]byte, ep Endpoint) error {
+	rep, ok := ep.(*RelayEndpoint)
+	if !ok {
+		return b.Bind.Send(bufs, ep)
+	}
+
+	frames := make([][]byte, len(bufs))
+	for i, buf := range bufs {
+		frame := b.framePool.Get().(*[]byte)
+		*frame = relay.AppendFrame((*frame)[:0], relay.FrameData, rep.Key, buf)
+		frames[i] = *frame
+		defer b.framePool.Put(frame)
+	}
+	return b.sendFrames(frames)
+}
+
+func (b *RelayBind) ParseEndpoint(s string) (Endpoint, error) {
+	if !strings.HasPrefix(s, relayEndpointPrefix) {
+		return b.Bind.ParseEndpoint(s)
+	}
+	var ep RelayEndpoint
+	key, err := hex.DecodeString(s[len(relayEndpointPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
+	}
+	if len(key) != len(ep.Key) {
+		return nil, fmt.Errorf("%w: relay key length %d", ErrInvalidEndpoint, len(key))
+	}
+	copy(ep.Key[:], key)
+	return &ep, nil
+}
@@ -0,0 +1,179 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn/relay"
+)
+
+// trackingListener keeps the conns it accepts, for the test to drop them.
+type trackingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, c)
+		l.mu.Unlock()
+	}
+	return c, err
+}
+
+func (l *trackingListener) drop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+}
+
+type relayPacket struct {
+	data []byte
+	ep   Endpoint
+}
+
+// openRelayBind opens a RelayBind over TCP, queueing what it receives from
+// the relay to the returned channel.
+func openRelayBind(t *testing.T, key relay.Key, address string) (*RelayBind, <-chan relayPacket) {
+	t.Helper()
+	b := NewRelayBind(NewStdNetBind(), key, "tcp", address)
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	c := make(chan relayPacket, 16)
+	go func() {
+		bufs := [][]byte{make([]byte, 2048)}
+		sizes := make([]int, 1)
+		eps := make([]Endpoint, 1)
+		for {
+			n, err := fns[len(fns)-1](bufs, sizes, eps)
+			if err != nil {
+				return
+			}
+			if n == 1 {
+				c <- relayPacket{bytes.Clone(bufs[0][:sizes[0]]), eps[0]}
+			}
+		}
+	}()
+	return b, c
+}
+
+func waitRegistered(t *testing.T, server *relay.Server, keys ...relay.Key) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, key := range keys {
+		for !server.Registered(key) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%x did not register with the relay", key[:4])
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestRelayBindRedial(t *testing.T) {
+	var server relay.Server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tracking := &trackingListener{Listener: ln}
+	go server.ServeTCP(tracking)
+
+	keyA, keyB := relay.Key{1}, relay.Key{2}
+	a, _ := openRelayBind(t, keyA, ln.Addr().String())
+	_, received := openRelayBind(t, keyB, ln.Addr().String())
+	waitRegistered(t, &server, keyA, keyB)
+
+	// Until the relay is reached again, sends may fail or be lost; keep
+	// sending until one arrives.
+	deliver := func(message string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			a.Send([][]byte{[]byte(message)}, &RelayEndpoint{Key: keyB})
+			select {
+			case p := <-received:
+				if string(p.data) != message || p.ep.(*RelayEndpoint).Key != keyA {
+					t.Fatalf("received %q from %s, want %q from %x", p.data, p.ep.DstToString(), message, keyA)
+				}
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		t.Fatalf("%q not delivered through the relay", message)
+	}
+	deliver("before")
+
+	// The relay drops both connections; the binds reconnect and register
+	// again on their own.
+	tracking.drop()
+	waitRegistered(t, &server, keyA, keyB)
+	deliver("after")
+}
+
+func TestRelayBindCloseWhileSending(t *testing.T) {
+	// A relay that accepts but never reads, so that writes block once the
+	// socket buffers are full.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	b := NewRelayBind(NewStdNetBind(), relay.Key{1}, "tcp", ln.Addr().String())
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatal(err)
+	}
+
+	sending := make(chan struct{})
+	go func() {
+		defer close(sending)
+		frame := make([]byte, 1400)
+		for b.Send([][]byte{frame}, &RelayEndpoint{Key: relay.Key{2}}) == nil {
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Close does not wait for the blocked write, but ends it.
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked behind a Send")
+	}
+	select {
+	case <-sending:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send still blocked after Close")
+	}
+}
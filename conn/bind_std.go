@@ -14,6 +14,7 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"golang.org/x/net/ipv4"
@@ -37,6 +38,10 @@ type StdNetBind struct {
 	ipv4RxOffload bool
 	ipv6TxOffload bool
 	ipv6RxOffload bool
+	gsoDisabled   bool
+
+	offloadsDisabled bool  // by DisableOffloads or a failed offload probe
+	offloadFailure   error // of the failed offload probe
 
 	// these two fields are not guarded by mu
 	udpAddrPool sync.Pool
@@ -44,10 +49,31 @@ type StdNetBind struct {
 
 	blackhole4 bool
 	blackhole6 bool
+
+	flowLabelPolicy atomic.Int32          // not guarded by mu
+	flowLabels      map[netip.Addr]uint32 // labels leased on ipv6, by destination
+
+	mark    uint32   // fwmark, applied to source sockets as they are opened
+	sources *sources // sockets bound to specific local addresses by SendFrom
+
+	busyPoll        int   // SO_BUSY_POLL requested, in microseconds
+	busyPollApplied int   // SO_BUSY_POLL set on the open sockets
+	affinity        []int // CPUs receive goroutines are pinned to, not guarded by mu
+	affinityApplied atomic.Bool
+
+	packetFilter        bool // requested by WithPacketFilter
+	packetFilterApplied bool // attached to the open sockets
+
+	fragmentation FragmentationPolicy
+	pathMTU       int      // configured, in bytes
+	pathMTUs      pathMTUs // not guarded by mu
+
+	endpointErrors endpointErrorHandler // not guarded by mu
 }
 
-func NewStdNetBind() Bind {
-	return &StdNetBind{
+// NewStdNetBind returns a StdNetBind configured by opts.
+func NewStdNetBind(opts ...StdNetBindOption) Bind {
+	s := &StdNetBind{
 		udpAddrPool: sync.Pool{
 			New: func() any {
 				return &net.UDPAddr{
@@ -63,12 +89,16 @@ func NewStdNetBind() Bind {
 				msgs := make([]ipv6.Message, IdealBatchSize)
 				for i := range msgs {
 					msgs[i].Buffers = make(net.Buffers, 1)
-					msgs[i].OOB = make([]byte, 0, stickyControlSize+gsoControlSize)
+					msgs[i].OOB = make([]byte, 0, stickyControlSize+gsoControlSize+flowLabelControlSize)
 				}
 				return &msgs
 			},
 		},
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 type StdNetEndpoint struct {
@@ -78,15 +108,20 @@ type StdNetEndpoint struct {
 	// supported. Typically this is a PKTINFO structure from/for control
 	// messages, see unix.PKTINFO for an example.
 	src []byte
+	// via is the socket Punch found the path to the endpoint from, if any,
+	// which datagrams to it are sent from while it is open.
+	via *sourceConn
 }
 
 var (
-	_ Bind     = (*StdNetBind)(nil)
-	_ Endpoint = &StdNetEndpoint{}
+	_ Bind          = (*StdNetBind)(nil)
+	_ FlowLabelBind = (*StdNetBind)(nil)
+	_ OffloadBind   = (*StdNetBind)(nil)
+	_ Endpoint      = &StdNetEndpoint{}
 )
 
 func (*StdNetBind) ParseEndpoint(s string) (Endpoint, error) {
-	e, err := netip.ParseAddrPort(s)
+	e, err := parseAddrPort(s)
 	if err != nil {
 		return nil, err
 	}
@@ -170,28 +205,35 @@ again:
 		v4conn.Close()
 		return nil, 0, err
 	}
+	s.applyBusyPoll(v4conn, v6conn)
+	s.applyFragmentation(v4conn, v6conn)
+	s.applyPacketFilter(v4conn, v6conn)
 	var fns []ReceiveFunc
 	if v4conn != nil {
-		s.ipv4TxOffload, s.ipv4RxOffload = supportsUDPOffload(v4conn)
+		enableErrorQueue(v4conn, false)
 		if runtime.GOOS == "linux" || runtime.GOOS == "android" {
 			v4pc = ipv4.NewPacketConn(v4conn)
 			s.ipv4PC = v4pc
 		}
+		s.ipv4TxOffload, s.ipv4RxOffload = s.udpOffloads(v4conn, v4pc, false)
 		fns = append(fns, s.makeReceiveIPv4(v4pc, v4conn, s.ipv4RxOffload))
 		s.ipv4 = v4conn
 	}
 	if v6conn != nil {
-		s.ipv6TxOffload, s.ipv6RxOffload = supportsUDPOffload(v6conn)
+		enableErrorQueue(v6conn, true)
 		if runtime.GOOS == "linux" || runtime.GOOS == "android" {
 			v6pc = ipv6.NewPacketConn(v6conn)
 			s.ipv6PC = v6pc
 		}
+		s.ipv6TxOffload, s.ipv6RxOffload = s.udpOffloads(v6conn, v6pc, true)
 		fns = append(fns, s.makeReceiveIPv6(v6pc, v6conn, s.ipv6RxOffload))
 		s.ipv6 = v6conn
 	}
 	if len(fns) == 0 {
 		return nil, 0, syscall.EAFNOSUPPORT
 	}
+	s.sources = newSources()
+	fns = append(fns, makeReceiveSources(s.sources))
 
 	return fns, uint16(port), nil
 }
@@ -273,15 +315,42 @@ func (s *StdNetBind) receiveIP(
 	return numMsgs, nil
 }
 
+// The ReceiveFuncs returned by makeReceiveIPv4 and makeReceiveIPv6 pin the
+// goroutine calling them, which must always be the same one, on first use.
+
 func (s *StdNetBind) makeReceiveIPv4(pc *ipv4.PacketConn, conn *net.UDPConn, rxOffload bool) ReceiveFunc {
+	pinned := false
 	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
-		return s.receiveIP(pc, conn, rxOffload, bufs, sizes, eps)
+		if !pinned {
+			pinned = true
+			s.pinReceiveThread()
+		}
+		for {
+			n, err = s.receiveIP(pc, conn, rxOffload, bufs, sizes, eps)
+			// An error the network reported for a datagram we sent
+			// fails the next read; it is not an error of the socket.
+			if err == nil || !s.readErrorQueue(conn, err) {
+				return n, err
+			}
+		}
 	}
 }
 
 func (s *StdNetBind) makeReceiveIPv6(pc *ipv6.PacketConn, conn *net.UDPConn, rxOffload bool) ReceiveFunc {
+	pinned := false
 	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
-		return s.receiveIP(pc, conn, rxOffload, bufs, sizes, eps)
+		if !pinned {
+			pinned = true
+			s.pinReceiveThread()
+		}
+		for {
+			n, err = s.receiveIP(pc, conn, rxOffload, bufs, sizes, eps)
+			// An error the network reported for a datagram we sent
+			// fails the next read; it is not an error of the socket.
+			if err == nil || !s.readErrorQueue(conn, err) {
+				return n, err
+			}
+		}
 	}
 }
 
@@ -309,8 +378,14 @@ func (s *StdNetBind) Close() error {
 		s.ipv6 = nil
 		s.ipv6PC = nil
 	}
+	if s.sources != nil {
+		s.sources.close()
+		s.sources = nil
+	}
 	s.blackhole4 = false
 	s.blackhole6 = false
+	s.flowLabels = nil
+	s.pathMTUs.reset()
 	s.ipv4TxOffload = false
 	s.ipv4RxOffload = false
 	s.ipv6TxOffload = false
@@ -321,6 +396,19 @@ func (s *StdNetBind) Close() error {
 	return err2
 }
 
+// SetUDPGSO enables or disables coalescing of outgoing datagrams with UDP
+// GSO. Disabling takes effect immediately; enabling takes effect the next
+// time the bind is opened, if the sockets support it.
+func (s *StdNetBind) SetUDPGSO(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gsoDisabled = !enabled
+	if !enabled {
+		s.ipv4TxOffload = false
+		s.ipv6TxOffload = false
+	}
+}
+
 type ErrUDPGSODisabled struct {
 	onLaddr  string
 	RetryErr error
@@ -334,19 +422,74 @@ func (e ErrUDPGSODisabled) Unwrap() error {
 	return e.RetryErr
 }
 
+// SetFlowLabelPolicy selects how the senders of datagrams choose IPv6 flow
+// labels. Policies other than FlowLabelKernel are only supported on Linux.
+func (s *StdNetBind) SetFlowLabelPolicy(policy FlowLabelPolicy) error {
+	if policy < FlowLabelKernel || policy > FlowLabelRandom {
+		return fmt.Errorf("invalid flow label policy %v", policy)
+	}
+	if policy != FlowLabelKernel && !flowLabelsSupported {
+		return errors.ErrUnsupported
+	}
+	s.flowLabelPolicy.Store(int32(policy))
+	return nil
+}
+
+func (s *StdNetBind) FlowLabelPolicy() FlowLabelPolicy {
+	return FlowLabelPolicy(s.flowLabelPolicy.Load())
+}
+
+// leaseFlowLabel reports whether conn holds a lease on label for sending to
+// dst, taking one if needed and releasing the label previously used for dst.
+// s.mu must be held.
+func (s *StdNetBind) leaseFlowLabel(conn *net.UDPConn, dst netip.Addr, label uint32) bool {
+	old, ok := s.flowLabels[dst]
+	if ok && old == label {
+		return true
+	}
+	if ok {
+		manageFlowLabel(conn, dst, old, true)
+		delete(s.flowLabels, dst)
+	}
+	if err := manageFlowLabel(conn, dst, label, false); err != nil {
+		// Most likely another socket holds the label; send unlabeled.
+		return false
+	}
+	if s.flowLabels == nil {
+		s.flowLabels = make(map[netip.Addr]uint32)
+	}
+	s.flowLabels[dst] = label
+	return true
+}
+
 func (s *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
+	return s.SendFlowLabel(bufs, endpoint, 0)
+}
+
+func (s *StdNetBind) SendFlowLabel(bufs [][]byte, endpoint Endpoint, label uint32) error {
+	if ep, ok := endpoint.(*StdNetEndpoint); ok && ep.via != nil {
+		if s.sendVia(bufs, ep) {
+			return nil
+		}
+	}
+	label &= FlowLabelMask
 	s.mu.Lock()
 	blackhole := s.blackhole4
 	conn := s.ipv4
 	offload := s.ipv4TxOffload
+	maxSegment := s.maxSegmentSize(endpoint.DstIP())
 	br := batchWriter(s.ipv4PC)
 	is6 := false
+	labeled := false
 	if endpoint.DstIP().Is6() {
 		blackhole = s.blackhole6
 		conn = s.ipv6
 		br = s.ipv6PC
 		is6 = true
 		offload = s.ipv6TxOffload
+		if label != 0 && conn != nil && s.FlowLabelPolicy() != FlowLabelKernel {
+			labeled = s.leaseFlowLabel(conn, endpoint.DstIP(), label)
+		}
 	}
 	s.mu.Unlock()
 
@@ -365,10 +508,12 @@ func (s *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
 		as16 := endpoint.DstIP().As16()
 		copy(ua.IP, as16[:])
 		ua.IP = ua.IP[:16]
+		ua.Zone = endpoint.DstIP().Zone()
 	} else {
 		as4 := endpoint.DstIP().As4()
 		copy(ua.IP, as4[:])
 		ua.IP = ua.IP[:4]
+		ua.Zone = ""
 	}
 	ua.Port = int(endpoint.(*StdNetEndpoint).Port())
 	var (
@@ -377,7 +522,12 @@ func (s *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
 	)
 retry:
 	if offload {
-		n := coalesceMessages(ua, endpoint.(*StdNetEndpoint), bufs, *msgs, setGSOSize)
+		n := coalesceMessages(ua, endpoint.(*StdNetEndpoint), bufs, *msgs, maxSegment, setGSOSize)
+		if labeled {
+			for i := range (*msgs)[:n] {
+				setFlowLabelControl(&(*msgs)[i].OOB, label)
+			}
+		}
 		err = s.send(conn, br, (*msgs)[:n])
 		if err != nil && offload && errShouldDisableUDPGSO(err) {
 			offload = false
@@ -396,6 +546,9 @@ retry:
 			(*msgs)[i].Addr = ua
 			(*msgs)[i].Buffers[0] = bufs[i]
 			setSrcControl(&(*msgs)[i].OOB, endpoint.(*StdNetEndpoint))
+			if labeled {
+				setFlowLabelControl(&(*msgs)[i].OOB, label)
+			}
 		}
 		err = s.send(conn, br, (*msgs)[:len(bufs)])
 	}
@@ -412,8 +565,15 @@ func (s *StdNetBind) send(conn *net.UDPConn, pc batchWriter, msgs []ipv6.Message
 		start int
 	)
 	if runtime.GOOS == "linux" || runtime.GOOS == "android" {
+		retried := false
 		for {
 			n, err = pc.WriteBatch(msgs[start:], 0)
+			if err != nil && !retried && s.readErrorQueue(conn, err) {
+				// The error was reported for an earlier datagram,
+				// and none of these was sent.
+				retried = true
+				continue
+			}
 			if err != nil || n == len(msgs[start:]) {
 				break
 			}
@@ -443,7 +603,10 @@ const (
 
 type setGSOFunc func(control *[]byte, gsoSize uint16)
 
-func coalesceMessages(addr *net.UDPAddr, ep *StdNetEndpoint, bufs [][]byte, msgs []ipv6.Message, setGSO setGSOFunc) int {
+// coalesceMessages coalesces bufs into msgs, in segments of up to maxSegment
+// bytes if it is not zero. Larger datagrams are each left in a message of
+// their own.
+func coalesceMessages(addr *net.UDPAddr, ep *StdNetEndpoint, bufs [][]byte, msgs []ipv6.Message, maxSegment int, setGSO setGSOFunc) int {
 	var (
 		base     = -1 // index of msg we are currently coalescing into
 		gsoSize  int  // segmentation size of msgs[base]
@@ -489,6 +652,9 @@ func coalesceMessages(addr *net.UDPAddr, ep *StdNetEndpoint, bufs [][]byte, msgs
 		msgs[base].Buffers[0] = buf
 		msgs[base].Addr = addr
 		dgramCnt = 1
+		// Nothing is coalesced with a datagram exceeding the path MTU, so
+		// that it alone is fragmented or rejected.
+		endBatch = maxSegment > 0 && gsoSize > maxSegment
 	}
 	return base + 1
 }
@@ -522,6 +688,9 @@ func splitCoalescedMessages(msgs []ipv6.Message, firstMsgAt int, getGSO getGSOFu
 			copied := copy(msgs[n].Buffers[0], msg.Buffers[0][start:end])
 			msgs[n].N = copied
 			msgs[n].Addr = msg.Addr
+			// Each datagram keeps the control messages of the coalesced
+			// one, such as the destination address of sticky sockets.
+			msgs[n].NN = copy(msgs[n].OOB[:cap(msgs[n].OOB)], msg.OOB[:msg.NN])
 			start = end
 			end += gsoSize
 			if end > msg.N {
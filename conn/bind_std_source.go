@@ -0,0 +1,200 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var _ SourceBind = (*StdNetBind)(nil)
+
+// sourceQueueSize is the number of datagrams received on source sockets that
+// may wait for the device to read them.
+const sourceQueueSize = 1024
+
+// A sourceConn is a socket bound to a specific local address, opened by
+// SendFrom in addition to the bind's wildcard sockets.
+type sourceConn struct {
+	conn *net.UDPConn
+	pc   batchWriter // nil on non-Linux
+}
+
+type sourcePacket struct {
+	data []byte
+	ep   *StdNetEndpoint
+}
+
+// sources holds the source sockets of an open StdNetBind and the queue of
+// the datagrams received on them.
+type sources struct {
+	conns   map[netip.Addr]*sourceConn
+	punched map[*sourceConn]struct{} // sockets Punch found paths from
+	rx      chan sourcePacket
+	closed  chan struct{}
+}
+
+func newSources() *sources {
+	return &sources{
+		conns:   make(map[netip.Addr]*sourceConn),
+		punched: make(map[*sourceConn]struct{}),
+		rx:      make(chan sourcePacket, sourceQueueSize),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (srcs *sources) close() {
+	close(srcs.closed)
+	for _, c := range srcs.conns {
+		c.conn.Close()
+	}
+	for c := range srcs.punched {
+		c.conn.Close()
+	}
+}
+
+// makeReceiveSources returns the ReceiveFunc delivering the datagrams
+// received on the source sockets of srcs.
+func makeReceiveSources(srcs *sources) ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
+		select {
+		case <-srcs.closed:
+			return 0, net.ErrClosed
+		case p := <-srcs.rx:
+			sizes[0] = copy(bufs[0], p.data)
+			eps[0] = p.ep
+			n = 1
+		}
+		for n < len(bufs) {
+			select {
+			case p := <-srcs.rx:
+				sizes[n] = copy(bufs[n], p.data)
+				eps[n] = p.ep
+				n++
+			default:
+				return n, nil
+			}
+		}
+		return n, nil
+	}
+}
+
+// receive queues the datagrams received on c until it is closed.
+func (srcs *sources) receive(c *net.UDPConn) {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := c.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		p := sourcePacket{data: slices.Clone(buf[:n]), ep: &StdNetEndpoint{AddrPort: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}}
+		select {
+		case srcs.rx <- p:
+		case <-srcs.closed:
+			return
+		default:
+			// The device is not keeping up; drop, as a full socket buffer would.
+		}
+	}
+}
+
+// sourceConn returns the socket bound to src, opening it if needed. s.mu
+// must be held.
+func (s *StdNetBind) sourceConn(src netip.Addr) (*sourceConn, error) {
+	if s.sources == nil {
+		return nil, net.ErrClosed
+	}
+	if c, ok := s.sources.conns[src]; ok {
+		return c, nil
+	}
+	network := "udp4"
+	if src.Is6() {
+		network = "udp6"
+	}
+	pc, err := listenConfig().ListenPacket(context.Background(), network, netip.AddrPortFrom(src, 0).String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSourceUnavailable, err)
+	}
+	c := &sourceConn{conn: pc.(*net.UDPConn)}
+	if s.mark != 0 {
+		if err := setMark(c.conn, s.mark); err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	_ = setFragmentation(c.conn, src.Is6(), s.fragmentation)
+	if s.packetFilter {
+		_ = setPacketFilter(c.conn)
+	}
+	if runtime.GOOS == "linux" || runtime.GOOS == "android" {
+		if src.Is6() {
+			c.pc = ipv6.NewPacketConn(c.conn)
+		} else {
+			c.pc = ipv4.NewPacketConn(c.conn)
+		}
+	}
+	s.sources.conns[src] = c
+	go s.sources.receive(c.conn)
+	return c, nil
+}
+
+// SendFrom sends bufs to endpoint from a socket bound to src, on an
+// ephemeral port. Datagrams arriving on that socket are received along with
+// those arriving on the wildcard sockets. Flow labels and UDP GSO are not
+// used on such sockets.
+func (s *StdNetBind) SendFrom(bufs [][]byte, endpoint Endpoint, src netip.Addr) error {
+	src = src.Unmap()
+	ep, ok := endpoint.(*StdNetEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	if src.Is4() != ep.DstIP().Unmap().Is4() {
+		return fmt.Errorf("%w: %v cannot reach %v", ErrSourceUnavailable, src, ep.DstIP())
+	}
+	s.mu.Lock()
+	c, err := s.sourceConn(src)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	msgs := s.getMessages()
+	defer s.putMessages(msgs)
+	ua := net.UDPAddrFromAddrPort(netip.AddrPortFrom(ep.DstIP().Unmap(), ep.Port()))
+	for i := range bufs {
+		(*msgs)[i].Addr = ua
+		(*msgs)[i].Buffers[0] = bufs[i]
+	}
+	err = s.send(c.conn, c.pc, (*msgs)[:len(bufs)])
+	if err != nil && errSourceGone(err) {
+		s.mu.Lock()
+		if s.sources != nil && s.sources.conns[src] == c {
+			delete(s.sources.conns, src)
+			c.conn.Close()
+		}
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %w", ErrSourceUnavailable, err)
+	}
+	return err
+}
+
+// errSourceGone reports whether err from sending on a socket bound to a
+// specific address means that the address or its link is gone.
+func errSourceGone(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.ENETDOWN) || errors.Is(err, syscall.ENETUNREACH)
+}
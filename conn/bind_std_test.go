@@ -2,8 +2,12 @@ package conn
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
 	"testing"
+	"time"
 
 	"golang.org/x/net/ipv6"
 )
@@ -27,6 +31,59 @@ func TestStdNetBindReceiveFuncAfterClose(t *testing.T) {
 	}
 }
 
+func TestStdNetBindSendFrom(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	ep, err := bind.ParseEndpoint(remote.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := netip.MustParseAddr("127.0.0.1")
+	if err := bind.SendFrom([][]byte{{1}}, ep, src); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, from, err := remote.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Addr() != src || from.Port() == port {
+		t.Errorf("datagram from %v, want %v on a port other than %d", from, src, port)
+	}
+
+	// Replies to the source socket are received with the bind's other datagrams.
+	if _, err := remote.WriteToUDPAddrPort([]byte{2}, from); err != nil {
+		t.Fatal(err)
+	}
+	bufs := [][]byte{make([]byte, 16)}
+	sizes := make([]int, 1)
+	eps := make([]Endpoint, 1)
+	n, err := fns[len(fns)-1](bufs, sizes, eps)
+	if err != nil || n != 1 || sizes[0] != 1 || bufs[0][0] != 2 {
+		t.Fatalf("received %d datagrams %v, %v", n, bufs[0][:sizes[0]], err)
+	}
+	if eps[0].DstToString() != remote.LocalAddr().String() {
+		t.Errorf("datagram from %v, want %v", eps[0].DstToString(), remote.LocalAddr())
+	}
+
+	for _, src := range []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.IPv6Loopback()} {
+		if err := bind.SendFrom([][]byte{{1}}, ep, src); !errors.Is(err, ErrSourceUnavailable) {
+			t.Errorf("SendFrom(%v) = %v, want %v", src, err, ErrSourceUnavailable)
+		}
+	}
+}
+
 func mockSetGSOSize(control *[]byte, gsoSize uint16) {
 	*control = (*control)[:cap(*control)]
 	binary.LittleEndian.PutUint16(*control, gsoSize)
@@ -34,10 +91,11 @@ func mockSetGSOSize(control *[]byte, gsoSize uint16) {
 
 func Test_coalesceMessages(t *testing.T) {
 	cases := []struct {
-		name     string
-		buffs    [][]byte
-		wantLens []int
-		wantGSO  []int
+		name       string
+		buffs      [][]byte
+		maxSegment int
+		wantLens   []int
+		wantGSO    []int
 	}{
 		{
 			name: "one message no coalesce",
@@ -85,6 +143,28 @@ func Test_coalesceMessages(t *testing.T) {
 			wantLens: []int{4, 2},
 			wantGSO:  []int{2, 0},
 		},
+		{
+			name: "three messages first exceeding max segment",
+			buffs: [][]byte{
+				make([]byte, 3, 3),
+				make([]byte, 2, 4),
+				make([]byte, 2, 2),
+			},
+			maxSegment: 2,
+			wantLens:   []int{3, 4},
+			wantGSO:    []int{0, 2},
+		},
+		{
+			name: "three messages second exceeding max segment",
+			buffs: [][]byte{
+				make([]byte, 2, 7),
+				make([]byte, 3, 3),
+				make([]byte, 2, 2),
+			},
+			maxSegment: 2,
+			wantLens:   []int{2, 3, 2},
+			wantGSO:    []int{0, 0, 0},
+		},
 	}
 
 	for _, tt := range cases {
@@ -98,7 +178,7 @@ func Test_coalesceMessages(t *testing.T) {
 				msgs[i].Buffers = make([][]byte, 1)
 				msgs[i].OOB = make([]byte, 0, 2)
 			}
-			got := coalesceMessages(addr, &StdNetEndpoint{AddrPort: addr.AddrPort()}, tt.buffs, msgs, mockSetGSOSize)
+			got := coalesceMessages(addr, &StdNetEndpoint{AddrPort: addr.AddrPort()}, tt.buffs, msgs, tt.maxSegment, mockSetGSOSize)
 			if got != len(tt.wantLens) {
 				t.Fatalf("got len %d want: %d", got, len(tt.wantLens))
 			}
@@ -149,6 +229,7 @@ func Test_splitCoalescedMessages(t *testing.T) {
 		firstMsgAt  int
 		wantNumEval int
 		wantMsgLens []int
+		wantMsgNNs  []int
 		wantErr     bool
 	}{
 		{
@@ -162,6 +243,7 @@ func Test_splitCoalescedMessages(t *testing.T) {
 			firstMsgAt:  2,
 			wantNumEval: 3,
 			wantMsgLens: []int{1, 1, 1, 0},
+			wantMsgNNs:  []int{2, 2, 2, 0},
 			wantErr:     false,
 		},
 		{
@@ -175,6 +257,7 @@ func Test_splitCoalescedMessages(t *testing.T) {
 			firstMsgAt:  2,
 			wantNumEval: 1,
 			wantMsgLens: []int{1, 0, 0, 0},
+			wantMsgNNs:  []int{0, 0, 0, 0},
 			wantErr:     false,
 		},
 		{
@@ -188,6 +271,7 @@ func Test_splitCoalescedMessages(t *testing.T) {
 			firstMsgAt:  2,
 			wantNumEval: 2,
 			wantMsgLens: []int{1, 1, 0, 0},
+			wantMsgNNs:  []int{0, 0, 0, 0},
 			wantErr:     false,
 		},
 		{
@@ -201,6 +285,7 @@ func Test_splitCoalescedMessages(t *testing.T) {
 			firstMsgAt:  2,
 			wantNumEval: 4,
 			wantMsgLens: []int{1, 1, 1, 1},
+			wantMsgNNs:  []int{0, 2, 2, 2},
 			wantErr:     false,
 		},
 		{
@@ -214,6 +299,7 @@ func Test_splitCoalescedMessages(t *testing.T) {
 			firstMsgAt:  2,
 			wantNumEval: 4,
 			wantMsgLens: []int{1, 1, 1, 1},
+			wantMsgNNs:  []int{2, 2, 2, 2},
 			wantErr:     false,
 		},
 		{
@@ -227,6 +313,7 @@ func Test_splitCoalescedMessages(t *testing.T) {
 			firstMsgAt:  2,
 			wantNumEval: 4,
 			wantMsgLens: []int{1, 1, 1, 1},
+			wantMsgNNs:  []int{0, 2, 2, 2},
 			wantErr:     true,
 		},
 	}
@@ -244,7 +331,128 @@ func Test_splitCoalescedMessages(t *testing.T) {
 				if msg.N != tt.wantMsgLens[i] {
 					t.Fatalf("msg[%d].N: %d want: %d", i, msg.N, tt.wantMsgLens[i])
 				}
+				if msg.NN != tt.wantMsgNNs[i] {
+					t.Fatalf("msg[%d].NN: %d want: %d", i, msg.NN, tt.wantMsgNNs[i])
+				}
 			}
 		})
 	}
 }
+
+// loopbackInterface returns the loopback interface, which every host has.
+func loopbackInterface(t *testing.T) net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			return ifi
+		}
+	}
+	t.Skip("no loopback interface")
+	return net.Interface{}
+}
+
+func TestStdNetBindParseEndpointZone(t *testing.T) {
+	lo := loopbackInterface(t)
+	bind := NewStdNetBind()
+	for _, tt := range []struct {
+		in   string
+		want string // empty if rejected
+	}{
+		{"[fe80::1%" + lo.Name + "]:51820", "[fe80::1%" + lo.Name + "]:51820"},
+		{fmt.Sprintf("[fe80::1%%%d]:51820", lo.Index), fmt.Sprintf("[fe80::1%%%d]:51820", lo.Index)},
+		{"[ff02::1%" + lo.Name + "]:51820", "[ff02::1%" + lo.Name + "]:51820"},
+		{"[fe80::1]:51820", "[fe80::1]:51820"},
+		{"[2001:db8::1%" + lo.Name + "]:51820", ""},
+		{"[fd00::1%" + lo.Name + "]:51820", ""},
+		{"[fe80::1%nonexistent0]:51820", ""},
+		{"[fe80::1%0]:51820", ""},
+	} {
+		ep, err := bind.ParseEndpoint(tt.in)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidEndpoint) {
+				t.Errorf("ParseEndpoint(%q) = %v, want %v", tt.in, err, ErrInvalidEndpoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseEndpoint(%q): %v", tt.in, err)
+			continue
+		}
+		if got := ep.DstToString(); got != tt.want {
+			t.Errorf("ParseEndpoint(%q).DstToString() = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStdNetBindSendLinkLocal(t *testing.T) {
+	var dst netip.AddrPort
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ip, ok := netip.AddrFromSlice(a.(*net.IPNet).IP); ok && ip.IsLinkLocalUnicast() && ip.Is6() {
+				dst = netip.AddrPortFrom(ip.WithZone(ifi.Name), 0)
+			}
+		}
+	}
+	if !dst.IsValid() {
+		t.Skip("no IPv6 link-local address")
+	}
+	r, err := net.ListenUDP("udp6", net.UDPAddrFromAddrPort(dst))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer r.Close()
+	dst = netip.AddrPortFrom(dst.Addr(), r.LocalAddr().(*net.UDPAddr).AddrPort().Port())
+
+	bind := NewStdNetBind()
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	ep, err := bind.ParseEndpoint(dst.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bind.Send([][]byte{{1}}, ep); err != nil {
+		t.Fatalf("Send to %v: %v", dst, err)
+	}
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStdNetBindOffloadProbe(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	_, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, rx := supportsUDPOffload(bind.ipv4)
+	if disabled, err := bind.OffloadsDisabled(); disabled || err != nil {
+		t.Fatalf("offloads disabled after a probe on loopback: %v", err)
+	}
+	if bind.ipv4TxOffload != tx || bind.ipv4RxOffload != rx {
+		t.Errorf("offloads tx %v rx %v after the probe, want tx %v rx %v", bind.ipv4TxOffload, bind.ipv4RxOffload, tx, rx)
+	}
+
+	bind.DisableOffloads()
+	if bind.ipv4TxOffload || bind.ipv6TxOffload {
+		t.Error("UDP GSO still used after DisableOffloads")
+	}
+	bind.Close()
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if _, rx := supportsUDPOffload(bind.ipv4); rx || bind.ipv4TxOffload || bind.ipv4RxOffload {
+		t.Error("offloads used after reopening with offloads disabled")
+	}
+	if disabled, err := bind.OffloadsDisabled(); !disabled || err != nil {
+		t.Errorf("OffloadsDisabled() = %v, %v after DisableOffloads, want true, nil", disabled, err)
+	}
+}
@@ -7,6 +7,7 @@ package conn
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"net/netip"
@@ -75,6 +76,9 @@ type WinRingBind struct {
 	v4, v6 afWinRingBind
 	mu     sync.RWMutex
 	isOpen atomic.Uint32 // 0, 1, or 2
+
+	fragmentation  FragmentationPolicy // guarded by mu
+	endpointErrors endpointErrorHandler
 }
 
 func NewDefaultBind() Bind { return NewWinRingBind() }
@@ -92,15 +96,26 @@ type WinRingEndpoint struct {
 }
 
 var (
-	_ Bind     = (*WinRingBind)(nil)
-	_ Endpoint = (*WinRingEndpoint)(nil)
+	_ Bind                  = (*WinRingBind)(nil)
+	_ EndpointErrorReporter = (*WinRingBind)(nil)
+	_ FragmentationBind     = (*WinRingBind)(nil)
+	_ Endpoint              = (*WinRingEndpoint)(nil)
 )
 
 func (*WinRingBind) ParseEndpoint(s string) (Endpoint, error) {
-	host, port, err := net.SplitHostPort(s)
+	ap, err := parseAddrPort(s)
 	if err != nil {
 		return nil, err
 	}
+	if zone := ap.Addr().Zone(); zone != "" {
+		// GetAddrInfoW only understands zones given by index.
+		index, _ := zoneIndex(zone)
+		s = netip.AddrPortFrom(ap.Addr().WithZone(strconv.Itoa(index)), ap.Port()).String()
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
+	}
 	host16, err := windows.UTF16PtrFromString(host)
 	if err != nil {
 		return nil, err
@@ -118,11 +133,11 @@ func (*WinRingBind) ParseEndpoint(s string) (Endpoint, error) {
 	var addrinfo *windows.AddrinfoW
 	err = windows.GetAddrInfoW(host16, port16, &hints, &addrinfo)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
 	}
 	defer windows.FreeAddrInfoW(addrinfo)
 	if (addrinfo.Family != windows.AF_INET && addrinfo.Family != windows.AF_INET6) || addrinfo.Addrlen > unsafe.Sizeof(WinRingEndpoint{}) {
-		return nil, windows.ERROR_INVALID_ADDRESS
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEndpoint, windows.ERROR_INVALID_ADDRESS)
 	}
 	var dst [unsafe.Sizeof(WinRingEndpoint{})]byte
 	copy(dst[:], unsafe.Slice((*byte)(unsafe.Pointer(addrinfo.Addr)), addrinfo.Addrlen))
@@ -289,12 +304,14 @@ func (bind *WinRingBind) Open(port uint16) (recvFns []ReceiveFunc, selectedPort
 		return nil, 0, err
 	}
 	selectedPort = uint16(sa.(*windows.SockaddrInet6).Port)
+	_ = setFragmentationSocket(bind.v4.sock, false, bind.fragmentation)
+	_ = setFragmentationSocket(bind.v6.sock, true, bind.fragmentation)
 	for i := 0; i < packetsPerRing; i++ {
-		err = bind.v4.InsertReceiveRequest()
+		err = bind.v4.InsertReceiveRequest(0)
 		if err != nil {
 			return nil, 0, err
 		}
-		err = bind.v6.InsertReceiveRequest()
+		err = bind.v6.InsertReceiveRequest(0)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -324,15 +341,39 @@ func (bind *WinRingBind) Close() error {
 // TODO: When all Binds handle IdealBatchSize, remove this dynamic function and
 // rename the IdealBatchSize constant to BatchSize.
 func (bind *WinRingBind) BatchSize() int {
-	// TODO: implement batching in and out of the ring
-	return 1
+	return IdealBatchSize
 }
 
 func (bind *WinRingBind) SetMark(mark uint32) error {
 	return nil
 }
 
-func (bind *afWinRingBind) InsertReceiveRequest() error {
+func (bind *WinRingBind) SetFragmentationPolicy(policy FragmentationPolicy) error {
+	if err := validFragmentationPolicy(policy); err != nil {
+		return err
+	}
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	bind.fragmentation = policy
+	if bind.isOpen.Load() != 1 {
+		return nil
+	}
+	if err := setFragmentationSocket(bind.v4.sock, false, policy); err != nil {
+		return err
+	}
+	return setFragmentationSocket(bind.v6.sock, true, policy)
+}
+
+func (bind *WinRingBind) FragmentationPolicy() FragmentationPolicy {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	return bind.fragmentation
+}
+
+// InsertReceiveRequest posts a receive into the next free slot of the rx ring.
+// Requests posted with winrio.MsgDefer are only handed to the kernel by the
+// next request posted without it.
+func (bind *afWinRingBind) InsertReceiveRequest(flags uint32) error {
 	packet := bind.rx.Push()
 	dataBuffer := &winrio.Buffer{
 		Id:     bind.rx.id,
@@ -346,144 +387,221 @@ func (bind *afWinRingBind) InsertReceiveRequest() error {
 	}
 	bind.mu.Lock()
 	defer bind.mu.Unlock()
-	return winrio.ReceiveEx(bind.rq, dataBuffer, 1, nil, addressBuffer, nil, nil, 0, uintptr(unsafe.Pointer(packet)))
+	return winrio.ReceiveEx(bind.rq, dataBuffer, 1, nil, addressBuffer, nil, nil, flags, uintptr(unsafe.Pointer(packet)))
 }
 
 //go:linkname procyield runtime.procyield
 func procyield(cycles uint32)
 
-func (bind *afWinRingBind) Receive(buf []byte, isOpen *atomic.Uint32) (int, Endpoint, error) {
+// Receive dequeues up to len(bufs) completed receives from the rx ring,
+// blocking until at least one is available. The completion queue of each
+// socket is only ever drained by that socket's ReceiveFunc goroutine.
+func (bind *afWinRingBind) Receive(bufs [][]byte, sizes []int, eps []Endpoint, isOpen *atomic.Uint32, errs *endpointErrorHandler) (int, error) {
 	if isOpen.Load() != 1 {
-		return 0, nil, net.ErrClosed
+		return 0, net.ErrClosed
 	}
 	bind.rx.mu.Lock()
 	defer bind.rx.mu.Unlock()
 
 	var err error
 	var count uint32
-	var results [1]winrio.Result
+	var resultsArray [IdealBatchSize]winrio.Result
+	results := resultsArray[:min(len(bufs), len(resultsArray))]
 retry:
 	count = 0
 	for tries := 0; count == 0 && tries < receiveSpins; tries++ {
 		if tries > 0 {
 			if isOpen.Load() != 1 {
-				return 0, nil, net.ErrClosed
+				return 0, net.ErrClosed
 			}
 			procyield(1)
 		}
-		count = winrio.DequeueCompletion(bind.rx.cq, results[:])
+		count = winrio.DequeueCompletion(bind.rx.cq, results)
 	}
 	if count == 0 {
 		err = winrio.Notify(bind.rx.cq)
 		if err != nil {
-			return 0, nil, err
+			return 0, err
 		}
 		var bytes uint32
 		var key uintptr
 		var overlapped *windows.Overlapped
 		err = windows.GetQueuedCompletionStatus(bind.rx.iocp, &bytes, &key, &overlapped, windows.INFINITE)
 		if err != nil {
-			return 0, nil, err
+			return 0, err
 		}
 		if isOpen.Load() != 1 {
-			return 0, nil, net.ErrClosed
+			return 0, net.ErrClosed
 		}
-		count = winrio.DequeueCompletion(bind.rx.cq, results[:])
+		count = winrio.DequeueCompletion(bind.rx.cq, results)
 		if count == 0 {
-			return 0, nil, io.ErrNoProgress
+			return 0, io.ErrNoProgress
+		}
+	}
+
+	// Copy the datagrams out before their slots are reposted.
+	n := 0
+	for i := range results[:count] {
+		packet := (*ringPacket)(unsafe.Pointer(uintptr(results[i].RequestContext)))
+		// We limit the MTU well below the 65k max for practicality, but this means a remote host can still send us
+		// huge packets. Just drop them. The infinite loop this could cause is still limited to attacker bandwidth,
+		// just like the rest of the receive path.
+		if windows.Errno(results[i].Status) == windows.WSAEMSGSIZE {
+			continue
+		}
+		// Windows fails a receive with the ICMP error received for a
+		// datagram sent to the address of the receive.
+		if e := endpointError(windows.Errno(results[i].Status)); e != 0 {
+			if dst, err := netip.ParseAddrPort(packet.addr.DstToString()); err == nil {
+				errs.report(dst, e)
+			}
+			continue
+		}
+		if results[i].Status != 0 {
+			if err == nil {
+				err = windows.Errno(results[i].Status)
+			}
+			continue
+		}
+		ep := packet.addr
+		sizes[n] = copy(bufs[n], packet.data[:results[i].BytesTransferred])
+		eps[n] = &ep
+		n++
+	}
+	bind.rx.Return(count)
+	for i := uint32(0); i < count; i++ {
+		flags := uint32(winrio.MsgDefer)
+		if i == count-1 {
+			flags = 0
+		}
+		if err := bind.InsertReceiveRequest(flags); err != nil {
+			return 0, err
 		}
 	}
-	bind.rx.Return(1)
-	err = bind.InsertReceiveRequest()
+	if n > 0 {
+		return n, nil
+	}
 	if err != nil {
-		return 0, nil, err
+		return 0, err
 	}
-	// We limit the MTU well below the 65k max for practicality, but this means a remote host can still send us
-	// huge packets. Just try again when this happens. The infinite loop this could cause is still limited to
-	// attacker bandwidth, just like the rest of the receive path.
-	if windows.Errno(results[0].Status) == windows.WSAEMSGSIZE {
-		if isOpen.Load() != 1 {
-			return 0, nil, net.ErrClosed
-		}
-		goto retry
+	if isOpen.Load() != 1 {
+		return 0, net.ErrClosed
 	}
-	if results[0].Status != 0 {
-		return 0, nil, windows.Errno(results[0].Status)
+	goto retry
+}
+
+// endpointError returns the EndpointError of a receive that failed with
+// errno, or zero if errno is not an error reported for a datagram sent.
+func endpointError(errno windows.Errno) EndpointError {
+	switch errno {
+	case windows.WSAECONNRESET:
+		return ErrPortUnreachable
+	case windows.WSAEHOSTUNREACH:
+		return ErrHostUnreachable
+	case windows.WSAENETUNREACH:
+		return ErrNetUnreachable
 	}
-	packet := (*ringPacket)(unsafe.Pointer(uintptr(results[0].RequestContext)))
-	ep := packet.addr
-	n := copy(buf, packet.data[:results[0].BytesTransferred])
-	return n, &ep, nil
+	return 0
+}
+
+func (bind *WinRingBind) SetEndpointErrorHandler(fn func(dst netip.AddrPort, err EndpointError)) {
+	bind.endpointErrors.set(fn)
 }
 
 func (bind *WinRingBind) receiveIPv4(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
 	bind.mu.RLock()
 	defer bind.mu.RUnlock()
-	n, ep, err := bind.v4.Receive(bufs[0], &bind.isOpen)
-	sizes[0] = n
-	eps[0] = ep
-	return 1, err
+	return bind.v4.Receive(bufs, sizes, eps, &bind.isOpen, &bind.endpointErrors)
 }
 
 func (bind *WinRingBind) receiveIPv6(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
 	bind.mu.RLock()
 	defer bind.mu.RUnlock()
-	n, ep, err := bind.v6.Receive(bufs[0], &bind.isOpen)
-	sizes[0] = n
-	eps[0] = ep
-	return 1, err
+	return bind.v6.Receive(bufs, sizes, eps, &bind.isOpen, &bind.endpointErrors)
 }
 
-func (bind *afWinRingBind) Send(buf []byte, nend *WinRingEndpoint, isOpen *atomic.Uint32) error {
+// Send queues bufs on the tx ring. Every send but the last is deferred, so the
+// kernel is entered once per batch rather than once per datagram.
+func (bind *afWinRingBind) Send(bufs [][]byte, nend *WinRingEndpoint, isOpen *atomic.Uint32) error {
 	if isOpen.Load() != 1 {
 		return net.ErrClosed
 	}
-	if len(buf) > bytesPerPacket {
-		return io.ErrShortBuffer
+	for _, buf := range bufs {
+		if len(buf) > bytesPerPacket {
+			return io.ErrShortBuffer
+		}
 	}
 	bind.tx.mu.Lock()
 	defer bind.tx.mu.Unlock()
 	var results [packetsPerRing]winrio.Result
-	count := winrio.DequeueCompletion(bind.tx.cq, results[:])
-	if count == 0 && bind.tx.isFull {
-		err := winrio.Notify(bind.tx.cq)
-		if err != nil {
-			return err
+	deferred := false
+	for i, buf := range bufs {
+		count := winrio.DequeueCompletion(bind.tx.cq, results[:])
+		if count == 0 && bind.tx.isFull {
+			if deferred {
+				// Commit what we have, or the ring will never drain.
+				if err := bind.commitSends(); err != nil {
+					return err
+				}
+				deferred = false
+			}
+			err := winrio.Notify(bind.tx.cq)
+			if err != nil {
+				return err
+			}
+			var bytes uint32
+			var key uintptr
+			var overlapped *windows.Overlapped
+			err = windows.GetQueuedCompletionStatus(bind.tx.iocp, &bytes, &key, &overlapped, windows.INFINITE)
+			if err != nil {
+				return err
+			}
+			if isOpen.Load() != 1 {
+				return net.ErrClosed
+			}
+			count = winrio.DequeueCompletion(bind.tx.cq, results[:])
+			if count == 0 {
+				return io.ErrNoProgress
+			}
 		}
-		var bytes uint32
-		var key uintptr
-		var overlapped *windows.Overlapped
-		err = windows.GetQueuedCompletionStatus(bind.tx.iocp, &bytes, &key, &overlapped, windows.INFINITE)
-		if err != nil {
-			return err
+		if count > 0 {
+			bind.tx.Return(count)
 		}
-		if isOpen.Load() != 1 {
-			return net.ErrClosed
+		packet := bind.tx.Push()
+		packet.addr = *nend
+		copy(packet.data[:], buf)
+		dataBuffer := &winrio.Buffer{
+			Id:     bind.tx.id,
+			Offset: uint32(uintptr(unsafe.Pointer(&packet.data[0])) - bind.tx.packets),
+			Length: uint32(len(buf)),
 		}
-		count = winrio.DequeueCompletion(bind.tx.cq, results[:])
-		if count == 0 {
-			return io.ErrNoProgress
+		addressBuffer := &winrio.Buffer{
+			Id:     bind.tx.id,
+			Offset: uint32(uintptr(unsafe.Pointer(&packet.addr)) - bind.tx.packets),
+			Length: uint32(unsafe.Sizeof(packet.addr)),
 		}
+		var flags uint32
+		if i < len(bufs)-1 {
+			flags = winrio.MsgDefer
+		}
+		bind.mu.Lock()
+		err := winrio.SendEx(bind.rq, dataBuffer, 1, nil, addressBuffer, nil, nil, flags, 0)
+		bind.mu.Unlock()
+		if err != nil {
+			if deferred {
+				bind.commitSends()
+			}
+			return err
+		}
+		deferred = flags != 0
 	}
-	if count > 0 {
-		bind.tx.Return(count)
-	}
-	packet := bind.tx.Push()
-	packet.addr = *nend
-	copy(packet.data[:], buf)
-	dataBuffer := &winrio.Buffer{
-		Id:     bind.tx.id,
-		Offset: uint32(uintptr(unsafe.Pointer(&packet.data[0])) - bind.tx.packets),
-		Length: uint32(len(buf)),
-	}
-	addressBuffer := &winrio.Buffer{
-		Id:     bind.tx.id,
-		Offset: uint32(uintptr(unsafe.Pointer(&packet.addr)) - bind.tx.packets),
-		Length: uint32(unsafe.Sizeof(packet.addr)),
-	}
+	return nil
+}
+
+func (bind *afWinRingBind) commitSends() error {
 	bind.mu.Lock()
 	defer bind.mu.Unlock()
-	return winrio.SendEx(bind.rq, dataBuffer, 1, nil, addressBuffer, nil, nil, 0, 0)
+	return winrio.SendEx(bind.rq, nil, 0, nil, nil, nil, nil, winrio.MsgCommitOnly, 0)
 }
 
 func (bind *WinRingBind) Send(bufs [][]byte, endpoint Endpoint) error {
@@ -493,23 +611,17 @@ func (bind *WinRingBind) Send(bufs [][]byte, endpoint Endpoint) error {
 	}
 	bind.mu.RLock()
 	defer bind.mu.RUnlock()
-	for _, buf := range bufs {
-		switch nend.family {
-		case windows.AF_INET:
-			if bind.v4.blackhole {
-				continue
-			}
-			if err := bind.v4.Send(buf, nend, &bind.isOpen); err != nil {
-				return err
-			}
-		case windows.AF_INET6:
-			if bind.v6.blackhole {
-				continue
-			}
-			if err := bind.v6.Send(buf, nend, &bind.isOpen); err != nil {
-				return err
-			}
+	switch nend.family {
+	case windows.AF_INET:
+		if bind.v4.blackhole {
+			return nil
+		}
+		return bind.v4.Send(bufs, nend, &bind.isOpen)
+	case windows.AF_INET6:
+		if bind.v6.blackhole {
+			return nil
 		}
+		return bind.v6.Send(bufs, nend, &bind.isOpen)
 	}
 	return nil
 }
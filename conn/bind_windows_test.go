@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// loopback opens bind on an ephemeral port and returns its IPv4 receive
+// function and an endpoint addressing the bind itself.
+func loopback(tb testing.TB, bind Bind) (ReceiveFunc, Endpoint) {
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { bind.Close() })
+	ep, err := bind.ParseEndpoint(fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fns[0], ep
+}
+
+func TestWinRingBindBatch(t *testing.T) {
+	bind := NewWinRingBind()
+	if _, ok := bind.(*WinRingBind); !ok {
+		t.Skip("registered I/O is unavailable")
+	}
+	recv, ep := loopback(t, bind)
+
+	out := make([][]byte, 32)
+	for i := range out {
+		out[i] = bytes.Repeat([]byte{byte(i)}, 100+i)
+	}
+	if err := bind.Send(out, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := make([][]byte, bind.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, 1500)
+	}
+	sizes := make([]int, len(bufs))
+	eps := make([]Endpoint, len(bufs))
+	received := 0
+	for received < len(out) {
+		n, err := recv(bufs, sizes, eps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if !bytes.Equal(bufs[i][:sizes[i]], out[received]) {
+				t.Fatalf("datagram %d corrupted or out of order", received)
+			}
+			if got := eps[i].DstToString(); got != ep.DstToString() {
+				t.Errorf("datagram %d source = %s, want %s", received, got, ep.DstToString())
+			}
+			received++
+		}
+	}
+}
+
+// benchmarkBindLoopback sends batches of 1200-byte datagrams from bind to
+// itself and reports how many arrive per second. Compare the results of
+// BenchmarkWinRingBind and BenchmarkStdNetBind to judge the batched ring
+// implementation against the per-datagram socket path.
+func benchmarkBindLoopback(b *testing.B, bind Bind) {
+	recv, ep := loopback(b, bind)
+	var received atomic.Uint64
+	go func() {
+		bufs := make([][]byte, bind.BatchSize())
+		for i := range bufs {
+			bufs[i] = make([]byte, 1500)
+		}
+		sizes := make([]int, len(bufs))
+		eps := make([]Endpoint, len(bufs))
+		for {
+			n, err := recv(bufs, sizes, eps)
+			if err != nil {
+				return
+			}
+			received.Add(uint64(n))
+		}
+	}()
+
+	out := make([][]byte, bind.BatchSize())
+	for i := range out {
+		out[i] = make([]byte, 1200)
+	}
+	b.SetBytes(int64(len(out) * 1200))
+	start := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := bind.Send(out, ep); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	want := uint64(b.N * len(out))
+	for deadline := time.Now().Add(time.Second); received.Load() < want && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	b.ReportMetric(float64(received.Load())/time.Since(start).Seconds(), "rx-pkts/s")
+}
+
+func BenchmarkWinRingBind(b *testing.B) {
+	bind := NewWinRingBind()
+	if _, ok := bind.(*WinRingBind); !ok {
+		b.Skip("registered I/O is unavailable")
+	}
+	benchmarkBindLoopback(b, bind)
+}
+
+func BenchmarkStdNetBind(b *testing.B) {
+	benchmarkBindLoopback(b, NewStdNetBind())
+}
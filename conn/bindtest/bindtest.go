@@ -130,7 +130,7 @@ func (c *ChannelBind) Send(bufs [][]byte, ep conn.Endpoint) error {
 func (c *ChannelBind) ParseEndpoint(s string) (conn.Endpoint, error) {
 	addr, err := netip.ParseAddrPort(s)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", conn.ErrInvalidEndpoint, err)
 	}
 	return ChannelEndpoint(addr.Port()), nil
 }
@@ -0,0 +1,206 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// linkQueueSize is the number of packets in flight in each direction of a
+// link. Packets sent while it is full are dropped, as a congested UDP path
+// would.
+const linkQueueSize = 1024
+
+// A LinkBind is one end of an in-memory point-to-point link between two
+// Binds, which can delay, drop and duplicate the packets sent through it.
+// Impairments are decided by a random source seeded when the link is
+// created, so that a test sending the same packets sees the same losses and
+// duplicates on every run.
+//
+// Every endpoint of a LinkBind denotes the other end of the link.
+type LinkBind struct {
+	port   uint16
+	remote LinkEndpoint
+	rx     chan linkPacket
+	tx     chan linkPacket
+
+	mu          sync.Mutex
+	rand        *rand.Rand
+	latency     time.Duration
+	loss        float64
+	duplication float64
+	closed      chan struct{}
+
+	stats LinkStats
+}
+
+// LinkStats counts the packets sent through one end of a link.
+type LinkStats struct {
+	Sent       uint64 // packets passed to Send
+	Dropped    uint64 // packets lost, or dropped because the link was full
+	Duplicated uint64 // packets delivered twice
+}
+
+type linkPacket struct {
+	data []byte
+	due  time.Time
+}
+
+// A LinkEndpoint is the endpoint of a LinkBind, which names the port of the
+// other end of the link.
+type LinkEndpoint uint16
+
+var (
+	_ conn.Bind     = (*LinkBind)(nil)
+	_ conn.Endpoint = LinkEndpoint(0)
+)
+
+// NewLink returns the two ends of a new link, whose impairments are decided
+// by random sources derived from seed. The link does not impair packets
+// until configured to.
+func NewLink(seed int64) (a, b *LinkBind) {
+	ab := make(chan linkPacket, linkQueueSize)
+	ba := make(chan linkPacket, linkQueueSize)
+	a = &LinkBind{port: 1, remote: 2, rx: ba, tx: ab, rand: rand.New(rand.NewSource(seed))}
+	b = &LinkBind{port: 2, remote: 1, rx: ab, tx: ba, rand: rand.New(rand.NewSource(seed + 1))}
+	return a, b
+}
+
+// SetLatency delays the packets sent from this end of the link by d.
+func (b *LinkBind) SetLatency(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latency = d
+}
+
+// SetLoss drops each packet sent from this end of the link with probability p.
+func (b *LinkBind) SetLoss(p float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.loss = p
+}
+
+// SetDuplication delivers each packet sent from this end of the link twice
+// with probability p.
+func (b *LinkBind) SetDuplication(p float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.duplication = p
+}
+
+// Stats returns the counts of packets sent from this end of the link.
+func (b *LinkBind) Stats() LinkStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+func (b *LinkBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	b.closed = make(chan struct{})
+	return []conn.ReceiveFunc{b.makeReceiveFunc(b.closed)}, b.port, nil
+}
+
+func (b *LinkBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	return nil
+}
+
+func (b *LinkBind) BatchSize() int { return 1 }
+
+func (b *LinkBind) SetMark(mark uint32) error { return nil }
+
+func (b *LinkBind) makeReceiveFunc(closed chan struct{}) conn.ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case p := <-b.rx:
+			if wait := time.Until(p.due); wait > 0 {
+				timer := time.NewTimer(wait)
+				defer timer.Stop()
+				select {
+				case <-closed:
+					return 0, net.ErrClosed
+				case <-timer.C:
+				}
+			}
+			sizes[0] = copy(bufs[0], p.data)
+			eps[0] = b.remote
+			return 1, nil
+		}
+	}
+}
+
+func (b *LinkBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	if _, ok := ep.(LinkEndpoint); !ok {
+		return conn.ErrWrongEndpointType
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed == nil {
+		return net.ErrClosed
+	}
+	due := time.Now().Add(b.latency)
+	for _, buf := range bufs {
+		b.stats.Sent++
+		if b.rand.Float64() < b.loss {
+			b.stats.Dropped++
+			continue
+		}
+		copies := 1
+		if b.rand.Float64() < b.duplication {
+			copies = 2
+			b.stats.Duplicated++
+		}
+		for i := 0; i < copies; i++ {
+			p := linkPacket{data: append([]byte(nil), buf...), due: due}
+			select {
+			case b.tx <- p:
+			default:
+				b.stats.Dropped++
+			}
+		}
+	}
+	return nil
+}
+
+// ParseEndpoint accepts any address and port, as there is only one place
+// to send packets to.
+func (b *LinkBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	if _, err := netip.ParseAddrPort(s); err != nil {
+		return nil, fmt.Errorf("%w: %w", conn.ErrInvalidEndpoint, err)
+	}
+	return b.remote, nil
+}
+
+func (e LinkEndpoint) ClearSrc() {}
+
+func (e LinkEndpoint) SrcToString() string { return "" }
+
+func (e LinkEndpoint) DstToString() string { return fmt.Sprintf("127.0.0.1:%d", uint16(e)) }
+
+func (e LinkEndpoint) DstToBytes() []byte { return []byte{byte(e)} }
+
+func (e LinkEndpoint) DstIP() netip.Addr { return netip.AddrFrom4([4]byte{127, 0, 0, 1}) }
+
+func (e LinkEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
@@ -7,12 +7,14 @@
 package conn
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
 	"reflect"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const (
@@ -29,7 +31,8 @@ type ReceiveFunc func(packets [][]byte, sizes []int, eps []Endpoint) (n int, err
 
 // A Bind listens on a port for both IPv6 and IPv4 UDP traffic.
 //
-// A Bind interface may also be a PeekLookAtSocketFd or BindSocketToInterface,
+// A Bind interface may also be a PeekLookAtSocketFd, BindSocketToInterface or
+// UDPGSOSetter or OffloadBind or FlowLabelBind or SourceBind or PunchBind,
 // depending on the platform-specific implementation.
 type Bind interface {
 	// Open puts the Bind into a listening state on a given port and reports the actual
@@ -64,6 +67,77 @@ type BindSocketToInterface interface {
 	BindSocketToInterface6(interfaceIndex uint32, blackhole bool) error
 }
 
+// UDPGSOSetter is implemented by Bind objects that can stop coalescing
+// outgoing datagrams with UDP generic segmentation offload.
+type UDPGSOSetter interface {
+	SetUDPGSO(enabled bool)
+}
+
+// OffloadBind is implemented by Bind objects that check UDP segmentation
+// offload with a probe when opened, and stop using offloads for their
+// lifetime when the probe fails, or when told to.
+type OffloadBind interface {
+	// DisableOffloads stops coalescing outgoing datagrams at once, and
+	// receiving coalesced datagrams from the next Open.
+	DisableOffloads()
+
+	// OffloadsDisabled reports whether offloads were disabled, and if by
+	// a failed probe, its error.
+	OffloadsDisabled() (bool, error)
+}
+
+// FlowLabelBind is implemented by Bind objects that can set the IPv6 flow
+// label of the datagrams they send, so that routers balancing traffic across
+// equal-cost paths by flow label keep each peer's traffic on one path.
+type FlowLabelBind interface {
+	// SetFlowLabelPolicy selects how the senders of datagrams choose flow
+	// labels, returning an error if the Bind cannot set them.
+	SetFlowLabelPolicy(policy FlowLabelPolicy) error
+	FlowLabelPolicy() FlowLabelPolicy
+
+	// SendFlowLabel is Send, labeling datagrams sent over IPv6 with the
+	// 20-bit flow label label. A label of zero is left to the kernel.
+	SendFlowLabel(bufs [][]byte, ep Endpoint, label uint32) error
+}
+
+// SourceBind is implemented by Bind objects that can send datagrams from a
+// chosen local address, so that the traffic of different peers leaves
+// through different uplinks.
+type SourceBind interface {
+	// SendFrom is Send from a socket bound to the local address src, which
+	// the Bind opens on first use and receives on until it is closed. It
+	// returns an error wrapping ErrSourceUnavailable if src cannot be bound
+	// or has stopped working, such as when its link went down.
+	SendFrom(bufs [][]byte, ep Endpoint, src netip.Addr) error
+}
+
+// PunchBind is implemented by Bind objects that can open a path to a peer
+// behind a NAT, even a symmetric one, by sending bursts of probes from many
+// local ports while the peer does the same.
+type PunchBind interface {
+	// Punch sends bursts of probes to the targets the application's
+	// signaling reads from targets until a datagram from the target
+	// arrives, and returns the path it arrived over, or ctx's error.
+	Punch(ctx context.Context, targets <-chan PunchTarget, opts PunchOptions) (PunchResult, error)
+
+	// Unpunch closes the punched socket ep sends from, if any, such as
+	// when the peer it was punched to is removed. Datagrams to endpoints
+	// over it leave from the Bind's own sockets from then on.
+	Unpunch(ep Endpoint)
+}
+
+// KeepaliveOffloader is implemented by Bind objects that can have the
+// platform send periodic keepalives, such as the modem of a phone through
+// Android's socket keepalives, letting the CPU sleep meanwhile.
+type KeepaliveOffloader interface {
+	// OffloadKeepalive has the platform send payload to ep every interval,
+	// until cancel is called or the Bind is closed. It returns an error if
+	// the platform cannot, such as for this endpoint or interval, in which
+	// case the caller sends keepalives itself. Calling cancel after the
+	// Bind was closed does nothing.
+	OffloadKeepalive(ep Endpoint, payload []byte, interval time.Duration) (cancel func(), err error)
+}
+
 // PeekLookAtSocketFd is implemented by Bind objects that support having their
 // file descriptor peeked at. Used by wireguard-android.
 type PeekLookAtSocketFd interface {
@@ -87,6 +161,14 @@ type Endpoint interface {
 var (
 	ErrBindAlreadyOpen   = errors.New("bind is already open")
 	ErrWrongEndpointType = errors.New("endpoint type does not correspond with bind type")
+
+	// ErrInvalidEndpoint is wrapped by the errors ParseEndpoint returns for
+	// strings that do not denote an endpoint.
+	ErrInvalidEndpoint = errors.New("invalid endpoint")
+
+	// ErrSourceUnavailable is wrapped by the errors SourceBind.SendFrom
+	// returns when it cannot send from the requested local address.
+	ErrSourceUnavailable = errors.New("source address unavailable")
 )
 
 func (fn ReceiveFunc) PrettyName() string {
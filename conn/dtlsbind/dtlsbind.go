@@ -0,0 +1,836 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package dtlsbind implements a conn.Bind that carries WireGuard messages
+// over DTLS 1.2 sessions, for networks that pass nothing but DTLS, such as
+// some SD-WAN middleboxes. It is a module of its own, so that only programs
+// using it depend on its DTLS implementation.
+package dtlsbind
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/protocol"
+	"github.com/pion/dtls/v3/pkg/protocol/handshake"
+	"github.com/pion/dtls/v3/pkg/protocol/recordlayer"
+)
+
+const (
+	// DefaultHandshakeTimeout is how long a Bind waits for a DTLS handshake
+	// to complete if Config.HandshakeTimeout is zero.
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// MaxPendingHandshakes is the number of handshakes with new clients a
+	// listening Bind runs at once. Further clients are ignored, and retry,
+	// until some complete or time out.
+	MaxPendingHandshakes = 256
+
+	// reconnectTimeout is how long a client keeps sending over a session
+	// without hearing back before it starts a new one, in case the listener
+	// lost the session, for instance because it restarted.
+	reconnectTimeout = 15 * time.Second
+
+	// queueSize is the number of packets a session holds while its
+	// handshake is in progress. Older ones are dropped.
+	queueSize = 16
+
+	// inboundQueueSize is the number of datagrams waiting to be processed
+	// by a session. Further ones are dropped.
+	inboundQueueSize = 64
+
+	// cookieLifetime is how long the cookies of a listener's
+	// HelloVerifyRequests are accepted for, at least.
+	cookieLifetime = time.Minute
+)
+
+// ErrNoSession is returned by Bind.Send in listening mode for an endpoint
+// that has no DTLS session with the bind.
+var ErrNoSession = errors.New("no DTLS session with endpoint")
+
+// Config configures a Bind. Exactly one of PSK and Certificates must be set
+// in listening mode, and at most one in client mode.
+type Config struct {
+	// Listen makes the bind accept the DTLS sessions of clients, and send
+	// only over those, instead of establishing sessions itself.
+	Listen bool
+
+	// PSK, if set, is a pre-shared key both ends of a session authenticate
+	// with, and PSKIdentity identifies it.
+	PSK         []byte
+	PSKIdentity []byte
+
+	// Certificates are the certificates presented to the other end of a
+	// session, as in tls.Config. A listener requires one unless PSK is set.
+	Certificates []tls.Certificate
+
+	// RootCAs verify the certificate of the listener, and ServerName its
+	// host name. If RootCAs is nil, the system roots are used.
+	RootCAs    *x509.CertPool
+	ServerName string
+
+	// ClientCAs, if set, makes a listener require a certificate from each
+	// client, which they verify.
+	ClientCAs *x509.CertPool
+
+	// HandshakeTimeout bounds each handshake. If zero,
+	// DefaultHandshakeTimeout is used.
+	HandshakeTimeout time.Duration
+
+	// RetransmitInterval is how long a handshake waits before resending
+	// unacknowledged messages, doubling after each attempt. If zero, it is
+	// one second.
+	RetransmitInterval time.Duration
+
+	// ListenPacket, if set, opens the socket of the bind instead of
+	// net.ListenPacket, which is called with network "udp" and address
+	// ":port".
+	ListenPacket func(network, address string) (net.PacketConn, error)
+}
+
+// An Endpoint addresses the other end of a DTLS session of a Bind by its
+// UDP address.
+type Endpoint struct {
+	AddrPort netip.AddrPort
+}
+
+var _ conn.Endpoint = (*Endpoint)(nil)
+
+func (*Endpoint) ClearSrc() {}
+
+func (*Endpoint) SrcToString() string { return "" }
+
+func (e *Endpoint) DstToString() string { return e.AddrPort.String() }
+
+func (e *Endpoint) DstToBytes() []byte {
+	b, _ := e.AddrPort.MarshalBinary()
+	return b
+}
+
+func (e *Endpoint) DstIP() netip.Addr { return e.AddrPort.Addr() }
+
+func (*Endpoint) SrcIP() netip.Addr { return netip.Addr{} }
+
+// Bind is a conn.Bind that carries WireGuard messages over DTLS 1.2
+// sessions. The messages stay encrypted by WireGuard; DTLS only makes the
+// traffic look, and be, what networks passing nothing else expect.
+//
+// In client mode, the bind establishes a session with each endpoint it
+// sends to, holding the first packets until the handshake completes. A
+// session that fails, or is not heard from for a while, is replaced by a
+// new one. In listening mode, it accepts sessions from clients, and sends
+// only to endpoints it has a session with, so that two devices using a
+// Bind each, one of them listening, can reach each other.
+//
+// A listener answers the ClientHello of a client with a HelloVerifyRequest
+// carrying a cookie it derives from the client's address and a secret, and
+// keeps no state for the client until it returns the cookie, proving that
+// it can receive at its address. Clients start their session anew with the
+// cookie, so that the listener's DTLS handshake begins with it. Datagrams
+// from unknown addresses that do not start a handshake are ignored, and at
+// most MaxPendingHandshakes handshakes are in progress at once. A client
+// that restarts from the same address gets a new session, which replaces
+// the old one once its handshake completes.
+type Bind struct {
+	cfg    Config
+	dtls   *dtls.Config
+	secret [32]byte // keys the cookies of a listener
+
+	mu      sync.Mutex
+	mark    uint32
+	sock    *socket
+	peers   map[netip.AddrPort]*peer
+	pending int // handshakes with clients in progress
+
+	wg sync.WaitGroup
+}
+
+var _ conn.Bind = (*Bind)(nil)
+
+// socket is the socket of an open Bind, with the datagrams its sessions
+// received.
+type socket struct {
+	pc   net.PacketConn
+	recv chan datagram
+
+	once sync.Once
+	done chan struct{} // closed once the socket is closed
+	err  error         // why done was closed
+}
+
+func (s *socket) shutdown(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		s.pc.Close()
+	})
+}
+
+type datagram struct {
+	data []byte
+	ep   *Endpoint
+}
+
+// peer holds the session with an address, and in listening mode a new
+// session the client at the address is establishing, if any.
+type peer struct {
+	cur  *session
+	next *session
+}
+
+// New returns a Bind configured by cfg.
+func New(cfg Config) (*Bind, error) {
+	config := &dtls.Config{
+		FlightInterval:       cfg.RetransmitInterval,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		// The bind checks the cookies of clients before any handshake
+		// starts, see routeLocked.
+		InsecureSkipVerifyHello: cfg.Listen,
+	}
+	switch {
+	case cfg.PSK != nil && cfg.Certificates != nil:
+		return nil, errors.New("DTLS bind configured with both a PSK and certificates")
+	case cfg.PSK != nil:
+		psk := cfg.PSK
+		config.PSK = func([]byte) ([]byte, error) { return psk, nil }
+		config.CipherSuites = []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256}
+		config.PSKIdentityHint = cfg.PSKIdentity
+		if config.PSKIdentityHint == nil {
+			config.PSKIdentityHint = []byte{}
+		}
+	case cfg.Listen && len(cfg.Certificates) == 0:
+		return nil, errors.New("listening DTLS bind configured with neither a PSK nor certificates")
+	default:
+		config.Certificates = cfg.Certificates
+		config.RootCAs = cfg.RootCAs
+		config.ServerName = cfg.ServerName
+		if cfg.ClientCAs != nil {
+			config.ClientCAs = cfg.ClientCAs
+			config.ClientAuth = dtls.RequireAndVerifyClientCert
+		}
+	}
+	if cfg.HandshakeTimeout <= 0 {
+		cfg.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if cfg.ListenPacket == nil {
+		cfg.ListenPacket = net.ListenPacket
+	}
+	b := &Bind{cfg: cfg, dtls: config}
+	if _, err := rand.Read(b.secret[:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Open opens the UDP socket of the bind on port, or on a random port if
+// port is zero.
+func (b *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sock != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	pc, err := b.cfg.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, 0, err
+	}
+	if b.mark != 0 {
+		if c, ok := pc.(syscall.Conn); ok {
+			if err := setMark(c, b.mark); err != nil {
+				pc.Close()
+				return nil, 0, err
+			}
+		}
+	}
+	if addr, err := netip.ParseAddrPort(pc.LocalAddr().String()); err == nil {
+		port = addr.Port()
+	}
+
+	sock := &socket{
+		pc:   pc,
+		recv: make(chan datagram, inboundQueueSize),
+		done: make(chan struct{}),
+	}
+	b.sock = sock
+	b.peers = make(map[netip.AddrPort]*peer)
+	b.pending = 0
+	b.wg.Add(1)
+	go b.demux(sock)
+	return []conn.ReceiveFunc{b.makeReceive(sock)}, port, nil
+}
+
+func (b *Bind) makeReceive(sock *socket) conn.ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+		select {
+		case d := <-sock.recv:
+			sizes[0] = copy(bufs[0], d.data)
+			eps[0] = d.ep
+			return 1, nil
+		case <-sock.done:
+			return 0, sock.err
+		}
+	}
+}
+
+// demux hands the datagrams received on the socket to the sessions with
+// their senders, accepting new sessions in listening mode.
+func (b *Bind) demux(sock *socket) {
+	defer b.wg.Done()
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := sock.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = net.ErrClosed
+			}
+			sock.shutdown(err)
+			return
+		}
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			continue
+		}
+		ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+		b.mu.Lock()
+		s := b.routeLocked(sock, ap, buf[:n])
+		b.mu.Unlock()
+		if s == nil {
+			continue
+		}
+		select {
+		case s.in <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+const (
+	recordHeaderSize = 13
+	handshakeOffset  = recordHeaderSize
+)
+
+// epoch returns the epoch of the first record of datagram, which is zero
+// for unencrypted handshake messages.
+func epoch(datagram []byte) uint16 {
+	if len(datagram) < recordHeaderSize {
+		return 0
+	}
+	return binary.BigEndian.Uint16(datagram[3:])
+}
+
+// isHandshake reports whether datagram starts with an unencrypted handshake
+// message of type typ.
+func isHandshake(datagram []byte, typ handshake.Type) bool {
+	return len(datagram) > handshakeOffset &&
+		protocol.ContentType(datagram[0]) == protocol.ContentTypeHandshake &&
+		epoch(datagram) == 0 &&
+		handshake.Type(datagram[handshakeOffset]) == typ
+}
+
+// parseHandshake returns the unencrypted handshake message that datagram
+// starts with, if it is whole, and the header of its record.
+func parseHandshake(datagram []byte) (*handshake.Handshake, *recordlayer.Header, bool) {
+	records, err := recordlayer.UnpackDatagram(datagram)
+	if err != nil || len(records) == 0 {
+		return nil, nil, false
+	}
+	var record recordlayer.RecordLayer
+	if err := record.Unmarshal(records[0]); err != nil || record.Header.Epoch != 0 {
+		return nil, nil, false
+	}
+	h, ok := record.Content.(*handshake.Handshake)
+	return h, &record.Header, ok
+}
+
+// cookie returns the cookie a client at addr is given at time t.
+func (b *Bind) cookie(addr netip.AddrPort, t time.Time) []byte {
+	mac := hmac.New(sha256.New, b.secret[:])
+	binary.Write(mac, binary.BigEndian, t.Unix()/int64(cookieLifetime/time.Second))
+	a, _ := addr.MarshalBinary()
+	mac.Write(a)
+	return mac.Sum(nil)
+}
+
+// verifyHello reports whether hello, a ClientHello from addr, carries a
+// valid cookie. If not, it answers with a HelloVerifyRequest carrying one,
+// keeping no state. Cookies are valid for the current and the previous
+// cookieLifetime.
+func (b *Bind) verifyHello(sock *socket, addr netip.AddrPort, hello []byte) bool {
+	h, header, ok := parseHandshake(hello)
+	if !ok {
+		return false
+	}
+	msg, ok := h.Message.(*handshake.MessageClientHello)
+	if !ok || h.Header.MessageSequence != 0 {
+		return false
+	}
+	now := time.Now()
+	if len(msg.Cookie) != 0 {
+		if hmac.Equal(msg.Cookie, b.cookie(addr, now)) || hmac.Equal(msg.Cookie, b.cookie(addr, now.Add(-cookieLifetime))) {
+			return true
+		}
+	}
+	reply := recordlayer.RecordLayer{
+		Header: recordlayer.Header{
+			Version:        protocol.Version1_2,
+			SequenceNumber: header.SequenceNumber,
+		},
+		Content: &handshake.Handshake{
+			Message: &handshake.MessageHelloVerifyRequest{
+				Version: protocol.Version1_2,
+				Cookie:  b.cookie(addr, now),
+			},
+		},
+	}
+	if packet, err := reply.Marshal(); err == nil {
+		sock.pc.WriteTo(packet, net.UDPAddrFromAddrPort(addr))
+	}
+	return false
+}
+
+// routeLocked returns the session a datagram from addr is for, if any.
+func (b *Bind) routeLocked(sock *socket, addr netip.AddrPort, datagram []byte) *session {
+	if b.sock != sock {
+		return nil
+	}
+	p := b.peers[addr]
+	if !b.cfg.Listen {
+		if p != nil && isHandshake(datagram, handshake.TypeHelloVerifyRequest) {
+			b.restartLocked(sock, p, datagram)
+			return nil
+		}
+		if p == nil {
+			return nil
+		}
+		return p.cur
+	}
+	hello := isHandshake(datagram, handshake.TypeClientHello)
+	switch {
+	case p == nil:
+		if !hello || !b.verifyHello(sock, addr, datagram) {
+			return nil
+		}
+		s := b.acceptLocked(sock, addr)
+		if s != nil {
+			b.peers[addr] = &peer{cur: s}
+		}
+		return s
+	case p.next != nil && epoch(datagram) == 0:
+		return p.next
+	case hello && p.cur.established.Load():
+		// The client restarted, or lost its session.
+		if !b.verifyHello(sock, addr, datagram) {
+			return nil
+		}
+		p.next = b.acceptLocked(sock, addr)
+		return p.next
+	}
+	return p.cur
+}
+
+// restartLocked starts the handshake of the client session with p anew,
+// with the cookie of the HelloVerifyRequest the listener answered it with,
+// unless it started with that cookie already or was established.
+func (b *Bind) restartLocked(sock *socket, p *peer, verify []byte) {
+	old := p.cur
+	if old.established.Load() {
+		return
+	}
+	h, _, ok := parseHandshake(verify)
+	if !ok {
+		return
+	}
+	msg, ok := h.Message.(*handshake.MessageHelloVerifyRequest)
+	if !ok || bytes.Equal(msg.Cookie, old.cookie) {
+		return
+	}
+	s, err := b.dialLocked(sock, old.addr, msg.Cookie)
+	if err != nil {
+		return
+	}
+	old.mu.Lock()
+	s.queue, old.queue = old.queue, nil
+	old.mu.Unlock()
+	p.cur = s
+	old.close()
+}
+
+func (b *Bind) acceptLocked(sock *socket, addr netip.AddrPort) *session {
+	if b.pending >= MaxPendingHandshakes {
+		return nil
+	}
+	s := newSession(sock, addr, nil)
+	conn, err := dtls.Server(s, s.raddr, b.dtls)
+	if err != nil {
+		return nil
+	}
+	s.conn = conn
+	s.pending = true
+	b.pending++
+	b.wg.Add(1)
+	go b.run(s)
+	return s
+}
+
+// dialLocked starts a client session with addr, whose ClientHello carries
+// cookie, if any.
+func (b *Bind) dialLocked(sock *socket, addr netip.AddrPort, cookie []byte) (*session, error) {
+	s := newSession(sock, addr, cookie)
+	config := b.dtls
+	if cookie != nil {
+		c := *b.dtls
+		c.ClientHelloMessageHook = func(hello handshake.MessageClientHello) handshake.Message {
+			hello.Cookie = cookie
+			return &hello
+		}
+		config = &c
+	}
+	conn, err := dtls.Client(s, s.raddr, config)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	b.wg.Add(1)
+	go b.run(s)
+	return s, nil
+}
+
+// run performs the handshake of s, then passes on what it receives until
+// the session ends.
+func (b *Bind) run(s *session) {
+	defer b.wg.Done()
+	defer b.remove(s)
+	defer s.conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.cfg.HandshakeTimeout)
+	err := s.conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+	b.established(s)
+
+	ep := &Endpoint{AddrPort: s.addr}
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.unanswered = time.Time{}
+		s.mu.Unlock()
+		select {
+		case s.sock.recv <- datagram{append([]byte(nil), buf[:n]...), ep}:
+		case <-s.sock.done:
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// established makes s the session with its address once its handshake
+// completed, and sends the packets queued meanwhile.
+func (b *Bind) established(s *session) {
+	b.mu.Lock()
+	if s.pending {
+		s.pending = false
+		b.pending--
+	}
+	var old *session
+	if p := b.peers[s.addr]; p != nil && p.next == s {
+		old, p.cur, p.next = p.cur, s, nil
+	}
+	b.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+
+	s.mu.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.established.Store(true)
+	s.mu.Unlock()
+	for _, packet := range queue {
+		if _, err := s.conn.Write(packet); err != nil {
+			return
+		}
+	}
+}
+
+// remove forgets s once it ended.
+func (b *Bind) remove(s *session) {
+	s.close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.pending {
+		s.pending = false
+		b.pending--
+	}
+	p := b.peers[s.addr]
+	if p == nil {
+		return
+	}
+	switch s {
+	case p.next:
+		p.next = nil
+	case p.cur:
+		p.cur, p.next = p.next, nil
+		if p.cur == nil {
+			delete(b.peers, s.addr)
+		}
+	}
+}
+
+func (b *Bind) Close() error {
+	b.mu.Lock()
+	sock := b.sock
+	b.sock = nil
+	var sessions []*session
+	for _, p := range b.peers {
+		sessions = append(sessions, p.cur)
+		if p.next != nil {
+			sessions = append(sessions, p.next)
+		}
+	}
+	b.peers = nil
+	b.mu.Unlock()
+	if sock == nil {
+		return nil
+	}
+	for _, s := range sessions {
+		s.close()
+	}
+	sock.shutdown(net.ErrClosed)
+	b.wg.Wait()
+	return nil
+}
+
+func (b *Bind) SetMark(mark uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mark = mark
+	if b.sock == nil {
+		return nil
+	}
+	if c, ok := b.sock.pc.(syscall.Conn); ok {
+		return setMark(c, mark)
+	}
+	return nil
+}
+
+// Send sends bufs over the session with endpoint, which in client mode it
+// establishes if there is none.
+func (b *Bind) Send(bufs [][]byte, endpoint conn.Endpoint) error {
+	ep, ok := endpoint.(*Endpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	b.mu.Lock()
+	if b.sock == nil {
+		b.mu.Unlock()
+		return net.ErrClosed
+	}
+	p := b.peers[ep.AddrPort]
+	var s *session
+	if p != nil {
+		s = p.cur
+	}
+	if s != nil && !b.cfg.Listen && s.stale() {
+		s.close()
+		s = nil
+	}
+	if s == nil {
+		if b.cfg.Listen {
+			b.mu.Unlock()
+			return ErrNoSession
+		}
+		var err error
+		s, err = b.dialLocked(b.sock, ep.AddrPort, nil)
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		if p == nil {
+			b.peers[ep.AddrPort] = &peer{cur: s}
+		} else {
+			p.cur = s
+		}
+	}
+	b.mu.Unlock()
+	return s.send(bufs)
+}
+
+func (b *Bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", conn.ErrInvalidEndpoint, err)
+	}
+	return &Endpoint{AddrPort: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}, nil
+}
+
+func (b *Bind) BatchSize() int { return 1 }
+
+// session is a DTLS session of a Bind with an address. It is also the
+// net.PacketConn the session runs over, which receives the datagrams of the
+// address, as passed on by Bind.demux, and sends through the socket of the
+// bind.
+type session struct {
+	sock   *socket
+	addr   netip.AddrPort
+	raddr  *net.UDPAddr
+	cookie []byte // the ClientHello of a client session carries
+	in     chan []byte
+	conn   *dtls.Conn
+
+	pending     bool // counted in Bind.pending, guarded by its mu
+	established atomic.Bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu           sync.Mutex
+	queue        [][]byte  // packets sent before the handshake completed
+	unanswered   time.Time // of the first packet sent since the last one received
+	deadline     time.Time
+	deadlineWake chan struct{}
+}
+
+var _ net.PacketConn = (*session)(nil)
+
+func newSession(sock *socket, addr netip.AddrPort, cookie []byte) *session {
+	return &session{
+		sock:         sock,
+		addr:         addr,
+		raddr:        net.UDPAddrFromAddrPort(addr),
+		cookie:       cookie,
+		in:           make(chan []byte, inboundQueueSize),
+		closed:       make(chan struct{}),
+		deadlineWake: make(chan struct{}),
+	}
+}
+
+func (s *session) send(bufs [][]byte) error {
+	s.mu.Lock()
+	if !s.established.Load() {
+		for _, buf := range bufs {
+			if len(s.queue) == queueSize {
+				s.queue = s.queue[1:]
+			}
+			s.queue = append(s.queue, append([]byte(nil), buf...))
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	if s.unanswered.IsZero() {
+		s.unanswered = time.Now()
+	}
+	s.mu.Unlock()
+	for _, buf := range bufs {
+		if _, err := s.conn.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stale reports whether nothing was received over the session for
+// reconnectTimeout while sending over it.
+func (s *session) stale() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.unanswered.IsZero() && time.Since(s.unanswered) > reconnectTimeout
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+func (s *session) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		s.mu.Lock()
+		deadline, wake := s.deadline, s.deadlineWake
+		s.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+		n, err := 0, error(nil)
+		select {
+		case datagram := <-s.in:
+			n = copy(p, datagram)
+		case <-s.closed:
+			err = net.ErrClosed
+		case <-s.sock.done:
+			err = net.ErrClosed
+		case <-expired:
+			err = os.ErrDeadlineExceeded
+		case <-wake:
+			err = errDeadlineChanged
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != errDeadlineChanged {
+			return n, s.raddr, err
+		}
+	}
+}
+
+// errDeadlineChanged wakes session.ReadFrom to wait for a new deadline.
+var errDeadlineChanged = errors.New("deadline changed")
+
+func (s *session) WriteTo(p []byte, _ net.Addr) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return s.sock.pc.WriteTo(p, s.raddr)
+}
+
+func (s *session) Close() error {
+	s.close()
+	return nil
+}
+
+func (s *session) LocalAddr() net.Addr { return s.sock.pc.LocalAddr() }
+
+func (s *session) SetDeadline(t time.Time) error { return s.SetReadDeadline(t) }
+
+func (s *session) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadline = t
+	close(s.deadlineWake)
+	s.deadlineWake = make(chan struct{})
+	return nil
+}
+
+func (s *session) SetWriteDeadline(time.Time) error { return nil }
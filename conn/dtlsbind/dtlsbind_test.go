@@ -0,0 +1,351 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package dtlsbind
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/protocol"
+	"github.com/pion/dtls/v3/pkg/protocol/handshake"
+	"github.com/pion/dtls/v3/pkg/protocol/recordlayer"
+)
+
+// lossyNet is an in-memory network of packet conns that drops a share of
+// the datagrams sent over it, and records the others.
+type lossyNet struct {
+	mu    sync.Mutex
+	loss  float64
+	rand  *mathrand.Rand
+	conns map[netip.AddrPort]*lossyConn
+	wire  [][]byte
+}
+
+func newLossyNet(loss float64) *lossyNet {
+	return &lossyNet{
+		loss:  loss,
+		rand:  mathrand.New(mathrand.NewSource(1)),
+		conns: make(map[netip.AddrPort]*lossyConn),
+	}
+}
+
+// listenPacket returns a Config.ListenPacket opening conns at ip.
+func (n *lossyNet) listenPacket(ip string) func(network, address string) (net.PacketConn, error) {
+	return func(network, address string) (net.PacketConn, error) {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddrPort(net.JoinHostPort(ip, port))
+		if err != nil {
+			return nil, err
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.conns[addr] != nil {
+			return nil, errors.New("address in use")
+		}
+		c := &lossyConn{net: n, addr: addr, in: make(chan lossyDatagram, 128), closed: make(chan struct{})}
+		n.conns[addr] = c
+		return c, nil
+	}
+}
+
+func (n *lossyNet) send(from, to netip.AddrPort, b []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.rand.Float64() < n.loss {
+		return
+	}
+	n.wire = append(n.wire, append([]byte(nil), b...))
+	if c := n.conns[to]; c != nil {
+		select {
+		case c.in <- lossyDatagram{append([]byte(nil), b...), from}:
+		default:
+		}
+	}
+}
+
+type lossyDatagram struct {
+	data []byte
+	from netip.AddrPort
+}
+
+type lossyConn struct {
+	net    *lossyNet
+	addr   netip.AddrPort
+	in     chan lossyDatagram
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *lossyConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case d := <-c.in:
+		return copy(p, d.data), net.UDPAddrFromAddrPort(d.from), nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *lossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	to, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	c.net.send(c.addr, to, p)
+	return len(p), nil
+}
+
+func (c *lossyConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.net.mu.Lock()
+		delete(c.net.conns, c.addr)
+		c.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *lossyConn) LocalAddr() net.Addr                { return net.UDPAddrFromAddrPort(c.addr) }
+func (c *lossyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *lossyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *lossyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func testCertificate(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// testBind is an open Bind with the packets it receives.
+type testBind struct {
+	*Bind
+	recv chan datagram
+}
+
+func openTestBind(t *testing.T, cfg Config, lossy *lossyNet, ip string, port uint16) *testBind {
+	cfg.RetransmitInterval = 50 * time.Millisecond
+	cfg.ListenPacket = lossy.listenPacket(ip)
+	bind, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns, _, err := bind.Open(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBind{bind, make(chan datagram, 128)}
+	go func() {
+		bufs, sizes, eps := [][]byte{make([]byte, 1500)}, []int{0}, []conn.Endpoint{nil}
+		for {
+			if _, err := fns[0](bufs, sizes, eps); err != nil {
+				return
+			}
+			b.recv <- datagram{append([]byte(nil), bufs[0][:sizes[0]]...), eps[0].(*Endpoint)}
+		}
+	}()
+	t.Cleanup(func() { bind.Close() })
+	return b
+}
+
+// exchange sends packets from one bind to ep until the other receives one,
+// returning the endpoint it was received from.
+func exchange(t *testing.T, from *testBind, ep conn.Endpoint, to *testBind) *Endpoint {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		payload := []byte(fmt.Sprintf("wireguard message %d", i))
+		if err := from.Send([][]byte{payload}, ep); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case d := <-to.recv:
+			if !bytes.HasPrefix(d.data, []byte("wireguard message ")) {
+				t.Fatalf("received %q", d.data)
+			}
+			return d.ep
+		case <-ticker.C:
+		case <-timeout:
+			t.Fatal("no packet received")
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	cert, roots := testCertificate(t, "server.test")
+	psk := []byte("0123456789abcdef0123456789abcdef")
+	for _, tt := range []struct {
+		name           string
+		server, client Config
+	}{
+		{"psk", Config{Listen: true, PSK: psk, PSKIdentity: []byte("wg")}, Config{PSK: psk, PSKIdentity: []byte("wg")}},
+		{"certificate", Config{Listen: true, Certificates: []tls.Certificate{cert}}, Config{RootCAs: roots, ServerName: "server.test"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lossy := newLossyNet(0.2)
+			server := openTestBind(t, tt.server, lossy, "192.0.2.1", 51820)
+			client := openTestBind(t, tt.client, lossy, "192.0.2.2", 0)
+			serverEP, err := client.ParseEndpoint("192.0.2.1:51820")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clientEP := exchange(t, client, serverEP, server)
+			if clientEP.AddrPort.Addr() != netip.MustParseAddr("192.0.2.2") {
+				t.Errorf("server received from %v", clientEP)
+			}
+			if got := exchange(t, server, clientEP, client); got.AddrPort != netip.MustParseAddrPort("192.0.2.1:51820") {
+				t.Errorf("client received from %v", got)
+			}
+			if err := server.Send([][]byte{[]byte("x")}, &Endpoint{netip.MustParseAddrPort("192.0.2.3:1")}); !errors.Is(err, ErrNoSession) {
+				t.Errorf("sending to an endpoint without a session: %v", err)
+			}
+
+			// A client restarting from the same address replaces its session.
+			client.Close()
+			client = openTestBind(t, tt.client, lossy, "192.0.2.2", clientEP.AddrPort.Port())
+			exchange(t, client, serverEP, server)
+			exchange(t, server, clientEP, client)
+
+			// Everything on the wire is DTLS, and the messages are encrypted.
+			lossy.mu.Lock()
+			defer lossy.mu.Unlock()
+			for _, datagram := range lossy.wire {
+				if len(datagram) < recordHeaderSize || datagram[0] < 20 || datagram[0] > 25 || datagram[1] != 0xfe {
+					t.Fatalf("datagram %x is not a DTLS record", datagram)
+				}
+				if bytes.Contains(datagram, []byte("wireguard message")) {
+					t.Fatalf("datagram %x carries a message in the clear", datagram)
+				}
+			}
+		})
+	}
+}
+
+// clientHello returns a datagram with a ClientHello carrying cookie.
+func clientHello(t *testing.T, cookie []byte) []byte {
+	record := recordlayer.RecordLayer{
+		Header: recordlayer.Header{Version: protocol.Version1_2},
+		Content: &handshake.Handshake{
+			Message: &handshake.MessageClientHello{
+				Version:            protocol.Version1_2,
+				Cookie:             cookie,
+				CipherSuiteIDs:     []uint16{uint16(dtls.TLS_PSK_WITH_AES_128_GCM_SHA256)},
+				CompressionMethods: []*protocol.CompressionMethod{{}},
+			},
+		},
+	}
+	datagram, err := record.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return datagram
+}
+
+func TestBindStatelessCookie(t *testing.T) {
+	psk := []byte("0123456789abcdef0123456789abcdef")
+	lossy := newLossyNet(0)
+	server := openTestBind(t, Config{Listen: true, PSK: psk}, lossy, "192.0.2.1", 51820)
+	serverAddr := netip.MustParseAddrPort("192.0.2.1:51820")
+
+	// ClientHellos from more spoofed addresses than there are handshake
+	// slots are answered, and leave nothing behind.
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; i < 2*MaxPendingHandshakes; i++ {
+		from := netip.AddrPortFrom(netip.AddrFrom4([4]byte{198, 51, 100 + byte(i>>8), byte(i)}), 1000)
+		lossy.send(from, serverAddr, clientHello(t, nil))
+		lossy.send(from, serverAddr, clientHello(t, []byte("forged cookie")))
+		for {
+			lossy.mu.Lock()
+			answered := len(lossy.wire) == 4*(i+1)
+			lossy.mu.Unlock()
+			if answered {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("ClientHellos not answered")
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+	server.mu.Lock()
+	peers, pending := len(server.peers), server.pending
+	server.mu.Unlock()
+	if peers != 0 || pending != 0 {
+		t.Errorf("%d sessions and %d handshakes for clients without cookies", peers, pending)
+	}
+	lossy.mu.Lock()
+	for _, datagram := range lossy.wire {
+		if h, _, ok := parseHandshake(datagram); ok && h.Message.Type() == handshake.TypeHelloVerifyRequest {
+			continue
+		}
+		if !isHandshake(datagram, handshake.TypeClientHello) {
+			t.Errorf("datagram %x is not a HelloVerifyRequest", datagram)
+			break
+		}
+	}
+	lossy.mu.Unlock()
+
+	// A client returning its cookie still gets a session.
+	client := openTestBind(t, Config{PSK: psk}, lossy, "192.0.2.2", 0)
+	serverEP, err := client.ParseEndpoint(serverAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, client, serverEP, server)
+}
+
+func TestNewConfig(t *testing.T) {
+	cert, _ := testCertificate(t, "server.test")
+	for _, cfg := range []Config{
+		{Listen: true},
+		{PSK: []byte("key"), Certificates: []tls.Certificate{cert}},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+module github.com/darkit/wireguard/conn/dtlsbind
+
+go 1.23.1
+
+require (
+	github.com/darkit/wireguard v0.0.0-20261015131644-190eb6d4618a
+	github.com/pion/dtls/v3 v3.0.4
+	golang.org/x/sys v0.28.0
+)
+
+require (
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/transport/v3 v3.0.7 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/net v0.33.0 // indirect
+)
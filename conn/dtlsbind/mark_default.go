@@ -0,0 +1,14 @@
+//go:build !linux && !openbsd && !freebsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package dtlsbind
+
+import "syscall"
+
+func setMark(conn syscall.Conn, mark uint32) error {
+	return nil
+}
@@ -13,3 +13,5 @@ import "net"
 func supportsUDPOffload(conn *net.UDPConn) (txOffload, rxOffload bool) {
 	return
 }
+
+func disableUDPGRO(conn *net.UDPConn) {}
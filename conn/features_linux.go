@@ -27,3 +27,14 @@ func supportsUDPOffload(conn *net.UDPConn) (txOffload, rxOffload bool) {
 	}
 	return txOffload, rxOffload
 }
+
+// disableUDPGRO stops the kernel from coalescing datagrams received on conn.
+func disableUDPGRO(conn *net.UDPConn) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 0)
+	})
+}
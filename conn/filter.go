@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/net/bpf"
+)
+
+// WithPacketFilter attaches a socket filter to the bind's sockets that drops
+// datagrams in the kernel unless they start with the type of a WireGuard
+// message and are at least as long as it, sparing a wakeup and a failed
+// parse for each datagram of the junk public endpoints are sent. It takes
+// effect on Linux only, and the sockets are left unfiltered if the kernel
+// refuses the filter; Capabilities reports whether it was attached.
+//
+// Datagrams the bind's owner expects on the same sockets that are not
+// WireGuard messages, such as STUN responses, are dropped as well.
+func WithPacketFilter() StdNetBindOption {
+	return func(s *StdNetBind) {
+		s.packetFilter = true
+	}
+}
+
+// The message types and the minimum sizes of the messages of each, as
+// defined by the device package, which conn cannot import.
+const (
+	filterMessageInitiationType  = 1
+	filterMessageResponseType    = 2
+	filterMessageCookieReplyType = 3
+	filterMessageTransportType   = 4
+
+	filterMessageInitiationSize  = 148
+	filterMessageResponseSize    = 92
+	filterMessageCookieReplySize = 64
+	filterMessageTransportSize   = 32
+)
+
+// packetFilterProgram returns the classic BPF program of WithPacketFilter.
+// The filter of a UDP socket sees the UDP header ahead of the payload, and
+// the length of both; the type of a message is a little-endian 32-bit
+// word, which a load reads as big-endian.
+func packetFilterProgram() ([]bpf.RawInstruction, error) {
+	const udpHeaderSize = 8
+	checkSize := func(size uint32) []bpf.Instruction {
+		return []bpf.Instruction{
+			bpf.LoadExtension{Num: bpf.ExtLen},
+			bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: udpHeaderSize + size, SkipFalse: 1},
+			bpf.RetConstant{Val: 0xffffffff},
+			bpf.RetConstant{Val: 0},
+		}
+	}
+	types := []struct {
+		typ  uint32
+		size uint32
+	}{
+		{filterMessageInitiationType, filterMessageInitiationSize},
+		{filterMessageResponseType, filterMessageResponseSize},
+		{filterMessageCookieReplyType, filterMessageCookieReplySize},
+		{filterMessageTransportType, filterMessageTransportSize},
+	}
+
+	// The jumps to the size checks, and a drop if none is taken.
+	program := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: udpHeaderSize + 4, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.LoadAbsolute{Off: udpHeaderSize, Size: 4},
+	}
+	for i, t := range types {
+		// Skip the remaining jumps and the drop, then the size checks of
+		// the types before.
+		skip := uint8(len(types)-i-1) + 1 + uint8(i*len(checkSize(0)))
+		program = append(program, bpf.JumpIf{Cond: bpf.JumpEqual, Val: t.typ << 24, SkipTrue: skip})
+	}
+	program = append(program, bpf.RetConstant{Val: 0})
+	for _, t := range types {
+		program = append(program, checkSize(t.size)...)
+	}
+	return bpf.Assemble(program)
+}
+
+// applyPacketFilter attaches the filter of WithPacketFilter to conns that are
+// not nil, if it is enabled, recording whether it was attached to all.
+func (s *StdNetBind) applyPacketFilter(conns ...*net.UDPConn) {
+	s.packetFilterApplied = false
+	if !s.packetFilter {
+		return
+	}
+	for _, conn := range conns {
+		if conn != nil && setPacketFilter(conn) != nil {
+			return
+		}
+	}
+	s.packetFilterApplied = true
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+func setPacketFilter(conn *net.UDPConn) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestStdNetBindPacketFilter(t *testing.T) {
+	bind := NewStdNetBind(WithPacketFilter()).(*StdNetBind)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if !bind.Capabilities().PacketFilter {
+		t.Skip("packet filter refused by the kernel")
+	}
+
+	message := func(typ byte, size int) []byte {
+		b := make([]byte, size)
+		b[0] = typ
+		return b
+	}
+	garbage := [][]byte{
+		[]byte("GET / HTTP/1.0\r\n\r\n"),
+		{1},
+		message(1, 147), // initiation too short
+		message(3, 63),  // cookie reply too short
+		message(5, 148), // unknown type
+		append([]byte{4, 0, 0, 1}, make([]byte, 28)...), // nonzero reserved bytes
+	}
+	valid := [][]byte{
+		message(1, 148),
+		message(2, 92),
+		message(3, 64),
+		message(4, 32),
+		message(4, 1452),
+	}
+
+	sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	for _, datagram := range append(garbage, valid...) {
+		if _, err := sender.Write(datagram); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bufs := make([][]byte, bind.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, 2048)
+	}
+	sizes := make([]int, len(bufs))
+	eps := make([]Endpoint, len(bufs))
+	var received [][]byte
+	for len(received) < len(valid) {
+		n, err := fns[0](bufs, sizes, eps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			received = append(received, append([]byte(nil), bufs[i][:sizes[i]]...))
+		}
+	}
+	for i, datagram := range received {
+		if i >= len(valid) || !bytes.Equal(datagram, valid[i]) {
+			t.Errorf("received datagram %d of %d bytes starting with %x, want only the valid messages in order", i, len(datagram), datagram[:min(len(datagram), 4)])
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import "fmt"
+
+// A FlowLabelPolicy selects the IPv6 flow labels of datagrams sent by a
+// FlowLabelBind.
+type FlowLabelPolicy int
+
+const (
+	// FlowLabelKernel leaves flow labels to the kernel, which usually
+	// derives them from the addresses and ports of the datagram.
+	FlowLabelKernel FlowLabelPolicy = iota
+	// FlowLabelPeer gives all datagrams to a peer the same label, derived
+	// from its identity, for as long as it is configured.
+	FlowLabelPeer
+	// FlowLabelRandom gives the datagrams to a peer a label derived from
+	// the random receiver index of the session, which changes with every
+	// session, so that an observer cannot link its sessions by label.
+	FlowLabelRandom
+)
+
+// FlowLabelMask selects the 20 bits of a flow label.
+const FlowLabelMask = 0xfffff
+
+func (p FlowLabelPolicy) String() string {
+	switch p {
+	case FlowLabelKernel:
+		return "kernel"
+	case FlowLabelPeer:
+		return "peer"
+	case FlowLabelRandom:
+		return "random"
+	}
+	return fmt.Sprintf("FlowLabelPolicy(%d)", int(p))
+}
+
+// ParseFlowLabelPolicy parses the string form of a FlowLabelPolicy.
+func ParseFlowLabelPolicy(s string) (FlowLabelPolicy, error) {
+	for p := FlowLabelKernel; p <= FlowLabelRandom; p++ {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid flow label policy %q", s)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+const flowLabelsSupported = false
+
+const flowLabelControlSize = 0
+
+func setFlowLabelControl(control *[]byte, label uint32) {}
+
+func manageFlowLabel(c *net.UDPConn, dst netip.Addr, label uint32, release bool) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants of linux/in6.h missing from x/sys/unix.
+const (
+	sockoptIPV6_FLOWINFO       = 11
+	sockoptIPV6_FLOWLABEL_MGR  = 32
+	sockoptIPV6_FL_A_GET       = 0
+	sockoptIPV6_FL_A_PUT       = 1
+	sockoptIPV6_FL_F_CREATE    = 1
+	sockoptIPV6_FL_S_EXCLUSIVE = 1
+)
+
+// in6FlowlabelReq is struct in6_flowlabel_req.
+type in6FlowlabelReq struct {
+	dst     [16]byte
+	label   [4]byte // big endian
+	action  uint8
+	share   uint8
+	flags   uint16
+	expires uint16
+	linger  uint16
+	_       uint32
+}
+
+const flowLabelsSupported = true
+
+// flowLabelControlSize is the size of the control message set by
+// setFlowLabelControl.
+var flowLabelControlSize = unix.CmsgSpace(4)
+
+// setFlowLabelControl appends an IPV6_FLOWINFO control message carrying
+// label to control, if it fits.
+func setFlowLabelControl(control *[]byte, label uint32) {
+	start := len(*control)
+	if cap(*control)-start < flowLabelControlSize {
+		return
+	}
+	*control = (*control)[:start+flowLabelControlSize]
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&(*control)[start]))
+	hdr.Level = unix.IPPROTO_IPV6
+	hdr.Type = sockoptIPV6_FLOWINFO
+	hdr.SetLen(unix.CmsgLen(4))
+	binary.BigEndian.PutUint32((*control)[start+unix.CmsgLen(0):], label&FlowLabelMask)
+}
+
+// manageFlowLabel leases label for sending to dst on c, or releases it. The
+// kernel only lets a socket send with flow labels it leased.
+func manageFlowLabel(c *net.UDPConn, dst netip.Addr, label uint32, release bool) error {
+	req := in6FlowlabelReq{
+		dst:    dst.As16(),
+		action: sockoptIPV6_FL_A_GET,
+		share:  sockoptIPV6_FL_S_EXCLUSIVE,
+		flags:  sockoptIPV6_FL_F_CREATE,
+	}
+	if release {
+		req.action = sockoptIPV6_FL_A_PUT
+		req.flags = 0
+	}
+	binary.BigEndian.PutUint32(req.label[:], label&FlowLabelMask)
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno unix.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall6(unix.SYS_SETSOCKOPT, fd, unix.IPPROTO_IPV6, sockoptIPV6_FLOWLABEL_MGR,
+			uintptr(unsafe.Pointer(&req)), unsafe.Sizeof(req), 0)
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// flowLabelCapture listens on [::1] and reports the flow label of each
+// datagram it receives.
+func flowLabelCapture(t *testing.T) (*net.UDPConn, func() uint32) {
+	c, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, sockoptIPV6_FLOWINFO, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() uint32 {
+		t.Helper()
+		buf, oob := make([]byte, 1500), make([]byte, 128)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, oobn, _, _, err := c.ReadMsgUDP(buf, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			if msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == sockoptIPV6_FLOWINFO {
+				return binary.BigEndian.Uint32(msg.Data) & FlowLabelMask
+			}
+		}
+		t.Fatal("received datagram without flow information")
+		return 0
+	}
+}
+
+func TestStdNetBindFlowLabel(t *testing.T) {
+	capture, label := flowLabelCapture(t)
+	bind := NewStdNetBind().(*StdNetBind)
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if bind.ipv6 == nil {
+		t.Skip("bind has no IPv6 socket")
+	}
+	ep, err := bind.ParseEndpoint(netip.AddrPortFrom(netip.IPv6Loopback(), uint16(capture.LocalAddr().(*net.UDPAddr).Port)).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bind.SetFlowLabelPolicy(FlowLabelPeer); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []uint32{0x12345, 0x12345, 0xabcde} {
+		if err := bind.SendFlowLabel([][]byte{{1}}, ep, want); err != nil {
+			t.Fatal(err)
+		}
+		if got := label(); got != want {
+			t.Errorf("got flow label %#x, want %#x", got, want)
+		}
+	}
+
+	if err := bind.SetFlowLabelPolicy(FlowLabelKernel); err != nil {
+		t.Fatal(err)
+	}
+	if err := bind.SendFlowLabel([][]byte{{1}}, ep, 0x54321); err != nil {
+		t.Fatal(err)
+	}
+	if got := label(); got == 0x54321 {
+		t.Errorf("got flow label %#x with the kernel policy", got)
+	}
+}
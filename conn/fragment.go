@@ -0,0 +1,209 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// A FragmentationPolicy selects whether the datagrams a bind sends may be
+// fragmented on their way, by setting the don't-fragment bit of IPv4
+// headers and, where the platform allows, its mode of path MTU discovery.
+// IPv6 datagrams are never fragmented by routers, so for them the policy
+// only selects whether the host fragments them.
+type FragmentationPolicy int
+
+const (
+	// DontFragment sets the don't-fragment bit and rejects datagrams
+	// larger than the known path MTU, which the network lowers with ICMP
+	// errors. It is the default.
+	DontFragment FragmentationPolicy = iota
+
+	// DoFragment clears the don't-fragment bit, so that the host and the
+	// routers on the path fragment datagrams larger than the path MTU.
+	DoFragment
+
+	// Probe sets the don't-fragment bit but ignores the path MTU, sending
+	// datagrams of any size up to the MTU of the interface, to probe
+	// whether they get through. On platforms without path MTU discovery
+	// modes, it is the same as DontFragment.
+	Probe
+)
+
+func (p FragmentationPolicy) String() string {
+	switch p {
+	case DontFragment:
+		return "dont-fragment"
+	case DoFragment:
+		return "do-fragment"
+	case Probe:
+		return "probe"
+	}
+	return "FragmentationPolicy(" + strconv.Itoa(int(p)) + ")"
+}
+
+// FragmentationBind is implemented by Binds whose fragmentation policy can
+// be set, such as StdNetBind and WinRingBind.
+type FragmentationBind interface {
+	// SetFragmentationPolicy applies policy to the open sockets of the
+	// bind, and to those it opens later.
+	SetFragmentationPolicy(policy FragmentationPolicy) error
+	FragmentationPolicy() FragmentationPolicy
+}
+
+var _ FragmentationBind = (*StdNetBind)(nil)
+
+// WithFragmentationPolicy sets the fragmentation policy of the bind's
+// sockets, which is DontFragment if unset. It is applied as far as the
+// platform supports it.
+func WithFragmentationPolicy(policy FragmentationPolicy) StdNetBindOption {
+	return func(s *StdNetBind) {
+		s.fragmentation = policy
+	}
+}
+
+// WithPathMTU limits the datagrams coalesced with UDP GSO to segments that
+// fit in mtu, the MTU of the path to the bind's endpoints, in addition to
+// the path MTUs the network reports. Larger datagrams are sent on their
+// own.
+func WithPathMTU(mtu int) StdNetBindOption {
+	return func(s *StdNetBind) {
+		s.pathMTU = mtu
+	}
+}
+
+func validFragmentationPolicy(policy FragmentationPolicy) error {
+	if policy < DontFragment || policy > Probe {
+		return fmt.Errorf("invalid fragmentation policy %v", policy)
+	}
+	return nil
+}
+
+func (s *StdNetBind) SetFragmentationPolicy(policy FragmentationPolicy) error {
+	if err := validFragmentationPolicy(policy); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fragmentation = policy
+	if s.ipv4 != nil {
+		if err := setFragmentation(s.ipv4, false, policy); err != nil {
+			return err
+		}
+	}
+	if s.ipv6 != nil {
+		if err := setFragmentation(s.ipv6, true, policy); err != nil {
+			return err
+		}
+	}
+	if s.sources != nil {
+		for src, c := range s.sources.conns {
+			if err := setFragmentation(c.conn, src.Is6(), policy); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *StdNetBind) FragmentationPolicy() FragmentationPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fragmentation
+}
+
+// applyFragmentation applies the fragmentation policy to the bind's
+// sockets that are not nil. It is allowed to fail, leaving the platform's
+// default.
+func (s *StdNetBind) applyFragmentation(v4conn, v6conn *net.UDPConn) {
+	if v4conn != nil {
+		_ = setFragmentation(v4conn, false, s.fragmentation)
+	}
+	if v6conn != nil {
+		_ = setFragmentation(v6conn, true, s.fragmentation)
+	}
+}
+
+// setFragmentation applies policy to conn, an IPv6 socket if is6.
+func setFragmentation(conn syscall.Conn, is6 bool, policy FragmentationPolicy) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	err = rc.Control(func(fd uintptr) {
+		operr = setFragmentationFd(fd, is6, policy)
+	})
+	if err == nil {
+		err = operr
+	}
+	return err
+}
+
+const (
+	minIPv4MTU = 68
+	minIPv6MTU = 1280
+
+	// maxPathMTUs bounds the number of destinations whose path MTU
+	// is remembered.
+	maxPathMTUs = 1024
+)
+
+// pathMTUs holds the path MTUs reported by the network, by destination.
+// It has its own lock, since errors are read from sockets with or without
+// the bind's lock held.
+type pathMTUs struct {
+	mu   sync.Mutex
+	mtus map[netip.Addr]int
+}
+
+// note records mtu, reported by the network, as the path MTU to dst.
+func (p *pathMTUs) note(dst netip.Addr, mtu int) {
+	dst = dst.Unmap()
+	if dst.Is4() && mtu < minIPv4MTU || dst.Is6() && mtu < minIPv6MTU {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mtus == nil || len(p.mtus) >= maxPathMTUs {
+		p.mtus = make(map[netip.Addr]int)
+	}
+	p.mtus[dst] = mtu
+}
+
+func (p *pathMTUs) get(dst netip.Addr) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mtus[dst.Unmap()]
+}
+
+func (p *pathMTUs) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mtus = nil
+}
+
+// maxSegmentSize returns the largest UDP payload that fits in the path MTU
+// to dst, configured or reported, or zero if it is unknown. s.mu must be
+// held.
+func (s *StdNetBind) maxSegmentSize(dst netip.Addr) int {
+	mtu := s.pathMTUs.get(dst)
+	if s.pathMTU > 0 && (mtu == 0 || s.pathMTU < mtu) {
+		mtu = s.pathMTU
+	}
+	if mtu == 0 {
+		return 0
+	}
+	if dst.Unmap().Is4() {
+		return max(mtu-20-8, 1)
+	}
+	return max(mtu-40-8, 1)
+}
@@ -0,0 +1,23 @@
+//go:build darwin || freebsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import "golang.org/x/sys/unix"
+
+// These platforms have no path MTU discovery modes, so Probe is the same as
+// DontFragment.
+func setFragmentationFd(fd uintptr, is6 bool, policy FragmentationPolicy) error {
+	dontFrag := 1
+	if policy == DoFragment {
+		dontFrag = 0
+	}
+	if is6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, dontFrag)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_DONTFRAG, dontFrag)
+}
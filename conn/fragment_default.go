@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import "errors"
+
+func setFragmentationFd(fd uintptr, is6 bool, policy FragmentationPolicy) error {
+	return errors.ErrUnsupported
+}
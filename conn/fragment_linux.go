@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import "golang.org/x/sys/unix"
+
+func setFragmentationFd(fd uintptr, is6 bool, policy FragmentationPolicy) error {
+	if is6 {
+		mode := unix.IPV6_PMTUDISC_DO
+		switch policy {
+		case DoFragment:
+			mode = unix.IPV6_PMTUDISC_DONT
+		case Probe:
+			mode = unix.IPV6_PMTUDISC_PROBE
+		}
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, mode)
+	}
+	mode := unix.IP_PMTUDISC_DO
+	switch policy {
+	case DoFragment:
+		mode = unix.IP_PMTUDISC_DONT
+	case Probe:
+		mode = unix.IP_PMTUDISC_PROBE
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, mode)
+}
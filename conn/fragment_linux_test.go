@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func mtuDiscover(t *testing.T, conn *net.UDPConn, is6 bool) int {
+	t.Helper()
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode int
+	var operr error
+	rc.Control(func(fd uintptr) {
+		if is6 {
+			mode, operr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+		} else {
+			mode, operr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+		}
+	})
+	if operr != nil {
+		t.Fatal(operr)
+	}
+	return mode
+}
+
+func TestStdNetBindFragmentationPolicy(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if mode := mtuDiscover(t, bind.ipv4, false); mode != unix.IP_PMTUDISC_DO {
+		t.Errorf("IPv4 mode %d by default, want %d", mode, unix.IP_PMTUDISC_DO)
+	}
+	if bind.ipv6 != nil {
+		if mode := mtuDiscover(t, bind.ipv6, true); mode != unix.IPV6_PMTUDISC_DO {
+			t.Errorf("IPv6 mode %d by default, want %d", mode, unix.IPV6_PMTUDISC_DO)
+		}
+	}
+
+	if err := bind.SetFragmentationPolicy(DoFragment); err != nil {
+		t.Fatal(err)
+	}
+	if mode := mtuDiscover(t, bind.ipv4, false); mode != unix.IP_PMTUDISC_DONT {
+		t.Errorf("IPv4 mode %d after setting %v, want %d", mode, DoFragment, unix.IP_PMTUDISC_DONT)
+	}
+	if err := bind.SetFragmentationPolicy(FragmentationPolicy(7)); err == nil {
+		t.Error("invalid policy set")
+	}
+
+	probing := NewStdNetBind(WithFragmentationPolicy(Probe)).(*StdNetBind)
+	if _, _, err := probing.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer probing.Close()
+	if mode := mtuDiscover(t, probing.ipv4, false); mode != unix.IP_PMTUDISC_PROBE {
+		t.Errorf("IPv4 mode %d with %v, want %d", mode, Probe, unix.IP_PMTUDISC_PROBE)
+	}
+}
+
+func TestStdNetBindPathMTU(t *testing.T) {
+	bind := NewStdNetBind(WithPathMTU(1400)).(*StdNetBind)
+	dst := netip.MustParseAddr("192.0.2.1")
+	if n := bind.maxSegmentSize(dst); n != 1400-28 {
+		t.Errorf("max segment size %d with the configured path MTU, want %d", n, 1400-28)
+	}
+
+	// A path MTU reported by the network below the configured one lowers
+	// the segments to that destination only.
+	ee := unix.SockExtendedErr{Errno: uint32(unix.EMSGSIZE), Origin: unix.SO_EE_ORIGIN_LOCAL, Info: 1280}
+	control := make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(ee))))
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+	hdr.Level = unix.IPPROTO_IP
+	hdr.Type = unix.IP_RECVERR
+	hdr.SetLen(unix.CmsgLen(int(unsafe.Sizeof(ee))))
+	*(*unix.SockExtendedErr)(unsafe.Pointer(&control[unix.CmsgLen(0)])) = ee
+	e, mtu := parseExtendedErr(control)
+	if e != 0 || mtu != 1280 {
+		t.Fatalf("parsed %v and path MTU %d, want path MTU 1280", e, mtu)
+	}
+	bind.pathMTUs.note(dst, mtu)
+	if n := bind.maxSegmentSize(dst); n != 1280-28 {
+		t.Errorf("max segment size %d with the reported path MTU, want %d", n, 1280-28)
+	}
+	if n := bind.maxSegmentSize(netip.MustParseAddr("2001:db8::1")); n != 1400-48 {
+		t.Errorf("max segment size %d to another destination, want %d", n, 1400-48)
+	}
+	bind.pathMTUs.note(dst, 20)
+	if n := bind.maxSegmentSize(dst); n != 1280-28 {
+		t.Errorf("max segment size %d after an implausible path MTU, want %d", n, 1280-28)
+	}
+}
@@ -0,0 +1,46 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import "golang.org/x/sys/windows"
+
+func setFragmentationFd(fd uintptr, is6 bool, policy FragmentationPolicy) error {
+	return setFragmentationSocket(windows.Handle(fd), is6, policy)
+}
+
+// setFragmentationSocket sets the path MTU discovery mode of sock, which
+// Windows supports since Windows 10 1703, falling back to the don't-fragment
+// option alone before it, where Probe is the same as DontFragment.
+func setFragmentationSocket(sock windows.Handle, is6 bool, policy FragmentationPolicy) error {
+	const (
+		IP_DONTFRAGMENT   = 14
+		IPV6_DONTFRAG     = 14
+		IP_MTU_DISCOVER   = 71
+		IPV6_MTU_DISCOVER = 71
+		IP_PMTUDISC_DO    = 1
+		IP_PMTUDISC_DONT  = 2
+		IP_PMTUDISC_PROBE = 3
+	)
+	level, discover, dontFrag := windows.IPPROTO_IP, IP_MTU_DISCOVER, IP_DONTFRAGMENT
+	if is6 {
+		level, discover, dontFrag = windows.IPPROTO_IPV6, IPV6_MTU_DISCOVER, IPV6_DONTFRAG
+	}
+	mode := IP_PMTUDISC_DO
+	switch policy {
+	case DoFragment:
+		mode = IP_PMTUDISC_DONT
+	case Probe:
+		mode = IP_PMTUDISC_PROBE
+	}
+	if windows.SetsockoptInt(sock, level, discover, mode) == nil {
+		return nil
+	}
+	on := 1
+	if policy == DoFragment {
+		on = 0
+	}
+	return windows.SetsockoptInt(sock, level, dontFrag, on)
+}
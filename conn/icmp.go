@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net/netip"
+	"sync/atomic"
+)
+
+// An EndpointError is an error the network reported, usually with an ICMP
+// message, for a datagram sent to an endpoint.
+type EndpointError int
+
+const (
+	ErrPortUnreachable EndpointError = iota + 1 // nothing listens on the port
+	ErrHostUnreachable                          // the host could not be reached
+	ErrNetUnreachable                           // there is no route to the host
+	ErrAdminProhibited                          // a firewall rejected the datagram
+)
+
+func (e EndpointError) Error() string {
+	switch e {
+	case ErrPortUnreachable:
+		return "port unreachable"
+	case ErrHostUnreachable:
+		return "host unreachable"
+	case ErrNetUnreachable:
+		return "network unreachable"
+	case ErrAdminProhibited:
+		return "administratively prohibited"
+	}
+	return "unknown endpoint error"
+}
+
+// EndpointErrorReporter is implemented by Binds that report the errors
+// received for the datagrams they sent, such as StdNetBind on Linux and
+// WinRingBind.
+type EndpointErrorReporter interface {
+	// SetEndpointErrorHandler sets fn to be called with the destination of
+	// a datagram and the error reported for it, replacing any previous
+	// handler. A nil fn removes the handler. fn is called from the
+	// goroutines sending and receiving, so it must not block.
+	SetEndpointErrorHandler(fn func(dst netip.AddrPort, err EndpointError))
+}
+
+var _ EndpointErrorReporter = (*StdNetBind)(nil)
+
+func (s *StdNetBind) SetEndpointErrorHandler(fn func(dst netip.AddrPort, err EndpointError)) {
+	s.endpointErrors.set(fn)
+}
+
+type endpointErrorHandler struct {
+	fn atomic.Pointer[func(netip.AddrPort, EndpointError)]
+}
+
+func (h *endpointErrorHandler) set(fn func(netip.AddrPort, EndpointError)) {
+	if fn == nil {
+		h.fn.Store(nil)
+		return
+	}
+	h.fn.Store(&fn)
+}
+
+func (h *endpointErrorHandler) report(dst netip.AddrPort, err EndpointError) {
+	if fn := h.fn.Load(); fn != nil {
+		(*fn)(netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()), err)
+	}
+}
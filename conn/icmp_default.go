@@ -0,0 +1,16 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import "net"
+
+func enableErrorQueue(conn *net.UDPConn, is6 bool) {}
+
+func (s *StdNetBind) readErrorQueue(conn *net.UDPConn, err error) bool {
+	return false
+}
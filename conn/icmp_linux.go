@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// enableErrorQueue makes the kernel queue the ICMP errors received for
+// datagrams sent from conn, to be read by readErrorQueue. It is allowed to
+// fail, leaving the errors unreported.
+func enableErrorQueue(conn *net.UDPConn, is6 bool) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		if is6 {
+			_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1)
+		} else {
+			_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVERR, 1)
+		}
+	})
+}
+
+// readErrorQueue reports the errors queued on conn to the endpoint error
+// handler, and records the path MTUs they carry, if err, returned by a read
+// or write, may have been caused by one. It returns whether any error was
+// queued, in which case err was.
+func (s *StdNetBind) readErrorQueue(conn *net.UDPConn, err error) bool {
+	var serr *os.SyscallError
+	if !errors.As(err, &serr) {
+		return false
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	queued := false
+	var oob [128]byte
+	rc.Control(func(fd uintptr) {
+		for {
+			_, oobn, _, from, err := unix.Recvmsg(int(fd), nil, oob[:], unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err != nil {
+				return
+			}
+			queued = true
+			var dst netip.AddrPort
+			switch sa := from.(type) {
+			case *unix.SockaddrInet4:
+				dst = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port))
+			case *unix.SockaddrInet6:
+				dst = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(sa.Port))
+			default:
+				continue
+			}
+			e, mtu := parseExtendedErr(oob[:oobn])
+			if e != 0 {
+				s.endpointErrors.report(dst, e)
+			}
+			if mtu != 0 {
+				s.pathMTUs.note(dst.Addr(), mtu)
+			}
+		}
+	})
+	return queued
+}
+
+// parseExtendedErr returns the EndpointError of the ICMP error described by
+// the control messages of a read from the error queue, or zero if it is
+// another kind of error, and the path MTU the error reports, if any.
+func parseExtendedErr(control []byte) (EndpointError, int) {
+	msgs, err := unix.ParseSocketControlMessage(control)
+	if err != nil {
+		return 0, 0
+	}
+	for _, msg := range msgs {
+		if !(msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_RECVERR) &&
+			!(msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_RECVERR) {
+			continue
+		}
+		if len(msg.Data) < int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+			continue
+		}
+		ee := (*unix.SockExtendedErr)(unsafe.Pointer(&msg.Data[0]))
+		switch ee.Origin {
+		case unix.SO_EE_ORIGIN_ICMP:
+			if ee.Type == 3 && ee.Code == 4 { // fragmentation needed
+				return 0, int(ee.Info)
+			}
+			return icmpError(ee.Type, ee.Code), 0
+		case unix.SO_EE_ORIGIN_ICMP6:
+			if ee.Type == 2 { // packet too big
+				return 0, int(ee.Info)
+			}
+			return icmp6Error(ee.Type, ee.Code), 0
+		case unix.SO_EE_ORIGIN_LOCAL:
+			if syscall.Errno(ee.Errno) == unix.EMSGSIZE {
+				return 0, int(ee.Info)
+			}
+		}
+	}
+	return 0, 0
+}
+
+func icmpError(typ, code uint8) EndpointError {
+	if typ != 3 { // destination unreachable
+		return 0
+	}
+	switch code {
+	case 3:
+		return ErrPortUnreachable
+	case 0, 6: // network unreachable, network unknown
+		return ErrNetUnreachable
+	case 9, 10, 13: // network, host, communication administratively prohibited
+		return ErrAdminProhibited
+	case 4: // fragmentation needed, for path MTU discovery
+		return 0
+	}
+	return ErrHostUnreachable
+}
+
+func icmp6Error(typ, code uint8) EndpointError {
+	if typ != 1 { // destination unreachable
+		return 0
+	}
+	switch code {
+	case 4:
+		return ErrPortUnreachable
+	case 0: // no route to destination
+		return ErrNetUnreachable
+	case 1, 5, 6: // administratively prohibited, source policy, reject route
+		return ErrAdminProhibited
+	}
+	return ErrHostUnreachable
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type endpointErrorReport struct {
+	dst netip.AddrPort
+	err EndpointError
+}
+
+func TestStdNetBindEndpointErrors(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	reports := make(chan endpointErrorReport, 16)
+	bind.SetEndpointErrorHandler(func(dst netip.AddrPort, err EndpointError) {
+		reports <- endpointErrorReport{dst, err}
+	})
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	// Nothing listens on the port of a closed socket.
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := closed.LocalAddr().(*net.UDPAddr).AddrPort()
+	closed.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		bufs := make([][]byte, IdealBatchSize)
+		for i := range bufs {
+			bufs[i] = make([]byte, 16)
+		}
+		_, err := fns[0](bufs, make([]int, len(bufs)), make([]Endpoint, len(bufs)))
+		received <- err
+	}()
+
+	if err := bind.Send([][]byte{{1}}, &StdNetEndpoint{AddrPort: dst}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-reports:
+		if r.dst != dst || r.err != ErrPortUnreachable {
+			t.Fatalf("reported %v for %v, want %v for %v", r.err, r.dst, ErrPortUnreachable, dst)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported")
+	}
+
+	// The error must not fail sending or receiving.
+	if err := bind.Send([][]byte{{1}}, &StdNetEndpoint{AddrPort: dst}); err != nil {
+		t.Fatalf("sending after the error: %v", err)
+	}
+	sender, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write([]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-received:
+		if err != nil {
+			t.Fatalf("receiving after the error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("datagram not received")
+	}
+}
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func getMark(t *testing.T, conn *net.UDPConn) int {
+	t.Helper()
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	var operr error
+	if err := rc.Control(func(fd uintptr) {
+		mark, operr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if operr != nil {
+		t.Fatal(operr)
+	}
+	return mark
+}
+
+func TestStdNetBindSetMarkSources(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	ep, err := bind.ParseEndpoint("127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := netip.MustParseAddr("127.0.0.1")
+	if err := bind.SendFrom([][]byte{{1}}, ep, src); err != nil {
+		t.Fatal(err)
+	}
+
+	// Source sockets opened before the mark is set get it too.
+	if err := bind.SetMark(0x51820); err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skip("setting marks needs CAP_NET_ADMIN")
+		}
+		t.Fatal(err)
+	}
+	bind.mu.Lock()
+	c := bind.sources.conns[src]
+	bind.mu.Unlock()
+	if mark := getMark(t, c.conn); mark != 0x51820 {
+		t.Errorf("source socket mark %#x, want %#x", mark, 0x51820)
+	}
+}
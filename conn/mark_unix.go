@@ -9,6 +9,7 @@ package conn
 
 import (
 	"runtime"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -27,39 +28,51 @@ func init() {
 }
 
 func (s *StdNetBind) SetMark(mark uint32) error {
-	var operr error
 	if fwmarkIoctl == 0 {
 		return nil
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mark = mark
 	if s.ipv4 != nil {
-		fd, err := s.ipv4.SyscallConn()
-		if err != nil {
-			return err
-		}
-		err = fd.Control(func(fd uintptr) {
-			operr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, fwmarkIoctl, int(mark))
-		})
-		if err == nil {
-			err = operr
-		}
-		if err != nil {
+		if err := setMark(s.ipv4, mark); err != nil {
 			return err
 		}
 	}
 	if s.ipv6 != nil {
-		fd, err := s.ipv6.SyscallConn()
-		if err != nil {
+		if err := setMark(s.ipv6, mark); err != nil {
 			return err
 		}
-		err = fd.Control(func(fd uintptr) {
-			operr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, fwmarkIoctl, int(mark))
-		})
-		if err == nil {
-			err = operr
+	}
+	if s.sources != nil {
+		for _, c := range s.sources.conns {
+			if err := setMark(c.conn, mark); err != nil {
+				return err
+			}
 		}
-		if err != nil {
-			return err
+		for c := range s.sources.punched {
+			if err := setMark(c.conn, mark); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
+
+func setMark(conn syscall.Conn, mark uint32) error {
+	if fwmarkIoctl == 0 {
+		return nil
+	}
+	fd, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	err = fd.Control(func(fd uintptr) {
+		operr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, fwmarkIoctl, int(mark))
+	})
+	if err == nil {
+		err = operr
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// offloadProbeSizes are the sizes of the datagrams of the offload probe: a
+// run of equal sizes, coalesced into one send, and a shorter last one, which
+// the kernel must carry as a short final segment.
+var offloadProbeSizes = []int{1200, 1200, 1200, 700}
+
+// offloadProbeTimeout bounds the wait for each datagram of the offload probe.
+const offloadProbeTimeout = 500 * time.Millisecond
+
+// DisableOffloads stops coalescing outgoing datagrams with UDP GSO at once,
+// and receiving datagrams coalesced with UDP GRO from the next Open, for the
+// lifetime of the bind.
+func (s *StdNetBind) DisableOffloads() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disableOffloadsLocked()
+}
+
+// disableOffloadsLocked implements DisableOffloads. s.mu must be held.
+func (s *StdNetBind) disableOffloadsLocked() {
+	s.offloadsDisabled = true
+	s.ipv4TxOffload = false
+	s.ipv6TxOffload = false
+}
+
+func (s *StdNetBind) OffloadsDisabled() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offloadsDisabled, s.offloadFailure
+}
+
+// udpOffloads reports the offloads to use on conn, checking segmentation with
+// a probe if it supports UDP GSO, and disabling offloads for the lifetime of
+// the bind if the probe fails. s.mu must be held.
+func (s *StdNetBind) udpOffloads(conn *net.UDPConn, bw batchWriter, is6 bool) (txOffload, rxOffload bool) {
+	if !s.offloadsDisabled {
+		txOffload, rxOffload = supportsUDPOffload(conn)
+		txOffload = txOffload && !s.gsoDisabled
+		if !txOffload {
+			return txOffload, rxOffload
+		}
+		err := s.probeUDPOffload(conn, bw, is6)
+		if err == nil {
+			return txOffload, rxOffload
+		}
+		s.offloadFailure = fmt.Errorf("UDP GSO probe on %s failed, disabled offloads: %w", conn.LocalAddr(), err)
+		s.disableOffloadsLocked()
+		if s.ipv4 != nil {
+			// Its receive function is made, but without UDP GRO it
+			// only sees single datagrams.
+			disableUDPGRO(s.ipv4)
+		}
+	}
+	disableUDPGRO(conn)
+	return false, false
+}
+
+// probeUDPOffload sends a coalesced batch of patterned datagrams from conn to
+// a socket on the loopback address, and checks that it receives them
+// segmented as sent. s.mu must be held.
+func (s *StdNetBind) probeUDPOffload(conn *net.UDPConn, bw batchWriter, is6 bool) error {
+	network, loopback := "udp4", netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	if is6 {
+		network, loopback = "udp6", netip.IPv6Loopback()
+	}
+	rx, err := net.ListenUDP(network, net.UDPAddrFromAddrPort(netip.AddrPortFrom(loopback, 0)))
+	if err != nil {
+		// Without a loopback address there is nothing to check against.
+		return nil
+	}
+	defer rx.Close()
+
+	// The first datagram has room for the others to be coalesced into it.
+	var total int
+	for _, size := range offloadProbeSizes {
+		total += size
+	}
+	bufs := make([][]byte, len(offloadProbeSizes))
+	for i, size := range offloadProbeSizes {
+		capacity := size
+		if i == 0 {
+			capacity = total
+		}
+		bufs[i] = make([]byte, size, capacity)
+		for j := range bufs[i] {
+			bufs[i][j] = byte(i*size + j)
+		}
+	}
+	ep := &StdNetEndpoint{AddrPort: rx.LocalAddr().(*net.UDPAddr).AddrPort()}
+	msgs := s.getMessages()
+	defer s.putMessages(msgs)
+	n := coalesceMessages(net.UDPAddrFromAddrPort(ep.AddrPort), ep, bufs, *msgs, 0, setGSOSize)
+	if err := s.send(conn, bw, (*msgs)[:n]); err != nil {
+		return fmt.Errorf("sending: %w", err)
+	}
+
+	got := make([]byte, 2*offloadProbeSizes[0])
+	for i, want := range bufs {
+		rx.SetReadDeadline(time.Now().Add(offloadProbeTimeout))
+		n, err := rx.Read(got)
+		if err != nil {
+			return fmt.Errorf("receiving datagram %d of %d: %w", i+1, len(bufs), err)
+		}
+		if n != len(want) {
+			return fmt.Errorf("received datagram %d of %d with %d bytes, want %d", i+1, len(bufs), n, len(want))
+		}
+		if !bytes.Equal(got[:n], want) {
+			return fmt.Errorf("received datagram %d of %d corrupted", i+1, len(bufs))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var _ PunchBind = (*StdNetBind)(nil)
+
+// Defaults for the zero fields of PunchOptions. With both sides punching,
+// 256 sockets and 1024 probes over the whole port range of a symmetric NAT
+// find a path in about 98% of the attempts, by the birthday paradox.
+const (
+	DefaultPunchSockets  = 256
+	DefaultPunchProbes   = 1024
+	DefaultPunchInterval = time.Millisecond
+)
+
+// punchProbeSize is the size of a probe, that of a handshake initiation, so
+// that NATs and firewalls treat the probes as they will the handshake.
+const punchProbeSize = filterMessageInitiationSize
+
+// punchProbeMagic starts every probe. As a message type, it is none of
+// WireGuard's, so that a device that receives a probe drops it.
+var punchProbeMagic = [4]byte{'P', 'N', 'C', 'H'}
+
+// PunchTarget is where the signaling of the application tells a peer behind
+// a NAT can be reached: its external address, and the range of ports its
+// NAT is predicted to map its probes to, such as the ports around those it
+// was last seen using. The zero range is every port.
+type PunchTarget struct {
+	Addr      netip.Addr
+	FirstPort uint16
+	LastPort  uint16
+}
+
+// PunchOptions configures the bursts of probes of Punch.
+type PunchOptions struct {
+	// Sockets is how many sockets, each on its own ephemeral port, the
+	// probes are sent from in turn. Zero selects DefaultPunchSockets.
+	Sockets int
+
+	// Probes is how many probes a burst sends, each to a random port of
+	// the target's range. Zero selects DefaultPunchProbes.
+	Probes int
+
+	// Interval is the time between two probes of a burst. Zero selects
+	// DefaultPunchInterval.
+	Interval time.Duration
+}
+
+// PunchResult is the path Punch found to a peer.
+type PunchResult struct {
+	// Endpoint is the peer's endpoint over the path, for the device to send
+	// to, as set with device.Peer.LearnEndpoint. Datagrams sent to it leave
+	// from the punched socket.
+	Endpoint Endpoint
+
+	Local  netip.AddrPort // the local address of the punched socket
+	Remote netip.AddrPort // the address the peer reached it from
+}
+
+// punchHit is a datagram from addr received on a punch socket.
+type punchHit struct {
+	c    *sourceConn
+	addr netip.AddrPort
+}
+
+func (opts *PunchOptions) setDefaults() {
+	if opts.Sockets <= 0 {
+		opts.Sockets = DefaultPunchSockets
+	}
+	if opts.Probes <= 0 {
+		opts.Probes = DefaultPunchProbes
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultPunchInterval
+	}
+}
+
+// Punch opens a path through the NATs between the bind and a peer, which
+// runs Punch toward the bind at the same time, by sending bursts of probes
+// to the targets read from targets from sockets on many local ports, until
+// a datagram from the target arrives on one of them. Each target read
+// starts a new burst; the last one is waited for after its burst until ctx
+// is done. The sockets receive along with the bind's until Punch returns,
+// and the punched one until the bind is closed. Punch returns ctx's error
+// if no path was found.
+func (s *StdNetBind) Punch(ctx context.Context, targets <-chan PunchTarget, opts PunchOptions) (PunchResult, error) {
+	opts.setDefaults()
+	var (
+		conns  []*sourceConn
+		target PunchTarget
+		probes int
+		ticker *time.Ticker
+		tick   <-chan time.Time
+		winner *sourceConn
+	)
+	hits := make(chan punchHit, opts.Sockets)
+	defer func() {
+		for _, c := range conns {
+			if c != winner {
+				c.conn.Close()
+			}
+		}
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	probe := make([]byte, punchProbeSize)
+	copy(probe, punchProbeMagic[:])
+	for i := len(punchProbeMagic); i < len(probe); i++ {
+		probe[i] = byte(rand.Uint32())
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return PunchResult{}, ctx.Err()
+
+		case t, ok := <-targets:
+			if !ok {
+				targets = nil
+				continue
+			}
+			t.Addr = t.Addr.Unmap()
+			if t.FirstPort == 0 && t.LastPort == 0 {
+				t.FirstPort, t.LastPort = 1, 0xffff
+			}
+			if !t.Addr.IsValid() || t.FirstPort > t.LastPort {
+				return PunchResult{}, errors.New("invalid punch target")
+			}
+			if len(conns) == 0 || t.Addr.Is6() != target.Addr.Is6() {
+				for _, c := range conns {
+					c.conn.Close()
+				}
+				var err error
+				if conns, err = s.openPunchSockets(t.Addr.Is6(), opts.Sockets, hits); err != nil {
+					return PunchResult{}, err
+				}
+			}
+			target, probes = t, 0
+			if ticker == nil {
+				ticker = time.NewTicker(opts.Interval)
+				tick = ticker.C
+			}
+
+		case <-tick:
+			if probes == opts.Probes {
+				continue
+			}
+			c := conns[probes%len(conns)]
+			port := target.FirstPort + uint16(rand.IntN(int(target.LastPort-target.FirstPort)+1))
+			// Errors, such as from a full socket buffer, only lose a probe.
+			c.conn.WriteToUDPAddrPort(probe, netip.AddrPortFrom(target.Addr, port))
+			probes++
+
+		case hit := <-hits:
+			if hit.addr.Addr() != target.Addr {
+				continue
+			}
+			s.mu.Lock()
+			if s.sources == nil {
+				s.mu.Unlock()
+				return PunchResult{}, net.ErrClosed
+			}
+			if s.packetFilter {
+				_ = setPacketFilter(hit.c.conn)
+			}
+			s.sources.punched[hit.c] = struct{}{}
+			s.mu.Unlock()
+			winner = hit.c
+			// Let the peer find the path too, if its probes got through
+			// before any of ours did.
+			hit.c.conn.WriteToUDPAddrPort(probe, hit.addr)
+			local := hit.c.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+			return PunchResult{
+				Endpoint: &StdNetEndpoint{AddrPort: hit.addr, via: hit.c},
+				Local:    netip.AddrPortFrom(local.Addr().Unmap(), local.Port()),
+				Remote:   hit.addr,
+			}, nil
+		}
+	}
+}
+
+// openPunchSockets opens n sockets on ephemeral ports, receiving until they
+// are closed.
+func (s *StdNetBind) openPunchSockets(is6 bool, n int, hits chan<- punchHit) ([]*sourceConn, error) {
+	network := "udp4"
+	if is6 {
+		network = "udp6"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sources == nil {
+		return nil, net.ErrClosed
+	}
+	conns := make([]*sourceConn, 0, n)
+	for range n {
+		pc, err := listenConfig().ListenPacket(context.Background(), network, ":0")
+		if err != nil {
+			for _, c := range conns {
+				c.conn.Close()
+			}
+			return nil, err
+		}
+		c := &sourceConn{conn: pc.(*net.UDPConn)}
+		if s.mark != 0 {
+			_ = setMark(c.conn, s.mark)
+		}
+		if runtime.GOOS == "linux" || runtime.GOOS == "android" {
+			if is6 {
+				c.pc = ipv6.NewPacketConn(c.conn)
+			} else {
+				c.pc = ipv4.NewPacketConn(c.conn)
+			}
+		}
+		conns = append(conns, c)
+		go s.sources.receivePunched(c, hits)
+	}
+	return conns, nil
+}
+
+// receivePunched reports the datagrams received on the punch socket c to
+// hits, and queues those that are not probes for the device, from endpoints
+// sending from c, until c is closed.
+func (srcs *sources) receivePunched(c *sourceConn, hits chan<- punchHit) {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := c.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		select {
+		case hits <- punchHit{c, addr}:
+		default:
+		}
+		if n >= len(punchProbeMagic) && [4]byte(buf[:4]) == punchProbeMagic {
+			continue
+		}
+		p := sourcePacket{data: slices.Clone(buf[:n]), ep: &StdNetEndpoint{AddrPort: addr, via: c}}
+		select {
+		case srcs.rx <- p:
+		case <-srcs.closed:
+			return
+		default:
+		}
+	}
+}
+
+// sendVia sends bufs to ep from its punched socket, and reports whether they
+// were sent. A socket that fails to send is closed, and bufs left to the
+// bind's own sockets.
+func (s *StdNetBind) sendVia(bufs [][]byte, ep *StdNetEndpoint) bool {
+	s.mu.Lock()
+	open := s.sources.isPunched(ep.via)
+	s.mu.Unlock()
+	if !open {
+		return false
+	}
+	msgs := s.getMessages()
+	defer s.putMessages(msgs)
+	ua := net.UDPAddrFromAddrPort(ep.AddrPort)
+	for i := range bufs {
+		(*msgs)[i].Addr = ua
+		(*msgs)[i].Buffers[0] = bufs[i]
+	}
+	if err := s.send(ep.via.conn, ep.via.pc, (*msgs)[:len(bufs)]); err != nil {
+		s.Unpunch(ep)
+		return false
+	}
+	return true
+}
+
+func (s *StdNetBind) Unpunch(endpoint Endpoint) {
+	ep, ok := endpoint.(*StdNetEndpoint)
+	if !ok || ep.via == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sources.isPunched(ep.via) {
+		delete(s.sources.punched, ep.via)
+		ep.via.conn.Close()
+	}
+}
+
+// isPunched reports whether c is a punched socket of srcs, which may be
+// nil. The bind's mutex must be held.
+func (srcs *sources) isPunched(c *sourceConn) bool {
+	if srcs == nil {
+		return false
+	}
+	_, ok := srcs.punched[c]
+	return ok
+}
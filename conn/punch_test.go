@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStdNetBindPunch(t *testing.T) {
+	bind := NewStdNetBind().(*StdNetBind)
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	// The peer answers the first probe that reaches it, as if its own
+	// probes had opened its NAT toward the socket sending it.
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peerAddr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+	go func() {
+		buf := make([]byte, 2048)
+		n, from, err := peer.ReadFromUDPAddrPort(buf)
+		if err == nil {
+			peer.WriteToUDPAddrPort(buf[:n], from)
+		}
+	}()
+
+	targets := make(chan PunchTarget, 1)
+	targets <- PunchTarget{Addr: peerAddr.Addr(), FirstPort: peerAddr.Port(), LastPort: peerAddr.Port()}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := bind.Punch(ctx, targets, PunchOptions{Sockets: 4, Probes: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Remote != peerAddr || result.Endpoint.DstToString() != peerAddr.String() {
+		t.Errorf("punched to %v, endpoint %s, want %v", result.Remote, result.Endpoint.DstToString(), peerAddr)
+	}
+
+	// Datagrams to the endpoint leave from the punched socket.
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message := bytes.Repeat([]byte{4}, 32)
+	if err := bind.Send([][]byte{message}, result.Endpoint); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := peer.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(buf[:n], punchProbeMagic[:]) {
+			continue // the confirming probe
+		}
+		if from.Port() != result.Local.Port() {
+			t.Errorf("sent from port %d, want the punched %d", from.Port(), result.Local.Port())
+		}
+		break
+	}
+
+	// Datagrams from the peer over the path reach the device.
+	if _, err := peer.WriteToUDPAddrPort(message, result.Local); err != nil {
+		t.Fatal(err)
+	}
+	bufs := [][]byte{make([]byte, 2048)}
+	sizes := make([]int, 1)
+	eps := make([]Endpoint, 1)
+	if _, err := fns[len(fns)-1](bufs, sizes, eps); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bufs[0][:sizes[0]], message) {
+		t.Errorf("received %x, want %x", bufs[0][:sizes[0]], message)
+	}
+	if ep, ok := eps[0].(*StdNetEndpoint); !ok || ep.via == nil || ep.AddrPort != peerAddr {
+		t.Errorf("received from %v, want %v over the punched socket", eps[0], peerAddr)
+	}
+
+	// Once unpunched, datagrams to the endpoint leave from the bind's own
+	// socket.
+	bind.Unpunch(result.Endpoint)
+	bind.mu.Lock()
+	punched := len(bind.sources.punched)
+	bind.mu.Unlock()
+	if punched != 0 {
+		t.Errorf("%d punched sockets left open", punched)
+	}
+	if err := bind.Send([][]byte{message}, result.Endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if _, from, err := peer.ReadFromUDPAddrPort(buf); err != nil {
+		t.Fatal(err)
+	} else if from.Port() == result.Local.Port() {
+		t.Error("sent from the unpunched socket")
+	}
+
+	// A closed target channel leaves Punch waiting until ctx is done.
+	close(targets)
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := bind.Punch(short, targets, PunchOptions{}); err != context.DeadlineExceeded {
+		t.Errorf("Punch without targets: %v", err)
+	}
+	invalid := make(chan PunchTarget, 1)
+	invalid <- PunchTarget{FirstPort: 2}
+	if _, err := bind.Punch(ctx, invalid, PunchOptions{}); err == nil {
+		t.Error("Punch to an invalid target succeeded")
+	}
+}
@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Command wireguard-relay runs a relay server for conn.RelayBind, forwarding
+// packets between peers over UDP and TCP on the same port.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"github.com/darkit/wireguard/conn/relay"
+)
+
+func main() {
+	listen := flag.String("listen", ":51821", "address to listen on, for both UDP and TCP")
+	verbose := flag.Bool("v", false, "log registrations and forwarding errors")
+	flag.Parse()
+
+	var server relay.Server
+	if *verbose {
+		server.Logf = log.Printf
+	}
+	pc, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("relaying on %v", *listen)
+	errs := make(chan error, 2)
+	go func() { errs <- server.ServeUDP(pc) }()
+	go func() { errs <- server.ServeTCP(ln) }()
+	log.Fatal(<-errs)
+}
@@ -0,0 +1,301 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package relay implements a relay that forwards WireGuard packets between
+// peers which cannot reach each other directly, in the spirit of Tailscale's
+// DERP servers. Peers register with the relay under their public key and
+// address packets to each other by public key. The relay never decrypts
+// anything: it only sees which keys talk to each other, and how much.
+//
+// Registration is not authenticated. A client can register under any key and
+// so divert the packets addressed to it, which denies service to the key's
+// owner but, thanks to WireGuard's cryptography, reveals nothing.
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// KeySize is the size of the public keys that identify peers.
+const KeySize = 32
+
+// A Key is a peer's public key.
+type Key [KeySize]byte
+
+// Frame types.
+const (
+	// FrameRegister registers the sender under the frame's key.
+	// It carries no payload.
+	FrameRegister byte = 1
+
+	// FrameData carries a WireGuard packet. From a client to the relay,
+	// the key is that of the destination; from the relay to a client, it
+	// is that of the source.
+	FrameData byte = 2
+)
+
+// frameMagic starts every frame. WireGuard messages start with their type,
+// which is between 1 and 4, so frames and messages can share a socket.
+const frameMagic = 0xfe
+
+// HeaderSize is the size of the header preceding a frame's payload.
+const HeaderSize = 4 + KeySize
+
+// MaxFrameSize is the size of the largest frame.
+const MaxFrameSize = HeaderSize + 65535
+
+const (
+	// RegisterInterval is how often clients renew their registration.
+	RegisterInterval = 10 * time.Second
+
+	// registrationTimeout is how long a registration over UDP lasts
+	// without being renewed.
+	registrationTimeout = 3 * RegisterInterval
+)
+
+var errFrameTooLarge = errors.New("relay frame too large")
+
+// AppendFrame appends a frame of type typ for key with payload to dst.
+func AppendFrame(dst []byte, typ byte, key Key, payload []byte) []byte {
+	dst = append(dst, frameMagic, typ, 0, 0)
+	dst = append(dst, key[:]...)
+	return append(dst, payload...)
+}
+
+// ParseFrame splits b into the type, key and payload of a frame. It reports
+// false if b is not a frame.
+func ParseFrame(b []byte) (typ byte, key Key, payload []byte, ok bool) {
+	if len(b) < HeaderSize || b[0] != frameMagic {
+		return 0, key, nil, false
+	}
+	copy(key[:], b[4:HeaderSize])
+	return b[1], key, b[HeaderSize:], true
+}
+
+// IsFrame reports whether b starts like a frame, as opposed to a WireGuard message.
+func IsFrame(b []byte) bool {
+	return len(b) > 0 && b[0] == frameMagic
+}
+
+// WriteStreamFrame writes frame, as built by AppendFrame, to a stream, such as
+// a TCP connection, behind a two byte length prefix.
+func WriteStreamFrame(w io.Writer, frame []byte) error {
+	if len(frame) > 0xffff {
+		return errFrameTooLarge
+	}
+	buf := make([]byte, 2, 2+len(frame))
+	binary.BigEndian.PutUint16(buf, uint16(len(frame)))
+	_, err := w.Write(append(buf, frame...))
+	return err
+}
+
+// ReadStreamFrame reads a frame written by WriteStreamFrame into buf, which
+// should be MaxFrameSize long, and returns it.
+func ReadStreamFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > len(buf) {
+		return nil, errFrameTooLarge
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// A Server forwards frames between registered clients, over UDP and TCP.
+// The zero value is ready to use.
+type Server struct {
+	// Logf, if non-nil, is used to log registrations and errors.
+	Logf func(format string, args ...any)
+
+	mu      sync.Mutex
+	clients map[Key]*client
+	byAddr  map[netip.AddrPort]Key // UDP clients only
+}
+
+type client struct {
+	// Exactly one of udp and tcp is set.
+	udp     net.PacketConn
+	addr    netip.AddrPort
+	tcp     *tcpClient
+	renewed time.Time
+}
+
+type tcpClient struct {
+	sync.Mutex // serializes writes
+	conn       net.Conn
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+func (s *Server) register(key Key, c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients == nil {
+		s.clients = make(map[Key]*client)
+		s.byAddr = make(map[netip.AddrPort]Key)
+	}
+	old := s.clients[key]
+	if old != nil && old.udp != nil && old.addr != c.addr {
+		delete(s.byAddr, old.addr)
+	}
+	if old == nil || old.addr != c.addr || old.tcp != c.tcp {
+		s.logf("relay: registered %x at %v", key[:4], c)
+	}
+	s.clients[key] = c
+	if c.udp != nil {
+		s.byAddr[c.addr] = key
+	}
+}
+
+func (s *Server) unregisterTCP(key Key, tc *tcpClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.clients[key]; c != nil && c.tcp == tc {
+		delete(s.clients, key)
+	}
+}
+
+// lookup returns the client registered under key, if any.
+func (s *Server) lookup(key Key) *client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clients[key]
+	if c != nil && c.udp != nil && time.Since(c.renewed) > registrationTimeout {
+		delete(s.clients, key)
+		delete(s.byAddr, c.addr)
+		return nil
+	}
+	return c
+}
+
+// Registered reports whether a client is registered under key.
+func (s *Server) Registered(key Key) bool {
+	return s.lookup(key) != nil
+}
+
+// keyOf returns the key registered by the UDP client at addr.
+func (s *Server) keyOf(addr netip.AddrPort) (Key, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.byAddr[addr]
+	return key, ok
+}
+
+// forward sends payload from src to the client registered under dst.
+func (s *Server) forward(src, dst Key, payload []byte) {
+	c := s.lookup(dst)
+	if c == nil {
+		return
+	}
+	frame := AppendFrame(make([]byte, 0, HeaderSize+len(payload)), FrameData, src, payload)
+	var err error
+	if c.udp != nil {
+		_, err = c.udp.WriteTo(frame, net.UDPAddrFromAddrPort(c.addr))
+	} else {
+		c.tcp.Lock()
+		err = WriteStreamFrame(c.tcp.conn, frame)
+		c.tcp.Unlock()
+	}
+	if err != nil {
+		s.logf("relay: forwarding to %x: %v", dst[:4], err)
+	}
+}
+
+func (c *client) String() string {
+	if c.udp != nil {
+		return "udp:" + c.addr.String()
+	}
+	return "tcp:" + c.tcp.conn.RemoteAddr().String()
+}
+
+// ServeUDP relays frames received on pc until reading from it fails.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	buf := make([]byte, MaxFrameSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		addr := udpAddr.AddrPort()
+		typ, key, payload, ok := ParseFrame(buf[:n])
+		if !ok {
+			continue
+		}
+		switch typ {
+		case FrameRegister:
+			s.register(key, &client{udp: pc, addr: addr, renewed: time.Now()})
+		case FrameData:
+			if src, ok := s.keyOf(addr); ok {
+				s.forward(src, key, payload)
+			}
+		}
+	}
+}
+
+// ServeTCP accepts connections on ln and relays the frames received on them
+// until accepting fails.
+func (s *Server) ServeTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	tc := &tcpClient{conn: conn}
+	var (
+		self       Key
+		registered bool
+	)
+	buf := make([]byte, MaxFrameSize)
+	for {
+		frame, err := ReadStreamFrame(conn, buf)
+		if err != nil {
+			if registered {
+				s.unregisterTCP(self, tc)
+			}
+			return
+		}
+		typ, key, payload, ok := ParseFrame(frame)
+		if !ok {
+			continue
+		}
+		switch typ {
+		case FrameRegister:
+			if registered && key != self {
+				s.unregisterTCP(self, tc)
+			}
+			self, registered = key, true
+			s.register(key, &client{tcp: tc, renewed: time.Now()})
+		case FrameData:
+			if registered {
+				s.forward(self, key, payload)
+			}
+		}
+	}
+}
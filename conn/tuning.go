@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"runtime"
+	"slices"
+)
+
+// A StdNetBindOption configures a StdNetBind created by NewStdNetBind.
+type StdNetBindOption func(*StdNetBind)
+
+// WithBusyPoll sets SO_BUSY_POLL on the bind's sockets, so that receiving
+// polls the device queue for up to usec microseconds instead of waiting for
+// an interrupt. It takes effect on Linux only; raising it above the
+// net.core.busy_read sysctl requires CAP_NET_ADMIN.
+func WithBusyPoll(usec int) StdNetBindOption {
+	return func(s *StdNetBind) {
+		s.busyPoll = usec
+	}
+}
+
+// WithReceiveAffinity locks each goroutine receiving from the bind's sockets
+// to its own OS thread, restricted to run on cpus. It takes effect on Linux
+// only.
+func WithReceiveAffinity(cpus []int) StdNetBindOption {
+	return func(s *StdNetBind) {
+		s.affinity = slices.Clone(cpus)
+	}
+}
+
+// Capabilities describes the optional features a Bind applied to its
+// sockets, as far as the platform supported them.
+type Capabilities struct {
+	TxOffload bool // sends coalesce datagrams with UDP GSO
+	RxOffload bool // receives split datagrams coalesced with UDP GRO
+
+	// BusyPoll is the SO_BUSY_POLL timeout, in microseconds, set on all
+	// of the bind's sockets, or zero if it was not set.
+	BusyPoll int
+
+	// PacketFilter is whether the filter of WithPacketFilter is attached to
+	// all of the bind's sockets.
+	PacketFilter bool
+
+	// ReceiveAffinity is the set of CPUs the receive goroutines are pinned
+	// to, or nil if none is pinned. It is set once a goroutine has started
+	// receiving.
+	ReceiveAffinity []int
+}
+
+// CapabilityReporter is implemented by Binds that report the features they
+// applied, such as StdNetBind.
+type CapabilityReporter interface {
+	Capabilities() Capabilities
+}
+
+var _ CapabilityReporter = (*StdNetBind)(nil)
+
+// Capabilities reports the features applied to the bind's open sockets.
+func (s *StdNetBind) Capabilities() Capabilities {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var caps Capabilities
+	if s.ipv4 != nil || s.ipv6 != nil {
+		caps.TxOffload = (s.ipv4 == nil || s.ipv4TxOffload) && (s.ipv6 == nil || s.ipv6TxOffload)
+		caps.RxOffload = (s.ipv4 == nil || s.ipv4RxOffload) && (s.ipv6 == nil || s.ipv6RxOffload)
+		caps.BusyPoll = s.busyPollApplied
+		caps.PacketFilter = s.packetFilterApplied
+	}
+	if s.affinityApplied.Load() {
+		caps.ReceiveAffinity = slices.Clone(s.affinity)
+	}
+	return caps
+}
+
+// applyBusyPoll sets the configured SO_BUSY_POLL timeout on conns, recording
+// it as applied if all of them accepted it.
+func (s *StdNetBind) applyBusyPoll(conns ...*net.UDPConn) {
+	s.busyPollApplied = 0
+	if s.busyPoll <= 0 {
+		return
+	}
+	for _, conn := range conns {
+		if conn != nil && setBusyPoll(conn, s.busyPoll) != nil {
+			return
+		}
+	}
+	s.busyPollApplied = s.busyPoll
+}
+
+// pinReceiveThread locks the calling goroutine to its OS thread and restricts
+// the thread to the configured CPUs. The goroutine must never be unlocked,
+// so that the thread is discarded when it exits instead of being reused
+// with the restricted affinity.
+func (s *StdNetBind) pinReceiveThread() {
+	if len(s.affinity) == 0 {
+		return
+	}
+	runtime.LockOSThread()
+	if err := setThreadAffinity(s.affinity); err != nil {
+		runtime.UnlockOSThread()
+		return
+	}
+	s.affinityApplied.Store(true)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+func setBusyPoll(conn *net.UDPConn, usec int) error {
+	return errors.ErrUnsupported
+}
+
+func setThreadAffinity(cpus []int) error {
+	return errors.ErrUnsupported
+}
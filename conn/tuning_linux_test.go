@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestStdNetBindTuning(t *testing.T) {
+	var allowed unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &allowed); err != nil {
+		t.Fatal(err)
+	}
+	cpu := 0
+	for !allowed.IsSet(cpu) {
+		cpu++
+	}
+
+	bind := NewStdNetBind(WithBusyPoll(50), WithReceiveAffinity([]int{cpu})).(*StdNetBind)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	caps := bind.Capabilities()
+	var busyPoll int
+	rc, _ := bind.ipv4.SyscallConn()
+	rc.Control(func(fd uintptr) {
+		busyPoll, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BUSY_POLL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.BusyPoll != busyPoll || (busyPoll != 0 && busyPoll != 50) {
+		t.Errorf("busy poll reported as %d, set to %d; want both 50, or 0 without CAP_NET_ADMIN", caps.BusyPoll, busyPoll)
+	}
+	if caps.ReceiveAffinity != nil {
+		t.Errorf("receive affinity %v before receiving, want none", caps.ReceiveAffinity)
+	}
+
+	sender, err := net.Dial("udp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan unix.CPUSet)
+	go func() {
+		bufs := make([][]byte, IdealBatchSize)
+		for i := range bufs {
+			bufs[i] = make([]byte, 16)
+		}
+		var set unix.CPUSet
+		if _, err := fns[0](bufs, make([]int, len(bufs)), make([]Endpoint, len(bufs))); err == nil {
+			unix.SchedGetaffinity(0, &set)
+		}
+		done <- set
+	}()
+	set := <-done
+	if set.Count() != 1 || !set.IsSet(cpu) {
+		t.Errorf("receive thread may run on %d CPUs, want only CPU %d", set.Count(), cpu)
+	}
+	if got := bind.Capabilities().ReceiveAffinity; !slices.Equal(got, []int{cpu}) {
+		t.Errorf("receive affinity reported as %v, want [%d]", got, cpu)
+	}
+}
@@ -0,0 +1,51 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// parseAddrPort parses an endpoint of the form "ip:port". IPv6 link-local
+// addresses may carry a zone naming the interface to send on, either by name
+// or by index, as in "[fe80::1%eth0]:51820" or "[fe80::1%2]:51820". Zones
+// are rejected on any other address, as the kernel ignores them there, and
+// zones naming no interface are rejected rather than sent without a scope.
+func parseAddrPort(s string) (netip.AddrPort, error) {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
+	}
+	zone := ap.Addr().Zone()
+	if zone == "" {
+		return ap, nil
+	}
+	if addr := ap.Addr(); !addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() {
+		return netip.AddrPort{}, fmt.Errorf("%w: zone %q on non-link-local address %v", ErrInvalidEndpoint, zone, addr.WithZone(""))
+	}
+	if _, err := zoneIndex(zone); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
+	}
+	return ap, nil
+}
+
+// zoneIndex returns the index of the interface zone names, by name or index.
+func zoneIndex(zone string) (int, error) {
+	if index, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		if index == 0 {
+			return 0, fmt.Errorf("zone index %q", zone)
+		}
+		return int(index), nil
+	}
+	ifi, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0, fmt.Errorf("zone %q: %w", zone, err)
+	}
+	return ifi.Index, nil
+}
@@ -188,6 +188,39 @@ func (trie parentIndirection) insert(ip []byte, cidr uint8, peer *Peer) {
 	}
 }
 
+func (node *trieEntry) remove() {
+	node.removeFromPeerEntries()
+	node.peer = nil
+	if node.child[0] != nil && node.child[1] != nil {
+		return
+	}
+	bit := 0
+	if node.child[0] == nil {
+		bit = 1
+	}
+	child := node.child[bit]
+	if child != nil {
+		child.parent = node.parent
+	}
+	*node.parent.parentBit = child
+	if node.child[0] != nil || node.child[1] != nil || node.parent.parentBitType > 1 {
+		node.zeroizePointers()
+		return
+	}
+	parent := (*trieEntry)(unsafe.Pointer(uintptr(unsafe.Pointer(node.parent.parentBit)) - unsafe.Offsetof(node.child) - unsafe.Sizeof(node.child[0])*uintptr(node.parent.parentBitType)))
+	if parent.peer != nil {
+		node.zeroizePointers()
+		return
+	}
+	child = parent.child[node.parent.parentBitType^1]
+	if child != nil {
+		child.parent = parent.parent
+	}
+	*parent.parent.parentBit = child
+	node.zeroizePointers()
+	parent.zeroizePointers()
+}
+
 func (node *trieEntry) lookup(ip []byte) *Peer {
 	var found *Peer
 	size := uint8(len(ip))
@@ -207,6 +240,7 @@ func (node *trieEntry) lookup(ip []byte) *Peer {
 type AllowedIPs struct {
 	IPv4  *trieEntry
 	IPv6  *trieEntry
+	count int // number of prefixes assigned to a peer
 	mutex sync.RWMutex
 }
 
@@ -227,48 +261,128 @@ func (table *AllowedIPs) RemoveByPeer(peer *Peer) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
+	table.count -= peer.trieEntries.Len()
 	var next *list.Element
 	for elem := peer.trieEntries.Front(); elem != nil; elem = next {
 		next = elem.Next()
-		node := elem.Value.(*trieEntry)
+		elem.Value.(*trieEntry).remove()
+	}
+}
 
-		node.removeFromPeerEntries()
-		node.peer = nil
-		if node.child[0] != nil && node.child[1] != nil {
-			continue
-		}
-		bit := 0
-		if node.child[0] == nil {
-			bit = 1
-		}
-		child := node.child[bit]
-		if child != nil {
-			child.parent = node.parent
-		}
-		*node.parent.parentBit = child
-		if node.child[0] != nil || node.child[1] != nil || node.parent.parentBitType > 1 {
-			node.zeroizePointers()
-			continue
-		}
-		parent := (*trieEntry)(unsafe.Pointer(uintptr(unsafe.Pointer(node.parent.parentBit)) - unsafe.Offsetof(node.child) - unsafe.Sizeof(node.child[0])*uintptr(node.parent.parentBitType)))
-		if parent.peer != nil {
-			node.zeroizePointers()
-			continue
-		}
-		child = parent.child[node.parent.parentBitType^1]
-		if child != nil {
-			child.parent = parent.parent
-		}
-		*parent.parent.parentBit = child
-		node.zeroizePointers()
-		parent.zeroizePointers()
+// Remove removes prefix from the table if it is assigned to peer.
+func (table *AllowedIPs) Remove(prefix netip.Prefix, peer *Peer) {
+	table.removeExact(prefix, peer)
+}
+
+// removeExact removes prefix, leaving the prefixes it covers, and fails with
+// ErrAllowedIPNotFound if it is not in the table, or ErrAllowedIPNotOwned if
+// it is assigned to a peer other than peer.
+func (table *AllowedIPs) removeExact(prefix netip.Prefix, peer *Peer) error {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	var node *trieEntry
+	var exact bool
+	if prefix.Addr().Is6() {
+		ip := prefix.Addr().As16()
+		node, exact = table.IPv6.nodePlacement(ip[:], uint8(prefix.Bits()))
+	} else if prefix.Addr().Is4() {
+		ip := prefix.Addr().As4()
+		node, exact = table.IPv4.nodePlacement(ip[:], uint8(prefix.Bits()))
+	} else {
+		panic(errors.New("removing unknown address type"))
 	}
+	switch {
+	case !exact || node == nil || node.peer == nil:
+		return ErrAllowedIPNotFound
+	case node.peer != peer:
+		return ErrAllowedIPNotOwned
+	}
+	table.count--
+	node.remove()
+	return nil
 }
 
 func (table *AllowedIPs) Insert(prefix netip.Prefix, peer *Peer) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
+	table.insertLocked(prefix, peer)
+}
+
+// insertLimited is like Insert, but fails if the insertion would give peer more
+// than perPeer prefixes or the table more than total prefixes. Limits of zero
+// mean unlimited. It returns the peer that previously owned prefix, if any.
+func (table *AllowedIPs) insertLimited(prefix netip.Prefix, peer *Peer, perPeer, total int) (*Peer, error) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	owner := table.ownerLocked(prefix)
+	if owner == peer {
+		return owner, nil
+	}
+	if perPeer > 0 && peer.trieEntries.Len() >= perPeer {
+		return owner, ErrTooManyAllowedIPsPerPeer
+	}
+	if owner == nil && total > 0 && table.count >= total {
+		return owner, ErrTooManyAllowedIPs
+	}
+	table.insertLocked(prefix, peer)
+	return owner, nil
+}
+
+// replaceLimited makes prefixes, which must be masked, the prefixes assigned
+// to peer, taking them from other peers. It removes and inserts only the
+// prefixes that differ from peer's current ones, under a single lock, so
+// lookups see either the old assignment or the new one. Like insertLimited,
+// it fails, changing nothing, if the replacement would exceed perPeer or
+// grow the table beyond total.
+func (table *AllowedIPs) replaceLimited(peer *Peer, prefixes []netip.Prefix, perPeer, total int) error {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	want := make(map[netip.Prefix]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		want[prefix] = true
+	}
+	if perPeer > 0 && len(want) > perPeer {
+		return ErrTooManyAllowedIPsPerPeer
+	}
+	var stale []*trieEntry
+	for elem := peer.trieEntries.Front(); elem != nil; elem = elem.Next() {
+		node := elem.Value.(*trieEntry)
+		a, _ := netip.AddrFromSlice(node.bits)
+		prefix := netip.PrefixFrom(a, int(node.cidr))
+		if want[prefix] {
+			delete(want, prefix)
+		} else {
+			stale = append(stale, node)
+		}
+	}
+	count := table.count - len(stale)
+	for prefix := range want {
+		if table.ownerLocked(prefix) == nil {
+			count++
+		}
+	}
+	if total > 0 && count > total && count > table.count {
+		return ErrTooManyAllowedIPs
+	}
+
+	table.count -= len(stale)
+	for _, node := range stale {
+		node.remove()
+	}
+	for prefix := range want {
+		table.insertLocked(prefix, peer)
+	}
+	return nil
+}
+
+func (table *AllowedIPs) insertLocked(prefix netip.Prefix, peer *Peer) {
+	if table.ownerLocked(prefix) == nil {
+		table.count++
+	}
 	if prefix.Addr().Is6() {
 		ip := prefix.Addr().As16()
 		parentIndirection{&table.IPv6, 2}.insert(ip[:], uint8(prefix.Bits()), peer)
@@ -280,6 +394,33 @@ func (table *AllowedIPs) Insert(prefix netip.Prefix, peer *Peer) {
 	}
 }
 
+// ownerLocked returns the peer that prefix is assigned to exactly, or nil.
+func (table *AllowedIPs) ownerLocked(prefix netip.Prefix) *Peer {
+	var root *trieEntry
+	var ip []byte
+	if prefix.Addr().Is6() {
+		a := prefix.Addr().As16()
+		root, ip = table.IPv6, a[:]
+	} else if prefix.Addr().Is4() {
+		a := prefix.Addr().As4()
+		root, ip = table.IPv4, a[:]
+	} else {
+		return nil
+	}
+	node, exact := root.nodePlacement(ip, uint8(prefix.Bits()))
+	if !exact {
+		return nil
+	}
+	return node.peer
+}
+
+// Len returns the number of prefixes in the table.
+func (table *AllowedIPs) Len() int {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.count
+}
+
 func (table *AllowedIPs) Lookup(ip []byte) *Peer {
 	table.mutex.RLock()
 	defer table.mutex.RUnlock()
@@ -6,9 +6,11 @@
 package device
 
 import (
+	"errors"
 	"math/rand"
 	"net"
 	"net/netip"
+	"strings"
 	"testing"
 )
 
@@ -176,6 +178,22 @@ func TestTrieIPv4(t *testing.T) {
 	allowedIPs.RemoveByPeer(a)
 
 	assertNEQ(a, 192, 168, 0, 1)
+
+	remove := func(peer *Peer, a, b, c, d byte, cidr uint8) {
+		allowedIPs.Remove(netip.PrefixFrom(netip.AddrFrom4([4]byte{a, b, c, d}), int(cidr)), peer)
+	}
+
+	insert(a, 192, 168, 0, 0, 16)
+	insert(b, 192, 168, 0, 0, 24)
+	remove(a, 192, 168, 0, 0, 24)
+	assertEQ(b, 192, 168, 0, 1)
+	remove(b, 192, 168, 0, 0, 24)
+	assertEQ(a, 192, 168, 0, 1)
+	remove(a, 192, 168, 0, 0, 16)
+	assertNEQ(a, 192, 168, 0, 1)
+	if allowedIPs.IPv4 != nil || allowedIPs.Len() != 0 {
+		t.Error("Expected removing all the prefixes to empty trie, but it did not")
+	}
 }
 
 /* Test ported from kernel implementation:
@@ -245,3 +263,221 @@ func TestTrieIPv6(t *testing.T) {
 	assertEQ(h, 0x24046800, 0x40040800, 0x10101010, 0x10101010)
 	assertEQ(a, 0x24046800, 0x40040800, 0xdeadbeef, 0xdeadbeef)
 }
+
+// replaceTestPrefixes returns n /32 prefixes, of which those with indices
+// below changed differ between the generations gen.
+func replaceTestPrefixes(n, changed, gen int) []netip.Prefix {
+	prefixes := make([]netip.Prefix, n)
+	for i := range prefixes {
+		a := [4]byte{10, byte(i >> 8), byte(i), 0}
+		if i < changed {
+			a[0], a[3] = 11, byte(gen)
+		}
+		prefixes[i] = netip.PrefixFrom(netip.AddrFrom4(a), 32)
+	}
+	return prefixes
+}
+
+func TestAllowedIPsReplace(t *testing.T) {
+	a := &Peer{}
+	b := &Peer{}
+	var table AllowedIPs
+	table.Insert(netip.MustParsePrefix("192.168.0.0/16"), a)
+	table.Insert(netip.MustParsePrefix("10.0.0.0/8"), a)
+	table.Insert(netip.MustParsePrefix("172.16.0.0/12"), b)
+
+	// Lookups of a prefix the peer keeps must never miss.
+	stop := make(chan struct{})
+	missed := make(chan bool)
+	go func() {
+		ip := net.IPv4(10, 1, 2, 3).To4()
+		for {
+			select {
+			case <-stop:
+				missed <- false
+				return
+			default:
+			}
+			if table.Lookup(ip) != a {
+				missed <- true
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+		if i%2 == 0 {
+			want = append(want, netip.MustParsePrefix("172.16.0.0/12"))
+		}
+		if err := table.replaceLimited(a, want, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	if <-missed {
+		t.Error("lookup of an unchanged prefix missed during replacement")
+	}
+
+	got := make(map[netip.Prefix]bool)
+	table.EntriesForPeer(a, func(prefix netip.Prefix) bool {
+		got[prefix] = true
+		return true
+	})
+	if len(got) != 2 || !got[netip.MustParsePrefix("10.0.0.0/8")] || !got[netip.MustParsePrefix("2001:db8::/32")] {
+		t.Errorf("peer has prefixes %v after replacement", got)
+	}
+	if peer := table.Lookup(net.IPv4(192, 168, 1, 1).To4()); peer != nil {
+		t.Error("removed prefix still routed")
+	}
+	if peer := table.Lookup(net.IPv4(172, 16, 1, 1).To4()); peer != nil {
+		t.Error("prefix taken from another peer and then removed still routed")
+	}
+	if n := table.Len(); n != 2 {
+		t.Errorf("table has %d prefixes, want 2", n)
+	}
+
+	// Limits are checked before anything changes.
+	if err := table.replaceLimited(a, replaceTestPrefixes(3, 0, 0), 2, 0); err != ErrTooManyAllowedIPsPerPeer {
+		t.Errorf("replacing beyond the per-peer limit: %v", err)
+	}
+	if err := table.replaceLimited(a, replaceTestPrefixes(3, 0, 0), 0, 2); err != ErrTooManyAllowedIPs {
+		t.Errorf("replacing beyond the total limit: %v", err)
+	}
+	if n := table.Len(); n != 2 {
+		t.Errorf("table has %d prefixes after failed replacements, want 2", n)
+	}
+}
+
+func TestAllowedIPsRemoveExact(t *testing.T) {
+	a := &Peer{}
+	b := &Peer{}
+	var table AllowedIPs
+	table.Insert(netip.MustParsePrefix("10.0.0.0/8"), a)
+	table.Insert(netip.MustParsePrefix("10.1.0.0/16"), a)
+	table.Insert(netip.MustParsePrefix("10.2.0.0/16"), b)
+
+	// Removing a covering prefix leaves the more specific ones.
+	if err := table.removeExact(netip.MustParsePrefix("10.0.0.0/8"), a); err != nil {
+		t.Fatal(err)
+	}
+	if peer := table.Lookup(net.IPv4(10, 1, 2, 3).To4()); peer != a {
+		t.Error("more specific prefix no longer routed after removing a covering one")
+	}
+	if peer := table.Lookup(net.IPv4(10, 2, 2, 3).To4()); peer != b {
+		t.Error("prefix of another peer no longer routed")
+	}
+	if peer := table.Lookup(net.IPv4(10, 3, 2, 3).To4()); peer != nil {
+		t.Error("removed prefix still routed")
+	}
+	if n := table.Len(); n != 2 {
+		t.Errorf("table has %d prefixes, want 2", n)
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		want   error
+	}{
+		{"10.0.0.0/8", ErrAllowedIPNotFound},    // already removed
+		{"10.1.0.0/24", ErrAllowedIPNotFound},   // only covered
+		{"10.2.0.0/16", ErrAllowedIPNotOwned},   // another peer's
+		{"2001:db8::/32", ErrAllowedIPNotFound}, // empty family
+	} {
+		if err := table.removeExact(netip.MustParsePrefix(tt.prefix), a); err != tt.want {
+			t.Errorf("removing %s: %v, want %v", tt.prefix, err, tt.want)
+		}
+	}
+	if n := table.Len(); n != 2 {
+		t.Errorf("table has %d prefixes after failed removals, want 2", n)
+	}
+}
+
+func TestRemoveAllowedIP(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", pk.Hex(),
+		"allowed_ip", "10.0.0.0/8",
+		"allowed_ip", "10.1.0.0/16",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+
+	if err := dev.IpcSet(uapiCfg("public_key", pk.Hex(), "remove_allowed_ip", "10.0.0.0/8")); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.allowedips.Lookup(net.IPv4(10, 1, 2, 3).To4()); got != peer {
+		t.Error("more specific prefix no longer routed after removing a covering one")
+	}
+	if got := dev.allowedips.Lookup(net.IPv4(10, 3, 2, 3).To4()); got != nil {
+		t.Error("removed prefix still routed")
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(cfg, "allowed_ip=10.0.0.0/8\n") || !strings.Contains(cfg, "allowed_ip=10.1.0.0/16\n") {
+		t.Errorf("IpcGet after removal:\n%s", cfg)
+	}
+
+	// Prefixes that are missing or not the peer's are errors.
+	for _, prefix := range []string{"10.0.0.0/8", "10.1.2.0/24", "bogus"} {
+		err := dev.IpcSet(uapiCfg("public_key", pk.Hex(), "remove_allowed_ip", prefix))
+		if err == nil {
+			t.Errorf("removing %s succeeded", prefix)
+		}
+	}
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AddAllowedIP(netip.MustParsePrefix("192.168.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.RemoveAllowedIP(pk, netip.MustParsePrefix("192.168.0.0/16")); !errors.Is(err, ErrAllowedIPNotOwned) {
+		t.Errorf("removing another peer's prefix: %v", err)
+	}
+	if err := dev.RemoveAllowedIP(NoisePublicKey{2}, netip.MustParsePrefix("10.1.0.0/16")); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("removing from a missing peer: %v", err)
+	}
+	if err := dev.RemoveAllowedIP(pk, netip.MustParsePrefix("10.1.0.1/16")); err != nil {
+		t.Errorf("removing an unmasked prefix: %v", err)
+	}
+	if got := dev.allowedips.Lookup(net.IPv4(10, 1, 2, 3).To4()); got != nil {
+		t.Error("removed prefix still routed")
+	}
+}
+
+func BenchmarkAllowedIPsReplace(b *testing.B) {
+	const n = 10000
+	const changed = n / 100
+	b.Run("diff", func(b *testing.B) {
+		peer := &Peer{}
+		var table AllowedIPs
+		table.replaceLimited(peer, replaceTestPrefixes(n, changed, 0), 0, 0)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			table.replaceLimited(peer, replaceTestPrefixes(n, changed, i+1), 0, 0)
+		}
+	})
+	b.Run("reinsert", func(b *testing.B) {
+		peer := &Peer{}
+		var table AllowedIPs
+		for _, prefix := range replaceTestPrefixes(n, changed, 0) {
+			table.Insert(prefix, peer)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			table.RemoveByPeer(peer)
+			for _, prefix := range replaceTestPrefixes(n, changed, i+1) {
+				table.Insert(prefix, peer)
+			}
+		}
+	})
+}
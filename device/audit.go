@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// UnknownInitiationAuditInterval is the minimum time between two audit
+// records for the same source address.
+const UnknownInitiationAuditInterval = time.Second
+
+// An UnknownInitiationReason describes why a handshake initiation was rejected.
+type UnknownInitiationReason int
+
+const (
+	// UnknownInitiationInvalidMAC1 means the initiation was not addressed to our
+	// public key, which usually indicates the client has the wrong server key.
+	UnknownInitiationInvalidMAC1 UnknownInitiationReason = iota
+	// UnknownInitiationUndecryptable means the initiator's static key could not be decrypted.
+	UnknownInitiationUndecryptable
+	// UnknownInitiationUnknownPeer means the initiator's static key is not a configured peer.
+	UnknownInitiationUnknownPeer
+)
+
+func (reason UnknownInitiationReason) String() string {
+	switch reason {
+	case UnknownInitiationInvalidMAC1:
+		return "invalid_mac1"
+	case UnknownInitiationUndecryptable:
+		return "undecryptable"
+	case UnknownInitiationUnknownPeer:
+		return "unknown_peer"
+	}
+	return "unknown"
+}
+
+// An UnknownInitiation records a handshake initiation rejected because it did not
+// come from a configured peer.
+type UnknownInitiation struct {
+	Time     time.Time
+	Source   netip.AddrPort
+	Reason   UnknownInitiationReason
+	Claimed  NoisePublicKey // static key claimed by the initiator, if Reason is UnknownInitiationUnknownPeer
+	Repeated uint64         // initiations from Source suppressed by rate limiting since the previous record
+}
+
+type initiationAudit struct {
+	enabled atomic.Bool
+	sync.Mutex
+	entries    []UnknownInitiation // ring buffer
+	next       int
+	full       bool
+	lastSource map[netip.Addr]*auditSource
+}
+
+type auditSource struct {
+	last       time.Time
+	suppressed uint64
+}
+
+// SetUnknownInitiationAudit enables recording of the most recent size handshake
+// initiations that were rejected because they did not come from a configured
+// peer. Records are rate-limited per source address. A size of zero disables
+// the audit and discards any records.
+func (device *Device) SetUnknownInitiationAudit(size int) {
+	audit := &device.audit
+	audit.Lock()
+	defer audit.Unlock()
+	if size <= 0 {
+		audit.enabled.Store(false)
+		audit.entries = nil
+		audit.lastSource = nil
+		audit.next, audit.full = 0, false
+		return
+	}
+	old := audit.recentLocked()
+	audit.entries = make([]UnknownInitiation, size)
+	audit.next, audit.full = 0, false
+	if len(old) > size {
+		old = old[len(old)-size:]
+	}
+	for _, entry := range old {
+		audit.appendLocked(entry)
+	}
+	if audit.lastSource == nil {
+		audit.lastSource = make(map[netip.Addr]*auditSource)
+	}
+	audit.enabled.Store(true)
+}
+
+// RecentUnknownInitiations returns the audited rejected initiations, oldest first.
+func (device *Device) RecentUnknownInitiations() []UnknownInitiation {
+	device.audit.Lock()
+	defer device.audit.Unlock()
+	return device.audit.recentLocked()
+}
+
+func (audit *initiationAudit) recentLocked() []UnknownInitiation {
+	if !audit.full {
+		return append([]UnknownInitiation(nil), audit.entries[:audit.next]...)
+	}
+	entries := make([]UnknownInitiation, 0, len(audit.entries))
+	entries = append(entries, audit.entries[audit.next:]...)
+	return append(entries, audit.entries[:audit.next]...)
+}
+
+func (audit *initiationAudit) appendLocked(entry UnknownInitiation) {
+	audit.entries[audit.next] = entry
+	audit.next++
+	if audit.next == len(audit.entries) {
+		audit.next = 0
+		audit.full = true
+	}
+}
+
+// auditUnknownInitiation records a rejected initiation if auditing is enabled.
+func (device *Device) auditUnknownInitiation(endpoint conn.Endpoint, reason UnknownInitiationReason, claimed *NoisePublicKey) {
+	audit := &device.audit
+	if !audit.enabled.Load() {
+		return
+	}
+	source, _ := netip.ParseAddrPort(endpoint.DstToString())
+	now := time.Now()
+
+	audit.Lock()
+	defer audit.Unlock()
+	if !audit.enabled.Load() {
+		return
+	}
+	addr := endpoint.DstIP()
+	state := audit.lastSource[addr]
+	if state != nil && now.Sub(state.last) < UnknownInitiationAuditInterval {
+		state.suppressed++
+		return
+	}
+	if state == nil {
+		if len(audit.lastSource) >= 4*len(audit.entries) {
+			for addr, state := range audit.lastSource {
+				if now.Sub(state.last) >= UnknownInitiationAuditInterval {
+					delete(audit.lastSource, addr)
+				}
+			}
+			if len(audit.lastSource) >= 4*len(audit.entries) {
+				return
+			}
+		}
+		state = new(auditSource)
+		audit.lastSource[addr] = state
+	}
+	entry := UnknownInitiation{
+		Time:     now,
+		Source:   source,
+		Reason:   reason,
+		Repeated: state.suppressed,
+	}
+	if claimed != nil {
+		entry.Claimed = *claimed
+	}
+	state.last = now
+	state.suppressed = 0
+	audit.appendLocked(entry)
+	device.log.Verbosef("Rejected handshake initiation from %s: %v", endpoint.DstToString(), reason)
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+func TestUnknownInitiationAudit(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// dev2 knows dev1, but dev1 has never heard of dev2.
+	peer, err := dev2.NewPeer(dev1.staticIdentity.publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Start()
+	msg, err := dev2.CreateMessageInitiation(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, _, _ := dev1.consumeMessageInitiation(msg); p != nil {
+		t.Fatal("initiation from unknown peer was accepted")
+	}
+
+	ep, err := conn.NewStdNetBind().ParseEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Disabled by default.
+	dev1.auditUnknownInitiation(ep, UnknownInitiationUnknownPeer, &dev2.staticIdentity.publicKey)
+	if entries := dev1.RecentUnknownInitiations(); len(entries) != 0 {
+		t.Fatalf("recorded %d entries while disabled", len(entries))
+	}
+
+	dev1.SetUnknownInitiationAudit(2)
+	_, claimed, decrypted := dev1.consumeMessageInitiation(msg)
+	if !decrypted || claimed != dev2.staticIdentity.publicKey {
+		t.Fatal("failed to recover claimed static key")
+	}
+	dev1.auditUnknownInitiation(ep, UnknownInitiationUnknownPeer, &claimed)
+	dev1.auditUnknownInitiation(ep, UnknownInitiationUnknownPeer, &claimed) // rate limited
+
+	entries := dev1.RecentUnknownInitiations()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if entries[0].Source != netip.MustParseAddrPort("192.0.2.1:51820") || entries[0].Claimed != claimed {
+		t.Errorf("unexpected entry: %+v", entries[0])
+	}
+
+	for _, addr := range []string{"192.0.2.2:1", "192.0.2.3:1"} {
+		ep, _ := conn.NewStdNetBind().ParseEndpoint(addr)
+		dev1.auditUnknownInitiation(ep, UnknownInitiationInvalidMAC1, nil)
+	}
+	entries = dev1.RecentUnknownInitiations()
+	if len(entries) != 2 || entries[0].Source.String() != "192.0.2.2:1" || entries[1].Source.String() != "192.0.2.3:1" {
+		t.Fatalf("ring buffer did not keep the most recent entries: %+v", entries)
+	}
+
+	out, err := dev1.IpcDebug("unknown_initiations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "unknown_initiation_endpoint=192.0.2.3:1\n") || !strings.Contains(out, "reason=invalid_mac1\n") {
+		t.Errorf("unexpected debug output:\n%s", out)
+	}
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "time"
+
+// DefaultHandshakeBackoffMax is the longest a peer is left in handshake
+// backoff unless SetHandshakeBackoff sets another cap.
+const DefaultHandshakeBackoffMax = 15 * time.Minute
+
+// SetHandshakeBackoff sets the cap of handshake backoff. Once a peer has
+// failed MaxTimerHandshakes retries in a row, instead of starting another
+// round of retries whenever there is traffic for it, the device sends it a
+// single initiation, at most once per backoff interval, which starts at
+// 2×RekeyTimeout and doubles with every unanswered initiation up to max.
+// Any packet from the peer ends its backoff. A max of zero or less disables
+// backoff, restoring the retries every RekeyTimeout of the protocol.
+func (device *Device) SetHandshakeBackoff(max time.Duration) {
+	if max <= 0 {
+		max = -1
+	}
+	device.handshakeBackoffMax.Store(int64(max))
+	if max > 0 {
+		return
+	}
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.endHandshakeBackoff()
+	}
+}
+
+// HandshakeBackoffMax returns the cap of handshake backoff, or zero if
+// backoff is disabled.
+func (device *Device) HandshakeBackoffMax() time.Duration {
+	switch max := time.Duration(device.handshakeBackoffMax.Load()); {
+	case max == 0:
+		return DefaultHandshakeBackoffMax
+	case max < 0:
+		return 0
+	default:
+		return max
+	}
+}
+
+// HandshakeBackoff returns the number of failed handshakes with the peer
+// since it entered handshake backoff, counting the round of retries that put
+// it there as one, and the earliest time the next initiation may be sent.
+// failures is zero if the peer is not in backoff.
+func (peer *Peer) HandshakeBackoff() (failures int, next time.Time) {
+	failures = int(peer.timers.backoffFailures.Load())
+	if failures == 0 {
+		return 0, time.Time{}
+	}
+	return failures, time.Unix(0, peer.timers.backoffUntil.Load())
+}
+
+// inHandshakeBackoff reports whether the peer is in handshake backoff.
+func (peer *Peer) inHandshakeBackoff() bool {
+	return peer.timers.backoffFailures.Load() > 0
+}
+
+// handshakeBackoffPending reports whether the peer is in handshake backoff
+// and must not be sent an initiation yet.
+func (peer *Peer) handshakeBackoffPending() bool {
+	return peer.inHandshakeBackoff() && time.Now().UnixNano() < peer.timers.backoffUntil.Load()
+}
+
+// extendHandshakeBackoff records a failed handshake, putting the peer in
+// backoff or doubling its backoff interval, and returns the new interval,
+// or zero if backoff is disabled.
+func (peer *Peer) extendHandshakeBackoff() time.Duration {
+	max := peer.device.HandshakeBackoffMax()
+	if max == 0 {
+		return 0
+	}
+	failures := peer.timers.backoffFailures.Add(1)
+	interval := max
+	if failures < 32 {
+		interval = min(RekeyTimeout<<failures, max)
+	}
+	peer.timers.backoffUntil.Store(time.Now().Add(interval).UnixNano())
+	if failures == 1 {
+		peer.device.emitEvent(EventPeerHandshakeBackoff, peer)
+	}
+	return interval
+}
+
+// endHandshakeBackoff takes the peer out of handshake backoff, if it was in it.
+func (peer *Peer) endHandshakeBackoff() {
+	if peer.timers.backoffFailures.Swap(0) == 0 {
+		return
+	}
+	peer.timers.backoffUntil.Store(0)
+	peer.device.log.Verbosef("%s - Heard from peer, leaving handshake backoff", peer)
+	peer.device.emitEvent(EventPeerHandshakeBackoffEnded, peer)
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeBackoff(t *testing.T) {
+	pair := genTestPair(t, false)
+	events := make(chan Event, 2)
+	pair[0].dev.SetEventHandler(func(event Event) {
+		if event.Type == EventPeerStateChanged {
+			return
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	pair[0].dev.SetHandshakeBackoff(30 * time.Second)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	// Exhaust the retries.
+	peer.timers.handshakeAttempts.Store(MaxTimerHandshakes + 1)
+	expiredRetransmitHandshake(peer)
+	failures, next := peer.HandshakeBackoff()
+	if failures != 1 || time.Until(next) <= RekeyTimeout || time.Until(next) > 2*RekeyTimeout {
+		t.Fatalf("HandshakeBackoff() = %d, %v from now; want 1, %v", failures, time.Until(next), 2*RekeyTimeout)
+	}
+	if event := <-events; event.Type != EventPeerHandshakeBackoff {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	// Traffic does not trigger initiations during backoff.
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Time{}
+	peer.handshake.mutex.Unlock()
+	peer.SendHandshakeInitiation(false)
+	peer.handshake.mutex.RLock()
+	sent := !peer.handshake.lastSentHandshake.IsZero()
+	peer.handshake.mutex.RUnlock()
+	if sent {
+		t.Error("initiation sent during backoff")
+	}
+
+	// Each failure doubles the interval, up to the cap.
+	for _, want := range []time.Duration{20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		expiredRetransmitHandshake(peer)
+		if _, next := peer.HandshakeBackoff(); time.Until(next) > want || time.Until(next) < want-time.Second {
+			t.Errorf("backoff interval %v, want %v", time.Until(next), want)
+		}
+	}
+	cfg, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"handshake_backoff_max=30\n", "handshake_backoff_failures=4\n"} {
+		if !strings.Contains(cfg, line) {
+			t.Errorf("IpcGet output lacks %q:\n%s", line, cfg)
+		}
+	}
+
+	// Once the interval has passed, traffic triggers an initiation, and
+	// the answer ends the backoff.
+	peer.timers.backoffUntil.Store(time.Now().UnixNano())
+	pair.Send(t, Ping, nil)
+	if failures, _ := peer.HandshakeBackoff(); failures != 0 {
+		t.Errorf("still in backoff after hearing from the peer: %d failures", failures)
+	}
+	if event := <-events; event.Type != EventPeerHandshakeBackoffEnded {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	if err := pair[0].dev.IpcSet("handshake_backoff_max=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if max := pair[0].dev.HandshakeBackoffMax(); max != 0 {
+		t.Errorf("HandshakeBackoffMax() = %v after disabling", max)
+	}
+	peer.timers.handshakeAttempts.Store(MaxTimerHandshakes + 1)
+	expiredRetransmitHandshake(peer)
+	if failures, _ := peer.HandshakeBackoff(); failures != 0 {
+		t.Errorf("entered backoff while disabled")
+	}
+}
@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// bootstrapPollInterval is how often Bootstrap.Provision checks whether a
+// handshake with the new key completed.
+const bootstrapPollInterval = 50 * time.Millisecond
+
+var errBootstrapProvisioned = errors.New("bootstrap already provisioned")
+
+// A Bootstrap brings up a device that ships without an identity of its own,
+// such as one flashed in a factory, in two phases. At first, the device has
+// a throwaway private key and a single peer, the bootstrap peer, such as a
+// provisioning server, to which it only responds. Once the bootstrap peer
+// has provisioned the device's identity and configuration over the tunnel,
+// Provision swaps them in without restarting the device, keeping the
+// provisioning channel until the sessions with the new key are live.
+type Bootstrap struct {
+	device *Device
+	peer   PeerConfig
+	key    NoisePrivateKey // the throwaway key, to roll back to
+}
+
+// NewBootstrap gives device a throwaway private key and peer as its only
+// peer, removing any others. The peer is passive, so the device waits for it
+// to initiate the first handshake, for which it must be told the throwaway
+// public key, returned by PublicKey.
+func NewBootstrap(device *Device, peer PeerConfig) (*Bootstrap, error) {
+	key, err := newPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := device.SetPrivateKey(key); err != nil {
+		return nil, err
+	}
+	if _, err := device.Reconcile(Config{Peers: []PeerConfig{peer}}); err != nil {
+		return nil, err
+	}
+	device.LookupPeer(peer.PublicKey).SetPassive(true)
+	return &Bootstrap{device: device, peer: peer, key: key}, nil
+}
+
+// PublicKey returns the throwaway public key of the device.
+func (b *Bootstrap) PublicKey() NoisePublicKey {
+	return b.key.PublicKey()
+}
+
+// Provision swaps in the identity of the device, sk, and its configuration.
+// It rotates the private key with RotatePrivateKey and applies config with
+// Reconcile, keeping the bootstrap peer and its session alongside the peers
+// of config. Once a handshake with the bootstrap peer completes with the new
+// key, which the bootstrap peer must have been told, it applies config
+// alone, removing the bootstrap peer unless config has it.
+//
+// If ctx is done before the handshake completes, the device is rolled back
+// to the throwaway key and the bootstrap peer, whose session it kept, and
+// Provision returns an error wrapping ctx's, so that it can be retried.
+func (b *Bootstrap) Provision(ctx context.Context, sk NoisePrivateKey, config Config) error {
+	if b.key.IsZero() {
+		return errBootstrapProvisioned
+	}
+	device := b.device
+	staged := Config{Peers: config.Peers}
+	if !slices.ContainsFunc(config.Peers, b.isBootstrapPeer) {
+		// Ahead of the others, for them to take the allowed IPs they share.
+		staged.Peers = append([]PeerConfig{b.stagedPeer()}, config.Peers...)
+	}
+
+	if err := device.RotatePrivateKey(sk); err != nil {
+		return err
+	}
+	rotated := time.Now()
+	if _, err := device.Reconcile(staged); err != nil {
+		b.rollBack()
+		return err
+	}
+	if err := b.awaitHandshake(ctx, rotated); err != nil {
+		b.rollBack()
+		return fmt.Errorf("no handshake with the bootstrap peer using the new key: %w", err)
+	}
+	device.log.Verbosef("Bootstrap: Handshake with the new key complete, applying the provisioned configuration")
+	if _, err := device.Reconcile(Config{Peers: config.Peers}); err != nil {
+		return err
+	}
+	if peer := device.LookupPeer(b.peer.PublicKey); peer != nil {
+		peer.SetPassive(false)
+	}
+	setZero(b.key[:])
+	return nil
+}
+
+func (b *Bootstrap) isBootstrapPeer(config PeerConfig) bool {
+	return config.PublicKey.Equals(b.peer.PublicKey)
+}
+
+// stagedPeer returns the config of the bootstrap peer, leaving its endpoint
+// where it reached the device from.
+func (b *Bootstrap) stagedPeer() PeerConfig {
+	config := b.peer
+	config.Endpoint = ""
+	return config
+}
+
+// awaitHandshake waits until a handshake with the bootstrap peer completes
+// after since.
+func (b *Bootstrap) awaitHandshake(ctx context.Context, since time.Time) error {
+	ticker := time.NewTicker(bootstrapPollInterval)
+	defer ticker.Stop()
+	for {
+		if peer := b.device.LookupPeer(b.peer.PublicKey); peer != nil && peer.lastHandshakeNano.Load() > since.UnixNano() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollBack restores the throwaway key and the bootstrap peer.
+func (b *Bootstrap) rollBack() {
+	device := b.device
+	device.log.Errorf("Bootstrap: Rolling back to the throwaway key")
+	if _, err := device.Reconcile(Config{Peers: []PeerConfig{b.stagedPeer()}}); err != nil {
+		device.log.Errorf("Bootstrap: Unable to restore the bootstrap peer: %v", err)
+	}
+	if peer := device.LookupPeer(b.peer.PublicKey); peer != nil {
+		peer.SetPassive(true)
+	}
+	if err := device.RotatePrivateKey(b.key); err != nil {
+		device.log.Errorf("Bootstrap: Unable to restore the throwaway key: %v", err)
+	}
+}
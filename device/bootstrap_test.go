@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRotatePrivateKey(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	keypair := peer.keypairs.Current()
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.RotatePrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	if dev.staticIdentity.publicKey != sk.PublicKey() {
+		t.Fatal("private key not rotated")
+	}
+	// The other device does not know the new key, yet the session made with
+	// the old one carries traffic both ways.
+	if peer.keypairs.Current() != keypair || keypair.sendNonce.Load() >= RejectAfterMessages {
+		t.Error("session expired by the rotation")
+	}
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+	peer.handshake.mutex.RLock()
+	state := peer.handshake.state
+	peer.handshake.mutex.RUnlock()
+	if state != handshakeInitiationCreated {
+		t.Errorf("handshake state %v after the rotation, want an initiation with the new key", state)
+	}
+
+	if err := dev.RotatePrivateKey(NoisePrivateKey{}); !errors.Is(err, ErrZeroKey) {
+		t.Errorf("RotatePrivateKey of the zero key: %v", err)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev, server := pair[0].dev, pair[1].dev
+	serverKey := server.staticIdentity.publicKey
+	factoryKey := dev.staticIdentity.publicKey
+
+	b, err := NewBootstrap(dev, PeerConfig{
+		PublicKey:  serverKey,
+		AllowedIPs: []netip.Prefix{netip.MustParsePrefix("1.0.0.2/32")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.PublicKey() == factoryKey || dev.staticIdentity.publicKey != b.PublicKey() {
+		t.Fatal("no throwaway key")
+	}
+	// The server learns the throwaway key out of band, and reaches the
+	// device, which only responds.
+	devEndpoint := fmt.Sprintf("127.0.0.1:%d", dev.net.port)
+	devIP := []netip.Prefix{netip.MustParsePrefix("1.0.0.1/32")}
+	if _, err := server.Reconcile(Config{Peers: []PeerConfig{
+		{PublicKey: b.PublicKey(), Endpoint: devEndpoint, AllowedIPs: devIP},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Peers: []PeerConfig{{
+		PublicKey:                   serverKey,
+		PersistentKeepaliveInterval: 25 * time.Second,
+		AllowedIPs:                  []netip.Prefix{netip.MustParsePrefix("1.0.0.2/32")},
+	}}}
+
+	// Provisioning fails while the server does not accept the new key, and
+	// the device keeps its channel to the server with the throwaway key.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := b.Provision(ctx, sk, config); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Provision without the server accepting the new key: %v", err)
+	}
+	if dev.staticIdentity.publicKey != b.PublicKey() {
+		t.Fatal("throwaway key not restored")
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// Once the server accepts the new key, the device handshakes with it
+	// over the channel it still has.
+	if _, err := server.Reconcile(Config{Peers: []PeerConfig{
+		{PublicKey: b.PublicKey()},
+		{PublicKey: sk.PublicKey(), Endpoint: devEndpoint, AllowedIPs: devIP},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := b.Provision(ctx, sk, config); err != nil {
+		t.Fatal(err)
+	}
+	if dev.staticIdentity.publicKey != sk.PublicKey() {
+		t.Fatal("provisioned key not in use")
+	}
+	peer := dev.LookupPeer(serverKey)
+	if peer.persistentKeepaliveInterval.Load() != 25 || peer.passive.Load() {
+		t.Error("provisioned configuration not applied to the bootstrap peer")
+	}
+	if server.LookupPeer(sk.PublicKey()).lastHandshakeNano.Load() == 0 {
+		t.Error("no handshake with the provisioned key")
+	}
+	// The server drops the throwaway key, and the tunnel carries on.
+	server.RemovePeer(b.PublicKey())
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	if err := b.Provision(ctx, sk, config); !errors.Is(err, errBootstrapProvisioned) {
+		t.Errorf("second Provision: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+func TestChannelBindDevices(t *testing.T) {
+	cfg, _ := genConfigs(t)
+	ids := [2]conn.ChannelEndpoint{{15: 1}, {15: 2}}
+	var tx, rx [2]chan conn.Datagram
+	var binds [2]*conn.ChannelBind
+	var pair testPair
+	for i := range pair {
+		tx[i], rx[i] = make(chan conn.Datagram, 16), make(chan conn.Datagram, 16)
+		binds[i] = conn.NewChannelBind(tx[i], rx[i])
+		p := &pair[i]
+		p.tun = tuntest.NewChannelTUN()
+		p.ip = netip.AddrFrom4([4]byte{1, 0, 0, byte(i + 1)})
+		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(LogLevelVerbose, fmt.Sprintf("dev%d: ", i)))
+		t.Cleanup(p.dev.Close)
+		if err := p.dev.IpcSet(cfg[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range pair {
+		pk := pair[i^1].dev.staticIdentity.publicKey
+		if err := pair[i].dev.IpcSet(uapiCfg("public_key", pk.Hex(), "endpoint", ids[i^1].DstToString())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The application shuttles datagrams between the devices, rewriting
+	// their endpoints to that of the sender, until stalled.
+	stall := make(chan struct{})
+	shuttled := make(chan struct{})
+	go func() {
+		defer close(shuttled)
+		for {
+			select {
+			case d := <-tx[0]:
+				rx[1] <- conn.Datagram{Endpoint: ids[0], Data: d.Data}
+			case d := <-tx[1]:
+				rx[0] <- conn.Datagram{Endpoint: ids[1], Data: d.Data}
+			case <-stall:
+				return
+			}
+		}
+	}()
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// With nobody reading tx, the device drops what it sends instead of
+	// blocking, and still closes.
+	close(stall)
+	<-shuttled
+	for range 64 {
+		pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for binds[0].Dropped() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if binds[0].Dropped() == 0 {
+		t.Error("no datagrams dropped with tx stalled")
+	}
+	closed := make(chan struct{})
+	go func() {
+		pair[0].dev.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked with tx stalled")
+	}
+}
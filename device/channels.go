@@ -10,40 +10,148 @@ import (
 	"sync"
 )
 
-// An outboundQueue is a channel of QueueOutboundElements awaiting encryption.
+// An outboundQueue holds QueueOutboundElementsContainers awaiting encryption,
+// in a queue of at most size containers per peer. The encryption workers take
+// them from the peers by deficit round robin, weighing them by the bytes of
+// their packets, so that a peer sending in bulk delays the packets of the
+// others by a round at most, rather than by everything it has queued.
 // An outboundQueue is ref-counted using its wg field.
 // An outboundQueue created with newOutboundQueue has one reference.
 // Every additional writer must call wg.Add(1).
 // Every completed writer must call wg.Done().
 // When no further writers will be added,
 // call wg.Done to remove the initial reference.
-// When the refcount hits 0, the queue's channel is closed.
+// When the refcount hits 0, the queue is closed,
+// and next fails once it has been drained.
 type outboundQueue struct {
-	c  chan *QueueOutboundElementsContainer
-	wg sync.WaitGroup
+	mu       sync.Mutex
+	nonEmpty sync.Cond // signalled when a container is queued or the queue closes
+	nonFull  sync.Cond // broadcast when a container is taken
+	flows    map[*Peer]*outboundFlow
+	active   []*outboundFlow // flows with containers, in round robin order
+	queued   int
+	size     int
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// An outboundFlow is the queue of a peer in an outboundQueue.
+type outboundFlow struct {
+	peer       *Peer
+	containers []*QueueOutboundElementsContainer
+	deficit    int // bytes the flow may still send in this round
 }
 
-func newOutboundQueue() *outboundQueue {
+// outboundQuantum is the share of a flow in each round, in bytes, the size
+// of a full message. A flow starts with its share of the current round.
+const outboundQuantum = MaxMessageSize
+
+func newOutboundQueue(size int) *outboundQueue {
 	q := &outboundQueue{
-		c: make(chan *QueueOutboundElementsContainer, QueueOutboundSize),
+		flows: make(map[*Peer]*outboundFlow),
+		size:  size,
 	}
+	q.nonEmpty.L = &q.mu
+	q.nonFull.L = &q.mu
 	q.wg.Add(1)
 	go func() {
 		q.wg.Wait()
-		close(q.c)
+		q.mu.Lock()
+		q.closed = true
+		q.mu.Unlock()
+		q.nonEmpty.Broadcast()
 	}()
 	return q
 }
 
+// push queues elemsContainer, whose elements are to be sent to peer,
+// waiting while the peer's queue is full.
+func (q *outboundQueue) push(peer *Peer, elemsContainer *QueueOutboundElementsContainer) {
+	q.mu.Lock()
+	flow := q.flows[peer]
+	for flow != nil && len(flow.containers) >= q.size {
+		q.nonFull.Wait()
+		flow = q.flows[peer]
+	}
+	if flow == nil {
+		flow = &outboundFlow{peer: peer, deficit: outboundQuantum}
+		q.flows[peer] = flow
+		q.active = append(q.active, flow)
+	}
+	flow.containers = append(flow.containers, elemsContainer)
+	q.queued++
+	q.mu.Unlock()
+	q.nonEmpty.Signal()
+}
+
+// next returns the next container to encrypt, waiting for one to be queued,
+// or false once the queue is closed and drained.
+func (q *outboundQueue) next() (*QueueOutboundElementsContainer, bool) {
+	q.mu.Lock()
+	for q.queued == 0 {
+		if q.closed {
+			q.mu.Unlock()
+			return nil, false
+		}
+		q.nonEmpty.Wait()
+	}
+	for {
+		flow := q.active[0]
+		head := flow.containers[0]
+		cost := outboundCost(head)
+		if flow.deficit < cost {
+			// The flow has spent its share of this round, so it is given
+			// its share of the next and goes after the others.
+			flow.deficit += outboundQuantum
+			q.active = append(q.active[1:], flow)
+			continue
+		}
+		flow.deficit -= cost
+		flow.containers[0] = nil
+		flow.containers = flow.containers[1:]
+		q.queued--
+		if len(flow.containers) == 0 {
+			// An idle flow does not keep its deficit.
+			delete(q.flows, flow.peer)
+			q.active = q.active[1:]
+		}
+		q.mu.Unlock()
+		q.nonFull.Broadcast()
+		return head, true
+	}
+}
+
+// deepest returns the number of containers queued for the peer with the
+// most of them.
+func (q *outboundQueue) deepest() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, flow := range q.flows {
+		n = max(n, len(flow.containers))
+	}
+	return n
+}
+
+// outboundCost returns the bytes that elemsContainer counts for in the round
+// robin: those of its packets, and the transport overhead of each.
+func outboundCost(elemsContainer *QueueOutboundElementsContainer) int {
+	cost := 0
+	for _, elem := range elemsContainer.elems {
+		cost += len(elem.packet) + MessageTransportSize
+	}
+	return cost
+}
+
 // A inboundQueue is similar to an outboundQueue; see those docs.
 type inboundQueue struct {
 	c  chan *QueueInboundElementsContainer
 	wg sync.WaitGroup
 }
 
-func newInboundQueue() *inboundQueue {
+func newInboundQueue(size int) *inboundQueue {
 	q := &inboundQueue{
-		c: make(chan *QueueInboundElementsContainer, QueueInboundSize),
+		c: make(chan *QueueInboundElementsContainer, size),
 	}
 	q.wg.Add(1)
 	go func() {
@@ -54,23 +162,55 @@ func newInboundQueue() *inboundQueue {
 }
 
 // A handshakeQueue is similar to an outboundQueue; see those docs.
+// Handshakes of established peers go to priority, which is served first,
+// so that they are not stuck behind a flood filling c.
 type handshakeQueue struct {
-	c  chan QueueHandshakeElement
-	wg sync.WaitGroup
+	c        chan QueueHandshakeElement
+	priority chan QueueHandshakeElement
+	wg       sync.WaitGroup
 }
 
-func newHandshakeQueue() *handshakeQueue {
+func newHandshakeQueue(size int) *handshakeQueue {
 	q := &handshakeQueue{
-		c: make(chan QueueHandshakeElement, QueueHandshakeSize),
+		c:        make(chan QueueHandshakeElement, size),
+		priority: make(chan QueueHandshakeElement, QueueHandshakePrioritySize),
 	}
 	q.wg.Add(1)
 	go func() {
 		q.wg.Wait()
+		close(q.priority)
 		close(q.c)
 	}()
 	return q
 }
 
+// next returns the next element to handle, taking those in priority first,
+// or false once the queue is closed and drained.
+func (q *handshakeQueue) next() (QueueHandshakeElement, bool) {
+	select {
+	case elem, ok := <-q.priority:
+		if ok {
+			return elem, true
+		}
+	default:
+	}
+	select {
+	case elem, ok := <-q.priority:
+		if ok {
+			return elem, true
+		}
+		// priority is closed just before c; drain c.
+		elem, ok = <-q.c
+		return elem, ok
+	case elem, ok := <-q.c:
+		if !ok {
+			// priority was closed first, but may hold the last elements.
+			elem, ok = <-q.priority
+		}
+		return elem, ok
+	}
+}
+
 type autodrainingInboundQueue struct {
 	c chan *QueueInboundElementsContainer
 }
@@ -81,7 +221,7 @@ type autodrainingInboundQueue struct {
 // some other means, such as sending a sentinel nil values.
 func newAutodrainingInboundQueue(device *Device) *autodrainingInboundQueue {
 	q := &autodrainingInboundQueue{
-		c: make(chan *QueueInboundElementsContainer, QueueInboundSize),
+		c: make(chan *QueueInboundElementsContainer, device.memory.queueInboundSize),
 	}
 	runtime.SetFinalizer(q, device.flushInboundQueue)
 	return q
@@ -114,7 +254,7 @@ type autodrainingOutboundQueue struct {
 // All sends to the channel must be best-effort, because there may be no receivers.
 func newAutodrainingOutboundQueue(device *Device) *autodrainingOutboundQueue {
 	q := &autodrainingOutboundQueue{
-		c: make(chan *QueueOutboundElementsContainer, QueueOutboundSize),
+		c: make(chan *QueueOutboundElementsContainer, device.memory.queueOutboundSize),
 	}
 	runtime.SetFinalizer(q, device.flushOutboundQueue)
 	return q
@@ -0,0 +1,186 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// testContainer returns a locked container of n packets of size bytes.
+func testContainer(n, size int) *QueueOutboundElementsContainer {
+	elemsContainer := &QueueOutboundElementsContainer{}
+	for i := 0; i < n; i++ {
+		elemsContainer.elems = append(elemsContainer.elems, &QueueOutboundElement{packet: make([]byte, size)})
+	}
+	elemsContainer.Lock()
+	return elemsContainer
+}
+
+func TestOutboundQueueFairness(t *testing.T) {
+	q := newOutboundQueue(64)
+	bulk, ping := new(Peer), new(Peer)
+	var bulkContainers []*QueueOutboundElementsContainer
+	for i := 0; i < 32; i++ {
+		elemsContainer := testContainer(16, 1420)
+		bulkContainers = append(bulkContainers, elemsContainer)
+		q.push(bulk, elemsContainer)
+	}
+	pingContainer := testContainer(1, 84)
+	q.push(ping, pingContainer)
+
+	// The bulk peer sends its share of the round, a message worth of bytes
+	// and two of its containers, ahead of the ping.
+	var order []*QueueOutboundElementsContainer
+	for i := 0; i < 33; i++ {
+		elemsContainer, ok := q.next()
+		if !ok {
+			t.Fatal("queue closed early")
+		}
+		order = append(order, elemsContainer)
+	}
+	if i := slices.Index(order, pingContainer); i != 2 {
+		t.Errorf("ping dequeued at position %d, want 2", i)
+	}
+	order = slices.DeleteFunc(order, func(c *QueueOutboundElementsContainer) bool { return c == pingContainer })
+	if !slices.Equal(order, bulkContainers) {
+		t.Error("bulk containers reordered")
+	}
+	if len(q.flows) != 0 || len(q.active) != 0 {
+		t.Errorf("%d flows left in a drained queue", len(q.flows))
+	}
+
+	q.wg.Done()
+	if _, ok := q.next(); ok {
+		t.Error("next succeeded on a closed queue")
+	}
+}
+
+func TestOutboundQueueBackpressure(t *testing.T) {
+	q := newOutboundQueue(2)
+	bulk, ping := new(Peer), new(Peer)
+	q.push(bulk, testContainer(1, 100))
+	q.push(bulk, testContainer(1, 100))
+
+	// A peer's full queue does not hold up the others.
+	q.push(ping, testContainer(1, 100))
+	if n := q.deepest(); n != 2 {
+		t.Errorf("deepest queue holds %d containers, want 2", n)
+	}
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(bulk, testContainer(1, 100))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push to a full queue did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.next()
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push to a full queue still waiting after a container was taken")
+	}
+
+	// Closing the queue drains it first.
+	q.wg.Done()
+	for i := 0; i < 3; i++ {
+		if _, ok := q.next(); !ok {
+			t.Fatalf("next failed with %d containers left", 3-i)
+		}
+	}
+	if _, ok := q.next(); ok {
+		t.Error("next succeeded on a drained closed queue")
+	}
+}
+
+// BenchmarkOutboundQueueLatency measures how long the packet of a peer
+// sending a ping at a time waits to be encrypted while another peer sends
+// in bulk, with a single FIFO for all peers and with the outboundQueue.
+func BenchmarkOutboundQueueLatency(b *testing.B) {
+	const workers = 2
+	encrypt := func(next func() (*QueueOutboundElementsContainer, bool), done *sync.WaitGroup) {
+		defer done.Done()
+		aead, _ := chacha20poly1305.New(make([]byte, chacha20poly1305.KeySize))
+		var nonce [chacha20poly1305.NonceSize]byte
+		out := make([]byte, 0, MaxMessageSize)
+		for {
+			elemsContainer, ok := next()
+			if !ok {
+				return
+			}
+			for _, elem := range elemsContainer.elems {
+				out = aead.Seal(out[:0], nonce[:], elem.packet, nil)
+			}
+			elemsContainer.Unlock()
+		}
+	}
+
+	run := func(b *testing.B, push func(peer *Peer, elemsContainer *QueueOutboundElementsContainer), next func() (*QueueOutboundElementsContainer, bool), closeQueue func()) {
+		var done sync.WaitGroup
+		done.Add(workers)
+		for i := 0; i < workers; i++ {
+			go encrypt(next, &done)
+		}
+		bulk, ping := new(Peer), new(Peer)
+		stop := make(chan struct{})
+		bulkDone := make(chan struct{})
+		go func() {
+			defer close(bulkDone)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				push(bulk, testContainer(16, 1420))
+			}
+		}()
+		time.Sleep(10 * time.Millisecond) // let the bulk peer fill the queue
+
+		latencies := make([]time.Duration, 0, b.N)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			elemsContainer := testContainer(1, 84)
+			start := time.Now()
+			push(ping, elemsContainer)
+			elemsContainer.Lock() // as the sequential sender waits for it
+			latencies = append(latencies, time.Since(start))
+		}
+		b.StopTimer()
+		slices.Sort(latencies)
+		b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+
+		close(stop)
+		// Drain the queue for the bulk peer's last push.
+		go func() {
+			<-bulkDone
+			closeQueue()
+		}()
+		done.Wait()
+	}
+
+	b.Run("fifo", func(b *testing.B) {
+		c := make(chan *QueueOutboundElementsContainer, QueueOutboundSize)
+		run(b, func(_ *Peer, elemsContainer *QueueOutboundElementsContainer) {
+			c <- elemsContainer
+		}, func() (*QueueOutboundElementsContainer, bool) {
+			elemsContainer, ok := <-c
+			return elemsContainer, ok
+		}, func() { close(c) })
+	})
+	b.Run("fair", func(b *testing.B) {
+		q := newOutboundQueue(QueueOutboundSize)
+		run(b, q.push, q.next, q.wg.Done)
+	})
+}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A CipherSuite is the AEAD that encrypts the transport data messages of
+// the sessions with a peer. The handshake is the same with every suite, and
+// always uses ChaCha20-Poly1305.
+type CipherSuite int32
+
+const (
+	// CipherChaCha20Poly1305 is the AEAD of the WireGuard protocol, and
+	// the default. Building with the purego tag replaces the assembly of
+	// its x/crypto implementation with portable Go.
+	CipherChaCha20Poly1305 CipherSuite = iota
+	// CipherAES256GCM is an experiment for hardware with AES instructions
+	// but slow ChaCha20. It is not part of the WireGuard protocol: nothing
+	// on the wire selects it, so both sides must be configured with it, and
+	// a peer that is not, including every other WireGuard implementation,
+	// completes handshakes but discards all data. The keys of its sessions
+	// are not wiped when they expire; see zeroize.go.
+	CipherAES256GCM
+)
+
+func (s CipherSuite) String() string {
+	switch s {
+	case CipherChaCha20Poly1305:
+		return "chacha20poly1305"
+	case CipherAES256GCM:
+		return "aes256gcm"
+	}
+	return fmt.Sprintf("CipherSuite(%d)", int(s))
+}
+
+// ParseCipherSuite parses the string form of a CipherSuite.
+func ParseCipherSuite(s string) (CipherSuite, error) {
+	for suite := CipherChaCha20Poly1305; suite <= CipherAES256GCM; suite++ {
+		if s == suite.String() {
+			return suite, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid cipher suite %q", s)
+}
+
+// newAEAD returns the AEAD of the suite with a 32 byte key. Both suites
+// take the 12 byte nonce and add the 16 byte tag of the transport messages.
+func (s CipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s {
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, fmt.Errorf("invalid cipher suite %v", s)
+}
+
+// SetCipherSuite selects the AEAD of the transport data messages of the
+// sessions established with the peer from now on. The peer must select the
+// same suite for us; see CipherAES256GCM.
+func (peer *Peer) SetCipherSuite(suite CipherSuite) error {
+	if suite < CipherChaCha20Poly1305 || suite > CipherAES256GCM {
+		return fmt.Errorf("invalid cipher suite %v", suite)
+	}
+	peer.cipherSuite.Store(int32(suite))
+	return nil
+}
+
+// CipherSuite returns the suite set by SetCipherSuite.
+func (peer *Peer) CipherSuite() CipherSuite {
+	return CipherSuite(peer.cipherSuite.Load())
+}
@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun/tuntest"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestCipherSuite(t *testing.T) {
+	for _, suite := range []CipherSuite{CipherChaCha20Poly1305, CipherAES256GCM} {
+		if got, err := ParseCipherSuite(suite.String()); err != nil || got != suite {
+			t.Errorf("ParseCipherSuite(%q) = %v, %v", suite, got, err)
+		}
+	}
+	if _, err := ParseCipherSuite("aes128gcm"); err == nil {
+		t.Error("ParseCipherSuite accepted an unknown suite")
+	}
+
+	// setSuites configures the peers of the pair with the suites over UAPI.
+	setSuites := func(t *testing.T, pair testPair, suites ...CipherSuite) {
+		for i := range pair {
+			pk := pair[i^1].dev.staticIdentity.publicKey
+			if err := pair[i].dev.IpcSet(uapiCfg(
+				"public_key", pk.Hex(),
+				"transport_cipher", suites[i].String(),
+			)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("matching", func(t *testing.T) {
+		pair := genTestPair(t, true)
+		setSuites(t, pair, CipherAES256GCM, CipherAES256GCM)
+		pair.Send(t, Ping, nil)
+		pair.Send(t, Pong, nil)
+		for i := range pair {
+			peer := pair[i].dev.LookupPeer(pair[i^1].dev.staticIdentity.publicKey)
+			if infos := peer.KeypairInfo(); len(infos) == 0 || infos[0].CipherSuite != CipherAES256GCM {
+				t.Errorf("device %d keypairs %+v, want %v", i, infos, CipherAES256GCM)
+			}
+			cfg, err := pair[i].dev.IpcGet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Contains(strings.Split(cfg, "\n"), "transport_cipher=aes256gcm") {
+				t.Errorf("device %d config lacks the transport cipher:\n%s", i, cfg)
+			}
+		}
+	})
+
+	t.Run("mismatched", func(t *testing.T) {
+		pair := genTestPair(t, true)
+		setSuites(t, pair, CipherAES256GCM, CipherChaCha20Poly1305)
+		msg := tuntest.Ping(pair[0].ip, pair[1].ip)
+		timeout := time.After(time.Second)
+		for {
+			pair[1].tun.Outbound <- msg
+			select {
+			case <-pair[0].tun.Inbound:
+				t.Fatal("ping transited between mismatched cipher suites")
+			case <-time.After(100 * time.Millisecond):
+				continue
+			case <-timeout:
+			}
+			break
+		}
+		// The handshake, which is the same with every suite, completed.
+		peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+		if len(peer.KeypairInfo()) == 0 {
+			t.Error("no keypair with mismatched cipher suites")
+		}
+	})
+}
+
+func BenchmarkTransportCipher(b *testing.B) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	rand.Read(key)
+	for _, suite := range []CipherSuite{CipherChaCha20Poly1305, CipherAES256GCM} {
+		aead, err := suite.newAEAD(key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, size := range []int{64, 1420} {
+			packet := make([]byte, size)
+			dst := make([]byte, 0, size+aead.Overhead())
+			var nonce [chacha20poly1305.NonceSize]byte
+			b.Run(fmt.Sprintf("%v/seal/%d", suite, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					binary.LittleEndian.PutUint64(nonce[4:], uint64(i))
+					aead.Seal(dst[:0], nonce[:], packet, nil)
+				}
+			})
+			sealed := aead.Seal(nil, nonce[:], packet, nil)
+			b.Run(fmt.Sprintf("%v/open/%d", suite, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if _, err := aead.Open(dst[:0], nonce[:], sealed, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
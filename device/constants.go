@@ -37,4 +37,6 @@ const (
 const (
 	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
 	MaxPeers           = 1 << 16     // maximum number of configured peers
+
+	QueueHandshakePrioritySize = 64 // handshakes of established peers queued ahead of the rest
 )
@@ -15,6 +15,9 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// A CookieChecker verifies the mac1 and mac2 fields of handshake messages
+// addressed to a public key, and creates cookie replies for them when under
+// load. The zero value must be initialized with Init before use.
 type CookieChecker struct {
 	sync.RWMutex
 	mac1 struct {
@@ -27,6 +30,9 @@ type CookieChecker struct {
 	}
 }
 
+// A CookieGenerator fills in the mac1 and mac2 fields of handshake messages
+// addressed to a public key, using the cookies that key's owner sends in
+// replies. The zero value must be initialized with Init before use.
 type CookieGenerator struct {
 	sync.RWMutex
 	mac1 struct {
@@ -41,6 +47,14 @@ type CookieGenerator struct {
 	}
 }
 
+// NewCookieChecker returns a CookieChecker for messages addressed to pk.
+func NewCookieChecker(pk NoisePublicKey) *CookieChecker {
+	st := new(CookieChecker)
+	st.Init(pk)
+	return st
+}
+
+// Init resets st to check messages addressed to pk.
 func (st *CookieChecker) Init(pk NoisePublicKey) {
 	st.Lock()
 	defer st.Unlock()
@@ -66,11 +80,17 @@ func (st *CookieChecker) Init(pk NoisePublicKey) {
 	st.mac2.secretSet = time.Time{}
 }
 
+// CheckMAC1 reports whether msg, a complete handshake message ending in its
+// mac1 and mac2 fields, carries a valid mac1.
 func (st *CookieChecker) CheckMAC1(msg []byte) bool {
+	size := len(msg)
+	if size < 2*blake2s.Size128 {
+		return false
+	}
+
 	st.RLock()
 	defer st.RUnlock()
 
-	size := len(msg)
 	smac2 := size - blake2s.Size128
 	smac1 := smac2 - blake2s.Size128
 
@@ -170,6 +190,15 @@ func (st *CookieChecker) CreateReply(
 	return reply, nil
 }
 
+// NewCookieGenerator returns a CookieGenerator for messages addressed to pk.
+func NewCookieGenerator(pk NoisePublicKey) *CookieGenerator {
+	st := new(CookieGenerator)
+	st.Init(pk)
+	return st
+}
+
+// Init resets st to generate macs for messages addressed to pk, forgetting
+// any cookie received.
 func (st *CookieGenerator) Init(pk NoisePublicKey) {
 	st.Lock()
 	defer st.Unlock()
@@ -212,6 +241,9 @@ func (st *CookieGenerator) ConsumeReply(msg *MessageCookieReply) bool {
 	return true
 }
 
+// AddMacs sets the mac1 field of msg, a complete handshake message ending in
+// its mac1 and mac2 fields, and also mac2 if a fresh cookie is known.
+// msg must be at least as long as the two fields.
 func (st *CookieGenerator) AddMacs(msg []byte) {
 	size := len(msg)
 
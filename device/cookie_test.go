@@ -6,6 +6,8 @@
 package device
 
 import (
+	"bytes"
+	"encoding/hex"
 	"testing"
 )
 
@@ -188,3 +190,42 @@ func TestCookieMAC1(t *testing.T) {
 		0x7d, 0xa1, 0xd5, 0x85, 0x6d, 0xf0, 0x1b, 0xaa,
 	})
 }
+
+func TestCookieMAC1Vector(t *testing.T) {
+	// mac1 = MAC(HASH(LABEL_MAC1 || Spub), msg up to mac1), computed with
+	// an independent BLAKE2s implementation
+	var pk NoisePublicKey
+	if err := pk.FromHex("e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a"); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := hex.DecodeString("f84245ded466ad96fdb04b27e7e7587c")
+
+	msg := make([]byte, MessageInitiationSize)
+	msg[0] = MessageInitiationType
+	for i := 4; i < MessageInitiationSize-32; i++ {
+		msg[i] = byte(i)
+	}
+	NewCookieGenerator(pk).AddMacs(msg)
+	if mac1 := msg[MessageInitiationSize-32 : MessageInitiationSize-16]; !bytes.Equal(mac1, want) {
+		t.Fatalf("mac1 = %x, want %x", mac1, want)
+	}
+	if mac2 := msg[MessageInitiationSize-16:]; !bytes.Equal(mac2, make([]byte, 16)) {
+		t.Fatalf("mac2 = %x without a cookie, want zeros", mac2)
+	}
+
+	checker := NewCookieChecker(pk)
+	if !checker.CheckMAC1(msg) {
+		t.Fatal("valid mac1 rejected")
+	}
+	msg[8] ^= 1
+	if checker.CheckMAC1(msg) {
+		t.Fatal("mac1 accepted after the message changed")
+	}
+	msg[8] ^= 1
+	if NewCookieChecker(NoisePublicKey{}).CheckMAC1(msg) {
+		t.Fatal("mac1 accepted for another public key")
+	}
+	if checker.CheckMAC1(msg[:31]) {
+		t.Fatal("mac1 accepted for a message too short to hold it")
+	}
+}
@@ -6,6 +6,10 @@
 package device
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -45,17 +49,22 @@ type Device struct {
 		port          uint16 // listening port
 		fwmark        uint32 // mark value (0 = disabled)
 		brokenRoaming bool
+
+		disableOffloads      bool // set by WithOffloadsDisabled
+		offloadFailureLogged bool
 	}
 
 	staticIdentity struct {
 		sync.RWMutex
-		privateKey NoisePrivateKey
+		privateKey NoisePrivateKey // zero if held by custom operations, else what ops points to
 		publicKey  NoisePublicKey
+		ops        *privateKeyOps
 	}
 
 	peers struct {
 		sync.RWMutex // protects keyMap
 		keyMap       map[NoisePublicKey]*Peer
+		generation   atomic.Uint64 // incremented whenever a peer is added or removed
 	}
 
 	rate struct {
@@ -66,6 +75,37 @@ type Device struct {
 	allowedips    AllowedIPs
 	indexTable    IndexTable
 	cookieChecker CookieChecker
+	audit         initiationAudit
+	limits        deviceLimits
+	events        eventHandler
+	drops         outboundDrops
+	malformed     malformedDatagrams
+	mirrors       packetMirrors
+	established   establishedSources
+	loops         routingLoops
+	policies      policies
+
+	watchdogWindow        atomic.Int64  // time.Duration, zero if the peer watchdog is disabled
+	handshakeBackoffMax   atomic.Int64  // time.Duration, zero for the default, negative if disabled
+	handshakeJitter       atomic.Int64  // time.Duration, the most initiations are delayed by
+	sessionMargin         atomic.Int64  // time.Duration, added to DefaultSessionMargin
+	sessionMarginMessages atomic.Uint64 // added to DefaultSessionMarginMessages
+	endpointTTL           atomic.Int64  // time.Duration, zero if learned endpoints are kept forever
+	logDisallowedSources  atomic.Bool
+	sizes                 sizeHistogram
+	peerSizeHistograms    atomic.Bool
+	reorder               atomic.Uint64 // depth<<32 | delay, set by SetReorderBuffer
+
+	memory  memoryLimits
+	workers int              // of each kind, set by WithWorkers
+	clock   func() time.Time // set by WithClock, nil for time.Now
+
+	metricsSink     io.Writer // set by WithMetricsSink
+	metricsInterval time.Duration
+
+	endpointErrors endpointErrors // reported by the bind, awaiting handshake retries
+
+	healthOptions atomic.Pointer[HealthCheckOptions] // nil for the defaults
 
 	pool struct {
 		inboundElementsContainer  *WaitPool
@@ -73,6 +113,7 @@ type Device struct {
 		messageBuffers            *WaitPool
 		inboundElements           *WaitPool
 		outboundElements          *WaitPool
+		batchSize                 int // set by NewDevice
 	}
 
 	queue struct {
@@ -130,9 +171,14 @@ func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 	// stop routing and processing of packets
 	device.allowedips.RemoveByPeer(peer)
 	peer.Stop()
+	peer.unpunch()
+	peer.handshake.mutex.Lock()
+	peer.handshake.zeroize()
+	peer.handshake.mutex.Unlock()
 
 	// remove from peer map
 	delete(device.peers.keyMap, key)
+	device.peers.generation.Add(1)
 }
 
 // changeState attempts to change the device state to match want.
@@ -217,7 +263,7 @@ func (device *Device) Down() error {
 func (device *Device) IsUnderLoad() bool {
 	// check if currently under load
 	now := time.Now()
-	underLoad := len(device.queue.handshake.c) >= QueueHandshakeSize/8
+	underLoad := len(device.queue.handshake.c) >= cap(device.queue.handshake.c)/8
 	if underLoad {
 		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime).UnixNano())
 		return true
@@ -226,13 +272,68 @@ func (device *Device) IsUnderLoad() bool {
 	return device.rate.underLoadUntil.Load() > now.UnixNano()
 }
 
+// SetPrivateKey sets the device's static private key, removing any peer
+// with the matching public key. It refuses an all-zero key with ErrZeroKey.
 func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
+	if sk.isWeak() {
+		return ErrZeroKey
+	}
+	return device.setStaticIdentity(&privateKeyOps{ops: &sk}, false)
+}
+
+// RotatePrivateKey is SetPrivateKey, but stages the change: rather than
+// expiring the sessions of the peers, it keeps them and initiates handshakes
+// with the new key over them at once. Traffic flows over the old sessions
+// until the new ones replace them, so a peer that is told the new public
+// key over the tunnel itself keeps its channel to the device in the
+// meantime. Peers that do not accept the new key keep the old sessions
+// until they expire.
+func (device *Device) RotatePrivateKey(sk NoisePrivateKey) error {
+	if sk.isWeak() {
+		return ErrZeroKey
+	}
+	if err := device.setStaticIdentity(&privateKeyOps{ops: &sk}, true); err != nil {
+		return err
+	}
+	// SendHandshakeInitiation takes the static identity lock, which is
+	// taken before the peers lock.
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+	for _, peer := range peers {
+		if peer.isRunning.Load() && peer.keypairs.Current() != nil {
+			peer.SendHandshakeInitiation(false)
+		}
+	}
+	return nil
+}
+
+// setStaticIdentity makes ops the device's private key operations. An
+// in-memory key, a *NoisePrivateKey, is moved into staticIdentity.privateKey,
+// wiping the caller's copy, and ops is pointed at it there, so that wiping
+// the device's key wipes the one the handshakes use. An in-memory all-zero
+// key removes the private key. The sessions of the peers are expired, unless
+// keepSessions is set.
+func (device *Device) setStaticIdentity(ops *privateKeyOps, keepSessions bool) error {
+	sk, inMemory := ops.backend().(*NoisePrivateKey)
+	if inMemory {
+		defer setZero(sk[:])
+	}
+	publicKey := ops.backend().PublicKey()
+	if !(inMemory && sk.IsZero()) && publicKey.isLowOrder() {
+		return ErrLowOrderKey
+	}
+
 	// lock required resources
 
 	device.staticIdentity.Lock()
 	defer device.staticIdentity.Unlock()
 
-	if sk.Equals(device.staticIdentity.privateKey) {
+	current := device.staticIdentity.ops.backend()
+	if inMemory && current == PrivateKeyOperations(&device.staticIdentity.privateKey) && device.staticIdentity.privateKey.Equals(*sk) {
 		return nil
 	}
 
@@ -247,7 +348,6 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 
 	// remove peers with matching public keys
 
-	publicKey := sk.publicKey()
 	for key, peer := range device.peers.keyMap {
 		if peer.handshake.remoteStatic.Equals(publicKey) {
 			peer.handshake.mutex.RUnlock()
@@ -258,8 +358,14 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 
 	// update key material
 
-	device.staticIdentity.privateKey = sk
+	if inMemory {
+		device.staticIdentity.privateKey = *sk
+		ops.ops = &device.staticIdentity.privateKey
+	} else {
+		setZero(device.staticIdentity.privateKey[:])
+	}
 	device.staticIdentity.publicKey = publicKey
+	device.staticIdentity.ops = ops
 	device.cookieChecker.Init(publicKey)
 
 	// do static-static DH pre-computations
@@ -267,7 +373,7 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	expiredPeers := make([]*Peer, 0, len(device.peers.keyMap))
 	for _, peer := range device.peers.keyMap {
 		handshake := &peer.handshake
-		handshake.precomputedStaticStatic, _ = device.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
+		handshake.precomputedStaticStatic = ops.precompute(handshake.remoteStatic)
 		expiredPeers = append(expiredPeers, peer)
 	}
 
@@ -275,17 +381,38 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 		peer.handshake.mutex.RUnlock()
 	}
 	for _, peer := range expiredPeers {
-		peer.ExpireCurrentKeypairs()
+		if keepSessions {
+			peer.abandonHandshake()
+		} else {
+			peer.ExpireCurrentKeypairs()
+		}
 	}
 
 	return nil
 }
 
-func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
+// New creates a device reading packets from tunDevice and exchanging
+// datagrams with peers over bind, configured by opts. The device is down,
+// without a private key or peers, until configured with IpcSet or its
+// setters and brought up with Up. It is closed once ctx is done, if not
+// before. New fails, leaving tunDevice and bind for the caller to close, if
+// ctx is done already or if any of opts is invalid, before the device starts
+// any goroutine.
+func New(ctx context.Context, tunDevice tun.Device, bind conn.Bind, opts ...Option) (*Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	device := new(Device)
+	device.memory = defaultMemoryLimits()
+	device.workers = runtime.NumCPU()
+	device.log = NewLogger(LogLevelSilent, "")
+	for _, opt := range opts {
+		if err := opt(device); err != nil {
+			return nil, fmt.Errorf("invalid device option: %w", err)
+		}
+	}
 	device.state.state.Store(uint32(deviceStateDown))
 	device.closed = make(chan struct{})
-	device.log = logger
 	device.net.bind = bind
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
@@ -294,6 +421,11 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 		mtu = DefaultMTU
 	}
 	device.tun.mtu.Store(int32(mtu))
+	device.configureBind(bind)
+	device.pool.batchSize = device.BatchSize() // fixed, as SwapBind changes the bind
+	if limit := device.memory.bindBatchSize; limit > 0 {
+		device.pool.batchSize = max(min(bind.BatchSize(), limit), tunDevice.BatchSize())
+	}
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 	device.rate.limiter.Init()
 	device.indexTable.Init()
@@ -302,16 +434,15 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 
 	// create queues
 
-	device.queue.handshake = newHandshakeQueue()
-	device.queue.encryption = newOutboundQueue()
-	device.queue.decryption = newInboundQueue()
+	device.queue.handshake = newHandshakeQueue(device.memory.queueHandshakeSize)
+	device.queue.encryption = newOutboundQueue(device.memory.queueOutboundSize)
+	device.queue.decryption = newInboundQueue(device.memory.queueInboundSize)
 
 	// start workers
 
-	cpus := runtime.NumCPU()
 	device.state.stopping.Wait()
-	device.queue.encryption.wg.Add(cpus) // One for each RoutineHandshake
-	for i := 0; i < cpus; i++ {
+	device.queue.encryption.wg.Add(device.workers) // One for each RoutineHandshake
+	for i := 0; i < device.workers; i++ {
 		go device.RoutineEncryption(i + 1)
 		go device.RoutineDecryption(i + 1)
 		go device.RoutineHandshake(i + 1)
@@ -322,6 +453,35 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
 
+	if device.metricsSink != nil {
+		go device.pushMetrics()
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				device.log.Verbosef("Closing device: %v", context.Cause(ctx))
+				device.Close()
+			case <-device.closed:
+			}
+		}()
+	}
+	return device, nil
+}
+
+// NewDevice creates a device as New does, logging to logger, and without a
+// context to close it. Invalid options are logged and ignored.
+func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger, opts ...Option) *Device {
+	opts = append([]Option{WithLogger(logger)}, opts...)
+	for i, opt := range opts {
+		opts[i] = func(device *Device) error {
+			if err := opt(device); err != nil {
+				device.log.Errorf("Ignoring invalid device option: %v", err)
+			}
+			return nil
+		}
+	}
+	device, _ := New(context.Background(), tunDevice, bind, opts...)
 	return device
 }
 
@@ -330,12 +490,10 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 // is the size used to construct memory pools, and is the allowed batch size for
 // the lifetime of the device.
 func (device *Device) BatchSize() int {
-	size := device.net.bind.BatchSize()
-	dSize := device.tun.device.BatchSize()
-	if size < dSize {
-		size = dSize
+	if size := device.pool.batchSize; size != 0 {
+		return size
 	}
-	return size
+	return max(device.net.bind.BatchSize(), device.tun.device.BatchSize())
 }
 
 func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
@@ -394,6 +552,7 @@ func (device *Device) Close() {
 	device.state.stopping.Wait()
 
 	device.rate.limiter.Close()
+	device.SetMirror(nil)
 
 	device.log.Verbosef("Device closed")
 	close(device.closed)
@@ -420,11 +579,34 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	device.peers.RUnlock()
 }
 
+// configureBind applies the device's settings to bind before it is first
+// opened.
+func (device *Device) configureBind(bind conn.Bind) {
+	// When offloads were turned off on the TUN device, don't coalesce on
+	// the wire either.
+	if reporter, ok := device.tun.device.(tun.OffloadReporter); ok {
+		if setter, ok := bind.(conn.UDPGSOSetter); ok && reporter.Offloads().Disabled {
+			setter.SetUDPGSO(false)
+		}
+	}
+	if device.net.disableOffloads {
+		if bind, ok := bind.(conn.OffloadBind); ok {
+			bind.DisableOffloads()
+		} else {
+			device.log.Errorf("UDP bind: unable to disable offloads: %v", errors.ErrUnsupported)
+		}
+	}
+	if reporter, ok := bind.(conn.EndpointErrorReporter); ok {
+		reporter.SetEndpointErrorHandler(device.handleEndpointError)
+	}
+}
+
 // closeBindLocked closes the device's net.bind.
 // The caller must hold the net mutex.
 func closeBindLocked(device *Device) error {
 	var err error
 	netc := &device.net
+	device.cancelKeepaliveOffloadsLocked()
 	if netc.netlinkCancel != nil {
 		netc.netlinkCancel.Cancel()
 	}
@@ -458,17 +640,26 @@ func (device *Device) BindSetMark(mark uint32) error {
 		}
 	}
 
-	// clear cached source addresses
+	// clear cached source addresses, and restart keepalive offloads, so
+	// that they are sent with the new mark
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.markEndpointSrcForClearing()
 	}
 	device.peers.RUnlock()
+	device.cancelKeepaliveOffloadsLocked()
+	device.refreshKeepaliveOffloadsLocked()
 
 	return nil
 }
 
 func (device *Device) BindUpdate() error {
+	return device.bindUpdate(false)
+}
+
+// bindUpdate reopens the bind's sockets on the listen port, or if anyPort
+// is set and the port is taken, on a new one.
+func (device *Device) bindUpdate(anyPort bool) error {
 	device.net.Lock()
 	defer device.net.Unlock()
 
@@ -481,17 +672,30 @@ func (device *Device) BindUpdate() error {
 	if !device.isUp() {
 		return nil
 	}
+	if err := device.openBindLocked(anyPort); err != nil {
+		return err
+	}
+	device.refreshKeepaliveOffloadsLocked()
+	return nil
+}
 
+// openBindLocked opens the bind's sockets, as bindUpdate describes, and
+// starts receiving from them. The caller must hold the net mutex.
+func (device *Device) openBindLocked(anyPort bool) error {
 	// bind to new port
-	var err error
-	var recvFns []conn.ReceiveFunc
 	netc := &device.net
-
-	recvFns, netc.port, err = netc.bind.Open(netc.port)
+	recvFns, port, err := netc.bind.Open(netc.port)
+	if err != nil && anyPort && netc.port != 0 {
+		device.log.Verbosef("UDP bind: port %d unavailable, choosing another: %v", netc.port, err)
+		recvFns, port, err = netc.bind.Open(0)
+	}
+	netc.port = port
 	if err != nil {
 		netc.port = 0
 		return err
 	}
+	device.loops.port.Store(uint32(netc.port))
+	device.logOffloadFailure()
 
 	netc.netlinkCancel, err = device.startRouteListener(netc.bind)
 	if err != nil {
@@ -519,7 +723,8 @@ func (device *Device) BindUpdate() error {
 	device.net.stopping.Add(len(recvFns))
 	device.queue.decryption.wg.Add(len(recvFns)) // each RoutineReceiveIncoming goroutine writes to device.queue.decryption
 	device.queue.handshake.wg.Add(len(recvFns))  // each RoutineReceiveIncoming goroutine writes to device.queue.handshake
-	batchSize := netc.bind.BatchSize()
+	// A bind given to SwapBind may batch more than the pools were sized for.
+	batchSize := min(netc.bind.BatchSize(), device.BatchSize())
 	for _, fn := range recvFns {
 		go device.RoutineReceiveIncoming(batchSize, fn)
 	}
@@ -528,6 +733,115 @@ func (device *Device) BindUpdate() error {
 	return nil
 }
 
+// RebindTransport closes and reopens the bind's sockets, so that traffic is
+// sent from the addresses of the current network, such as after a mobile
+// application sees a change from Wi-Fi to cellular. The listen port is kept
+// if it is still available, and a new one is chosen otherwise. The sticky
+// sources of the peers' endpoints are cleared, and peers with a current
+// session are sent a handshake initiation right away, so that they learn the
+// new source address. RebindTransport does nothing if the device
+// is down.
+func (device *Device) RebindTransport() error {
+	device.state.Lock()
+	defer device.state.Unlock()
+	if !device.isUp() {
+		return nil
+	}
+	if err := device.bindUpdate(true); err != nil {
+		return err
+	}
+
+	// The sources the peers' endpoints stick to may be gone from the new
+	// network. SendHandshakeInitiation takes the static identity lock, which
+	// is taken before the peers lock, so the peers are sent to unlocked.
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peer.markEndpointSrcForClearing()
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+	for _, peer := range peers {
+		if !peer.isRunning.Load() || peer.keypairs.Current() == nil {
+			continue
+		}
+		peer.handshake.mutex.Lock()
+		peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+		peer.handshake.mutex.Unlock()
+		peer.SendHandshakeInitiation(false)
+	}
+	return nil
+}
+
+// SwapBind replaces the device's bind with bind, such as to move its
+// traffic from UDP to an obfuscating transport, without interrupting the
+// sessions with its peers. If the device is up, the receiving routines are
+// stopped and the old bind closed, and bind is opened on the same port if
+// it is available, or a new one otherwise. The endpoint of each peer is
+// parsed again by bind; peers whose endpoint it rejects are left without
+// one, until they reach the device or are given another. The flow label
+// policy is carried over if bind supports it.
+//
+// The old bind is closed and no longer used by the device, unless bind
+// cannot be opened, in which case the old bind is opened again and the
+// error returned.
+func (device *Device) SwapBind(bind conn.Bind) error {
+	device.state.Lock()
+	defer device.state.Unlock()
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	old := device.net.bind
+	if bind == old {
+		return nil
+	}
+	if err := closeBindLocked(device); err != nil {
+		device.log.Errorf("UDP bind: closing bind being replaced: %v", err)
+	}
+	device.configureBind(bind)
+	if fb, ok := old.(conn.FlowLabelBind); ok {
+		if policy := fb.FlowLabelPolicy(); policy != conn.FlowLabelKernel {
+			if fb, ok := bind.(conn.FlowLabelBind); !ok || fb.SetFlowLabelPolicy(policy) != nil {
+				device.log.Errorf("UDP bind: new bind does not support flow label policy %v", policy)
+			}
+		}
+	}
+
+	device.net.bind = bind
+	if device.isUp() {
+		if err := device.openBindLocked(true); err != nil {
+			device.net.bind = old
+			if err := device.openBindLocked(true); err != nil {
+				device.log.Errorf("UDP bind: reopening replaced bind: %v", err)
+			}
+			device.refreshKeepaliveOffloadsLocked()
+			return err
+		}
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.endpoint.Lock()
+		if val := peer.endpoint.val; val != nil {
+			endpoint, err := bind.ParseEndpoint(val.DstToString())
+			if err != nil {
+				device.log.Errorf("%v - Dropping endpoint %v, not supported by the new bind: %v", peer, val.DstToString(), err)
+				endpoint = nil
+			}
+			peer.endpoint.val = endpoint
+			peer.endpoint.clearSrcOnTx = false
+		}
+		if val := peer.endpoint.configured; val != nil {
+			peer.endpoint.configured, _ = bind.ParseEndpoint(val.DstToString())
+		}
+		peer.endpoint.Unlock()
+		peer.refreshKeepaliveOffloadLocked()
+	}
+	device.log.Verbosef("UDP bind has been replaced")
+	return nil
+}
+
 func (device *Device) BindClose() error {
 	device.net.Lock()
 	err := closeBindLocked(device)
@@ -8,6 +8,7 @@ package device
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -17,6 +18,7 @@ import (
 	"runtime/pprof"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -149,7 +151,7 @@ func (pair *testPair) Send(tb testing.TB, ping SendDirection, done chan struct{}
 }
 
 // genTestPair creates a testPair.
-func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
+func genTestPair(tb testing.TB, realSocket bool, opts ...Option) (pair testPair) {
 	cfg, endpointCfg := genConfigs(tb)
 	var binds [2]conn.Bind
 	if realSocket {
@@ -166,7 +168,7 @@ func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
 		if _, ok := tb.(*testing.B); ok && !testing.Verbose() {
 			level = LogLevelError
 		}
-		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)))
+		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)), opts...)
 		if err := p.dev.IpcSet(cfg[i]); err != nil {
 			tb.Errorf("failed to configure device %d: %v", i, err)
 			p.dev.Close()
@@ -474,3 +476,183 @@ func TestBatchSize(t *testing.T) {
 		t.Errorf("expected batch size %d, got %d", want, got)
 	}
 }
+
+// takenPortBind fails to open on any port but zero once taken is set.
+type takenPortBind struct {
+	conn.Bind
+	taken atomic.Bool
+}
+
+func (b *takenPortBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	if port != 0 && b.taken.Load() {
+		return nil, 0, syscall.EADDRINUSE
+	}
+	return b.Bind.Open(port)
+}
+
+func TestRebindTransport(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	idleSK, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idlePK := idleSK.publicKey()
+	if err := dev.IpcSet(uapiCfg("public_key", idlePK.Hex(), "endpoint", "127.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	idle := dev.LookupPeer(idlePK)
+	port := dev.net.port
+
+	start := time.Now()
+	if err := dev.RebindTransport(); err != nil {
+		t.Fatal(err)
+	}
+	if dev.net.port != port {
+		t.Errorf("listen port changed from %d to %d", port, dev.net.port)
+	}
+	// The sticky sources of the endpoints are dropped, and that of the
+	// peer without a session stays marked until something is sent to it.
+	idle.endpoint.Lock()
+	cleared := idle.endpoint.clearSrcOnTx
+	idle.endpoint.Unlock()
+	if !cleared {
+		t.Errorf("sticky source of an idle peer kept by the rebind")
+	}
+	// The peer with a session is sent an initiation at once, although
+	// the last handshake is recent.
+	peer.handshake.mutex.RLock()
+	sent := peer.handshake.lastSentHandshake
+	peer.handshake.mutex.RUnlock()
+	if sent.Before(start) {
+		t.Errorf("no handshake initiation sent by the rebind")
+	}
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+
+	// Down devices are left alone.
+	dev.Down()
+	if err := dev.RebindTransport(); err != nil {
+		t.Errorf("RebindTransport of a down device: %v", err)
+	}
+	if dev.isUp() {
+		t.Errorf("RebindTransport brought the device up")
+	}
+}
+
+func TestRebindTransportPortTaken(t *testing.T) {
+	bind := &takenPortBind{Bind: conn.NewDefaultBind()}
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bind, NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	port := dev.net.port
+
+	bind.taken.Store(true)
+	if err := dev.RebindTransport(); err != nil {
+		t.Fatalf("RebindTransport with the listen port taken: %v", err)
+	}
+	if dev.net.port == 0 || dev.net.port == port {
+		t.Errorf("listen port %d after rebinding away from %d", dev.net.port, port)
+	}
+}
+
+// parseFailBind is a Bind whose ParseEndpoint or Open fail.
+type parseFailBind struct {
+	conn.Bind
+	openErr error
+}
+
+func (b *parseFailBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return nil, errors.New("unsupported endpoint")
+}
+
+func (b *parseFailBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	if b.openErr != nil {
+		return nil, 0, b.openErr
+	}
+	return b.Bind.Open(port)
+}
+
+func TestSwapBind(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	port := dev.net.port
+	keypair := peer.keypairs.Current()
+
+	bind := conn.NewDefaultBind()
+	if err := dev.SwapBind(bind); err != nil {
+		t.Fatal(err)
+	}
+	if dev.Bind() != bind || dev.net.port != port {
+		t.Errorf("bind %p on port %d, want %p on %d", dev.Bind(), dev.net.port, bind, port)
+	}
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+	if peer.keypairs.Current() != keypair {
+		t.Error("session replaced by the swap")
+	}
+
+	// A bind that cannot be opened is given up on.
+	if err := dev.SwapBind(&parseFailBind{conn.NewDefaultBind(), syscall.EACCES}); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("swapping to a bind failing to open: %v", err)
+	}
+	if dev.Bind() != bind {
+		t.Error("bind failing to open kept")
+	}
+	pair.Send(t, Pong, nil)
+
+	// Endpoints the new bind rejects are dropped, until the peer reaches
+	// the device again.
+	if err := dev.SwapBind(&parseFailBind{Bind: conn.NewDefaultBind()}); err != nil {
+		t.Fatal(err)
+	}
+	peer.endpoint.Lock()
+	endpoint := peer.endpoint.val
+	peer.endpoint.Unlock()
+	if endpoint != nil {
+		t.Errorf("endpoint %v kept", endpoint.DstToString())
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
+func TestSwapBindUnderLoad(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range pair {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := tuntest.Ping(pair[i^1].ip, pair[i].ip)
+			for {
+				select {
+				case pair[i].tun.Outbound <- msg:
+				case <-pair[i^1].tun.Inbound:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	for range 20 {
+		if err := pair[0].dev.SwapBind(conn.NewDefaultBind()); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package devicetest connects pairs of Devices through in-memory TUNs and an
+// in-memory link, for testing code that embeds package device.
+package devicetest
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"github.com/darkit/wireguard/conn/bindtest"
+	"github.com/darkit/wireguard/device"
+	"github.com/darkit/wireguard/tun/netstack"
+)
+
+// A Node is one of the two ends of a pair created by NewPair.
+type Node struct {
+	Device     *device.Device
+	Net        *netstack.Net // the network stack behind the device's TUN
+	Bind       *bindtest.LinkBind
+	Addr       netip.Addr // the tunnel address of Net
+	PrivateKey device.NoisePrivateKey
+	PublicKey  device.NoisePublicKey
+
+	pingTimeout time.Duration
+	pingSeq     atomic.Uint32
+}
+
+type config struct {
+	seed        int64
+	logLevel    int
+	mtu         int
+	pingTimeout time.Duration
+}
+
+// An Option configures NewPair.
+type Option func(*config)
+
+// WithSeed sets the seed of the link's random source, which decides which
+// packets are lost or duplicated. It defaults to 1.
+func WithSeed(seed int64) Option {
+	return func(c *config) { c.seed = seed }
+}
+
+// WithLogLevel sets the log level of both devices, which defaults to
+// device.LogLevelError.
+func WithLogLevel(level int) Option {
+	return func(c *config) { c.logLevel = level }
+}
+
+// WithMTU sets the MTU of both TUNs, which defaults to 1420.
+func WithMTU(mtu int) Option {
+	return func(c *config) { c.mtu = mtu }
+}
+
+// WithPingTimeout sets how long Node.Ping waits for a reply, which defaults
+// to five seconds.
+func WithPingTimeout(d time.Duration) Option {
+	return func(c *config) { c.pingTimeout = d }
+}
+
+// NewPair returns two up Devices that are each other's only peer, connected
+// by an unimpaired in-memory link. Their tunnel addresses are 10.0.0.1 and
+// 10.0.0.2. They are closed when the test completes.
+func NewPair(tb testing.TB, opts ...Option) (a, b *Node) {
+	tb.Helper()
+	cfg := config{seed: 1, logLevel: device.LogLevelError, mtu: 1420, pingTimeout: 5 * time.Second}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	binds := [2]*bindtest.LinkBind{}
+	binds[0], binds[1] = bindtest.NewLink(cfg.seed)
+	var nodes [2]*Node
+	for i := range nodes {
+		sk, err := device.NewPrivateKey()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		n := &Node{
+			Bind:        binds[i],
+			Addr:        netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 1)}),
+			PrivateKey:  sk,
+			PublicKey:   sk.PublicKey(),
+			pingTimeout: cfg.pingTimeout,
+		}
+		tun, tnet, err := netstack.CreateNetTUN([]netip.Addr{n.Addr}, nil, cfg.mtu)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		n.Net = tnet
+		n.Device = device.NewDevice(tun, n.Bind, device.NewLogger(cfg.logLevel, fmt.Sprintf("dev%d: ", i)))
+		tb.Cleanup(n.Device.Close)
+		nodes[i] = n
+	}
+	for i, n := range nodes {
+		peer := nodes[i^1]
+		if err := n.Device.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=0\npublic_key=%s\nendpoint=127.0.0.1:1\nallowed_ip=%s/32\n",
+			n.PrivateKey.Hex(), peer.PublicKey.Hex(), peer.Addr)); err != nil {
+			tb.Fatalf("failed to configure device %d: %v", i, err)
+		}
+		if err := n.Device.Up(); err != nil {
+			tb.Fatalf("failed to bring up device %d: %v", i, err)
+		}
+	}
+	return nodes[0], nodes[1]
+}
+
+// SetLoss drops each packet the node sends with probability p.
+func (n *Node) SetLoss(p float64) {
+	n.Bind.SetLoss(p)
+}
+
+// SetLatency delays each packet the node sends by d.
+func (n *Node) SetLatency(d time.Duration) {
+	n.Bind.SetLatency(d)
+}
+
+// SetDuplication delivers each packet the node sends twice with probability p.
+func (n *Node) SetDuplication(p float64) {
+	n.Bind.SetDuplication(p)
+}
+
+// Ping sends an ICMP echo request to peer through the tunnel and waits for
+// the reply, for as long as set by WithPingTimeout. The first ping of a pair
+// also completes the handshake.
+func (n *Node) Ping(peer *Node) error {
+	c, err := n.Net.DialPingAddr(n.Addr, peer.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	echo := &icmp.Echo{Seq: int(uint16(n.pingSeq.Add(1))), Data: []byte("devicetest")}
+	request, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: echo}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+	c.SetReadDeadline(time.Now().Add(n.pingTimeout))
+	if _, err := c.Write(request); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		size, err := c.Read(buf)
+		if err != nil {
+			return err
+		}
+		reply, err := icmp.ParseMessage(1, buf[:size])
+		if err != nil {
+			return err
+		}
+		if r, ok := reply.Body.(*icmp.Echo); ok && r.Seq == echo.Seq && bytes.Equal(r.Data, echo.Data) {
+			return nil
+		}
+		if reply.Type != ipv4.ICMPTypeEchoReply {
+			return fmt.Errorf("unexpected ICMP message %v", reply.Type)
+		}
+		// A duplicate reply to an earlier ping; keep waiting.
+	}
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package devicetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/darkit/wireguard/conn/bindtest"
+)
+
+func TestPairPing(t *testing.T) {
+	a, b := NewPair(t)
+	if err := a.Ping(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Ping(a); err != nil {
+		t.Fatal(err)
+	}
+
+	a.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	if err := a.Ping(b); err != nil {
+		t.Fatal(err)
+	}
+	if rtt := time.Since(start); rtt < 50*time.Millisecond {
+		t.Errorf("ping took %v, less than the link latency", rtt)
+	}
+}
+
+func TestPairLoss(t *testing.T) {
+	a, b := NewPair(t, WithSeed(7), WithPingTimeout(time.Second))
+	if err := a.Ping(b); err != nil {
+		t.Fatal(err)
+	}
+	a.SetLoss(1)
+	if err := a.Ping(b); err == nil {
+		t.Fatal("ping succeeded over a link losing every packet")
+	}
+	a.SetLoss(0)
+	a.SetDuplication(1)
+	if err := a.Ping(b); err != nil {
+		t.Fatal(err)
+	}
+	if stats := a.Bind.Stats(); stats.Dropped == 0 || stats.Duplicated == 0 {
+		t.Errorf("stats = %+v, want drops and duplicates", stats)
+	}
+}
+
+func TestLinkDeterministic(t *testing.T) {
+	delivered := func() (got []int) {
+		a, b := bindtest.NewLink(42)
+		a.SetLoss(0.5)
+		if _, _, err := a.Open(0); err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		fns, _, err := b.Open(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		ep, err := a.ParseEndpoint("127.0.0.1:2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 32; i++ {
+			if err := a.Send([][]byte{{byte(i)}}, ep); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bufs, sizes, eps := [][]byte{make([]byte, 1)}, make([]int, 1), make([]conn.Endpoint, 1)
+		for i := uint64(0); i < 32-a.Stats().Dropped; i++ {
+			if _, err := fns[0](bufs, sizes, eps); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, int(bufs[0][0]))
+		}
+		return got
+	}
+	first, second := delivered(), delivered()
+	if len(first) == 0 || len(first) == 32 {
+		t.Fatalf("delivered %d of 32 packets at 50%% loss", len(first))
+	}
+	if len(first) != len(second) {
+		t.Fatalf("runs delivered %v and %v", first, second)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("runs delivered %v and %v", first, second)
+		}
+	}
+}
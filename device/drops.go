@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A DropReason explains why the device dropped a packet read from the TUN
+// device instead of sending it to a peer.
+type DropReason int
+
+const (
+	// DropNoRoute means no peer's allowed IPs contain the destination.
+	DropNoRoute DropReason = iota
+
+	// DropPeerNoEndpoint means the packet waited for a handshake with a
+	// peer whose endpoint is unknown, until newer packets displaced it.
+	DropPeerNoEndpoint
+
+	// DropPeerDown means the peer was stopped, because the device is down
+	// or the peer is being removed.
+	DropPeerDown
+
+	// DropHandshakeQueueFull means the packet waited for a handshake to
+	// complete, until newer packets displaced it.
+	DropHandshakeQueueFull
+
+	// DropRoutingLoop means the packet was the device's own encrypted
+	// traffic to a peer endpoint, routed back into the tunnel.
+	DropRoutingLoop
+
+	// DropPolicy means the outbound policy dropped the packet, or
+	// redirected it to a peer that does not exist.
+	DropPolicy
+
+	dropReasonCount
+)
+
+func (reason DropReason) String() string {
+	switch reason {
+	case DropNoRoute:
+		return "no_route"
+	case DropPeerNoEndpoint:
+		return "peer_no_endpoint"
+	case DropPeerDown:
+		return "peer_down"
+	case DropHandshakeQueueFull:
+		return "handshake_queue_full"
+	case DropRoutingLoop:
+		return "routing_loop"
+	case DropPolicy:
+		return "policy"
+	}
+	return "unknown"
+}
+
+const (
+	// dropReportInterval is the minimum time between two reports of drops
+	// to the same destination.
+	dropReportInterval = time.Second
+
+	// maxDropReportDestinations bounds the destinations remembered for
+	// sampling, so that a scan of the address space cannot grow it without limit.
+	maxDropReportDestinations = 4096
+)
+
+type outboundDrops struct {
+	counts [dropReasonCount]atomic.Uint64
+	fn     atomic.Pointer[func(netip.Addr, DropReason)]
+
+	sync.Mutex
+	lastReport map[netip.Addr]time.Time
+}
+
+// OnOutboundDrop registers fn to be called when the device drops a packet
+// read from the TUN device, replacing any previous callback. A nil fn removes
+// the callback. Reports are sampled: fn is called at most once per second for
+// each destination, synchronously from the device's internal goroutines, so
+// it must not block.
+func (device *Device) OnOutboundDrop(fn func(dst netip.Addr, reason DropReason)) {
+	if fn == nil {
+		device.drops.fn.Store(nil)
+		return
+	}
+	device.drops.fn.Store(&fn)
+}
+
+// OutboundDrops returns the number of packets read from the TUN device that
+// were dropped for reason.
+func (device *Device) OutboundDrops(reason DropReason) uint64 {
+	if reason < 0 || reason >= dropReasonCount {
+		return 0
+	}
+	return device.drops.counts[reason].Load()
+}
+
+// dropOutbound accounts for dropping packet, which was read from the TUN device.
+func (device *Device) dropOutbound(packet []byte, reason DropReason) {
+	if len(packet) == 0 {
+		return // a keepalive, which shares the queues but wasn't read from the TUN device
+	}
+	device.drops.counts[reason].Add(1)
+	dst := packetDestination(packet)
+	if !device.drops.sample(dst) {
+		return
+	}
+	if reason == DropRoutingLoop {
+		device.log.Errorf("Dropped outbound packet to %v: the tunnel's own traffic was routed into the tunnel; exclude peer endpoints from the routes to it", dst)
+	} else {
+		device.log.Verbosef("Dropped outbound packet to %v: %v", dst, reason)
+	}
+	if fn := device.drops.fn.Load(); fn != nil {
+		(*fn)(dst, reason)
+	}
+}
+
+// sample reports whether a drop to dst should be reported now.
+func (drops *outboundDrops) sample(dst netip.Addr) bool {
+	now := time.Now()
+	drops.Lock()
+	defer drops.Unlock()
+	if last, ok := drops.lastReport[dst]; ok && now.Sub(last) < dropReportInterval {
+		return false
+	}
+	if drops.lastReport == nil {
+		drops.lastReport = make(map[netip.Addr]time.Time)
+	}
+	if len(drops.lastReport) >= maxDropReportDestinations {
+		for addr, last := range drops.lastReport {
+			if now.Sub(last) >= dropReportInterval {
+				delete(drops.lastReport, addr)
+			}
+		}
+		if len(drops.lastReport) >= maxDropReportDestinations {
+			return false
+		}
+	}
+	drops.lastReport[dst] = now
+	return true
+}
+
+// packetDestination returns the destination address of an IP packet, or the
+// zero Addr if it is not one. packet must not be empty.
+func packetDestination(packet []byte) netip.Addr {
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= ipv4.HeaderLen {
+			return netip.AddrFrom4([net.IPv4len]byte(packet[IPv4offsetDst:]))
+		}
+	case 6:
+		if len(packet) >= ipv6.HeaderLen {
+			return netip.AddrFrom16([net.IPv6len]byte(packet[IPv6offsetDst:]))
+		}
+	}
+	return netip.Addr{}
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+func TestOutboundDrops(t *testing.T) {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+	device.SetPrivateKey(sk)
+	if err := device.IpcSet(uapiCfg(
+		"listen_port", "0",
+		"public_key", randNoisePublicKey(t).Hex(),
+		"allowed_ip", "10.0.1.0/24",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		reports []string
+	)
+	device.OnOutboundDrop(func(dst netip.Addr, reason DropReason) {
+		mu.Lock()
+		reports = append(reports, dst.String()+" "+reason.String())
+		mu.Unlock()
+	})
+	waitDrops := func(reason DropReason, want uint64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if device.OutboundDrops(reason) >= want {
+				break
+			}
+		}
+		if got := device.OutboundDrops(reason); got != want {
+			t.Fatalf("OutboundDrops(%v) = %d, want %d", reason, got, want)
+		}
+	}
+
+	src := netip.MustParseAddr("10.0.0.1")
+	unrouted := netip.MustParseAddr("10.0.2.1")
+	for i := 0; i < 3; i++ {
+		tun.Outbound <- tuntest.Ping(unrouted, src)
+	}
+	waitDrops(DropNoRoute, 3)
+
+	// The peer has no endpoint, so packets to it wait for a handshake
+	// that never happens, until they are displaced.
+	routed := netip.MustParseAddr("10.0.1.1")
+	for i := 0; i < QueueStagedSize+2; i++ {
+		tun.Outbound <- tuntest.Ping(routed, src)
+	}
+	waitDrops(DropPeerNoEndpoint, 2)
+
+	mu.Lock()
+	got := strings.Join(reports, ", ")
+	mu.Unlock()
+	if want := "10.0.2.1 no_route, 10.0.1.1 peer_no_endpoint"; got != want {
+		t.Errorf("reported drops %q, want %q", got, want)
+	}
+
+	out, err := device.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"dropped_no_route=3\n", "dropped_peer_no_endpoint=2\n"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("IpcGet output missing %q", line)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package dynamic
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+
+	"github.com/darkit/wireguard/device"
+	"github.com/darkit/wireguard/tun/netstack"
+)
+
+// A Client obtains an address from a Server among the peers of its device,
+// and assigns it to the network stack behind the device's TUN.
+type Client struct {
+	Net       *netstack.Net
+	PublicKey device.NoisePublicKey // the public key of the client's device
+	Logf      func(string, ...any)  // optional
+}
+
+// retryInterval is how long Run waits after a failed request.
+const retryInterval = 5 * time.Second
+
+func (c *Client) logf(format string, args ...any) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
+
+// Request asks the server for a lease, preferably of hint, which may be the
+// zero Addr. It assigns the client's link-local address to Net, but not the
+// leased address.
+func (c *Client) Request(ctx context.Context, hint netip.Addr) (Lease, error) {
+	local := LinkLocal(c.PublicKey)
+	if err := c.Net.AddAddress(local); err != nil {
+		return Lease{}, fmt.Errorf("dynamic: %w", err)
+	}
+	conn, err := gonet.DialTCPWithBind(ctx, c.Net.Stack(),
+		tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom16(local.As16())},
+		tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom16(ServerAddr.As16()), Port: Port},
+		ipv6.ProtocolNumber)
+	if err != nil {
+		return Lease{}, fmt.Errorf("dynamic: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := message{{"request_ip", "1"}, {"public_key", c.PublicKey.Hex()}}
+	if hint.IsValid() {
+		req.set(addrKey(hint), hint.String())
+	}
+	if _, err := req.WriteTo(conn); err != nil {
+		return Lease{}, fmt.Errorf("dynamic: %w", err)
+	}
+	resp, err := readMessage(bufio.NewReader(conn))
+	if err != nil {
+		return Lease{}, fmt.Errorf("dynamic: %w", err)
+	}
+	return parseResponse(c.PublicKey, resp)
+}
+
+func parseResponse(pk device.NoisePublicKey, resp message) (Lease, error) {
+	if errno, _ := resp.get("errno"); errno != "0" {
+		errmsg, _ := resp.get("errmsg")
+		return Lease{}, fmt.Errorf("dynamic: server error %s: %s", errno, errmsg)
+	}
+	l := Lease{PublicKey: pk}
+	for _, key := range []string{"ipv4", "ipv6"} {
+		if v, ok := resp.get(key); ok {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return Lease{}, fmt.Errorf("dynamic: invalid %s: %w", key, err)
+			}
+			l.Addr = p.Addr()
+		}
+	}
+	v, _ := resp.get("leasestart")
+	start, err1 := strconv.ParseInt(v, 10, 64)
+	v, _ = resp.get("leasetime")
+	secs, err2 := strconv.ParseInt(v, 10, 64)
+	if !l.Addr.IsValid() || err1 != nil || err2 != nil || secs <= 0 {
+		return Lease{}, errors.New("dynamic: malformed response")
+	}
+	l.Start = time.Unix(start, 0)
+	l.Duration = time.Duration(secs) * time.Second
+	return l, nil
+}
+
+// Run keeps a lease until ctx is done: it requests one, assigns its address
+// to Net, and renews it halfway through its lease time, retrying failed
+// requests. It calls onLease, if not nil, with every lease obtained. If the
+// server assigns a different address on renewal, the old one is removed
+// from Net.
+func (c *Client) Run(ctx context.Context, onLease func(Lease)) error {
+	var current netip.Addr
+	for {
+		l, err := c.Request(ctx, current)
+		wait := retryInterval
+		if err != nil {
+			c.logf("%v", err)
+		} else {
+			if err := c.Net.AddAddress(l.Addr); err != nil {
+				return fmt.Errorf("dynamic: %w", err)
+			}
+			if current.IsValid() && current != l.Addr {
+				c.Net.RemoveAddress(current)
+			}
+			current = l.Addr
+			if onLease != nil {
+				onLease(l)
+			}
+			wait = time.Until(l.Start.Add(l.Duration / 2))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
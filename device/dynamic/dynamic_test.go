@@ -0,0 +1,203 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package dynamic
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/device"
+	"github.com/darkit/wireguard/device/devicetest"
+)
+
+type memStore struct {
+	mu     sync.Mutex
+	leases map[device.NoisePublicKey]Lease
+}
+
+func (s *memStore) LoadLeases() ([]Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var leases []Lease
+	for _, l := range s.leases {
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+func (s *memStore) SaveLease(l Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases[l.PublicKey] = l
+	return nil
+}
+
+func (s *memStore) DeleteLease(pk device.NoisePublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.leases, pk)
+	return nil
+}
+
+func (s *memStore) get(pk device.NoisePublicKey) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[pk]
+	return l, ok
+}
+
+// newPair returns a server node and a client node whose devices route
+// requests between them.
+func newPair(t *testing.T) (server, client *devicetest.Node) {
+	server, client = devicetest.NewPair(t)
+	if err := server.Device.IpcSet(fmt.Sprintf("public_key=%s\nallowed_ip=%s\n", client.PublicKey.Hex(), LinkLocalPrefix(client.PublicKey))); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Device.IpcSet(fmt.Sprintf("public_key=%s\nallowed_ip=%s/128\n", server.PublicKey.Hex(), ServerAddr)); err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func startServer(t *testing.T, s *Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Serve(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func request(t *testing.T, c *Client, hint netip.Addr) (Lease, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The server may not be listening yet.
+	for {
+		l, err := c.Request(ctx, hint)
+		if err == nil || ctx.Err() != nil {
+			return l, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLease(t *testing.T) {
+	a, b := newPair(t)
+	store := &memStore{leases: make(map[device.NoisePublicKey]Lease)}
+	s := &Server{
+		Device:   a.Device,
+		Net:      a.Net,
+		Pool:     netip.MustParsePrefix("10.99.0.0/24"),
+		Reserved: []netip.Addr{netip.MustParseAddr("10.99.0.1")},
+		Store:    store,
+	}
+	startServer(t, s)
+
+	c := &Client{Net: b.Net, PublicKey: b.PublicKey}
+	l, err := request(t, c, netip.Addr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddr("10.99.0.2"); l.Addr != want || l.Duration != DefaultLeaseTime {
+		t.Fatalf("got lease of %v for %v, want %v for %v", l.Addr, l.Duration, want, DefaultLeaseTime)
+	}
+	peer := a.Device.LookupPeer(b.PublicKey)
+	if !slices.Contains(peer.AllowedIPs(), l.Prefix()) {
+		t.Errorf("leased address not routed to peer: %v", peer.AllowedIPs())
+	}
+	if stored, ok := store.get(b.PublicKey); !ok || stored.Addr != l.Addr {
+		t.Errorf("stored lease %v, want %v", stored, l)
+	}
+
+	// Renewing keeps the address, whatever the hint.
+	renewed, err := request(t, c, netip.MustParseAddr("10.99.0.9"))
+	if err != nil || renewed.Addr != l.Addr {
+		t.Errorf("renewed lease of %v (%v), want %v", renewed.Addr, err, l.Addr)
+	}
+
+	// The leased address works through the tunnel.
+	if err := b.Net.AddAddress(l.Addr); err != nil {
+		t.Fatal(err)
+	}
+	b.Addr = l.Addr
+	if err := b.Ping(a); err != nil {
+		t.Errorf("ping from leased address: %v", err)
+	}
+
+	// Removing the peer reclaims its lease.
+	a.Device.RemovePeer(b.PublicKey)
+	s.reclaim(time.Now())
+	if len(s.Leases()) != 0 {
+		t.Errorf("lease of removed peer not reclaimed: %v", s.Leases())
+	}
+	if _, ok := store.get(b.PublicKey); ok {
+		t.Error("lease of removed peer not deleted from store")
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	a, b := newPair(t)
+	s := &Server{
+		Device:    a.Device,
+		Net:       a.Net,
+		Pool:      netip.MustParsePrefix("10.99.0.0/30"),
+		LeaseTime: time.Second,
+	}
+	startServer(t, s)
+
+	c := &Client{Net: b.Net, PublicKey: b.PublicKey}
+	l, err := request(t, c, netip.MustParseAddr("10.99.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Addr != netip.MustParseAddr("10.99.0.2") {
+		t.Errorf("got %v, want hinted address", l.Addr)
+	}
+	peer := a.Device.LookupPeer(b.PublicKey)
+	s.reclaim(l.Expiry().Add(time.Second)) // leasestart is in whole seconds
+	if len(s.Leases()) != 0 || slices.Contains(peer.AllowedIPs(), l.Prefix()) {
+		t.Errorf("expired lease not reclaimed: %v, %v", s.Leases(), peer.AllowedIPs())
+	}
+}
+
+func TestClientRun(t *testing.T) {
+	a, b := newPair(t)
+	s := &Server{Device: a.Device, Net: a.Net, Pool: netip.MustParsePrefix("fd00:99::/64")}
+	startServer(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leases := make(chan Lease, 1)
+	c := &Client{Net: b.Net, PublicKey: b.PublicKey}
+	go c.Run(ctx, func(l Lease) { leases <- l })
+	select {
+	case l := <-leases:
+		if l.Addr != netip.MustParseAddr("fd00:99::1") {
+			t.Errorf("got %v, want fd00:99::1", l.Addr)
+		}
+	case <-time.After(2 * retryInterval):
+		t.Fatal("no lease")
+	}
+}
+
+func TestLinkLocal(t *testing.T) {
+	var pk device.NoisePublicKey
+	for i := 0; i < 100; i++ {
+		pk[0] = byte(i)
+		addr := LinkLocal(pk)
+		if !addr.IsLinkLocalUnicast() || addr == ServerAddr {
+			t.Fatalf("LinkLocal(%x) = %v", pk, addr)
+		}
+	}
+}
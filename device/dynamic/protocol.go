@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package dynamic assigns tunnel addresses to peers in-band, in the style of
+// wg-dynamic. A Server, running on the network stack of a device, leases
+// addresses from a pool to the Clients among its peers, and routes each
+// leased address to the peer that holds it.
+//
+// Requests travel inside the tunnel before the client has an address of its
+// own: the client sends them from its link-local address, LinkLocal of its
+// public key, to the server at ServerAddr, port Port. For them to get
+// through, the server device must route LinkLocal of each client's public
+// key to that client, and each client device must route ServerAddr to the
+// server, with allowed IPs such as
+//
+//	allowed_ip=fe80::1/128
+//
+// on the client and the prefix returned by LinkLocalPrefix on the server.
+// Cryptokey routing then authenticates requests: only a peer can send from
+// its link-local address.
+//
+// The protocol is line based. A request is a series of key=value lines
+// ended by a blank line:
+//
+//	request_ip=1
+//	public_key=<hex public key of the client>
+//	ipv4=<address to prefer, optional>
+//
+// to which the server responds with
+//
+//	request_ip=1
+//	ipv4=<leased address>/32
+//	leasestart=<unix time>
+//	leasetime=<seconds>
+//	errno=0
+//
+// naming IPv6 addresses with ipv6= instead, or with a nonzero errno and an
+// errmsg= line on failure.
+package dynamic
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/crypto/blake2s"
+
+	"github.com/darkit/wireguard/device"
+)
+
+// Port is the TCP port of the server.
+const Port = 970
+
+// ServerAddr is the address of the server inside the tunnel.
+var ServerAddr = netip.MustParseAddr("fe80::1")
+
+// maxMessageSize bounds requests and responses.
+const maxMessageSize = 4096
+
+// LinkLocal returns the link-local address a client with public key pk sends
+// requests from, derived from the key.
+func LinkLocal(pk device.NoisePublicKey) netip.Addr {
+	sum := blake2s.Sum256(pk[:])
+	var a [16]byte
+	a[0], a[1] = 0xfe, 0x80
+	copy(a[8:], sum[:8])
+	if a == ServerAddr.As16() {
+		a[15] ^= 2
+	}
+	return netip.AddrFrom16(a)
+}
+
+// LinkLocalPrefix returns the single-address prefix of LinkLocal(pk), to be
+// routed to the client on the server device.
+func LinkLocalPrefix(pk device.NoisePublicKey) netip.Prefix {
+	return netip.PrefixFrom(LinkLocal(pk), 128)
+}
+
+// A message is a request or response, a list of key=value pairs.
+type message [][2]string
+
+func (m message) get(key string) (string, bool) {
+	for _, kv := range m {
+		if kv[0] == key {
+			return kv[1], true
+		}
+	}
+	return "", false
+}
+
+func (m *message) set(key, value string) {
+	*m = append(*m, [2]string{key, value})
+}
+
+func (m message) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	for _, kv := range m {
+		fmt.Fprintf(&b, "%s=%s\n", kv[0], kv[1])
+	}
+	b.WriteByte('\n')
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+var errMessageTooLarge = errors.New("message too large")
+
+// readMessage reads key=value lines up to a blank line.
+func readMessage(r *bufio.Reader) (message, error) {
+	var m message
+	size := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if size += len(line); size > maxMessageSize {
+			return nil, errMessageTooLarge
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return m, nil
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		m.set(key, value)
+	}
+}
+
+// addrKey returns the key naming addresses of the family of addr.
+func addrKey(addr netip.Addr) string {
+	if addr.Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
@@ -0,0 +1,356 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package dynamic
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/darkit/wireguard/device"
+	"github.com/darkit/wireguard/tun/netstack"
+)
+
+// DefaultLeaseTime is the lease time of a Server that does not set one.
+const DefaultLeaseTime = time.Hour
+
+// A Lease is the assignment of an address to a peer until an expiry time.
+type Lease struct {
+	PublicKey device.NoisePublicKey
+	Addr      netip.Addr
+	Start     time.Time
+	Duration  time.Duration
+}
+
+// Expiry returns the time the lease ends.
+func (l Lease) Expiry() time.Time {
+	return l.Start.Add(l.Duration)
+}
+
+// Prefix returns the single-address prefix of the leased address, which is
+// routed to the peer holding the lease.
+func (l Lease) Prefix() netip.Prefix {
+	return netip.PrefixFrom(l.Addr, l.Addr.BitLen())
+}
+
+// A LeaseStore persists the leases of a Server, so that peers keep their
+// addresses across restarts. Its methods are called from a single goroutine
+// at a time.
+type LeaseStore interface {
+	// LoadLeases returns the stored leases. It is called once, when the
+	// server starts.
+	LoadLeases() ([]Lease, error)
+	// SaveLease stores a new or renewed lease, replacing any lease of the
+	// same peer.
+	SaveLease(Lease) error
+	// DeleteLease removes the lease of the peer with the given key.
+	DeleteLease(device.NoisePublicKey) error
+}
+
+// A Server leases the addresses of Pool to the peers of Device. Each address
+// is leased to one peer at a time, and routed to it while the lease lasts;
+// addresses already routed to a peer by other means, and those in Reserved,
+// are never leased. Leases end when they expire without being renewed or
+// when their peer is removed from the device, which takes the address's
+// route with it.
+type Server struct {
+	Device    *device.Device
+	Net       *netstack.Net // the network stack behind Device's TUN
+	Pool      netip.Prefix
+	Reserved  []netip.Addr         // addresses in Pool not to lease, such as the server's own
+	LeaseTime time.Duration        // defaults to DefaultLeaseTime
+	Store     LeaseStore           // optional
+	Logf      func(string, ...any) // optional
+
+	mu     sync.Mutex
+	leases map[device.NoisePublicKey]*lease
+}
+
+type lease struct {
+	Lease
+	peer *device.Peer
+}
+
+// Leases returns the current leases.
+func (s *Server) Leases() []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	leases := make([]Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, l.Lease)
+	}
+	return leases
+}
+
+// Serve answers requests until ctx is done. It assigns ServerAddr to Net,
+// and restores the leases in Store of the peers still on the device.
+func (s *Server) Serve(ctx context.Context) error {
+	if !s.Pool.IsValid() {
+		return errors.New("dynamic: invalid pool")
+	}
+	if s.LeaseTime <= 0 {
+		s.LeaseTime = DefaultLeaseTime
+	}
+	if err := s.Net.AddAddress(ServerAddr); err != nil {
+		return fmt.Errorf("dynamic: %w", err)
+	}
+	if err := s.restore(); err != nil {
+		return fmt.Errorf("dynamic: loading leases: %w", err)
+	}
+	ln, err := s.Net.ListenTCPAddrPort(netip.AddrPortFrom(ServerAddr, Port))
+	if err != nil {
+		return fmt.Errorf("dynamic: %w", err)
+	}
+	defer ln.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Closing the endpoint alone does not unblock Accept.
+			ln.Shutdown()
+			ln.Close()
+		case <-done:
+		}
+	}()
+	go s.reclaimLoop(done)
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("dynamic: %w", err)
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+func (s *Server) restore() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases = make(map[device.NoisePublicKey]*lease)
+	if s.Store == nil {
+		return nil
+	}
+	stored, err := s.Store.LoadLeases()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, l := range stored {
+		peer := s.Device.LookupPeer(l.PublicKey)
+		if peer == nil || !now.Before(l.Expiry()) || !s.Pool.Contains(l.Addr) {
+			s.deleteStored(l.PublicKey)
+			continue
+		}
+		if err := peer.AddAllowedIP(l.Prefix()); err != nil {
+			s.logf("dynamic: restoring lease of %v for %v: %v", l.Addr, peer, err)
+			s.deleteStored(l.PublicKey)
+			continue
+		}
+		s.leases[l.PublicKey] = &lease{Lease: l, peer: peer}
+	}
+	return nil
+}
+
+func (s *Server) deleteStored(pk device.NoisePublicKey) {
+	if s.Store == nil {
+		return
+	}
+	if err := s.Store.DeleteLease(pk); err != nil {
+		s.logf("dynamic: deleting lease: %v", err)
+	}
+}
+
+// reclaimLoop ends expired leases and those of removed peers until done is
+// closed.
+func (s *Server) reclaimLoop(done <-chan struct{}) {
+	interval := min(s.LeaseTime/2, 10*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.reclaim(now)
+		}
+	}
+}
+
+func (s *Server) reclaim(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for pk, l := range s.leases {
+		removed := s.Device.LookupPeer(pk) != l.peer
+		if !removed && now.Before(l.Expiry()) {
+			continue
+		}
+		if !removed {
+			l.peer.RemoveAllowedIP(l.Prefix())
+		}
+		delete(s.leases, pk)
+		s.deleteStored(pk)
+		s.logf("dynamic: reclaimed %v from %v", l.Addr, pk.Hex())
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	src, _ := netip.ParseAddrPort(c.RemoteAddr().String())
+	r := bufio.NewReader(c)
+	for {
+		req, err := readMessage(r)
+		if err != nil {
+			return
+		}
+		resp := message{{"request_ip", "1"}}
+		l, err := s.serveRequest(src.Addr(), req)
+		if err != nil {
+			s.logf("dynamic: request from %v: %v", src.Addr(), err)
+			resp.set("errno", "1")
+			resp.set("errmsg", err.Error())
+		} else {
+			resp.set(addrKey(l.Addr), l.Prefix().String())
+			resp.set("leasestart", strconv.FormatInt(l.Start.Unix(), 10))
+			resp.set("leasetime", strconv.FormatInt(int64(l.Duration/time.Second), 10))
+			resp.set("errno", "0")
+		}
+		if _, err := resp.WriteTo(c); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) serveRequest(src netip.Addr, req message) (Lease, error) {
+	if v, _ := req.get("request_ip"); v != "1" {
+		return Lease{}, errors.New("unsupported request")
+	}
+	v, _ := req.get("public_key")
+	var pk device.NoisePublicKey
+	if err := pk.FromHex(v); err != nil {
+		return Lease{}, err
+	}
+	// Only the peer can send from its link-local address, as long as the
+	// device routes it to the peer.
+	if src != LinkLocal(pk) {
+		return Lease{}, fmt.Errorf("source address %v does not belong to the key", src)
+	}
+	peer, err := s.Device.Peer(pk)
+	if err != nil {
+		return Lease{}, err
+	}
+	var hint netip.Addr
+	if v, ok := req.get(addrKey(s.Pool.Addr())); ok {
+		if p, err := netip.ParsePrefix(v); err == nil {
+			hint = p.Addr()
+		} else if a, err := netip.ParseAddr(v); err == nil {
+			hint = a
+		}
+	}
+	return s.allocate(peer, pk, hint)
+}
+
+// allocate leases an address to peer: the one it holds, else hint if it is
+// free, else the first free address of the pool.
+func (s *Server) allocate(peer *device.Peer, pk device.NoisePublicKey, hint netip.Addr) (Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leases == nil {
+		return Lease{}, errors.New("server not running")
+	}
+	l := s.leases[pk]
+	if l != nil && l.peer != peer {
+		delete(s.leases, pk)
+		l = nil
+	}
+	if l == nil {
+		addr := hint
+		if !s.free(addr) {
+			addr = s.firstFree()
+		}
+		if !addr.IsValid() {
+			return Lease{}, errors.New("address pool exhausted")
+		}
+		l = &lease{Lease: Lease{PublicKey: pk, Addr: addr}, peer: peer}
+		if err := peer.AddAllowedIP(l.Prefix()); err != nil {
+			return Lease{}, err
+		}
+		s.leases[pk] = l
+		s.logf("dynamic: leased %v to %v", addr, peer)
+	}
+	l.Start = time.Now()
+	l.Duration = s.LeaseTime
+	if s.Store != nil {
+		if err := s.Store.SaveLease(l.Lease); err != nil {
+			s.logf("dynamic: saving lease: %v", err)
+		}
+	}
+	return l.Lease, nil
+}
+
+// free reports whether addr may be leased.
+func (s *Server) free(addr netip.Addr) bool {
+	if !addr.IsValid() || !s.Pool.Contains(addr) || addr == s.Pool.Masked().Addr() {
+		return false
+	}
+	if addr.Is4() && addr == lastAddr(s.Pool) {
+		return false // broadcast
+	}
+	for _, r := range s.Reserved {
+		if addr == r {
+			return false
+		}
+	}
+	for _, l := range s.leases {
+		if addr == l.Addr {
+			return false
+		}
+	}
+	return s.Device.LookupAllowedIP(addr) == nil
+}
+
+func (s *Server) firstFree() netip.Addr {
+	for addr := s.Pool.Masked().Addr().Next(); s.Pool.Contains(addr); addr = addr.Next() {
+		if s.free(addr) {
+			return addr
+		}
+	}
+	return netip.Addr{}
+}
+
+// lastAddr returns the last address of p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Masked().Addr().As16()
+	bits := p.Bits()
+	if p.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		a[i/8] |= 0x80 >> (i % 8)
+	}
+	addr := netip.AddrFrom16(a)
+	if p.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// SetEndpointTTL makes the device forget the endpoint it learned from a
+// peer once no authenticated packet has come from the peer for ttl, such as
+// when the NAT mapping the peer was reached through has expired. The peer
+// falls back to the endpoint configured for it, if any, and is then passive,
+// sending no handshake initiations to the dead address, until it reaches the
+// device again. A ttl of zero, the default, keeps learned endpoints forever.
+func (device *Device) SetEndpointTTL(ttl time.Duration) {
+	device.endpointTTL.Store(int64(max(ttl, 0)))
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if ttl > 0 && peer.timersActive() {
+			peer.timers.endpointTTL.Mod(ttl)
+		} else {
+			peer.timers.endpointTTL.Del()
+		}
+	}
+}
+
+// EndpointTTL returns the time set by SetEndpointTTL.
+func (device *Device) EndpointTTL() time.Duration {
+	return time.Duration(device.endpointTTL.Load())
+}
+
+// EndpointExpired reports whether the device forgot the endpoint it learned
+// from the peer, under SetEndpointTTL, and has not heard from it since.
+func (peer *Peer) EndpointExpired() bool {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	return peer.endpoint.expired
+}
+
+// setConfiguredEndpoint sets the endpoint of the peer as configured, which
+// also ends its expiry. The caller must hold the endpoint mutex.
+func (peer *Peer) setConfiguredEndpoint(endpoint conn.Endpoint) {
+	peer.endpoint.val = endpoint
+	peer.endpoint.configured = endpoint
+	peer.endpoint.expired = false
+}
+
+func expiredEndpointTTL(peer *Peer) {
+	ttl := peer.device.EndpointTTL()
+	if ttl == 0 {
+		return
+	}
+	peer.endpoint.Lock()
+	if !peer.endpoint.learned {
+		peer.endpoint.Unlock()
+		return
+	}
+	peer.endpoint.learned = false
+	peer.endpoint.expired = true
+	peer.endpoint.val = peer.endpoint.configured
+	peer.endpoint.clearSrcOnTx = false
+	peer.endpoint.Unlock()
+	peer.device.log.Verbosef("%v - Forgetting endpoint, nothing received for %v", peer, ttl)
+
+	peer.timers.retransmitHandshake.Del()
+	peer.timers.handshakeAttempts.Store(0)
+	peer.FlushStagedPackets()
+	peer.updateState()
+}
@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEndpointTTL(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	if err := dev.IpcSet(uapiCfg("endpoint_ttl", "1")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "\nendpoint_ttl=1\n") {
+		t.Errorf("config lacks endpoint_ttl=1:\n%s", cfg)
+	}
+
+	// The endpoint learned from the peer is forgotten once it falls silent,
+	// leaving the configured one, without initiating to it.
+	pair.Send(t, Ping, nil)
+	for start := time.Now(); !peer.EndpointExpired(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("endpoint did not expire")
+		}
+	}
+	peer.endpoint.Lock()
+	val, configured := peer.endpoint.val, peer.endpoint.configured
+	peer.endpoint.Unlock()
+	if configured == nil || val != configured {
+		t.Errorf("endpoint %v after expiry, want the configured %v", val, configured)
+	}
+	lastSent := time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = lastSent
+	peer.handshake.mutex.Unlock()
+	peer.SendHandshakeInitiation(false)
+	peer.handshake.mutex.RLock()
+	initiated := !peer.handshake.lastSentHandshake.Equal(lastSent)
+	peer.handshake.mutex.RUnlock()
+	if initiated {
+		t.Error("initiated to the peer after its endpoint expired")
+	}
+
+	// Hearing from the peer again ends the expiry.
+	pair.Send(t, Ping, nil)
+	if peer.EndpointExpired() {
+		t.Error("endpoint still expired after the peer reached the device")
+	}
+	pair.Send(t, Pong, nil)
+
+	dev.SetEndpointTTL(0)
+	if peer.timers.endpointTTL.IsPending() {
+		t.Error("endpoint TTL pending after disabling it")
+	}
+}
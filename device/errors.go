@@ -0,0 +1,44 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// Errors returned by IpcSet, IpcGet and the other configuration methods of
+// Device and Peer, possibly wrapped; test for them with errors.Is. Errors
+// from the UAPI operations are also of type *IPCError, whose Errno method
+// reports the code sent to UAPI clients.
+var (
+	ErrInvalidKey        = errors.New("invalid key")
+	ErrInvalidEndpoint   = conn.ErrInvalidEndpoint
+	ErrInvalidAllowedIP  = errors.New("invalid allowed IP")
+	ErrAllowedIPNotFound = errors.New("allowed IP not found")
+	ErrAllowedIPNotOwned = errors.New("allowed IP belongs to another peer")
+	ErrPeerNotFound      = errors.New("peer not found")
+	ErrInvalidLabel      = errors.New("invalid peer label")
+	ErrProtocolViolation = errors.New("UAPI protocol violation")
+)
+
+// Errors for keys that are well-formed but unsafe to use, which also match
+// ErrInvalidKey.
+var (
+	ErrZeroKey     = fmt.Errorf("%w: all-zero private key", ErrInvalidKey)
+	ErrLowOrderKey = fmt.Errorf("%w: public key of small order", ErrInvalidKey)
+	ErrOwnKey      = fmt.Errorf("%w: peer public key is the device's own", ErrInvalidKey)
+)
+
+// Peer returns the peer with public key pk, or ErrPeerNotFound.
+func (device *Device) Peer(pk NoisePublicKey) (*Peer, error) {
+	if peer := device.LookupPeer(pk); peer != nil {
+		return peer, nil
+	}
+	return nil, ErrPeerNotFound
+}
@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/darkit/wireguard/ipc"
+)
+
+func TestIpcSetErrors(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	peer := randNoisePublicKey(t).Hex()
+	for _, tt := range []struct {
+		name  string
+		cfg   string
+		want  error
+		errno int64
+	}{
+		{"private key", uapiCfg("private_key", "zz"), ErrInvalidKey, ipc.IpcErrorInvalid},
+		{"public key", uapiCfg("public_key", "00"), ErrInvalidKey, ipc.IpcErrorInvalid},
+		{"low-order public key", uapiCfg("public_key", lowOrderPoints[2]), ErrLowOrderKey, ipc.IpcErrorInvalid},
+		{"own public key", uapiCfg("public_key", dev.staticIdentity.publicKey.Hex()), ErrOwnKey, ipc.IpcErrorInvalid},
+		{"preshared key", uapiCfg("public_key", peer, "preshared_key", "abc"), ErrInvalidKey, ipc.IpcErrorInvalid},
+		{"endpoint", uapiCfg("public_key", peer, "endpoint", "nowhere"), ErrInvalidEndpoint, ipc.IpcErrorInvalid},
+		{"endpoint zone", uapiCfg("public_key", peer, "endpoint", "[2001:db8::1%1]:51820"), ErrInvalidEndpoint, ipc.IpcErrorInvalid},
+		{"allowed ip", uapiCfg("public_key", peer, "allowed_ip", "10.0.0.1/33"), ErrInvalidAllowedIP, ipc.IpcErrorInvalid},
+		{"device key", uapiCfg("no_such_key", "1"), ErrProtocolViolation, ipc.IpcErrorInvalid},
+		{"malformed line", "private_key\n", ErrProtocolViolation, ipc.IpcErrorProtocol},
+	} {
+		err := dev.IpcSet(tt.cfg)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+		var ipcErr *IPCError
+		if !errors.As(err, &ipcErr) || ipcErr.Errno() != tt.errno {
+			t.Errorf("%s: got %v, want errno %d", tt.name, err, tt.errno)
+		}
+	}
+
+	if _, err := dev.Peer(NoisePublicKey{1}); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("Peer of unknown key: got %v, want %v", err, ErrPeerNotFound)
+	}
+}
+
+func TestIpcEndpointZone(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo net.Interface
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			lo = ifi
+		}
+	}
+	if lo.Name == "" {
+		t.Skip("no loopback interface")
+	}
+	peer := randNoisePublicKey(t).Hex()
+	for _, endpoint := range []string{
+		"[fe80::1%" + lo.Name + "]:51820",
+		fmt.Sprintf("[fe80::1%%%d]:51820", lo.Index),
+	} {
+		if err := dev.IpcSet(uapiCfg("public_key", peer, "endpoint", endpoint)); err != nil {
+			t.Fatalf("setting endpoint %s: %v", endpoint, err)
+		}
+		cfg, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(cfg, "endpoint="+endpoint+"\n") {
+			t.Errorf("IpcGet output lacks endpoint=%s:\n%s", endpoint, cfg)
+		}
+	}
+}
+
+func TestIpcHandleErrno(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go dev.IpcHandle(server)
+
+	r := bufio.NewReader(client)
+	for _, tt := range []struct {
+		request string
+		errno   int64
+	}{
+		{"set=1\nlisten_port=x\n\n", ipc.IpcErrorInvalid},
+		{"set=1\nlisten_port=0\n\n", 0},
+		{"set=1\nlisten_port\n", ipc.IpcErrorProtocol},
+	} {
+		if _, err := client.Write([]byte(tt.request)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("errno=%d\n", tt.errno); line != want {
+			t.Errorf("%q: got %q, want %q", tt.request, line, want)
+		}
+		r.ReadString('\n')
+	}
+}
+
+// authorizingConn refuses the operations in denied.
+type authorizingConn struct {
+	net.Conn
+	denied map[string]error
+}
+
+func (c authorizingConn) Authorize(op string) error {
+	return c.denied[op]
+}
+
+func TestIpcHandleAuthorize(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	// Open the bind now, rather than when the TUN device comes up, so
+	// that only the refused set could change the port read here.
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	dev.net.RLock()
+	port := dev.net.port
+	dev.net.RUnlock()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go dev.IpcHandle(authorizingConn{server, map[string]error{
+		"set":   ipc.ErrRateLimited,
+		"debug": ipc.ErrDenied,
+	}})
+
+	r := bufio.NewReader(client)
+	for _, tt := range []struct {
+		request string
+		errno   int64
+	}{
+		{"set=1\nlisten_port=1\nfwmark=2\n\n", ipc.IpcErrorRateLimited},
+		{"debug=keypairs\n\n", ipc.IpcErrorPermission},
+		{"get=1\n\n", 0},
+	} {
+		if _, err := client.Write([]byte(tt.request)); err != nil {
+			t.Fatal(err)
+		}
+		var line string
+		for !strings.HasPrefix(line, "errno=") {
+			var err error
+			if line, err = r.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if want := fmt.Sprintf("errno=%d\n", tt.errno); line != want {
+			t.Errorf("%q: got %q, want %q", tt.request, line, want)
+		}
+		r.ReadString('\n')
+	}
+	dev.net.RLock()
+	defer dev.net.RUnlock()
+	if dev.net.port != port {
+		t.Errorf("refused set changed the listen port from %d to %d", port, dev.net.port)
+	}
+}
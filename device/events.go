@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// An EventType identifies the kind of an Event.
+type EventType int
+
+const (
+	// EventPeerWatchdogRecovery means the peer watchdog found a peer's session
+	// stalled, cleared its keypairs, and initiated a new handshake.
+	EventPeerWatchdogRecovery EventType = iota
+
+	// EventPeerHandshakeBackoff means a peer failed to complete a handshake
+	// after all retries, and handshake initiations to it are now backed off.
+	EventPeerHandshakeBackoff
+
+	// EventPeerHandshakeBackoffEnded means a packet arrived from a peer in
+	// handshake backoff, ending it.
+	EventPeerHandshakeBackoffEnded
+
+	// EventPeerTransportSourceFallback means the local address set by
+	// Peer.SetTransportSource became unavailable, and the peer's traffic is
+	// sent from the default sockets.
+	EventPeerTransportSourceFallback
+
+	// EventPeerTransportSourceRestored means the peer's traffic is sent from
+	// its transport source again after a fallback.
+	EventPeerTransportSourceRestored
+
+	// EventPeerEndpointError means the network reported an error, such as
+	// ICMP port unreachable, for the handshakes sent to the peer's
+	// endpoint. Peer.EndpointError returns it.
+	EventPeerEndpointError
+
+	// EventPeerStateChanged means the state returned by Peer.State changed.
+	// Event.State is the new state. The changes of a peer are reported one
+	// at a time, in order.
+	EventPeerStateChanged
+)
+
+func (typ EventType) String() string {
+	switch typ {
+	case EventPeerWatchdogRecovery:
+		return "peer_watchdog_recovery"
+	case EventPeerHandshakeBackoff:
+		return "peer_handshake_backoff"
+	case EventPeerHandshakeBackoffEnded:
+		return "peer_handshake_backoff_ended"
+	case EventPeerTransportSourceFallback:
+		return "peer_transport_source_fallback"
+	case EventPeerTransportSourceRestored:
+		return "peer_transport_source_restored"
+	case EventPeerEndpointError:
+		return "peer_endpoint_error"
+	case EventPeerStateChanged:
+		return "peer_state_changed"
+	}
+	return "unknown"
+}
+
+// An Event reports something noteworthy that happened to the device or one of its peers.
+type Event struct {
+	Type EventType
+	Time time.Time
+	Peer NoisePublicKey // zero for device-wide events
+
+	// Labels are the labels of the peer set by Peer.SetLabels, nil for
+	// device-wide events and peers without labels.
+	Labels map[string]string
+
+	// State is the new state of the peer for EventPeerStateChanged.
+	State PeerState
+}
+
+type eventHandler struct {
+	fn atomic.Pointer[func(Event)]
+}
+
+// SetEventHandler registers fn to be called for every Event, replacing any
+// previous handler. A nil fn removes the handler. fn is called synchronously
+// from the device's internal goroutines, so it must not block.
+func (device *Device) SetEventHandler(fn func(Event)) {
+	if fn == nil {
+		device.events.fn.Store(nil)
+		return
+	}
+	device.events.fn.Store(&fn)
+}
+
+func (device *Device) emitEvent(typ EventType, peer *Peer) {
+	device.emit(Event{Type: typ}, peer)
+}
+
+func (device *Device) emitPeerStateChanged(peer *Peer, state PeerState) {
+	device.emit(Event{Type: EventPeerStateChanged, State: state}, peer)
+}
+
+func (device *Device) emit(event Event, peer *Peer) {
+	fn := device.events.fn.Load()
+	if fn == nil {
+		return
+	}
+	event.Time = device.now()
+	if peer != nil {
+		peer.handshake.mutex.RLock()
+		event.Peer = peer.handshake.remoteStatic
+		peer.handshake.mutex.RUnlock()
+		event.Labels = peer.Labels()
+	}
+	(*fn)(event)
+}
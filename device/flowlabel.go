@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/blake2s"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// SetFlowLabelPolicy selects the IPv6 flow labels of the datagrams sent to
+// peers over IPv6, for routers that balance traffic across equal-cost paths
+// by flow label. With conn.FlowLabelPeer, each peer's datagrams carry a label
+// derived from its public key, which stays the same across handshakes, unlike
+// its session indices, so that its traffic keeps to one path. With
+// conn.FlowLabelRandom, the label is derived from the receiver index of the
+// current session, which the peer picks at random, so that it changes with
+// every session, rekeys included; before the first, the kernel picks it.
+// It fails if the device's Bind is not a conn.FlowLabelBind, or cannot set
+// flow labels on this platform.
+func (device *Device) SetFlowLabelPolicy(policy conn.FlowLabelPolicy) error {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	bind, ok := device.net.bind.(conn.FlowLabelBind)
+	if !ok {
+		if policy == conn.FlowLabelKernel {
+			return nil
+		}
+		return errors.ErrUnsupported
+	}
+	return bind.SetFlowLabelPolicy(policy)
+}
+
+// FlowLabelPolicy returns the policy set by SetFlowLabelPolicy.
+func (device *Device) FlowLabelPolicy() conn.FlowLabelPolicy {
+	if bind, ok := device.net.bind.(conn.FlowLabelBind); ok {
+		return bind.FlowLabelPolicy()
+	}
+	return conn.FlowLabelKernel
+}
+
+// stableFlowLabel derives the flow label of a peer under conn.FlowLabelPeer.
+func stableFlowLabel(pk NoisePublicKey) uint32 {
+	sum := blake2s.Sum256(pk[:])
+	return max(binary.LittleEndian.Uint32(sum[:])&conn.FlowLabelMask, 1)
+}
+
+// sessionFlowLabel derives the flow label of a session under
+// conn.FlowLabelRandom from remoteIndex, the receiver index its transport
+// messages carry.
+func sessionFlowLabel(remoteIndex uint32) uint32 {
+	return max(remoteIndex&conn.FlowLabelMask, 1)
+}
+
+// flowLabel returns the label of datagrams sent to the peer under policy.
+func (peer *Peer) flowLabel(policy conn.FlowLabelPolicy) uint32 {
+	switch policy {
+	case conn.FlowLabelPeer:
+		return peer.stableFlowLabel
+	case conn.FlowLabelRandom:
+		return peer.sessionFlowLabel.Load()
+	}
+	return 0
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+func TestFlowLabelPolicyUAPI(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("flow labels are only supported on Linux")
+	}
+	dev := randDevice(t)
+	defer dev.Close()
+
+	key := randNoisePublicKey(t)
+	if err := dev.IpcSet(uapiCfg("flow_label_policy", "peer", "public_key", key.Hex())); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "flow_label_policy=peer\n") {
+		t.Errorf("policy missing from IpcGet output:\n%s", cfg)
+	}
+	if err := dev.IpcSet(uapiCfg("flow_label_policy", "sometimes")); err == nil {
+		t.Error("invalid policy accepted")
+	}
+
+	peer := dev.LookupPeer(key)
+	if label := peer.flowLabel(conn.FlowLabelPeer); label == 0 || label != stableFlowLabel(key) {
+		t.Errorf("peer label %#x is not stable", label)
+	}
+	if label := peer.flowLabel(conn.FlowLabelRandom); label != 0 {
+		t.Errorf("session label %#x before the first session, want 0", label)
+	}
+	if label := peer.flowLabel(conn.FlowLabelKernel); label != 0 {
+		t.Errorf("label %#x under the kernel policy, want 0", label)
+	}
+}
+
+func TestSessionFlowLabel(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	// The label follows the receiver index of the current session, and so
+	// changes with a rekey.
+	session := func() (*Keypair, uint32) {
+		t.Helper()
+		peer.keypairs.RLock()
+		defer peer.keypairs.RUnlock()
+		current := peer.keypairs.current
+		label := peer.flowLabel(conn.FlowLabelRandom)
+		if label == 0 || label > conn.FlowLabelMask || label != sessionFlowLabel(current.remoteIndex) {
+			t.Fatalf("session label %#x, want one derived from receiver index %#x", label, current.remoteIndex)
+		}
+		return current, label
+	}
+	first, label := session()
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	if err := peer.SendHandshakeInitiation(false); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		pair.Send(t, Ping, nil)
+		peer.keypairs.RLock()
+		rekeyed := peer.keypairs.current != first
+		peer.keypairs.RUnlock()
+		if rekeyed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no rekey")
+		}
+	}
+	if _, next := session(); next == label {
+		t.Errorf("session label %#x unchanged by the rekey", next)
+	}
+}
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// establishedSourcesInterval is how long the endpoints of established peers
+// are cached for prioritizing their handshakes while the device is under load.
+const establishedSourcesInterval = time.Second
+
+type establishedSources struct {
+	sync.Mutex // serializes refreshes
+	expires    atomic.Int64
+	set        atomic.Pointer[map[string]struct{}] // keyed by Endpoint.DstToBytes
+}
+
+// isEstablishedHandshake reports whether the handshake message packet from
+// endpoint belongs to an established peer, and may skip ahead of a flood of
+// other handshakes: a response to an initiation the device sent, or an
+// initiation from the endpoint of a peer with a current session. Forging a
+// response requires knowing the index, and forgeries only compete for the
+// bounded priority queue. Responses still pass the mac1 and rate limiter
+// checks before any work is done for them, and initiations, whose source
+// address may be spoofed, the mac2 check as well.
+func (device *Device) isEstablishedHandshake(msgType uint32, packet []byte, endpoint conn.Endpoint) bool {
+	switch msgType {
+	case MessageResponseType:
+		receiver := binary.LittleEndian.Uint32(packet[MessageResponseOffsetReceiver:])
+		return device.indexTable.Lookup(receiver).handshake != nil
+	case MessageInitiationType:
+		_, ok := device.establishedSources()[string(endpoint.DstToBytes())]
+		return ok
+	}
+	return false
+}
+
+// establishedSources returns the endpoints of the peers with a current
+// session, refreshing them if they are older than establishedSourcesInterval.
+func (device *Device) establishedSources() map[string]struct{} {
+	sources := &device.established
+	now := time.Now()
+	if set := sources.set.Load(); set != nil && sources.expires.Load() > now.UnixNano() {
+		return *set
+	}
+	sources.Lock()
+	defer sources.Unlock()
+	if set := sources.set.Load(); set != nil && sources.expires.Load() > now.UnixNano() {
+		return *set
+	}
+
+	set := make(map[string]struct{})
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		keypair := peer.keypairs.Current()
+		if keypair == nil || now.Sub(keypair.created) >= RejectAfterTime {
+			continue
+		}
+		peer.endpoint.Lock()
+		if peer.endpoint.val != nil {
+			set[string(peer.endpoint.val.DstToBytes())] = struct{}{}
+		}
+		peer.endpoint.Unlock()
+	}
+	device.peers.RUnlock()
+	sources.set.Store(&set)
+	sources.expires.Store(now.Add(establishedSourcesInterval).UnixNano())
+	return set
+}
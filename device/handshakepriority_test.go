@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// floodInitiations keeps the device's handshake queue full with random
+// initiations with a valid mac1 from src, until stop is closed.
+func floodInitiations(dev *Device, src conn.Endpoint, stop <-chan struct{}) {
+	var gen CookieGenerator
+	gen.Init(dev.staticIdentity.publicKey)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		buf := dev.GetMessageBuffer()
+		packet := (*buf)[:MessageInitiationSize]
+		rand.Read(packet)
+		binary.LittleEndian.PutUint32(packet, MessageInitiationType)
+		gen.AddMacs(packet)
+		select {
+		case dev.queue.handshake.c <- QueueHandshakeElement{msgType: MessageInitiationType, packet: packet, endpoint: src, buffer: buf}:
+		case <-stop:
+			dev.PutMessageBuffer(buf)
+			return
+		}
+	}
+}
+
+func TestHandshakeFloodRekey(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	before := peer.keypairs.Current()
+
+	// The channel binds reach nothing from this endpoint, so the cookie
+	// replies to the flood are dropped rather than flood the other device.
+	src, err := dev.net.bind.ParseEndpoint("127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			floodInitiations(dev, src, stop)
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	for !dev.IsUnderLoad() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The rekey the device initiates must complete with the first response,
+	// which has no mac2, rather than wait behind the flood and for a cookie.
+	// It must not follow the ping's initiation so closely that it is taken
+	// for a flood.
+	time.Sleep(HandshakeInitationRate)
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	peer.SendHandshakeInitiation(false)
+	deadline := time.Now().Add(RekeyTimeout)
+	for peer.keypairs.Current() == before {
+		if time.Now().After(deadline) {
+			t.Fatal("rekey did not complete during the flood")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIsEstablishedHandshake(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	initiation := make([]byte, MessageInitiationSize)
+	endpoint := peer.endpoint.val
+
+	if dev.isEstablishedHandshake(MessageInitiationType, initiation, endpoint) {
+		t.Error("initiation from a peer without a session prioritized")
+	}
+	pair.Send(t, Ping, nil)
+	dev.established.expires.Store(0)
+	peer.endpoint.Lock()
+	endpoint = peer.endpoint.val
+	peer.endpoint.Unlock()
+	if !dev.isEstablishedHandshake(MessageInitiationType, initiation, endpoint) {
+		t.Error("initiation from the endpoint of an established peer not prioritized")
+	}
+	other, _ := CreateDummyEndpoint()
+	if dev.isEstablishedHandshake(MessageInitiationType, initiation, other) {
+		t.Error("initiation from another source prioritized")
+	}
+
+	// Responses are recognized by the index of an initiation sent.
+	response := make([]byte, MessageResponseSize)
+	binary.LittleEndian.PutUint32(response[MessageResponseOffsetReceiver:], 1)
+	if dev.isEstablishedHandshake(MessageResponseType, response, other) {
+		t.Error("response to an unknown index prioritized")
+	}
+	msg, err := dev.CreateMessageInitiation(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(response[MessageResponseOffsetReceiver:], msg.Sender)
+	if !dev.isEstablishedHandshake(MessageResponseType, response, other) {
+		t.Error("response to an initiation sent not prioritized")
+	}
+}
@@ -0,0 +1,273 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/darkit/wireguard/ipc"
+)
+
+// Defaults for the zero fields of HealthCheckOptions.
+const (
+	DefaultHealthHandshakeMaxAge = RejectAfterTime
+	DefaultHealthQueueThreshold  = 0.9
+)
+
+const (
+	// healthClockSkew is how far the timestamps of peers' handshakes may be
+	// ahead of the local clock before it is reported as behind.
+	healthClockSkew = 10 * time.Minute
+)
+
+// healthClockFloor is a time the local clock is surely past, unless unset.
+var healthClockFloor = time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// HealthStatus is the outcome of a health check.
+type HealthStatus int
+
+const (
+	HealthOK HealthStatus = iota
+	HealthWarning
+	HealthFailed
+)
+
+func (status HealthStatus) String() string {
+	switch status {
+	case HealthOK:
+		return "ok"
+	case HealthWarning:
+		return "warn"
+	case HealthFailed:
+		return "fail"
+	}
+	return "unknown"
+}
+
+// HealthCheckOptions tunes the thresholds of HealthCheck.
+type HealthCheckOptions struct {
+	// HandshakeMaxAge is how recent the latest handshake with any peer must
+	// be. Zero selects DefaultHealthHandshakeMaxAge; a negative value
+	// disables the check.
+	HandshakeMaxAge time.Duration
+
+	// QueueThreshold is the fraction of the capacity of a queue beyond
+	// which it is reported as congested. Zero selects
+	// DefaultHealthQueueThreshold.
+	QueueThreshold float64
+}
+
+// HealthCheckResult is the outcome of one check of HealthCheck.
+type HealthCheckResult struct {
+	Name     string // "bind", "tun_mtu", "handshake", "queues" or "clock"
+	Status   HealthStatus
+	Message  string
+	Duration time.Duration
+}
+
+// HealthReport is the outcome of HealthCheck.
+type HealthReport struct {
+	Status HealthStatus // the worst status of the checks
+	Checks []HealthCheckResult
+}
+
+// SetHealthCheckOptions sets the thresholds used by HealthCheck and the UAPI
+// health operation.
+func (device *Device) SetHealthCheckOptions(opts HealthCheckOptions) {
+	if opts.HandshakeMaxAge == 0 {
+		opts.HandshakeMaxAge = DefaultHealthHandshakeMaxAge
+	}
+	if opts.QueueThreshold == 0 {
+		opts.QueueThreshold = DefaultHealthQueueThreshold
+	}
+	device.healthOptions.Store(&opts)
+}
+
+// HealthCheck checks that the device works, for appliance health checks:
+//
+//   - bind: the sockets are open, and a probe can be sent to the device's
+//     port on the loopback address.
+//   - tun_mtu: the MTU of the TUN device can be queried, showing that it
+//     is open, though no packets are exchanged with it.
+//   - handshake: a handshake with some peer is recent enough.
+//   - queues: the encryption queues of the peers, and the decryption and
+//     handshake queues, are not congested, which is only a warning.
+//   - clock: the local clock is set, and not behind the timestamps of the
+//     peers' handshakes, which is only a warning.
+//
+// Checks not started before ctx is done fail with its error.
+func (device *Device) HealthCheck(ctx context.Context) HealthReport {
+	opts := device.healthOptions.Load()
+	if opts == nil {
+		opts = &HealthCheckOptions{HandshakeMaxAge: DefaultHealthHandshakeMaxAge, QueueThreshold: DefaultHealthQueueThreshold}
+	}
+	checks := []struct {
+		name  string
+		check func() (HealthStatus, string)
+	}{
+		{"bind", device.healthCheckBind},
+		{"tun_mtu", device.healthCheckTUNMTU},
+		{"handshake", func() (HealthStatus, string) { return device.healthCheckHandshake(opts.HandshakeMaxAge) }},
+		{"queues", func() (HealthStatus, string) { return device.healthCheckQueues(opts.QueueThreshold) }},
+		{"clock", device.healthCheckClock},
+	}
+
+	var report HealthReport
+	for _, c := range checks {
+		if c.name == "handshake" && opts.HandshakeMaxAge < 0 {
+			continue
+		}
+		result := HealthCheckResult{Name: c.name}
+		if err := ctx.Err(); err != nil {
+			result.Status, result.Message = HealthFailed, err.Error()
+		} else {
+			start := time.Now()
+			result.Status, result.Message = c.check()
+			result.Duration = time.Since(start)
+		}
+		report.Status = max(report.Status, result.Status)
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+func (device *Device) healthCheckBind() (HealthStatus, string) {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if !device.isUp() {
+		return HealthFailed, "device is down"
+	}
+	// The probe is shorter than any message, so the receiving end ignores it.
+	probe := [][]byte{{0}}
+	var errs []error
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		endpoint, err := device.net.bind.ParseEndpoint(net.JoinHostPort(host, strconv.Itoa(int(device.net.port))))
+		if err == nil {
+			err = device.net.bind.Send(probe, endpoint)
+		}
+		if err == nil {
+			return HealthOK, fmt.Sprintf("sent probe to %s", endpoint.DstToString())
+		}
+		errs = append(errs, err)
+	}
+	return HealthFailed, errors.Join(errs...).Error()
+}
+
+func (device *Device) healthCheckTUNMTU() (HealthStatus, string) {
+	mtu, err := device.tun.device.MTU()
+	if err != nil {
+		return HealthFailed, err.Error()
+	}
+	return HealthOK, fmt.Sprintf("mtu %d", mtu)
+}
+
+func (device *Device) healthCheckHandshake(maxAge time.Duration) (HealthStatus, string) {
+	device.peers.RLock()
+	peers := len(device.peers.keyMap)
+	var latest int64
+	for _, peer := range device.peers.keyMap {
+		latest = max(latest, peer.lastHandshakeNano.Load())
+	}
+	device.peers.RUnlock()
+
+	switch {
+	case peers == 0:
+		return HealthFailed, "no peers"
+	case latest == 0:
+		return HealthFailed, "no handshake yet"
+	}
+	age := time.Since(time.Unix(0, latest)).Round(time.Second)
+	if age > maxAge {
+		return HealthFailed, fmt.Sprintf("latest handshake %v ago, longer than %v", age, maxAge)
+	}
+	return HealthOK, fmt.Sprintf("latest handshake %v ago", age)
+}
+
+func (device *Device) healthCheckQueues(threshold float64) (HealthStatus, string) {
+	queues := []struct {
+		name     string
+		len, cap int
+	}{
+		{"encryption", device.queue.encryption.deepest(), device.memory.queueOutboundSize},
+		{"decryption", len(device.queue.decryption.c), cap(device.queue.decryption.c)},
+		{"handshake", len(device.queue.handshake.c) + len(device.queue.handshake.priority),
+			cap(device.queue.handshake.c) + cap(device.queue.handshake.priority)},
+	}
+	status := HealthOK
+	var message bytes.Buffer
+	for i, q := range queues {
+		if i > 0 {
+			message.WriteString(", ")
+		}
+		fmt.Fprintf(&message, "%s %d/%d", q.name, q.len, q.cap)
+		if float64(q.len) > threshold*float64(q.cap) {
+			status = HealthWarning
+		}
+	}
+	return status, message.String()
+}
+
+func (device *Device) healthCheckClock() (HealthStatus, string) {
+	now := device.now()
+	if now.Before(healthClockFloor) {
+		return HealthFailed, fmt.Sprintf("clock at %v, which looks unset", now.UTC())
+	}
+
+	device.peers.RLock()
+	var latest time.Time
+	var from *Peer
+	for _, peer := range device.peers.keyMap {
+		peer.handshake.mutex.RLock()
+		stamp := peer.handshake.lastTimestamp
+		peer.handshake.mutex.RUnlock()
+		if t := stamp.Time(); stamp != [len(stamp)]byte{} && t.After(latest) {
+			latest, from = t, peer
+		}
+	}
+	device.peers.RUnlock()
+
+	if behind := latest.Sub(now); from != nil && behind > healthClockSkew {
+		return HealthWarning, fmt.Sprintf("clock %v behind the handshake timestamp of %v", behind.Round(time.Second), from)
+	}
+	return HealthOK, ""
+}
+
+// IpcHealthOperation implements the "health" operation, an extension to the
+// WireGuard configuration protocol that runs HealthCheck and reports it,
+// using the same key=value line format as the "get" operation.
+func (device *Device) IpcHealthOperation(ctx context.Context, w io.Writer) error {
+	report := device.HealthCheck(ctx)
+
+	buf := byteBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer byteBufferPool.Put(buf)
+	sendf := func(format string, args ...any) {
+		fmt.Fprintf(buf, format, args...)
+		buf.WriteByte('\n')
+	}
+
+	sendf("health=%v", report.Status)
+	for _, check := range report.Checks {
+		sendf("check=%s", check.Name)
+		sendf("status=%v", check.Status)
+		sendf("duration_nsec=%d", check.Duration.Nanoseconds())
+		if check.Message != "" {
+			sendf("message=%s", check.Message)
+		}
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+	}
+	return nil
+}
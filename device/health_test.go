@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func healthStatuses(report HealthReport) map[string]HealthStatus {
+	statuses := make(map[string]HealthStatus)
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+	}
+	return statuses
+}
+
+func TestHealthCheck(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+
+	report := pair[0].dev.HealthCheck(context.Background())
+	if report.Status != HealthOK || len(report.Checks) != 5 {
+		t.Errorf("HealthCheck of a working device = %+v, want 5 checks, all ok", report)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report = pair[0].dev.HealthCheck(ctx)
+	for _, check := range report.Checks {
+		if check.Status != HealthFailed || check.Message != context.Canceled.Error() {
+			t.Errorf("check %s with a canceled context = %v %q, want it failed", check.Name, check.Status, check.Message)
+		}
+	}
+}
+
+func TestHealthCheckDown(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	report := dev.HealthCheck(context.Background())
+	want := map[string]HealthStatus{"bind": HealthFailed, "tun_mtu": HealthOK, "handshake": HealthFailed, "queues": HealthOK, "clock": HealthOK}
+	if got := healthStatuses(report); report.Status != HealthFailed || len(got) != len(want) {
+		t.Errorf("HealthCheck of a device down = %+v", report)
+	} else {
+		for name, status := range want {
+			if got[name] != status {
+				t.Errorf("check %s = %v, want %v", name, got[name], status)
+			}
+		}
+	}
+
+	dev.SetHealthCheckOptions(HealthCheckOptions{HandshakeMaxAge: -1})
+	if _, ok := healthStatuses(dev.HealthCheck(context.Background()))["handshake"]; ok {
+		t.Error("handshake checked despite a negative HandshakeMaxAge")
+	}
+}
+
+func TestIpcHealth(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go pair[0].dev.IpcHandle(server)
+	if _, err := client.Write([]byte("health=1\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(client)
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\n" {
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if len(lines) == 0 || lines[0] != "health=ok" || lines[len(lines)-1] != "errno=0" {
+		t.Fatalf("health operation returned %q", lines)
+	}
+	checks := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "check=") {
+			checks++
+		}
+	}
+	if checks != 5 {
+		t.Errorf("health operation reported %d checks, want 5: %q", checks, lines)
+	}
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// SizeHistogramBuckets is the number of buckets of a SizeHistogram in each
+// direction. Bucket 0 counts packets shorter than 64 bytes, bucket i > 0
+// those from 32<<i up to 64<<i bytes.
+const SizeHistogramBuckets = 11
+
+// SizeHistogramBucketLimit returns the exclusive upper bound of bucket i of a
+// SizeHistogram, in bytes.
+func SizeHistogramBucketLimit(i int) int {
+	return 64 << i
+}
+
+// A SizeHistogram counts the data packets sent and received by their
+// plaintext size. Keepalives are not counted.
+type SizeHistogram struct {
+	TX [SizeHistogramBuckets]uint64
+	RX [SizeHistogramBuckets]uint64
+}
+
+type sizeHistogram struct {
+	tx [SizeHistogramBuckets]atomic.Uint64
+	rx [SizeHistogramBuckets]atomic.Uint64
+}
+
+func sizeBucket(size int) int {
+	return min(max(bits.Len(uint(size))-6, 0), SizeHistogramBuckets-1)
+}
+
+func (h *sizeHistogram) load() (s SizeHistogram) {
+	for i := range s.TX {
+		s.TX[i] = h.tx[i].Load()
+		s.RX[i] = h.rx[i].Load()
+	}
+	return
+}
+
+// SizeHistogram returns the sizes of the data packets sent and received by
+// the device.
+func (device *Device) SizeHistogram() SizeHistogram {
+	return device.sizes.load()
+}
+
+// SetPeerSizeHistograms enables or disables counting packet sizes for each
+// peer in addition to the device as a whole, at the cost of a second atomic
+// add per packet. Counts are kept while disabled, but stop changing.
+func (device *Device) SetPeerSizeHistograms(enabled bool) {
+	device.peerSizeHistograms.Store(enabled)
+}
+
+// SizeHistogram returns the sizes of the data packets sent to and received
+// from the peer, while per-peer histograms were enabled with
+// Device.SetPeerSizeHistograms.
+func (peer *Peer) SizeHistogram() SizeHistogram {
+	return peer.sizes.load()
+}
+
+func (peer *Peer) countTXSize(size int) {
+	bucket := sizeBucket(size)
+	peer.device.sizes.tx[bucket].Add(1)
+	if peer.device.peerSizeHistograms.Load() {
+		peer.sizes.tx[bucket].Add(1)
+	}
+}
+
+func (peer *Peer) countRXSize(size int) {
+	bucket := sizeBucket(size)
+	peer.device.sizes.rx[bucket].Add(1)
+	if peer.device.peerSizeHistograms.Load() {
+		peer.sizes.rx[bucket].Add(1)
+	}
+}
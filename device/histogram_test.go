@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSizeBucket(t *testing.T) {
+	for _, tt := range []struct {
+		size, bucket int
+	}{
+		{1, 0},
+		{63, 0},
+		{64, 1},
+		{127, 1},
+		{128, 2},
+		{1420, 5},
+		{32767, 9},
+		{32768, 10},
+		{65535, 10},
+	} {
+		if got := sizeBucket(tt.size); got != tt.bucket {
+			t.Errorf("sizeBucket(%d) = %d, want %d", tt.size, got, tt.bucket)
+		}
+		if limit := SizeHistogramBucketLimit(tt.bucket); tt.size >= limit {
+			t.Errorf("size %d not below limit %d of its bucket", tt.size, limit)
+		}
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair[0].dev.SetPeerSizeHistograms(true)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// Ping and Pong are 28 byte ICMP packets, sent once in each direction.
+	var want SizeHistogram
+	want.TX[0], want.RX[0] = 1, 1
+	for i := range pair {
+		if got := pair[i].dev.SizeHistogram(); got != want {
+			t.Errorf("dev%d: SizeHistogram() = %v, want %v", i, got, want)
+		}
+	}
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	if got := peer.SizeHistogram(); got != want {
+		t.Errorf("peer SizeHistogram() = %v, want %v", got, want)
+	}
+	peer = pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	if got := peer.SizeHistogram(); got != (SizeHistogram{}) {
+		t.Errorf("peer SizeHistogram() = %v with per-peer histograms disabled, want zero", got)
+	}
+
+	out, err := pair[0].dev.IpcDebug("size_histograms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out, "size_bucket_limit="); n != 2*SizeHistogramBuckets {
+		t.Errorf("debug output has %d buckets, want %d", n, 2*SizeHistogramBuckets)
+	}
+	if !strings.HasPrefix(out, "size_bucket_limit=64\ntx_packets=1\nrx_packets=1\n") {
+		t.Errorf("unexpected debug output:\n%s", out)
+	}
+}
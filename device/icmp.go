@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"sync"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// maxEndpointErrors bounds the endpoint errors awaiting a handshake retry,
+// which is when they are attributed to peers.
+const maxEndpointErrors = 1024
+
+type endpointErrors struct {
+	sync.Mutex
+	byDst map[netip.AddrPort]conn.EndpointError
+}
+
+// handleEndpointError records err, reported by the bind for a datagram sent
+// to dst. It is called from the bind's goroutines, possibly while sending
+// with locks held, so it only stores the error for the next handshake retry.
+func (device *Device) handleEndpointError(dst netip.AddrPort, err conn.EndpointError) {
+	errs := &device.endpointErrors
+	errs.Lock()
+	defer errs.Unlock()
+	if errs.byDst == nil || len(errs.byDst) >= maxEndpointErrors {
+		errs.byDst = make(map[netip.AddrPort]conn.EndpointError)
+	}
+	errs.byDst[endpointErrorKey(dst)] = err
+}
+
+// takeEndpointError removes and returns the error recorded for dst, or zero.
+func (device *Device) takeEndpointError(dst netip.AddrPort) conn.EndpointError {
+	errs := &device.endpointErrors
+	errs.Lock()
+	defer errs.Unlock()
+	key := endpointErrorKey(dst)
+	err := errs.byDst[key]
+	delete(errs.byDst, key)
+	return err
+}
+
+// endpointErrorKey returns dst without its zone, as the bind may report a
+// link-local destination by interface index while the peer's endpoint names
+// the interface.
+func endpointErrorKey(dst netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(dst.Addr().WithZone(""), dst.Port())
+}
+
+// EndpointError returns the error the network last reported for datagrams
+// sent to the peer's endpoint, such as conn.ErrPortUnreachable when nothing
+// listens on it, or nil if there was none since the peer was last heard
+// from. Errors are attributed to the peer when it retries a handshake.
+func (peer *Peer) EndpointError() error {
+	if err := conn.EndpointError(peer.endpointError.Load()); err != 0 {
+		return err
+	}
+	return nil
+}
+
+// updateEndpointError attributes the error recorded for the peer's endpoint
+// to the peer, emitting an event if it is a new one. The handshake is
+// retried regardless, as the error may be transient.
+func (peer *Peer) updateEndpointError() {
+	dst := peer.endpointAddrPort()
+	if !dst.IsValid() {
+		return
+	}
+	err := peer.device.takeEndpointError(dst)
+	if err == 0 {
+		return
+	}
+	if conn.EndpointError(peer.endpointError.Swap(int32(err))) != err {
+		peer.device.log.Verbosef("%s - Endpoint %v reported %v", peer, dst, err)
+		peer.device.emitEvent(EventPeerEndpointError, peer)
+	}
+}
+
+// endpointErrorName returns the name of err in the UAPI.
+func endpointErrorName(err conn.EndpointError) string {
+	switch err {
+	case conn.ErrPortUnreachable:
+		return "port_unreachable"
+	case conn.ErrHostUnreachable:
+		return "host_unreachable"
+	case conn.ErrNetUnreachable:
+		return "net_unreachable"
+	case conn.ErrAdminProhibited:
+		return "admin_prohibited"
+	}
+	return "unknown"
+}
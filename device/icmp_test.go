@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+func TestEndpointError(t *testing.T) {
+	pair := genTestPair(t, false)
+	events := make(chan Event, 4)
+	pair[0].dev.SetEventHandler(func(event Event) {
+		if event.Type == EventPeerStateChanged {
+			return
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	pair[0].dev.handleEndpointError(netip.MustParseAddrPort("192.0.2.1:51820"), conn.ErrHostUnreachable)
+	pair[0].dev.handleEndpointError(peer.endpointAddrPort(), conn.ErrPortUnreachable)
+	if err := peer.EndpointError(); err != nil {
+		t.Fatalf("error %v attributed before a handshake retry", err)
+	}
+
+	// The retry attributes the error to the peer, once.
+	for i := 0; i < 2; i++ {
+		expiredRetransmitHandshake(peer)
+		if err := peer.EndpointError(); err != conn.ErrPortUnreachable {
+			t.Fatalf("EndpointError() = %v, want %v", err, conn.ErrPortUnreachable)
+		}
+		pair[0].dev.handleEndpointError(peer.endpointAddrPort(), conn.ErrPortUnreachable)
+	}
+	if event := <-events; event.Type != EventPeerEndpointError || event.Peer != pair[1].dev.staticIdentity.publicKey {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event: %+v", event)
+	default:
+	}
+	cfg, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "last_error=port_unreachable\n") {
+		t.Errorf("IpcGet output lacks last_error:\n%s", cfg)
+	}
+
+	// Hearing from the peer clears the error. The peer answers the
+	// initiation sent by the retry, so the ping goes the other way.
+	pair.Send(t, Pong, nil)
+	if err := peer.EndpointError(); err != nil {
+		t.Errorf("EndpointError() = %v after hearing from the peer, want nil", err)
+	}
+	if cfg, _ := pair[0].dev.IpcGet(); strings.Contains(cfg, "last_error=") {
+		t.Errorf("IpcGet output has last_error after hearing from the peer:\n%s", cfg)
+	}
+}
@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// ingressIPs is a set of prefixes that inbound packets from a peer may come
+// from, separate from the allowed IPs routed to it. It is never modified.
+type ingressIPs struct {
+	prefixes []netip.Prefix // masked, sorted and without duplicates
+	disjoint []netip.Prefix // prefixes without those within others, to search
+}
+
+func newIngressIPs(prefixes []netip.Prefix) *ingressIPs {
+	masked := make([]netip.Prefix, len(prefixes))
+	for i, prefix := range prefixes {
+		masked[i] = prefix.Masked()
+	}
+	slices.SortFunc(masked, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+	ips := &ingressIPs{prefixes: slices.Compact(masked)}
+	// Sorted by address, a prefix within another follows it, and any
+	// prefixes in between are within it too, so it follows the last one
+	// kept.
+	for _, prefix := range ips.prefixes {
+		if n := len(ips.disjoint); n > 0 && ips.disjoint[n-1].Overlaps(prefix) {
+			continue
+		}
+		ips.disjoint = append(ips.disjoint, prefix)
+	}
+	return ips
+}
+
+// contains reports whether src, a 4 or 16 byte address, is within one of
+// the prefixes, which only the last of the disjoint ones starting at or
+// before it can be.
+func (ips *ingressIPs) contains(src []byte) bool {
+	addr, ok := netip.AddrFromSlice(src)
+	if !ok {
+		return false
+	}
+	i, found := slices.BinarySearchFunc(ips.disjoint, addr, func(prefix netip.Prefix, addr netip.Addr) int {
+		return prefix.Addr().Compare(addr)
+	})
+	if !found {
+		i--
+	}
+	return i >= 0 && ips.disjoint[i].Contains(addr)
+}
+
+// SetIngressAllowedIPs makes prefixes the addresses inbound packets from the
+// peer may come from, in place of its allowed IPs. The allowed IPs keep
+// deciding which packets are sent to the peer, so that a spoke may, say,
+// route everything to its hub while only accepting packets from the hub's
+// network. A nil slice restores the default, validating sources against the
+// allowed IPs; an empty one accepts packets from no address.
+//
+// With IpcSet, replace_ingress_allowed_ips=true restores the default, each
+// ingress_allowed_ip key adds a prefix, and separate_ingress_allowed_ips=true
+// sets an empty set if none was set.
+func (peer *Peer) SetIngressAllowedIPs(prefixes []netip.Prefix) {
+	if prefixes == nil {
+		peer.ingressIPs.Store(nil)
+		return
+	}
+	peer.ingressIPs.Store(newIngressIPs(prefixes))
+}
+
+// IngressAllowedIPs returns the prefixes set by SetIngressAllowedIPs, and
+// whether they are set, rather than sources being validated against the
+// allowed IPs.
+func (peer *Peer) IngressAllowedIPs() ([]netip.Prefix, bool) {
+	ips := peer.ingressIPs.Load()
+	if ips == nil {
+		return nil, false
+	}
+	return slices.Clone(ips.prefixes), true
+}
+
+// addIngressAllowedIP adds prefix to the peer's ingress allowed IPs, which
+// start out empty if they were not set.
+func (peer *Peer) addIngressAllowedIP(prefix netip.Prefix) {
+	var prefixes []netip.Prefix
+	if ips := peer.ingressIPs.Load(); ips != nil {
+		prefixes = ips.prefixes
+	}
+	peer.ingressIPs.Store(newIngressIPs(append(slices.Clip(prefixes), prefix)))
+}
+
+// admitsSource reports whether an inbound packet from the peer may come from
+// src, a 4 or 16 byte address.
+func (peer *Peer) admitsSource(src []byte) bool {
+	if peer.allowAnySource.Load() {
+		return true
+	}
+	if ips := peer.ingressIPs.Load(); ips != nil {
+		return ips.contains(src)
+	}
+	return peer.device.allowedips.Lookup(src) == peer
+}
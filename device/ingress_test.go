@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+func TestIngressAllowedIPs(t *testing.T) {
+	pair := genTestPair(t, false)
+	remote := pair[1].dev.staticIdentity.publicKey
+	dev := pair[0].dev
+	peer := dev.LookupPeer(remote)
+	pair.Send(t, Pong, nil)
+
+	// By default, sources are validated against the allowed IPs, and IpcGet
+	// reports nothing more.
+	if _, ok := peer.IngressAllowedIPs(); ok {
+		t.Fatal("ingress allowed IPs set by default")
+	}
+	if out, err := dev.IpcGet(); err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(out, "ingress") {
+		t.Errorf("IpcGet reports ingress allowed IPs by default:\n%s", out)
+	}
+	pair.Send(t, Ping, nil)
+
+	// The peer may send from another address than the one routed to it,
+	// which keeps being routed to it.
+	other := netip.MustParseAddr("1.0.0.99")
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(remote[:]),
+		"ingress_allowed_ip", "1.0.0.99/32",
+		"ingress_allowed_ip", "10.0.0.0/8",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Pong, nil)
+	delivered := func(src netip.Addr) bool {
+		t.Helper()
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, src)
+		select {
+		case <-pair[0].tun.Inbound:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+	if !delivered(other) {
+		t.Error("packet from an ingress allowed IP dropped")
+	}
+	if delivered(pair[1].ip) {
+		t.Error("packet from an allowed IP outside the ingress allowed IPs delivered")
+	}
+	out, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"allowed_ip=" + netip.PrefixFrom(pair[1].ip, 32).String(),
+		"separate_ingress_allowed_ips=true",
+		"ingress_allowed_ip=1.0.0.99/32",
+		"ingress_allowed_ip=10.0.0.0/8",
+	} {
+		if !strings.Contains(out, "\n"+line+"\n") {
+			t.Errorf("IpcGet output missing %q", line)
+		}
+	}
+
+	// No ingress allowed IPs accept no packets at all.
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(remote[:]),
+		"replace_ingress_allowed_ips", "true",
+		"separate_ingress_allowed_ips", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if prefixes, ok := peer.IngressAllowedIPs(); !ok || len(prefixes) != 0 {
+		t.Fatalf("ingress allowed IPs %v, %v; want none", prefixes, ok)
+	}
+	if delivered(other) || delivered(pair[1].ip) {
+		t.Error("packet delivered without ingress allowed IPs")
+	}
+
+	// Replacing them alone restores the default.
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(remote[:]),
+		"replace_ingress_allowed_ips", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := peer.IngressAllowedIPs(); ok {
+		t.Error("ingress allowed IPs not replaced by the default")
+	}
+	pair.Send(t, Ping, nil)
+
+	peer.SetIngressAllowedIPs([]netip.Prefix{
+		netip.MustParsePrefix("10.1.2.3/8"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("1.0.0.99/32"),
+	})
+	want := []netip.Prefix{netip.MustParsePrefix("1.0.0.99/32"), netip.MustParsePrefix("10.0.0.0/8")}
+	if prefixes, _ := peer.IngressAllowedIPs(); !slices.Equal(prefixes, want) {
+		t.Errorf("ingress allowed IPs %v, want %v", prefixes, want)
+	}
+}
+
+func TestIngressIPsContains(t *testing.T) {
+	var prefixes []netip.Prefix
+	for _, s := range []string{
+		"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.200.0.0/16",
+		"192.168.1.128/25", "192.168.1.0/26", "0.0.0.0/32",
+		"2001:db8::/32", "2001:db8:1::/48", "fd00::1/128",
+	} {
+		prefixes = append(prefixes, netip.MustParsePrefix(s))
+	}
+	ips := newIngressIPs(prefixes)
+	for _, s := range []string{
+		"10.0.0.1", "10.1.2.3", "10.2.0.1", "10.255.255.255", "11.0.0.0", "9.255.255.255",
+		"192.168.1.1", "192.168.1.64", "192.168.1.200", "192.168.2.1", "0.0.0.0", "0.0.0.1",
+		"2001:db8::1", "2001:db8:ffff::1", "2001:db9::", "fd00::1", "fd00::2", "::",
+	} {
+		addr := netip.MustParseAddr(s)
+		want := slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+		if got := ips.contains(addr.AsSlice()); got != want {
+			t.Errorf("contains(%v) = %v, want %v", addr, got, want)
+		}
+	}
+}
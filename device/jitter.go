@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+// RekeyAfterTimeJitterMax bounds the jitter each peer adds to RekeyAfterTime,
+// so that sessions established together, such as after a restart, are not
+// all renewed at once every RekeyAfterTime. Renewals still start well ahead
+// of the last-minute handshake at RejectAfterTime-KeepaliveTimeout-RekeyTimeout.
+const RekeyAfterTimeJitterMax = 15 * time.Second
+
+// SetHandshakeJitter delays every handshake initiation the device starts of
+// its own accord, such as for traffic to a peer without a session or to
+// renew a session, by a random time up to fraction of RekeyTimeout. It
+// spreads the handshakes of many peers that would otherwise start at the
+// same time, at the cost of that much latency for the first packets of a
+// session. Retries, which are spread already, are not delayed. fraction
+// must be between 0, which disables the jitter, and 1.
+func (device *Device) SetHandshakeJitter(fraction float64) error {
+	if !(fraction >= 0 && fraction <= 1) {
+		return fmt.Errorf("handshake jitter %v not between 0 and 1", fraction)
+	}
+	device.handshakeJitter.Store(int64(fraction * float64(RekeyTimeout)))
+	return nil
+}
+
+// HandshakeJitter returns the fraction of RekeyTimeout set by
+// SetHandshakeJitter.
+func (device *Device) HandshakeJitter() float64 {
+	return float64(device.handshakeJitter.Load()) / float64(RekeyTimeout)
+}
+
+// newRekeyAfterTime returns RekeyAfterTime with the jitter of a new peer.
+func newRekeyAfterTime() time.Duration {
+	return RekeyAfterTime + time.Duration(fastrandn(uint32(RekeyAfterTimeJitterMax/time.Millisecond)))*time.Millisecond
+}
+
+// rekeyDue reports whether the session of keypair is due for renewal by
+// time at now.
+func (peer *Peer) rekeyDue(keypair *Keypair, now time.Time) bool {
+	rekeyAfterTime, _ := peer.rekeyAfter()
+	return keypair.isInitiator && now.Sub(keypair.created) > rekeyAfterTime
+}
+
+// delayInitiation schedules a handshake initiation to the peer after the
+// handshake jitter, unless one is scheduled already, and reports whether
+// the initiation is delayed.
+func (peer *Peer) delayInitiation() bool {
+	window := time.Duration(peer.device.handshakeJitter.Load())
+	if window <= 0 || !peer.timersActive() {
+		return false
+	}
+	if !peer.timers.delayedInitiation.IsPending() {
+		delay := time.Duration(fastrandn(uint32(window/time.Millisecond)+1)) * time.Millisecond
+		peer.timers.delayedInitiation.Mod(delay)
+	}
+	return true
+}
+
+func expiredDelayedInitiation(peer *Peer) {
+	peer.sendHandshakeInitiation(false, true)
+}
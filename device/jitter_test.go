@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRekeyJitter(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	addTestPeers(t, dev, 1000)
+
+	// Step a clock through the renewals of sessions all established at
+	// start, noting the tick each peer renews its session at.
+	const tick = 100 * time.Millisecond
+	start := time.Now()
+	keypair := &Keypair{isInitiator: true, created: start}
+	renewals := make(map[time.Duration]int)
+	for _, peer := range dev.peers.keyMap {
+		for now := start.Add(RekeyAfterTime - tick); ; now = now.Add(tick) {
+			if peer.rekeyDue(keypair, now) {
+				renewals[now.Sub(start)]++
+				break
+			}
+		}
+	}
+	most := 0
+	for at, n := range renewals {
+		if at <= RekeyAfterTime || at > RekeyAfterTime+RekeyAfterTimeJitterMax+tick {
+			t.Errorf("%d sessions renewed after %v", n, at)
+		}
+		most = max(most, n)
+	}
+	if len(renewals) < 100 || most > 50 {
+		t.Errorf("renewals spread over %d ticks, at most %d at once", len(renewals), most)
+	}
+}
+
+func TestHandshakeJitter(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[1].dev
+	for _, value := range []string{"-0.1", "1.5", "NaN", "soon"} {
+		if err := dev.IpcSet(uapiCfg("handshake_jitter", value)); err == nil {
+			t.Errorf("handshake_jitter=%s accepted", value)
+		}
+	}
+	if err := dev.IpcSet(uapiCfg("handshake_jitter", "0.1")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "\nhandshake_jitter=0.1\n") {
+		t.Errorf("config lacks handshake_jitter=0.1:\n%s", cfg)
+	}
+
+	// The initiation is sent once the jitter has passed.
+	time.Sleep(HandshakeInitationRate)
+	peer := dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	keypair := peer.keypairs.Current()
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	peer.SendHandshakeInitiation(false)
+	if !peer.timers.delayedInitiation.IsPending() {
+		t.Error("initiation not delayed")
+	}
+	for start := time.Now(); peer.keypairs.Current() == keypair; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("handshake did not complete")
+		}
+	}
+	pair.Send(t, Pong, nil)
+}
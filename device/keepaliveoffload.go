@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// keepaliveOffload is the persistent keepalive of a peer that the bind has
+// the platform send, if it is a conn.KeepaliveOffloader.
+type keepaliveOffload struct {
+	sync.Mutex
+	cancel   func()   // nil unless offloaded
+	dst      string   // of the endpoint offloaded to
+	keypair  *Keypair // that encrypted the payload
+	interval uint32
+}
+
+// refreshKeepaliveOffload offloads the persistent keepalives of the peer to
+// the bind, if it supports it, for the current endpoint and keypair,
+// establishing the offload anew if either changed since. It reports whether
+// the keepalives are offloaded; if not, the persistent keepalive timer
+// sends them.
+//
+// Each offload sends the same keepalive message, which the peer accepts
+// once and then drops as a replay, which is harmless: what matters is that
+// it keeps the NAT mappings on the way open.
+func (peer *Peer) refreshKeepaliveOffload() bool {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+	return peer.refreshKeepaliveOffloadLocked()
+}
+
+// refreshKeepaliveOffloadLocked is refreshKeepaliveOffload for callers that
+// hold the net mutex, which keeps the bind from being closed or replaced
+// while it is offloaded to.
+func (peer *Peer) refreshKeepaliveOffloadLocked() bool {
+	offloader, ok := peer.device.net.bind.(conn.KeepaliveOffloader)
+	if !ok {
+		return false
+	}
+	offload := &peer.keepaliveOffload
+	offload.Lock()
+	defer offload.Unlock()
+
+	interval := peer.persistentKeepaliveInterval.Load()
+	keypair := peer.keypairs.Current()
+	peer.endpoint.Lock()
+	ep := peer.endpoint.val
+	peer.endpoint.Unlock()
+	if interval == 0 || keypair == nil || ep == nil || !peer.isRunning.Load() {
+		offload.stop()
+		return false
+	}
+	dst := ep.DstToString()
+	if offload.cancel != nil && offload.dst == dst && offload.keypair == keypair && offload.interval == interval {
+		return true
+	}
+	offload.stop()
+
+	nonce := keypair.sendNonce.Add(1) - 1
+	if nonce >= RejectAfterMessages {
+		keypair.sendNonce.Store(RejectAfterMessages)
+		return false
+	}
+	payload := keypair.keepaliveMessage(nonce)
+	cancel, err := offloader.OffloadKeepalive(ep, payload, time.Duration(interval)*time.Second)
+	if err != nil {
+		peer.device.log.Verbosef("%v - Failed to offload keepalives: %v", peer, err)
+		return false
+	}
+	peer.device.log.Verbosef("%v - Offloaded keepalives to %s every %d seconds", peer, dst, interval)
+	offload.cancel, offload.dst, offload.keypair, offload.interval = cancel, dst, keypair, interval
+	return true
+}
+
+// cancelKeepaliveOffload stops the keepalives offloaded for the peer, if any.
+func (peer *Peer) cancelKeepaliveOffload() {
+	peer.keepaliveOffload.Lock()
+	defer peer.keepaliveOffload.Unlock()
+	peer.keepaliveOffload.stop()
+}
+
+// cancelKeepaliveOffloadsLocked stops the keepalives offloaded for all
+// peers, before the bind they were offloaded to is closed or changed. The
+// caller must hold the net mutex, and restarts them with
+// refreshKeepaliveOffloadsLocked.
+func (device *Device) cancelKeepaliveOffloadsLocked() {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.cancelKeepaliveOffload()
+	}
+}
+
+// refreshKeepaliveOffloadsLocked offloads the keepalives of all peers to
+// the bind anew. The caller must hold the net mutex.
+func (device *Device) refreshKeepaliveOffloadsLocked() {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.refreshKeepaliveOffloadLocked()
+	}
+}
+
+func (offload *keepaliveOffload) stop() {
+	if offload.cancel != nil {
+		offload.cancel()
+	}
+	offload.cancel, offload.dst, offload.keypair, offload.interval = nil, "", nil, 0
+}
+
+// keepaliveMessage returns a transport data message without content, sent
+// with nonce.
+func (keypair *Keypair) keepaliveMessage(nonce uint64) []byte {
+	msg := make([]byte, MessageTransportHeaderSize, MessageKeepaliveSize)
+	binary.LittleEndian.PutUint32(msg[0:4], MessageTransportType)
+	binary.LittleEndian.PutUint32(msg[4:8], keypair.remoteIndex)
+	binary.LittleEndian.PutUint64(msg[8:16], nonce)
+	var nonceBytes [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonceBytes[4:], nonce)
+	return keypair.send.Seal(msg, nonceBytes[:], nil, nil)
+}
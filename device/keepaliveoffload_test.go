@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// offloadBind records the keepalives offloaded to it, without sending them.
+type offloadBind struct {
+	conn.Bind
+	mu       sync.Mutex
+	offloads []*testOffload
+}
+
+type testOffload struct {
+	payload  []byte
+	interval time.Duration
+	canceled bool
+}
+
+func (b *offloadBind) OffloadKeepalive(ep conn.Endpoint, payload []byte, interval time.Duration) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	offload := &testOffload{payload: append([]byte(nil), payload...), interval: interval}
+	b.offloads = append(b.offloads, offload)
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		offload.canceled = true
+	}, nil
+}
+
+// Close ends the offloads, as closing the sockets they are sent from does.
+func (b *offloadBind) Close() error {
+	b.mu.Lock()
+	for _, offload := range b.offloads {
+		offload.canceled = true
+	}
+	b.mu.Unlock()
+	return b.Bind.Close()
+}
+
+// active returns the offloads not canceled.
+func (b *offloadBind) active() (active []testOffload) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, offload := range b.offloads {
+		if !offload.canceled {
+			active = append(active, *offload)
+		}
+	}
+	return active
+}
+
+// openKeepalive reports whether dev accepts msg as a keepalive.
+func openKeepalive(dev *Device, msg []byte) bool {
+	if len(msg) != MessageKeepaliveSize || binary.LittleEndian.Uint32(msg) != MessageTransportType {
+		return false
+	}
+	keypair := dev.indexTable.Lookup(binary.LittleEndian.Uint32(msg[4:8])).keypair
+	if keypair == nil {
+		return false
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	copy(nonce[4:], msg[8:16])
+	content, err := keypair.receive.Open(nil, nonce[:], msg[MessageTransportHeaderSize:], nil)
+	return err == nil && len(content) == 0
+}
+
+func TestKeepaliveOffload(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[1].dev
+	bind := &offloadBind{Bind: conn.NewDefaultBind()}
+	if err := dev.SwapBind(bind); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	if active := bind.active(); len(active) != 0 {
+		t.Fatalf("%d keepalives offloaded without a persistent keepalive", len(active))
+	}
+
+	peer := dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	setInterval := func(interval string) {
+		t.Helper()
+		if err := dev.IpcSet(uapiCfg("public_key", peer.publicKey().Hex(), "persistent_keepalive_interval", interval)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setInterval("1")
+	active := bind.active()
+	if len(active) != 1 || active[0].interval != time.Second {
+		t.Fatalf("offloads %v, want one every second", active)
+	}
+	if !openKeepalive(pair[0].dev, active[0].payload) {
+		t.Fatal("offloaded keepalive not accepted by the peer")
+	}
+	first := active[0].payload
+
+	// A new session replaces the offload with a keepalive of its keypair.
+	// Initiations closer than HandshakeInitationRate are dropped.
+	time.Sleep(HandshakeInitationRate)
+	keypair := peer.keypairs.Current()
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	peer.SendHandshakeInitiation(false)
+	for start := time.Now(); peer.keypairs.Current() == keypair; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("handshake did not complete")
+		}
+	}
+	active = bind.active()
+	if len(active) != 1 || string(active[0].payload) == string(first) {
+		t.Fatalf("%d offloads after rekeying, want one anew", len(active))
+	}
+	if !openKeepalive(pair[0].dev, active[0].payload) {
+		t.Error("offloaded keepalive of the new session not accepted by the peer")
+	}
+
+	// Reopening the bind offloads the keepalives to it anew.
+	if err := dev.RebindTransport(); err != nil {
+		t.Fatal(err)
+	}
+	if active := bind.active(); len(active) != 1 {
+		t.Fatalf("%d offloads after rebinding, want one", len(active))
+	}
+
+	setInterval("0")
+	if active := bind.active(); len(active) != 0 {
+		t.Errorf("%d keepalives offloaded after disabling persistent keepalives", len(active))
+	}
+	pair.Send(t, Pong, nil)
+}
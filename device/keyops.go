@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"runtime"
+)
+
+// PrivateKeyOperations performs the handshake operations that need the
+// device's static private key, so that it can be held by a backend such as
+// an HSM or TPM instead of the process. NoisePrivateKey implements it, for
+// a key held in memory; the device uses its own key through a
+// *NoisePrivateKey, so that wiping the key wipes what the handshakes use.
+type PrivateKeyOperations interface {
+	// PublicKey returns the public key of the private key.
+	PublicKey() NoisePublicKey
+
+	// SharedSecret returns the X25519 shared secret of the private key and
+	// pk, or an error if it is all zeros.
+	SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error)
+}
+
+var _ PrivateKeyOperations = NoisePrivateKey{}
+
+// SharedSecret returns the X25519 shared secret of sk and pk.
+func (sk NoisePrivateKey) SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error) {
+	return sk.sharedSecret(pk)
+}
+
+var errPrivateKeyBusy = errors.New("private key operations busy")
+
+// privateKeyOps bounds the concurrent use of a PrivateKeyOperations. The nil
+// *privateKeyOps uses the zero private key, as a device without one does.
+type privateKeyOps struct {
+	ops   PrivateKeyOperations
+	slots chan struct{} // nil if unbounded
+}
+
+func (k *privateKeyOps) backend() PrivateKeyOperations {
+	if k == nil {
+		return NoisePrivateKey{}
+	}
+	return k.ops
+}
+
+// sharedSecret computes a shared secret for a handshake message. If the
+// backend is busy, it fails at once, dropping the message for the peer to
+// retry, rather than holding up a handshake worker.
+func (k *privateKeyOps) sharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error) {
+	if k != nil && k.slots != nil {
+		select {
+		case k.slots <- struct{}{}:
+			defer func() { <-k.slots }()
+		default:
+			return [NoisePublicKeySize]byte{}, errPrivateKeyBusy
+		}
+	}
+	return k.backend().SharedSecret(pk)
+}
+
+// precompute computes the static-static shared secret with a peer, waiting
+// for the backend if it is busy.
+func (k *privateKeyOps) precompute(pk NoisePublicKey) [NoisePublicKeySize]byte {
+	if k != nil && k.slots != nil {
+		k.slots <- struct{}{}
+		defer func() { <-k.slots }()
+	}
+	ss, _ := k.backend().SharedSecret(pk)
+	return ss
+}
+
+// SetPrivateKeyOperations makes the device use ops for the handshake
+// operations that need its static private key, replacing the key set by
+// SetPrivateKey. The handshake workers use ops for at most maxConcurrent
+// messages at once, dropping those arriving while all are in use for their
+// senders to retry, so that a slow backend cannot occupy all of them. A
+// non-positive maxConcurrent selects half the workers.
+func (device *Device) SetPrivateKeyOperations(ops PrivateKeyOperations, maxConcurrent int) error {
+	if ops == nil {
+		return errors.New("nil private key operations")
+	}
+	if maxConcurrent <= 0 {
+		maxConcurrent = max(runtime.NumCPU()/2, 1)
+	}
+	return device.setStaticIdentity(&privateKeyOps{
+		ops:   ops,
+		slots: make(chan struct{}, maxConcurrent),
+	}, false)
+}
@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// remoteSigner is a fake remote key backend, which holds the private key in
+// a goroutine of its own and answers requests after a delay.
+type remoteSigner struct {
+	public   NoisePublicKey
+	requests chan signerRequest
+	calls    atomic.Int32
+}
+
+type signerRequest struct {
+	pk    NoisePublicKey
+	reply chan [NoisePublicKeySize]byte
+}
+
+func newRemoteSigner(sk NoisePrivateKey, delay time.Duration) *remoteSigner {
+	s := &remoteSigner{public: sk.PublicKey(), requests: make(chan signerRequest)}
+	go func() {
+		for req := range s.requests {
+			time.Sleep(delay)
+			ss, _ := sk.SharedSecret(req.pk)
+			req.reply <- ss
+		}
+	}()
+	return s
+}
+
+func (s *remoteSigner) PublicKey() NoisePublicKey { return s.public }
+
+func (s *remoteSigner) SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error) {
+	s.calls.Add(1)
+	reply := make(chan [NoisePublicKeySize]byte)
+	s.requests <- signerRequest{pk, reply}
+	ss := <-reply
+	if isZero(ss[:]) {
+		return ss, errInvalidPublicKey
+	}
+	return ss, nil
+}
+
+func TestPrivateKeyOperations(t *testing.T) {
+	pair := genTestPair(t, false)
+	if err := pair[0].dev.SetPrivateKeyOperations(nil, 1); err == nil {
+		t.Error("nil private key operations accepted")
+	}
+	var signers [2]*remoteSigner
+	for i := range pair {
+		signer := newRemoteSigner(pair[i].dev.staticIdentity.privateKey, time.Millisecond)
+		signers[i] = signer
+		if err := pair[i].dev.SetPrivateKeyOperations(signer, 1); err != nil {
+			t.Fatal(err)
+		}
+		if !pair[i].dev.staticIdentity.privateKey.IsZero() {
+			t.Fatalf("dev%d kept the private key after switching to a remote signer", i)
+		}
+		if pair[i].dev.staticIdentity.publicKey != signer.public {
+			t.Fatalf("dev%d public key changed after switching to a remote signer", i)
+		}
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	for i, signer := range signers {
+		pair[i].dev.Close()
+		close(signer.requests)
+		if calls := signer.calls.Load(); calls < 2 {
+			t.Errorf("dev%d: signer called %d times, want a precomputation and a handshake", i, calls)
+		}
+	}
+}
+
+type blockingKey struct {
+	NoisePrivateKey
+	release chan struct{}
+}
+
+func (k blockingKey) SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error) {
+	<-k.release
+	return k.NoisePrivateKey.SharedSecret(pk)
+}
+
+func TestPrivateKeyOperationsBusy(t *testing.T) {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := blockingKey{sk, make(chan struct{})}
+	ops := &privateKeyOps{ops: key, slots: make(chan struct{}, 1)}
+	peer := sk.publicKey()
+
+	done := make(chan error)
+	go func() {
+		_, err := ops.sharedSecret(peer)
+		done <- err
+	}()
+	for len(ops.slots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := ops.sharedSecret(peer); !errors.Is(err, errPrivateKeyBusy) {
+		t.Fatalf("second operation while the backend is busy: %v, want %v", err, errPrivateKeyBusy)
+	}
+	close(key.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ops.sharedSecret(peer); err != nil {
+		t.Fatalf("operation once the backend is free: %v", err)
+	}
+}
@@ -14,17 +14,16 @@ import (
 	"github.com/darkit/wireguard/replay"
 )
 
-/* Due to limitations in Go and /x/crypto there is currently
- * no way to ensure that key material is securely ereased in memory.
- *
- * Since this may harm the forward secrecy property,
- * we plan to resolve this issue; whenever Go allows us to do so.
+/* The transport keys of a keypair are wiped once its AEADs are built; the
+ * AEADs themselves are dropped by DeleteKeypair; see zeroize.go.
  */
 
 type Keypair struct {
 	sendNonce    atomic.Uint64
+	receiveNonce atomic.Uint64 // one more than the highest counter accepted
 	send         cipher.AEAD
 	receive      cipher.AEAD
+	suite        CipherSuite
 	replayFilter replay.Filter
 	isInitiator  bool
 	created      time.Time
@@ -45,6 +44,87 @@ func (kp *Keypairs) Current() *Keypair {
 	return kp.current
 }
 
+// KeypairSlot identifies the role of one of a peer's keypairs during rekeying.
+type KeypairSlot int
+
+const (
+	// KeypairPrevious is the keypair replaced by the current one, kept
+	// to decrypt packets still in flight.
+	KeypairPrevious KeypairSlot = iota
+
+	// KeypairCurrent is the keypair used to send.
+	KeypairCurrent
+
+	// KeypairNext is the keypair of a handshake we responded to, which
+	// becomes current once the initiator sends with it.
+	KeypairNext
+)
+
+func (slot KeypairSlot) String() string {
+	switch slot {
+	case KeypairPrevious:
+		return "previous"
+	case KeypairCurrent:
+		return "current"
+	case KeypairNext:
+		return "next"
+	}
+	return "unknown"
+}
+
+// KeypairInfo describes one of a peer's keypairs, without its key material.
+type KeypairInfo struct {
+	Slot         KeypairSlot
+	Created      time.Time
+	Initiator    bool   // whether the keypair is from a handshake we initiated
+	LocalIndex   uint32 // the receiver index the peer sends to
+	RemoteIndex  uint32 // the receiver index we send to
+	SendNonce    uint64 // the number of messages sent with the keypair
+	ReceiveNonce uint64 // one more than the highest counter received with it
+	CipherSuite  CipherSuite
+}
+
+func (keypair *Keypair) info(slot KeypairSlot) KeypairInfo {
+	return KeypairInfo{
+		Slot:         slot,
+		Created:      keypair.created,
+		Initiator:    keypair.isInitiator,
+		LocalIndex:   keypair.localIndex,
+		RemoteIndex:  keypair.remoteIndex,
+		SendNonce:    keypair.sendNonce.Load(),
+		ReceiveNonce: keypair.receiveNonce.Load(),
+		CipherSuite:  keypair.suite,
+	}
+}
+
+// noteReceived records that a message with counter was accepted, returning
+// the counter expected before, one more than the highest accepted. It is
+// only called from the peer's sequential receiver.
+func (keypair *Keypair) noteReceived(counter uint64) (expected uint64) {
+	expected = keypair.receiveNonce.Load()
+	if counter >= expected {
+		keypair.receiveNonce.Store(counter + 1)
+	}
+	return expected
+}
+
+// KeypairInfo describes the peer's previous, current and next keypairs, in
+// that order, omitting those it does not have.
+func (peer *Peer) KeypairInfo() []KeypairInfo {
+	keypairs := &peer.keypairs
+	keypairs.RLock()
+	defer keypairs.RUnlock()
+	infos := make([]KeypairInfo, 0, 3)
+	for slot, keypair := range [...]*Keypair{keypairs.previous, keypairs.current, keypairs.next.Load()} {
+		if keypair != nil {
+			infos = append(infos, keypair.info(KeypairSlot(slot)))
+		}
+	}
+	return infos
+}
+
+// DeleteKeypair removes key from the index table, dropping it. All keypairs
+// that are done with go through it.
 func (device *Device) DeleteKeypair(key *Keypair) {
 	if key != nil {
 		device.indexTable.Delete(key.localIndex)
@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeypairInfo(t *testing.T) {
+	pair := genTestPair(t, false)
+	start := time.Now()
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	for i, initiator := range []bool{false, true} { // dev1 sends the Ping, initiating
+		peer := pair[i].dev.LookupPeer(pair[1-i].dev.staticIdentity.publicKey)
+		infos := peer.KeypairInfo()
+		if len(infos) != 1 {
+			t.Fatalf("dev%d: %d keypairs, want only the current one: %+v", i, len(infos), infos)
+		}
+		info := infos[0]
+		if info.Slot != KeypairCurrent || info.Initiator != initiator {
+			t.Errorf("dev%d: keypair %v with initiator %t, want current with initiator %t", i, info.Slot, info.Initiator, initiator)
+		}
+		if info.Created.Before(start.Add(-time.Second)) || info.Created.After(time.Now()) {
+			t.Errorf("dev%d: keypair created at %v, during the test starting at %v", i, info.Created, start)
+		}
+		if info.SendNonce == 0 || info.ReceiveNonce == 0 {
+			t.Errorf("dev%d: send nonce %d and receive nonce %d after a ping and pong, want both nonzero", i, info.SendNonce, info.ReceiveNonce)
+		}
+		other := pair[1-i].dev.LookupPeer(pair[i].dev.staticIdentity.publicKey).KeypairInfo()[0]
+		if info.LocalIndex != other.RemoteIndex || info.RemoteIndex != other.LocalIndex {
+			t.Errorf("dev%d: indices %d/%d don't match the peer's %d/%d", i, info.LocalIndex, info.RemoteIndex, other.RemoteIndex, other.LocalIndex)
+		}
+	}
+
+	out, err := pair[1].dev.IpcDebug("keypairs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "public_key=") || !strings.HasPrefix(lines[1], "keypair=current created_sec=") || !strings.Contains(lines[1], " initiator=true ") {
+		t.Errorf("unexpected debug output:\n%s", out)
+	}
+}
@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"testing"
+)
+
+// Alice's key pair from RFC 7748, section 6.1, as wg genkey and wg pubkey
+// would print it.
+const (
+	testPrivateKey = "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo="
+	testPublicKey  = "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="
+	testPublicHex  = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+)
+
+func TestKeyDerivation(t *testing.T) {
+	var sk NoisePrivateKey
+	if err := sk.FromBase64(testPrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.PublicKey()
+	if got := pk.Base64(); got != testPublicKey {
+		t.Errorf("PublicKey().Base64() = %s, want %s", got, testPublicKey)
+	}
+	if got := pk.Hex(); got != testPublicHex {
+		t.Errorf("PublicKey().Hex() = %s, want %s", got, testPublicHex)
+	}
+
+	var parsed NoisePublicKey
+	if err := parsed.FromBase64(testPublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equals(pk) {
+		t.Error("public key did not round trip through base64")
+	}
+	if err := parsed.FromHex(pk.Hex()); err != nil || !parsed.Equals(pk) {
+		t.Errorf("public key did not round trip through hex: %v", err)
+	}
+}
+
+func TestNewKeys(t *testing.T) {
+	sk, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sk[0]&7 != 0 || sk[31]&128 != 0 || sk[31]&64 == 0 {
+		t.Error("generated private key is not clamped")
+	}
+	var parsed NoisePrivateKey
+	if err := parsed.FromBase64(sk.Base64()); err != nil || !parsed.Equals(sk) {
+		t.Errorf("private key did not round trip through base64: %v", err)
+	}
+	if err := parsed.FromHex(sk.Hex()); err != nil || !parsed.Equals(sk) {
+		t.Errorf("private key did not round trip through hex: %v", err)
+	}
+
+	psk, err := NewPresharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if psk == (NoisePresharedKey{}) {
+		t.Error("generated preshared key is zero")
+	}
+	var parsedPSK NoisePresharedKey
+	if err := parsedPSK.FromBase64(psk.Base64()); err != nil || parsedPSK != psk {
+		t.Errorf("preshared key did not round trip through base64: %v", err)
+	}
+}
+
+func TestKeyDecodeErrors(t *testing.T) {
+	var pk NoisePublicKey
+	for _, src := range []string{
+		"",
+		"not base64!",
+		"hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTg==", // 31 bytes
+	} {
+		if err := pk.FromBase64(src); err == nil {
+			t.Errorf("FromBase64(%q) succeeded", src)
+		}
+	}
+}
+
+// lowOrderPoints are the Curve25519 points of small order, from libsodium's
+// blocklist, followed by their encodings with the ignored top bit set.
+var lowOrderPoints = []string{
+	"0000000000000000000000000000000000000000000000000000000000000000",
+	"0100000000000000000000000000000000000000000000000000000000000000",
+	"e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800",
+	"5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f1157",
+	"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	"edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	"eeffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	"0000000000000000000000000000000000000000000000000000000000000080",
+	"0100000000000000000000000000000000000000000000000000000000000080",
+	"e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b880",
+	"5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f11d7",
+	"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	"edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	"eeffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+}
+
+func TestUnsafeKeys(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	for _, h := range lowOrderPoints {
+		var pk NoisePublicKey
+		if err := pk.FromHex(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := device.NewPeer(pk); !errors.Is(err, ErrLowOrderKey) {
+			t.Errorf("NewPeer(%s) = %v, want ErrLowOrderKey", h, err)
+		}
+		if err := device.IpcSet(uapiCfg("public_key", h)); !errors.Is(err, ErrLowOrderKey) {
+			t.Errorf("setting peer %s = %v, want ErrLowOrderKey", h, err)
+		}
+	}
+	var pk NoisePublicKey
+	if err := pk.FromHex(testPublicHex); err != nil {
+		t.Fatal(err)
+	}
+	if pk.isLowOrder() {
+		t.Errorf("%s reported of small order", testPublicHex)
+	}
+
+	own := device.staticIdentity.publicKey
+	if _, err := device.NewPeer(own); !errors.Is(err, ErrOwnKey) {
+		t.Errorf("NewPeer with the device's own key = %v, want ErrOwnKey", err)
+	}
+	if err := device.IpcSet(uapiCfg("public_key", own.Hex())); !errors.Is(err, ErrOwnKey) {
+		t.Errorf("setting peer with the device's own key = %v, want ErrOwnKey", err)
+	}
+	if _, err := device.Reconcile(Config{Peers: []PeerConfig{{PublicKey: own}}}); !errors.Is(err, ErrOwnKey) {
+		t.Errorf("Reconcile with the device's own key = %v, want ErrOwnKey", err)
+	}
+
+	// An all-zero private key is refused, whether clamped or not, but a zero
+	// private_key removes the key through the UAPI, as documented.
+	var sk NoisePrivateKey
+	if err := device.SetPrivateKey(sk); !errors.Is(err, ErrZeroKey) {
+		t.Errorf("SetPrivateKey(zero) = %v, want ErrZeroKey", err)
+	}
+	if err := sk.FromBase64("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.SetPrivateKey(sk); !errors.Is(err, ErrZeroKey) {
+		t.Errorf("SetPrivateKey(clamped zero) = %v, want ErrZeroKey", err)
+	}
+	if device.staticIdentity.publicKey != own {
+		t.Error("refused private key replaced the device's key")
+	}
+	if err := device.IpcSet(uapiCfg("private_key", NoisePrivateKey{}.Hex())); err != nil {
+		t.Fatal(err)
+	}
+	if !device.staticIdentity.privateKey.IsZero() {
+		t.Error("zero private_key did not remove the private key")
+	}
+}
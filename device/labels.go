@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// Bounds on the labels of a peer set by Peer.SetLabels.
+const (
+	MaxPeerLabels          = 32
+	MaxPeerLabelKeyLen     = 63
+	MaxPeerLabelValueLen   = 255
+	peerLabelKeyCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-"
+)
+
+// validatePeerLabel checks a label against the bounds of Peer.SetLabels.
+func validatePeerLabel(key, value string) error {
+	switch {
+	case key == "" || len(key) > MaxPeerLabelKeyLen:
+		return fmt.Errorf("%w: key %q is empty or longer than %d bytes", ErrInvalidLabel, key, MaxPeerLabelKeyLen)
+	case strings.Trim(key, peerLabelKeyCharacters) != "":
+		return fmt.Errorf("%w: key %q has characters other than letters, digits, '.', '_' and '-'", ErrInvalidLabel, key)
+	case len(value) > MaxPeerLabelValueLen:
+		return fmt.Errorf("%w: value of %q longer than %d bytes", ErrInvalidLabel, key, MaxPeerLabelValueLen)
+	case strings.ContainsAny(value, "\x00\n"):
+		return fmt.Errorf("%w: value of %q has a newline or NUL", ErrInvalidLabel, key)
+	}
+	return nil
+}
+
+// SetLabels replaces the peer's labels, metadata for management systems
+// such as a tenant ID or device name, which are reported in its events and
+// by IpcGet. Keys are up to MaxPeerLabelKeyLen letters, digits, '.', '_' or
+// '-'; values are up to MaxPeerLabelValueLen bytes without newlines; and a
+// peer has up to MaxPeerLabels of them. Labels are kept when other settings
+// of the peer change, and removed with it. A nil or empty map removes them.
+func (peer *Peer) SetLabels(labels map[string]string) error {
+	if len(labels) > MaxPeerLabels {
+		return fmt.Errorf("%w: %d labels, more than %d", ErrInvalidLabel, len(labels), MaxPeerLabels)
+	}
+	for key, value := range labels {
+		if err := validatePeerLabel(key, value); err != nil {
+			return err
+		}
+	}
+	if len(labels) == 0 {
+		peer.labels.Store(nil)
+		return nil
+	}
+	labels = maps.Clone(labels)
+	peer.labels.Store(&labels)
+	return nil
+}
+
+// setLabel sets the peer's label key to value, or removes it if value is
+// empty.
+func (peer *Peer) setLabel(key, value string) error {
+	if err := validatePeerLabel(key, value); err != nil {
+		return err
+	}
+	labels := peer.Labels()
+	if value == "" {
+		delete(labels, key)
+	} else {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[key] = value
+	}
+	return peer.SetLabels(labels)
+}
+
+// Labels returns a copy of the labels set by SetLabels, or nil if it has
+// none.
+func (peer *Peer) Labels() map[string]string {
+	labels := peer.labels.Load()
+	if labels == nil {
+		return nil
+	}
+	return maps.Clone(*labels)
+}
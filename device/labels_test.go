@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestPeerLabels(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	pk := randNoisePublicKey(t)
+	if _, err := device.Reconcile(Config{Peers: []PeerConfig{{PublicKey: pk}}}); err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(pk)
+	labels := map[string]string{"tenant": "acme", "device.name": "router-1"}
+	if err := peer.SetLabels(labels); err != nil {
+		t.Fatal(err)
+	}
+	labels["tenant"] = "changed"
+	if got := peer.Labels(); got["tenant"] != "acme" || len(got) != 2 {
+		t.Errorf("Labels() = %v after modifying the map given to SetLabels", got)
+	}
+
+	tooMany := make(map[string]string)
+	for i := range MaxPeerLabels + 1 {
+		tooMany[fmt.Sprint("k", i)] = "v"
+	}
+	for _, invalid := range []map[string]string{
+		{"": "empty key"},
+		{"has space": "v"},
+		{"k=v": "v"},
+		{strings.Repeat("k", MaxPeerLabelKeyLen+1): "v"},
+		{"k": strings.Repeat("v", MaxPeerLabelValueLen+1)},
+		{"k": "two\nlines"},
+		tooMany,
+	} {
+		if err := peer.SetLabels(invalid); !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("SetLabels(%.40v) = %v, want ErrInvalidLabel", invalid, err)
+		}
+	}
+
+	// Labels survive reconciling the peer's other settings.
+	if _, err := device.Reconcile(Config{Peers: []PeerConfig{{PublicKey: pk, Endpoint: "127.0.0.1:1000"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := peer.Labels(); !maps.Equal(got, map[string]string{"tenant": "acme", "device.name": "router-1"}) {
+		t.Errorf("Labels() = %v after Reconcile", got)
+	}
+
+	var events []Event
+	device.SetEventHandler(func(event Event) { events = append(events, event) })
+	device.emitEvent(EventPeerEndpointError, peer)
+	if len(events) != 1 || events[0].Labels["tenant"] != "acme" {
+		t.Errorf("events = %+v, want one with the peer's labels", events)
+	}
+}
+
+func TestPeerLabelsUAPI(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	pk := randNoisePublicKey(t).Hex()
+	if err := device.IpcSet(uapiCfg("public_key", pk, "label.tenant", "acme", "label.name", "a=b")); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := device.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "label.name=a=b\nlabel.tenant=acme\n") {
+		t.Errorf("labels missing from IpcGet output:\n%s", cfg)
+	}
+
+	if err := device.IpcSet(uapiCfg("public_key", pk, "label.name", "")); err != nil {
+		t.Fatal(err)
+	}
+	var key NoisePublicKey
+	key.FromHex(pk)
+	if got := device.LookupPeer(key).Labels(); !maps.Equal(got, map[string]string{"tenant": "acme"}) {
+		t.Errorf("Labels() = %v after removing one", got)
+	}
+	if err := device.IpcSet(uapiCfg("public_key", pk, "label.bad key", "v")); !errors.Is(err, ErrInvalidLabel) {
+		t.Errorf("invalid label key accepted: %v", err)
+	}
+	if err := device.IpcSet(uapiCfg("public_key", pk, "replace_labels", "true")); err != nil {
+		t.Fatal(err)
+	}
+	if got := device.LookupPeer(key).Labels(); got != nil {
+		t.Errorf("Labels() = %v after replace_labels", got)
+	}
+
+	// Labels are removed with the peer.
+	if err := device.IpcSet(uapiCfg("public_key", pk, "label.tenant", "acme")); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.IpcSet(uapiCfg("public_key", pk, "remove", "true", "public_key", pk)); err != nil {
+		t.Fatal(err)
+	}
+	if got := device.LookupPeer(key).Labels(); got != nil {
+		t.Errorf("Labels() = %v of a re-added peer", got)
+	}
+}
@@ -0,0 +1,54 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net/netip"
+	"sync/atomic"
+)
+
+var (
+	ErrTooManyPeers             = errors.New("too many peers")
+	ErrTooManyAllowedIPsPerPeer = errors.New("too many allowed IPs for peer")
+	ErrTooManyAllowedIPs        = errors.New("too many allowed IPs")
+)
+
+type deviceLimits struct {
+	peers             atomic.Int64
+	allowedIPsPerPeer atomic.Int64
+	totalAllowedIPs   atomic.Int64
+}
+
+func (limits *deviceLimits) enabled() bool {
+	return limits.peers.Load() != 0 || limits.allowedIPsPerPeer.Load() != 0 || limits.totalAllowedIPs.Load() != 0
+}
+
+// SetLimits caps the number of peers, the number of allowed IPs of any one
+// peer, and the number of allowed IPs across all peers. A limit of zero (or
+// less) means unlimited. Limits only constrain additions: configuration that
+// already exceeds a newly lowered limit is left in place.
+//
+// The limits cannot be changed through the configuration protocol, so that a
+// misbehaving management plane cannot lift them.
+func (device *Device) SetLimits(maxPeers, maxAllowedIPsPerPeer, maxTotalAllowedIPs int) {
+	device.limits.peers.Store(int64(max(maxPeers, 0)))
+	device.limits.allowedIPsPerPeer.Store(int64(max(maxAllowedIPsPerPeer, 0)))
+	device.limits.totalAllowedIPs.Store(int64(max(maxTotalAllowedIPs, 0)))
+}
+
+// isLimitError reports whether err was caused by exceeding a limit set by SetLimits.
+func isLimitError(err error) bool {
+	return errors.Is(err, ErrTooManyPeers) || errors.Is(err, ErrTooManyAllowedIPsPerPeer) || errors.Is(err, ErrTooManyAllowedIPs)
+}
+
+// insertAllowedIP assigns prefix to peer, subject to the device's limits.
+// It returns the peer that previously owned prefix, if any.
+func (device *Device) insertAllowedIP(prefix netip.Prefix, peer *Peer) (*Peer, error) {
+	return device.allowedips.insertLimited(prefix, peer,
+		int(device.limits.allowedIPsPerPeer.Load()),
+		int(device.limits.totalAllowedIPs.Load()))
+}
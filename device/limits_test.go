@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// allowedIPsByPeer returns the sorted allowed IPs of every peer of device.
+func allowedIPsByPeer(device *Device) map[NoisePublicKey][]string {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	m := make(map[NoisePublicKey][]string)
+	for key, peer := range device.peers.keyMap {
+		prefixes := []string{}
+		device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
+			prefixes = append(prefixes, prefix.String())
+			return true
+		})
+		sort.Strings(prefixes)
+		m[key] = prefixes
+	}
+	return m
+}
+
+func TestLimitsRollback(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	a, b := randNoisePublicKey(t).Hex(), randNoisePublicKey(t).Hex()
+	if err := device.IpcSet(uapiCfg(
+		"public_key", a,
+		"allowed_ip", "10.0.0.1/32",
+		"allowed_ip", "10.0.0.2/32",
+		"public_key", b,
+		"allowed_ip", "10.0.1.0/24",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	device.SetLimits(3, 2, 4)
+	before := allowedIPsByPeer(device)
+
+	tests := []struct {
+		name string
+		cfg  string
+		want error
+	}{
+		{
+			name: "peers",
+			cfg: uapiCfg(
+				"public_key", randNoisePublicKey(t).Hex(),
+				"allowed_ip", "10.0.2.1/32",
+				"public_key", randNoisePublicKey(t).Hex(),
+			),
+			want: ErrTooManyPeers,
+		},
+		{
+			name: "per peer",
+			cfg: uapiCfg(
+				"public_key", b,
+				"allowed_ip", "10.0.0.1/32", // moved from a
+				"allowed_ip", "10.0.3.0/24",
+			),
+			want: ErrTooManyAllowedIPsPerPeer,
+		},
+		{
+			name: "total",
+			cfg: uapiCfg(
+				"public_key", a,
+				"replace_allowed_ips", "true",
+				"allowed_ip", "10.0.4.1/32",
+				"public_key", b,
+				"allowed_ip", "10.0.4.2/32",
+				"public_key", randNoisePublicKey(t).Hex(),
+				"allowed_ip", "10.0.4.3/32",
+				"allowed_ip", "10.0.4.4/32",
+			),
+			want: ErrTooManyAllowedIPs,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := device.IpcSet(tt.cfg)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("IpcSet error = %v, want %v", err, tt.want)
+			}
+			if after := allowedIPsByPeer(device); !reflect.DeepEqual(after, before) {
+				t.Errorf("config not rolled back:\nbefore: %v\nafter:  %v", before, after)
+			}
+			if n := device.allowedips.Len(); n != 3 {
+				t.Errorf("allowed IP count = %d, want 3", n)
+			}
+		})
+	}
+
+	out, err := device.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"max_peers=3\n", "peer_count=2\n", "allowed_ip_count=3\n"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("IpcGet output missing %q", line)
+		}
+	}
+}
+
+func TestLimitsNewPeer(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.SetLimits(1, 0, 0)
+
+	pk1, pk2 := randNoisePublicKey(t), randNoisePublicKey(t)
+	if _, err := device.NewPeer(pk1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := device.NewPeer(pk2); !errors.Is(err, ErrTooManyPeers) {
+		t.Fatalf("NewPeer error = %v, want %v", err, ErrTooManyPeers)
+	}
+	device.SetLimits(0, 0, 0)
+	if _, err := device.NewPeer(pk2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplaceAllowedIPs(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	pk1, pk2 := randNoisePublicKey(t), randNoisePublicKey(t)
+	peer1, err := device.NewPeer(pk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := device.NewPeer(pk2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer1.AddAllowedIP(netip.MustParsePrefix("10.0.0.0/24"))
+	peer2.AddAllowedIP(netip.MustParsePrefix("10.0.1.0/24"))
+
+	err = device.ReplaceAllowedIPs(pk1, []netip.Prefix{netip.MustParsePrefix("10.0.1.1/24"), netip.MustParsePrefix("fd00::/64")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[NoisePublicKey][]string{pk1: {"10.0.1.0/24", "fd00::/64"}, pk2: {}}
+	if got := allowedIPsByPeer(device); !reflect.DeepEqual(got, want) {
+		t.Errorf("allowed IPs %v, want %v", got, want)
+	}
+
+	if err := device.ReplaceAllowedIPs(NoisePublicKey{3}, nil); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("replacing the allowed IPs of an unknown peer: %v, want %v", err, ErrPeerNotFound)
+	}
+	if err := device.ReplaceAllowedIPs(pk1, []netip.Prefix{{}}); !errors.Is(err, ErrInvalidAllowedIP) {
+		t.Errorf("replacing with an invalid prefix: %v, want %v", err, ErrInvalidAllowedIP)
+	}
+	device.SetLimits(0, 1, 0)
+	if err := device.ReplaceAllowedIPs(pk1, []netip.Prefix{netip.MustParsePrefix("10.0.2.0/24"), netip.MustParsePrefix("10.0.3.0/24")}); !errors.Is(err, ErrTooManyAllowedIPsPerPeer) {
+		t.Errorf("replacing beyond the limit: %v, want %v", err, ErrTooManyAllowedIPsPerPeer)
+	}
+	if got := allowedIPsByPeer(device); !reflect.DeepEqual(got, want) {
+		t.Errorf("allowed IPs %v after failed replacements, want %v", got, want)
+	}
+}
@@ -8,6 +8,7 @@ package device
 import (
 	"log"
 	"os"
+	"reflect"
 )
 
 // A Logger provides logging for a Device.
@@ -34,7 +35,7 @@ func DiscardLogf(format string, args ...any) {}
 // It logs at the specified log level and above.
 // It decorates log lines with the log level, date, time, and prepend.
 func NewLogger(level int, prepend string) *Logger {
-	logger := &Logger{DiscardLogf, DiscardLogf}
+	logger := &Logger{Verbosef: DiscardLogf, Errorf: DiscardLogf}
 	logf := func(prefix string) func(string, ...any) {
 		return log.New(os.Stdout, prefix+": "+prepend, log.Ldate|log.Ltime).Printf
 	}
@@ -46,3 +47,13 @@ func NewLogger(level int, prepend string) *Logger {
 	}
 	return logger
 }
+
+// Verbose reports whether Verbosef logs, so that hot paths can skip building
+// its arguments, which are evaluated even when they are discarded. It is
+// false for Loggers whose Verbosef is nil or DiscardLogf, as it is for those
+// made by NewLogger below LogLevelVerbose, and true otherwise.
+func (logger *Logger) Verbose() bool {
+	return logger.Verbosef != nil && reflect.ValueOf(logger.Verbosef).Pointer() != discardLogfPointer
+}
+
+var discardLogfPointer = reflect.ValueOf(DiscardLogf).Pointer()
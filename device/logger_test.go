@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+// invalidInitiation returns a device logging to logger, and an initiation
+// for it with a valid mac1 that fails to decrypt, which the handshake
+// worker logs. With verbose logging off, handling it allocates no more than
+// the handshake itself.
+func invalidInitiation(tb testing.TB, logger *Logger) (*Device, *QueueHandshakeElement) {
+	sk, err := newPrivateKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	device := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), logger)
+	device.SetPrivateKey(sk)
+	endpoint, err := device.net.bind.ParseEndpoint("192.0.2.1:51820")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	packet := make([]byte, MessageInitiationSize)
+	rand.Read(packet)
+	binary.LittleEndian.PutUint32(packet, MessageInitiationType)
+	var gen CookieGenerator
+	gen.Init(device.staticIdentity.publicKey)
+	gen.AddMacs(packet)
+	return device, &QueueHandshakeElement{msgType: MessageInitiationType, packet: packet, endpoint: endpoint}
+}
+
+func verboseDiscardLogger() *Logger {
+	return &Logger{Verbosef: log.New(io.Discard, "", 0).Printf, Errorf: DiscardLogf}
+}
+
+func TestLoggerVerbose(t *testing.T) {
+	if NewLogger(LogLevelError, "").Verbose() || !NewLogger(LogLevelVerbose, "").Verbose() {
+		t.Error("Verbose() does not follow the level given to NewLogger")
+	}
+	if (&Logger{Errorf: DiscardLogf}).Verbose() || (&Logger{DiscardLogf, DiscardLogf}).Verbose() || !verboseDiscardLogger().Verbose() {
+		t.Error("Verbose() does not follow whether Verbosef logs")
+	}
+}
+
+func BenchmarkHandshakeInvalidInitiation(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		logger *Logger
+	}{
+		{"quiet", NewLogger(LogLevelError, "")},
+		{"verbose", verboseDiscardLogger()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			device, elem := invalidInitiation(b, bench.logger)
+			defer device.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				device.handleHandshake(elem)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// routingLoops detects the device's own encrypted traffic coming back
+// through the TUN device, as happens when a peer endpoint is within the
+// allowed IPs of a peer and the system routes those addresses into the
+// tunnel. Encapsulating it again would loop until the packets outgrow the
+// MTU or memory runs out.
+type routingLoops struct {
+	port atomic.Uint32 // listening port of the bind
+
+	sync.Mutex
+	warned map[*Peer]netip.Addr // endpoint addresses already warned about
+}
+
+const udpProtocol = 17
+
+// isRoutingLoop reports whether packet, read from the TUN device, is a UDP
+// datagram from the device's listening port to the endpoint of one of its
+// peers, that is, one of the device's own encrypted packets.
+func (device *Device) isRoutingLoop(packet []byte) bool {
+	var dst netip.Addr
+	var udp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		fragment := binary.BigEndian.Uint16(packet[6:]) & 0x1fff
+		if packet[9] != udpProtocol || ihl < ipv4.HeaderLen || fragment != 0 || len(packet) < ihl+4 {
+			return false
+		}
+		dst = netip.AddrFrom4([4]byte(packet[IPv4offsetDst:]))
+		udp = packet[ihl:]
+	case 6:
+		if packet[6] != udpProtocol || len(packet) < ipv6.HeaderLen+4 {
+			return false
+		}
+		dst = netip.AddrFrom16([16]byte(packet[IPv6offsetDst:]))
+		udp = packet[ipv6.HeaderLen:]
+	default:
+		return false
+	}
+	port := device.loops.port.Load()
+	if port == 0 || uint32(binary.BigEndian.Uint16(udp)) != port {
+		return false
+	}
+	// Only packets from the listening port get this far, so searching the
+	// peers does not slow down ordinary traffic.
+	dstPort := netip.AddrPortFrom(dst, binary.BigEndian.Uint16(udp[2:]))
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if peer.endpointAddrPort() == dstPort {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointAddrPort returns the address and port of the peer's endpoint, or
+// the zero AddrPort if it has none.
+func (peer *Peer) endpointAddrPort() netip.AddrPort {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	if peer.endpoint.val == nil {
+		return netip.AddrPort{}
+	}
+	addrPort, _ := netip.ParseAddrPort(peer.endpoint.val.DstToString())
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
+
+// warnRoutingLoops logs a warning for each peer whose endpoint is within the
+// allowed IPs of a peer, once per endpoint address. Such configurations only
+// work if the system routes the endpoint around the tunnel, as wg-quick does
+// with a firewall mark, so they are not rejected.
+func (device *Device) warnRoutingLoops() {
+	loops := &device.loops
+	loops.Lock()
+	defer loops.Unlock()
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for peer := range loops.warned {
+		if device.peers.keyMap[peer.handshake.remoteStatic] != peer {
+			delete(loops.warned, peer)
+		}
+	}
+	for _, peer := range device.peers.keyMap {
+		addr := peer.endpointAddrPort().Addr()
+		if !addr.IsValid() {
+			continue
+		}
+		owner := device.allowedips.Lookup(addr.AsSlice())
+		if owner == nil {
+			delete(loops.warned, peer)
+			continue
+		}
+		if warned, ok := loops.warned[peer]; ok && warned == addr {
+			continue
+		}
+		if loops.warned == nil {
+			loops.warned = make(map[*Peer]netip.Addr)
+		}
+		loops.warned[peer] = addr
+		device.log.Errorf("%v - Endpoint %v is within the allowed IPs of %v; unless the system routes it outside the tunnel, packets to it will loop and be dropped", peer, addr, owner)
+	}
+}
@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// udp4Packet returns the header of an IPv4 UDP datagram.
+func udp4Packet(src, dst netip.AddrPort) []byte {
+	packet := make([]byte, 28)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = udpProtocol
+	copy(packet[12:], src.Addr().AsSlice())
+	copy(packet[16:], dst.Addr().AsSlice())
+	binary.BigEndian.PutUint16(packet[20:], src.Port())
+	binary.BigEndian.PutUint16(packet[22:], dst.Port())
+	return packet
+}
+
+func TestRoutingLoop(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	key := randNoisePublicKey(t)
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", key.Hex(),
+		"endpoint", "192.0.2.1:51820",
+		"allowed_ip", "0.0.0.0/0",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(key)
+	if addr, ok := dev.loops.warned[peer]; !ok || addr != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("no warning for endpoint within allowed IPs: %v", dev.loops.warned)
+	}
+
+	dev.loops.port.Store(41414)
+	src := netip.MustParseAddrPort("10.0.0.1:41414")
+	endpoint := netip.MustParseAddrPort("192.0.2.1:51820")
+	for _, tt := range []struct {
+		src, dst netip.AddrPort
+		want     bool
+	}{
+		{src, endpoint, true},
+		{netip.MustParseAddrPort("10.0.0.1:41415"), endpoint, false},
+		{src, netip.MustParseAddrPort("192.0.2.1:51821"), false},
+		{src, netip.MustParseAddrPort("192.0.2.2:51820"), false},
+	} {
+		if got := dev.isRoutingLoop(udp4Packet(tt.src, tt.dst)); got != tt.want {
+			t.Errorf("isRoutingLoop(%v -> %v) = %v, want %v", tt.src, tt.dst, got, tt.want)
+		}
+	}
+
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", key.Hex(),
+		"replace_allowed_ips", "true",
+		"allowed_ip", "10.0.0.0/8",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dev.loops.warned[peer]; ok {
+		t.Error("warning not cleared after the endpoint left the allowed IPs")
+	}
+}
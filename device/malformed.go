@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// A MalformedReason explains why the device dropped a datagram received from
+// the bind before processing it.
+type MalformedReason int
+
+const (
+	// MalformedTooShort means the datagram is shorter than the smallest
+	// message, or than the size of the message type it claims.
+	MalformedTooShort MalformedReason = iota
+
+	// MalformedTooLarge means the datagram is longer than the largest
+	// message, or than the fixed size of the handshake message type it
+	// claims, as when a middlebox reassembled it with other data.
+	MalformedTooLarge
+
+	// MalformedUnknownType means the datagram claims no known message type.
+	MalformedUnknownType
+
+	malformedReasonCount
+)
+
+func (reason MalformedReason) String() string {
+	switch reason {
+	case MalformedTooShort:
+		return "too_short"
+	case MalformedTooLarge:
+		return "too_large"
+	case MalformedUnknownType:
+		return "unknown_type"
+	}
+	return "unknown"
+}
+
+// malformedLogInterval is the minimum time between two log messages about
+// malformed datagrams.
+const malformedLogInterval = time.Second
+
+type malformedDatagrams struct {
+	counts  [malformedReasonCount]atomic.Uint64
+	log     atomic.Bool
+	lastLog atomic.Int64 // unix nanoseconds
+}
+
+// MalformedDatagrams returns the number of datagrams received from the bind
+// that were dropped for reason.
+func (device *Device) MalformedDatagrams(reason MalformedReason) uint64 {
+	if reason < 0 || reason >= malformedReasonCount {
+		return 0
+	}
+	return device.malformed.counts[reason].Load()
+}
+
+// SetLogMalformedDatagrams enables or disables logging of datagrams dropped
+// as malformed. Each message names the source address of the datagram, its
+// size and the reason, and is logged at most once per second.
+func (device *Device) SetLogMalformedDatagrams(enabled bool) {
+	device.malformed.log.Store(enabled)
+}
+
+// dropMalformed accounts for dropping a datagram of size bytes from ep.
+func (device *Device) dropMalformed(reason MalformedReason, size int, ep conn.Endpoint) {
+	device.malformed.counts[reason].Add(1)
+	if !device.malformed.log.Load() {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := device.malformed.lastLog.Load()
+	if now-last < int64(malformedLogInterval) || !device.malformed.lastLog.CompareAndSwap(last, now) {
+		return
+	}
+	device.log.Errorf("Dropped malformed datagram of %d bytes from %v: %v", size, ep.DstToString(), reason)
+}
+
+// checkDatagram returns whether a datagram of the given size and message
+// type is well-formed, and if not, why.
+func checkDatagram(msgType uint32, size int) (MalformedReason, bool) {
+	var want int
+	switch msgType {
+	case MessageTransportType:
+		if size < MessageTransportSize {
+			return MalformedTooShort, false
+		}
+		if size > MaxMessageSize {
+			return MalformedTooLarge, false
+		}
+		return 0, true
+	case MessageInitiationType:
+		want = MessageInitiationSize
+	case MessageResponseType:
+		want = MessageResponseSize
+	case MessageCookieReplyType:
+		want = MessageCookieReplySize
+	default:
+		return MalformedUnknownType, false
+	}
+	switch {
+	case size < want:
+		return MalformedTooShort, false
+	case size > want:
+		return MalformedTooLarge, false
+	}
+	return 0, true
+}
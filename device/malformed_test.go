@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMalformedDatagrams(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	if err := dev.IpcSet(uapiCfg("log_malformed_datagrams", "true")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("udp4", fmt.Sprintf("127.0.0.1:%d", dev.net.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	message := func(msgType uint32, size int) []byte {
+		b := make([]byte, size)
+		binary.LittleEndian.PutUint32(b, msgType)
+		return b
+	}
+	for _, b := range [][]byte{
+		{1, 0, 0},
+		message(MessageTransportType, MessageTransportSize-1),
+		message(MessageInitiationType, MessageInitiationSize-1),
+		message(MessageInitiationType, MessageInitiationSize+1),
+		message(MessageCookieReplyType, 1200),
+		message(9, 100),
+	} {
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[MalformedReason]uint64{
+		MalformedTooShort:    3,
+		MalformedTooLarge:    2,
+		MalformedUnknownType: 1,
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		done := true
+		for reason, n := range want {
+			done = done && dev.MalformedDatagrams(reason) == n
+		}
+		if done {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			for reason, n := range want {
+				if got := dev.MalformedDatagrams(reason); got != n {
+					t.Errorf("%d datagrams dropped as %v, want %d", got, reason, n)
+				}
+			}
+			t.FailNow()
+		}
+	}
+
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"log_malformed_datagrams=true", "malformed_too_short=3", "malformed_too_large=2", "malformed_unknown_type=1"} {
+		if !strings.Contains(cfg, "\n"+line+"\n") {
+			t.Errorf("config lacks %s:\n%s", line, cfg)
+		}
+	}
+
+	// Well-formed messages still get through.
+	pair.Send(t, Ping, nil)
+}
@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+)
+
+// MemoryProfile selects the sizes of a Device's queues and packet buffers.
+type MemoryProfile int
+
+const (
+	// ProfileDefault sizes queues and pools for throughput.
+	ProfileDefault MemoryProfile = iota
+
+	// ProfileLowMemory, for routers with little RAM, shortens the queues,
+	// bounds the number of packet buffers, and receives fewer datagrams
+	// from the bind at a time, so that its receive routines hold fewer
+	// buffers. Message buffers, each MaxMessageSize bytes, are further
+	// capped at 16 MiB in total, or at what the receive and TUN routines
+	// hold at once if the TUN device batches enough to need more.
+	ProfileLowMemory
+)
+
+// WithMemoryProfile selects the device's memory profile, ProfileDefault if
+// not given.
+func WithMemoryProfile(profile MemoryProfile) Option {
+	return func(device *Device) error {
+		switch profile {
+		case ProfileDefault:
+			device.memory = defaultMemoryLimits()
+		case ProfileLowMemory:
+			device.memory = memoryLimits{
+				queueOutboundSize:  128,
+				queueInboundSize:   128,
+				queueHandshakeSize: 128,
+				buffersPerPool:     1024,
+				bindBatchSize:      8,
+				messageBufferBytes: 16 << 20,
+			}
+		default:
+			return fmt.Errorf("unknown memory profile %d", profile)
+		}
+		return nil
+	}
+}
+
+type memoryLimits struct {
+	queueOutboundSize  int
+	queueInboundSize   int
+	queueHandshakeSize int
+	buffersPerPool     uint32 // 0 for no limit
+	bindBatchSize      int    // most datagrams received at a time, 0 for the bind's
+	messageBufferBytes int    // most bytes of message buffers, 0 for buffersPerPool of them
+}
+
+func defaultMemoryLimits() memoryLimits {
+	return memoryLimits{
+		queueOutboundSize:  QueueOutboundSize,
+		queueInboundSize:   QueueInboundSize,
+		queueHandshakeSize: QueueHandshakeSize,
+		buffersPerPool:     uint32(PreallocatedBuffersPerPool),
+	}
+}
+
+// messageBuffers returns the most message buffers the device hands out at
+// once, 0 for no limit. A limit in bytes leaves room for the buffers its
+// routines hold while reading, a batch for each, so that they never wait on
+// one another.
+func (device *Device) messageBuffers() uint32 {
+	bytes := device.memory.messageBufferBytes
+	if bytes == 0 {
+		return device.memory.buffersPerPool
+	}
+	return uint32(max(bytes/MaxMessageSize, messageBufferBatches*device.BatchSize()))
+}
+
+// messageBufferBatches is the number of batches of message buffers a limit
+// in bytes leaves room for: one for the TUN routine, up to three for the
+// receive routines of the bind, and the rest for the queues.
+const messageBufferBatches = 8
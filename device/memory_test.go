@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/darkit/wireguard/conn/bindtest"
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+// batchBind receives in batches, as StdNetBind does, so that the receive
+// routines hold a batch of message buffers.
+type batchBind struct {
+	conn.Bind
+}
+
+func (batchBind) BatchSize() int { return conn.IdealBatchSize }
+
+func heapInUse() uint64 {
+	// The second collection frees what the first moved to the pools'
+	// victim caches.
+	runtime.GC()
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// idleDeviceHeap returns the heap in use by an up device with 100 peers.
+func idleDeviceHeap(t *testing.T, profile MemoryProfile) uint64 {
+	before := heapInUse()
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), batchBind{bindtest.NewChannelBinds()[0]}, NewLogger(LogLevelError, ""), WithMemoryProfile(profile))
+	defer dev.Close()
+	for i := 0; i < 100; i++ {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dev.NewPeer(sk.publicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	after := heapInUse()
+	runtime.KeepAlive(dev)
+	return after - before
+}
+
+func TestMemoryProfile(t *testing.T) {
+	def := idleDeviceHeap(t, ProfileDefault)
+	low := idleDeviceHeap(t, ProfileLowMemory)
+	t.Logf("heap in use: %d KiB by default, %d KiB with ProfileLowMemory", def>>10, low>>10)
+	if low*4 > def {
+		t.Errorf("ProfileLowMemory uses %d KiB, more than a quarter of the default's %d KiB", low>>10, def>>10)
+	}
+
+	// Under load, the message buffers held account for most of the heap.
+	heap, limit := loadedPairHeap(t)
+	t.Logf("heap in use: %d KiB by two loaded devices with ProfileLowMemory", heap>>10)
+	if slack := uint64(8 << 20); heap > limit+slack {
+		t.Errorf("two loaded devices use %d KiB, more than the %d KiB of their message buffers and %d KiB", heap>>10, limit>>10, slack>>10)
+	}
+}
+
+// loadedPairHeap returns the heap in use by a pair of devices with
+// ProfileLowMemory while one floods the other, which does not read its TUN
+// device, once their queues and pools have filled up, and the most bytes of
+// message buffers the pair may hold.
+func loadedPairHeap(t *testing.T) (heap, limit uint64) {
+	before := heapInUse()
+	pair := genTestPair(t, false, WithMemoryProfile(ProfileLowMemory))
+	pair.Send(t, Ping, nil)
+	var sent atomic.Uint64
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		msg := tuntest.Ping(pair[0].ip, pair[1].ip)
+		for {
+			select {
+			case pair[1].tun.Outbound <- msg:
+				sent.Add(1)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer func() {
+		// Blocked sending to the other, the flooding device cannot close
+		// until the other reads its TUN device again.
+		close(stop)
+		<-stopped
+		closed := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-pair[0].tun.Inbound:
+				case <-closed:
+					return
+				}
+			}
+		}()
+		pair[1].dev.Close()
+		pair[0].dev.Close()
+		close(closed)
+	}()
+
+	for n := uint64(0); n == 0 || sent.Load() != n; time.Sleep(200 * time.Millisecond) {
+		n = sent.Load()
+	}
+	for _, p := range pair {
+		limit += uint64(p.dev.pool.messageBuffers.max) * MaxMessageSize
+	}
+	return heapInUse() - before, limit
+}
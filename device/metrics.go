@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+)
+
+// WriteMetrics writes the metrics of the device and its peers to w in the
+// Prometheus text exposition format. Peers are labeled by their public key
+// in base64, as in wg(8).
+func (device *Device) WriteMetrics(w io.Writer) error {
+	buf := byteBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer byteBufferPool.Put(buf)
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(buf, "# HELP wireguard_%s %s\n# TYPE wireguard_%s %s\n", name, help, name, typ)
+	}
+	sample := func(name, labels string, value any) {
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(buf, "wireguard_%s%s %v\n", name, labels, value)
+	}
+
+	up := 0
+	if device.isUp() {
+		up = 1
+	}
+	metric("device_up", "gauge", "Whether the device is up.")
+	sample("device_up", "", up)
+
+	metric("dropped_packets_total", "counter", "Packets read from the TUN device and dropped, by reason.")
+	for reason := DropReason(0); reason < dropReasonCount; reason++ {
+		sample("dropped_packets_total", fmt.Sprintf("reason=%q", reason.String()), device.drops.counts[reason].Load())
+	}
+
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+	keys := make([]string, len(peers))
+	for i, peer := range peers {
+		peer.handshake.mutex.RLock()
+		keys[i] = fmt.Sprintf("public_key=%q", base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:]))
+		peer.handshake.mutex.RUnlock()
+	}
+
+	metric("peers", "gauge", "Number of peers.")
+	sample("peers", "", len(peers))
+
+	perPeer := []struct {
+		name, typ, help string
+		value           func(*Peer) any
+	}{
+		{"peer_receive_bytes_total", "counter", "Bytes received from the peer.",
+			func(peer *Peer) any { return peer.rxBytes.Load() }},
+		{"peer_transmit_bytes_total", "counter", "Bytes sent to the peer.",
+			func(peer *Peer) any { return peer.txBytes.Load() }},
+		{"peer_last_handshake_seconds", "gauge", "Unix time of the latest handshake with the peer, or 0 if none.",
+			func(peer *Peer) any { return float64(peer.lastHandshakeNano.Load()) / float64(time.Second) }},
+		{"peer_watchdog_recoveries_total", "counter", "Stalled sessions with the peer recovered by the watchdog.",
+			func(peer *Peer) any { return peer.watchdogRecoveries.Load() }},
+		{"peer_last_watchdog_recovery_seconds", "gauge", "Unix time the watchdog last recovered a stalled session with the peer, or 0 if never.",
+			func(peer *Peer) any { return float64(peer.lastWatchdogRecovery.Load()) / float64(time.Second) }},
+		{"peer_out_of_order_packets_total", "counter", "Packets received from the peer after one with a higher counter.",
+			func(peer *Peer) any { packets, _ := peer.OutOfOrder(); return packets }},
+		{"peer_out_of_order_distance_total", "counter", "Sum over out-of-order packets from the peer of how far their counter was behind the highest received.",
+			func(peer *Peer) any { _, distance := peer.OutOfOrder(); return distance }},
+		{"peer_handshake_backoff_failures", "gauge", "Failed handshakes with the peer in handshake backoff, or 0 if not in backoff.",
+			func(peer *Peer) any { failures, _ := peer.HandshakeBackoff(); return failures }},
+	}
+	for _, m := range perPeer {
+		metric(m.name, m.typ, m.help)
+		for i, peer := range peers {
+			sample(m.name, keys[i], m.value(peer))
+		}
+	}
+
+	metric("peer_state", "gauge", "State of the connection to the peer, 1 for the current state.")
+	for i, peer := range peers {
+		current := peer.State()
+		for state := PeerNoContact; state <= PeerFailed; state++ {
+			value := 0
+			if state == current {
+				value = 1
+			}
+			sample("peer_state", fmt.Sprintf("%s,state=%q", keys[i], state.String()), value)
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
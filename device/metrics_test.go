@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+
+	var b strings.Builder
+	if err := pair[0].dev.WriteMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	metrics := b.String()
+	key := base64.StdEncoding.EncodeToString(pair[1].dev.staticIdentity.publicKey[:])
+	for _, line := range []string{
+		"# TYPE wireguard_peer_receive_bytes_total counter\n",
+		"wireguard_device_up 1\n",
+		"wireguard_peers 1\n",
+		`wireguard_dropped_packets_total{reason="no_route"} 0` + "\n",
+		`wireguard_peer_out_of_order_packets_total{public_key="` + key + `"} 0` + "\n",
+		`wireguard_peer_state{public_key="` + key + `",state="connected"} 1` + "\n",
+		`wireguard_peer_state{public_key="` + key + `",state="failed"} 0` + "\n",
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("metrics lack %q:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, `wireguard_peer_receive_bytes_total{public_key="`+key+`"} 0`+"\n") {
+		t.Errorf("no bytes received after a ping:\n%s", metrics)
+	}
+}
@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// mirrorQueueSize bounds the packets awaiting a PacketMirror. Packets
+// arriving while it is full are dropped rather than stalling the tunnel.
+const mirrorQueueSize = 1024
+
+// A MirrorDirection tells whether a mirrored packet came from or goes to
+// the peer.
+type MirrorDirection int
+
+const (
+	// MirrorInbound is a packet received from the peer, after decryption.
+	MirrorInbound MirrorDirection = iota
+
+	// MirrorOutbound is a packet sent to the peer, before encryption.
+	MirrorOutbound
+)
+
+func (dir MirrorDirection) String() string {
+	switch dir {
+	case MirrorInbound:
+		return "inbound"
+	case MirrorOutbound:
+		return "outbound"
+	}
+	return "unknown"
+}
+
+// A PacketMirror receives copies of the plaintext IP packets exchanged with
+// peers, such as to feed an intrusion detection system.
+type PacketMirror interface {
+	// MirrorPacket is called for each packet, from a single goroutine and
+	// in the order the device handled the packets of each peer. packet is
+	// only valid until MirrorPacket returns, and must not be modified.
+	MirrorPacket(dir MirrorDirection, peer NoisePublicKey, packet []byte)
+}
+
+type mirroredPacket struct {
+	dir    MirrorDirection
+	peer   NoisePublicKey
+	packet *[]byte
+}
+
+type mirrorQueue struct {
+	mirror  PacketMirror
+	packets chan mirroredPacket
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type packetMirrors struct {
+	queue   atomic.Pointer[mirrorQueue]
+	dropped atomic.Uint64
+	buffers sync.Pool
+
+	sync.Mutex // serializes SetMirror
+}
+
+// SetMirror starts passing copies of the plaintext packets exchanged with
+// all peers to m, which runs asynchronously: packets are queued for it, and
+// dropped if it falls behind, which MirrorDropped counts. A nil m stops
+// mirroring; packets still queued for the previous mirror are discarded.
+func (device *Device) SetMirror(m PacketMirror) {
+	mirrors := &device.mirrors
+	mirrors.Lock()
+	defer mirrors.Unlock()
+	if m == nil {
+		if q := mirrors.queue.Swap(nil); q != nil {
+			close(q.stop)
+			<-q.done
+		}
+		return
+	}
+	q := &mirrorQueue{
+		mirror:  m,
+		packets: make(chan mirroredPacket, mirrorQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go device.runMirror(q)
+	if old := mirrors.queue.Swap(q); old != nil {
+		close(old.stop)
+		<-old.done
+	}
+}
+
+// MirrorDropped returns the number of packets not passed to the mirror set
+// by SetMirror because it fell behind.
+func (device *Device) MirrorDropped() uint64 {
+	return device.mirrors.dropped.Load()
+}
+
+func (device *Device) runMirror(q *mirrorQueue) {
+	defer close(q.done)
+	for {
+		select {
+		case p := <-q.packets:
+			q.mirror.MirrorPacket(p.dir, p.peer, *p.packet)
+			device.mirrors.buffers.Put(p.packet)
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// mirroring returns the queue of the current mirror, or nil if there is none.
+func (device *Device) mirroring() *mirrorQueue {
+	return device.mirrors.queue.Load()
+}
+
+// mirrorPacket queues a copy of packet for q.
+func (device *Device) mirrorPacket(q *mirrorQueue, dir MirrorDirection, peer NoisePublicKey, packet []byte) {
+	buf, _ := device.mirrors.buffers.Get().(*[]byte)
+	if buf == nil {
+		buf = new([]byte)
+	}
+	*buf = append((*buf)[:0], packet...)
+	select {
+	case q.packets <- mirroredPacket{dir, peer, buf}:
+	default:
+		device.mirrors.buffers.Put(buf)
+		device.mirrors.dropped.Add(1)
+	}
+}
+
+// publicKey returns the peer's static public key.
+func (peer *Peer) publicKey() NoisePublicKey {
+	return peer.staticKey
+}
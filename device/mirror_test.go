@@ -0,0 +1,158 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+type mirrorRecord struct {
+	dir    MirrorDirection
+	peer   NoisePublicKey
+	packet []byte
+}
+
+type chanMirror chan mirrorRecord
+
+func (c chanMirror) MirrorPacket(dir MirrorDirection, peer NoisePublicKey, packet []byte) {
+	c <- mirrorRecord{dir, peer, bytes.Clone(packet)}
+}
+
+func TestMirror(t *testing.T) {
+	pair := genTestPair(t, false)
+	mirrors := [2]chanMirror{make(chanMirror, 8), make(chanMirror, 8)}
+	pair[0].dev.SetMirror(mirrors[0])
+	pair[1].dev.SetMirror(mirrors[1])
+
+	pair.Send(t, Ping, nil)
+	ping := tuntest.Ping(pair[0].ip, pair[1].ip)
+	for _, tt := range []struct {
+		mirror chanMirror
+		want   mirrorRecord
+	}{
+		{mirrors[1], mirrorRecord{MirrorOutbound, pair[0].dev.staticIdentity.publicKey, ping}},
+		{mirrors[0], mirrorRecord{MirrorInbound, pair[1].dev.staticIdentity.publicKey, ping}},
+	} {
+		select {
+		case got := <-tt.mirror:
+			if got.dir != tt.want.dir || got.peer != tt.want.peer || !bytes.Equal(got.packet, tt.want.packet) {
+				t.Errorf("mirrored %v packet %x from %x, want %v packet %x from %x", got.dir, got.packet, got.peer[:4], tt.want.dir, tt.want.packet, tt.want.peer[:4])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v packet mirrored", tt.want.dir)
+		}
+	}
+
+	// Without a mirror, nothing is copied.
+	pair[0].dev.SetMirror(nil)
+	pair.Send(t, Pong, nil)
+	select {
+	case got := <-mirrors[0]:
+		t.Errorf("packet mirrored after SetMirror(nil): %+v", got)
+	default:
+	}
+}
+
+// blockedMirror stalls until unblocked.
+type blockedMirror chan struct{}
+
+func (c blockedMirror) MirrorPacket(MirrorDirection, NoisePublicKey, []byte) { <-c }
+
+func TestMirrorDropped(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	blocked := make(blockedMirror)
+	dev.SetMirror(blocked)
+
+	q := dev.mirroring()
+	for i := 0; i < mirrorQueueSize+10; i++ {
+		dev.mirrorPacket(q, MirrorInbound, NoisePublicKey{}, []byte{0x45})
+	}
+	// One packet may have been dequeued by the stalled mirror.
+	if n := dev.MirrorDropped(); n < 9 || n > 10 {
+		t.Errorf("MirrorDropped() = %d, want 9 or 10", n)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "mirror_dropped=") {
+		t.Errorf("IpcGet output lacks mirror_dropped:\n%s", cfg)
+	}
+	close(blocked)
+}
+
+func TestPcapngMirror(t *testing.T) {
+	var buf bytes.Buffer
+	m, err := NewPcapngMirror(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.MirrorPacket(MirrorInbound, NoisePublicKey{1}, []byte{0x45, 1, 2})
+	m.MirrorPacket(MirrorOutbound, NoisePublicKey{2}, []byte{0x60, 1, 2, 3})
+	m.MirrorPacket(MirrorOutbound, NoisePublicKey{1}, []byte{0x45})
+
+	type block struct {
+		typ  uint32
+		body []byte
+	}
+	var blocks []block
+	b := buf.Bytes()
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block: %x", b)
+		}
+		length := binary.LittleEndian.Uint32(b[4:])
+		if length%4 != 0 || int(length) > len(b) || binary.LittleEndian.Uint32(b[length-4:]) != length {
+			t.Fatalf("malformed block of length %d: %x", length, b)
+		}
+		blocks = append(blocks, block{binary.LittleEndian.Uint32(b), b[8 : length-4]})
+		b = b[length:]
+	}
+	wantTypes := []uint32{pcapngSectionHeader, pcapngInterfaceDesc, pcapngEnhancedPacket, pcapngInterfaceDesc, pcapngEnhancedPacket, pcapngEnhancedPacket}
+	if len(blocks) != len(wantTypes) {
+		t.Fatalf("wrote %d blocks, want %d", len(blocks), len(wantTypes))
+	}
+	for i, want := range wantTypes {
+		if blocks[i].typ != want {
+			t.Errorf("block %d has type %#x, want %#x", i, blocks[i].typ, want)
+		}
+	}
+	if magic := binary.LittleEndian.Uint32(blocks[0].body); magic != pcapngByteOrderMagic {
+		t.Errorf("byte order magic %#x", magic)
+	}
+	for _, tt := range []struct {
+		block  int
+		iface  uint32
+		packet []byte
+		flags  uint32
+	}{
+		{2, 0, []byte{0x45, 1, 2}, pcapngFlagInbound},
+		{4, 1, []byte{0x60, 1, 2, 3}, pcapngFlagOutbound},
+		{5, 0, []byte{0x45}, pcapngFlagOutbound},
+	} {
+		body := blocks[tt.block].body
+		if iface := binary.LittleEndian.Uint32(body); iface != tt.iface {
+			t.Errorf("block %d: interface %d, want %d", tt.block, iface, tt.iface)
+		}
+		n := binary.LittleEndian.Uint32(body[12:])
+		if packet := body[20 : 20+n]; !bytes.Equal(packet, tt.packet) {
+			t.Errorf("block %d: packet %x, want %x", tt.block, packet, tt.packet)
+		}
+		opts := body[20+(n+3)&^3:]
+		if code := binary.LittleEndian.Uint16(opts); code != pcapngOptEPBFlags {
+			t.Errorf("block %d: option %d, want epb_flags", tt.block, code)
+		} else if flags := binary.LittleEndian.Uint32(opts[4:]); flags != tt.flags {
+			t.Errorf("block %d: flags %d, want %d", tt.block, flags, tt.flags)
+		}
+	}
+}
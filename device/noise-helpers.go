@@ -82,12 +82,40 @@ func (sk *NoisePrivateKey) clamp() {
 	sk[31] = (sk[31] & 127) | 64
 }
 
+// isWeak reports whether the key is all zero, or all zero but for the bits
+// set by clamping, as decoded from an all-zero key in base64 or hex.
+func (sk *NoisePrivateKey) isWeak() bool {
+	var clampedZero NoisePrivateKey
+	clampedZero.clamp()
+	return sk.IsZero() || sk.Equals(clampedZero)
+}
+
+// isLowOrder reports whether the key is a point of small order, in any of its
+// encodings, with which every shared secret is zero. The scalar is clamped
+// to a multiple of the cofactor, so its product with such a point is zero.
+func (pk *NoisePublicKey) isLowOrder() bool {
+	var scalar [NoisePrivateKeySize]byte
+	_, err := curve25519.X25519(scalar[:], pk[:])
+	return err != nil
+}
+
 func newPrivateKey() (sk NoisePrivateKey, err error) {
 	_, err = rand.Read(sk[:])
 	sk.clamp()
 	return
 }
 
+// NewPrivateKey generates a new, clamped Curve25519 private key, like wg genkey.
+func NewPrivateKey() (NoisePrivateKey, error) {
+	return newPrivateKey()
+}
+
+// NewPresharedKey generates a new random preshared key, like wg genpsk.
+func NewPresharedKey() (psk NoisePresharedKey, err error) {
+	_, err = rand.Read(psk[:])
+	return
+}
+
 func (sk *NoisePrivateKey) publicKey() (pk NoisePublicKey) {
 	apk := (*[NoisePublicKeySize]byte)(&pk)
 	ask := (*[NoisePrivateKeySize]byte)(sk)
@@ -95,6 +123,11 @@ func (sk *NoisePrivateKey) publicKey() (pk NoisePublicKey) {
 	return
 }
 
+// PublicKey derives the public key of sk, like wg pubkey.
+func (sk NoisePrivateKey) PublicKey() NoisePublicKey {
+	return sk.publicKey()
+}
+
 var errInvalidPublicKey = errors.New("invalid public key")
 
 func (sk *NoisePrivateKey) sharedSecret(pk NoisePublicKey) (ss [NoisePublicKeySize]byte, err error) {
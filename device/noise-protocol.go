@@ -73,6 +73,7 @@ const (
 	MessageTransportOffsetReceiver = 4
 	MessageTransportOffsetCounter  = 8
 	MessageTransportOffsetContent  = 16
+	MessageResponseOffsetReceiver  = 8
 )
 
 /* Type is an 8-bit field, followed by 3 nul bytes,
@@ -207,12 +208,14 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		return nil, err
 	}
 	var key [chacha20poly1305.KeySize]byte
+	defer setZero(key[:])
 	KDF2(
 		&handshake.chainKey,
 		&key,
 		handshake.chainKey[:],
 		ss[:],
 	)
+	setZero(ss[:])
 	aead, _ := chacha20poly1305.New(key[:])
 	aead.Seal(msg.Static[:0], ZeroNonce[:], device.staticIdentity.publicKey[:], handshake.hash[:])
 	handshake.mixHash(msg.Static[:])
@@ -227,7 +230,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		handshake.chainKey[:],
 		handshake.precomputedStaticStatic[:],
 	)
-	timestamp := tai64n.Now()
+	timestamp := tai64n.At(device.now())
 	aead, _ = chacha20poly1305.New(key[:])
 	aead.Seal(msg.Timestamp[:0], ZeroNonce[:], timestamp[:], handshake.hash[:])
 
@@ -245,13 +248,21 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	peer, _, _ := device.consumeMessageInitiation(msg)
+	return peer
+}
+
+// consumeMessageInitiation is ConsumeMessageInitiation, additionally returning
+// the static key claimed by the initiator and whether it could be decrypted,
+// so that rejected initiations from unknown peers can be audited.
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation) (peer *Peer, peerPK NoisePublicKey, decrypted bool) {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
 
 	if msg.Type != MessageInitiationType {
-		return nil
+		return
 	}
 
 	device.staticIdentity.RLock()
@@ -262,25 +273,28 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
 
 	// decrypt static key
-	var peerPK NoisePublicKey
 	var key [chacha20poly1305.KeySize]byte
-	ss, err := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+	defer setZero(key[:])
+	defer setZero(chainKey[:])
+	ss, err := device.staticIdentity.ops.sharedSecret(msg.Ephemeral)
 	if err != nil {
-		return nil
+		return
 	}
 	KDF2(&chainKey, &key, chainKey[:], ss[:])
+	setZero(ss[:])
 	aead, _ := chacha20poly1305.New(key[:])
 	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
 	if err != nil {
-		return nil
+		return
 	}
+	decrypted = true
 	mixHash(&hash, &hash, msg.Static[:])
 
 	// lookup peer
 
-	peer := device.LookupPeer(peerPK)
+	peer = device.LookupPeer(peerPK)
 	if peer == nil || !peer.isRunning.Load() {
-		return nil
+		return nil, peerPK, decrypted
 	}
 
 	handshake := &peer.handshake
@@ -293,7 +307,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	if isZero(handshake.precomputedStaticStatic[:]) {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, peerPK, decrypted
 	}
 	KDF2(
 		&chainKey,
@@ -305,7 +319,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, peerPK, decrypted
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
@@ -315,12 +329,16 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	flood := time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if replay {
-		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v", peer, timestamp)
-		return nil
+		if device.log.Verbose() {
+			device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v", peer, timestamp)
+		}
+		return nil, peerPK, decrypted
 	}
 	if flood {
-		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake flood", peer)
-		return nil
+		if device.log.Verbose() {
+			device.log.Verbosef("%v - ConsumeMessageInitiation: handshake flood", peer)
+		}
+		return nil, peerPK, decrypted
 	}
 
 	// update handshake state
@@ -345,7 +363,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return peer
+	return peer, peerPK, decrypted
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
@@ -391,11 +409,13 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 		return nil, err
 	}
 	handshake.mixKey(ss[:])
+	setZero(ss[:])
 
 	// add preshared key
 
 	var tau [blake2s.Size]byte
 	var key [chacha20poly1305.KeySize]byte
+	defer setZero(key[:])
 
 	KDF3(
 		&handshake.chainKey,
@@ -433,6 +453,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
+	defer setZero(chainKey[:])
 
 	ok := func() bool {
 		// lock handshake state
@@ -461,7 +482,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		mixKey(&chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
-		ss, err = device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+		ss, err = device.staticIdentity.ops.sharedSecret(msg.Ephemeral)
 		if err != nil {
 			return false
 		}
@@ -472,6 +493,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 
 		var tau [blake2s.Size]byte
 		var key [chacha20poly1305.KeySize]byte
+		defer setZero(key[:])
 		KDF3(
 			&chainKey,
 			&tau,
@@ -558,11 +580,8 @@ func (peer *Peer) BeginSymmetricSession() error {
 	// create AEAD instances
 
 	keypair := new(Keypair)
-	keypair.send, _ = chacha20poly1305.New(sendKey[:])
-	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
-
-	setZero(sendKey[:])
-	setZero(recvKey[:])
+	keypair.suite = peer.CipherSuite()
+	keypair.setKeys(&sendKey, &recvKey)
 
 	keypair.created = time.Now()
 	keypair.replayFilter.Reset()
@@ -574,6 +593,7 @@ func (peer *Peer) BeginSymmetricSession() error {
 
 	device.indexTable.SwapIndexForKeypair(handshake.localIndex, keypair)
 	handshake.localIndex = 0
+	peer.sessionFlowLabel.Store(sessionFlowLabel(keypair.remoteIndex))
 
 	// rotate key pairs
 
@@ -7,8 +7,9 @@ package device
 
 import (
 	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
-	"errors"
+	"fmt"
 )
 
 const (
@@ -24,13 +25,25 @@ type (
 	NoiseNonce        uint64 // padded to 12-bytes
 )
 
+func loadExactBase64(dst []byte, src string) error {
+	slice, err := base64.StdEncoding.DecodeString(src)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+	if len(slice) != len(dst) {
+		return fmt.Errorf("%w: base64 string does not fit the slice", ErrInvalidKey)
+	}
+	copy(dst, slice)
+	return nil
+}
+
 func loadExactHex(dst []byte, src string) error {
 	slice, err := hex.DecodeString(src)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrInvalidKey, err)
 	}
 	if len(slice) != len(dst) {
-		return errors.New("hex string does not fit the slice")
+		return fmt.Errorf("%w: hex string does not fit the slice", ErrInvalidKey)
 	}
 	copy(dst, slice)
 	return nil
@@ -60,10 +73,43 @@ func (key *NoisePrivateKey) FromMaybeZeroHex(src string) (err error) {
 	return
 }
 
+// FromBase64 decodes a private key in the base64 form used by wg(8) and
+// configuration files, clamping it.
+func (key *NoisePrivateKey) FromBase64(src string) (err error) {
+	err = loadExactBase64(key[:], src)
+	key.clamp()
+	return
+}
+
+// Hex returns the key in the hex form used by the configuration protocol.
+func (key NoisePrivateKey) Hex() string {
+	return hex.EncodeToString(key[:])
+}
+
+// Base64 returns the key in the base64 form used by wg(8) and configuration files.
+func (key NoisePrivateKey) Base64() string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
 func (key *NoisePublicKey) FromHex(src string) error {
 	return loadExactHex(key[:], src)
 }
 
+// FromBase64 decodes a public key in the base64 form used by wg(8) and configuration files.
+func (key *NoisePublicKey) FromBase64(src string) error {
+	return loadExactBase64(key[:], src)
+}
+
+// Hex returns the key in the hex form used by the configuration protocol.
+func (key NoisePublicKey) Hex() string {
+	return hex.EncodeToString(key[:])
+}
+
+// Base64 returns the key in the base64 form used by wg(8) and configuration files.
+func (key NoisePublicKey) Base64() string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
 func (key NoisePublicKey) IsZero() bool {
 	var zero NoisePublicKey
 	return key.Equals(zero)
@@ -76,3 +122,18 @@ func (key NoisePublicKey) Equals(tar NoisePublicKey) bool {
 func (key *NoisePresharedKey) FromHex(src string) error {
 	return loadExactHex(key[:], src)
 }
+
+// FromBase64 decodes a preshared key in the base64 form used by wg(8) and configuration files.
+func (key *NoisePresharedKey) FromBase64(src string) error {
+	return loadExactBase64(key[:], src)
+}
+
+// Hex returns the key in the hex form used by the configuration protocol.
+func (key NoisePresharedKey) Hex() string {
+	return hex.EncodeToString(key[:])
+}
+
+// Base64 returns the key in the base64 form used by wg(8) and configuration files.
+func (key NoisePresharedKey) Base64() string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// WithOffloadsDisabled disables UDP segmentation offloads on the device's
+// Bind, as DisableOffloads does, for NICs whose drivers corrupt coalesced
+// datagrams in ways its probe does not catch.
+func WithOffloadsDisabled() Option {
+	return func(device *Device) error {
+		device.net.disableOffloads = true
+		return nil
+	}
+}
+
+// DisableOffloads stops the device's Bind from coalescing the datagrams it
+// sends with UDP GSO, and from the next time it is opened, from receiving
+// datagrams coalesced with UDP GRO, until the device is closed. It fails if
+// the Bind is not a conn.OffloadBind.
+func (device *Device) DisableOffloads() error {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	bind, ok := device.net.bind.(conn.OffloadBind)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	bind.DisableOffloads()
+	return nil
+}
+
+// OffloadsDisabled reports whether the device's Bind stopped using UDP
+// segmentation offloads, by DisableOffloads or after its probe failed.
+func (device *Device) OffloadsDisabled() bool {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return device.offloadsDisabledLocked()
+}
+
+// offloadsDisabledLocked is OffloadsDisabled for callers holding device.net.
+func (device *Device) offloadsDisabledLocked() bool {
+	if bind, ok := device.net.bind.(conn.OffloadBind); ok {
+		disabled, _ := bind.OffloadsDisabled()
+		return disabled
+	}
+	return false
+}
+
+// logOffloadFailure logs the failure of the Bind's offload probe, the first
+// time it is seen. device.net must be locked.
+func (device *Device) logOffloadFailure() {
+	bind, ok := device.net.bind.(conn.OffloadBind)
+	if !ok || device.net.offloadFailureLogged {
+		return
+	}
+	if _, err := bind.OffloadsDisabled(); err != nil {
+		device.log.Errorf("UDP bind: %v", err)
+		device.net.offloadFailureLogged = true
+	}
+}
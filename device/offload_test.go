@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/darkit/wireguard/conn/bindtest"
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+func TestDisableOffloadsUAPI(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	if dev.OffloadsDisabled() {
+		t.Fatal("offloads disabled on a new device")
+	}
+	if err := dev.IpcSet(uapiCfg("disable_offloads", "false")); err == nil {
+		t.Error("disable_offloads=false accepted")
+	}
+	if err := dev.IpcSet(uapiCfg("disable_offloads", "true")); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.OffloadsDisabled() {
+		t.Error("offloads not disabled by UAPI")
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "disable_offloads=true\n") {
+		t.Errorf("disable_offloads missing from IpcGet output:\n%s", cfg)
+	}
+}
+
+func TestWithOffloadsDisabled(t *testing.T) {
+	bind := conn.NewStdNetBind()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bind, NewLogger(LogLevelError, ""), WithOffloadsDisabled())
+	defer dev.Close()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if disabled, err := bind.(conn.OffloadBind).OffloadsDisabled(); !disabled || err != nil {
+		t.Errorf("OffloadsDisabled() = %v, %v with WithOffloadsDisabled, want true, nil", disabled, err)
+	}
+	if caps := bind.(conn.CapabilityReporter).Capabilities(); caps.TxOffload || caps.RxOffload {
+		t.Errorf("offloads used with WithOffloadsDisabled: %+v", caps)
+	}
+}
+
+func TestWithOffloadsDisabledUnsupported(t *testing.T) {
+	var logged []string
+	logger := &Logger{
+		Verbosef: DiscardLogf,
+		Errorf:   func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) },
+	}
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], logger, WithOffloadsDisabled())
+	defer dev.Close()
+	if len(logged) != 1 || !strings.Contains(logged[0], "unable to disable offloads") {
+		t.Errorf("WithOffloadsDisabled with a bind without offloads logged %q", logged)
+	}
+}
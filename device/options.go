@@ -0,0 +1,157 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// An Option configures a Device created by New or NewDevice. Options are
+// applied in order, later ones overriding earlier ones, before the device
+// starts any of its goroutines.
+type Option func(*Device) error
+
+// TimerOptions configures the timers of a Device from its creation, as the
+// setters named for each field do later.
+type TimerOptions struct {
+	// HandshakeBackoffMax is the longest a peer is left in handshake
+	// backoff, see SetHandshakeBackoff. Zero selects
+	// DefaultHandshakeBackoffMax; a negative value disables backoff.
+	HandshakeBackoffMax time.Duration
+
+	// HandshakeJitter is the fraction of RekeyTimeout initiations are
+	// delayed by at most, see SetHandshakeJitter.
+	HandshakeJitter float64
+
+	// PeerWatchdog is the window of the peer watchdog, see
+	// SetPeerWatchdog. Zero disables it.
+	PeerWatchdog time.Duration
+
+	// EndpointTTL is how long learned endpoints are kept without hearing
+	// from their peers, see SetEndpointTTL. Zero keeps them forever.
+	EndpointTTL time.Duration
+
+	// SessionMargin and SessionMarginMessages are the margins sessions are
+	// renewed within, see SetSessionMargins. Zero selects the defaults.
+	SessionMargin         time.Duration
+	SessionMarginMessages uint64
+}
+
+// WithLogger makes the device log to logger, rather than nowhere.
+func WithLogger(logger *Logger) Option {
+	return func(device *Device) error {
+		if logger == nil {
+			return errors.New("nil logger")
+		}
+		device.log = logger
+		return nil
+	}
+}
+
+// WithTimers configures the device's timers.
+func WithTimers(timers TimerOptions) Option {
+	return func(device *Device) error {
+		if timers.PeerWatchdog < 0 {
+			return fmt.Errorf("negative peer watchdog window %v", timers.PeerWatchdog)
+		}
+		if timers.EndpointTTL < 0 {
+			return fmt.Errorf("negative endpoint TTL %v", timers.EndpointTTL)
+		}
+		if err := device.SetHandshakeJitter(timers.HandshakeJitter); err != nil {
+			return err
+		}
+		if err := device.SetSessionMargins(timers.SessionMargin, timers.SessionMarginMessages); err != nil {
+			return err
+		}
+		device.handshakeBackoffMax.Store(int64(timers.HandshakeBackoffMax))
+		device.SetPeerWatchdog(timers.PeerWatchdog)
+		device.SetEndpointTTL(timers.EndpointTTL)
+		return nil
+	}
+}
+
+// WithWorkers makes the device encrypt, decrypt and process handshakes on n
+// goroutines each, rather than one per CPU, such as to leave CPUs to other
+// work on a shared host.
+func WithWorkers(n int) Option {
+	return func(device *Device) error {
+		if n < 1 {
+			return fmt.Errorf("%d workers, want at least 1", n)
+		}
+		device.workers = n
+		return nil
+	}
+}
+
+// WithEventHandler registers fn to be called for every Event from the
+// device's creation on, as SetEventHandler does.
+func WithEventHandler(fn func(Event)) Option {
+	return func(device *Device) error {
+		device.SetEventHandler(fn)
+		return nil
+	}
+}
+
+// WithClock makes the device tell the time of day with now, rather than
+// time.Now, such as on a system without a real-time clock that learns the
+// time from its network. It stamps the device's handshake initiations, which
+// peers reject unless their timestamps are later than the last ones they
+// saw, as well as its events, and is checked by HealthCheck. Timeouts and
+// timers run on the monotonic system clock regardless.
+func WithClock(now func() time.Time) Option {
+	return func(device *Device) error {
+		if now == nil {
+			return errors.New("nil clock")
+		}
+		device.clock = now
+		return nil
+	}
+}
+
+// WithMetricsSink makes the device write its metrics to sink every interval
+// until it is closed, each time in full, as WriteMetrics does, such as to
+// push them to a gateway. Errors writing to sink are logged.
+func WithMetricsSink(sink io.Writer, interval time.Duration) Option {
+	return func(device *Device) error {
+		if sink == nil {
+			return errors.New("nil metrics sink")
+		}
+		if interval <= 0 {
+			return fmt.Errorf("metrics interval %v not positive", interval)
+		}
+		device.metricsSink = sink
+		device.metricsInterval = interval
+		return nil
+	}
+}
+
+// now returns the time of day by the device's clock.
+func (device *Device) now() time.Time {
+	if device.clock != nil {
+		return device.clock()
+	}
+	return time.Now()
+}
+
+// pushMetrics writes the metrics of the device to its metrics sink every
+// interval until it is closed.
+func (device *Device) pushMetrics() {
+	ticker := time.NewTicker(device.metricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-device.closed:
+			return
+		case <-ticker.C:
+			if err := device.WriteMetrics(device.metricsSink); err != nil {
+				device.log.Errorf("Unable to write metrics: %v", err)
+			}
+		}
+	}
+}
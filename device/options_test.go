@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn/bindtest"
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestNewOptions(t *testing.T) {
+	logger := NewLogger(LogLevelError, "")
+	var events []Event
+	clock := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var metrics lockedBuffer
+	timers := TimerOptions{
+		HandshakeBackoffMax:   time.Minute,
+		HandshakeJitter:       0.5,
+		PeerWatchdog:          time.Minute,
+		EndpointTTL:           time.Hour,
+		SessionMargin:         MaxSessionMargin,
+		SessionMarginMessages: MaxSessionMarginMessages,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dev, err := New(ctx, tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0],
+		WithLogger(logger),
+		WithTimers(timers),
+		WithWorkers(1),
+		WithWorkers(3), // overrides the previous one
+		WithMemoryProfile(ProfileLowMemory),
+		WithEventHandler(func(ev Event) { events = append(events, ev) }),
+		WithClock(func() time.Time { return clock }),
+		WithMetricsSink(&metrics, 10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dev.log != logger {
+		t.Error("logger not set")
+	}
+	if dev.handshakeBackoffMax.Load() != int64(time.Minute) || dev.HandshakeJitter() != 0.5 ||
+		dev.watchdogWindow.Load() != int64(time.Minute) || dev.EndpointTTL() != time.Hour {
+		t.Error("timers not set")
+	}
+	if margin, messages := dev.SessionMargins(); margin != MaxSessionMargin || messages != MaxSessionMarginMessages {
+		t.Errorf("session margins %v and %d, want the maximum", margin, messages)
+	}
+	if dev.workers != 3 {
+		t.Errorf("%d workers, want 3", dev.workers)
+	}
+	if dev.memory.queueOutboundSize != 128 {
+		t.Error("low memory profile not selected")
+	}
+	dev.emitEvent(EventPeerWatchdogRecovery, nil)
+	if len(events) != 1 || !events[0].Time.Equal(clock) {
+		t.Errorf("events %v, want one at %v", events, clock)
+	}
+	if status, _ := dev.healthCheckClock(); status != HealthFailed {
+		t.Errorf("clock health %v with the clock in 2000", status)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(metrics.String(), "\nwireguard_device_up "); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no metrics written to the sink")
+		}
+	}
+
+	// Cancelling the context closes the device.
+	cancel()
+	select {
+	case <-dev.Wait():
+	case <-time.After(5 * time.Second):
+		t.Fatal("device not closed with its context")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opt  Option
+	}{
+		{"nil logger", WithLogger(nil)},
+		{"jitter", WithTimers(TimerOptions{HandshakeJitter: 2})},
+		{"session margin", WithTimers(TimerOptions{SessionMargin: time.Second})},
+		{"watchdog", WithTimers(TimerOptions{PeerWatchdog: -time.Second})},
+		{"endpoint TTL", WithTimers(TimerOptions{EndpointTTL: -time.Second})},
+		{"workers", WithWorkers(0)},
+		{"memory profile", WithMemoryProfile(MemoryProfile(99))},
+		{"nil clock", WithClock(nil)},
+		{"nil metrics sink", WithMetricsSink(nil, time.Second)},
+		{"metrics interval", WithMetricsSink(&lockedBuffer{}, 0)},
+	} {
+		dev, err := New(context.Background(), tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], WithWorkers(1), test.opt)
+		if err == nil {
+			dev.Close()
+			t.Errorf("%s: New succeeded", test.name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := New(ctx, tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0]); !errors.Is(err, context.Canceled) {
+		t.Errorf("New with a cancelled context: %v", err)
+	}
+
+	var logged []string
+	logger := &Logger{
+		Verbosef: DiscardLogf,
+		Errorf:   func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) },
+	}
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], logger, WithWorkers(-1))
+	defer dev.Close()
+	if dev.workers != runtime.NumCPU() {
+		t.Errorf("NewDevice with an invalid worker count: %d workers, want the default %d", dev.workers, runtime.NumCPU())
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "-1 workers") {
+		t.Errorf("NewDevice with an invalid option logged %q", logged)
+	}
+}
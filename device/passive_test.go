@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+func TestPassivePeer(t *testing.T) {
+	pair := genTestPair(t, false)
+	remote := pair[1].dev.staticIdentity.publicKey
+	if err := pair[0].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(remote[:]),
+		"passive", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	peer := pair[0].dev.LookupPeer(remote)
+
+	// Traffic for a passive peer is staged, but no handshake is attempted.
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	time.Sleep(100 * time.Millisecond)
+	peer.handshake.mutex.RLock()
+	state := peer.handshake.state
+	peer.handshake.mutex.RUnlock()
+	if state != handshakeZeroed || peer.timers.retransmitHandshake.IsPending() {
+		t.Fatal("passive peer initiated a handshake")
+	}
+
+	// Once the peer has reached us, it is treated as active.
+	pair.Send(t, Ping, nil)
+	select {
+	case <-pair[1].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("staged packet was not delivered after the peer made contact")
+	}
+	if !peer.canInitiate() {
+		t.Error("peer still passive after an inbound handshake")
+	}
+	pair.Send(t, Pong, nil)
+
+	if out, err := pair[0].dev.IpcGet(); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(out, "\npassive=true\n") {
+		t.Error("IpcGet does not report passive=true")
+	}
+}
@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Parameters of the Argon2id derivation of PresharedKeyFromPassphrase. They
+// are part of its definition: changing them changes every derived key.
+const (
+	PassphraseKDFTime    = 3         // passes over the memory
+	PassphraseKDFMemory  = 64 * 1024 // KiB of memory
+	PassphraseKDFThreads = 4         // lanes
+)
+
+// PresharedKeyFromPassphrase derives a preshared key from a passphrase with
+// Argon2id, using PassphraseKDFTime, PassphraseKDFMemory and
+// PassphraseKDFThreads, so that guessing the passphrase from the key is
+// costly. Peers deriving their key this way should use PresharedKeySalt,
+// which the UAPI key preshared_key_passphrase does.
+func PresharedKeyFromPassphrase(passphrase string, salt []byte) (psk NoisePresharedKey) {
+	copy(psk[:], argon2.IDKey([]byte(passphrase), salt, PassphraseKDFTime, PassphraseKDFMemory, PassphraseKDFThreads, NoisePresharedKeySize))
+	return
+}
+
+// PresharedKeySalt returns the salt of the preshared key of the peers with
+// public keys a and b: both keys, the lesser first, so that each peer
+// derives the same key.
+func PresharedKeySalt(a, b NoisePublicKey) []byte {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return append(a[:], b[:]...)
+}
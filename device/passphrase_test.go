@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPresharedKeyFromPassphrase(t *testing.T) {
+	// The key is pinned, so that the parameters of the derivation, which
+	// both sides must agree on, cannot change by accident.
+	psk := PresharedKeyFromPassphrase("correct horse battery staple", []byte("wireguard salt"))
+	if got, want := psk.Hex(), "b20da311bf5502f2f4138f11bc37c4e033592bb7d5a6c504fad76c727fd2b9a3"; got != want {
+		t.Errorf("PresharedKeyFromPassphrase = %s, want %s", got, want)
+	}
+
+	a, b := randNoisePublicKey(t), randNoisePublicKey(t)
+	if string(PresharedKeySalt(a, b)) != string(PresharedKeySalt(b, a)) {
+		t.Error("PresharedKeySalt depends on the order of the keys")
+	}
+}
+
+func TestPresharedKeyPassphraseHandshake(t *testing.T) {
+	pair := genTestPair(t, true)
+	for i := range pair {
+		pk := pair[i^1].dev.staticIdentity.publicKey
+		if err := pair[i].dev.IpcSet(uapiCfg("public_key", pk.Hex(), "preshared_key_passphrase", "correct horse battery staple")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var psks [2]NoisePresharedKey
+	for i := range pair {
+		peer := pair[i].dev.LookupPeer(pair[i^1].dev.staticIdentity.publicKey)
+		peer.handshake.mutex.RLock()
+		psks[i] = peer.handshake.presharedKey
+		peer.handshake.mutex.RUnlock()
+	}
+	if psks[0] != psks[1] || psks[0] == (NoisePresharedKey{}) {
+		t.Fatalf("devices derived preshared keys %x and %x", psks[0], psks[1])
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	dev := randDevice(t)
+	defer dev.Close()
+	if err := dev.IpcSet(uapiCfg("public_key", randNoisePublicKey(t).Hex(), "preshared_key_passphrase", "")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("setting an empty passphrase = %v, want ErrInvalidKey", err)
+	}
+}
@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types, options and flags, as specified by
+// draft-ietf-opsawg-pcapng.
+const (
+	pcapngSectionHeader     = 0x0a0d0d0a
+	pcapngInterfaceDesc     = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1a2b3c4d
+	pcapngLinkTypeRaw       = 101 // LINKTYPE_RAW: packets begin with an IPv4 or IPv6 header
+	pcapngOptEnd            = 0
+	pcapngOptIfName         = 2
+	pcapngOptIfDescription  = 3
+	pcapngOptEPBFlags       = 2
+	pcapngFlagInbound       = 1
+	pcapngFlagOutbound      = 2
+	pcapngBlockOverheadSize = 12 // type, and the length before and after the body
+)
+
+// PcapngMirror is a PacketMirror writing the packets it receives in the
+// pcapng format, readable by Wireshark, Suricata and Zeek. Each peer appears
+// as an interface named by its public key.
+type PcapngMirror struct {
+	w          io.Writer
+	interfaces map[NoisePublicKey]uint32
+	body       []byte
+	block      []byte
+	err        error
+}
+
+// NewPcapngMirror returns a PcapngMirror writing to w, having written the
+// section header.
+func NewPcapngMirror(w io.Writer) (*PcapngMirror, error) {
+	m := &PcapngMirror{w: w, interfaces: make(map[NoisePublicKey]uint32)}
+	body := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // major version
+	body = binary.LittleEndian.AppendUint16(body, 0) // minor version
+	body = binary.LittleEndian.AppendUint64(body, ^uint64(0))
+	m.writeBlock(pcapngSectionHeader, body)
+	return m, m.err
+}
+
+// Err returns the first error writing to the underlying writer. Packets
+// mirrored after an error are discarded.
+func (m *PcapngMirror) Err() error {
+	return m.err
+}
+
+// MirrorPacket writes packet, preceded by an interface description of the
+// peer if it is the first packet of the peer.
+func (m *PcapngMirror) MirrorPacket(dir MirrorDirection, peer NoisePublicKey, packet []byte) {
+	if m.err != nil {
+		return
+	}
+	id, ok := m.interfaces[peer]
+	if !ok {
+		id = uint32(len(m.interfaces))
+		m.interfaces[peer] = id
+		name := base64.StdEncoding.EncodeToString(peer[:])
+		body := binary.LittleEndian.AppendUint16(nil, pcapngLinkTypeRaw)
+		body = binary.LittleEndian.AppendUint16(body, 0) // reserved
+		body = binary.LittleEndian.AppendUint32(body, 0) // no snapshot length
+		body = appendPcapngOption(body, pcapngOptIfName, []byte(name))
+		body = appendPcapngOption(body, pcapngOptIfDescription, []byte("WireGuard peer "+name))
+		body = appendPcapngOption(body, pcapngOptEnd, nil)
+		m.writeBlock(pcapngInterfaceDesc, body)
+	}
+
+	ts := uint64(time.Now().UnixMicro()) // the default if_tsresol
+	flags := uint32(pcapngFlagInbound)
+	if dir == MirrorOutbound {
+		flags = pcapngFlagOutbound
+	}
+	body := binary.LittleEndian.AppendUint32(m.body[:0], id)
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet))) // captured
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet))) // original
+	body = appendPcapngPadded(body, packet)
+	body = appendPcapngOption(body, pcapngOptEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	body = appendPcapngOption(body, pcapngOptEnd, nil)
+	m.writeBlock(pcapngEnhancedPacket, body)
+	m.body = body
+}
+
+func (m *PcapngMirror) writeBlock(typ uint32, body []byte) {
+	if m.err != nil {
+		return
+	}
+	length := uint32(len(body) + pcapngBlockOverheadSize)
+	block := binary.LittleEndian.AppendUint32(m.block[:0], typ)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	_, m.err = m.w.Write(block)
+	m.block = block
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return appendPcapngPadded(b, value)
+}
+
+// appendPcapngPadded appends value to b, padded to 32 bits.
+func appendPcapngPadded(b, value []byte) []byte {
+	b = append(b, value...)
+	var pad [3]byte
+	return append(b, pad[:(4-len(value)%4)%4]...)
+}
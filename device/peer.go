@@ -8,6 +8,7 @@ package device
 import (
 	"container/list"
 	"errors"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,16 +21,31 @@ type Peer struct {
 	keypairs          Keypairs
 	handshake         Handshake
 	device            *Device
+	staticKey         NoisePublicKey // handshake.remoteStatic, which never changes, to read without its lock
 	stopping          sync.WaitGroup // routines pending stop
 	txBytes           atomic.Uint64  // bytes send to peer (endpoint)
 	rxBytes           atomic.Uint64  // bytes received from peer
 	lastHandshakeNano atomic.Int64   // nano seconds since epoch
+	prewarmAt         atomic.Int64   // nano seconds since epoch, set by PrewarmAt, zero if none
+	lastReceivedNano  atomic.Int64   // nano seconds since epoch of the last authenticated packet received
+	reportedState     atomic.Int32   // PeerState last reported by EventPeerStateChanged, changed under stateMu
+	stateMu           sync.Mutex     // serializes updateState, so that changes are reported in order
+	stableFlowLabel   uint32         // IPv6 flow label under conn.FlowLabelPeer
+	rekeyAfterTime    time.Duration  // RekeyAfterTime with jitter
+	sessionFlowLabel  atomic.Uint32  // IPv6 flow label under conn.FlowLabelRandom, zero before the first session
 
 	endpoint struct {
 		sync.Mutex
 		val            conn.Endpoint
 		clearSrcOnTx   bool // signal to val.ClearSrc() prior to next packet transmission
 		disableRoaming bool
+		learned        bool           // whether an authenticated packet has arrived from the peer
+		configured     conn.Endpoint  // set through the configuration, kept once a learned endpoint expires
+		expired        bool           // whether the learned endpoint expired, see SetEndpointTTL
+		source         netip.Addr     // local address to send from, if set by SetTransportSource
+		sourceRetry    time.Time      // when to try source again after it failed, zero if it works
+		punched        conn.Endpoint  // the path Punch last opened to the peer, if any
+		punchedBy      conn.PunchBind // the bind punched was opened through
 	}
 
 	timers struct {
@@ -38,7 +54,14 @@ type Peer struct {
 		newHandshake            *Timer
 		zeroKeyMaterial         *Timer
 		persistentKeepalive     *Timer
+		watchdog                *Timer
+		state                   *Timer // rechecks State when it changes with time
+		delayedInitiation       *Timer // sends an initiation delayed by the handshake jitter
+		endpointTTL             *Timer // forgets the learned endpoint, see SetEndpointTTL
+		prewarm                 *Timer // initiates the handshake set by PrewarmAt
 		handshakeAttempts       atomic.Uint32
+		backoffFailures         atomic.Uint32 // failed handshakes since entering handshake backoff
+		backoffUntil            atomic.Int64  // unix nanoseconds before which no initiation is sent in backoff
 		needAnotherKeepalive    atomic.Bool
 		sentLastMinuteHandshake atomic.Bool
 	}
@@ -56,23 +79,48 @@ type Peer struct {
 	cookieGenerator             CookieGenerator
 	trieEntries                 list.List
 	persistentKeepaliveInterval atomic.Uint32
+	keepaliveOffload            keepaliveOffload
+	watchdogRecoveries          atomic.Uint64
+	watchdogWindow              atomic.Int64               // time.Duration set by SetWatchdog, zero for the device's
+	lastWatchdogRecovery        atomic.Int64               // unix nanoseconds of the last recovered stall, zero if none
+	outOfOrder                  atomic.Uint64              // packets received after one of a higher counter
+	outOfOrderDistance          atomic.Uint64              // sum of how far behind they were
+	passive                     atomic.Bool                // never initiate until the peer has reached us
+	allowAnySource              atomic.Bool                // skip source address validation; unsafe
+	ingressIPs                  atomic.Pointer[ingressIPs] // set by SetIngressAllowedIPs; nil to validate against allowed IPs
+	cipherSuite                 atomic.Int32               // CipherSuite of new sessions
+	stackedTransport            atomic.Bool                // stack small packets into shared messages
+	disallowedSources           disallowedSources
+	inboundPolicyDrops          atomic.Uint64 // packets from the peer dropped by the inbound policy
+	sizes                       sizeHistogram
+	endpointError               atomic.Int32                      // conn.EndpointError reported since last heard from
+	labels                      atomic.Pointer[map[string]string] // set by SetLabels, never modified
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	if device.isClosed() {
 		return nil, errors.New("device closed")
 	}
+	if pk.isLowOrder() {
+		return nil, ErrLowOrderKey
+	}
 
 	// lock resources
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
+	if pk.Equals(device.staticIdentity.publicKey) {
+		return nil, ErrOwnKey
+	}
 
 	device.peers.Lock()
 	defer device.peers.Unlock()
 
 	// check if over limit
 	if len(device.peers.keyMap) >= MaxPeers {
-		return nil, errors.New("too many peers")
+		return nil, ErrTooManyPeers
+	}
+	if limit := device.limits.peers.Load(); limit > 0 && int64(len(device.peers.keyMap)) >= limit {
+		return nil, ErrTooManyPeers
 	}
 
 	// create peer
@@ -80,6 +128,8 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
+	peer.stableFlowLabel = stableFlowLabel(pk)
+	peer.rekeyAfterTime = newRekeyAfterTime()
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
 	peer.queue.inbound = newAutodrainingInboundQueue(device)
 	peer.queue.staged = make(chan *QueueOutboundElementsContainer, QueueStagedSize)
@@ -93,9 +143,10 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	// pre-compute DH
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
-	handshake.precomputedStaticStatic, _ = device.staticIdentity.privateKey.sharedSecret(pk)
+	handshake.precomputedStaticStatic = device.staticIdentity.ops.precompute(pk)
 	handshake.remoteStatic = pk
 	handshake.mutex.Unlock()
+	peer.staticKey = pk
 
 	// reset endpoint
 	peer.endpoint.Lock()
@@ -109,6 +160,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	// add
 	device.peers.keyMap[pk] = peer
+	device.peers.generation.Add(1)
 
 	return peer, nil
 }
@@ -131,9 +183,21 @@ func (peer *Peer) SendBuffers(buffers [][]byte) error {
 		endpoint.ClearSrc()
 		peer.endpoint.clearSrcOnTx = false
 	}
+	src, retrying := peer.transportSource()
 	peer.endpoint.Unlock()
 
-	err := peer.device.net.bind.Send(buffers, endpoint)
+	err := peer.send(buffers, endpoint, src, retrying)
+	if err != nil && errStaleSource(err) && peer.clearStaleSource(endpoint) {
+		// The sticky source is gone or no longer routes to the peer, as
+		// when the default route moved to another interface; send from
+		// whatever source the kernel picks instead, as the kernel
+		// implementation does.
+		peer.device.log.Verbosef("%v - Sticky source unusable, retrying without: %v", peer, err)
+		peer.endpoint.Lock()
+		src, retrying = peer.transportSource()
+		peer.endpoint.Unlock()
+		err = peer.send(buffers, endpoint, src, retrying)
+	}
 	if err == nil {
 		var totalLen uint64
 		for _, b := range buffers {
@@ -144,6 +208,29 @@ func (peer *Peer) SendBuffers(buffers [][]byte) error {
 	return err
 }
 
+func (peer *Peer) send(buffers [][]byte, endpoint conn.Endpoint, src netip.Addr, retrying bool) error {
+	bind := peer.device.net.bind
+	if _, ok := bind.(conn.SourceBind); ok && src.IsValid() {
+		return peer.sendFrom(bind, buffers, endpoint, src, retrying)
+	} else if fb, ok := bind.(conn.FlowLabelBind); ok {
+		return fb.SendFlowLabel(buffers, endpoint, peer.flowLabel(fb.FlowLabelPolicy()))
+	}
+	return bind.Send(buffers, endpoint)
+}
+
+// clearStaleSource clears the sticky source of endpoint, reporting whether
+// it had one and is still the peer's endpoint.
+func (peer *Peer) clearStaleSource(endpoint conn.Endpoint) bool {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	if peer.endpoint.val != endpoint || !endpoint.SrcIP().IsValid() {
+		return false
+	}
+	endpoint.ClearSrc()
+	peer.endpoint.clearSrcOnTx = false
+	return true
+}
+
 func (peer *Peer) String() string {
 	// The awful goo that follows is identical to:
 	//
@@ -209,9 +296,16 @@ func (peer *Peer) Start() {
 	go peer.RoutineSequentialReceiver(batchSize)
 
 	peer.isRunning.Store(true)
+	peer.armPrewarm()
 }
 
 func (peer *Peer) ZeroAndFlushAll() {
+	peer.zeroKeyMaterial()
+	peer.FlushStagedPackets()
+}
+
+// zeroKeyMaterial clears the peer's keypairs and handshake state.
+func (peer *Peer) zeroKeyMaterial() {
 	device := peer.device
 
 	// clear key pairs
@@ -234,7 +328,7 @@ func (peer *Peer) ZeroAndFlushAll() {
 	handshake.Clear()
 	handshake.mutex.Unlock()
 
-	peer.FlushStagedPackets()
+	peer.updateState()
 }
 
 func (peer *Peer) ExpireCurrentKeypairs() {
@@ -256,6 +350,18 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	keypairs.Unlock()
 }
 
+// abandonHandshake abandons the handshake in progress, made with a static
+// key that was just replaced, and lets one be initiated with the new key at
+// once.
+func (peer *Peer) abandonHandshake() {
+	handshake := &peer.handshake
+	handshake.mutex.Lock()
+	peer.device.indexTable.Delete(handshake.localIndex)
+	handshake.Clear()
+	handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	handshake.mutex.Unlock()
+}
+
 func (peer *Peer) Stop() {
 	peer.state.Lock()
 	defer peer.state.Unlock()
@@ -279,6 +385,8 @@ func (peer *Peer) Stop() {
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	peer.endpoint.Lock()
 	defer peer.endpoint.Unlock()
+	peer.endpoint.learned = true
+	peer.endpoint.expired = false
 	if peer.endpoint.disableRoaming {
 		return
 	}
@@ -286,6 +394,39 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	peer.endpoint.val = endpoint
 }
 
+// SetPassive marks the peer as passive. A passive peer never initiates
+// handshakes, and so arms no handshake timers, until it has reached us with
+// an inbound handshake; from then on it behaves like any other peer. Peers
+// without an endpoint are implicitly passive.
+func (peer *Peer) SetPassive(passive bool) {
+	peer.passive.Store(passive)
+}
+
+// canInitiate reports whether we may send handshake initiations to the peer.
+func (peer *Peer) canInitiate() bool {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	if peer.endpoint.val == nil || peer.endpoint.expired {
+		return false
+	}
+	return peer.endpoint.learned || !peer.passive.Load()
+}
+
+// InvalidateStickySources makes the packets next sent to each peer leave
+// from whatever source address the routes select, rather than the address
+// the peer's packets last arrived at, until the peer is heard from again.
+// A device with the default bind on Linux needs no call, as it looks up the
+// route to each peer whenever the routes change and clears the sticky
+// sources of those routed through another interface; others need it when
+// the default route moves to another interface.
+func (device *Device) InvalidateStickySources() {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.markEndpointSrcForClearing()
+	}
+}
+
 func (peer *Peer) markEndpointSrcForClearing() {
 	peer.endpoint.Lock()
 	defer peer.endpoint.Unlock()
@@ -294,3 +435,80 @@ func (peer *Peer) markEndpointSrcForClearing() {
 	}
 	peer.endpoint.clearSrcOnTx = true
 }
+
+// AllowedIPs returns the prefixes routed to the peer.
+func (peer *Peer) AllowedIPs() []netip.Prefix {
+	var prefixes []netip.Prefix
+	peer.device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
+		prefixes = append(prefixes, prefix)
+		return true
+	})
+	return prefixes
+}
+
+// AddAllowedIP routes prefix to the peer, taking it from any other peer it
+// was routed to, like the allowed_ip key of IpcSet. It fails if that would
+// exceed a limit set by Device.SetLimits.
+func (peer *Peer) AddAllowedIP(prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return ErrInvalidAllowedIP
+	}
+	_, err := peer.device.insertAllowedIP(prefix.Masked(), peer)
+	return err
+}
+
+// RemoveAllowedIP stops routing prefix to the peer, if it was.
+func (peer *Peer) RemoveAllowedIP(prefix netip.Prefix) {
+	if prefix.IsValid() {
+		peer.device.allowedips.Remove(prefix.Masked(), peer)
+	}
+}
+
+// RemoveAllowedIP removes prefix from the allowed IPs of the peer with
+// public key pk, like the remove_allowed_ip key of IpcSet, leaving any more
+// specific prefixes it covers. It fails with ErrPeerNotFound if there is no
+// such peer, ErrAllowedIPNotFound if prefix is not an allowed IP of any
+// peer, or ErrAllowedIPNotOwned if it is another peer's.
+func (device *Device) RemoveAllowedIP(pk NoisePublicKey, prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return ErrInvalidAllowedIP
+	}
+	peer, err := device.Peer(pk)
+	if err != nil {
+		return err
+	}
+	return device.allowedips.removeExact(prefix.Masked(), peer)
+}
+
+// ReplaceAllowedIPs makes prefixes the allowed IPs of the peer with public
+// key pk, taking them from any other peers they were routed to, like the
+// replace_allowed_ips and allowed_ip keys of IpcSet. Unlike those, it only
+// removes and adds the prefixes that changed, atomically with respect to
+// routing lookups, so packets to the unchanged ones are never dropped. It
+// fails, changing nothing, with ErrPeerNotFound if there is no such peer, or
+// if the new prefixes would exceed a limit set by SetLimits.
+func (device *Device) ReplaceAllowedIPs(pk NoisePublicKey, prefixes []netip.Prefix) error {
+	masked := make([]netip.Prefix, len(prefixes))
+	for i, prefix := range prefixes {
+		if !prefix.IsValid() {
+			return ErrInvalidAllowedIP
+		}
+		masked[i] = prefix.Masked()
+	}
+
+	// Holding the peers lock keeps the peer from being removed meanwhile.
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	peer := device.peers.keyMap[pk]
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	return device.allowedips.replaceLimited(peer, masked,
+		int(device.limits.allowedIPsPerPeer.Load()),
+		int(device.limits.totalAllowedIPs.Load()))
+}
+
+// LookupAllowedIP returns the peer addr is routed to, or nil.
+func (device *Device) LookupAllowedIP(addr netip.Addr) *Peer {
+	return device.allowedips.Lookup(addr.Unmap().AsSlice())
+}
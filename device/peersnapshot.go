@@ -0,0 +1,169 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"cmp"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// PeerStats is the traffic of a peer and the time of its latest handshake.
+type PeerStats struct {
+	RxBytes       uint64
+	TxBytes       uint64
+	LastHandshake time.Time // zero if there has been none
+}
+
+// A PeerSnapshot describes a peer as it was when taken.
+type PeerSnapshot struct {
+	PublicKey NoisePublicKey
+	Endpoint  string // as given by conn.Endpoint.DstToString, or empty if none
+	State     PeerState
+	Stats     PeerStats
+}
+
+// A SortKey is the order in which PeersSorted returns peers. Peers equal by
+// it are ordered by their public keys, so that the order is total.
+type SortKey int
+
+const (
+	SortByPublicKey     SortKey = iota // ascending
+	SortByLastHandshake                // most recent first, those without one last
+	SortByRxBytes                      // most first
+	SortByTxBytes                      // most first
+	SortByEndpoint                     // ascending, those without one last
+)
+
+func (key SortKey) String() string {
+	switch key {
+	case SortByPublicKey:
+		return "public_key"
+	case SortByLastHandshake:
+		return "last_handshake"
+	case SortByRxBytes:
+		return "rx_bytes"
+	case SortByTxBytes:
+		return "tx_bytes"
+	case SortByEndpoint:
+		return "endpoint"
+	}
+	return "unknown"
+}
+
+// PeersSorted returns snapshots of the peers in the order given by by,
+// skipping the first offset of them and returning at most limit, or all the
+// others if limit is not positive.
+//
+// The device's lock is only held to list the peers, and each is snapshotted
+// on its own, so paging through many peers does not stall the device. Pages
+// sorted by public key are consistent across calls, missing only the peers
+// added or removed meanwhile, and only their peers are snapshotted; pages
+// sorted by the other keys may shift as the peers' state changes.
+func (device *Device) PeersSorted(by SortKey, offset, limit int) []PeerSnapshot {
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+
+	page := func(n int) (start, end int) {
+		start = min(max(offset, 0), n)
+		end = n
+		if limit > 0 {
+			end = min(start+limit, n)
+		}
+		return start, end
+	}
+
+	if by == SortByPublicKey {
+		type keyedPeer struct {
+			key  NoisePublicKey
+			peer *Peer
+		}
+		keyed := make([]keyedPeer, len(peers))
+		for i, peer := range peers {
+			keyed[i] = keyedPeer{peer.publicKey(), peer}
+		}
+		slices.SortFunc(keyed, func(a, b keyedPeer) int {
+			return bytes.Compare(a.key[:], b.key[:])
+		})
+		start, end := page(len(keyed))
+		snapshots := make([]PeerSnapshot, 0, end-start)
+		for _, p := range keyed[start:end] {
+			snapshots = append(snapshots, p.peer.snapshot())
+		}
+		return snapshots
+	}
+
+	snapshots := make([]PeerSnapshot, len(peers))
+	for i, peer := range peers {
+		snapshots[i] = peer.snapshot()
+	}
+	slices.SortFunc(snapshots, func(a, b PeerSnapshot) int {
+		var c int
+		switch by {
+		case SortByLastHandshake:
+			// The zero time of peers without one sorts last.
+			c = b.Stats.LastHandshake.Compare(a.Stats.LastHandshake)
+		case SortByRxBytes:
+			c = cmp.Compare(b.Stats.RxBytes, a.Stats.RxBytes)
+		case SortByTxBytes:
+			c = cmp.Compare(b.Stats.TxBytes, a.Stats.TxBytes)
+		case SortByEndpoint:
+			c = compareEndpoints(a.Endpoint, b.Endpoint)
+		}
+		if c != 0 {
+			return c
+		}
+		return bytes.Compare(a.PublicKey[:], b.PublicKey[:])
+	})
+	start, end := page(len(snapshots))
+	return slices.Clip(snapshots[start:end])
+}
+
+func (peer *Peer) snapshot() PeerSnapshot {
+	s := PeerSnapshot{
+		PublicKey: peer.publicKey(),
+		State:     peer.State(),
+		Stats: PeerStats{
+			RxBytes: peer.rxBytes.Load(),
+			TxBytes: peer.txBytes.Load(),
+		},
+	}
+	if nano := peer.lastHandshakeNano.Load(); nano != 0 {
+		s.Stats.LastHandshake = time.Unix(0, nano)
+	}
+	peer.endpoint.Lock()
+	if peer.endpoint.val != nil {
+		s.Endpoint = peer.endpoint.val.DstToString()
+	}
+	peer.endpoint.Unlock()
+	return s
+}
+
+// compareEndpoints orders endpoints by address and port if both are
+// addresses and ports, and as strings otherwise, with empty ones last.
+func compareEndpoints(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+	ap, errA := netip.ParseAddrPort(a)
+	bp, errB := netip.ParseAddrPort(b)
+	if errA == nil && errB == nil {
+		return ap.Compare(bp)
+	}
+	return strings.Compare(a, b)
+}
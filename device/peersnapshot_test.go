@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPeersSorted(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	addTestPeers(t, dev, 25)
+
+	// Paging by public key covers every peer once, in order.
+	var paged []PeerSnapshot
+	for offset := 0; ; offset += 10 {
+		page := dev.PeersSorted(SortByPublicKey, offset, 10)
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+	}
+	if len(paged) != 25 {
+		t.Fatalf("paged through %d peers, want 25", len(paged))
+	}
+	if !slices.IsSortedFunc(paged, func(a, b PeerSnapshot) int { return bytes.Compare(a.PublicKey[:], b.PublicKey[:]) }) {
+		t.Error("peers not sorted by public key")
+	}
+	if all := dev.PeersSorted(SortByPublicKey, 0, 0); !slices.Equal(all, paged) {
+		t.Error("peers paged through differ from all peers")
+	}
+	if page := dev.PeersSorted(SortByPublicKey, 30, 10); len(page) != 0 {
+		t.Errorf("%d peers past the last one", len(page))
+	}
+
+	// Traffic sorts the busiest peers first, the others by public key.
+	busy := dev.LookupPeer(paged[20].PublicKey)
+	busy.rxBytes.Add(100)
+	busier := dev.LookupPeer(paged[3].PublicKey)
+	busier.rxBytes.Add(200)
+	top := dev.PeersSorted(SortByRxBytes, 0, 4)
+	want := []NoisePublicKey{paged[3].PublicKey, paged[20].PublicKey, paged[0].PublicKey, paged[1].PublicKey}
+	for i := range want {
+		if top[i].PublicKey != want[i] {
+			t.Errorf("peer %d by rx bytes is %x, want %x", i, top[i].PublicKey[:4], want[i][:4])
+		}
+	}
+	if top[0].Stats.RxBytes != 200 {
+		t.Errorf("snapshot has %d rx bytes, want 200", top[0].Stats.RxBytes)
+	}
+
+	// Peers without an endpoint sort last.
+	if err := dev.IpcSet(uapiCfg("public_key", paged[10].PublicKey.Hex(), "endpoint", "192.0.2.1:51820")); err != nil {
+		t.Fatal(err)
+	}
+	if first := dev.PeersSorted(SortByEndpoint, 0, 1); first[0].PublicKey != paged[10].PublicKey || first[0].Endpoint != "192.0.2.1:51820" {
+		t.Errorf("first peer by endpoint %+v, want %x at 192.0.2.1:51820", first[0], paged[10].PublicKey[:4])
+	}
+}
+
+func TestIpcGetSortedByPublicKey(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	addTestPeers(t, dev, 10)
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, line := range strings.Split(cfg, "\n") {
+		if key, ok := strings.CutPrefix(line, "public_key="); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) != 10 || !slices.IsSorted(keys) {
+		t.Errorf("public keys %v, want 10 in order", keys)
+	}
+}
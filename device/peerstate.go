@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "time"
+
+// PeerState is the state of the connection to a peer, as returned by
+// Peer.State.
+type PeerState int32
+
+const (
+	// PeerNoContact means there is no session with the peer, and no
+	// handshake with it under way.
+	PeerNoContact PeerState = iota
+
+	// PeerConnecting means a handshake initiation was sent to the peer, and
+	// its response is awaited.
+	PeerConnecting
+
+	// PeerConnected means there is a session with the peer younger than
+	// RejectAfterTime.
+	PeerConnected
+
+	// PeerStale means there is a session with the peer, but nothing has
+	// arrived from it for longer than PeerStaleTimeout.
+	PeerStale
+
+	// PeerFailed means the handshake retries with the peer are exhausted,
+	// or it is in handshake backoff.
+	PeerFailed
+)
+
+// PeerStaleTimeout is how long a peer with a session may stay silent before
+// it is reported as PeerStale.
+const PeerStaleTimeout = KeepaliveTimeout * 3
+
+func (state PeerState) String() string {
+	switch state {
+	case PeerNoContact:
+		return "no_contact"
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerStale:
+		return "stale"
+	case PeerFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// peerStateInputs is what the state of a peer is derived from.
+type peerStateInputs struct {
+	session      time.Time // when the current keypair was created, zero if none
+	lastReceived time.Time // when an authenticated packet last arrived
+	initiating   bool      // whether an initiation awaits its response
+	failed       bool      // whether retries are exhausted or in backoff
+}
+
+// stateAt returns the state at now, and how long after now it changes
+// without any other event, or zero if it does not.
+func (in *peerStateInputs) stateAt(now time.Time) (PeerState, time.Duration) {
+	if !in.session.IsZero() {
+		if expiry := in.session.Add(RejectAfterTime); now.Before(expiry) {
+			heard := in.session
+			if in.lastReceived.After(heard) {
+				heard = in.lastReceived
+			}
+			if stale := heard.Add(PeerStaleTimeout); now.Before(stale) {
+				return PeerConnected, stale.Sub(now)
+			}
+			return PeerStale, expiry.Sub(now)
+		}
+	}
+	switch {
+	case in.failed:
+		return PeerFailed, 0
+	case in.initiating:
+		return PeerConnecting, 0
+	}
+	return PeerNoContact, 0
+}
+
+func (peer *Peer) stateInputs() peerStateInputs {
+	in := peerStateInputs{
+		initiating: peer.timers.retransmitHandshake != nil && peer.timers.retransmitHandshake.IsPending(),
+		failed:     peer.inHandshakeBackoff() || peer.timers.handshakeAttempts.Load() > MaxTimerHandshakes,
+	}
+	if keypair := peer.keypairs.Current(); keypair != nil {
+		in.session = keypair.created
+	}
+	if nano := peer.lastReceivedNano.Load(); nano != 0 {
+		in.lastReceived = time.Unix(0, nano)
+	}
+	return in
+}
+
+// State returns the state of the connection to the peer. Transitions between
+// states are reported by EventPeerStateChanged.
+func (peer *Peer) State() PeerState {
+	in := peer.stateInputs()
+	state, _ := in.stateAt(time.Now())
+	return state
+}
+
+// updateState reports a change of the peer's state, and schedules the next
+// check for one that happens with the passage of time. The event is emitted
+// under stateMu, so that concurrent changes are reported in the order they
+// are made.
+func (peer *Peer) updateState() {
+	peer.stateMu.Lock()
+	defer peer.stateMu.Unlock()
+	in := peer.stateInputs()
+	state, next := in.stateAt(time.Now())
+	if next > 0 && peer.timersActive() {
+		peer.timers.state.Mod(next)
+	}
+	if PeerState(peer.reportedState.Swap(int32(state))) != state {
+		peer.device.emitPeerStateChanged(peer, state)
+	}
+}
+
+func expiredState(peer *Peer) {
+	peer.updateState()
+}
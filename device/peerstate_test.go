@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerStateAt(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	tests := []struct {
+		name  string
+		in    peerStateInputs
+		now   time.Time
+		state PeerState
+		next  time.Duration
+	}{
+		{"fresh", peerStateInputs{}, start, PeerNoContact, 0},
+		{"initiating", peerStateInputs{initiating: true}, start, PeerConnecting, 0},
+		{"retries exhausted", peerStateInputs{initiating: true, failed: true}, start, PeerFailed, 0},
+		{"new session", peerStateInputs{session: start}, start, PeerConnected, PeerStaleTimeout},
+		{"heard recently", peerStateInputs{session: start, lastReceived: at(time.Minute)}, at(time.Minute + time.Second),
+			PeerConnected, PeerStaleTimeout - time.Second},
+		{"silent", peerStateInputs{session: start, lastReceived: at(time.Minute)}, at(time.Minute + PeerStaleTimeout),
+			PeerStale, RejectAfterTime - time.Minute - PeerStaleTimeout},
+		{"silent since session", peerStateInputs{session: start}, at(PeerStaleTimeout), PeerStale, RejectAfterTime - PeerStaleTimeout},
+		{"session outlives failure", peerStateInputs{session: start, failed: true}, start, PeerConnected, PeerStaleTimeout},
+		{"session expired", peerStateInputs{session: start, lastReceived: at(RejectAfterTime - time.Second)}, at(RejectAfterTime), PeerNoContact, 0},
+		{"session expired, rekeying", peerStateInputs{session: start, initiating: true}, at(RejectAfterTime), PeerConnecting, 0},
+	}
+	for _, tt := range tests {
+		state, next := tt.in.stateAt(tt.now)
+		if state != tt.state || next != tt.next {
+			t.Errorf("%s: stateAt = %v, %v; want %v, %v", tt.name, state, next, tt.state, tt.next)
+		}
+	}
+}
+
+func TestPeerStateEvents(t *testing.T) {
+	pair := genTestPair(t, false)
+	events := make(chan PeerState, 8)
+	// pair[1] sends the ping, and initiates the handshake.
+	pair[1].dev.SetEventHandler(func(event Event) {
+		if event.Type != EventPeerStateChanged {
+			return
+		}
+		select {
+		case events <- event.State:
+		default:
+		}
+	})
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	if state := peer.State(); state != PeerNoContact {
+		t.Fatalf("State() of a new peer = %v", state)
+	}
+	expect := func(want ...PeerState) {
+		t.Helper()
+		for _, state := range want {
+			select {
+			case got := <-events:
+				if got != state {
+					t.Errorf("state changed to %v, want %v", got, state)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no change to state %v", state)
+			}
+		}
+	}
+
+	pair.Send(t, Ping, nil)
+	expect(PeerConnecting, PeerConnected)
+	if state := peer.State(); state != PeerConnected {
+		t.Errorf("State() after a handshake = %v", state)
+	}
+
+	// Traffic from the peer does not repeat the event.
+	pair.Send(t, Pong, nil)
+	select {
+	case state := <-events:
+		t.Errorf("state changed to %v with the session up", state)
+	default:
+	}
+
+	// Losing the session, then exhausting the retries.
+	pair[1].dev.SetHandshakeBackoff(-1)
+	peer.ZeroAndFlushAll()
+	peer.timers.handshakeAttempts.Store(MaxTimerHandshakes + 1)
+	expiredRetransmitHandshake(peer)
+	expect(PeerNoContact, PeerFailed)
+	if state := peer.State(); state != PeerFailed {
+		t.Errorf("State() after the retries = %v", state)
+	}
+}
+
+func TestPeerStateEventsOrdered(t *testing.T) {
+	pair := genTestPair(t, false)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	pair[1].dev.SetHandshakeBackoff(-1)
+	var mu sync.Mutex
+	var states []PeerState
+	pair[1].dev.SetEventHandler(func(event Event) {
+		if event.Type == EventPeerStateChanged {
+			runtime.Gosched() // to let other updates overtake this one, if they can
+			mu.Lock()
+			states = append(states, event.State)
+			mu.Unlock()
+		}
+	})
+
+	// Concurrent updates flip the state between no contact and failed.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				peer.timers.handshakeAttempts.Store(uint32(j%2) * (MaxTimerHandshakes + 1))
+				peer.updateState()
+			}
+		}()
+	}
+	wg.Wait()
+	peer.updateState()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i < len(states); i++ {
+		if states[i] == states[i-1] {
+			t.Fatalf("state change %d to %v repeats the previous one", i, states[i])
+		}
+	}
+	if last := states[len(states)-1]; last != peer.State() {
+		t.Errorf("last state change to %v, but the state is %v", last, peer.State())
+	}
+}
@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"sync/atomic"
+)
+
+// A Verdict is the decision of a policy set by SetInboundPolicy or
+// SetOutboundPolicy on a packet.
+type Verdict int
+
+const (
+	// VerdictAccept lets the packet through as cryptokey routing decided.
+	VerdictAccept Verdict = iota
+
+	// VerdictDrop drops the packet.
+	VerdictDrop
+
+	// VerdictRedirect sends an outbound packet to another peer.
+	VerdictRedirect
+
+	verdictCount
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictAccept:
+		return "accept"
+	case VerdictDrop:
+		return "drop"
+	case VerdictRedirect:
+		return "redirect"
+	}
+	return "unknown"
+}
+
+// An InboundPolicy decides on a packet decrypted from peer, with the inner
+// source and destination addresses src and dst, and the protocol proto,
+// which is the next header field for IPv6. It may only return VerdictAccept
+// or VerdictDrop.
+type InboundPolicy func(peer NoisePublicKey, src, dst netip.Addr, proto uint8) Verdict
+
+// An OutboundPolicy decides on a packet read from the TUN device and routed
+// to peer. To send it to another peer instead, it returns VerdictRedirect
+// and the public key of that peer.
+type OutboundPolicy func(peer NoisePublicKey, src, dst netip.Addr, proto uint8) (Verdict, NoisePublicKey)
+
+type policies struct {
+	inbound          atomic.Pointer[InboundPolicy]
+	outbound         atomic.Pointer[OutboundPolicy]
+	inboundVerdicts  [verdictCount]atomic.Uint64
+	outboundVerdicts [verdictCount]atomic.Uint64
+	redirect         atomic.Pointer[policyRedirect] // the last peer redirected to
+}
+
+// policyRedirect is the peer of the public key the outbound policy last
+// redirected packets to, valid while the peers are of generation.
+type policyRedirect struct {
+	key        NoisePublicKey
+	peer       *Peer
+	generation uint64
+}
+
+// SetInboundPolicy has fn decide on every packet received from a peer once
+// it has passed the check of its source against the peer's allowed IPs,
+// replacing any previous policy. A nil fn removes the policy. fn is called
+// on the hot path, synchronously for each packet, so it must be fast and
+// must not block; without a policy, the check costs a single atomic load.
+func (device *Device) SetInboundPolicy(fn InboundPolicy) {
+	if fn == nil {
+		device.policies.inbound.Store(nil)
+		return
+	}
+	device.policies.inbound.Store(&fn)
+}
+
+// SetOutboundPolicy has fn decide on every packet read from the TUN device
+// once the peer to send it to has been looked up in the allowed IPs, like
+// SetInboundPolicy. A packet redirected to a peer that does not exist is
+// dropped, as DropPolicy.
+func (device *Device) SetOutboundPolicy(fn OutboundPolicy) {
+	if fn == nil {
+		device.policies.outbound.Store(nil)
+		return
+	}
+	device.policies.outbound.Store(&fn)
+}
+
+// InboundVerdicts returns the number of received packets the inbound policy
+// returned v for. Peer.InboundPolicyDrops counts the drops of each peer.
+func (device *Device) InboundVerdicts(v Verdict) uint64 {
+	if v < 0 || v >= verdictCount {
+		return 0
+	}
+	return device.policies.inboundVerdicts[v].Load()
+}
+
+// OutboundVerdicts returns the number of packets read from the TUN device
+// the outbound policy returned v for.
+func (device *Device) OutboundVerdicts(v Verdict) uint64 {
+	if v < 0 || v >= verdictCount {
+		return 0
+	}
+	return device.policies.outboundVerdicts[v].Load()
+}
+
+// admitInbound reports whether the inbound policy, if any, accepts packet,
+// a valid IP packet from peer.
+func (peer *Peer) admitInbound(packet []byte) bool {
+	fn := peer.device.policies.inbound.Load()
+	if fn == nil {
+		return true
+	}
+	src, dst, proto := packetHeader(packet)
+	v := (*fn)(peer.publicKey(), src, dst, proto)
+	if v != VerdictDrop {
+		v = VerdictAccept
+	} else {
+		peer.inboundPolicyDrops.Add(1)
+	}
+	peer.device.policies.inboundVerdicts[v].Add(1)
+	return v == VerdictAccept
+}
+
+// InboundPolicyDrops returns the number of packets received from the peer
+// that the inbound policy dropped.
+func (peer *Peer) InboundPolicyDrops() uint64 {
+	return peer.inboundPolicyDrops.Load()
+}
+
+// routeOutbound returns the peer the outbound policy, if any, sends packet
+// to, which was routed to peer, or nil if it is dropped.
+func (device *Device) routeOutbound(peer *Peer, packet []byte) *Peer {
+	fn := device.policies.outbound.Load()
+	if fn == nil {
+		return peer
+	}
+	src, dst, proto := packetHeader(packet)
+	v, pk := (*fn)(peer.publicKey(), src, dst, proto)
+	switch v {
+	case VerdictDrop:
+	case VerdictRedirect:
+		peer = device.redirectTarget(pk)
+	default:
+		v = VerdictAccept
+	}
+	device.policies.outboundVerdicts[v].Add(1)
+	if v == VerdictDrop || peer == nil {
+		device.dropOutbound(packet, DropPolicy)
+		return nil
+	}
+	return peer
+}
+
+// redirectTarget returns the peer with the public key pk, looking it up
+// only when the policy redirects to another peer than before, or the peers
+// changed since.
+func (device *Device) redirectTarget(pk NoisePublicKey) *Peer {
+	generation := device.peers.generation.Load()
+	if r := device.policies.redirect.Load(); r != nil && r.generation == generation && r.key == pk {
+		return r.peer
+	}
+	peer := device.LookupPeer(pk)
+	device.policies.redirect.Store(&policyRedirect{key: pk, peer: peer, generation: generation})
+	return peer
+}
+
+// packetHeader returns the addresses and protocol of an IP packet whose
+// header has been checked to be complete.
+func packetHeader(packet []byte) (src, dst netip.Addr, proto uint8) {
+	if packet[0]>>4 == 4 {
+		return netip.AddrFrom4([4]byte(packet[IPv4offsetSrc:])), netip.AddrFrom4([4]byte(packet[IPv4offsetDst:])), packet[9]
+	}
+	return netip.AddrFrom16([16]byte(packet[IPv6offsetSrc:])), netip.AddrFrom16([16]byte(packet[IPv6offsetDst:])), packet[6]
+}
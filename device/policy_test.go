@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+// waitCount waits for count to return n.
+func waitCount(t *testing.T, what string, count func() uint64, n uint64) {
+	t.Helper()
+	for start := time.Now(); count() != n; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%s: %d, want %d", what, count(), n)
+		}
+	}
+}
+
+func TestInboundPolicy(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	sender := pair[1].dev.staticIdentity.publicKey
+
+	type call struct {
+		peer     NoisePublicKey
+		src, dst netip.Addr
+		proto    uint8
+	}
+	calls := make(chan call, 16)
+	var verdict atomic.Int32
+	verdict.Store(int32(VerdictDrop))
+	dev.SetInboundPolicy(func(peer NoisePublicKey, src, dst netip.Addr, proto uint8) Verdict {
+		calls <- call{peer, src, dst, proto}
+		return Verdict(verdict.Load())
+	})
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	waitCount(t, "dropped", func() uint64 { return dev.InboundVerdicts(VerdictDrop) }, 1)
+	if n := dev.LookupPeer(sender).InboundPolicyDrops(); n != 1 {
+		t.Errorf("%d packets of the peer dropped, want 1", n)
+	}
+	want := call{sender, pair[1].ip, pair[0].ip, 1} // ICMP
+	if got := <-calls; got != want {
+		t.Errorf("policy called with %+v, want %+v", got, want)
+	}
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Error("dropped packet delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	verdict.Store(int32(VerdictAccept))
+	pair.Send(t, Ping, nil)
+	if n := dev.InboundVerdicts(VerdictAccept); n != 1 {
+		t.Errorf("%d packets accepted, want 1", n)
+	}
+
+	dev.SetInboundPolicy(nil)
+	pair.Send(t, Ping, nil)
+	if n := dev.InboundVerdicts(VerdictAccept); n != 1 {
+		t.Errorf("%d packets accepted after removing the policy, want 1", n)
+	}
+}
+
+func TestOutboundPolicyRedirect(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[1].dev
+	target := pair[0].dev.staticIdentity.publicKey
+
+	// A peer routed to but unreachable, whose packets are redirected.
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := sk.publicKey()
+	if err := dev.IpcSet(uapiCfg("public_key", unreachable.Hex(), "allowed_ip", "1.0.0.3/32")); err != nil {
+		t.Fatal(err)
+	}
+	var redirectTo atomic.Pointer[NoisePublicKey]
+	redirectTo.Store(&target)
+	dev.SetOutboundPolicy(func(peer NoisePublicKey, src, dst netip.Addr, proto uint8) (Verdict, NoisePublicKey) {
+		if peer == unreachable {
+			return VerdictRedirect, *redirectTo.Load()
+		}
+		return VerdictAccept, NoisePublicKey{}
+	})
+
+	msg := tuntest.Ping(netip.MustParseAddr("1.0.0.3"), pair[1].ip)
+	pair[1].tun.Outbound <- msg
+	select {
+	case got := <-pair[0].tun.Inbound:
+		if !bytes.Equal(got, msg) {
+			t.Error("redirected packet did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("redirected packet did not transit")
+	}
+	if n := dev.OutboundVerdicts(VerdictRedirect); n != 1 {
+		t.Errorf("%d packets redirected, want 1", n)
+	}
+	pair.Send(t, Ping, nil)
+	if n := dev.OutboundVerdicts(VerdictAccept); n != 1 {
+		t.Errorf("%d packets accepted, want 1", n)
+	}
+
+	// Packets redirected to a peer that does not exist are dropped.
+	redirectTo.Store(&NoisePublicKey{1})
+	pair[1].tun.Outbound <- msg
+	waitCount(t, "dropped by policy", func() uint64 { return dev.OutboundDrops(DropPolicy) }, 1)
+
+	// So are those redirected to a peer once it is removed.
+	redirectTo.Store(&target)
+	pair[1].tun.Outbound <- msg
+	select {
+	case <-pair[0].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("redirected packet did not transit")
+	}
+	dev.RemovePeer(target)
+	pair[1].tun.Outbound <- msg
+	waitCount(t, "dropped by policy", func() uint64 { return dev.OutboundDrops(DropPolicy) }, 2)
+}
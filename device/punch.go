@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+var errPunchUnsupported = errors.New("bind does not support punching")
+
+// LearnEndpoint sets the endpoint of the peer to one learned out of band,
+// such as the path conn.PunchBind.Punch opened to it, as if the peer had
+// reached the device from it, and initiates a handshake over it at once,
+// leaving any handshake backoff and skipping the handshake jitter. It takes effect even if roaming is
+// disabled, and expires like any learned endpoint under SetEndpointTTL.
+func (peer *Peer) LearnEndpoint(endpoint conn.Endpoint) {
+	peer.endpoint.Lock()
+	peer.endpoint.val = endpoint
+	peer.endpoint.learned = true
+	peer.endpoint.expired = false
+	peer.endpoint.clearSrcOnTx = false
+	peer.endpoint.Unlock()
+	if ttl := peer.device.endpointTTL.Load(); ttl > 0 && peer.timersActive() {
+		peer.timers.endpointTTL.Mod(time.Duration(ttl))
+	}
+	peer.device.log.Verbosef("%v - Learned endpoint %s", peer, endpoint.DstToString())
+
+	peer.endHandshakeBackoff()
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	peer.timers.handshakeAttempts.Store(0)
+	peer.sendHandshakeInitiation(false, true)
+}
+
+// Punch opens a path to the peer behind a NAT with the Punch method of the
+// device's bind, which must be a conn.PunchBind, reading the targets the
+// application's signaling tells from targets, and learns the path found as
+// the peer's endpoint with LearnEndpoint. The punched socket of the path a
+// previous Punch opened is closed, as it is when the peer is removed.
+func (peer *Peer) Punch(ctx context.Context, targets <-chan conn.PunchTarget, opts conn.PunchOptions) (conn.PunchResult, error) {
+	device := peer.device
+	device.net.RLock()
+	bind, ok := device.net.bind.(conn.PunchBind)
+	device.net.RUnlock()
+	if !ok {
+		return conn.PunchResult{}, errPunchUnsupported
+	}
+	result, err := bind.Punch(ctx, targets, opts)
+	if err != nil {
+		return conn.PunchResult{}, err
+	}
+	device.log.Verbosef("%v - Punched a path from %v to %v", peer, result.Local, result.Remote)
+	peer.unpunch()
+	peer.endpoint.Lock()
+	peer.endpoint.punched, peer.endpoint.punchedBy = result.Endpoint, bind
+	peer.endpoint.Unlock()
+	peer.LearnEndpoint(result.Endpoint)
+	return result, nil
+}
+
+// unpunch closes the punched socket of the path Punch last opened to the
+// peer, if any.
+func (peer *Peer) unpunch() {
+	peer.endpoint.Lock()
+	punched, bind := peer.endpoint.punched, peer.endpoint.punchedBy
+	peer.endpoint.punched, peer.endpoint.punchedBy = nil, nil
+	peer.endpoint.Unlock()
+	if punched != nil {
+		bind.Unpunch(punched)
+	}
+}
@@ -0,0 +1,56 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+func TestLearnEndpoint(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	handshake := peer.lastHandshakeNano.Load()
+
+	ep, err := dev.net.bind.ParseEndpoint(peer.endpoint.configured.DstToString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The initiation is not left to the handshake jitter.
+	if err := dev.SetHandshakeJitter(1); err != nil {
+		t.Fatal(err)
+	}
+	peer.LearnEndpoint(ep)
+	if peer.timers.delayedInitiation.IsPending() {
+		t.Error("initiation over the learned endpoint delayed by the jitter")
+	}
+	peer.endpoint.Lock()
+	learned := peer.endpoint.val == ep && peer.endpoint.learned
+	peer.endpoint.Unlock()
+	if !learned {
+		t.Fatal("endpoint not learned")
+	}
+	// The handshake initiated over the endpoint completes.
+	deadline := time.Now().Add(5 * time.Second)
+	for peer.lastHandshakeNano.Load() == handshake {
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake over the learned endpoint")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pair.Send(t, Ping, nil)
+
+	// The channel binds do not punch.
+	if _, err := peer.Punch(context.Background(), nil, conn.PunchOptions{}); !errors.Is(err, errPunchUnsupported) {
+		t.Errorf("Punch over a channel bind: %v", err)
+	}
+}
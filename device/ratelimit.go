@@ -0,0 +1,54 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+
+	"github.com/darkit/wireguard/ratelimiter"
+)
+
+// SetRatelimitExempt replaces the list of source prefixes whose handshake
+// messages are never rate limited while the device is under load, such as
+// those of trusted monitoring hosts.
+func (device *Device) SetRatelimitExempt(prefixes []netip.Prefix) {
+	device.rate.limiter.SetExempt(prefixes)
+}
+
+// RatelimitExempt returns the source prefixes exempt from handshake rate
+// limiting, along with the number of handshake messages each let through
+// while the device was under load.
+func (device *Device) RatelimitExempt() (prefixes []netip.Prefix, hits []uint64) {
+	return device.rate.limiter.Exempt()
+}
+
+// SetRatelimitRates sets the number of handshake messages per second allowed
+// from a single IPv4 or IPv6 source address while the device is under load.
+// Zero selects the default of 20.
+func (device *Device) SetRatelimitRates(v4, v6 int) {
+	device.rate.limiter.SetPacketsPerSecond(v4, v6)
+}
+
+// SetRatelimitAbusePolicy sets when a source whose handshake messages keep
+// being rate limited is considered abusive, and for how long it is then
+// banned, its messages dropped before any other work. Only messages dropped
+// while the device is under load count toward abuse.
+func (device *Device) SetRatelimitAbusePolicy(policy ratelimiter.AbusePolicy) {
+	device.rate.limiter.SetAbusePolicy(policy)
+}
+
+// OnRatelimitAbuse registers fn to be called when a source becomes abusive
+// under the policy set by SetRatelimitAbusePolicy, such as to have a firewall
+// ban it for longer. fn is called from the handshake goroutines, so it must
+// not block; see ratelimiter.Ratelimiter.OnSustainedAbuse.
+func (device *Device) OnRatelimitAbuse(fn func(addr netip.Addr, droppedInWindow uint64)) {
+	device.rate.limiter.OnSustainedAbuse(fn)
+}
+
+// RatelimitBans returns the sources currently banned for abuse.
+func (device *Device) RatelimitBans() []ratelimiter.Ban {
+	return device.rate.limiter.Bans()
+}
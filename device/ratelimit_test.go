@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/ratelimiter"
+)
+
+func TestRatelimitExemptUAPI(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	if err := dev.IpcSet(uapiCfg(
+		"ratelimit_exempt", "192.0.2.0/24",
+		"ratelimit_exempt", "2001:db8::/32",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "ratelimit_exempt=192.0.2.0/24\nratelimit_exempt=2001:db8::/32\n") {
+		t.Errorf("exemptions missing from IpcGet output:\n%s", cfg)
+	}
+
+	dev.rate.limiter.Allow(netip.MustParseAddr("192.0.2.7"))
+	out, err := dev.IpcDebug("ratelimit_exempt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ratelimit_exempt=192.0.2.0/24\nhits=1\nratelimit_exempt=2001:db8::/32\nhits=0\n"; out != want {
+		t.Errorf("debug output = %q, want %q", out, want)
+	}
+
+	if err := dev.IpcSet(uapiCfg(
+		"replace_ratelimit_exempt", "true",
+		"ratelimit_exempt", "10.0.0.0/8",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if prefixes, _ := dev.RatelimitExempt(); len(prefixes) != 1 || prefixes[0] != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Errorf("exemptions after replacing = %v, want [10.0.0.0/8]", prefixes)
+	}
+}
+
+func TestRatelimitBans(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	var abused []netip.Addr
+	dev.OnRatelimitAbuse(func(addr netip.Addr, droppedInWindow uint64) {
+		abused = append(abused, addr)
+	})
+	dev.SetRatelimitAbusePolicy(ratelimiter.AbusePolicy{Drops: 10, Window: time.Minute, BanDuration: time.Hour})
+	src := netip.MustParseAddr("192.0.2.7")
+	for i := 0; i < 20; i++ {
+		dev.rate.limiter.Allow(src)
+	}
+	if len(abused) != 1 || abused[0] != src {
+		t.Fatalf("abusive sources %v, want [%v]", abused, src)
+	}
+
+	out, err := dev.IpcDebug("ratelimit_bans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans := dev.RatelimitBans()
+	if len(bans) != 1 {
+		t.Fatalf("bans %+v, want one", bans)
+	}
+	want := fmt.Sprintf("ratelimit_ban=192.0.2.7\nexpires_sec=%d\ndrops=10\ndenied=%d\n", bans[0].Expires.Unix(), bans[0].Denied)
+	if out != want {
+		t.Errorf("debug output = %q, want %q", out, want)
+	}
+}
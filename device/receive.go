@@ -20,10 +20,11 @@ import (
 )
 
 type QueueHandshakeElement struct {
-	msgType  uint32
-	packet   []byte
-	endpoint conn.Endpoint
-	buffer   *[MaxMessageSize]byte
+	msgType     uint32
+	packet      []byte
+	endpoint    conn.Endpoint
+	buffer      *[MaxMessageSize]byte
+	established bool // queued as the handshake of an established peer
 }
 
 type QueueInboundElement struct {
@@ -113,7 +114,9 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-			device.log.Verbosef("Failed to receive %s packet: %v", recvName, err)
+			if device.log.Verbose() {
+				device.log.Verbosef("Failed to receive %s packet: %v", recvName, err)
+			}
 			if neterr, ok := err.(net.Error); ok && !neterr.Temporary() {
 				return
 			}
@@ -129,26 +132,22 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 		// handle each packet in the batch
 		for i, size := range sizes[:count] {
 			if size < MinMessageSize {
+				device.dropMalformed(MalformedTooShort, size, endpoints[i])
 				continue
 			}
 
-			// check size of packet
+			// check size of packet for its type
 
 			packet := bufsArrs[i][:size]
 			msgType := binary.LittleEndian.Uint32(packet[:4])
-
-			switch msgType {
+			if reason, ok := checkDatagram(msgType, size); !ok {
+				device.dropMalformed(reason, size, endpoints[i])
+				continue
+			}
 
 			// check if transport
 
-			case MessageTransportType:
-
-				// check size
-
-				if len(packet) < MessageTransportSize {
-					continue
-				}
-
+			if msgType == MessageTransportType {
 				// lookup key pair
 
 				receiver := binary.LittleEndian.Uint32(
@@ -185,36 +184,31 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 				bufsArrs[i] = device.GetMessageBuffer()
 				bufs[i] = bufsArrs[i][:]
 				continue
+			}
 
 			// otherwise it is a fixed size & handshake related packet
 
-			case MessageInitiationType:
-				if len(packet) != MessageInitiationSize {
-					continue
-				}
-
-			case MessageResponseType:
-				if len(packet) != MessageResponseSize {
-					continue
-				}
-
-			case MessageCookieReplyType:
-				if len(packet) != MessageCookieReplySize {
-					continue
-				}
-
-			default:
-				device.log.Verbosef("Received message with unknown type")
-				continue
-			}
-
-			select {
-			case device.queue.handshake.c <- QueueHandshakeElement{
+			elem := QueueHandshakeElement{
 				msgType:  msgType,
 				buffer:   bufsArrs[i],
 				packet:   packet,
 				endpoint: endpoints[i],
-			}:
+			}
+			if device.IsUnderLoad() && device.isEstablishedHandshake(msgType, packet, endpoints[i]) {
+				elem.established = true
+				select {
+				case device.queue.handshake.priority <- elem:
+					bufsArrs[i] = device.GetMessageBuffer()
+					bufs[i] = bufsArrs[i][:]
+					continue
+				default:
+				}
+			}
+			// Without room in the priority queue, established peers are
+			// checked like any other.
+			elem.established = false
+			select {
+			case device.queue.handshake.c <- elem:
 				bufsArrs[i] = device.GetMessageBuffer()
 				bufs[i] = bufsArrs[i][:]
 			default:
@@ -276,156 +270,188 @@ func (device *Device) RoutineHandshake(id int) {
 	}()
 	device.log.Verbosef("Routine: handshake worker %d - started", id)
 
-	for elem := range device.queue.handshake.c {
+	for {
+		elem, ok := device.queue.handshake.next()
+		if !ok {
+			return
+		}
 
-		// handle cookie fields and ratelimiting
+		device.handleHandshake(&elem)
+		setZero(elem.packet)
+		device.PutMessageBuffer(elem.buffer)
+	}
+}
 
-		switch elem.msgType {
+// handleHandshake handles a message from the handshake queue. The caller
+// returns its buffer.
+func (device *Device) handleHandshake(elem *QueueHandshakeElement) {
+	// handle cookie fields and ratelimiting
 
-		case MessageCookieReplyType:
+	switch elem.msgType {
 
-			// unmarshal packet
+	case MessageCookieReplyType:
 
-			var reply MessageCookieReply
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &reply)
-			if err != nil {
-				device.log.Verbosef("Failed to decode cookie reply")
-				goto skip
-			}
+		// unmarshal packet
 
-			// lookup peer from index
+		var reply MessageCookieReply
+		reader := bytes.NewReader(elem.packet)
+		err := binary.Read(reader, binary.LittleEndian, &reply)
+		if err != nil {
+			device.log.Verbosef("Failed to decode cookie reply")
+			return
+		}
 
-			entry := device.indexTable.Lookup(reply.Receiver)
+		// lookup peer from index
 
-			if entry.peer == nil {
-				goto skip
-			}
+		entry := device.indexTable.Lookup(reply.Receiver)
+
+		if entry.peer == nil {
+			return
+		}
 
-			// consume reply
+		// consume reply
 
-			if peer := entry.peer; peer.isRunning.Load() {
+		if peer := entry.peer; peer.isRunning.Load() {
+			if device.log.Verbose() {
 				device.log.Verbosef("Receiving cookie response from %s", elem.endpoint.DstToString())
-				if !peer.cookieGenerator.ConsumeReply(&reply) {
-					device.log.Verbosef("Could not decrypt invalid cookie response")
-				}
 			}
+			if !peer.cookieGenerator.ConsumeReply(&reply) {
+				device.log.Verbosef("Could not decrypt invalid cookie response")
+			}
+		}
 
-			goto skip
+		return
 
-		case MessageInitiationType, MessageResponseType:
+	case MessageInitiationType, MessageResponseType:
 
-			// check mac fields and maybe ratelimit
+		// check mac fields and maybe ratelimit
 
-			if !device.cookieChecker.CheckMAC1(elem.packet) {
-				device.log.Verbosef("Received packet with invalid mac1")
-				goto skip
+		if !device.cookieChecker.CheckMAC1(elem.packet) {
+			device.log.Verbosef("Received packet with invalid mac1")
+			if elem.msgType == MessageInitiationType {
+				device.auditUnknownInitiation(elem.endpoint, UnknownInitiationInvalidMAC1, nil)
 			}
+			return
+		}
 
-			// endpoints destination address is the source of the datagram
+		// endpoints destination address is the source of the datagram
 
-			if device.IsUnderLoad() {
+		if device.IsUnderLoad() {
 
-				// verify MAC2 field
+			// verify MAC2 field, unless the message is a response to an
+			// initiation the device sent, which would otherwise be delayed
+			// until its retry; the ratelimiter still bounds the work done for
+			// it. Initiations of established peers are only served first, as
+			// their source address is no proof of where they come from
 
-				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
-					device.SendHandshakeCookie(&elem)
-					goto skip
-				}
+			if !(elem.established && elem.msgType == MessageResponseType) && !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+				device.SendHandshakeCookie(elem)
+				return
+			}
 
-				// check ratelimiter
+			// check ratelimiter
 
-				if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
-					goto skip
-				}
+			if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+				return
 			}
-
-		default:
-			device.log.Errorf("Invalid packet ended up in the handshake queue")
-			goto skip
 		}
 
-		// handle handshake initiation/response content
+	default:
+		device.log.Errorf("Invalid packet ended up in the handshake queue")
+		return
+	}
 
-		switch elem.msgType {
-		case MessageInitiationType:
+	// handle handshake initiation/response content
 
-			// unmarshal
+	switch elem.msgType {
+	case MessageInitiationType:
 
-			var msg MessageInitiation
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
-			if err != nil {
-				device.log.Errorf("Failed to decode initiation message")
-				goto skip
-			}
+		// unmarshal
+
+		var msg MessageInitiation
+		reader := bytes.NewReader(elem.packet)
+		err := binary.Read(reader, binary.LittleEndian, &msg)
+		if err != nil {
+			device.log.Errorf("Failed to decode initiation message")
+			return
+		}
 
-			// consume initiation
+		// consume initiation
 
-			peer := device.ConsumeMessageInitiation(&msg)
-			if peer == nil {
+		peer, claimed, decrypted := device.consumeMessageInitiation(&msg)
+		if peer == nil {
+			if device.log.Verbose() {
 				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
-				goto skip
 			}
+			if !decrypted {
+				device.auditUnknownInitiation(elem.endpoint, UnknownInitiationUndecryptable, nil)
+			} else if device.LookupPeer(claimed) == nil {
+				device.auditUnknownInitiation(elem.endpoint, UnknownInitiationUnknownPeer, &claimed)
+			}
+			return
+		}
 
-			// update timers
+		// update timers
 
-			peer.timersAnyAuthenticatedPacketTraversal()
-			peer.timersAnyAuthenticatedPacketReceived()
+		peer.timersAnyAuthenticatedPacketTraversal()
+		peer.timersAnyAuthenticatedPacketReceived()
 
-			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+		// update endpoint
+		peer.SetEndpointFromPacket(elem.endpoint)
 
+		if device.log.Verbose() {
 			device.log.Verbosef("%v - Received handshake initiation", peer)
-			peer.rxBytes.Add(uint64(len(elem.packet)))
+		}
+		peer.rxBytes.Add(uint64(len(elem.packet)))
 
-			peer.SendHandshakeResponse()
+		peer.SendHandshakeResponse()
 
-		case MessageResponseType:
+	case MessageResponseType:
 
-			// unmarshal
+		// unmarshal
 
-			var msg MessageResponse
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
-			if err != nil {
-				device.log.Errorf("Failed to decode response message")
-				goto skip
-			}
+		var msg MessageResponse
+		reader := bytes.NewReader(elem.packet)
+		err := binary.Read(reader, binary.LittleEndian, &msg)
+		if err != nil {
+			device.log.Errorf("Failed to decode response message")
+			return
+		}
 
-			// consume response
+		// consume response
 
-			peer := device.ConsumeMessageResponse(&msg)
-			if peer == nil {
+		peer := device.ConsumeMessageResponse(&msg)
+		if peer == nil {
+			if device.log.Verbose() {
 				device.log.Verbosef("Received invalid response message from %s", elem.endpoint.DstToString())
-				goto skip
 			}
+			return
+		}
 
-			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+		// update endpoint
+		peer.SetEndpointFromPacket(elem.endpoint)
 
+		if device.log.Verbose() {
 			device.log.Verbosef("%v - Received handshake response", peer)
-			peer.rxBytes.Add(uint64(len(elem.packet)))
-
-			// update timers
+		}
+		peer.rxBytes.Add(uint64(len(elem.packet)))
 
-			peer.timersAnyAuthenticatedPacketTraversal()
-			peer.timersAnyAuthenticatedPacketReceived()
+		// update timers
 
-			// derive keypair
+		peer.timersAnyAuthenticatedPacketTraversal()
+		peer.timersAnyAuthenticatedPacketReceived()
 
-			err = peer.BeginSymmetricSession()
-			if err != nil {
-				device.log.Errorf("%v - Failed to derive keypair: %v", peer, err)
-				goto skip
-			}
+		// derive keypair
 
-			peer.timersSessionDerived()
-			peer.timersHandshakeComplete()
-			peer.SendKeepalive()
+		err = peer.BeginSymmetricSession()
+		if err != nil {
+			device.log.Errorf("%v - Failed to derive keypair: %v", peer, err)
+			return
 		}
-	skip:
-		device.PutMessageBuffer(elem.buffer)
+
+		peer.timersSessionDerived()
+		peer.timersHandshakeComplete()
+		peer.SendKeepalive()
 	}
 }
 
@@ -438,11 +464,33 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 	device.log.Verbosef("%v - Routine: sequential receiver - started", peer)
 
 	bufs := make([][]byte, 0, maxBatchSize)
+	var packets [][]byte                  // those of one message
+	var unstacked []*[MaxMessageSize]byte // buffers of the packets of stacked messages
+	pk := peer.publicKey()
+	var reorder *reorderBuffer
+	defer func() { reorder.discard() }()
 
-	for elemsContainer := range peer.queue.inbound.c {
+	for {
+		var elemsContainer *QueueInboundElementsContainer
+		select {
+		case elemsContainer = <-peer.queue.inbound.c:
+		case <-reorder.expired():
+			bufs = reorder.flush(bufs)
+			peer.writeInbound(bufs)
+			reorder.release()
+			bufs = bufs[:0]
+			continue
+		}
 		if elemsContainer == nil {
 			return
 		}
+		depth, delay := device.ReorderBuffer()
+		if depth > 0 && reorder == nil {
+			reorder = newReorderBuffer(device)
+		} else if depth == 0 && reorder != nil {
+			bufs = reorder.flush(bufs)
+			reorder.keypair = nil
+		}
 		elemsContainer.Lock()
 		validTailPacket := -1
 		dataPacketReceived := false
@@ -456,6 +504,8 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 			if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
 				continue
 			}
+			expected := elem.keypair.noteReceived(elem.counter)
+			peer.noteOrder(elem.counter, expected)
 
 			validTailPacket = i
 			if peer.ReceivedWithKeypair(elem.keypair) {
@@ -465,52 +515,34 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 			}
 			rxBytesLen += uint64(len(elem.packet) + MinMessageSize)
 
+			packets = packets[:0]
 			if len(elem.packet) == 0 {
-				device.log.Verbosef("%v - Receiving keepalive packet", peer)
-				continue
-			}
-			dataPacketReceived = true
-
-			switch elem.packet[0] >> 4 {
-			case 4:
-				if len(elem.packet) < ipv4.HeaderLen {
-					continue
+				if device.log.Verbose() {
+					device.log.Verbosef("%v - Receiving keepalive packet", peer)
 				}
-				field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
-				length := binary.BigEndian.Uint16(field)
-				if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
-					continue
-				}
-				elem.packet = elem.packet[:length]
-				src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
-				if device.allowedips.Lookup(src) != peer {
-					device.log.Verbosef("IPv4 packet with disallowed source address from %v", peer)
-					continue
+			} else if isStacked(elem.packet) && peer.stackedTransport.Load() {
+				dataPacketReceived = true
+				var buf *[MaxMessageSize]byte
+				if packets, buf = peer.unstackInbound(elem, packets); buf != nil {
+					unstacked = append(unstacked, buf)
 				}
-
-			case 6:
-				if len(elem.packet) < ipv6.HeaderLen {
-					continue
-				}
-				field := elem.packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
-				length := binary.BigEndian.Uint16(field)
-				length += ipv6.HeaderLen
-				if int(length) > len(elem.packet) {
-					continue
-				}
-				elem.packet = elem.packet[:length]
-				src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
-				if device.allowedips.Lookup(src) != peer {
-					device.log.Verbosef("IPv6 packet with disallowed source address from %v", peer)
-					continue
+			} else {
+				dataPacketReceived = true
+				if packet, ok := peer.admitPacket(elem.packet); ok {
+					peer.countRXSize(len(packet))
+					if mirror := device.mirroring(); mirror != nil {
+						device.mirrorPacket(mirror, MirrorInbound, pk, packet)
+					}
+					packets = append(packets, elem.buffer[:MessageTransportOffsetContent+len(packet)])
 				}
-
-			default:
-				device.log.Verbosef("Packet with invalid IP version from %v", peer)
-				continue
 			}
-
-			bufs = append(bufs, elem.buffer[:MessageTransportOffsetContent+len(elem.packet)])
+			if depth > 0 {
+				// Keepalives and dropped packets take their place in the
+				// counter order too.
+				bufs = reorder.push(bufs, elem.keypair, elem.counter, expected, packets, depth, delay)
+			} else {
+				bufs = append(bufs, packets...)
+			}
 		}
 
 		peer.rxBytes.Add(rxBytesLen)
@@ -519,16 +551,20 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 			peer.keepKeyFreshReceiving()
 			peer.timersAnyAuthenticatedPacketTraversal()
 			peer.timersAnyAuthenticatedPacketReceived()
+			peer.timersTransportReceived()
 		}
 		if dataPacketReceived {
 			peer.timersDataReceived()
 		}
-		if len(bufs) > 0 {
-			_, err := device.tun.device.Write(bufs, MessageTransportOffsetContent)
-			if err != nil && !device.isClosed() {
-				device.log.Errorf("Failed to write packets to TUN device: %v", err)
-			}
+		peer.writeInbound(bufs)
+		if reorder != nil {
+			reorder.release()
 		}
+		for i, buf := range unstacked {
+			device.PutMessageBuffer(buf)
+			unstacked[i] = nil
+		}
+		unstacked = unstacked[:0]
 		for _, elem := range elemsContainer.elems {
 			device.PutMessageBuffer(elem.buffer)
 			device.PutInboundElement(elem)
@@ -537,3 +573,64 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 		device.PutInboundElementsContainer(elemsContainer)
 	}
 }
+
+// admitPacket checks the IP header of a decrypted packet, and returns the
+// packet trimmed to its length, and whether it may be written to the TUN
+// device.
+func (peer *Peer) admitPacket(packet []byte) ([]byte, bool) {
+	device := peer.device
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < ipv4.HeaderLen {
+			return nil, false
+		}
+		field := packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
+		length := binary.BigEndian.Uint16(field)
+		if int(length) > len(packet) || int(length) < ipv4.HeaderLen {
+			return nil, false
+		}
+		packet = packet[:length]
+		src := packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
+		if !peer.admitsSource(src) {
+			device.dropDisallowedSource(peer, src)
+			return nil, false
+		}
+
+	case 6:
+		if len(packet) < ipv6.HeaderLen {
+			return nil, false
+		}
+		field := packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
+		length := binary.BigEndian.Uint16(field)
+		length += ipv6.HeaderLen
+		if int(length) > len(packet) {
+			return nil, false
+		}
+		packet = packet[:length]
+		src := packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
+		if !peer.admitsSource(src) {
+			device.dropDisallowedSource(peer, src)
+			return nil, false
+		}
+
+	default:
+		if device.log.Verbose() {
+			device.log.Verbosef("Packet with invalid IP version from %v", peer)
+		}
+		return nil, false
+	}
+	return packet, peer.admitInbound(packet)
+}
+
+// writeInbound writes the packets in bufs, with their headroom, to the TUN
+// device.
+func (peer *Peer) writeInbound(bufs [][]byte) {
+	if len(bufs) == 0 {
+		return
+	}
+	device := peer.device
+	_, err := device.tun.device.Write(bufs, MessageTransportOffsetContent)
+	if err != nil && !device.isClosed() {
+		device.log.Errorf("Failed to write packets to TUN device: %v", err)
+	}
+}
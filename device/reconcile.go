@@ -0,0 +1,276 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// Config is the desired peer configuration of a device, for Reconcile.
+// Settings of the device itself, such as its private key and port, are not
+// part of it and are left alone.
+type Config struct {
+	Peers []PeerConfig
+
+	// DryRun makes Reconcile only compute the changes, without applying them.
+	DryRun bool
+}
+
+// PeerConfig is the desired configuration of a peer.
+type PeerConfig struct {
+	PublicKey    NoisePublicKey
+	PresharedKey NoisePresharedKey
+
+	// Endpoint is where to send to the peer, in the form the bind parses,
+	// such as "192.0.2.1:51820". If empty, the peer's endpoint is left as
+	// it is, including one it roamed to.
+	Endpoint string
+
+	// PersistentKeepaliveInterval is truncated to whole seconds; zero
+	// disables persistent keepalives.
+	PersistentKeepaliveInterval time.Duration
+
+	AllowedIPs []netip.Prefix
+}
+
+// ChangeSet describes the differences between the running state of a device
+// and a Config, as applied by Reconcile.
+type ChangeSet struct {
+	Added   []NoisePublicKey // peers created, in Config order
+	Removed []NoisePublicKey // peers removed, sorted
+	Updated []PeerChange     // existing peers changed, in Config order
+}
+
+// PeerChange describes the changes to an existing peer.
+type PeerChange struct {
+	PublicKey           NoisePublicKey
+	PresharedKey        bool
+	Endpoint            bool
+	PersistentKeepalive bool
+	AddedAllowedIPs     []netip.Prefix
+	RemovedAllowedIPs   []netip.Prefix
+}
+
+// Empty reports whether the ChangeSet changes nothing.
+func (changes ChangeSet) Empty() bool {
+	return len(changes.Added) == 0 && len(changes.Removed) == 0 && len(changes.Updated) == 0
+}
+
+func (change *PeerChange) empty() bool {
+	return !change.PresharedKey && !change.Endpoint && !change.PersistentKeepalive &&
+		len(change.AddedAllowedIPs) == 0 && len(change.RemovedAllowedIPs) == 0
+}
+
+// reconcilePeer is a peer of a Config, validated, and the peer it applies to
+// if it exists.
+type reconcilePeer struct {
+	config     *PeerConfig
+	peer       *Peer
+	endpoint   conn.Endpoint // nil if the Config leaves the endpoint alone
+	keepalive  uint32
+	allowedIPs []netip.Prefix
+	change     PeerChange
+}
+
+// Reconcile makes the peers of the device match target, changing only what
+// differs: peers absent from target are removed, missing ones are created,
+// and the preshared key, endpoint, persistent keepalive interval and allowed
+// IPs of the others are updated in place, keeping their sessions. It returns
+// the changes; if target.DryRun is set, it only computes them.
+//
+// Invalid configs fail, changing nothing. If applying fails, such as on
+// exceeding a limit set by SetLimits, the changes made before are kept, and
+// the returned ChangeSet is the full set Reconcile tried to apply.
+func (device *Device) Reconcile(target Config) (ChangeSet, error) {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	var changes ChangeSet
+	peers, err := device.reconcileDiff(target, &changes)
+	if err != nil || target.DryRun {
+		return changes, err
+	}
+
+	for _, pk := range changes.Removed {
+		device.log.Verbosef("Reconcile: Removing peer %v", pk.Base64())
+		device.RemovePeer(pk)
+	}
+	for i := range peers {
+		if err := device.reconcileApply(&peers[i]); err != nil {
+			device.log.Errorf("Reconcile: %v", err)
+			return changes, err
+		}
+	}
+	device.warnRoutingLoops()
+	return changes, nil
+}
+
+// reconcileDiff validates target and compares it with the running state,
+// filling in changes.
+func (device *Device) reconcileDiff(target Config, changes *ChangeSet) ([]reconcilePeer, error) {
+	device.staticIdentity.RLock()
+	self := device.staticIdentity.publicKey
+	device.staticIdentity.RUnlock()
+
+	peers := make([]reconcilePeer, len(target.Peers))
+	wanted := make(map[NoisePublicKey]bool, len(target.Peers))
+	for i := range target.Peers {
+		config := &target.Peers[i]
+		p := &peers[i]
+		p.config = config
+		if config.PublicKey.Equals(self) {
+			return nil, fmt.Errorf("%w: peer %v", ErrOwnKey, config.PublicKey.Base64())
+		}
+		if config.PublicKey.isLowOrder() {
+			return nil, fmt.Errorf("%w: peer %v", ErrLowOrderKey, config.PublicKey.Base64())
+		}
+		if wanted[config.PublicKey] {
+			return nil, fmt.Errorf("%w: peer %v appears twice", ErrInvalidKey, config.PublicKey.Base64())
+		}
+		wanted[config.PublicKey] = true
+
+		if config.Endpoint != "" {
+			device.net.RLock()
+			endpoint, err := device.net.bind.ParseEndpoint(config.Endpoint)
+			device.net.RUnlock()
+			if err != nil {
+				if !errors.Is(err, ErrInvalidEndpoint) {
+					err = fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
+				}
+				return nil, fmt.Errorf("peer %v: %w", config.PublicKey.Base64(), err)
+			}
+			p.endpoint = endpoint
+		}
+		secs := config.PersistentKeepaliveInterval / time.Second
+		if secs < 0 || secs > math.MaxUint16 {
+			return nil, fmt.Errorf("peer %v: persistent keepalive interval %v out of range", config.PublicKey.Base64(), config.PersistentKeepaliveInterval)
+		}
+		p.keepalive = uint32(secs)
+		for _, prefix := range config.AllowedIPs {
+			if !prefix.IsValid() {
+				return nil, fmt.Errorf("peer %v: %w", config.PublicKey.Base64(), ErrInvalidAllowedIP)
+			}
+			if prefix = prefix.Masked(); !slices.Contains(p.allowedIPs, prefix) {
+				p.allowedIPs = append(p.allowedIPs, prefix)
+			}
+		}
+
+		p.peer = device.LookupPeer(config.PublicKey)
+		if p.peer == nil {
+			changes.Added = append(changes.Added, config.PublicKey)
+			continue
+		}
+		p.change = p.peer.reconcileDiff(p)
+		if !p.change.empty() {
+			changes.Updated = append(changes.Updated, p.change)
+		}
+	}
+
+	device.peers.RLock()
+	for pk := range device.peers.keyMap {
+		if !wanted[pk] {
+			changes.Removed = append(changes.Removed, pk)
+		}
+	}
+	device.peers.RUnlock()
+	slices.SortFunc(changes.Removed, func(a, b NoisePublicKey) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return peers, nil
+}
+
+// reconcileDiff compares the peer with p.
+func (peer *Peer) reconcileDiff(p *reconcilePeer) PeerChange {
+	change := PeerChange{PublicKey: p.config.PublicKey}
+
+	peer.handshake.mutex.RLock()
+	change.PresharedKey = peer.handshake.presharedKey != p.config.PresharedKey
+	peer.handshake.mutex.RUnlock()
+
+	if p.endpoint != nil {
+		peer.endpoint.Lock()
+		change.Endpoint = peer.endpoint.val == nil || peer.endpoint.val.DstToString() != p.endpoint.DstToString()
+		peer.endpoint.Unlock()
+	}
+
+	change.PersistentKeepalive = peer.persistentKeepaliveInterval.Load() != p.keepalive
+
+	current := peer.AllowedIPs()
+	for _, prefix := range p.allowedIPs {
+		if !slices.Contains(current, prefix) {
+			change.AddedAllowedIPs = append(change.AddedAllowedIPs, prefix)
+		}
+	}
+	for _, prefix := range current {
+		if !slices.Contains(p.allowedIPs, prefix) {
+			change.RemovedAllowedIPs = append(change.RemovedAllowedIPs, prefix)
+		}
+	}
+	return change
+}
+
+// reconcileApply creates or updates the peer of p.
+func (device *Device) reconcileApply(p *reconcilePeer) error {
+	peer := p.peer
+	created := peer == nil
+	if created {
+		var err error
+		peer, err = device.NewPeer(p.config.PublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to create peer %v: %w", p.config.PublicKey.Base64(), err)
+		}
+		device.log.Verbosef("%v - Reconcile: Created", peer)
+		p.change = PeerChange{
+			PresharedKey:        true,
+			Endpoint:            p.endpoint != nil,
+			PersistentKeepalive: true,
+			AddedAllowedIPs:     p.allowedIPs,
+		}
+	} else if !p.change.empty() {
+		device.log.Verbosef("%v - Reconcile: Updating", peer)
+	}
+
+	if p.change.PresharedKey {
+		peer.handshake.mutex.Lock()
+		peer.handshake.presharedKey = p.config.PresharedKey
+		peer.handshake.mutex.Unlock()
+	}
+	if p.change.Endpoint {
+		peer.endpoint.Lock()
+		peer.setConfiguredEndpoint(p.endpoint)
+		if created {
+			peer.endpoint.disableRoaming = device.net.brokenRoaming
+		}
+		peer.endpoint.Unlock()
+	}
+	pkaOn := false
+	if p.change.PersistentKeepalive {
+		pkaOn = peer.persistentKeepaliveInterval.Swap(p.keepalive) == 0 && p.keepalive != 0
+	}
+	if len(p.change.AddedAllowedIPs) != 0 || len(p.change.RemovedAllowedIPs) != 0 {
+		if err := device.ReplaceAllowedIPs(p.config.PublicKey, p.allowedIPs); err != nil {
+			return fmt.Errorf("failed to set allowed IPs of %v: %w", peer, err)
+		}
+	}
+
+	if device.isUp() {
+		peer.Start()
+		peer.refreshKeepaliveOffload()
+		if pkaOn {
+			peer.SendKeepalive()
+		}
+		peer.SendStagedPackets()
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func randNoisePublicKey(t *testing.T) NoisePublicKey {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk.publicKey()
+}
+
+func TestReconcile(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	a, b, c := randNoisePublicKey(t), randNoisePublicKey(t), randNoisePublicKey(t)
+	config := Config{Peers: []PeerConfig{
+		{
+			PublicKey:                   a,
+			Endpoint:                    "127.0.0.1:1000",
+			PersistentKeepaliveInterval: 25 * time.Second,
+			AllowedIPs:                  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.1.1/24")},
+		},
+		{
+			PublicKey:    b,
+			PresharedKey: NoisePresharedKey{1},
+			AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("10.0.2.1/32")},
+		},
+	}}
+	changes, err := device.Reconcile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ChangeSet{Added: []NoisePublicKey{a, b}}); !reflect.DeepEqual(changes, want) {
+		t.Errorf("first Reconcile = %+v, want %+v", changes, want)
+	}
+	if changes, err := device.Reconcile(config); err != nil || !changes.Empty() {
+		t.Errorf("second Reconcile = %+v, %v; want no changes", changes, err)
+	}
+
+	// A peer added behind Reconcile's back is removed, and only what differs
+	// is updated.
+	if err := device.IpcSet(uapiCfg("public_key", c.Hex())); err != nil {
+		t.Fatal(err)
+	}
+	aPeer := device.LookupPeer(a)
+	config.Peers = []PeerConfig{config.Peers[0]}
+	config.Peers[0].Endpoint = "127.0.0.1:1001"
+	config.Peers[0].PresharedKey = NoisePresharedKey{2}
+	config.Peers[0].AllowedIPs = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.3.0/24")}
+	want := ChangeSet{
+		Removed: []NoisePublicKey{b, c},
+		Updated: []PeerChange{{
+			PublicKey:         a,
+			PresharedKey:      true,
+			Endpoint:          true,
+			AddedAllowedIPs:   []netip.Prefix{netip.MustParsePrefix("10.0.3.0/24")},
+			RemovedAllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")},
+		}},
+	}
+	if string(b[:]) > string(c[:]) {
+		want.Removed[0], want.Removed[1] = c, b
+	}
+
+	config.DryRun = true
+	changes, err = device.Reconcile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("dry run Reconcile = %+v, want %+v", changes, want)
+	}
+	if device.LookupPeer(b) == nil || device.LookupPeer(c) == nil || device.LookupAllowedIP(netip.MustParseAddr("10.0.3.1")) != nil {
+		t.Error("dry run Reconcile changed the device")
+	}
+
+	config.DryRun = false
+	changes, err = device.Reconcile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("third Reconcile = %+v, want %+v", changes, want)
+	}
+	if changes, err := device.Reconcile(config); err != nil || !changes.Empty() {
+		t.Errorf("fourth Reconcile = %+v, %v; want no changes", changes, err)
+	}
+	if device.LookupPeer(a) != aPeer {
+		t.Error("Reconcile replaced an updated peer")
+	}
+	if device.LookupPeer(b) != nil || device.LookupPeer(c) != nil {
+		t.Error("Reconcile did not remove peers absent from the config")
+	}
+	if peer := device.LookupAllowedIP(netip.MustParseAddr("10.0.3.1")); peer != aPeer {
+		t.Errorf("10.0.3.1 routed to %v, want %v", peer, aPeer)
+	}
+
+	// An empty endpoint leaves a roamed endpoint alone.
+	config.Peers[0].Endpoint = ""
+	if changes, err := device.Reconcile(config); err != nil || !changes.Empty() {
+		t.Errorf("Reconcile without endpoint = %+v, %v; want no changes", changes, err)
+	}
+}
+
+func TestReconcileInvalid(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	a := randNoisePublicKey(t)
+	if _, err := device.Reconcile(Config{Peers: []PeerConfig{{PublicKey: a}}}); err != nil {
+		t.Fatal(err)
+	}
+	b := randNoisePublicKey(t)
+	for _, test := range []struct {
+		name  string
+		peers []PeerConfig
+		want  error
+	}{
+		{"duplicate peer", []PeerConfig{{PublicKey: b}, {PublicKey: b}}, ErrInvalidKey},
+		{"own key", []PeerConfig{{PublicKey: device.staticIdentity.publicKey}}, ErrInvalidKey},
+		{"endpoint", []PeerConfig{{PublicKey: b, Endpoint: "nowhere"}}, ErrInvalidEndpoint},
+		{"allowed IP", []PeerConfig{{PublicKey: b, AllowedIPs: []netip.Prefix{{}}}}, ErrInvalidAllowedIP},
+		{"keepalive", []PeerConfig{{PublicKey: b, PersistentKeepaliveInterval: 24 * time.Hour}}, nil},
+	} {
+		_, err := device.Reconcile(Config{Peers: test.peers})
+		if err == nil || test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: Reconcile = %v, want %v", test.name, err, test.want)
+		}
+		if device.LookupPeer(a) == nil || device.LookupPeer(b) != nil {
+			t.Errorf("%s: failed Reconcile changed the peers", test.name)
+		}
+	}
+}
+
+func TestReconcileKeepsSession(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+
+	dev := pair[0].dev
+	pk := pair[1].dev.staticIdentity.publicKey
+	peer := dev.LookupPeer(pk)
+	keypair := peer.keypairs.Current()
+	if keypair == nil {
+		t.Fatal("no session after ping")
+	}
+
+	changes, err := dev.Reconcile(Config{Peers: []PeerConfig{{
+		PublicKey:                   pk,
+		PersistentKeepaliveInterval: 10 * time.Second,
+		AllowedIPs:                  []netip.Prefix{netip.MustParsePrefix("1.0.0.2/32"), netip.MustParsePrefix("10.0.0.0/8")},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ChangeSet{Updated: []PeerChange{{
+		PublicKey:           pk,
+		PersistentKeepalive: true,
+		AddedAllowedIPs:     []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Reconcile = %+v, want %+v", changes, want)
+	}
+	if dev.LookupPeer(pk) != peer || peer.keypairs.Current() != keypair {
+		t.Error("Reconcile dropped the session of an updated peer")
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/darkit/wireguard/conn/relay"
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+// TestRelay connects two devices that only know each other by public key,
+// with no direct endpoint, through a relay server.
+func TestRelay(t *testing.T) {
+	var server relay.Server
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.ServeUDP(pc)
+	go server.ServeTCP(ln)
+
+	for _, tt := range []struct {
+		network, address string
+	}{
+		{"udp", pc.LocalAddr().String()},
+		{"tcp", ln.Addr().String()},
+	} {
+		t.Run(tt.network, func(t *testing.T) {
+			var (
+				keys [2]NoisePrivateKey
+				tuns [2]*tuntest.ChannelTUN
+				ips  [2]netip.Addr
+			)
+			for i := range keys {
+				var err error
+				if keys[i], err = NewPrivateKey(); err != nil {
+					t.Fatal(err)
+				}
+				ips[i] = netip.AddrFrom4([4]byte{1, 0, 0, byte(i + 1)})
+			}
+			for i := range keys {
+				pub, peer := keys[i].PublicKey(), keys[i^1].PublicKey()
+				tuns[i] = tuntest.NewChannelTUN()
+				bind := conn.NewRelayBind(conn.NewStdNetBind(), relay.Key(pub), tt.network, tt.address)
+				dev := NewDevice(tuns[i].TUN(), bind, NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i)))
+				t.Cleanup(dev.Close)
+				if err := dev.IpcSet(uapiCfg(
+					"private_key", keys[i].Hex(),
+					"listen_port", "0",
+					"public_key", peer.Hex(),
+					"endpoint", "relay:"+hex.EncodeToString(peer[:]),
+					"allowed_ip", ips[i^1].String()+"/32",
+				)); err != nil {
+					t.Fatal(err)
+				}
+				if err := dev.Up(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Registrations are asynchronous; don't let a handshake
+			// initiation overtake them.
+			for i := range keys {
+				for deadline := time.Now().Add(5 * time.Second); !server.Registered(relay.Key(keys[i].PublicKey())); time.Sleep(time.Millisecond) {
+					if time.Now().After(deadline) {
+						t.Fatalf("dev%d did not register with the relay", i)
+					}
+				}
+			}
+
+			for i := range tuns {
+				msg := tuntest.Ping(ips[i^1], ips[i])
+				tuns[i].Outbound <- msg
+				select {
+				case got := <-tuns[i^1].Inbound:
+					if !bytes.Equal(got, msg) {
+						t.Errorf("dev%d received a different packet than dev%d sent", i^1, i)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("packet from dev%d not delivered through the relay", i)
+				}
+			}
+		})
+	}
+}
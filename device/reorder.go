@@ -0,0 +1,206 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// Limits of SetReorderBuffer.
+const (
+	MaxReorderDepth = 64
+	MaxReorderDelay = 5 * time.Millisecond
+)
+
+// SetReorderBuffer makes the device restore the order of the packets
+// received from each peer before writing them to the TUN device, which
+// helps TCP over underlays that reorder packets, such as multiple paths.
+// Packets that arrive ahead of a missing one are held, up to depth of them
+// and for at most delay, capped at MaxReorderDepth and MaxReorderDelay,
+// after which the missing packets are given up on. Packets arriving after
+// that are written at once. A depth of zero, the default, disables the
+// buffer, and packets are written in the order they arrive.
+func (device *Device) SetReorderBuffer(depth int, delay time.Duration) {
+	depth = min(max(depth, 0), MaxReorderDepth)
+	delay = min(max(delay, 0), MaxReorderDelay)
+	if delay == 0 {
+		depth = 0
+	}
+	device.reorder.Store(uint64(depth)<<32 | uint64(delay))
+}
+
+// ReorderBuffer returns the depth and delay set by SetReorderBuffer.
+func (device *Device) ReorderBuffer() (depth int, delay time.Duration) {
+	v := device.reorder.Load()
+	return int(v >> 32), time.Duration(uint32(v))
+}
+
+// OutOfOrder returns how many packets from the peer arrived after one of a
+// higher counter, and the sum of how far their counters were behind the
+// highest one received.
+func (peer *Peer) OutOfOrder() (packets, distance uint64) {
+	return peer.outOfOrder.Load(), peer.outOfOrderDistance.Load()
+}
+
+// noteOrder counts the packet with counter as out of order if it is behind
+// the counter expected.
+func (peer *Peer) noteOrder(counter, expected uint64) {
+	if counter < expected {
+		peer.outOfOrder.Add(1)
+		peer.outOfOrderDistance.Add(expected - 1 - counter)
+	}
+}
+
+// A reorderBuffer restores the counter order of the packets of a keypair,
+// as the sequential receiver of a peer writes them to the TUN device. It is
+// used by that goroutine only.
+type reorderBuffer struct {
+	device   *Device
+	keypair  *Keypair
+	next     uint64        // counter of the next packet to write
+	held     []reorderSlot // packets ahead of next, by counter
+	timer    *time.Timer
+	armed    bool
+	released []*[MaxMessageSize]byte // buffers of packets written, to put back after the write
+}
+
+// A reorderSlot holds the packets of a message, copied into buf each with
+// the headroom of a message buffer, or if buf is nil, a counter with no
+// packet to write, such as a keepalive's.
+type reorderSlot struct {
+	counter uint64
+	buf     *[MaxMessageSize]byte
+	packets [][]byte
+}
+
+func newReorderBuffer(device *Device) *reorderBuffer {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &reorderBuffer{device: device, timer: timer}
+}
+
+// expired returns a channel that receives once the oldest held packet has
+// been held long enough, or nil if none is held.
+func (rb *reorderBuffer) expired() <-chan time.Time {
+	if rb == nil || !rb.armed {
+		return nil
+	}
+	return rb.timer.C
+}
+
+// push adds the packets with counter of keypair, slices of message buffers
+// starting with their headroom, or none if there is nothing to write, and
+// appends the packets now in order to bufs. expected is the counter the
+// keypair expected before the packet, as returned by Keypair.noteReceived.
+func (rb *reorderBuffer) push(bufs [][]byte, keypair *Keypair, counter, expected uint64, packets [][]byte, depth int, delay time.Duration) [][]byte {
+	if keypair != rb.keypair {
+		// Packets of the previous and current keypairs may interleave
+		// around a rekey; only those of one are held at a time.
+		bufs = rb.flush(bufs)
+		rb.keypair = keypair
+		rb.next = expected
+	}
+	switch {
+	case counter < rb.next:
+		// Given up on, or a duplicate the replay filter let through.
+		return append(bufs, packets...)
+	case counter == rb.next:
+		bufs = append(bufs, packets...)
+		rb.next++
+		return rb.drain(bufs)
+	}
+
+	slot := reorderSlot{counter: counter}
+	if len(packets) > 0 {
+		slot.buf = rb.device.GetMessageBuffer()
+		n := 0
+		for _, packet := range packets {
+			end := n + copy((*slot.buf)[n:], packet)
+			slot.packets = append(slot.packets, (*slot.buf)[n:end:end])
+			n = end
+		}
+	}
+	i, _ := slices.BinarySearchFunc(rb.held, counter, func(s reorderSlot, c uint64) int {
+		return cmp.Compare(s.counter, c)
+	})
+	rb.held = slices.Insert(rb.held, i, slot)
+	for len(rb.held) > depth {
+		rb.next = rb.held[0].counter
+		bufs = rb.drain(bufs)
+	}
+	if len(rb.held) > 0 && !rb.armed {
+		rb.timer.Reset(delay)
+		rb.armed = true
+	}
+	return bufs
+}
+
+// drain appends the held packets that are next in order to bufs.
+func (rb *reorderBuffer) drain(bufs [][]byte) [][]byte {
+	n := 0
+	for n < len(rb.held) && rb.held[n].counter == rb.next {
+		bufs = rb.write(bufs, rb.held[n])
+		rb.next++
+		n++
+	}
+	rb.held = slices.Delete(rb.held, 0, n)
+	if len(rb.held) == 0 {
+		rb.disarm()
+	}
+	return bufs
+}
+
+// flush appends all held packets to bufs, giving up on the missing ones.
+func (rb *reorderBuffer) flush(bufs [][]byte) [][]byte {
+	for _, slot := range rb.held {
+		bufs = rb.write(bufs, slot)
+		rb.next = slot.counter + 1
+	}
+	rb.held = rb.held[:0]
+	rb.disarm()
+	return bufs
+}
+
+func (rb *reorderBuffer) write(bufs [][]byte, slot reorderSlot) [][]byte {
+	if slot.buf == nil {
+		return bufs
+	}
+	rb.released = append(rb.released, slot.buf)
+	return append(bufs, slot.packets...)
+}
+
+func (rb *reorderBuffer) disarm() {
+	if rb.armed {
+		rb.timer.Stop()
+		rb.armed = false
+	}
+}
+
+// release puts back the buffers of the packets written.
+func (rb *reorderBuffer) release() {
+	for i, buf := range rb.released {
+		rb.device.PutMessageBuffer(buf)
+		rb.released[i] = nil
+	}
+	rb.released = rb.released[:0]
+}
+
+// discard drops the held packets.
+func (rb *reorderBuffer) discard() {
+	if rb == nil {
+		return
+	}
+	rb.release()
+	for _, slot := range rb.held {
+		if slot.buf != nil {
+			rb.device.PutMessageBuffer(slot.buf)
+		}
+	}
+	rb.held = nil
+	rb.disarm()
+}
@@ -0,0 +1,214 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+// reorderTest feeds a reorderBuffer packets of synthetic counters, as the
+// sequential receiver does.
+type reorderTest struct {
+	rb   *reorderBuffer
+	bufs [][]byte
+}
+
+// push adds the packet of keypair with counter, carrying label, or nothing
+// to write if keepalive is set.
+func (rt *reorderTest) push(keypair *Keypair, counter, label uint64, keepalive bool, depth int) {
+	var packets [][]byte
+	if !keepalive {
+		packet := make([]byte, MessageTransportOffsetContent+8)
+		binary.BigEndian.PutUint64(packet[MessageTransportOffsetContent:], label)
+		packets = append(packets, packet)
+	}
+	expected := keypair.noteReceived(counter)
+	rt.bufs = rt.rb.push(rt.bufs, keypair, counter, expected, packets, depth, time.Millisecond)
+}
+
+// written returns the labels of the packets written since the last call.
+func (rt *reorderTest) written() []uint64 {
+	labels := make([]uint64, len(rt.bufs))
+	for i, buf := range rt.bufs {
+		labels[i] = binary.BigEndian.Uint64(buf[MessageTransportOffsetContent:])
+	}
+	rt.bufs = rt.bufs[:0]
+	rt.rb.release()
+	return labels
+}
+
+func TestReorderBuffer(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	for _, tt := range []struct {
+		name       string
+		depth      int
+		start      uint64 // highest counter received before, plus one
+		counters   []uint64
+		keepalives []uint64 // counters, among counters, with nothing to write
+		want       []uint64 // written as they arrive
+		held       []uint64 // written once the delay expired
+	}{
+		{"in order", 4, 0, []uint64{0, 1, 2, 3}, nil, []uint64{0, 1, 2, 3}, nil},
+		{"swapped", 4, 0, []uint64{0, 2, 1, 3}, nil, []uint64{0, 1, 2, 3}, nil},
+		{"reversed", 4, 0, []uint64{3, 2, 1, 0}, nil, []uint64{0, 1, 2, 3}, nil},
+		{"keepalive", 4, 0, []uint64{0, 2, 1, 3}, []uint64{1}, []uint64{0, 2, 3}, nil},
+		{"gap", 4, 0, []uint64{0, 2, 3}, nil, []uint64{0}, []uint64{2, 3}},
+		{"gap beyond depth", 2, 0, []uint64{0, 2, 4, 6}, nil, []uint64{0, 2}, []uint64{4, 6}},
+		{"late after gap", 1, 0, []uint64{0, 2, 3, 1}, nil, []uint64{0, 2, 3, 1}, nil},
+		{"mid-session", 4, 1000, []uint64{1000, 1002, 1001}, nil, []uint64{1000, 1001, 1002}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &reorderTest{rb: newReorderBuffer(device)}
+			defer rt.rb.discard()
+			keypair := new(Keypair)
+			keypair.receiveNonce.Store(tt.start)
+			for _, counter := range tt.counters {
+				rt.push(keypair, counter, counter, slices.Contains(tt.keepalives, counter), tt.depth)
+			}
+			if got := rt.written(); !slices.Equal(got, tt.want) {
+				t.Errorf("written %v, want %v", got, tt.want)
+			}
+
+			if tt.held == nil {
+				if rt.rb.expired() != nil {
+					t.Error("packets held")
+				}
+				return
+			}
+			select {
+			case <-rt.rb.expired():
+				rt.bufs = rt.rb.flush(rt.bufs)
+			case <-time.After(time.Second):
+				t.Fatal("held packets not written after the delay")
+			}
+			if got := rt.written(); !slices.Equal(got, tt.held) {
+				t.Errorf("written after the delay %v, want %v", got, tt.held)
+			}
+			if rt.rb.expired() != nil {
+				t.Error("timer armed with nothing held")
+			}
+		})
+	}
+}
+
+func TestReorderBufferRekey(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	rt := &reorderTest{rb: newReorderBuffer(device)}
+	defer rt.rb.discard()
+
+	previous, current := new(Keypair), new(Keypair)
+	previous.receiveNonce.Store(900)
+	rt.push(previous, 900, 1, false, 4)
+	rt.push(current, 1, 3, false, 4) // held until the keypair changes
+	rt.push(previous, 902, 4, false, 4)
+	rt.push(current, 0, 2, false, 4)
+	rt.push(current, 2, 5, false, 4)
+	if got, want := rt.written(), []uint64{1, 3, 4, 2, 5}; !slices.Equal(got, want) {
+		t.Errorf("written %v, want %v", got, want)
+	}
+	if rt.rb.expired() != nil {
+		t.Error("packets held")
+	}
+}
+
+func TestSequentialReceiverReorder(t *testing.T) {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+	device.SetPrivateKey(sk)
+	peerKey, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := device.IpcSet(uapiCfg(
+		"listen_port", "0",
+		"public_key", peerKey.publicKey().Hex(),
+		"allowed_ip", "10.0.0.0/24",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Up(); err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(peerKey.publicKey())
+	ep, err := device.net.bind.ParseEndpoint("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := netip.MustParseAddr("10.0.1.1")
+
+	// receive hands the sequential receiver decrypted packets with counters,
+	// each from source 10.0.0.100 + counter.
+	keypair := new(Keypair)
+	receive := func(counters ...uint64) {
+		container := device.GetInboundElementsContainer()
+		for _, counter := range counters {
+			elem := device.GetInboundElement()
+			elem.buffer = device.GetMessageBuffer()
+			src := netip.AddrFrom4([4]byte{10, 0, 0, 100 + byte(counter)})
+			n := copy(elem.buffer[MessageTransportOffsetContent:], tuntest.Ping(dst, src))
+			elem.packet = elem.buffer[MessageTransportOffsetContent : MessageTransportOffsetContent+n]
+			elem.counter = counter
+			elem.keypair = keypair
+			elem.endpoint = ep
+			container.elems = append(container.elems, elem)
+		}
+		peer.queue.inbound.c <- container
+	}
+	expect := func(counters ...uint64) {
+		t.Helper()
+		for _, counter := range counters {
+			select {
+			case packet := <-tun.Inbound:
+				if got := uint64(packet[15]) - 100; got != counter {
+					t.Fatalf("wrote packet %d, want %d", got, counter)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("packet %d not written", counter)
+			}
+		}
+	}
+
+	// Disabled, packets are written as they arrive.
+	receive(0, 2, 1)
+	expect(0, 2, 1)
+	if packets, distance := peer.OutOfOrder(); packets != 1 || distance != 1 {
+		t.Errorf("OutOfOrder() = %d, %d, want 1, 1", packets, distance)
+	}
+
+	device.SetReorderBuffer(8, MaxReorderDelay)
+	receive(3, 5)
+	receive(6, 4)
+	expect(3, 4, 5, 6)
+
+	// Packets after a missing one are held for the delay at most.
+	start := time.Now()
+	receive(8, 9)
+	expect(8, 9)
+	if held := time.Since(start); held < MaxReorderDelay {
+		t.Errorf("packets after a gap written after %v, before the delay", held)
+	}
+	receive(7)
+	expect(7)
+
+	if packets, distance := peer.OutOfOrder(); packets != 3 || distance != 1+2+2 {
+		t.Errorf("OutOfOrder() = %d, %d, want 3, 5", packets, distance)
+	}
+}
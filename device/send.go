@@ -86,7 +86,9 @@ func (peer *Peer) SendKeepalive() {
 		elemsContainer.elems = append(elemsContainer.elems, elem)
 		select {
 		case peer.queue.staged <- elemsContainer:
-			peer.device.log.Verbosef("%v - Sending keepalive packet", peer)
+			if peer.device.log.Verbose() {
+				peer.device.log.Verbosef("%v - Sending keepalive packet", peer)
+			}
 		default:
 			peer.device.PutMessageBuffer(elem.buffer)
 			peer.device.PutOutboundElement(elem)
@@ -97,10 +99,26 @@ func (peer *Peer) SendKeepalive() {
 }
 
 func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
+	return peer.sendHandshakeInitiation(isRetry, false)
+}
+
+// sendHandshakeInitiation is SendHandshakeInitiation, where delayed is set
+// if the handshake jitter delayed the initiation already.
+func (peer *Peer) sendHandshakeInitiation(isRetry, delayed bool) error {
 	if !isRetry {
 		peer.timers.handshakeAttempts.Store(0)
 	}
 
+	// Passive peers wait to be contacted; staged packets go out once they have.
+	if !peer.canInitiate() {
+		return nil
+	}
+
+	// Peers in handshake backoff get a single initiation per interval.
+	if peer.handshakeBackoffPending() {
+		return nil
+	}
+
 	peer.handshake.mutex.RLock()
 	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
 		peer.handshake.mutex.RUnlock()
@@ -108,6 +126,10 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	}
 	peer.handshake.mutex.RUnlock()
 
+	if !isRetry && !delayed && peer.delayInitiation() {
+		return nil
+	}
+
 	peer.handshake.mutex.Lock()
 	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
 		peer.handshake.mutex.Unlock()
@@ -116,7 +138,9 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	peer.handshake.lastSentHandshake = time.Now()
 	peer.handshake.mutex.Unlock()
 
-	peer.device.log.Verbosef("%v - Sending handshake initiation", peer)
+	if peer.device.log.Verbose() {
+		peer.device.log.Verbosef("%v - Sending handshake initiation", peer)
+	}
 
 	msg, err := peer.device.CreateMessageInitiation(peer)
 	if err != nil {
@@ -147,7 +171,9 @@ func (peer *Peer) SendHandshakeResponse() error {
 	peer.handshake.lastSentHandshake = time.Now()
 	peer.handshake.mutex.Unlock()
 
-	peer.device.log.Verbosef("%v - Sending handshake response", peer)
+	if peer.device.log.Verbose() {
+		peer.device.log.Verbosef("%v - Sending handshake response", peer)
+	}
 
 	response, err := peer.device.CreateMessageResponse(peer)
 	if err != nil {
@@ -180,7 +206,9 @@ func (peer *Peer) SendHandshakeResponse() error {
 }
 
 func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
-	device.log.Verbosef("Sending cookie response for denied handshake message for %v", initiatingElem.endpoint.DstToString())
+	if device.log.Verbose() {
+		device.log.Verbosef("Sending cookie response for denied handshake message for %v", initiatingElem.endpoint.DstToString())
+	}
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
 	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
@@ -193,7 +221,9 @@ func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement)
 	writer := bytes.NewBuffer(buf[:0])
 	binary.Write(writer, binary.LittleEndian, reply)
 	// TODO: allocation could be avoided
+	device.net.RLock()
 	device.net.bind.Send([][]byte{writer.Bytes()}, initiatingElem.endpoint)
+	device.net.RUnlock()
 	return nil
 }
 
@@ -202,8 +232,8 @@ func (peer *Peer) keepKeyFreshSending() {
 	if keypair == nil {
 		return
 	}
-	nonce := keypair.sendNonce.Load()
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	_, rekeyAfterMessages := peer.rekeyAfter()
+	if keypair.sendNonce.Load() > rekeyAfterMessages || peer.rekeyDue(keypair, time.Now()) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
@@ -275,6 +305,14 @@ func (device *Device) RoutineReadFromTUN() {
 			}
 
 			if peer == nil {
+				device.dropOutbound(elem.packet, DropNoRoute)
+				continue
+			}
+			if device.isRoutingLoop(elem.packet) {
+				device.dropOutbound(elem.packet, DropRoutingLoop)
+				continue
+			}
+			if peer = device.routeOutbound(peer, elem.packet); peer == nil {
 				continue
 			}
 			elemsForPeer, ok := elemsByPeer[peer]
@@ -293,6 +331,7 @@ func (device *Device) RoutineReadFromTUN() {
 				peer.SendStagedPackets()
 			} else {
 				for _, elem := range elemsForPeer.elems {
+					device.dropOutbound(elem.packet, DropPeerDown)
 					device.PutMessageBuffer(elem.buffer)
 					device.PutOutboundElement(elem)
 				}
@@ -306,7 +345,9 @@ func (device *Device) RoutineReadFromTUN() {
 				// TODO: record stat for this
 				// This will happen if MSS is surprisingly small (< 576)
 				// coincident with reasonably high throughput.
-				device.log.Verbosef("Dropped some packets from multi-segment read: %v", readErr)
+				if device.log.Verbose() {
+					device.log.Verbosef("Dropped some packets from multi-segment read: %v", readErr)
+				}
 				continue
 			}
 			if !device.isClosed() {
@@ -329,7 +370,14 @@ func (peer *Peer) StagePackets(elems *QueueOutboundElementsContainer) {
 		}
 		select {
 		case tooOld := <-peer.queue.staged:
+			reason := DropHandshakeQueueFull
+			peer.endpoint.Lock()
+			if peer.endpoint.val == nil {
+				reason = DropPeerNoEndpoint
+			}
+			peer.endpoint.Unlock()
 			for _, elem := range tooOld.elems {
+				peer.device.dropOutbound(elem.packet, reason)
 				peer.device.PutMessageBuffer(elem.buffer)
 				peer.device.PutOutboundElement(elem)
 			}
@@ -355,6 +403,14 @@ top:
 		var elemsContainerOOO *QueueOutboundElementsContainer
 		select {
 		case elemsContainer := <-peer.queue.staged:
+			if peer.stackedTransport.Load() {
+				elemsContainer.elems = peer.stackPackets(elemsContainer.elems)
+			}
+			mirror := peer.device.mirroring()
+			var pk NoisePublicKey
+			if mirror != nil {
+				pk = peer.publicKey()
+			}
 			i := 0
 			for _, elem := range elemsContainer.elems {
 				elem.peer = peer
@@ -370,6 +426,11 @@ top:
 					elemsContainer.elems[i] = elem
 					i++
 				}
+				if mirror != nil && len(elem.packet) > 0 {
+					eachPacket(elem.packet, func(packet []byte) {
+						peer.device.mirrorPacket(mirror, MirrorOutbound, pk, packet)
+					})
+				}
 
 				elem.keypair = keypair
 			}
@@ -388,9 +449,10 @@ top:
 			// add to parallel and sequential queue
 			if peer.isRunning.Load() {
 				peer.queue.outbound.c <- elemsContainer
-				peer.device.queue.encryption.c <- elemsContainer
+				peer.device.queue.encryption.push(peer, elemsContainer)
 			} else {
 				for _, elem := range elemsContainer.elems {
+					peer.device.dropOutbound(elem.packet, DropPeerDown)
 					peer.device.PutMessageBuffer(elem.buffer)
 					peer.device.PutOutboundElement(elem)
 				}
@@ -448,7 +510,11 @@ func (device *Device) RoutineEncryption(id int) {
 	defer device.log.Verbosef("Routine: encryption worker %d - stopped", id)
 	device.log.Verbosef("Routine: encryption worker %d - started", id)
 
-	for elemsContainer := range device.queue.encryption.c {
+	for {
+		elemsContainer, ok := device.queue.encryption.next()
+		if !ok {
+			return
+		}
 		for _, elem := range elemsContainer.elems {
 			// populate header fields
 			header := elem.buffer[:MessageTransportHeaderSize]
@@ -461,6 +527,12 @@ func (device *Device) RoutineEncryption(id int) {
 			binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
 			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
+			if len(elem.packet) > 0 {
+				eachPacket(elem.packet, func(packet []byte) {
+					elem.peer.countTXSize(len(packet))
+				})
+			}
+
 			// pad content to multiple of 16
 			paddingSize := calculatePaddingSize(len(elem.packet), int(device.tun.mtu.Load()))
 			elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
@@ -532,7 +604,9 @@ func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
 		if err != nil {
 			var errGSO conn.ErrUDPGSODisabled
 			if errors.As(err, &errGSO) {
-				device.log.Verbosef(err.Error())
+				if device.log.Verbose() {
+					device.log.Verbosef(err.Error())
+				}
 				err = errGSO.RetryErr
 			}
 		}
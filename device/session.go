@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultSessionMargin and DefaultSessionMarginMessages are how far
+	// ahead of RejectAfterTime and RejectAfterMessages sessions are renewed
+	// by default, as the protocol specifies. They are also the least margins
+	// SetSessionMargins accepts.
+	DefaultSessionMargin         = RejectAfterTime - RekeyAfterTime
+	DefaultSessionMarginMessages = RejectAfterMessages - RekeyAfterMessages
+
+	// MaxSessionMargin and MaxSessionMarginMessages are the most margins
+	// SetSessionMargins accepts, which still let a session live as long as
+	// the last-minute handshake ahead of RejectAfterTime allows for, and
+	// carry a million messages.
+	MaxSessionMargin         = RejectAfterTime - KeepaliveTimeout - RekeyTimeout
+	MaxSessionMarginMessages = RejectAfterMessages - 1<<20
+
+	// PrewarmLead is how long before the time given to Peer.PrewarmAt the
+	// handshake is initiated, long enough for two retries.
+	PrewarmLead = 3 * RekeyTimeout
+)
+
+// SetSessionMargins renews the sessions the device initiated once they are
+// within margin of RejectAfterTime, or have carried all but messages of
+// RejectAfterMessages, rather than at RekeyAfterTime and
+// RekeyAfterMessages. Larger margins renew sessions earlier, so that an
+// unattended link that is only used now and then is more likely to find a
+// fresh one. Zero selects the defaults; the margins cannot be less than the
+// defaults, nor more than MaxSessionMargin and MaxSessionMarginMessages.
+func (device *Device) SetSessionMargins(margin time.Duration, messages uint64) error {
+	if margin == 0 {
+		margin = DefaultSessionMargin
+	}
+	if messages == 0 {
+		messages = DefaultSessionMarginMessages
+	}
+	if margin < DefaultSessionMargin || margin > MaxSessionMargin {
+		return fmt.Errorf("session margin %v not between %v and %v", margin, DefaultSessionMargin, MaxSessionMargin)
+	}
+	if messages < DefaultSessionMarginMessages || messages > MaxSessionMarginMessages {
+		return fmt.Errorf("session margin of %d messages not between %d and %d", messages, uint64(DefaultSessionMarginMessages), uint64(MaxSessionMarginMessages))
+	}
+	device.sessionMargin.Store(int64(margin - DefaultSessionMargin))
+	device.sessionMarginMessages.Store(messages - DefaultSessionMarginMessages)
+	return nil
+}
+
+// SessionMargins returns the margins set by SetSessionMargins.
+func (device *Device) SessionMargins() (time.Duration, uint64) {
+	return DefaultSessionMargin + time.Duration(device.sessionMargin.Load()),
+		DefaultSessionMarginMessages + device.sessionMarginMessages.Load()
+}
+
+// rekeyAfter returns the age at which the peer renews the sessions it
+// initiated, and the number of messages after which it renews any.
+func (peer *Peer) rekeyAfter() (time.Duration, uint64) {
+	device := peer.device
+	return peer.rekeyAfterTime - time.Duration(device.sessionMargin.Load()),
+		RekeyAfterMessages - device.sessionMarginMessages.Load()
+}
+
+// PrewarmAt schedules a handshake with the peer to complete ahead of t, so
+// that a session is fresh when traffic is expected then, such as when a
+// remote sensor wakes up to check in. The handshake is initiated PrewarmLead
+// ahead of t, or at once if that has passed, unless by then the current
+// session is recent enough to last past t without being renewed. A
+// handshake completing in the meantime with such a session cancels it as
+// well. Only the latest time is kept; the zero time cancels it.
+func (peer *Peer) PrewarmAt(t time.Time) {
+	if t.IsZero() {
+		peer.prewarmAt.Store(0)
+		peer.timers.prewarm.Del()
+		return
+	}
+	peer.prewarmAt.Store(t.UnixNano())
+	peer.armPrewarm()
+}
+
+// armPrewarm schedules the handshake set by PrewarmAt, if any.
+func (peer *Peer) armPrewarm() {
+	at := peer.prewarmAt.Load()
+	if at == 0 {
+		return
+	}
+	peer.timers.prewarm.Mod(max(time.Until(time.Unix(0, at).Add(-PrewarmLead)), 0))
+}
+
+// prewarmDone reports whether the current session lasts past the time set
+// by PrewarmAt without being renewed, and cancels it if so.
+func (peer *Peer) prewarmDone() bool {
+	at := peer.prewarmAt.Load()
+	if at == 0 {
+		return true
+	}
+	keypair := peer.keypairs.Current()
+	if keypair == nil {
+		return false
+	}
+	rekeyAfterTime, _ := peer.rekeyAfter()
+	if time.Unix(0, at).Sub(keypair.created) >= rekeyAfterTime {
+		return false
+	}
+	peer.prewarmAt.CompareAndSwap(at, 0)
+	peer.timers.prewarm.Del()
+	return true
+}
+
+func expiredPrewarm(peer *Peer) {
+	if !peer.timersActive() || peer.prewarmDone() {
+		return
+	}
+	peer.prewarmAt.Store(0)
+	peer.device.log.Verbosef("%s - Initiating a handshake ahead of expected traffic", peer)
+	peer.sendHandshakeInitiation(false, true)
+}
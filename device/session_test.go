@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionMargins(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	addTestPeers(t, dev, 1)
+	var peer *Peer
+	for _, p := range dev.peers.keyMap {
+		peer = p
+	}
+
+	for _, bad := range []struct {
+		margin   time.Duration
+		messages uint64
+	}{
+		{DefaultSessionMargin - time.Second, 0},
+		{MaxSessionMargin + time.Second, 0},
+		{0, DefaultSessionMarginMessages - 1},
+		{0, MaxSessionMarginMessages + 1},
+	} {
+		if err := dev.SetSessionMargins(bad.margin, bad.messages); err == nil {
+			t.Errorf("SetSessionMargins(%v, %d) succeeded", bad.margin, bad.messages)
+		}
+	}
+
+	// A session initiated a little over a minute ago is renewed with the
+	// largest margin only.
+	now := time.Now()
+	keypair := &Keypair{isInitiator: true, created: now.Add(-70 * time.Second)}
+	if peer.rekeyDue(keypair, now) {
+		t.Error("session renewed early with the default margins")
+	}
+	if err := dev.SetSessionMargins(MaxSessionMargin, MaxSessionMarginMessages); err != nil {
+		t.Fatal(err)
+	}
+	if margin, messages := dev.SessionMargins(); margin != MaxSessionMargin || messages != MaxSessionMarginMessages {
+		t.Errorf("SessionMargins() = %v, %d after setting the largest", margin, messages)
+	}
+	if !peer.rekeyDue(keypair, now) {
+		t.Error("session not renewed with the largest margin")
+	}
+	if _, messages := peer.rekeyAfter(); messages != RejectAfterMessages-MaxSessionMarginMessages {
+		t.Errorf("session renewed after %d messages with the largest margin", messages)
+	}
+
+	if err := dev.SetSessionMargins(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if margin, messages := dev.SessionMargins(); margin != DefaultSessionMargin || messages != DefaultSessionMarginMessages {
+		t.Errorf("SessionMargins() = %v, %d after restoring the defaults", margin, messages)
+	}
+}
+
+func TestPrewarmAt(t *testing.T) {
+	pair := genTestPair(t, true)
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	// Without traffic, only the prewarm initiates a handshake.
+	time.Sleep(50 * time.Millisecond)
+	if peer.lastHandshakeNano.Load() != 0 {
+		t.Fatal("handshake without traffic nor prewarm")
+	}
+	peer.PrewarmAt(time.Now().Add(PrewarmLead + 100*time.Millisecond))
+	deadline := time.Now().Add(5 * time.Second)
+	for peer.lastHandshakeNano.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake ahead of the prewarm time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if peer.prewarmAt.Load() != 0 {
+		t.Error("prewarm time kept after its handshake")
+	}
+
+	// The fresh session lasts past another prewarm time, which is then
+	// dropped without a handshake.
+	last := peer.lastHandshakeNano.Load()
+	peer.PrewarmAt(time.Now().Add(PrewarmLead))
+	time.Sleep(100 * time.Millisecond)
+	if peer.lastHandshakeNano.Load() != last {
+		t.Error("handshake initiated although the session lasts past the prewarm time")
+	}
+	if peer.prewarmAt.Load() != 0 || peer.timers.prewarm.IsPending() {
+		t.Error("unneeded prewarm not cancelled")
+	}
+
+	peer.PrewarmAt(time.Now().Add(time.Hour))
+	if !peer.timers.prewarm.IsPending() {
+		t.Error("prewarm not scheduled")
+	}
+	peer.PrewarmAt(time.Time{})
+	if peer.prewarmAt.Load() != 0 || peer.timers.prewarm.IsPending() {
+		t.Error("prewarm not cancelled by the zero time")
+	}
+}
@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+)
+
+// sourceRetryInterval is how long a peer whose transport source became
+// unavailable is sent to from the bind's default sockets before the source
+// is tried again.
+const sourceRetryInterval = 10 * time.Second
+
+// SetTransportSource makes the device send the peer's encrypted traffic from
+// the local address src, so that it leaves through the uplink src belongs
+// to, rather than from the sockets listening on all addresses. The zero Addr
+// restores the default. The bind must implement conn.SourceBind.
+//
+// If src cannot be used, for instance because its link is down, the peer's
+// traffic falls back to the default sockets, and src is tried again every
+// ten seconds. EventPeerTransportSourceFallback and
+// EventPeerTransportSourceRestored report the changes.
+func (peer *Peer) SetTransportSource(src netip.Addr) error {
+	if src.IsValid() {
+		peer.device.net.RLock()
+		_, ok := peer.device.net.bind.(conn.SourceBind)
+		peer.device.net.RUnlock()
+		if !ok {
+			return errors.ErrUnsupported
+		}
+	}
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	peer.endpoint.source = src.Unmap()
+	peer.endpoint.sourceRetry = time.Time{}
+	return nil
+}
+
+// TransportSource returns the local address set by SetTransportSource, and
+// whether the peer's traffic has fallen back to the default sockets because
+// it is unavailable.
+func (peer *Peer) TransportSource() (src netip.Addr, fallback bool) {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	return peer.endpoint.source, !peer.endpoint.sourceRetry.IsZero()
+}
+
+// transportSource returns the local address to send the peer's traffic
+// from, or the zero Addr for the default sockets, and whether it is being
+// retried after a fallback. peer.endpoint must be locked.
+func (peer *Peer) transportSource() (src netip.Addr, retrying bool) {
+	src = peer.endpoint.source
+	if retry := peer.endpoint.sourceRetry; !retry.IsZero() {
+		if time.Now().Before(retry) {
+			return netip.Addr{}, false
+		}
+		retrying = true
+	}
+	return src, retrying
+}
+
+// sendFrom sends buffers to endpoint from src, falling back to the default
+// sockets if src is unavailable. The bind must implement conn.SourceBind.
+func (peer *Peer) sendFrom(bind conn.Bind, buffers [][]byte, endpoint conn.Endpoint, src netip.Addr, retrying bool) error {
+	err := bind.(conn.SourceBind).SendFrom(buffers, endpoint, src)
+	if errors.Is(err, conn.ErrSourceUnavailable) {
+		peer.endpoint.Lock()
+		first := peer.endpoint.sourceRetry.IsZero() && peer.endpoint.source == src
+		if peer.endpoint.source == src {
+			peer.endpoint.sourceRetry = time.Now().Add(sourceRetryInterval)
+		}
+		peer.endpoint.Unlock()
+		if first {
+			peer.device.log.Errorf("%v - Cannot send from %v, falling back to the default source: %v", peer, src, err)
+			peer.device.emitEvent(EventPeerTransportSourceFallback, peer)
+		}
+		return bind.Send(buffers, endpoint)
+	}
+	if err == nil && retrying {
+		peer.endpoint.Lock()
+		restored := peer.endpoint.source == src && !peer.endpoint.sourceRetry.IsZero()
+		if restored {
+			peer.endpoint.sourceRetry = time.Time{}
+		}
+		peer.endpoint.Unlock()
+		if restored {
+			peer.device.log.Verbosef("%v - Sending from %v again", peer, src)
+			peer.device.emitEvent(EventPeerTransportSourceRestored, peer)
+		}
+	}
+	return err
+}
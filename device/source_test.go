@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportSource(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	events := make(chan Event, 4)
+	dev.SetEventHandler(func(event Event) {
+		if event.Type == EventPeerStateChanged {
+			return
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	key := randNoisePublicKey(t)
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", key.Hex(),
+		"endpoint", remote.LocalAddr().String(),
+		"source", "127.0.0.1",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "source=127.0.0.1\n") {
+		t.Errorf("IpcGet output lacks source:\n%s", cfg)
+	}
+	peer := dev.LookupPeer(key)
+
+	// initiate sends a handshake initiation and returns its source port.
+	initiate := func() uint16 {
+		t.Helper()
+		peer.handshake.mutex.Lock()
+		peer.handshake.lastSentHandshake = time.Time{}
+		peer.handshake.mutex.Unlock()
+		if err := peer.SendHandshakeInitiation(false); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, MaxMessageSize)
+		remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, from, err := remote.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return from.Port()
+	}
+	dev.net.RLock()
+	port := dev.net.port
+	dev.net.RUnlock()
+	if got := initiate(); got == port {
+		t.Errorf("initiation sent from the listening port %d, not from the source socket", port)
+	}
+
+	// An address that cannot be bound falls back to the default sockets.
+	if err := peer.SetTransportSource(netip.MustParseAddr("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if got := initiate(); got != port {
+		t.Errorf("fallback initiation sent from port %d, want %d", got, port)
+	}
+	if event := <-events; event.Type != EventPeerTransportSourceFallback {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	if src, fallback := peer.TransportSource(); src != netip.MustParseAddr("192.0.2.1") || !fallback {
+		t.Errorf("TransportSource() = %v, %v", src, fallback)
+	}
+
+	// Once the source works again, traffic returns to it.
+	if err := peer.SetTransportSource(netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	peer.endpoint.Lock()
+	peer.endpoint.sourceRetry = time.Now()
+	peer.endpoint.Unlock()
+	if got := initiate(); got == port {
+		t.Errorf("initiation sent from the listening port after the source was restored")
+	}
+	if event := <-events; event.Type != EventPeerTransportSourceRestored {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
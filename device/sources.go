@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// disallowedSourceLogInterval is the minimum time between two log messages
+// about packets from the same peer with disallowed source addresses.
+const disallowedSourceLogInterval = time.Second
+
+type disallowedSources struct {
+	drops   atomic.Uint64
+	lastLog atomic.Int64 // unix nanoseconds
+}
+
+// SetLogDisallowedSources enables or disables logging of inbound packets
+// dropped because their source address is not among the allowed IPs of the
+// peer that sent them. Each message names the source address and the peer,
+// along with the number of such packets from the peer, and is logged at most
+// once per second for each peer. Use it to debug asymmetric routing.
+func (device *Device) SetLogDisallowedSources(enabled bool) {
+	device.logDisallowedSources.Store(enabled)
+}
+
+// SetAllowAnySource disables source address validation of inbound packets
+// from the peer, so that it may send packets from any address, not only from
+// its allowed IPs.
+//
+// This is unsafe: it lets the peer impersonate every other peer and any host
+// behind the device, defeating cryptokey routing. It exists for lab setups
+// where traffic is hairpinned, and must not be used in production.
+func (peer *Peer) SetAllowAnySource(allow bool) {
+	peer.allowAnySource.Store(allow)
+}
+
+// dropDisallowedSource accounts for dropping a packet from peer whose source
+// address src is not among the peer's allowed IPs.
+func (device *Device) dropDisallowedSource(peer *Peer, src []byte) {
+	drops := peer.disallowedSources.drops.Add(1)
+	if !device.logDisallowedSources.Load() {
+		device.log.Verbosef("Packet with disallowed source address from %v", peer)
+		return
+	}
+	now := time.Now().UnixNano()
+	last := peer.disallowedSources.lastLog.Load()
+	if now-last < int64(disallowedSourceLogInterval) || !peer.disallowedSources.lastLog.CompareAndSwap(last, now) {
+		return
+	}
+	addr, _ := netip.AddrFromSlice(src)
+	device.log.Errorf("%v - Dropped packet with source address %v, which is not in the peer's allowed IPs (%d dropped)", peer, addr, drops)
+}
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+func TestDisallowedSources(t *testing.T) {
+	pair := genTestPair(t, false)
+	remote := pair[1].dev.staticIdentity.publicKey
+	peer := pair[0].dev.LookupPeer(remote)
+	if err := pair[0].dev.IpcSet(uapiCfg("log_disallowed_sources", "true")); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Pong, nil) // establish the session
+
+	spoofed := netip.MustParseAddr("1.0.0.99")
+	msg := tuntest.Ping(pair[0].ip, spoofed)
+	pair[1].tun.Outbound <- msg
+	for deadline := time.Now().Add(5 * time.Second); peer.disallowedSources.drops.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("packet with disallowed source address was not dropped")
+		}
+	}
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Fatal("packet with disallowed source address was delivered")
+	default:
+	}
+	out, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"log_disallowed_sources=true\n", "disallowed_source_drops=1\n"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("IpcGet output missing %q", line)
+		}
+	}
+
+	if err := pair[0].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(remote[:]),
+		"allow_any_source", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	pair[1].tun.Outbound <- msg
+	select {
+	case got := <-pair[0].tun.Inbound:
+		if !bytes.Equal(got, msg) {
+			t.Error("delivered packet differs from the one sent")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not delivered with allow_any_source=true")
+	}
+	if out, err := pair[0].dev.IpcGet(); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(out, "\nallow_any_source=true\n") {
+		t.Error("IpcGet does not report allow_any_source=true")
+	}
+}
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "encoding/binary"
+
+// A stacked payload carries several packets in one transport data message,
+// saving the message and UDP/IP overhead of all but one of them, which for
+// streams of small packets is most of the bytes sent. It starts with
+// stackedMarker, whose version nibble no IP packet has, followed by each
+// packet prefixed with its length as a big endian uint16, and ends with the
+// padding of the message, which reads as a zero length.
+//
+// Like the transport cipher, stacking is not part of the WireGuard protocol:
+// a peer that has not enabled it drops stacked payloads as packets of an
+// unknown IP version, so both sides must enable it. Counters and replay
+// protection still apply to messages, not to the packets stacked in them.
+const (
+	stackedMarker     = 1 << 4
+	stackedHeaderSize = 1
+	stackedLengthSize = 2
+)
+
+// SetStackedTransport sets whether small packets sent to the peer are
+// stacked into shared transport data messages, and whether stacked messages
+// are accepted from it. This is experimental, and the peer must enable it
+// too; see stackedMarker.
+func (peer *Peer) SetStackedTransport(enabled bool) {
+	peer.stackedTransport.Store(enabled)
+}
+
+// StackedTransport reports whether SetStackedTransport enabled stacking.
+func (peer *Peer) StackedTransport() bool {
+	return peer.stackedTransport.Load()
+}
+
+func isStacked(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == stackedMarker
+}
+
+// eachPacket calls fn with each packet stacked in payload, or with payload
+// itself if it is not stacked.
+func eachPacket(payload []byte, fn func(packet []byte)) {
+	if !isStacked(payload) {
+		fn(payload)
+		return
+	}
+	for rest := payload[stackedHeaderSize:]; len(rest) >= stackedLengthSize; {
+		length := int(binary.BigEndian.Uint16(rest))
+		rest = rest[stackedLengthSize:]
+		if length == 0 || length > len(rest) {
+			return
+		}
+		fn(rest[:length])
+		rest = rest[length:]
+	}
+}
+
+// stackPackets stacks each run of consecutive packets of elems that fit in
+// a message of the MTU into the first of the run, putting back the others,
+// and returns the elements left, in order.
+func (peer *Peer) stackPackets(elems []*QueueOutboundElement) []*QueueOutboundElement {
+	device := peer.device
+	mtu := int(device.tun.mtu.Load())
+	if mtu == 0 || len(elems) < 2 {
+		return elems
+	}
+	kept := elems[:0]
+	var head *QueueOutboundElement
+	for _, elem := range elems {
+		if head != nil && len(elem.packet) > 0 {
+			size := len(head.packet) + stackedLengthSize + len(elem.packet)
+			if !isStacked(head.packet) {
+				size += stackedHeaderSize + stackedLengthSize
+			}
+			if size <= mtu {
+				if !isStacked(head.packet) {
+					head.packet = stackFirst(head.packet)
+				}
+				head.packet = binary.BigEndian.AppendUint16(head.packet, uint16(len(elem.packet)))
+				head.packet = append(head.packet, elem.packet...)
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+				continue
+			}
+		}
+		kept = append(kept, elem)
+		head = nil
+		if len(elem.packet) > 0 {
+			head = elem
+		}
+	}
+	clear(elems[len(kept):])
+	return kept
+}
+
+// stackFirst turns packet into a stacked payload of it alone, in place.
+func stackFirst(packet []byte) []byte {
+	n := len(packet)
+	payload := packet[:stackedHeaderSize+stackedLengthSize+n]
+	copy(payload[stackedHeaderSize+stackedLengthSize:], packet)
+	payload[0] = stackedMarker
+	binary.BigEndian.PutUint16(payload[stackedHeaderSize:], uint16(n))
+	return payload
+}
+
+// unstackInbound admits the packets stacked in the payload of elem, copying
+// them into a message buffer, each after the headroom the TUN device needs,
+// and appends them to packets. It returns the buffer, to be put back once
+// the packets are written, or nil if none was admitted.
+func (peer *Peer) unstackInbound(elem *QueueInboundElement, packets [][]byte) ([][]byte, *[MaxMessageSize]byte) {
+	device := peer.device
+	mirror := device.mirroring()
+	buf := device.GetMessageBuffer()
+	n := 0
+	eachPacket(elem.packet, func(packet []byte) {
+		if n+MessageTransportOffsetContent+len(packet) > len(buf) {
+			return
+		}
+		dst := buf[n+MessageTransportOffsetContent:]
+		packet, ok := peer.admitPacket(dst[:copy(dst, packet)])
+		if !ok {
+			return
+		}
+		peer.countRXSize(len(packet))
+		if mirror != nil {
+			device.mirrorPacket(mirror, MirrorInbound, peer.publicKey(), packet)
+		}
+		end := n + MessageTransportOffsetContent + len(packet)
+		packets = append(packets, buf[n:end:end])
+		n = end
+	})
+	if n == 0 {
+		device.PutMessageBuffer(buf)
+		return packets, nil
+	}
+	return packets, buf
+}
@@ -0,0 +1,178 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+// stackTestPackets returns IPv4 UDP packets of sizes from src to dst, each
+// carrying its index.
+func stackTestPackets(src, dst netip.Addr, sizes ...int) [][]byte {
+	packets := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		packet := udp4Packet(netip.AddrPortFrom(src, 1), netip.AddrPortFrom(dst, 2))
+		packet = append(packet, make([]byte, size-len(packet))...)
+		binary.BigEndian.PutUint16(packet[2:], uint16(size))
+		binary.BigEndian.PutUint32(packet[28:], uint32(i))
+		packets[i] = packet
+	}
+	return packets
+}
+
+// sendBatch sends packets from the second device of the pair to the first,
+// as one batch read from the TUN device, and returns the number of messages
+// that carried them.
+func (pair *testPair) sendBatch(tb testing.TB, packets [][]byte) uint64 {
+	tb.Helper()
+	dev := pair[1].dev
+	peer := dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	sent := func() uint64 {
+		infos := peer.KeypairInfo()
+		if len(infos) == 0 {
+			tb.Fatal("no keypair")
+		}
+		return infos[0].SendNonce
+	}
+	before := sent()
+	container := dev.GetOutboundElementsContainer()
+	for _, packet := range packets {
+		elem := dev.NewOutboundElement()
+		elem.packet = elem.buffer[MessageTransportHeaderSize:]
+		elem.packet = elem.packet[:copy(elem.packet, packet)]
+		container.elems = append(container.elems, elem)
+	}
+	peer.StagePackets(container)
+	peer.SendStagedPackets()
+	// The counters are assigned as the packets are queued for encryption.
+	return sent() - before
+}
+
+// receive returns the n packets the first device of the pair writes to its
+// TUN device, or fewer if they do not arrive within wait.
+func (pair *testPair) receive(n int, wait time.Duration) [][]byte {
+	var packets [][]byte
+	timeout := time.After(wait)
+	for len(packets) < n {
+		select {
+		case packet := <-pair[0].tun.Inbound:
+			packets = append(packets, packet)
+		case <-timeout:
+			return packets
+		}
+	}
+	return packets
+}
+
+func TestStackedTransport(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	setStacked := func(t *testing.T, enabled ...bool) {
+		for i := range pair {
+			if err := pair[i].dev.IpcSet(uapiCfg(
+				"public_key", pair[i^1].dev.staticIdentity.publicKey.Hex(),
+				"stacked_transport", fmt.Sprint(enabled[i]),
+			)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pair.Send(t, Ping, nil)
+
+	setStacked(t, true, true)
+	cfg, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains([]byte(cfg), []byte("\nstacked_transport=true\n")) {
+		t.Errorf("config lacks stacked_transport:\n%s", cfg)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		sizes    []int
+		messages uint64
+	}{
+		// 13 packets of 100 bytes, each with its length, fit in the MTU.
+		{"small", slices.Repeat([]int{100}, 40), 4},
+		{"mixed", []int{100, 100, 100, 1400, 100, 100}, 3},
+		{"large", []int{1400, 1400}, 2},
+		{"single", []int{100}, 1},
+	} {
+		for _, reorder := range []int{0, 8} {
+			t.Run(fmt.Sprintf("%s/reorder=%d", tt.name, reorder), func(t *testing.T) {
+				pair[0].dev.SetReorderBuffer(reorder, time.Millisecond)
+				packets := stackTestPackets(pair[1].ip, pair[0].ip, tt.sizes...)
+				txBefore := pair[1].dev.SizeHistogram().TX
+				if messages := pair.sendBatch(t, packets); messages != tt.messages {
+					t.Errorf("%d packets sent in %d messages, want %d", len(packets), messages, tt.messages)
+				}
+				got := pair.receive(len(packets), 5*time.Second)
+				if len(got) != len(packets) {
+					t.Fatalf("received %d of %d packets", len(got), len(packets))
+				}
+				for i := range got {
+					if !bytes.Equal(got[i], packets[i]) {
+						t.Fatalf("packet %d received as packet %d", i, binary.BigEndian.Uint32(got[i][28:]))
+					}
+				}
+				var counted uint64
+				for i, n := range pair[1].dev.SizeHistogram().TX {
+					counted += n - txBefore[i]
+				}
+				if counted != uint64(len(packets)) {
+					t.Errorf("%d packets counted in the size histogram, want %d", counted, len(packets))
+				}
+			})
+		}
+	}
+	pair[0].dev.SetReorderBuffer(0, 0)
+
+	// A receiver that has not enabled stacking drops stacked messages.
+	setStacked(t, false, true)
+	packets := stackTestPackets(pair[1].ip, pair[0].ip, 100, 100)
+	if messages := pair.sendBatch(t, packets); messages != 1 {
+		t.Errorf("%d packets sent in %d messages, want 1", len(packets), messages)
+	}
+	if got := pair.receive(1, 200*time.Millisecond); len(got) != 0 {
+		t.Error("stacked message accepted by a peer that has not enabled stacking")
+	}
+	pair.Send(t, Ping, nil)
+}
+
+func BenchmarkStackedTransport(b *testing.B) {
+	pair := genTestPair(b, true)
+	pair.Send(b, Ping, nil)
+	const size = 100
+	packets := stackTestPackets(pair[1].ip, pair[0].ip, slices.Repeat([]int{size}, 64)...)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+
+	for _, stacked := range []bool{false, true} {
+		b.Run(fmt.Sprintf("stacked=%t", stacked), func(b *testing.B) {
+			for i := range pair {
+				pair[i].dev.LookupPeer(pair[i^1].dev.staticIdentity.publicKey).SetStackedTransport(stacked)
+			}
+			b.SetBytes(int64(len(packets) * size))
+			txBefore := peer.txBytes.Load()
+			var messages uint64
+			for range b.N {
+				messages += pair.sendBatch(b, packets)
+				if got := pair.receive(len(packets), 5*time.Second); len(got) != len(packets) {
+					b.Fatalf("received %d of %d packets", len(got), len(packets))
+				}
+			}
+			// The bytes of the UDP payloads, and of the IPv4 and UDP headers.
+			wire := peer.txBytes.Load() - txBefore + messages*28
+			b.ReportMetric(float64(wire)/float64(b.N*len(packets)), "wire-B/packet")
+		})
+	}
+}
@@ -10,3 +10,7 @@ import (
 func (device *Device) startRouteListener(bind conn.Bind) (*rwcancel.RWCancel, error) {
 	return nil, nil
 }
+
+func errStaleSource(err error) bool {
+	return false
+}
@@ -15,6 +15,9 @@
 package device
 
 import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
 	"sync"
 	"unsafe"
 
@@ -42,17 +45,17 @@ func (device *Device) startRouteListener(bind conn.Bind) (*rwcancel.RWCancel, er
 		return nil, err
 	}
 
-	go device.routineRouteListener(bind, netlinkSock, netlinkCancel)
+	go device.routineRouteListener(netlinkSock, netlinkCancel)
 
 	return netlinkCancel, nil
 }
 
-func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netlinkCancel *rwcancel.RWCancel) {
-	type peerEndpointPtr struct {
+func (device *Device) routineRouteListener(netlinkSock int, netlinkCancel *rwcancel.RWCancel) {
+	type peerEndpoint struct {
 		peer     *Peer
-		endpoint *conn.Endpoint
+		endpoint conn.Endpoint
 	}
-	var reqPeer map[uint32]peerEndpointPtr
+	var reqPeer map[uint32]peerEndpoint
 	var reqPeerLock sync.Mutex
 
 	defer netlinkCancel.Close()
@@ -78,127 +81,62 @@ func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netl
 
 			hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&remain[0]))
 
-			if uint(hdr.Len) > uint(len(remain)) {
+			if uint(hdr.Len) > uint(len(remain)) || hdr.Len < unix.SizeofNlMsghdr {
 				break
 			}
 
 			switch hdr.Type {
 			case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
 				if hdr.Seq <= MaxPeers && hdr.Seq > 0 {
-					if uint(len(remain)) < uint(hdr.Len) {
+					// The answer to the query for a peer's route: clear
+					// its sticky source if the route leaves through
+					// another interface than the source's.
+					ifidx, ok := routeOutputInterface(remain[:hdr.Len])
+					if !ok {
 						break
 					}
-					if hdr.Len > unix.SizeofNlMsghdr+unix.SizeofRtMsg {
-						attr := remain[unix.SizeofNlMsghdr+unix.SizeofRtMsg:]
-						for {
-							if uint(len(attr)) < uint(unix.SizeofRtAttr) {
-								break
-							}
-							attrhdr := *(*unix.RtAttr)(unsafe.Pointer(&attr[0]))
-							if attrhdr.Len < unix.SizeofRtAttr || uint(len(attr)) < uint(attrhdr.Len) {
-								break
-							}
-							if attrhdr.Type == unix.RTA_OIF && attrhdr.Len == unix.SizeofRtAttr+4 {
-								ifidx := *(*uint32)(unsafe.Pointer(&attr[unix.SizeofRtAttr]))
-								reqPeerLock.Lock()
-								if reqPeer == nil {
-									reqPeerLock.Unlock()
-									break
-								}
-								pePtr, ok := reqPeer[hdr.Seq]
-								reqPeerLock.Unlock()
-								if !ok {
-									break
-								}
-								pePtr.peer.endpoint.Lock()
-								if &pePtr.peer.endpoint.val != pePtr.endpoint {
-									pePtr.peer.endpoint.Unlock()
-									break
-								}
-								if uint32(pePtr.peer.endpoint.val.(*conn.StdNetEndpoint).SrcIfidx()) == ifidx {
-									pePtr.peer.endpoint.Unlock()
-									break
-								}
-								pePtr.peer.endpoint.clearSrcOnTx = true
-								pePtr.peer.endpoint.Unlock()
-							}
-							attr = attr[attrhdr.Len:]
-						}
+					reqPeerLock.Lock()
+					pe, ok := reqPeer[hdr.Seq]
+					reqPeerLock.Unlock()
+					if !ok {
+						break
+					}
+					pe.peer.endpoint.Lock()
+					if pe.peer.endpoint.val == pe.endpoint && uint32(pe.endpoint.(*conn.StdNetEndpoint).SrcIfidx()) != ifidx {
+						pe.peer.endpoint.clearSrcOnTx = true
 					}
+					pe.peer.endpoint.Unlock()
 					break
 				}
+				// A route changed: query the route of every peer with a
+				// sticky source again.
 				reqPeerLock.Lock()
-				reqPeer = make(map[uint32]peerEndpointPtr)
+				reqPeer = make(map[uint32]peerEndpoint)
 				reqPeerLock.Unlock()
 				go func() {
+					device.net.RLock()
+					mark := device.net.fwmark
+					device.net.RUnlock()
 					device.peers.RLock()
+					defer device.peers.RUnlock()
 					i := uint32(1)
 					for _, peer := range device.peers.keyMap {
 						peer.endpoint.Lock()
-						if peer.endpoint.val == nil {
-							peer.endpoint.Unlock()
-							continue
-						}
 						nativeEP, _ := peer.endpoint.val.(*conn.StdNetEndpoint)
-						if nativeEP == nil {
+						if nativeEP == nil || nativeEP.SrcIfidx() == 0 || !nativeEP.SrcIP().IsValid() || i > MaxPeers {
 							peer.endpoint.Unlock()
 							continue
 						}
-						if nativeEP.DstIP().Is6() || nativeEP.SrcIfidx() == 0 {
-							peer.endpoint.Unlock()
-							break
-						}
-						nlmsg := struct {
-							hdr     unix.NlMsghdr
-							msg     unix.RtMsg
-							dsthdr  unix.RtAttr
-							dst     [4]byte
-							srchdr  unix.RtAttr
-							src     [4]byte
-							markhdr unix.RtAttr
-							mark    uint32
-						}{
-							unix.NlMsghdr{
-								Type:  uint16(unix.RTM_GETROUTE),
-								Flags: unix.NLM_F_REQUEST,
-								Seq:   i,
-							},
-							unix.RtMsg{
-								Family:  unix.AF_INET,
-								Dst_len: 32,
-								Src_len: 32,
-							},
-							unix.RtAttr{
-								Len:  8,
-								Type: unix.RTA_DST,
-							},
-							nativeEP.DstIP().As4(),
-							unix.RtAttr{
-								Len:  8,
-								Type: unix.RTA_SRC,
-							},
-							nativeEP.SrcIP().As4(),
-							unix.RtAttr{
-								Len:  8,
-								Type: unix.RTA_MARK,
-							},
-							device.net.fwmark,
-						}
-						nlmsg.hdr.Len = uint32(unsafe.Sizeof(nlmsg))
+						req := routeRequest(i, nativeEP.DstIP(), nativeEP.SrcIP(), mark)
 						reqPeerLock.Lock()
-						reqPeer[i] = peerEndpointPtr{
-							peer:     peer,
-							endpoint: &peer.endpoint.val,
-						}
+						reqPeer[i] = peerEndpoint{peer, nativeEP}
 						reqPeerLock.Unlock()
 						peer.endpoint.Unlock()
 						i++
-						_, err := netlinkCancel.Write((*[unsafe.Sizeof(nlmsg)]byte)(unsafe.Pointer(&nlmsg))[:])
-						if err != nil {
-							break
+						if _, err := netlinkCancel.Write(req); err != nil {
+							return
 						}
 					}
-					device.peers.RUnlock()
 				}()
 			}
 			remain = remain[hdr.Len:]
@@ -206,6 +144,58 @@ func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netl
 	}
 }
 
+// routeRequest returns an RTM_GETROUTE request numbered seq for the route
+// from src to dst taken by packets marked with mark.
+func routeRequest(seq uint32, dst, src netip.Addr, mark uint32) []byte {
+	dst, src = dst.Unmap(), src.Unmap()
+	rtmsg := unix.RtMsg{Family: unix.AF_INET, Dst_len: 32, Src_len: 32}
+	if dst.Is6() {
+		rtmsg = unix.RtMsg{Family: unix.AF_INET6, Dst_len: 128, Src_len: 128}
+	}
+	attr := func(b []byte, typ uint16, data []byte) []byte {
+		b = binary.NativeEndian.AppendUint16(b, uint16(unix.SizeofRtAttr+len(data)))
+		b = binary.NativeEndian.AppendUint16(b, typ)
+		return append(b, data...)
+	}
+	b := make([]byte, unix.SizeofNlMsghdr, 64)
+	b = append(b, (*[unix.SizeofRtMsg]byte)(unsafe.Pointer(&rtmsg))[:]...)
+	b = attr(b, unix.RTA_DST, dst.AsSlice())
+	b = attr(b, unix.RTA_SRC, src.AsSlice())
+	b = attr(b, unix.RTA_MARK, binary.NativeEndian.AppendUint32(nil, mark))
+	*(*unix.NlMsghdr)(unsafe.Pointer(&b[0])) = unix.NlMsghdr{
+		Len:   uint32(len(b)),
+		Type:  uint16(unix.RTM_GETROUTE),
+		Flags: unix.NLM_F_REQUEST,
+		Seq:   seq,
+	}
+	return b
+}
+
+// routeOutputInterface returns the RTA_OIF attribute of msg, a route
+// message.
+func routeOutputInterface(msg []byte) (uint32, bool) {
+	if len(msg) < unix.SizeofNlMsghdr+unix.SizeofRtMsg {
+		return 0, false
+	}
+	for attr := msg[unix.SizeofNlMsghdr+unix.SizeofRtMsg:]; len(attr) >= unix.SizeofRtAttr; {
+		attrhdr := *(*unix.RtAttr)(unsafe.Pointer(&attr[0]))
+		if attrhdr.Len < unix.SizeofRtAttr || uint(len(attr)) < uint(attrhdr.Len) {
+			break
+		}
+		if attrhdr.Type == unix.RTA_OIF && attrhdr.Len == unix.SizeofRtAttr+4 {
+			return binary.NativeEndian.Uint32(attr[unix.SizeofRtAttr:]), true
+		}
+		attr = attr[min(int(attrhdr.Len+unix.RTA_ALIGNTO-1)&^(unix.RTA_ALIGNTO-1), len(attr)):]
+	}
+	return 0, false
+}
+
+// errStaleSource reports whether err, from sending to an endpoint with a
+// sticky source, is the kernel refusing that source.
+func errStaleSource(err error) bool {
+	return errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENETUNREACH)
+}
+
 func createNetlinkRouteSocket() (int, error) {
 	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
 	if err != nil {
@@ -213,7 +203,7 @@ func createNetlinkRouteSocket() (int, error) {
 	}
 	saddr := &unix.SockaddrNetlink{
 		Family: unix.AF_NETLINK,
-		Groups: unix.RTMGRP_IPV4_ROUTE,
+		Groups: unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
 	}
 	err = unix.Bind(sock, saddr)
 	if err != nil {
@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/darkit/wireguard/conn"
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+// A testNetns runs functions in a network namespace of its own, on an OS
+// thread that is discarded along with the namespace once closed.
+type testNetns struct {
+	path  string
+	funcs chan func()
+}
+
+func newTestNetns(t *testing.T) *testNetns {
+	ns := &testNetns{funcs: make(chan func())}
+	errc := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		// Never unlocked: the thread exits with the goroutine.
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errc <- err
+			return
+		}
+		ns.path = fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+		errc <- nil
+		for fn := range ns.funcs {
+			fn()
+		}
+	}()
+	if err := <-errc; err != nil {
+		t.Skip("cannot create a network namespace:", err)
+	}
+	t.Cleanup(func() { close(ns.funcs) })
+	ns.ip(t, "link set lo up")
+	return ns
+}
+
+// do runs fn in the namespace.
+func (ns *testNetns) do(fn func()) {
+	done := make(chan struct{})
+	ns.funcs <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+// ip runs the ip command with args in the namespace.
+func (ns *testNetns) ip(t *testing.T, args string) {
+	t.Helper()
+	var out []byte
+	var err error
+	ns.do(func() {
+		out, err = exec.Command("ip", strings.Fields(args)...).CombinedOutput()
+	})
+	if err != nil {
+		t.Fatalf("ip %s: %v: %s", args, err, out)
+	}
+}
+
+func TestStickySourceRouteChange(t *testing.T) {
+	if !conn.StdNetSupportsStickySockets {
+		t.Skip("no sticky sockets")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("no ip command")
+	}
+	goroutineLeakCheck(t)
+
+	// The local device reaches the remote one over two veths, a0 and a1,
+	// whichever the default route points at.
+	local, remote := newTestNetns(t), newTestNetns(t)
+	for i := range 2 {
+		local.ip(t, fmt.Sprintf("link add a%d type veth peer name b%d netns %s", i, i, remote.path))
+		local.ip(t, fmt.Sprintf("addr add 10.%d.0.1/24 dev a%d", i, i))
+		local.ip(t, fmt.Sprintf("link set a%d up", i))
+		remote.ip(t, fmt.Sprintf("addr add 10.%d.0.2/24 dev b%d", i, i))
+		remote.ip(t, fmt.Sprintf("link set b%d up", i))
+	}
+	remote.ip(t, "addr add 192.0.2.1/32 dev lo")
+	local.ip(t, "route add default via 10.0.0.2 dev a0")
+
+	cfg, endpointCfg := genConfigs(t)
+	var pair testPair
+	for i, ns := range []*testNetns{local, remote} {
+		p := &pair[i]
+		p.tun = tuntest.NewChannelTUN()
+		p.ip = netip.AddrFrom4([4]byte{1, 0, 0, byte(i + 1)})
+		ns.do(func() {
+			// The sockets and the route listener are opened in ns.
+			p.dev = NewDevice(p.tun.TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i)))
+			if err := p.dev.IpcSet(cfg[i]); err != nil {
+				t.Error(err)
+			}
+			if err := p.dev.Up(); err != nil {
+				t.Error(err)
+			}
+		})
+		t.Cleanup(p.dev.Close)
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+	// Only the local device knows the other's endpoint; the remote one
+	// learns it, and follows it around, from the packets it receives.
+	remoteEndpoint := strings.Replace(endpointCfg[0], "127.0.0.1", "192.0.2.1", 1)
+	if err := pair[0].dev.IpcSet(fmt.Sprintf(remoteEndpoint, pair[1].dev.net.port)); err != nil {
+		t.Fatal(err)
+	}
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	source := func() netip.Addr {
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		return peer.endpoint.val.SrcIP()
+	}
+
+	// exchange passes packets both ways until the local device sends from
+	// want, as it does once it has noticed the change of routes.
+	exchange := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			pair.Send(t, Pong, nil)
+			pair.Send(t, Ping, nil)
+			src := source()
+			if src == netip.MustParseAddr(want) {
+				return
+			}
+			if time.Now().After(deadline) || t.Failed() {
+				t.Fatalf("sticky source %v, want %s", src, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	exchange("10.0.0.1")
+
+	// Once the default route moves to a1, packets leave from a1's address.
+	local.ip(t, "route replace default via 10.1.0.2 dev a1")
+	exchange("10.1.0.1")
+
+	// Likewise once the sticky source is removed altogether.
+	local.ip(t, "route replace default via 10.0.0.2 dev a0")
+	local.ip(t, "addr del 10.1.0.1/24 dev a1")
+	exchange("10.0.0.1")
+}
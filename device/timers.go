@@ -8,6 +8,7 @@
 package device
 
 import (
+	"fmt"
 	"sync"
 	"time"
 	_ "unsafe"
@@ -77,8 +78,16 @@ func (peer *Peer) timersActive() bool {
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
-	if peer.timers.handshakeAttempts.Load() > MaxTimerHandshakes {
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, MaxTimerHandshakes+2)
+	peer.updateEndpointError()
+	if peer.timers.handshakeAttempts.Load() > MaxTimerHandshakes || peer.inHandshakeBackoff() {
+		interval := peer.extendHandshakeBackoff()
+		if peer.device.log.Verbose() {
+			if interval > 0 {
+				peer.device.log.Verbosef("%s - Handshake did not complete, backing off for %v", peer, interval)
+			} else {
+				peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, MaxTimerHandshakes+2)
+			}
+		}
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -95,9 +104,16 @@ func expiredRetransmitHandshake(peer *Peer) {
 		if peer.timersActive() && !peer.timers.zeroKeyMaterial.IsPending() {
 			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
 		}
+		peer.updateState()
 	} else {
 		peer.timers.handshakeAttempts.Add(1)
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(RekeyTimeout.Seconds()), peer.timers.handshakeAttempts.Load()+1)
+		if peer.device.log.Verbose() {
+			var reason string
+			if err := peer.EndpointError(); err != nil {
+				reason = fmt.Sprintf(" (%v)", err)
+			}
+			peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds%s, retrying (try %d)", peer, int(RekeyTimeout.Seconds()), reason, peer.timers.handshakeAttempts.Load()+1)
+		}
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.markEndpointSrcForClearing()
@@ -117,19 +133,23 @@ func expiredSendKeepalive(peer *Peer) {
 }
 
 func expiredNewHandshake(peer *Peer) {
-	peer.device.log.Verbosef("%s - Retrying handshake because we stopped hearing back after %d seconds", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+	if peer.device.log.Verbose() {
+		peer.device.log.Verbosef("%s - Retrying handshake because we stopped hearing back after %d seconds", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+	}
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.markEndpointSrcForClearing()
 	peer.SendHandshakeInitiation(false)
 }
 
 func expiredZeroKeyMaterial(peer *Peer) {
-	peer.device.log.Verbosef("%s - Removing all keys, since we haven't received a new one in %d seconds", peer, int((RejectAfterTime * 3).Seconds()))
+	if peer.device.log.Verbose() {
+		peer.device.log.Verbosef("%s - Removing all keys, since we haven't received a new one in %d seconds", peer, int((RejectAfterTime * 3).Seconds()))
+	}
 	peer.ZeroAndFlushAll()
 }
 
 func expiredPersistentKeepalive(peer *Peer) {
-	if peer.persistentKeepaliveInterval.Load() > 0 {
+	if peer.persistentKeepaliveInterval.Load() > 0 && !peer.refreshKeepaliveOffload() {
 		peer.SendKeepalive()
 	}
 }
@@ -139,6 +159,16 @@ func (peer *Peer) timersDataSent() {
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
 		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
 	}
+	if window := peer.watchdogTimeout(); window > 0 && peer.timersActive() && !peer.timers.watchdog.IsPending() {
+		peer.timers.watchdog.Mod(window)
+	}
+}
+
+/* Should be called after an authenticated transport packet -- keepalive or data -- is received. */
+func (peer *Peer) timersTransportReceived() {
+	if peer.timersActive() {
+		peer.timers.watchdog.Del()
+	}
 }
 
 /* Should be called after an authenticated data packet is received. */
@@ -163,6 +193,17 @@ func (peer *Peer) timersAnyAuthenticatedPacketSent() {
 func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 	if peer.timersActive() {
 		peer.timers.newHandshake.Del()
+		if ttl := peer.device.endpointTTL.Load(); ttl > 0 {
+			peer.timers.endpointTTL.Mod(time.Duration(ttl))
+		}
+	}
+	peer.endHandshakeBackoff()
+	if peer.endpointError.Load() != 0 {
+		peer.endpointError.Store(0)
+	}
+	peer.lastReceivedNano.Store(time.Now().UnixNano())
+	if PeerState(peer.reportedState.Load()) != PeerConnected {
+		peer.updateState()
 	}
 }
 
@@ -171,6 +212,7 @@ func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
 		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
 	}
+	peer.updateState()
 }
 
 /* Should be called after a handshake response message is received and processed or when getting key confirmation via the first data message. */
@@ -181,6 +223,9 @@ func (peer *Peer) timersHandshakeComplete() {
 	peer.timers.handshakeAttempts.Store(0)
 	peer.timers.sentLastMinuteHandshake.Store(false)
 	peer.lastHandshakeNano.Store(time.Now().UnixNano())
+	peer.updateState()
+	peer.refreshKeepaliveOffload()
+	peer.prewarmDone()
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
@@ -204,6 +249,11 @@ func (peer *Peer) timersInit() {
 	peer.timers.newHandshake = peer.NewTimer(expiredNewHandshake)
 	peer.timers.zeroKeyMaterial = peer.NewTimer(expiredZeroKeyMaterial)
 	peer.timers.persistentKeepalive = peer.NewTimer(expiredPersistentKeepalive)
+	peer.timers.watchdog = peer.NewTimer(expiredWatchdog)
+	peer.timers.state = peer.NewTimer(expiredState)
+	peer.timers.delayedInitiation = peer.NewTimer(expiredDelayedInitiation)
+	peer.timers.endpointTTL = peer.NewTimer(expiredEndpointTTL)
+	peer.timers.prewarm = peer.NewTimer(expiredPrewarm)
 }
 
 func (peer *Peer) timersStart() {
@@ -218,4 +268,10 @@ func (peer *Peer) timersStop() {
 	peer.timers.newHandshake.DelSync()
 	peer.timers.zeroKeyMaterial.DelSync()
 	peer.timers.persistentKeepalive.DelSync()
+	peer.timers.watchdog.DelSync()
+	peer.timers.state.DelSync()
+	peer.timers.delayedInitiation.DelSync()
+	peer.timers.endpointTTL.DelSync()
+	peer.timers.prewarm.DelSync()
+	peer.cancelKeepaliveOffload()
 }
@@ -8,16 +8,20 @@ package device
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/darkit/wireguard/conn"
 	"github.com/darkit/wireguard/ipc"
 )
 
@@ -38,6 +42,11 @@ func (s IPCError) ErrorCode() int64 {
 	return s.code
 }
 
+// Errno returns the error code reported to UAPI clients in the errno= line.
+func (s IPCError) Errno() int64 {
+	return s.code
+}
+
 func ipcErrorf(code int64, msg string, args ...any) *IPCError {
 	return &IPCError{code: code, err: fmt.Errorf(msg, args...)}
 }
@@ -46,9 +55,47 @@ var byteBufferPool = &sync.Pool{
 	New: func() any { return new(bytes.Buffer) },
 }
 
+// ipcGetChunkSize is how much output of a get operation is buffered before
+// it is written, which happens without holding any lock of the device.
+const ipcGetChunkSize = 64 << 10
+
+// An IpcGetFilter selects the peers serialized by IpcGetFilteredOperation.
+type IpcGetFilter struct {
+	// PublicKeys, if not empty, selects only the peers with these keys.
+	PublicKeys []NoisePublicKey
+
+	// HandshakeSince, if not zero, selects only the peers whose last
+	// handshake completed at or after it.
+	HandshakeSince time.Time
+}
+
+func (filter *IpcGetFilter) matches(key NoisePublicKey, peer *Peer) bool {
+	if len(filter.PublicKeys) > 0 && !slices.Contains(filter.PublicKeys, key) {
+		return false
+	}
+	if !filter.HandshakeSince.IsZero() && peer.lastHandshakeNano.Load() < filter.HandshakeSince.UnixNano() {
+		return false
+	}
+	return true
+}
+
 // IpcGetOperation implements the WireGuard configuration protocol "get" operation.
 // See https://www.wireguard.com/xplatform/#configuration-protocol for details.
 func (device *Device) IpcGetOperation(w io.Writer) error {
+	return device.IpcGetFilteredOperation(w, IpcGetFilter{})
+}
+
+// IpcGetFilteredOperation is like IpcGetOperation, but serializes only the
+// peers selected by filter.
+//
+// Peers are serialized in the order of their public keys, one at a time,
+// holding locks only meanwhile, and the output is written in chunks without
+// holding any, so that a slow reader of the configuration of many peers does
+// not stall the device. The output is therefore not a consistent snapshot:
+// peers added meanwhile are missing, peers removed meanwhile are skipped, and
+// the counters of different peers are read at different times.
+// Configuration changes wait for the operation to complete.
+func (device *Device) IpcGetFilteredOperation(w io.Writer, filter IpcGetFilter) error {
 	device.ipcMutex.RLock()
 	defer device.ipcMutex.RUnlock()
 
@@ -71,6 +118,12 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 		buf.WriteByte('\n')
 	}
 
+	type keyedPeer struct {
+		key  NoisePublicKey
+		peer *Peer
+	}
+	var peers []keyedPeer
+
 	func() {
 		// lock required resources
 
@@ -97,57 +150,210 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("fwmark=%d", device.net.fwmark)
 		}
 
-		for _, peer := range device.peers.keyMap {
-			// Serialize peer state.
-			peer.handshake.mutex.RLock()
-			keyf("public_key", (*[32]byte)(&peer.handshake.remoteStatic))
-			keyf("preshared_key", (*[32]byte)(&peer.handshake.presharedKey))
-			peer.handshake.mutex.RUnlock()
-			sendf("protocol_version=1")
-			peer.endpoint.Lock()
-			if peer.endpoint.val != nil {
-				sendf("endpoint=%s", peer.endpoint.val.DstToString())
-			}
-			peer.endpoint.Unlock()
+		if device.audit.enabled.Load() {
+			device.audit.Lock()
+			sendf("audit_unknown_initiations=%d", len(device.audit.entries))
+			device.audit.Unlock()
+		}
+
+		if window := device.watchdogWindow.Load(); window > 0 {
+			sendf("peer_watchdog_window=%d", time.Duration(window)/time.Second)
+		}
+
+		if device.handshakeBackoffMax.Load() != 0 {
+			sendf("handshake_backoff_max=%d", device.HandshakeBackoffMax()/time.Second)
+		}
+
+		if ttl := device.EndpointTTL(); ttl > 0 {
+			sendf("endpoint_ttl=%d", ttl/time.Second)
+		}
 
-			nano := peer.lastHandshakeNano.Load()
-			secs := nano / time.Second.Nanoseconds()
-			nano %= time.Second.Nanoseconds()
+		if device.handshakeJitter.Load() != 0 {
+			sendf("handshake_jitter=%s", strconv.FormatFloat(device.HandshakeJitter(), 'g', -1, 64))
+		}
 
-			sendf("last_handshake_time_sec=%d", secs)
-			sendf("last_handshake_time_nsec=%d", nano)
-			sendf("tx_bytes=%d", peer.txBytes.Load())
-			sendf("rx_bytes=%d", peer.rxBytes.Load())
-			sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
+		if device.logDisallowedSources.Load() {
+			sendf("log_disallowed_sources=true")
+		}
+
+		if device.malformed.log.Load() {
+			sendf("log_malformed_datagrams=true")
+		}
+
+		if device.limits.enabled() {
+			sendf("max_peers=%d", device.limits.peers.Load())
+			sendf("max_allowed_ips_per_peer=%d", device.limits.allowedIPsPerPeer.Load())
+			sendf("max_total_allowed_ips=%d", device.limits.totalAllowedIPs.Load())
+			sendf("peer_count=%d", len(device.peers.keyMap))
+			sendf("allowed_ip_count=%d", device.allowedips.Len())
+		}
+
+		if policy := device.FlowLabelPolicy(); policy != conn.FlowLabelKernel {
+			sendf("flow_label_policy=%v", policy)
+		}
 
-			device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
-				sendf("allowed_ip=%s", prefix.String())
-				return true
-			})
+		if device.offloadsDisabledLocked() {
+			sendf("disable_offloads=true")
+		}
+
+		prefixes, _ := device.RatelimitExempt()
+		for _, prefix := range prefixes {
+			sendf("ratelimit_exempt=%v", prefix)
+		}
+
+		for reason := DropReason(0); reason < dropReasonCount; reason++ {
+			if n := device.drops.counts[reason].Load(); n != 0 {
+				sendf("dropped_%v=%d", reason, n)
+			}
+		}
+		for reason := MalformedReason(0); reason < malformedReasonCount; reason++ {
+			if n := device.malformed.counts[reason].Load(); n != 0 {
+				sendf("malformed_%v=%d", reason, n)
+			}
+		}
+		if n := device.mirrors.dropped.Load(); n != 0 {
+			sendf("mirror_dropped=%d", n)
+		}
+
+		peers = make([]keyedPeer, 0, len(device.peers.keyMap))
+		for key, peer := range device.peers.keyMap {
+			if filter.matches(key, peer) {
+				peers = append(peers, keyedPeer{key, peer})
+			}
 		}
 	}()
+	slices.SortFunc(peers, func(a, b keyedPeer) int {
+		return bytes.Compare(a.key[:], b.key[:])
+	})
 
 	// send lines (does not require resource locks)
-	if _, err := w.Write(buf.Bytes()); err != nil {
-		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+	flush := func() error {
+		_, err := w.Write(buf.Bytes())
+		buf.Reset()
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+		}
+		return nil
+	}
+	if err := flush(); err != nil {
+		return err
 	}
 
-	return nil
+	for _, p := range peers {
+		peer := p.peer
+		// Holding the peers lock keeps the peer from being removed meanwhile.
+		device.peers.RLock()
+		if device.peers.keyMap[p.key] != peer {
+			device.peers.RUnlock()
+			continue
+		}
+
+		// Serialize peer state.
+		peer.handshake.mutex.RLock()
+		keyf("public_key", (*[32]byte)(&peer.handshake.remoteStatic))
+		keyf("preshared_key", (*[32]byte)(&peer.handshake.presharedKey))
+		peer.handshake.mutex.RUnlock()
+		sendf("protocol_version=1")
+		peer.endpoint.Lock()
+		if peer.endpoint.val != nil {
+			sendf("endpoint=%s", peer.endpoint.val.DstToString())
+		}
+		if peer.endpoint.source.IsValid() {
+			sendf("source=%s", peer.endpoint.source)
+		}
+		peer.endpoint.Unlock()
+
+		nano := peer.lastHandshakeNano.Load()
+		secs := nano / time.Second.Nanoseconds()
+		nano %= time.Second.Nanoseconds()
+
+		sendf("last_handshake_time_sec=%d", secs)
+		sendf("last_handshake_time_nsec=%d", nano)
+		sendf("tx_bytes=%d", peer.txBytes.Load())
+		sendf("rx_bytes=%d", peer.rxBytes.Load())
+		sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
+		if window := peer.watchdogWindow.Load(); window != 0 {
+			sendf("watchdog_window=%d", time.Duration(window)/time.Second)
+		}
+		if recoveries := peer.watchdogRecoveries.Load(); recoveries > 0 || peer.watchdogTimeout() > 0 {
+			sendf("watchdog_recoveries=%d", recoveries)
+		}
+		if nano := peer.lastWatchdogRecovery.Load(); nano != 0 {
+			sendf("last_watchdog_recovery_sec=%d", nano/time.Second.Nanoseconds())
+		}
+		if failures, next := peer.HandshakeBackoff(); failures > 0 {
+			sendf("handshake_backoff_failures=%d", failures)
+			sendf("handshake_backoff_remaining_sec=%d", max(time.Until(next), 0)/time.Second)
+		}
+		if err := conn.EndpointError(peer.endpointError.Load()); err != 0 {
+			sendf("last_error=%s", endpointErrorName(err))
+		}
+		if peer.passive.Load() {
+			sendf("passive=true")
+		}
+		if suite := peer.CipherSuite(); suite != CipherChaCha20Poly1305 {
+			sendf("transport_cipher=%v", suite)
+		}
+		if peer.StackedTransport() {
+			sendf("stacked_transport=true")
+		}
+		if peer.allowAnySource.Load() {
+			sendf("allow_any_source=true")
+		}
+		if device.logDisallowedSources.Load() {
+			sendf("disallowed_source_drops=%d", peer.disallowedSources.drops.Load())
+		}
+		if drops := peer.inboundPolicyDrops.Load(); drops > 0 {
+			sendf("inbound_policy_drops=%d", drops)
+		}
+		labels := peer.Labels()
+		for _, key := range slices.Sorted(maps.Keys(labels)) {
+			sendf("label.%s=%s", key, labels[key])
+		}
+
+		device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
+			sendf("allowed_ip=%s", prefix.String())
+			return true
+		})
+		if ingress, ok := peer.IngressAllowedIPs(); ok {
+			sendf("separate_ingress_allowed_ips=true")
+			for _, prefix := range ingress {
+				sendf("ingress_allowed_ip=%s", prefix.String())
+			}
+		}
+		device.peers.RUnlock()
+
+		if buf.Len() >= ipcGetChunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
 }
 
 // IpcSetOperation implements the WireGuard configuration protocol "set" operation.
 // See https://www.wireguard.com/xplatform/#configuration-protocol for details.
+//
+// If the operation fails because it exceeds a limit set by SetLimits, the peers
+// it created are removed and the allowed IPs it changed are restored.
 func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 	device.ipcMutex.Lock()
 	defer device.ipcMutex.Unlock()
 
+	journal := new(ipcSetJournal)
 	defer func() {
 		if err != nil {
 			device.log.Errorf("%v", err)
+			if isLimitError(err) {
+				journal.rollback(device)
+			}
+		} else {
+			device.warnRoutingLoops()
 		}
 	}()
 
-	peer := new(ipcSetPeer)
+	peer := &ipcSetPeer{journal: journal}
 	deviceConfig := true
 
 	scanner := bufio.NewScanner(r)
@@ -160,7 +366,7 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 		}
 		key, value, ok := strings.Cut(line, "=")
 		if !ok {
-			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q", line)
+			return ipcErrorf(ipc.IpcErrorProtocol, "%w: failed to parse line %q", ErrProtocolViolation, line)
 		}
 
 		if key == "public_key" {
@@ -202,8 +408,16 @@ func (device *Device) handleDeviceLine(key, value string) error {
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set private_key: %w", err)
 		}
-		device.log.Verbosef("UAPI: Updating private key")
-		device.SetPrivateKey(sk)
+		if sk.IsZero() {
+			device.log.Verbosef("UAPI: Removing private key")
+			err = device.setStaticIdentity(&privateKeyOps{ops: &sk}, false)
+		} else {
+			device.log.Verbosef("UAPI: Updating private key")
+			err = device.SetPrivateKey(sk)
+		}
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set private_key: %w", err)
+		}
 
 	case "listen_port":
 		port, err := strconv.ParseUint(value, 10, 16)
@@ -233,6 +447,99 @@ func (device *Device) handleDeviceLine(key, value string) error {
 			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to update fwmark: %w", err)
 		}
 
+	case "audit_unknown_initiations":
+		size, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse audit_unknown_initiations: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating unknown initiation audit size")
+		device.SetUnknownInitiationAudit(int(size))
+
+	case "peer_watchdog_window":
+		secs, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse peer_watchdog_window: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating peer watchdog window")
+		device.SetPeerWatchdog(time.Duration(secs) * time.Second)
+
+	case "handshake_backoff_max":
+		secs, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse handshake_backoff_max: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating handshake backoff cap")
+		device.SetHandshakeBackoff(time.Duration(secs) * time.Second)
+
+	case "endpoint_ttl":
+		secs, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse endpoint_ttl: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating endpoint TTL")
+		device.SetEndpointTTL(time.Duration(secs) * time.Second)
+
+	case "handshake_jitter":
+		fraction, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			err = device.SetHandshakeJitter(fraction)
+		}
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set handshake_jitter: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating handshake jitter")
+
+	case "log_disallowed_sources":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_disallowed_sources, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Updating logging of disallowed source addresses")
+		device.SetLogDisallowedSources(enabled)
+
+	case "log_malformed_datagrams":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_malformed_datagrams, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Updating logging of malformed datagrams")
+		device.SetLogMalformedDatagrams(enabled)
+
+	case "flow_label_policy":
+		policy, err := conn.ParseFlowLabelPolicy(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set flow_label_policy: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating flow label policy")
+		if err := device.SetFlowLabelPolicy(policy); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set flow_label_policy %v: %w", policy, err)
+		}
+
+	case "disable_offloads":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set disable_offloads, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Disabling UDP segmentation offloads")
+		if err := device.DisableOffloads(); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set disable_offloads: %w", err)
+		}
+
+	case "replace_ratelimit_exempt":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to replace ratelimit_exempt, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Removing all rate limit exemptions")
+		device.SetRatelimitExempt(nil)
+
+	case "ratelimit_exempt":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set ratelimit_exempt: %w", err)
+		}
+		device.log.Verbosef("UAPI: Adding rate limit exemption")
+		prefixes, _ := device.RatelimitExempt()
+		device.SetRatelimitExempt(append(prefixes, prefix))
+
 	case "replace_peers":
 		if value != "true" {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set replace_peers, invalid value: %v", value)
@@ -241,7 +548,7 @@ func (device *Device) handleDeviceLine(key, value string) error {
 		device.RemoveAllPeers()
 
 	default:
-		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
+		return ipcErrorf(ipc.IpcErrorInvalid, "%w: invalid UAPI device key: %v", ErrProtocolViolation, key)
 	}
 
 	return nil
@@ -253,6 +560,65 @@ type ipcSetPeer struct {
 	dummy   bool // dummy reports whether this peer is a temporary, placeholder peer
 	created bool // new reports whether this is a newly created peer
 	pkaOn   bool // pkaOn reports whether the peer had the persistent keepalive turn on
+	journal *ipcSetJournal
+}
+
+// An ipcSetJournal records the peers and allowed IPs changed by an IPC set
+// operation, so that they can be restored if the operation exceeds a limit.
+type ipcSetJournal struct {
+	created    map[*Peer]bool
+	allowedIPs map[*Peer][]netip.Prefix // allowed IPs of pre-existing peers before the operation
+}
+
+func (journal *ipcSetJournal) peerCreated(peer *Peer) {
+	if journal.created == nil {
+		journal.created = make(map[*Peer]bool)
+	}
+	journal.created[peer] = true
+}
+
+// saveAllowedIPs records the allowed IPs of peer, plus extra, unless they were
+// already recorded or peer was created by the operation.
+func (journal *ipcSetJournal) saveAllowedIPs(device *Device, peer *Peer, extra ...netip.Prefix) {
+	if journal.created[peer] {
+		return
+	}
+	if _, ok := journal.allowedIPs[peer]; ok {
+		return
+	}
+	if journal.allowedIPs == nil {
+		journal.allowedIPs = make(map[*Peer][]netip.Prefix)
+	}
+	prefixes := extra
+	device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
+		prefixes = append(prefixes, prefix)
+		return true
+	})
+	journal.allowedIPs[peer] = prefixes
+}
+
+func (journal *ipcSetJournal) rollback(device *Device) {
+	device.peers.Lock()
+	defer device.peers.Unlock()
+
+	for peer := range journal.created {
+		key := peer.handshake.remoteStatic
+		if device.peers.keyMap[key] == peer {
+			removePeerLocked(device, peer, key)
+		}
+	}
+	for peer := range journal.allowedIPs {
+		device.allowedips.RemoveByPeer(peer)
+	}
+	for peer, prefixes := range journal.allowedIPs {
+		if device.peers.keyMap[peer.handshake.remoteStatic] != peer {
+			continue
+		}
+		for _, prefix := range prefixes {
+			device.allowedips.Insert(prefix, peer)
+		}
+	}
+	device.log.Verbosef("UAPI: Rolled back peers and allowed IPs after exceeding a limit")
 }
 
 func (peer *ipcSetPeer) handlePostConfig() {
@@ -264,6 +630,7 @@ func (peer *ipcSetPeer) handlePostConfig() {
 	}
 	if peer.device.isUp() {
 		peer.Start()
+		peer.refreshKeepaliveOffload()
 		if peer.pkaOn {
 			peer.SendKeepalive()
 		}
@@ -279,23 +646,15 @@ func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error
 		return ipcErrorf(ipc.IpcErrorInvalid, "failed to get peer by public key: %w", err)
 	}
 
-	// Ignore peer with the same public key as this device.
-	device.staticIdentity.RLock()
-	peer.dummy = device.staticIdentity.publicKey.Equals(publicKey)
-	device.staticIdentity.RUnlock()
-
-	if peer.dummy {
-		peer.Peer = &Peer{}
-	} else {
-		peer.Peer = device.LookupPeer(publicKey)
-	}
-
+	peer.dummy = false
+	peer.Peer = device.LookupPeer(publicKey)
 	peer.created = peer.Peer == nil
 	if peer.created {
 		peer.Peer, err = device.NewPeer(publicKey)
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to create new peer: %w", err)
 		}
+		peer.journal.peerCreated(peer.Peer)
 		device.log.Verbosef("%v - UAPI: Created", peer.Peer)
 	}
 	return nil
@@ -337,15 +696,54 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set preshared key: %w", err)
 		}
 
+	case "preshared_key_passphrase":
+		if value == "" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set preshared key: %w: empty passphrase", ErrInvalidKey)
+		}
+		if peer.dummy {
+			return nil
+		}
+		device.staticIdentity.RLock()
+		self := device.staticIdentity.publicKey
+		sk, inMemory := device.staticIdentity.ops.backend().(NoisePrivateKey)
+		device.staticIdentity.RUnlock()
+		if inMemory && sk.IsZero() {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set preshared key: %w: passphrase needs the private key set first", ErrInvalidKey)
+		}
+		device.log.Verbosef("%v - UAPI: Deriving preshared key from passphrase", peer.Peer)
+		psk := PresharedKeyFromPassphrase(value, PresharedKeySalt(self, peer.handshake.remoteStatic))
+
+		peer.handshake.mutex.Lock()
+		peer.handshake.presharedKey = psk
+		peer.handshake.mutex.Unlock()
+
 	case "endpoint":
 		device.log.Verbosef("%v - UAPI: Updating endpoint", peer.Peer)
+		device.net.RLock()
 		endpoint, err := device.net.bind.ParseEndpoint(value)
+		device.net.RUnlock()
 		if err != nil {
+			if !errors.Is(err, ErrInvalidEndpoint) {
+				err = fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
+			}
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint %v: %w", value, err)
 		}
 		peer.endpoint.Lock()
 		defer peer.endpoint.Unlock()
-		peer.endpoint.val = endpoint
+		peer.setConfiguredEndpoint(endpoint)
+
+	case "source":
+		device.log.Verbosef("%v - UAPI: Updating transport source", peer.Peer)
+		var src netip.Addr
+		if value != "" {
+			var err error
+			if src, err = netip.ParseAddr(value); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set source %v: %w", value, err)
+			}
+		}
+		if err := peer.SetTransportSource(src); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set source %v: %w", value, err)
+		}
 
 	case "persistent_keepalive_interval":
 		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
@@ -360,6 +758,33 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		// Send immediate keepalive if we're turning it on and before it wasn't on.
 		peer.pkaOn = old == 0 && secs != 0
 
+	case "watchdog_window":
+		device.log.Verbosef("%v - UAPI: Updating watchdog window", peer.Peer)
+		secs, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set watchdog_window: %w", err)
+		}
+		peer.SetWatchdog(time.Duration(secs) * time.Second)
+
+	case "passive":
+		device.log.Verbosef("%v - UAPI: Updating passive mode", peer.Peer)
+		passive, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set passive, invalid value: %v", value)
+		}
+		peer.SetPassive(passive)
+
+	case "allow_any_source":
+		device.log.Verbosef("%v - UAPI: Updating source address validation", peer.Peer)
+		allow, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set allow_any_source, invalid value: %v", value)
+		}
+		if allow {
+			device.log.Errorf("%v - Source address validation disabled; the peer may impersonate any address", peer.Peer)
+		}
+		peer.SetAllowAnySource(allow)
+
 	case "replace_allowed_ips":
 		device.log.Verbosef("%v - UAPI: Removing all allowedips", peer.Peer)
 		if value != "true" {
@@ -368,26 +793,107 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		if peer.dummy {
 			return nil
 		}
+		peer.journal.saveAllowedIPs(device, peer.Peer)
 		device.allowedips.RemoveByPeer(peer.Peer)
 
 	case "allowed_ip":
 		device.log.Verbosef("%v - UAPI: Adding allowedip", peer.Peer)
 		prefix, err := netip.ParsePrefix(value)
 		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set allowed ip: %w", err)
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set allowed ip: %w: %w", ErrInvalidAllowedIP, err)
 		}
 		if peer.dummy {
 			return nil
 		}
-		device.allowedips.Insert(prefix, peer.Peer)
+		peer.journal.saveAllowedIPs(device, peer.Peer)
+		previous, err := device.insertAllowedIP(prefix, peer.Peer)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set allowed ip %v: %w", prefix, err)
+		}
+		if previous != nil && previous != peer.Peer {
+			peer.journal.saveAllowedIPs(device, previous, prefix)
+		}
+
+	case "remove_allowed_ip":
+		device.log.Verbosef("%v - UAPI: Removing allowedip", peer.Peer)
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to remove allowed ip: %w: %w", ErrInvalidAllowedIP, err)
+		}
+		if peer.dummy {
+			return nil
+		}
+		peer.journal.saveAllowedIPs(device, peer.Peer)
+		if err := device.allowedips.removeExact(prefix.Masked(), peer.Peer); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to remove allowed ip %v: %w", prefix, err)
+		}
+
+	case "replace_ingress_allowed_ips":
+		device.log.Verbosef("%v - UAPI: Validating sources against allowedips", peer.Peer)
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to replace ingress allowedips, invalid value: %v", value)
+		}
+		peer.SetIngressAllowedIPs(nil)
+
+	case "separate_ingress_allowed_ips":
+		device.log.Verbosef("%v - UAPI: Validating sources against ingress allowedips", peer.Peer)
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to separate ingress allowedips, invalid value: %v", value)
+		}
+		if _, ok := peer.IngressAllowedIPs(); !ok {
+			peer.SetIngressAllowedIPs([]netip.Prefix{})
+		}
+
+	case "ingress_allowed_ip":
+		device.log.Verbosef("%v - UAPI: Adding ingress allowedip", peer.Peer)
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set ingress allowed ip: %w: %w", ErrInvalidAllowedIP, err)
+		}
+		peer.addIngressAllowedIP(prefix)
+
+	case "replace_labels":
+		device.log.Verbosef("%v - UAPI: Removing all labels", peer.Peer)
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to replace labels, invalid value: %v", value)
+		}
+		peer.SetLabels(nil)
+
+	case "transport_cipher":
+		suite, err := ParseCipherSuite(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set transport_cipher: %w", err)
+		}
+		if suite != CipherChaCha20Poly1305 {
+			device.log.Verbosef("%v - UAPI: Transport cipher set to %v; the peer must be set to it too", peer.Peer, suite)
+		}
+		peer.SetCipherSuite(suite)
+
+	case "stacked_transport":
+		device.log.Verbosef("%v - UAPI: Updating stacked transport", peer.Peer)
+		stacked, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set stacked_transport, invalid value: %v", value)
+		}
+		if stacked {
+			device.log.Verbosef("%v - UAPI: Stacked transport enabled; the peer must enable it too", peer.Peer)
+		}
+		peer.SetStackedTransport(stacked)
 
 	case "protocol_version":
 		if value != "1" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "invalid protocol version: %v", value)
+			return ipcErrorf(ipc.IpcErrorInvalid, "%w: invalid protocol version: %v", ErrProtocolViolation, value)
 		}
 
 	default:
-		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI peer key: %v", key)
+		if label, ok := strings.CutPrefix(key, "label."); ok {
+			device.log.Verbosef("%v - UAPI: Updating label", peer.Peer)
+			if err := peer.setLabel(label, value); err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set label: %w", err)
+			}
+			return nil
+		}
+		return ipcErrorf(ipc.IpcErrorInvalid, "%w: invalid UAPI peer key: %v", ErrProtocolViolation, key)
 	}
 
 	return nil
@@ -414,6 +920,12 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		return bufio.NewReadWriter(reader, writer)
 	}(socket)
 
+	// Connections accepted by an ipc.UAPIListener authorize each operation.
+	authorize := func(op string) error { return nil }
+	if conn, ok := socket.(interface{ Authorize(op string) error }); ok {
+		authorize = conn.Authorize
+	}
+
 	for {
 		op, err := buffered.ReadString('\n')
 		if err != nil {
@@ -423,19 +935,55 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		// handle operation
 		switch op {
 		case "set=1\n":
+			if err = ipcAuthorize(authorize, "set"); err != nil {
+				// Skip the refused configuration to reach the next operation.
+				if ipcSkipSet(buffered.Reader) != nil {
+					return
+				}
+				break
+			}
 			err = device.IpcSetOperation(buffered.Reader)
 		case "get=1\n":
+			filter, invalid, readErr := ipcReadGetFilter(buffered.Reader)
+			if readErr != nil {
+				return
+			}
+			if invalid != nil {
+				err = invalid
+				break
+			}
+			if err = ipcAuthorize(authorize, "get"); err == nil {
+				err = device.IpcGetFilteredOperation(buffered.Writer, filter)
+			}
+		case "health=1\n":
 			var nextByte byte
 			nextByte, err = buffered.ReadByte()
 			if err != nil {
 				return
 			}
 			if nextByte != '\n' {
-				err = ipcErrorf(ipc.IpcErrorInvalid, "trailing character in UAPI get: %q", nextByte)
+				err = ipcErrorf(ipc.IpcErrorInvalid, "%w: trailing character in UAPI health: %q", ErrProtocolViolation, nextByte)
 				break
 			}
-			err = device.IpcGetOperation(buffered.Writer)
+			if err = ipcAuthorize(authorize, "get"); err == nil {
+				err = device.IpcHealthOperation(context.Background(), buffered.Writer)
+			}
 		default:
+			if query, ok := strings.CutPrefix(op, "debug="); ok {
+				var nextByte byte
+				nextByte, err = buffered.ReadByte()
+				if err != nil {
+					return
+				}
+				if nextByte != '\n' {
+					err = ipcErrorf(ipc.IpcErrorInvalid, "%w: trailing character in UAPI debug: %q", ErrProtocolViolation, nextByte)
+					break
+				}
+				if err = ipcAuthorize(authorize, "debug"); err == nil {
+					err = device.IpcDebugOperation(buffered.Writer, strings.TrimSuffix(query, "\n"))
+				}
+				break
+			}
 			device.log.Errorf("invalid UAPI operation: %v", op)
 			return
 		}
@@ -455,3 +1003,70 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		buffered.Flush()
 	}
 }
+
+// ipcReadGetFilter reads the lines of a get operation, up to the blank line
+// ending it, each selecting peers: "public_key=<key>", which may repeat, and
+// "filter=handshake_since:<unix seconds>". It returns the IPCError of the
+// first invalid line, if any, and the error reading them.
+func ipcReadGetFilter(r *bufio.Reader) (filter IpcGetFilter, invalid *IPCError, err error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return filter, invalid, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return filter, invalid, nil
+		}
+		if invalid != nil {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "public_key":
+			var publicKey NoisePublicKey
+			if err := publicKey.FromHex(value); err != nil {
+				invalid = ipcErrorf(ipc.IpcErrorInvalid, "failed to get peer by public key: %w", err)
+				continue
+			}
+			filter.PublicKeys = append(filter.PublicKeys, publicKey)
+		case "filter":
+			since, ok := strings.CutPrefix(value, "handshake_since:")
+			secs, err := strconv.ParseInt(since, 10, 64)
+			if !ok || err != nil {
+				invalid = ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI get filter: %q", value)
+				continue
+			}
+			filter.HandshakeSince = time.Unix(secs, 0)
+		default:
+			invalid = ipcErrorf(ipc.IpcErrorInvalid, "%w: invalid UAPI get key: %q", ErrProtocolViolation, key)
+		}
+	}
+}
+
+// ipcAuthorize returns the IPCError refusing op if authorize does.
+func ipcAuthorize(authorize func(op string) error, op string) error {
+	err := authorize(op)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ipc.ErrRateLimited):
+		return ipcErrorf(ipc.IpcErrorRateLimited, "UAPI %s: %w", op, err)
+	default:
+		return ipcErrorf(ipc.IpcErrorPermission, "UAPI %s: %w", op, err)
+	}
+}
+
+// ipcSkipSet reads the lines of a set operation up to its terminating
+// blank line.
+func ipcSkipSet(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line == "\n" {
+			return nil
+		}
+	}
+}
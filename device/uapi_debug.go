@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/darkit/wireguard/ipc"
+)
+
+// IpcDebugOperation implements the "debug" operation, an extension to the
+// WireGuard configuration protocol that reports diagnostic state selected by
+// query, using the same key=value line format as the "get" operation.
+func (device *Device) IpcDebugOperation(w io.Writer, query string) error {
+	buf := byteBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer byteBufferPool.Put(buf)
+	sendf := func(format string, args ...any) {
+		fmt.Fprintf(buf, format, args...)
+		buf.WriteByte('\n')
+	}
+
+	switch query {
+	case "unknown_initiations":
+		for _, entry := range device.RecentUnknownInitiations() {
+			sendf("unknown_initiation_endpoint=%s", entry.Source)
+			sendf("time_sec=%d", entry.Time.Unix())
+			sendf("reason=%s", entry.Reason)
+			if entry.Reason == UnknownInitiationUnknownPeer {
+				sendf("public_key=%x", entry.Claimed[:])
+			}
+			sendf("suppressed=%d", entry.Repeated)
+		}
+
+	case "size_histograms":
+		histogramf := func(h SizeHistogram) {
+			for i := range h.TX {
+				sendf("size_bucket_limit=%d", SizeHistogramBucketLimit(i))
+				sendf("tx_packets=%d", h.TX[i])
+				sendf("rx_packets=%d", h.RX[i])
+			}
+		}
+		histogramf(device.SizeHistogram())
+		if device.peerSizeHistograms.Load() {
+			device.peers.RLock()
+			for key, peer := range device.peers.keyMap {
+				sendf("public_key=%x", key[:])
+				histogramf(peer.SizeHistogram())
+			}
+			device.peers.RUnlock()
+		}
+
+	case "ratelimit_exempt":
+		prefixes, hits := device.RatelimitExempt()
+		for i, prefix := range prefixes {
+			sendf("ratelimit_exempt=%v", prefix)
+			sendf("hits=%d", hits[i])
+		}
+
+	case "ratelimit_bans":
+		for _, ban := range device.RatelimitBans() {
+			sendf("ratelimit_ban=%v", ban.Addr)
+			sendf("expires_sec=%d", ban.Expires.Unix())
+			sendf("drops=%d", ban.Drops)
+			sendf("denied=%d", ban.Denied)
+		}
+
+	case "keypairs":
+		device.peers.RLock()
+		for key, peer := range device.peers.keyMap {
+			sendf("public_key=%x", key[:])
+			for _, info := range peer.KeypairInfo() {
+				sendf("keypair=%s created_sec=%d initiator=%t local_index=%d remote_index=%d send_nonce=%d receive_nonce=%d",
+					info.Slot, info.Created.Unix(), info.Initiator, info.LocalIndex, info.RemoteIndex, info.SendNonce, info.ReceiveNonce)
+			}
+		}
+		device.peers.RUnlock()
+
+	default:
+		return ipcErrorf(ipc.IpcErrorInvalid, "%w: invalid UAPI debug query: %v", ErrProtocolViolation, query)
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+	}
+	return nil
+}
+
+func (device *Device) IpcDebug(query string) (string, error) {
+	buf := new(strings.Builder)
+	if err := device.IpcDebugOperation(buf, query); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
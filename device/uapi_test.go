@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/ipc"
+)
+
+// addTestPeers adds n peers with random keys to dev.
+func addTestPeers(tb testing.TB, dev *Device, n int) {
+	tb.Helper()
+	for range n {
+		sk, err := newPrivateKey()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := dev.NewPeer(sk.publicKey()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestIpcGetFiltered(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	addTestPeers(t, dev, 3)
+	handshaken := pair[1].dev.staticIdentity.publicKey.Hex()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go dev.IpcHandle(server)
+	r := bufio.NewReader(client)
+	get := func(request string) (keys []string, errno string) {
+		t.Helper()
+		if _, err := client.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key, ok := strings.CutPrefix(line, "public_key="); ok {
+				keys = append(keys, strings.TrimSpace(key))
+			}
+			if strings.HasPrefix(line, "errno=") {
+				r.ReadString('\n')
+				return keys, strings.TrimSpace(line)
+			}
+		}
+	}
+
+	if keys, errno := get("get=1\n\n"); len(keys) != 4 || errno != "errno=0" {
+		t.Errorf("get: %d peers, %s, want 4 peers", len(keys), errno)
+	}
+	for _, tt := range []struct {
+		name    string
+		request string
+	}{
+		{"public_key", "get=1\npublic_key=" + handshaken + "\n\n"},
+		{"handshake_since", fmt.Sprintf("get=1\nfilter=handshake_since:%d\n\n", time.Now().Add(-time.Minute).Unix())},
+	} {
+		if keys, errno := get(tt.request); len(keys) != 1 || keys[0] != handshaken || errno != "errno=0" {
+			t.Errorf("get by %s: peers %q, %s, want only %s", tt.name, keys, errno, handshaken)
+		}
+	}
+	if keys, errno := get(fmt.Sprintf("get=1\nfilter=handshake_since:%d\n\n", time.Now().Add(time.Minute).Unix())); len(keys) != 0 || errno != "errno=0" {
+		t.Errorf("get by future handshake: peers %q, %s, want none", keys, errno)
+	}
+
+	// Invalid queries fail as a whole, without losing sync.
+	for _, request := range []string{
+		"get=1\npublic_key=zz\n\n",
+		"get=1\nfilter=handshake_since:soon\npublic_key=" + handshaken + "\n\n",
+		"get=1\nprivate_key=" + handshaken + "\n\n",
+	} {
+		if keys, errno := get(request); len(keys) != 0 || errno != fmt.Sprintf("errno=%d", ipc.IpcErrorInvalid) {
+			t.Errorf("%q: peers %q, %s, want errno=%d", request, keys, errno, ipc.IpcErrorInvalid)
+		}
+	}
+	if keys, errno := get("get=1\n\n"); len(keys) != 4 || errno != "errno=0" {
+		t.Errorf("get after invalid queries: %d peers, %s, want 4 peers", len(keys), errno)
+	}
+}
+
+// slowWriter discards writes, each after a delay.
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(p), nil
+}
+
+// BenchmarkIpcGetSlowReader measures handshakes of a device with many peers
+// while a slow UAPI client keeps draining their configuration.
+func BenchmarkIpcGetSlowReader(b *testing.B) {
+	pair := genTestPair(b, true)
+	pair.Send(b, Ping, nil)
+	dev := pair[0].dev
+	addTestPeers(b, dev, 10000)
+	peer := pair[1].dev.LookupPeer(dev.staticIdentity.publicKey)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := dev.IpcGetOperation(slowWriter{10 * time.Millisecond}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	var handshakes time.Duration
+	b.ResetTimer()
+	for range b.N {
+		// Initiations closer than HandshakeInitationRate are dropped.
+		time.Sleep(HandshakeInitationRate)
+		before := peer.keypairs.Current()
+		peer.handshake.mutex.Lock()
+		peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+		peer.handshake.mutex.Unlock()
+
+		start := time.Now()
+		peer.SendHandshakeInitiation(false)
+		for peer.keypairs.Current() == before {
+			if time.Since(start) > 5*time.Second {
+				b.Fatal("handshake did not complete")
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+		handshakes += time.Since(start)
+	}
+	b.ReportMetric(float64(handshakes.Microseconds())/float64(b.N), "handshake-us")
+}
@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "time"
+
+// DefaultPeerWatchdogWindow is the suggested window for SetPeerWatchdog.
+const DefaultPeerWatchdogWindow = 3 * KeepaliveTimeout
+
+// SetPeerWatchdog enables the stalled peer watchdog. When data has been sent
+// to a peer but no transport packet, not even a passive keepalive, has come
+// back from it within window, the peer's keypairs are cleared and a new
+// handshake is initiated. Flows that are legitimately unidirectional are not
+// affected, because the receiving side answers them with keepalives after
+// KeepaliveTimeout, so window must be well above KeepaliveTimeout. A window of
+// zero disables the watchdog, except for peers given a window of their own
+// with Peer.SetWatchdog.
+func (device *Device) SetPeerWatchdog(window time.Duration) {
+	device.watchdogWindow.Store(int64(max(window, 0)))
+	if window > 0 {
+		return
+	}
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if peer.watchdogWindow.Load() <= 0 {
+			peer.timers.watchdog.Del()
+		}
+	}
+}
+
+// SetWatchdog gives the peer a watchdog window of its own, in place of the
+// device's set by SetPeerWatchdog, such as a longer one for a peer behind a
+// slow link. A negative window disables the watchdog for the peer, and zero
+// restores the device's.
+//
+// With IpcSet, watchdog_window sets it in seconds.
+func (peer *Peer) SetWatchdog(window time.Duration) {
+	peer.watchdogWindow.Store(int64(window))
+	if peer.watchdogTimeout() == 0 {
+		peer.timers.watchdog.Del()
+	}
+}
+
+// watchdogTimeout returns the watchdog window in effect for the peer, zero
+// if the watchdog is disabled for it.
+func (peer *Peer) watchdogTimeout() time.Duration {
+	if window := peer.watchdogWindow.Load(); window != 0 {
+		return time.Duration(max(window, 0))
+	}
+	return time.Duration(peer.device.watchdogWindow.Load())
+}
+
+// WatchdogRecoveries returns how many times the watchdog has restarted the peer's session.
+func (peer *Peer) WatchdogRecoveries() uint64 {
+	return peer.watchdogRecoveries.Load()
+}
+
+// LastWatchdogRecovery returns when the watchdog last restarted the peer's
+// stalled session, or the zero time if it never did.
+func (peer *Peer) LastWatchdogRecovery() time.Time {
+	if nano := peer.lastWatchdogRecovery.Load(); nano != 0 {
+		return time.Unix(0, nano)
+	}
+	return time.Time{}
+}
+
+func expiredWatchdog(peer *Peer) {
+	device := peer.device
+	window := peer.watchdogTimeout()
+	if window == 0 {
+		return
+	}
+	device.log.Verbosef("%s - Session stalled, no reply after %v; clearing keypairs and restarting handshake", peer, window)
+
+	peer.zeroKeyMaterial()
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	peer.watchdogRecoveries.Add(1)
+	peer.lastWatchdogRecovery.Store(device.now().UnixNano())
+	device.emitEvent(EventPeerWatchdogRecovery, peer)
+
+	peer.markEndpointSrcForClearing()
+	peer.SendHandshakeInitiation(false)
+}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun/tuntest"
+)
+
+func TestPeerWatchdog(t *testing.T) {
+	pair := genTestPair(t, false)
+	events := make(chan Event, 1)
+	pair[0].dev.SetEventHandler(func(event Event) {
+		if event.Type == EventPeerStateChanged {
+			return
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	pair[0].dev.SetPeerWatchdog(200 * time.Millisecond)
+
+	// A healthy session answers before the watchdog fires. The window is far
+	// shorter than KeepaliveTimeout here, so dev1 must answer with data.
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+	time.Sleep(400 * time.Millisecond)
+	select {
+	case event := <-events:
+		t.Fatalf("watchdog fired on a healthy session: %+v", event)
+	default:
+	}
+
+	// Silence the remote side and keep sending.
+	if err := pair[1].dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	select {
+	case event := <-events:
+		if event.Type != EventPeerWatchdogRecovery || event.Peer != pair[1].dev.staticIdentity.publicKey {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog did not fire on a stalled session")
+	}
+
+	peer := pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	if n := peer.WatchdogRecoveries(); n != 1 {
+		t.Errorf("WatchdogRecoveries() = %d, want 1", n)
+	}
+	peer.keypairs.RLock()
+	current := peer.keypairs.current
+	peer.keypairs.RUnlock()
+	if current != nil {
+		t.Error("watchdog did not clear the stalled keypair")
+	}
+	if last := peer.LastWatchdogRecovery(); time.Since(last) > 5*time.Second {
+		t.Errorf("LastWatchdogRecovery() = %v, want the recovery just made", last)
+	}
+
+	// A peer may opt out of the device's watchdog.
+	peer.SetWatchdog(-1)
+	if window := peer.watchdogTimeout(); window != 0 {
+		t.Errorf("watchdog window %v after opting out", window)
+	}
+}
+
+func TestPeerWatchdogWindow(t *testing.T) {
+	pair := genTestPair(t, false)
+	events := make(chan Event, 1)
+	pair[0].dev.SetEventHandler(func(event Event) {
+		if event.Type == EventPeerWatchdogRecovery {
+			select {
+			case events <- event:
+			default:
+			}
+		}
+	})
+	pair.Send(t, Ping, nil)
+
+	// The device has no watchdog, but the peer has one of its own.
+	if err := pair[0].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pair[1].dev.staticIdentity.publicKey[:]),
+		"update_only", "true",
+		"watchdog_window", "1",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pair[1].dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer's own watchdog did not fire on a stalled session")
+	}
+
+	config, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"watchdog_window=1\n", "watchdog_recoveries=1\n", "last_watchdog_recovery_sec="} {
+		if !strings.Contains(config, line) {
+			t.Errorf("IpcGet missing %q:\n%s", line, config)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/* Key material the package holds itself is wiped as soon as it is no longer
+ * needed: the transport keys of a keypair once its AEADs are built from them,
+ * the session state of a handshake once it is done or abandoned, the keys of
+ * a peer once it is removed, and the static private key on Zeroize. The
+ * AEADs, whose copies of the keys live in the crypto packages, are dropped
+ * for the garbage collector by DeleteKeypair instead, as are copies the
+ * runtime makes. This is best effort.
+ */
+
+var errZeroizeOpen = errors.New("device not closed")
+
+// Zeroize wipes the static private key of a closed device, after Close has
+// wiped the keys of its peers and their handshakes. It returns an error,
+// wiping nothing, if the device is not closed. The private key operations
+// are dropped rather than wiped, so keys held by the backend of
+// SetPrivateKeyOperations are left to it.
+func (device *Device) Zeroize() error {
+	if !device.isClosed() {
+		return errZeroizeOpen
+	}
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+	setZero(device.staticIdentity.privateKey[:])
+	device.staticIdentity.ops = nil
+	return nil
+}
+
+// setKeys builds the AEADs of the keypair from the transport keys derived by
+// the handshake, and wipes the keys.
+func (keypair *Keypair) setKeys(sendKey, recvKey *[chacha20poly1305.KeySize]byte) {
+	keypair.send, _ = keypair.suite.newAEAD(sendKey[:])
+	keypair.receive, _ = keypair.suite.newAEAD(recvKey[:])
+	setZero(sendKey[:])
+	setZero(recvKey[:])
+}
+
+// zeroize wipes all the key material of the handshake, including the
+// preshared key and the static-static shared secret, for a removed peer.
+// handshake.mutex must be held.
+func (h *Handshake) zeroize() {
+	h.Clear()
+	setZero(h.presharedKey[:])
+	setZero(h.precomputedStaticStatic[:])
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+)
+
+// sentinelKey is a key pattern searched for in memory once wiped.
+var sentinelKey = bytes.Repeat([]byte{0x5a}, 32)
+
+// memoryOf returns the memory of the value p points to.
+func memoryOf[T any](p *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(p)), unsafe.Sizeof(*p))
+}
+
+func TestZeroize(t *testing.T) {
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	var sk NoisePrivateKey
+	copy(sk[:], sentinelKey)
+	if err := dev.SetPrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	// The memory the handshakes take the private key from.
+	backend := memoryOf(dev.staticIdentity.ops.backend().(*NoisePrivateKey))
+	if !bytes.Equal(backend, sentinelKey) {
+		t.Fatal("private key operations do not use the key set")
+	}
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+	peer.handshake.mutex.Lock()
+	copy(peer.handshake.presharedKey[:], sentinelKey)
+	peer.handshake.mutex.Unlock()
+
+	if err := dev.Zeroize(); err == nil {
+		t.Error("Zeroize of an open device succeeded")
+	}
+	dev.Close()
+	if bytes.Contains(memoryOf(&peer.handshake), sentinelKey) || !isZero(peer.handshake.precomputedStaticStatic[:]) {
+		t.Error("Close left key material in the handshake of a peer")
+	}
+
+	if err := dev.Zeroize(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(memoryOf(&dev.staticIdentity), sentinelKey) || bytes.Contains(backend, sentinelKey) || dev.staticIdentity.ops != nil {
+		t.Error("Zeroize left the private key")
+	}
+}
+
+func TestZeroizeReplacedPrivateKey(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	var sk NoisePrivateKey
+	copy(sk[:], sentinelKey)
+	if err := dev.SetPrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	backend := memoryOf(dev.staticIdentity.ops.backend().(*NoisePrivateKey))
+	other, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetPrivateKey(other); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(backend, sentinelKey) {
+		t.Error("replaced private key left in the memory of its operations")
+	}
+}
+
+func TestKeypairSetKeys(t *testing.T) {
+	var sendKey, recvKey [32]byte
+	copy(sendKey[:], sentinelKey)
+	copy(recvKey[:], sentinelKey)
+	keypair := new(Keypair)
+	keypair.setKeys(&sendKey, &recvKey)
+	if !isZero(sendKey[:]) || !isZero(recvKey[:]) {
+		t.Error("setKeys left the transport keys")
+	}
+	if keypair.send == nil || keypair.receive == nil {
+		t.Error("setKeys built no AEADs")
+	}
+}
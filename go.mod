@@ -11,5 +11,6 @@ require (
 
 require (
 	github.com/google/btree v1.1.2 // indirect
+	golang.org/x/text v0.21.0 // indirect
 	golang.org/x/time v0.7.0 // indirect
 )
@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDenied is returned by Conn.Authorize for operations the
+	// listener's authorizer refuses.
+	ErrDenied = errors.New("UAPI operation denied")
+
+	// ErrRateLimited is returned by Conn.Authorize for set operations
+	// exceeding the listener's rate limit.
+	ErrRateLimited = errors.New("UAPI set operations rate limited")
+)
+
+// PeerCredentials identifies the process at the other end of a UAPI
+// connection. Fields the platform does not report are -1 or empty: UID and
+// GID are only known on Unix, and SID only on Windows.
+type PeerCredentials struct {
+	PID int
+	UID int
+	GID int
+	SID string
+}
+
+// Authorizer reports whether the process identified by cred may perform op,
+// which is "get", "set" or "debug".
+type Authorizer func(cred PeerCredentials, op string) bool
+
+// AllowAll is the default Authorizer, allowing every operation. The
+// permissions of the socket or pipe still restrict who may connect.
+func AllowAll(cred PeerCredentials, op string) bool {
+	return true
+}
+
+// uapiAuth is the authorization state a UAPIListener shares with the
+// connections it accepts.
+type uapiAuth struct {
+	mu        sync.RWMutex
+	authorize Authorizer
+	every     time.Duration
+	burst     int
+}
+
+// SetAuthorizer sets the function consulted for each operation on the
+// connections of the listener, including those already accepted. A nil fn
+// restores AllowAll.
+func (a *uapiAuth) SetAuthorizer(fn Authorizer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.authorize = fn
+}
+
+// SetRateLimit limits set operations on each connection of the listener to
+// one per every on average, with bursts of up to burst. An every of zero,
+// the default, removes the limit.
+func (a *uapiAuth) SetRateLimit(every time.Duration, burst int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.every = every
+	a.burst = max(burst, 1)
+}
+
+func (a *uapiAuth) wrap(c net.Conn, cred PeerCredentials) net.Conn {
+	return &Conn{Conn: c, cred: cred, auth: a}
+}
+
+// Conn is a connection accepted by a UAPIListener.
+type Conn struct {
+	net.Conn
+	cred PeerCredentials
+	auth *uapiAuth
+
+	// sets is the point up to which the rate limit has admitted set
+	// operations, advanced by every for each.
+	sets time.Time
+}
+
+// PeerCredentials returns the credentials of the process that connected.
+func (c *Conn) PeerCredentials() PeerCredentials {
+	return c.cred
+}
+
+// Authorize returns ErrDenied if the listener's authorizer refuses op, and
+// ErrRateLimited if op is a set operation beyond the rate limit. It is
+// called once per operation by the handler of the connection.
+func (c *Conn) Authorize(op string) error {
+	c.auth.mu.RLock()
+	authorize, every, burst := c.auth.authorize, c.auth.every, c.auth.burst
+	c.auth.mu.RUnlock()
+	if authorize != nil && !authorize(c.cred, op) {
+		return ErrDenied
+	}
+	if op != "set" || every == 0 {
+		return nil
+	}
+	now := time.Now()
+	if floor := now.Add(-every * time.Duration(burst)); c.sets.Before(floor) {
+		c.sets = floor
+	}
+	if c.sets.After(now.Add(-every)) {
+		return ErrRateLimited
+	}
+	c.sets = c.sets.Add(every)
+	return nil
+}
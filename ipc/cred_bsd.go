@@ -0,0 +1,40 @@
+//go:build darwin || freebsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the credentials of the process connected to c,
+// as reported by LOCAL_PEERCRED, which does not include the PID.
+func peerCredentials(c net.Conn) PeerCredentials {
+	cred := PeerCredentials{PID: -1, UID: -1, GID: -1}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return cred
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return cred
+	}
+	rc.Control(func(fd uintptr) {
+		xucred, err := unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		if err != nil {
+			return
+		}
+		cred.UID = int(xucred.Uid)
+		if xucred.Ngroups > 0 {
+			cred.GID = int(xucred.Groups[0])
+		}
+	})
+	return cred
+}
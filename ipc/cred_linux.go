@@ -0,0 +1,35 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the credentials of the process connected to c,
+// as reported by SO_PEERCRED when the socket was connected.
+func peerCredentials(c net.Conn) PeerCredentials {
+	cred := PeerCredentials{PID: -1, UID: -1, GID: -1}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return cred
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return cred
+	}
+	rc.Control(func(fd uintptr) {
+		ucred, err := unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+		if err != nil {
+			return
+		}
+		cred.PID, cred.UID, cred.GID = int(ucred.Pid), int(ucred.Uid), int(ucred.Gid)
+	})
+	return cred
+}
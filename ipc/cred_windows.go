@@ -0,0 +1,41 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+// peerCredentials returns the PID of the client of the named pipe c and the
+// SID of the user its process runs as.
+func peerCredentials(c net.Conn) PeerCredentials {
+	cred := PeerCredentials{PID: -1, UID: -1, GID: -1}
+	pipe, ok := c.(interface{ Handle() windows.Handle })
+	if !ok {
+		return cred
+	}
+	var pid uint32
+	if windows.GetNamedPipeClientProcessId(pipe.Handle(), &pid) != nil {
+		return cred
+	}
+	cred.PID = int(pid)
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return cred
+	}
+	defer windows.CloseHandle(process)
+	var token windows.Token
+	if windows.OpenProcessToken(process, windows.TOKEN_QUERY, &token) != nil {
+		return cred
+	}
+	defer token.Close()
+	if user, err := token.GetTokenUser(); err == nil {
+		cred.SID = user.User.Sid.String()
+	}
+	return cred
+}
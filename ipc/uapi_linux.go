@@ -14,6 +14,7 @@ import (
 )
 
 type UAPIListener struct {
+	uapiAuth
 	listener        net.Listener // unix socket listener
 	connNew         chan net.Conn
 	connErr         chan error
@@ -25,7 +26,7 @@ func (l *UAPIListener) Accept() (net.Conn, error) {
 	for {
 		select {
 		case conn := <-l.connNew:
-			return conn, nil
+			return l.wrap(conn, peerCredentials(conn)), nil
 
 		case err := <-l.connErr:
 			return nil, err
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUAPIListenerAuthorize(t *testing.T) {
+	socketDirectory = t.TempDir()
+	file, err := UAPIOpen("wgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	ln, err := UAPIListen("wgtest", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	uapi := ln.(*UAPIListener)
+
+	client, err := net.Dial("unix", sockPath("wgtest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := c.(*Conn)
+
+	want := PeerCredentials{PID: os.Getpid(), UID: os.Getuid(), GID: os.Getgid()}
+	if cred := conn.PeerCredentials(); cred != want {
+		t.Errorf("PeerCredentials() = %+v, want %+v", cred, want)
+	}
+	if err := conn.Authorize("set"); err != nil {
+		t.Errorf("default authorizer refused set: %v", err)
+	}
+
+	// The authorizer applies to connections already accepted.
+	uapi.SetAuthorizer(func(cred PeerCredentials, op string) bool {
+		return cred == want && op == "get"
+	})
+	if err := conn.Authorize("get"); err != nil {
+		t.Errorf("Authorize(get) = %v, want nil", err)
+	}
+	if err := conn.Authorize("set"); !errors.Is(err, ErrDenied) {
+		t.Errorf("Authorize(set) = %v, want %v", err, ErrDenied)
+	}
+
+	uapi.SetAuthorizer(nil)
+	uapi.SetRateLimit(time.Hour, 3)
+	for i := 0; i < 3; i++ {
+		if err := conn.Authorize("set"); err != nil {
+			t.Fatalf("set %d within the burst: %v", i, err)
+		}
+	}
+	if err := conn.Authorize("set"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("set beyond the burst: got %v, want %v", err, ErrRateLimited)
+	}
+	if err := conn.Authorize("get"); err != nil {
+		t.Errorf("get rate limited: %v", err)
+	}
+	uapi.SetRateLimit(0, 0)
+	if err := conn.Authorize("set"); err != nil {
+		t.Errorf("set after removing the rate limit: %v", err)
+	}
+}
@@ -22,6 +22,9 @@ const (
 	IpcErrorInvalid   = -int64(unix.EINVAL)
 	IpcErrorPortInUse = -int64(unix.EADDRINUSE)
 	IpcErrorUnknown   = -55 // ENOANO
+
+	IpcErrorPermission  = -int64(unix.EACCES)
+	IpcErrorRateLimited = -int64(unix.EAGAIN)
 )
 
 // socketDirectory is variable because it is modified by a linker
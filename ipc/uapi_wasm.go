@@ -12,4 +12,7 @@ const (
 	IpcErrorPortInUse = 3
 	IpcErrorUnknown   = 4
 	IpcErrorProtocol  = 5
+
+	IpcErrorPermission  = 6
+	IpcErrorRateLimited = 7
 )
@@ -19,9 +19,13 @@ const (
 	IpcErrorInvalid   = -int64(22)
 	IpcErrorPortInUse = -int64(98)
 	IpcErrorUnknown   = -int64(55)
+
+	IpcErrorPermission  = -int64(13)
+	IpcErrorRateLimited = -int64(11)
 )
 
 type UAPIListener struct {
+	uapiAuth
 	listener net.Listener // unix socket listener
 	connNew  chan net.Conn
 	connErr  chan error
@@ -33,7 +37,7 @@ func (l *UAPIListener) Accept() (net.Conn, error) {
 	for {
 		select {
 		case conn := <-l.connNew:
-			return conn, nil
+			return l.wrap(conn, peerCredentials(conn)), nil
 
 		case err := <-l.connErr:
 			return nil, err
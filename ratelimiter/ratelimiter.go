@@ -6,8 +6,11 @@
 package ratelimiter
 
 import (
+	"cmp"
 	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,13 +19,18 @@ const (
 	packetsBurstable   = 5
 	garbageCollectTime = time.Second
 	packetCost         = 1000000000 / packetsPerSecond
-	maxTokens          = packetCost * packetsBurstable
 )
 
 type RatelimiterEntry struct {
 	mu       sync.Mutex
 	lastTime time.Time
 	tokens   int64
+
+	// Packets denied in the current and previous abuse windows, the
+	// current one starting at windowStart.
+	windowStart time.Time
+	drops       uint64
+	prevDrops   uint64
 }
 
 type Ratelimiter struct {
@@ -31,6 +39,236 @@ type Ratelimiter struct {
 
 	stopReset chan struct{} // send to reset, close to stop
 	table     map[netip.Addr]*RatelimiterEntry
+
+	costs  [2]atomic.Int64 // IPv4 and IPv6 packet costs, 0 for packetCost
+	exempt atomic.Pointer[[]*exemptPrefix]
+
+	abuse   atomic.Pointer[AbusePolicy]
+	onAbuse atomic.Pointer[func(netip.Addr, uint64)]
+	bans    map[netip.Addr]*ban // guarded by mu
+}
+
+// An AbusePolicy sets when a source denied by the Ratelimiter is considered
+// abusive, and for how long it is then banned.
+type AbusePolicy struct {
+	// Drops is the number of packets that must be denied to a source within
+	// Window for it to be abusive. Zero disables abuse detection.
+	Drops uint64
+
+	// Window is the length of the sliding window over which denied packets
+	// are counted. It is approximated by weighing the count of the previous
+	// window by the part of it still within the sliding one.
+	Window time.Duration
+
+	// BanDuration is how long an abusive source is denied all packets,
+	// without being accounted. Zero reports abuse without banning.
+	BanDuration time.Duration
+}
+
+// A Ban is a source denied all packets until it expires.
+type Ban struct {
+	Addr    netip.Addr
+	Expires time.Time
+	Drops   uint64 // packets denied within the window that caused the ban
+	Denied  uint64 // packets denied since the ban
+}
+
+type ban struct {
+	expires time.Time
+	drops   uint64
+	denied  atomic.Uint64
+}
+
+// SetAbusePolicy sets when sources are considered abusive. It applies to
+// packets denied from now on; existing bans run until they expire.
+func (rate *Ratelimiter) SetAbusePolicy(policy AbusePolicy) {
+	if policy.Drops == 0 || policy.Window <= 0 {
+		rate.abuse.Store(nil)
+		return
+	}
+	rate.abuse.Store(&policy)
+}
+
+// OnSustainedAbuse registers fn to be called when a source becomes abusive
+// under the AbusePolicy, with the number of its packets denied in the window,
+// replacing any previous callback. A nil fn removes the callback. fn is
+// called once per ban, or when BanDuration is zero, once per Drops packets
+// denied, synchronously from Allow, so it must not block.
+func (rate *Ratelimiter) OnSustainedAbuse(fn func(addr netip.Addr, droppedInWindow uint64)) {
+	if fn == nil {
+		rate.onAbuse.Store(nil)
+		return
+	}
+	rate.onAbuse.Store(&fn)
+}
+
+// Bans returns the sources currently banned, sorted by address.
+func (rate *Ratelimiter) Bans() []Ban {
+	rate.mu.RLock()
+	defer rate.mu.RUnlock()
+
+	now := rate.timeNow()
+	bans := make([]Ban, 0, len(rate.bans))
+	for addr, b := range rate.bans {
+		if now.Before(b.expires) {
+			bans = append(bans, Ban{addr, b.expires, b.drops, b.denied.Load()})
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return a.Addr.Compare(b.Addr)
+	})
+	return bans
+}
+
+// isBanned reports whether ip is banned, counting a denied packet if so.
+// It must be called with mu held for reading.
+func (rate *Ratelimiter) isBanned(ip netip.Addr) bool {
+	if len(rate.bans) == 0 {
+		return false
+	}
+	b := rate.bans[ip]
+	if b == nil || !rate.timeNow().Before(b.expires) {
+		return false
+	}
+	b.denied.Add(1)
+	return true
+}
+
+// countDrop accounts for denying a packet of the entry at now under policy, and
+// reports whether the source has become abusive, along with the number of
+// packets denied within the window. It must be called with entry.mu held.
+func (entry *RatelimiterEntry) countDrop(now time.Time, policy *AbusePolicy) (abusive bool, drops uint64) {
+	if elapsed := now.Sub(entry.windowStart); elapsed >= 2*policy.Window {
+		entry.windowStart, entry.drops, entry.prevDrops = now, 0, 0
+	} else if elapsed >= policy.Window {
+		entry.windowStart = entry.windowStart.Add(policy.Window)
+		entry.drops, entry.prevDrops = 0, entry.drops
+	}
+	entry.drops++
+	remaining := policy.Window - now.Sub(entry.windowStart)
+	drops = entry.drops + uint64(float64(entry.prevDrops)*float64(remaining)/float64(policy.Window))
+	if drops < policy.Drops {
+		return false, drops
+	}
+	entry.drops, entry.prevDrops = 0, 0
+	return true, drops
+}
+
+// escalate bans ip, if the policy asks for it, and reports it as abusive.
+func (rate *Ratelimiter) escalate(ip netip.Addr, drops uint64, policy *AbusePolicy) {
+	if policy.BanDuration > 0 {
+		rate.mu.Lock()
+		rate.bans[ip] = &ban{expires: rate.timeNow().Add(policy.BanDuration), drops: drops}
+		rate.mu.Unlock()
+	}
+	if fn := rate.onAbuse.Load(); fn != nil {
+		(*fn)(ip, drops)
+	}
+}
+
+// exemptPrefix is an entry of the sorted, non-overlapping exemption list.
+type exemptPrefix struct {
+	prefix netip.Prefix
+	hits   atomic.Uint64
+}
+
+// SetPacketsPerSecond sets the sustained rate at which packets from a single
+// IPv4 or IPv6 source are allowed. The burst allowance stays at five packets,
+// so a lower rate also refills it more slowly. IPv6 sources are cheap to vary
+// and may deserve a stricter rate. A rate of zero restores the default of 20.
+func (rate *Ratelimiter) SetPacketsPerSecond(v4, v6 int) {
+	for i, pps := range [2]int{v4, v6} {
+		var cost int64
+		if pps > 0 {
+			cost = max(time.Second.Nanoseconds()/int64(pps), 1)
+		}
+		rate.costs[i].Store(cost)
+	}
+}
+
+func (rate *Ratelimiter) cost(ip netip.Addr) int64 {
+	family := 0
+	if !ip.Unmap().Is4() {
+		family = 1
+	}
+	if cost := rate.costs[family].Load(); cost != 0 {
+		return cost
+	}
+	return packetCost
+}
+
+// SetExempt replaces the list of source prefixes that are always allowed,
+// without being accounted. Hit counts of prefixes that remain in the list
+// are kept.
+func (rate *Ratelimiter) SetExempt(prefixes []netip.Prefix) {
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix.IsValid() {
+			sorted = append(sorted, prefix.Masked())
+		}
+	}
+	slices.SortFunc(sorted, func(a, b netip.Prefix) int {
+		return cmp.Or(a.Addr().Compare(b.Addr()), a.Bits()-b.Bits())
+	})
+
+	var old []*exemptPrefix
+	if list := rate.exempt.Load(); list != nil {
+		old = *list
+	}
+	list := make([]*exemptPrefix, 0, len(sorted))
+	for _, prefix := range sorted {
+		// Prefixes either nest or are disjoint, so after sorting, a prefix
+		// overlaps the list only if the last one kept contains it.
+		if len(list) > 0 && list[len(list)-1].prefix.Overlaps(prefix) {
+			continue
+		}
+		entry := &exemptPrefix{prefix: prefix}
+		if i, ok := slices.BinarySearchFunc(old, prefix, comparePrefix); ok {
+			entry.hits.Store(old[i].hits.Load())
+		}
+		list = append(list, entry)
+	}
+	rate.exempt.Store(&list)
+}
+
+func comparePrefix(entry *exemptPrefix, prefix netip.Prefix) int {
+	return cmp.Or(entry.prefix.Addr().Compare(prefix.Addr()), entry.prefix.Bits()-prefix.Bits())
+}
+
+// Exempt returns the prefixes exempt from rate limiting and the number of
+// packets allowed because of each. Prefixes contained in others passed to
+// SetExempt are not listed.
+func (rate *Ratelimiter) Exempt() (prefixes []netip.Prefix, hits []uint64) {
+	list := rate.exempt.Load()
+	if list == nil {
+		return nil, nil
+	}
+	for _, entry := range *list {
+		prefixes = append(prefixes, entry.prefix)
+		hits = append(hits, entry.hits.Load())
+	}
+	return
+}
+
+// isExempt reports whether ip is in an exempt prefix, counting a hit if so.
+func (rate *Ratelimiter) isExempt(ip netip.Addr) bool {
+	list := rate.exempt.Load()
+	if list == nil || len(*list) == 0 {
+		return false
+	}
+	ip = ip.Unmap()
+	i, found := slices.BinarySearchFunc(*list, ip, func(entry *exemptPrefix, ip netip.Addr) int {
+		return entry.prefix.Addr().Compare(ip)
+	})
+	if !found {
+		// The closest candidate is the last prefix starting before ip.
+		if i == 0 || !(*list)[i-1].prefix.Contains(ip) {
+			return false
+		}
+		i--
+	}
+	(*list)[i].hits.Add(1)
+	return true
 }
 
 func (rate *Ratelimiter) Close() {
@@ -57,6 +295,7 @@ func (rate *Ratelimiter) Init() {
 
 	rate.stopReset = make(chan struct{})
 	rate.table = make(map[netip.Addr]*RatelimiterEntry)
+	rate.bans = make(map[netip.Addr]*ban)
 
 	stopReset := rate.stopReset // store in case Init is called again.
 
@@ -85,28 +324,51 @@ func (rate *Ratelimiter) cleanup() (empty bool) {
 	rate.mu.Lock()
 	defer rate.mu.Unlock()
 
+	// Entries are kept for as long as their denied packets may count
+	// toward abuse, so that a source cannot evade detection by pausing.
+	keep := garbageCollectTime
+	if policy := rate.abuse.Load(); policy != nil {
+		keep = max(keep, 2*policy.Window)
+	}
+	now := rate.timeNow()
 	for key, entry := range rate.table {
 		entry.mu.Lock()
-		if rate.timeNow().Sub(entry.lastTime) > garbageCollectTime {
+		idle := now.Sub(entry.lastTime)
+		if idle > garbageCollectTime && (entry.drops == 0 || idle > keep) {
 			delete(rate.table, key)
 		}
 		entry.mu.Unlock()
 	}
+	for key, b := range rate.bans {
+		if !now.Before(b.expires) {
+			delete(rate.bans, key)
+		}
+	}
 
-	return len(rate.table) == 0
+	return len(rate.table) == 0 && len(rate.bans) == 0
 }
 
 func (rate *Ratelimiter) Allow(ip netip.Addr) bool {
+	if rate.isExempt(ip) {
+		return true
+	}
+	cost := rate.cost(ip)
+	maxTokens := cost * packetsBurstable
+
 	var entry *RatelimiterEntry
-	// lookup entry
+	// lookup entry, denying banned sources right away
 	rate.mu.RLock()
+	if rate.isBanned(ip) {
+		rate.mu.RUnlock()
+		return false
+	}
 	entry = rate.table[ip]
 	rate.mu.RUnlock()
 
 	// make new entry if not found
 	if entry == nil {
 		entry = new(RatelimiterEntry)
-		entry.tokens = maxTokens - packetCost
+		entry.tokens = maxTokens - cost
 		entry.lastTime = rate.timeNow()
 		rate.mu.Lock()
 		rate.table[ip] = entry
@@ -127,11 +389,20 @@ func (rate *Ratelimiter) Allow(ip netip.Addr) bool {
 	}
 
 	// subtract cost of packet
-	if entry.tokens > packetCost {
-		entry.tokens -= packetCost
+	if entry.tokens > cost {
+		entry.tokens -= cost
 		entry.mu.Unlock()
 		return true
 	}
+	policy := rate.abuse.Load()
+	if policy == nil {
+		entry.mu.Unlock()
+		return false
+	}
+	abusive, drops := entry.countDrop(now, policy)
 	entry.mu.Unlock()
+	if abusive {
+		rate.escalate(ip, drops, policy)
+	}
 	return false
 }
@@ -7,6 +7,7 @@ package ratelimiter
 
 import (
 	"net/netip"
+	"slices"
 	"testing"
 	"time"
 )
@@ -117,3 +118,191 @@ func TestRatelimiter(t *testing.T) {
 		}
 	}
 }
+
+func TestRatelimiterExempt(t *testing.T) {
+	var rate Ratelimiter
+	now := time.Now()
+	rate.timeNow = func() time.Time {
+		return now
+	}
+	rate.Init()
+	defer rate.Close()
+
+	rate.SetExempt([]netip.Prefix{
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("10.1.2.3/8"),
+		netip.MustParsePrefix("10.20.0.0/16"), // inside 10.0.0.0/8
+		netip.MustParsePrefix("192.168.1.0/24"),
+	})
+	prefixes, _ := rate.Exempt()
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	if !slices.Equal(prefixes, want) {
+		t.Fatalf("Exempt() = %v, want %v", prefixes, want)
+	}
+
+	for _, tt := range []struct {
+		ip     string
+		exempt bool
+	}{
+		{"10.0.0.0", true},
+		{"10.20.1.1", true},
+		{"11.0.0.1", false},
+		{"192.168.1.255", true},
+		{"192.168.2.1", false},
+		{"::ffff:192.168.1.1", true},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::1", false},
+		{"::1", false},
+	} {
+		ip := netip.MustParseAddr(tt.ip)
+		allowed := 0
+		for i := 0; i < 2*packetsBurstable; i++ {
+			if rate.Allow(ip) {
+				allowed++
+			}
+		}
+		if exempt := allowed == 2*packetsBurstable; exempt != tt.exempt {
+			t.Errorf("%v: allowed %d of %d packets, want exempt=%v", ip, allowed, 2*packetsBurstable, tt.exempt)
+		}
+	}
+
+	_, hits := rate.Exempt()
+	if want := []uint64{20, 20, 10}; !slices.Equal(hits, want) {
+		t.Errorf("hits = %v, want %v", hits, want)
+	}
+	rate.SetExempt(nil)
+	rate.SetExempt([]netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")})
+	if _, hits := rate.Exempt(); len(hits) != 1 || hits[0] != 0 {
+		t.Errorf("hits = %v after clearing the list, want [0]", hits)
+	}
+}
+
+func TestRatelimiterCosts(t *testing.T) {
+	var rate Ratelimiter
+	now := time.Now()
+	rate.timeNow = func() time.Time {
+		return now
+	}
+	rate.Init()
+	defer rate.Close()
+
+	rate.SetPacketsPerSecond(0, 2)
+	v4, v6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+	for i := 0; i <= packetsBurstable; i++ {
+		rate.Allow(v4)
+		rate.Allow(v6)
+	}
+
+	var allowed4, allowed6 int
+	for i := 0; i < 100; i++ {
+		now = now.Add(10 * time.Millisecond)
+		if rate.Allow(v4) {
+			allowed4++
+		}
+		if rate.Allow(v6) {
+			allowed6++
+		}
+	}
+	if allowed4 != packetsPerSecond || allowed6 != 2 {
+		t.Errorf("allowed %d IPv4 and %d IPv6 packets in a second after the burst, want %d and 2", allowed4, allowed6, packetsPerSecond)
+	}
+}
+
+func TestRatelimiterAbuse(t *testing.T) {
+	var rate Ratelimiter
+	now := time.Now()
+	rate.timeNow = func() time.Time {
+		return now
+	}
+	rate.Init()
+	defer rate.Close()
+
+	var abused []netip.Addr
+	var dropped []uint64
+	rate.OnSustainedAbuse(func(addr netip.Addr, droppedInWindow uint64) {
+		abused = append(abused, addr)
+		dropped = append(dropped, droppedInWindow)
+	})
+	rate.SetAbusePolicy(AbusePolicy{Drops: 50, Window: 10 * time.Second, BanDuration: time.Minute})
+
+	// A source sending 40 packets a second is denied 20 of them, and is
+	// abusive two and a half seconds in, while one sending 10 is not.
+	ip, other := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	var elapsed time.Duration
+	for i := 0; len(abused) == 0 && elapsed < 10*time.Second; i++ {
+		now = now.Add(25 * time.Millisecond)
+		elapsed += 25 * time.Millisecond
+		rate.Allow(ip)
+		if i%4 == 0 && !rate.Allow(other) {
+			t.Fatalf("%v denied at 10 packets a second", other)
+		}
+	}
+	if len(abused) != 1 || abused[0] != ip || dropped[0] != 50 {
+		t.Fatalf("abusive sources %v with %v drops, want [%v] with [50]", abused, dropped, ip)
+	}
+	if elapsed < 2*time.Second || elapsed > 3*time.Second {
+		t.Errorf("abusive after %v, want about 2.5s", elapsed)
+	}
+
+	// Banned, the source is denied every packet, even once it has
+	// refilled its tokens, until the ban expires.
+	now = now.Add(time.Second)
+	for i := 0; i < 10; i++ {
+		if rate.Allow(ip) {
+			t.Fatal("banned source allowed")
+		}
+	}
+	bans := rate.Bans()
+	if len(bans) != 1 || bans[0].Addr != ip || bans[0].Drops != 50 || bans[0].Denied != 10 {
+		t.Fatalf("Bans() = %+v, want %v with 50 drops and 10 denied", bans, ip)
+	}
+	if want := now.Add(-time.Second).Add(time.Minute); !bans[0].Expires.Equal(want) {
+		t.Errorf("ban expires %v, want %v", bans[0].Expires, want)
+	}
+
+	now = now.Add(time.Minute)
+	if !rate.Allow(ip) {
+		t.Error("source denied once its ban expired")
+	}
+	if bans := rate.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() = %+v after expiring", bans)
+	}
+	rate.cleanup()
+	rate.mu.RLock()
+	if len(rate.bans) != 0 {
+		t.Error("expired ban not collected")
+	}
+	rate.mu.RUnlock()
+
+	// Drops within the window are remembered while the source pauses.
+	// Those of the previous window count in part: of 30 drops, 5 seconds
+	// into the next window, 15 still count.
+	rate.SetAbusePolicy(AbusePolicy{Drops: 40, Window: 10 * time.Second})
+	slow := netip.MustParseAddr("2001:db8::1")
+	drop := func(n int) {
+		for i := 0; i < n; {
+			if !rate.Allow(slow) {
+				i++
+			}
+		}
+	}
+	abused = nil
+	drop(30)
+	now = now.Add(15 * time.Second)
+	rate.cleanup()
+	drop(24)
+	if len(abused) != 0 {
+		t.Fatalf("abusive sources %v before reaching the threshold", abused)
+	}
+	drop(1)
+	if len(abused) != 1 || abused[0] != slow {
+		t.Fatalf("abusive sources %v, want [%v]", abused, slow)
+	}
+	if bans := rate.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() = %+v without a ban duration", bans)
+	}
+}
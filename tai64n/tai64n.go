@@ -32,10 +32,20 @@ func Now() Timestamp {
 	return stamp(time.Now())
 }
 
+// At returns the timestamp of t, as Now does of the current time.
+func At(t time.Time) Timestamp {
+	return stamp(t)
+}
+
 func (t1 Timestamp) After(t2 Timestamp) bool {
 	return bytes.Compare(t1[:], t2[:]) > 0
 }
 
+// Time returns the time t stamps, to the precision left by whitening.
+func (t Timestamp) Time() time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(t[:8])-base), int64(binary.BigEndian.Uint32(t[8:12])))
+}
+
 func (t Timestamp) String() string {
-	return time.Unix(int64(binary.BigEndian.Uint64(t[:8])-base), int64(binary.BigEndian.Uint32(t[8:12]))).String()
+	return t.Time().String()
 }
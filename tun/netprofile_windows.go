@@ -0,0 +1,251 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/darkit/wireguard/tun/wintun"
+	"github.com/darkit/wireguard/windows/tunnel/winipcfg"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// Windows keeps a network profile for every network it has seen, and tells
+// the networks of adapters apart by their GUIDs, so an adapter recreated
+// with another GUID gets another profile, named after the adapter with a
+// number appended. The GUIDs of the adapters created here are therefore
+// kept in the registry, to be requested again when the adapter is
+// recreated.
+
+const (
+	networkProfilesKey   = `SOFTWARE\Microsoft\Windows NT\CurrentVersion\NetworkList\Profiles`
+	networkSignaturesKey = `SOFTWARE\Microsoft\Windows NT\CurrentVersion\NetworkList\Signatures\Unmanaged`
+)
+
+// adapterGUIDsKey is the registry key holding the GUID of each adapter,
+// as a string value named after the adapter.
+func adapterGUIDsKey() string {
+	return `SOFTWARE\` + WintunTunnelType + `\Adapters`
+}
+
+// persistentGUID returns the GUID kept for the adapter named ifname, or a
+// new one if there is none.
+func persistentGUID(ifname string) (*windows.GUID, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, adapterGUIDsKey(), registry.QUERY_VALUE)
+	if err == nil {
+		defer key.Close()
+		value, _, err := key.GetStringValue(ifname)
+		if err == nil {
+			if guid, err := windows.GUIDFromString(value); err == nil {
+				return &guid, nil
+			}
+		} else if !errors.Is(err, registry.ErrNotExist) {
+			return nil, err
+		}
+	} else if !errors.Is(err, registry.ErrNotExist) {
+		return nil, err
+	}
+	guid, err := windows.GenerateGUID()
+	if err != nil {
+		return nil, err
+	}
+	return &guid, nil
+}
+
+// keepGUID records the GUID the adapter named ifname was created with.
+func keepGUID(ifname string, wt *wintun.Adapter) error {
+	guid, err := winipcfg.LUID(wt.LUID()).GUID()
+	if err != nil {
+		return err
+	}
+	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, adapterGUIDsKey(), registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	if value, _, err := key.GetStringValue(ifname); err == nil && value == guid.String() {
+		return nil
+	}
+	return key.SetStringValue(ifname, guid.String())
+}
+
+// networkProfile is an entry of the NetworkList\Profiles registry key.
+type networkProfile struct {
+	guid          string // name of the entry
+	name          string // ProfileName
+	lastConnected [8]uint16
+}
+
+// profileAdapterName returns the name of the adapter the network profile
+// named name is for, that is, name without the number Windows appends to
+// tell profiles of the same name apart.
+func profileAdapterName(name string) string {
+	i := strings.LastIndexByte(name, ' ')
+	if i < 0 {
+		return name
+	}
+	if n, err := strconv.Atoi(name[i+1:]); err != nil || n < 2 {
+		return name
+	}
+	return name[:i]
+}
+
+// CleanupNetworkProfiles removes the stale network profiles of adapters
+// whose names start with namePrefix, along with the signatures Windows
+// assigns them by. The profiles of an adapter are stale if it no longer
+// exists, and otherwise, all but the one connected last, which is the one
+// in use. It needs to run elevated. Adapters created with
+// CreateTUNWithRequestedGUID keep their GUIDs, so only the profiles from
+// before that, or of adapters since deleted, need to be removed.
+func CleanupNetworkProfiles(namePrefix string) error {
+	profilesKey, err := registry.OpenKey(registry.LOCAL_MACHINE, networkProfilesKey, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return fmt.Errorf("opening network profiles: %w", err)
+	}
+	defer profilesKey.Close()
+	guids, err := profilesKey.ReadSubKeyNames(-1)
+	if err != nil {
+		return fmt.Errorf("listing network profiles: %w", err)
+	}
+
+	byAdapter := make(map[string][]networkProfile)
+	for _, guid := range guids {
+		profile, err := readNetworkProfile(guid)
+		if err != nil {
+			continue
+		}
+		if name := profileAdapterName(profile.name); strings.HasPrefix(name, namePrefix) {
+			byAdapter[name] = append(byAdapter[name], profile)
+		}
+	}
+
+	stale := make(map[string]string) // by upper case GUID
+	for name, profiles := range byAdapter {
+		keep := -1
+		if wt, err := wintun.OpenAdapter(name); err == nil {
+			wt.Close()
+			for i := range profiles {
+				if keep < 0 || laterSystemTime(profiles[i].lastConnected, profiles[keep].lastConnected) {
+					keep = i
+				}
+			}
+		}
+		for i, profile := range profiles {
+			if i != keep {
+				stale[strings.ToUpper(profile.guid)] = profile.guid
+			}
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	var errs []error
+	if err := removeNetworkSignatures(stale); err != nil {
+		errs = append(errs, err)
+	}
+	for _, guid := range stale {
+		if err := deleteKeyTree(networkProfilesKey + `\` + guid); err != nil {
+			errs = append(errs, fmt.Errorf("removing network profile %s: %w", guid, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func readNetworkProfile(guid string) (profile networkProfile, err error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, networkProfilesKey+`\`+guid, registry.QUERY_VALUE)
+	if err != nil {
+		return profile, err
+	}
+	defer key.Close()
+	profile.guid = guid
+	profile.name, _, err = key.GetStringValue("ProfileName")
+	if err != nil {
+		return profile, err
+	}
+	// DateLastConnected is a SYSTEMTIME, which is missing for profiles
+	// never connected.
+	if b, _, err := key.GetBinaryValue("DateLastConnected"); err == nil && len(b) >= 16 {
+		for i := range profile.lastConnected {
+			profile.lastConnected[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+		}
+	}
+	return profile, nil
+}
+
+// laterSystemTime reports whether the SYSTEMTIME a is later than b.
+func laterSystemTime(a, b [8]uint16) bool {
+	// Compare year, month, day, hour, minute, second and milliseconds,
+	// skipping the day of the week.
+	for _, i := range []int{0, 1, 3, 4, 5, 6, 7} {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// removeNetworkSignatures removes the signatures assigning the network
+// profiles whose upper case GUIDs are in profiles, so Windows does not
+// recreate them.
+func removeNetworkSignatures(profiles map[string]string) error {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, networkSignaturesKey, registry.ENUMERATE_SUB_KEYS)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("opening network signatures: %w", err)
+	}
+	defer key.Close()
+	names, err := key.ReadSubKeyNames(-1)
+	if err != nil {
+		return fmt.Errorf("listing network signatures: %w", err)
+	}
+	var errs []error
+	for _, name := range names {
+		sig, err := registry.OpenKey(registry.LOCAL_MACHINE, networkSignaturesKey+`\`+name, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		profile, _, err := sig.GetStringValue("ProfileGuid")
+		sig.Close()
+		if _, ok := profiles[strings.ToUpper(profile)]; err != nil || !ok {
+			continue
+		}
+		if err := deleteKeyTree(networkSignaturesKey + `\` + name); err != nil {
+			errs = append(errs, fmt.Errorf("removing network signature %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteKeyTree deletes the key at path of HKEY_LOCAL_MACHINE with its
+// subkeys, if it exists.
+func deleteKeyTree(path string) error {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.ENUMERATE_SUB_KEYS)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	names, err := key.ReadSubKeyNames(-1)
+	key.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := deleteKeyTree(path + `\` + name); err != nil {
+			return err
+		}
+	}
+	if err := registry.DeleteKey(registry.LOCAL_MACHINE, path); err != nil && !errors.Is(err, registry.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+func skipUnlessElevated(t *testing.T) {
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		t.Skip("not elevated")
+	}
+}
+
+func TestProfileAdapterName(t *testing.T) {
+	for name, want := range map[string]string{
+		"WireGuard Tunnel":    "WireGuard Tunnel",
+		"WireGuard Tunnel 2":  "WireGuard Tunnel",
+		"WireGuard Tunnel 14": "WireGuard Tunnel",
+		"WireGuard Tunnel 1":  "WireGuard Tunnel 1",
+		"wg0":                 "wg0",
+		"office vpn":          "office vpn",
+	} {
+		if got := profileAdapterName(name); got != want {
+			t.Errorf("profileAdapterName(%q) = %q, want %q", name, got, want)
+		}
+	}
+	// Year, month, day of the week, day, and so on.
+	if !laterSystemTime([8]uint16{2024, 3, 0, 1}, [8]uint16{2024, 2, 6, 28}) {
+		t.Error("March not later than February")
+	}
+	if laterSystemTime([8]uint16{2024, 3, 6, 1}, [8]uint16{2024, 3, 0, 1}) {
+		t.Error("day of the week compared")
+	}
+}
+
+func TestPersistentGUID(t *testing.T) {
+	skipUnlessElevated(t)
+	const name = "WireGuardTestGUID"
+	guid := func() string {
+		dev, err := CreateTUNWithRequestedGUID(name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dev.Close()
+		key, err := registry.OpenKey(registry.LOCAL_MACHINE, adapterGUIDsKey(), registry.QUERY_VALUE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer key.Close()
+		guid, _, err := key.GetStringValue(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return guid
+	}
+	if first, second := guid(), guid(); first != second {
+		t.Errorf("recreated with GUID %s, want %s", second, first)
+	}
+}
+
+func TestCleanupNetworkProfiles(t *testing.T) {
+	skipUnlessElevated(t)
+	const (
+		profile   = "{5F6D8E58-1B65-4D9C-9A5B-7E9B6C2E1F01}"
+		signature = "0100000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000001"
+	)
+	set := func(path string, values map[string]string) {
+		key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, path, registry.SET_VALUE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer key.Close()
+		for name, value := range values {
+			if err := key.SetStringValue(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set(networkProfilesKey+`\`+profile, map[string]string{"ProfileName": "WireGuardTestCleanup 3"})
+	set(networkSignaturesKey+`\`+signature, map[string]string{"ProfileGuid": profile})
+	defer deleteKeyTree(networkProfilesKey + `\` + profile)
+	defer deleteKeyTree(networkSignaturesKey + `\` + signature)
+
+	if err := CleanupNetworkProfiles("WireGuardTestCleanup"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{networkProfilesKey + `\` + profile, networkSignaturesKey + `\` + signature} {
+		key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+		if err == nil {
+			key.Close()
+			t.Errorf("%s not removed", path)
+		} else if !errors.Is(err, registry.ErrNotExist) {
+			t.Error(err)
+		}
+	}
+}
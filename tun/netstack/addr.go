@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"fmt"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// AddAddress assigns ip to the stack, in addition to the addresses it was
+// created with, routing all traffic of its address family through the
+// tunnel. It is a no-op if ip is already assigned. Unlike the addresses
+// passed to CreateNetTUN, it does not change which address families names
+// are resolved to.
+func (tnet *Net) AddAddress(ip netip.Addr) error {
+	protocol, subnet := ipv4.ProtocolNumber, header.IPv4EmptySubnet
+	if ip.Is6() {
+		protocol, subnet = ipv6.ProtocolNumber, header.IPv6EmptySubnet
+	} else if !ip.Is4() {
+		return fmt.Errorf("invalid address %v", ip)
+	}
+	addr := tcpip.AddrFromSlice(ip.AsSlice())
+	if tnet.hasAddress(addr) {
+		return nil
+	}
+	protoAddr := tcpip.ProtocolAddress{Protocol: protocol, AddressWithPrefix: addr.WithPrefix()}
+	if tcpipErr := tnet.stack.AddProtocolAddress(1, protoAddr, stack.AddressProperties{}); tcpipErr != nil {
+		return fmt.Errorf("AddProtocolAddress(%v): %v", ip, tcpipErr)
+	}
+	for _, route := range tnet.stack.GetRouteTable() {
+		if route.Destination == subnet {
+			return nil
+		}
+	}
+	tnet.stack.AddRoute(tcpip.Route{Destination: subnet, NIC: 1})
+	return nil
+}
+
+// RemoveAddress removes ip from the stack. Connections using it stop
+// working.
+func (tnet *Net) RemoveAddress(ip netip.Addr) error {
+	if tcpipErr := tnet.stack.RemoveAddress(1, tcpip.AddrFromSlice(ip.AsSlice())); tcpipErr != nil {
+		return fmt.Errorf("RemoveAddress(%v): %v", ip, tcpipErr)
+	}
+	return nil
+}
+
+func (tnet *Net) hasAddress(addr tcpip.Address) bool {
+	for _, pa := range tnet.stack.AllAddresses()[1] {
+		if pa.AddressWithPrefix.Address == addr {
+			return true
+		}
+	}
+	return false
+}
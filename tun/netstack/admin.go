@@ -0,0 +1,161 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darkit/wireguard/device"
+)
+
+// AdminOptions configures ServeAdmin.
+type AdminOptions struct {
+	// Token, if set, is the bearer token requests must present in their
+	// Authorization header.
+	Token string
+
+	// TLSConfig, if set, makes ServeAdmin serve HTTPS with it, such as
+	// with the TLSConfig of a TLSManager.
+	TLSConfig *tls.Config
+}
+
+// adminShutdownTimeout bounds how long stopping ServeAdmin waits for
+// pending requests.
+const adminShutdownTimeout = 5 * time.Second
+
+// ServeAdmin serves an HTTP endpoint for monitoring dev on addr of net,
+// usually the device's own tunnel address, so that it is reachable only
+// from inside the tunnel:
+//
+//   - /healthz runs Device.HealthCheck, answering 503 Service Unavailable
+//     if it fails, with a line per check.
+//   - /metrics returns Device.WriteMetrics, in the Prometheus text format.
+//   - /peers returns the configuration of Device.IpcGet as JSON, without the
+//     private and preshared keys: the device's keys, and a "peers" array of
+//     objects of the peers' keys. Keys that may repeat, such as
+//     "allowed_ip", are arrays.
+//
+// It returns once listening, with a function that stops serving, waiting
+// briefly for pending requests to complete.
+func ServeAdmin(net *Net, dev *device.Device, addr netip.AddrPort, opts AdminOptions) (stop func(), err error) {
+	ln, err := net.ListenTCPAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Handler:           adminHandler(dev, opts),
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         opts.TLSConfig,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if srv.TLSConfig != nil {
+			srv.ServeTLS(newTCPListener(ln, false), "", "")
+		} else {
+			srv.Serve(newTCPListener(ln, false))
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+			defer cancel()
+			if srv.Shutdown(ctx) != nil {
+				srv.Close()
+			}
+			<-done
+		})
+	}, nil
+}
+
+func adminHandler(dev *device.Device, opts AdminOptions) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := dev.HealthCheck(r.Context())
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if report.Status == device.HealthFailed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintln(w, report.Status)
+		for _, check := range report.Checks {
+			fmt.Fprintf(w, "%s: %v %s\n", check.Name, check.Status, check.Message)
+		}
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		dev.WriteMetrics(w)
+	})
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := dev.IpcGet()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ipcToJSON(cfg))
+	})
+	if opts.Token == "" {
+		return mux
+	}
+	want := []byte("Bearer " + opts.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ipcSecretKeys are the UAPI keys left out of /peers.
+var ipcSecretKeys = map[string]bool{
+	"private_key":   true,
+	"preshared_key": true,
+}
+
+// ipcListKeys are the UAPI keys that may repeat, which become arrays.
+var ipcListKeys = map[string]bool{
+	"allowed_ip":       true,
+	"ratelimit_exempt": true,
+}
+
+// ipcToJSON converts the output of the UAPI get operation to a JSON object.
+func ipcToJSON(cfg string) map[string]any {
+	dev := map[string]any{}
+	peers := []map[string]any{}
+	section := dev
+	scanner := bufio.NewScanner(strings.NewReader(cfg))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || ipcSecretKeys[key] {
+			continue
+		}
+		if key == "public_key" {
+			section = map[string]any{"allowed_ip": []string{}}
+			peers = append(peers, section)
+		}
+		if ipcListKeys[key] {
+			list, _ := section[key].([]string)
+			section[key] = append(list, value)
+			continue
+		}
+		section[key] = value
+	}
+	dev["peers"] = peers
+	return dev
+}
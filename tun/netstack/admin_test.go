@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/darkit/wireguard/device/devicetest"
+	"github.com/darkit/wireguard/tun/netstack"
+)
+
+func TestServeAdmin(t *testing.T) {
+	a, b := devicetest.NewPair(t)
+	stop, err := netstack.ServeAdmin(b.Net, b.Device, netip.AddrPortFrom(b.Addr, 8080), netstack.AdminOptions{Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: a.Net.DialContext}}
+	get := func(path, token string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://"+b.Addr.String()+":8080"+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := get("/metrics", token); code != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d, want 401", token, code)
+		}
+	}
+	if code, body := get("/healthz", "secret"); code != http.StatusOK || !strings.HasPrefix(body, "ok\n") {
+		t.Errorf("/healthz = %d %q", code, body)
+	}
+	if code, body := get("/metrics", "secret"); code != http.StatusOK || !strings.Contains(body, "wireguard_peers 1\n") {
+		t.Errorf("/metrics = %d %q", code, body)
+	}
+
+	code, body := get("/peers", "secret")
+	var cfg struct {
+		ListenPort string `json:"listen_port"`
+		PrivateKey string `json:"private_key"`
+		Peers      []struct {
+			PublicKey    string   `json:"public_key"`
+			PresharedKey string   `json:"preshared_key"`
+			AllowedIPs   []string `json:"allowed_ip"`
+		}
+	}
+	if err := json.Unmarshal([]byte(body), &cfg); err != nil || code != http.StatusOK {
+		t.Fatalf("/peers = %d %q, %v", code, body, err)
+	}
+	if cfg.ListenPort == "" || cfg.PrivateKey != "" || len(cfg.Peers) != 1 {
+		t.Fatalf("/peers = %s", body)
+	}
+	if p := cfg.Peers[0]; p.PublicKey != a.PublicKey.Hex() || p.PresharedKey != "" || len(p.AllowedIPs) != 1 || p.AllowedIPs[0] != a.Addr.String()+"/32" {
+		t.Errorf("/peers lists peer %+v", p)
+	}
+
+	// Once stopped, the endpoint is gone.
+	stop()
+	if _, err := client.Get("http://" + b.Addr.String() + ":8080/healthz"); err == nil {
+		t.Error("endpoint reachable after stop")
+	}
+}
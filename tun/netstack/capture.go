@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"os"
+	"slices"
+	"sync"
+)
+
+// outboundCaptures are the functions given to Net.CaptureOutbound.
+type outboundCaptures struct {
+	sync.RWMutex // held for reading while calling fns
+	fns          []*func(pkt []byte)
+}
+
+// InjectInbound hands the IP packet pkt to the stack as if it had arrived
+// over the tunnel, that is, as if the device had written it. It goes through
+// the same processing as the packets of the device, such as reassembly of
+// IPv4 fragments, and is ordered with them only as far as it is injected
+// before or after the device's Write call. pkt is not retained, so the
+// caller may reuse it once InjectInbound returns.
+func (net *Net) InjectInbound(pkt []byte) error {
+	select {
+	case <-net.done:
+		return os.ErrClosed
+	default:
+	}
+	_, err := (*netTun)(net).Write([][]byte{pkt}, 0)
+	return err
+}
+
+// CaptureOutbound calls fn with each IP packet the stack sends, until stop
+// is called. The packets still reach the device, so capturing does not
+// interfere with it: fn is called before the packet is queued for the
+// device's Read, with a copy that fn may keep. fn is called from the stack's
+// goroutines, possibly concurrently, and must not block, nor call stop.
+// Once stop returns, fn is not called anymore.
+func (net *Net) CaptureOutbound(fn func(pkt []byte)) (stop func()) {
+	c := &net.captures
+	p := &fn
+	c.Lock()
+	c.fns = append(c.fns, p)
+	c.Unlock()
+	return func() {
+		c.Lock()
+		defer c.Unlock()
+		c.fns = slices.DeleteFunc(c.fns, func(q *func(pkt []byte)) bool { return q == p })
+	}
+}
+
+// capture calls the functions given to CaptureOutbound with pkt.
+func (c *outboundCaptures) capture(pkt []byte) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, fn := range c.fns {
+		(*fn)(append([]byte(nil), pkt...))
+	}
+}
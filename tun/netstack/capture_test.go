@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestInjectCapture(t *testing.T) {
+	local := netip.MustParseAddrPort("192.168.4.29:5300")
+	remote := netip.MustParseAddrPort("10.0.0.1:4000")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local.Addr()}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	conn, err := tnet.ListenUDPAddrPort(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packets := readPackets(dev)
+
+	captured := make(chan []byte, 16)
+	stop := tnet.CaptureOutbound(func(pkt []byte) { captured <- pkt })
+
+	pkt := buildUDPv4(remote, local, 1, []byte("ping"))
+	if err := tnet.InjectInbound(pkt); err != nil {
+		t.Fatal(err)
+	}
+	clear(pkt)
+	buf := make([]byte, 100)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || from.String() != remote.String() {
+		t.Errorf("received %q from %v, want %q from %v", buf[:n], from, "ping", remote)
+	}
+
+	// The reply is captured, and still reaches the device.
+	if _, err := conn.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	var capture []byte
+	select {
+	case capture = <-captured:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not captured")
+	}
+	if payload := header.UDP(header.IPv4(capture).Payload()).Payload(); string(payload) != "pong" {
+		t.Errorf("captured %q, want %q", payload, "pong")
+	}
+	var read []byte
+	select {
+	case read = <-packets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not read by the device")
+	}
+	if !bytes.Equal(read, capture) {
+		t.Error("device read another packet than captured")
+	}
+
+	stop()
+	if _, err := conn.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-packets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not read by the device")
+	}
+	select {
+	case <-captured:
+		t.Error("packet captured after stop")
+	default:
+	}
+
+	dev.Close()
+	if err := tnet.InjectInbound(pkt); err == nil {
+		t.Error("packet injected after closing")
+	}
+}
@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// deadline is a read or write deadline of a conn. The channel returned by
+// wait is closed once the deadline passes.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	ch    chan struct{}
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	return d.ch
+}
+
+// exceeded reports whether the deadline has passed.
+func (d *deadline) exceeded() bool {
+	select {
+	case <-d.wait():
+		return true
+	default:
+		return false
+	}
+}
+
+// set moves the deadline to t, with the zero time meaning no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	// A timer that already fired may still be about to close the channel,
+	// so replace it as well as one already closed.
+	if d.timer != nil && !d.timer.Stop() {
+		d.ch = make(chan struct{})
+	}
+	d.timer = nil
+	select {
+	case <-d.ch:
+		d.ch = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return
+	}
+	timeout := time.Until(t)
+	if timeout <= 0 {
+		close(d.ch)
+		return
+	}
+	ch := d.ch
+	d.timer = time.AfterFunc(timeout, func() { close(ch) })
+}
+
+// deadlineError makes err, returned by a gonet conn, match
+// os.ErrDeadlineExceeded if it is a timeout. The gonet conns report timeouts
+// with an error of their own, which only implements net.Error.
+func deadlineError(err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Timeout() && !errors.Is(opErr.Err, os.ErrDeadlineExceeded) {
+		opErr.Err = os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// WithIdleTimeout returns conn wrapped to close it once no data has been
+// read from or written to it for d. Operations pending at that point fail
+// as they would if the caller had closed the conn.
+func WithIdleTimeout(conn net.Conn, d time.Duration) net.Conn {
+	c := &idleConn{Conn: conn, timeout: d}
+	c.active()
+	c.timer = time.AfterFunc(math.MaxInt64, c.expire)
+	c.timer.Reset(d)
+	return c
+}
+
+type idleConn struct {
+	net.Conn
+	timeout    time.Duration
+	timer      *time.Timer
+	lastActive atomic.Int64 // in nanoseconds since the Unix epoch
+}
+
+func (c *idleConn) active() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// expire closes the conn if it has been idle for the timeout, and otherwise
+// checks again once it could have been.
+func (c *idleConn) expire() {
+	idle := time.Duration(time.Now().UnixNano() - c.lastActive.Load())
+	if idle < c.timeout {
+		c.timer.Reset(c.timeout - idle)
+		return
+	}
+	c.Conn.Close()
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.active()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.active()
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+const deadlineTolerance = time.Second
+
+// checkReadDeadline sets a read deadline on c and checks that a read from
+// the stalled peer fails once it passes, twice in a row.
+func checkReadDeadline(t *testing.T, c interface {
+	Read([]byte) (int, error)
+	SetReadDeadline(time.Time) error
+}) {
+	t.Helper()
+	const timeout = 50 * time.Millisecond
+	for range 2 {
+		start := time.Now()
+		c.SetReadDeadline(start.Add(timeout))
+		_, err := c.Read(make([]byte, 64))
+		if elapsed := time.Since(start); !errors.Is(err, os.ErrDeadlineExceeded) || elapsed < timeout || elapsed > timeout+deadlineTolerance {
+			t.Fatalf("read returned %v after %v, want %v after %v", err, elapsed, os.ErrDeadlineExceeded, timeout)
+		}
+	}
+}
+
+func TestTCPReadDeadline(t *testing.T) {
+	tnet := blackhole(t, Options{})
+	addr := netip.MustParseAddrPort("192.168.4.29:80")
+	ln, err := tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1)) // stall until the client closes
+		}
+	}()
+	c, err := tnet.DialContextTCPConn(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	checkReadDeadline(t, c)
+}
+
+func TestUDPDeadlines(t *testing.T) {
+	tnet := blackhole(t, Options{})
+	c, err := tnet.DialUDPConn(netip.AddrPort{}, netip.MustParseAddrPort("192.168.4.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	checkReadDeadline(t, c)
+
+	c.SetWriteDeadline(time.Now().Add(-time.Second))
+	if n, err := c.WriteBatch([][]byte{{1}}, nil); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("WriteBatch after the write deadline sent %d datagrams, %v; want %v", n, err, os.ErrDeadlineExceeded)
+	}
+	c.SetWriteDeadline(time.Time{})
+	if n, err := c.WriteBatch([][]byte{{1}}, nil); n != 1 || err != nil {
+		t.Fatalf("WriteBatch after clearing the write deadline sent %d datagrams, %v", n, err)
+	}
+}
+
+func TestPingDeadlines(t *testing.T) {
+	tnet := blackhole(t, Options{})
+	c, err := tnet.DialPingAddr(netip.Addr{}, netip.MustParseAddr("192.168.4.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	checkReadDeadline(t, c)
+
+	// Clearing the deadline lets reads block until the conn is closed.
+	c.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 64))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("read without a deadline returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("read after close succeeded")
+		}
+	case <-time.After(deadlineTolerance):
+		t.Fatal("read still blocked after close")
+	}
+
+	c.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := c.Write([]byte{8, 0, 0, 0, 0, 0, 0, 0}); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write after the write deadline: %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	client, server := net.Pipe()
+	defer server.Close()
+	c := WithIdleTimeout(client, timeout)
+	defer c.Close()
+
+	// Activity in either direction keeps the conn open.
+	go func() {
+		buf := make([]byte, 1)
+		for range 4 {
+			server.Write(buf)
+			server.Read(buf)
+		}
+	}()
+	buf := make([]byte, 1)
+	for range 4 {
+		time.Sleep(timeout / 2)
+		if _, err := c.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	_, err := c.Read(buf)
+	if elapsed := time.Since(start); !errors.Is(err, io.ErrClosedPipe) || elapsed > timeout+deadlineTolerance {
+		t.Fatalf("read from an idle conn returned %v after %v, want it closed after %v", err, elapsed, timeout)
+	}
+}
@@ -0,0 +1,198 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// DefaultConnectTimeout bounds a TCP handshake whose context has no deadline.
+const DefaultConnectTimeout = 30 * time.Second
+
+// dialTCP connects a TCP endpoint to raddr, binding it to laddr first unless
+// that is the zero address. Unlike gonet.DialTCPWithBind, it aborts the
+// endpoint when ctx is done, so an abandoned handshake releases it at once
+// instead of lingering until the stack gives up on the SYN retransmits.
+func (net *Net) dialTCP(ctx context.Context, laddr, raddr tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*TCPConn, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline && net.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, net.connectTimeout)
+		defer cancel()
+	}
+	ctx, dial, own := net.dialTrace.start(ctx)
+
+	var wq waiter.Queue
+	ep, tcpipErr := net.stack.NewEndpoint(tcp.ProtocolNumber, pn, &wq)
+	if tcpipErr != nil {
+		return nil, errors.New(tcpipErr.String())
+	}
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	if err := ctx.Err(); err != nil {
+		ep.Abort()
+		return nil, dialError(raddr, err)
+	}
+	// A traced dial is bound to an ephemeral port even without laddr, for
+	// its SYNs to be told apart from those of other dials to raddr.
+	if laddr != (tcpip.FullAddress{}) || dial != nil {
+		if tcpipErr = ep.Bind(laddr); tcpipErr != nil {
+			ep.Close()
+			return nil, dialError(raddr, errors.New(tcpipErr.String()))
+		}
+	}
+	attempt := dial.attempt(net.stack, ep, raddr, pn)
+	tcpipErr = ep.Connect(raddr)
+	if _, ok := tcpipErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Abort()
+			err := dialError(raddr, ctx.Err())
+			attempt.done(err)
+			return nil, err
+		case <-notifyCh:
+		}
+		tcpipErr = ep.LastError()
+	}
+	if tcpipErr != nil {
+		ep.Close()
+		err := dialError(raddr, errors.New(tcpipErr.String()))
+		attempt.done(err)
+		return nil, err
+	}
+	attempt.done(nil)
+	if own {
+		dial.established()
+	}
+	return &TCPConn{TCPConn: gonet.NewTCPConn(&wq, ep)}, nil
+}
+
+func dialError(raddr tcpip.FullAddress, err error) error {
+	if err == context.DeadlineExceeded {
+		err = errTimeout
+	}
+	ip, _ := netip.AddrFromSlice(raddr.Addr.AsSlice())
+	return &net.OpError{
+		Op:   "dial",
+		Net:  "tcp",
+		Addr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, raddr.Port)),
+		Err:  err,
+	}
+}
+
+// HappyEyeballsDelay is how long DialContext waits for a TCP connection
+// attempt before starting one to the next address, when the host has
+// addresses of both families, as RFC 8305 recommends.
+const HappyEyeballsDelay = 250 * time.Millisecond
+
+// hasBothFamilies reports whether addrs has both IPv4 and IPv6 addresses.
+func hasBothFamilies(addrs []netip.AddrPort) bool {
+	for _, addr := range addrs[1:] {
+		if addr.Addr().Is4() != addrs[0].Addr().Is4() {
+			return true
+		}
+	}
+	return false
+}
+
+// interleaveFamilies orders addrs for connection attempts as RFC 8305
+// section 4 does, alternating between the families, starting with that of
+// the first address, which the resolver put first by preference. Within a
+// family, the resolver's order is kept.
+func interleaveFamilies(addrs []netip.AddrPort) []netip.AddrPort {
+	var first, second []netip.AddrPort
+	for _, addr := range addrs {
+		if addr.Addr().Is4() == addrs[0].Addr().Is4() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	ordered := make([]netip.AddrPort, 0, len(addrs))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			ordered = append(ordered, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			ordered = append(ordered, second[0])
+			second = second[1:]
+		}
+	}
+	return ordered
+}
+
+// dialHappyEyeballs connects to the first of addrs to accept, starting an
+// attempt to each in turn every HappyEyeballsDelay, or as soon as the
+// previous attempts failed, and aborting the others once one succeeds.
+// Failing all, it returns the error of the first attempt.
+func (net *Net) dialHappyEyeballs(ctx context.Context, addrs []netip.AddrPort) (*TCPConn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   *TCPConn
+		err error
+	}
+	results := make(chan result, len(addrs))
+	started, pending := 0, 0
+	start := func() {
+		addr := addrs[started]
+		started++
+		pending++
+		go func() {
+			c, err := net.dialTCPAddrPort(ctx, addr)
+			results <- result{c, err}
+		}()
+	}
+	start()
+	stagger := time.NewTimer(HappyEyeballsDelay)
+	defer stagger.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Attempts that connected before seeing the cancellation
+				// are closed as they return.
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}
+				}(pending)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if started < len(addrs) && ctx.Err() == nil {
+				start()
+				stagger.Reset(HappyEyeballsDelay)
+			}
+		case <-stagger.C:
+			if started < len(addrs) {
+				start()
+				stagger.Reset(HappyEyeballsDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,208 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blackhole creates a stack whose outbound packets are read and discarded,
+// so connections it starts are never answered.
+func blackhole(t *testing.T, options Options) *Net {
+	t.Helper()
+	dev, tnet, err := CreateNetTUNWithOptions([]netip.Addr{netip.MustParseAddr("192.168.4.29")}, nil, 1420, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		bufs := make([][]byte, batchSize)
+		for i := range bufs {
+			bufs[i] = make([]byte, 1420)
+		}
+		sizes := make([]int, batchSize)
+		for {
+			if _, err := dev.Read(bufs, sizes, 0); err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { dev.Close() })
+	return tnet
+}
+
+func TestDialCancel(t *testing.T) {
+	tnet := blackhole(t, Options{})
+	raddr := netip.MustParseAddrPort("192.168.4.1:80")
+	goroutines := runtime.NumGoroutine()
+	endpoints := len(tnet.stack.RegisteredEndpoints())
+
+	const dials = 1000
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	errs := make(chan error, dials)
+	for range dials {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := tnet.DialContextTCPAddrPort(ctx, raddr)
+			if err == nil {
+				c.Close()
+			}
+			errs <- err
+		}()
+	}
+	for len(tnet.stack.RegisteredEndpoints()) < endpoints+dials {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("dial: got %v, want %v", err, context.Canceled)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, g := len(tnet.stack.RegisteredEndpoints()), runtime.NumGoroutine()
+		if n == endpoints && g <= goroutines+2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after cancelling: %d endpoints and %d goroutines, want %d and %d", n, g, endpoints, goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialConnectTimeout(t *testing.T) {
+	tnet := blackhole(t, Options{ConnectTimeout: 50 * time.Millisecond})
+	start := time.Now()
+	_, err := tnet.DialTCPAddrPort(netip.MustParseAddrPort("192.168.4.1:80"))
+	if !errors.Is(err, errTimeout) {
+		t.Fatalf("dial: got %v, want %v", err, errTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("dial took %v despite a 50ms connect timeout", elapsed)
+	}
+	if n := len(tnet.stack.RegisteredEndpoints()); n != 0 {
+		t.Fatalf("%d endpoints left after the dial timed out", n)
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	parse := func(addrs ...string) []netip.AddrPort {
+		var aps []netip.AddrPort
+		for _, addr := range addrs {
+			aps = append(aps, netip.AddrPortFrom(netip.MustParseAddr(addr), 80))
+		}
+		return aps
+	}
+	got := interleaveFamilies(parse("fd00::1", "fd00::2", "fd00::3", "10.0.0.1", "10.0.0.2"))
+	want := parse("fd00::1", "10.0.0.1", "fd00::2", "10.0.0.2", "fd00::3")
+	if !slices.Equal(got, want) {
+		t.Errorf("interleaveFamilies = %v, want %v", got, want)
+	}
+	if hasBothFamilies(parse("10.0.0.1", "10.0.0.2")) || !hasBothFamilies(parse("10.0.0.1", "fd00::1")) {
+		t.Error("hasBothFamilies misreports")
+	}
+}
+
+// dualStackPair returns a Net with an IPv4 and an IPv6 address, spliced to
+// one with addrs, which accepts TCP connections on port 80 of each.
+func dualStackPair(t *testing.T, addrs ...netip.Addr) *Net {
+	t.Helper()
+	devA, a, err := CreateNetTUN([]netip.Addr{spliceAddrA, netip.MustParseAddr("fd00::1")}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { devA.Close() })
+	devB, b, err := CreateNetTUN(addrs, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { devB.Close() })
+	t.Cleanup(Splice(a, b))
+	for _, addr := range addrs {
+		ln, err := b.ListenTCPAddrPort(netip.AddrPortFrom(addr, 80))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { c.Close() })
+			}
+		}()
+	}
+	a.SetHosts(map[string][]netip.Addr{"dual.test": {netip.MustParseAddr("fd00::2"), spliceAddrB}})
+	return a
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The IPv6 address is preferred when it works.
+	a := dualStackPair(t, spliceAddrB, netip.MustParseAddr("fd00::2"))
+	c, err := a.DialContext(ctx, "tcp", "dual.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raddr := c.RemoteAddr().String(); raddr != "[fd00::2]:80" {
+		t.Errorf("connected to %s, want [fd00::2]:80", raddr)
+	}
+	c.Close()
+
+	// With IPv6 blackholed, IPv4 connects after the stagger.
+	a = dualStackPair(t, spliceAddrB)
+	endpoints := len(a.stack.RegisteredEndpoints())
+	start := time.Now()
+	c, err = a.DialContext(ctx, "tcp", "dual.test:80")
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if raddr := c.RemoteAddr().String(); raddr != "10.0.0.2:80" {
+		t.Errorf("connected to %s, want 10.0.0.2:80", raddr)
+	}
+	if elapsed < HappyEyeballsDelay || elapsed > HappyEyeballsDelay+150*time.Millisecond {
+		t.Errorf("connected after %v, want about %v", elapsed, HappyEyeballsDelay)
+	}
+	// The IPv6 attempt was aborted.
+	for deadline := time.Now().Add(5 * time.Second); len(a.stack.RegisteredEndpoints()) != endpoints+1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d endpoints after connecting, want %d", len(a.stack.RegisteredEndpoints()), endpoints+1)
+		}
+	}
+}
+
+func TestDialHappyEyeballsDeadline(t *testing.T) {
+	a := dualStackPair(t, netip.MustParseAddr("10.0.0.3"))
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := a.DialContext(ctx, "tcp", "dual.test:80")
+	if !errors.Is(err, errTimeout) {
+		t.Fatalf("dial: got %v, want %v", err, errTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial returned after %v, past its deadline", elapsed)
+	}
+}
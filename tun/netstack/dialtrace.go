@@ -0,0 +1,370 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"math/bits"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// DialTraceEventType is the step of a TCP dial a DialTraceEvent marks.
+type DialTraceEventType int
+
+const (
+	DialResolveStart       DialTraceEventType = iota // DialContext starts resolving Host
+	DialResolveDone                                  // Host resolved to Addrs, or failed with Err
+	DialRouteSelected                                // an attempt to connect from Local to Addr starts
+	DialHandshakeWaitStart                           // the SYN to Addr is held by Options.WarmUp
+	DialHandshakeWaitDone                            // the held SYN to Addr is released
+	DialSYNSent                                      // a SYN, or a retransmission of it, was sent to Addr
+	DialSYNACKReceived                               // Addr answered the first SYN
+	DialEstablished                                  // the connection to Addr is established
+	DialFailed                                       // the attempt to connect to Addr failed with Err
+)
+
+func (typ DialTraceEventType) String() string {
+	switch typ {
+	case DialResolveStart:
+		return "resolve start"
+	case DialResolveDone:
+		return "resolve done"
+	case DialRouteSelected:
+		return "route selected"
+	case DialHandshakeWaitStart:
+		return "handshake wait start"
+	case DialHandshakeWaitDone:
+		return "handshake wait done"
+	case DialSYNSent:
+		return "SYN sent"
+	case DialSYNACKReceived:
+		return "SYN-ACK received"
+	case DialEstablished:
+		return "established"
+	case DialFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// DialTraceEvent is a step of a TCP dial, passed to the function set by
+// Net.SetDialTracer.
+type DialTraceEvent struct {
+	// ID identifies the dial, across its attempts to connect to each of
+	// the addresses of the host.
+	ID   uint64
+	Type DialTraceEventType
+	Time time.Time
+
+	Host  string       // the host dialed, for the resolve events
+	Addrs []netip.Addr // the addresses of Host, for DialResolveDone
+
+	// Addr and Local are the addresses connected to and from, for the
+	// events from DialRouteSelected on. Local is invalid if there is no
+	// route to Addr.
+	Addr  netip.AddrPort
+	Local netip.AddrPort
+
+	Err error // for DialResolveDone and DialFailed
+}
+
+// DialHistogramBuckets is the number of buckets of each histogram of
+// DialHistograms. Bucket 0 counts durations shorter than a millisecond,
+// bucket i > 0 those from 1ms<<(i-1) up to 1ms<<i, and the last one longer
+// ones as well.
+const DialHistogramBuckets = 16
+
+// DialHistogramBucketLimit returns the exclusive upper bound of bucket i of
+// a histogram of DialHistograms.
+func DialHistogramBucketLimit(i int) time.Duration {
+	return time.Millisecond << i
+}
+
+// DialHistograms counts the TCP dials traced while a function was set by
+// Net.SetDialTracer by how long each of their phases took.
+type DialHistograms struct {
+	Resolve       [DialHistogramBuckets]uint64 // resolving the host by DialContext
+	HandshakeWait [DialHistogramBuckets]uint64 // SYNs held by Options.WarmUp
+	Connect       [DialHistogramBuckets]uint64 // from the first SYN to the SYN-ACK
+	Total         [DialHistogramBuckets]uint64 // from the start of the dial until established
+}
+
+type dialHistograms struct {
+	resolve       [DialHistogramBuckets]atomic.Uint64
+	handshakeWait [DialHistogramBuckets]atomic.Uint64
+	connect       [DialHistogramBuckets]atomic.Uint64
+	total         [DialHistogramBuckets]atomic.Uint64
+}
+
+func observeDial(h *[DialHistogramBuckets]atomic.Uint64, d time.Duration) {
+	h[min(bits.Len64(uint64(max(d, 0)/time.Millisecond)), DialHistogramBuckets-1)].Add(1)
+}
+
+func (h *dialHistograms) load() (s DialHistograms) {
+	for i := range s.Resolve {
+		s.Resolve[i] = h.resolve[i].Load()
+		s.HandshakeWait[i] = h.handshakeWait[i].Load()
+		s.Connect[i] = h.connect[i].Load()
+		s.Total[i] = h.total[i].Load()
+	}
+	return
+}
+
+// dialTracer traces the TCP dials made while a function is set, following
+// the SYNs and SYN-ACKs of their attempts through the tunnel.
+type dialTracer struct {
+	fn         atomic.Pointer[func(DialTraceEvent)]
+	ids        atomic.Uint64
+	histograms dialHistograms
+
+	mu       sync.Mutex
+	attempts map[dialFlow]*dialAttempt
+	active   atomic.Int32 // len(attempts), to skip parsing packets without any
+}
+
+// dialFlow identifies the packets of an attempt sent to remote from the
+// local port.
+type dialFlow struct {
+	port   uint16
+	remote netip.AddrPort
+}
+
+// tracedDial is a dial being traced, carried by the context of its
+// attempts.
+type tracedDial struct {
+	tracer *dialTracer
+	fn     func(DialTraceEvent)
+	id     uint64
+	start  time.Time
+}
+
+// dialAttempt is an attempt of a traced dial to connect to an address.
+type dialAttempt struct {
+	dial       *tracedDial
+	flow       dialFlow
+	local      netip.AddrPort
+	held       time.Time // when the SYN was held, if it is
+	firstSYN   time.Time
+	synAckSeen bool
+	registered bool
+}
+
+type tracedDialKey struct{}
+
+// SetDialTracer sets fn to be called with the events of the TCP dials
+// started afterwards by DialContext, DialContextTCP and the like, such as
+// to find out why a dial is slow. The events of a dial are delivered in
+// order, but those of concurrent dials may interleave, so fn must be safe
+// for concurrent use. As it is called on the paths of packets, it must not
+// block. Traced dials are counted by DialHistograms. A nil fn stops tracing.
+//
+// Tracing binds the endpoints of dials to an ephemeral port before they
+// connect, so that their SYNs can be told apart.
+func (net *Net) SetDialTracer(fn func(DialTraceEvent)) {
+	if fn == nil {
+		net.dialTrace.fn.Store(nil)
+		return
+	}
+	net.dialTrace.fn.Store(&fn)
+}
+
+// DialHistograms returns how long the phases of the dials traced while a
+// function was set by SetDialTracer took.
+func (net *Net) DialHistograms() DialHistograms {
+	return net.dialTrace.histograms.load()
+}
+
+// start returns ctx carrying a new traced dial, unless no tracer is set or
+// ctx already carries one, and the dial carried by ctx, if any. own reports
+// whether the dial is new.
+func (d *dialTracer) start(ctx context.Context) (_ context.Context, dial *tracedDial, own bool) {
+	if dial, ok := ctx.Value(tracedDialKey{}).(*tracedDial); ok {
+		return ctx, dial, false
+	}
+	fn := d.fn.Load()
+	if fn == nil {
+		return ctx, nil, false
+	}
+	dial = &tracedDial{tracer: d, fn: *fn, id: d.ids.Add(1), start: time.Now()}
+	return context.WithValue(ctx, tracedDialKey{}, dial), dial, true
+}
+
+func (dial *tracedDial) emit(ev DialTraceEvent) {
+	if dial == nil {
+		return
+	}
+	ev.ID = dial.id
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	dial.fn(ev)
+}
+
+// resolved marks the end of resolving host, which started at start.
+func (dial *tracedDial) resolved(host string, start time.Time, addrs []string, err error) {
+	if dial == nil {
+		return
+	}
+	ev := DialTraceEvent{Type: DialResolveDone, Host: host, Err: err}
+	for _, addr := range addrs {
+		if ip, err := netip.ParseAddr(addr); err == nil {
+			ev.Addrs = append(ev.Addrs, ip)
+		}
+	}
+	ev.Time = time.Now()
+	observeDial(&dial.tracer.histograms.resolve, ev.Time.Sub(start))
+	dial.emit(ev)
+}
+
+// established marks the end of a successful dial.
+func (dial *tracedDial) established() {
+	if dial == nil {
+		return
+	}
+	observeDial(&dial.tracer.histograms.total, time.Since(dial.start))
+}
+
+// attempt starts an attempt of dial to connect ep, bound to a local port,
+// to raddr, and follows its SYNs and SYN-ACK until done is called.
+func (dial *tracedDial) attempt(s *stack.Stack, ep tcpip.Endpoint, raddr tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) *dialAttempt {
+	if dial == nil {
+		return nil
+	}
+	ip, _ := netip.AddrFromSlice(raddr.Addr.AsSlice())
+	a := &dialAttempt{dial: dial, flow: dialFlow{remote: netip.AddrPortFrom(ip, raddr.Port)}}
+	bound, tcpipErr := ep.GetLocalAddress()
+	if tcpipErr == nil {
+		a.flow.port = bound.Port
+	}
+	if r, tcpipErr := s.FindRoute(0, bound.Addr, raddr.Addr, pn, false); tcpipErr == nil {
+		local := r.LocalAddress()
+		ip, _ := netip.AddrFromSlice(local.AsSlice())
+		a.local = netip.AddrPortFrom(ip, a.flow.port)
+		r.Release()
+	}
+	dial.emit(DialTraceEvent{Type: DialRouteSelected, Addr: a.flow.remote, Local: a.local})
+
+	d := dial.tracer
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.attempts == nil {
+		d.attempts = make(map[dialFlow]*dialAttempt)
+	}
+	if _, ok := d.attempts[a.flow]; !ok && a.flow.port != 0 {
+		d.attempts[a.flow] = a
+		a.registered = true
+		d.active.Add(1)
+	}
+	return a
+}
+
+// done marks the end of the attempt, which connected if err is nil.
+func (a *dialAttempt) done(err error) {
+	if a == nil {
+		return
+	}
+	if a.registered {
+		d := a.dial.tracer
+		d.mu.Lock()
+		delete(d.attempts, a.flow)
+		d.active.Add(-1)
+		d.mu.Unlock()
+	}
+	ev := DialTraceEvent{Type: DialEstablished, Addr: a.flow.remote, Local: a.local}
+	if err != nil {
+		ev.Type, ev.Err = DialFailed, err
+	}
+	a.dial.emit(ev)
+}
+
+// lookup returns the attempt packet belongs to, if it is the SYN of one and
+// outbound, or its SYN-ACK and inbound.
+func (d *dialTracer) lookup(packet []byte, outbound bool) *dialAttempt {
+	if d.active.Load() == 0 {
+		return nil
+	}
+	p, ok := parseSNATPacket(packet)
+	if !ok || p.flow.proto != header.TCPProtocolNumber {
+		return nil
+	}
+	flags := header.TCP(p.transport).Flags() & (header.TCPFlagSyn | header.TCPFlagAck)
+	var flow dialFlow
+	switch {
+	case outbound && flags == header.TCPFlagSyn:
+		flow = dialFlow{port: p.flow.src.Port(), remote: p.flow.dst}
+	case !outbound && flags == header.TCPFlagSyn|header.TCPFlagAck:
+		flow = dialFlow{port: p.flow.dst.Port(), remote: p.flow.src}
+	default:
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.attempts[flow]
+}
+
+// hold traces an outbound packet held by Options.WarmUp.
+func (d *dialTracer) hold(packet []byte) {
+	a := d.lookup(packet, true)
+	if a == nil {
+		return
+	}
+	d.mu.Lock()
+	first := a.held.IsZero()
+	if first {
+		a.held = time.Now()
+	}
+	d.mu.Unlock()
+	if first {
+		a.dial.emit(DialTraceEvent{Type: DialHandshakeWaitStart, Time: a.held, Addr: a.flow.remote, Local: a.local})
+	}
+}
+
+// send traces an outbound packet handed to the device, which may have been
+// held by Options.WarmUp.
+func (d *dialTracer) send(packet []byte) {
+	a := d.lookup(packet, true)
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	d.mu.Lock()
+	held := a.held
+	a.held = time.Time{}
+	if a.firstSYN.IsZero() {
+		a.firstSYN = now
+	}
+	d.mu.Unlock()
+	if !held.IsZero() {
+		observeDial(&d.histograms.handshakeWait, now.Sub(held))
+		a.dial.emit(DialTraceEvent{Type: DialHandshakeWaitDone, Time: now, Addr: a.flow.remote, Local: a.local})
+	}
+	a.dial.emit(DialTraceEvent{Type: DialSYNSent, Time: now, Addr: a.flow.remote, Local: a.local})
+}
+
+// receive traces an inbound packet.
+func (d *dialTracer) receive(packet []byte) {
+	a := d.lookup(packet, false)
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	d.mu.Lock()
+	firstSYN := a.firstSYN
+	first := !a.synAckSeen && !firstSYN.IsZero()
+	a.synAckSeen = true
+	d.mu.Unlock()
+	if first {
+		observeDial(&d.histograms.connect, now.Sub(firstSYN))
+		a.dial.emit(DialTraceEvent{Type: DialSYNACKReceived, Time: now, Addr: a.flow.remote, Local: a.local})
+	}
+}
@@ -0,0 +1,161 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dialTraceRecorder struct {
+	mu     sync.Mutex
+	events []DialTraceEvent
+}
+
+func (r *dialTraceRecorder) record(ev DialTraceEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+// check checks that the events recorded are of a single dial, and of the
+// types want in order.
+func (r *dialTraceRecorder) check(t *testing.T, want ...DialTraceEventType) []DialTraceEvent {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var got []DialTraceEventType
+	for i, ev := range r.events {
+		got = append(got, ev.Type)
+		if ev.ID != r.events[0].ID {
+			t.Errorf("event %v of dial %d, want %d", ev.Type, ev.ID, r.events[0].ID)
+		}
+		if i > 0 && ev.Time.Before(r.events[i-1].Time) {
+			t.Errorf("event %v at %v, before the previous one", ev.Type, ev.Time)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+	return r.events
+}
+
+func histogramCount(h [DialHistogramBuckets]uint64) (n uint64) {
+	for _, count := range h {
+		n += count
+	}
+	return
+}
+
+func TestDialTrace(t *testing.T) {
+	a, b, _ := splicedPair(t, SpliceOptions{Latency: 20 * time.Millisecond})
+	ln, err := b.ListenTCPAddrPort(netip.AddrPortFrom(spliceAddrB, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	a.SetHosts(map[string][]netip.Addr{"b.test": {spliceAddrB}})
+	var r dialTraceRecorder
+	a.SetDialTracer(r.record)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := a.DialContext(ctx, "tcp", "b.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	events := r.check(t, DialResolveStart, DialResolveDone, DialRouteSelected, DialSYNSent, DialSYNACKReceived, DialEstablished)
+	if events[0].Host != "b.test" || !slices.Equal(events[1].Addrs, []netip.Addr{spliceAddrB}) {
+		t.Errorf("resolved %q to %v", events[1].Host, events[1].Addrs)
+	}
+	route := events[2]
+	if route.Addr != netip.AddrPortFrom(spliceAddrB, 80) || route.Local.Addr() != spliceAddrA || route.Local.Port() == 0 {
+		t.Errorf("route selected from %v to %v", route.Local, route.Addr)
+	}
+	if rtt := events[4].Time.Sub(events[3].Time); rtt < 40*time.Millisecond {
+		t.Errorf("SYN-ACK received %v after the SYN, within the round trip", rtt)
+	}
+
+	h := a.DialHistograms()
+	for _, phase := range []struct {
+		name string
+		h    [DialHistogramBuckets]uint64
+		want uint64
+	}{
+		{"resolve", h.Resolve, 1},
+		{"handshake wait", h.HandshakeWait, 0},
+		{"connect", h.Connect, 1},
+		{"total", h.Total, 1},
+	} {
+		if n := histogramCount(phase.h); n != phase.want {
+			t.Errorf("%d dials in the %s histogram, want %d", n, phase.name, phase.want)
+		}
+	}
+	// The round trip of 40ms falls in the bucket from 32ms, or a later one.
+	if slices.Index(h.Connect[:], 1) < 6 {
+		t.Errorf("connect histogram %v, want the dial from bucket 6", h.Connect)
+	}
+
+	// Without a tracer, nothing is recorded.
+	a.SetDialTracer(nil)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	if c, err := a.DialContext(ctx, "tcp", "b.test:80"); err != nil {
+		t.Fatal(err)
+	} else {
+		c.Close()
+	}
+	if n := histogramCount(a.DialHistograms().Total); n != 1 {
+		t.Errorf("%d dials counted, want the traced one only", n)
+	}
+}
+
+func TestDialTraceTimeout(t *testing.T) {
+	// The SYN is held for a handshake that never completes, then sent and
+	// never answered.
+	tnet := blackhole(t, Options{
+		WarmUp: WarmUpOptions{
+			Ready: func(netip.Addr) bool { return false },
+			Hold:  50 * time.Millisecond,
+		},
+	})
+	var r dialTraceRecorder
+	tnet.SetDialTracer(r.record)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if c, err := tnet.DialContext(ctx, "tcp", "192.168.4.1:80"); err == nil {
+		c.Close()
+		t.Fatal("dial to a blackhole succeeded")
+	}
+
+	events := r.check(t, DialResolveStart, DialResolveDone, DialRouteSelected, DialHandshakeWaitStart, DialHandshakeWaitDone, DialSYNSent, DialFailed)
+	if held := events[4].Time.Sub(events[3].Time); held < 50*time.Millisecond {
+		t.Errorf("SYN held for %v, want at least 50ms", held)
+	}
+	if events[6].Err == nil {
+		t.Error("failed event without an error")
+	}
+
+	h := tnet.DialHistograms()
+	if histogramCount(h.HandshakeWait) != 1 || histogramCount(h.Connect) != 0 || histogramCount(h.Total) != 0 {
+		t.Errorf("histograms %+v, want the handshake wait only", h)
+	}
+}
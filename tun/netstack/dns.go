@@ -0,0 +1,348 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultDNSTimeout bounds a query to an upstream resolver.
+const DefaultDNSTimeout = 5 * time.Second
+
+// DNSOptions configures the resolvers queried by LookupContextHost, and
+// therefore DialContext.
+type DNSOptions struct {
+	// Upstreams are the resolvers queried, in order, until one answers,
+	// instead of the servers passed to CreateNetTUNWithOptions. Each is
+	// either the address of a plain DNS server, such as "192.0.2.53" or
+	// "[2001:db8::53]:5353", queried over UDP, or TCP if the answer is
+	// truncated; "tls://host[:port]", a DNS-over-TLS server, port 853 by
+	// default; or "https://host[:port]/path", a DNS-over-HTTPS server.
+	// Host names of upstreams are resolved with the hosts table and the
+	// servers passed to CreateNetTUNWithOptions only.
+	Upstreams []string
+
+	// TLSConfig, if set, is the base configuration of the TLS connections
+	// to upstreams, such as to trust custom RootCAs or, for testing, to skip
+	// verification with InsecureSkipVerify. Unless it sets ServerName, the
+	// certificate is verified against the host of each upstream.
+	TLSConfig *tls.Config
+
+	// Timeout bounds each query to an upstream, including connecting to
+	// it. Zero selects DefaultDNSTimeout.
+	Timeout time.Duration
+}
+
+// dnsIdleTimeout is how long connections to encrypted upstreams are kept
+// for reuse, and maxIdleDNSConns how many of them per upstream.
+const (
+	dnsIdleTimeout  = 30 * time.Second
+	maxIdleDNSConns = 2
+)
+
+// A dnsUpstream is a resolver queried by tryOneName.
+type dnsUpstream interface {
+	exchange(ctx context.Context, q dnsmessage.Question) (dnsmessage.Parser, dnsmessage.Header, error)
+	close()
+	String() string
+}
+
+// bootstrapKey marks the context of lookups of the host names of upstreams,
+// which only query the servers passed to CreateNetTUNWithOptions.
+type bootstrapKey struct{}
+
+func (tnet *Net) upstreamsFor(ctx context.Context) []dnsUpstream {
+	if ctx.Value(bootstrapKey{}) != nil {
+		return tnet.dnsBootstrap
+	}
+	return tnet.dnsUpstreams
+}
+
+// dialUpstream connects to the host and port of an encrypted upstream.
+func (tnet *Net) dialUpstream(ctx context.Context, network, address string) (net.Conn, error) {
+	return tnet.DialContext(context.WithValue(ctx, bootstrapKey{}, true), network, address)
+}
+
+// setDNSOptions sets the upstreams of the stack, those passed to
+// CreateNetTUNWithOptions becoming the bootstrap ones.
+func (tnet *Net) setDNSOptions(servers []netip.Addr, opts DNSOptions) error {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDNSTimeout
+	}
+	for _, server := range servers {
+		tnet.dnsBootstrap = append(tnet.dnsBootstrap, &plainUpstream{tnet, netip.AddrPortFrom(server, 53), timeout})
+	}
+	if len(opts.Upstreams) == 0 {
+		tnet.dnsUpstreams = tnet.dnsBootstrap
+		return nil
+	}
+	for _, s := range opts.Upstreams {
+		u, err := tnet.parseUpstream(s, opts.TLSConfig, timeout)
+		if err != nil {
+			return err
+		}
+		tnet.dnsUpstreams = append(tnet.dnsUpstreams, u)
+	}
+	return nil
+}
+
+func (tnet *Net) parseUpstream(s string, cfg *tls.Config, timeout time.Duration) (dnsUpstream, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return &plainUpstream{tnet, netip.AddrPortFrom(addr, 53), timeout}, nil
+	}
+	if addr, err := netip.ParseAddrPort(s); err == nil {
+		return &plainUpstream{tnet, addr, timeout}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || u.User != nil {
+		return nil, fmt.Errorf("invalid DNS upstream %q", s)
+	}
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	cfg = cfg.Clone()
+	switch u.Scheme {
+	case "tls":
+		if u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid DNS upstream %q: DNS-over-TLS has no path", s)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "853"
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		return &dotUpstream{tnet: tnet, addr: net.JoinHostPort(u.Hostname(), port), cfg: cfg, timeout: timeout}, nil
+	case "https":
+		return &dohUpstream{
+			url: u.String(),
+			client: &http.Client{Transport: &http.Transport{
+				DialContext:         tnet.dialUpstream,
+				TLSClientConfig:     cfg,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: maxIdleDNSConns,
+				IdleConnTimeout:     dnsIdleTimeout,
+			}},
+			timeout: timeout,
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid DNS upstream %q: unsupported scheme %q", s, u.Scheme)
+}
+
+// plainUpstream is a DNS server queried over UDP, and TCP if the answer is
+// truncated.
+type plainUpstream struct {
+	tnet    *Net
+	addr    netip.AddrPort
+	timeout time.Duration
+}
+
+func (u *plainUpstream) exchange(ctx context.Context, q dnsmessage.Question) (dnsmessage.Parser, dnsmessage.Header, error) {
+	return u.tnet.exchange(ctx, u.addr, q, u.timeout)
+}
+
+func (u *plainUpstream) close() {}
+
+func (u *plainUpstream) String() string {
+	if u.addr.Port() == 53 {
+		return u.addr.Addr().String()
+	}
+	return u.addr.String()
+}
+
+// dotUpstream is a DNS-over-TLS server, to which queries are sent one at a
+// time per connection, and the connections kept for reuse.
+type dotUpstream struct {
+	tnet    *Net
+	addr    string
+	cfg     *tls.Config
+	timeout time.Duration
+
+	mu   sync.Mutex
+	idle []idleTLSConn
+}
+
+type idleTLSConn struct {
+	c     *tls.Conn
+	since time.Time
+}
+
+func (u *dotUpstream) exchange(ctx context.Context, q dnsmessage.Question) (dnsmessage.Parser, dnsmessage.Header, error) {
+	q.Class = dnsmessage.ClassINET
+	id, _, tcpReq, err := newRequest(q)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotMarshalDNSMessage
+	}
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	for {
+		c, reused := u.get()
+		if c == nil {
+			if c, err = u.dial(ctx); err != nil {
+				return dnsmessage.Parser{}, dnsmessage.Header{}, dnsContextError(err)
+			}
+		}
+		deadline, _ := ctx.Deadline()
+		c.SetDeadline(deadline)
+		p, h, err := dnsStreamRoundTrip(c, id, q, tcpReq)
+		if err == nil {
+			if err := p.SkipQuestion(); err != dnsmessage.ErrSectionDone {
+				c.Close()
+				return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+			}
+			u.put(c)
+			return p, h, nil
+		}
+		c.Close()
+		// The server may have closed the connection while it was idle.
+		if !reused || ctx.Err() != nil {
+			return dnsmessage.Parser{}, dnsmessage.Header{}, dnsContextError(err)
+		}
+	}
+}
+
+func (u *dotUpstream) dial(ctx context.Context) (*tls.Conn, error) {
+	c, err := u.tnet.dialUpstream(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(c, u.cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// get returns the most recently used idle connection, if any.
+func (u *dotUpstream) get() (c *tls.Conn, reused bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for len(u.idle) > 0 {
+		last := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if time.Since(last.since) < dnsIdleTimeout {
+			return last.c, true
+		}
+		last.c.Close()
+	}
+	return nil, false
+}
+
+func (u *dotUpstream) put(c *tls.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle) >= maxIdleDNSConns {
+		u.idle[0].c.Close()
+		u.idle = append(u.idle[:0], u.idle[1:]...)
+	}
+	u.idle = append(u.idle, idleTLSConn{c, time.Now()})
+}
+
+func (u *dotUpstream) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, idle := range u.idle {
+		idle.c.Close()
+	}
+	u.idle = nil
+}
+
+func (u *dotUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+// dohUpstream is a DNS-over-HTTPS server, queried with POST requests.
+type dohUpstream struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+// maxDNSMessageSize is the largest DNS message, that of TCP.
+const maxDNSMessageSize = 65535
+
+func (u *dohUpstream) exchange(ctx context.Context, q dnsmessage.Question) (dnsmessage.Parser, dnsmessage.Header, error) {
+	q.Class = dnsmessage.ClassINET
+	id, udpReq, _, err := newRequest(q)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotMarshalDNSMessage
+	}
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(udpReq))
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errors.New(errServerMisbehaving.Error() + ": " + resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, dnsContextError(err)
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
+	}
+	respQ, err := p.Question()
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
+	}
+	if !checkResponse(id, q, h, respQ) {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+	}
+	if err := p.SkipQuestion(); err != dnsmessage.ErrSectionDone {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+	}
+	return p, h, nil
+}
+
+func (u *dohUpstream) close() {
+	u.client.CloseIdleConnections()
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+// dnsContextError replaces the errors of a context with those of the
+// resolver of the standard library.
+func dnsContextError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return errCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return errTimeout
+	}
+	return err
+}
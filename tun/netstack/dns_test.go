@@ -0,0 +1,286 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTestServer answers A queries for the names of its records over UDP
+// port 53, TLS port 853 and HTTPS port 443 at spliceAddrB, counting the
+// queries by transport.
+type dnsTestServer struct {
+	records map[string]netip.Addr
+
+	mu       sync.Mutex
+	queries  map[string][]string // names queried, by transport
+	dotConns []net.Conn
+}
+
+func startDNSTestServer(t *testing.T, b *Net, cert tls.Certificate, records map[string]netip.Addr) *dnsTestServer {
+	t.Helper()
+	srv := &dnsTestServer{records: records, queries: make(map[string][]string)}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	pc, err := b.ListenUDPAddrPort(netip.AddrPortFrom(spliceAddrB, 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(srv.answer("udp", buf[:n]), addr)
+		}
+	}()
+
+	dot, err := b.ListenTLS(netip.AddrPortFrom(spliceAddrB, 853), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dot.Close() })
+	go func() {
+		for {
+			c, err := dot.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.dotConns = append(srv.dotConns, c)
+			srv.mu.Unlock()
+			go srv.serveStream(c)
+		}
+	}()
+
+	doh, err := b.ListenTLS(netip.AddrPortFrom(spliceAddrB, 443), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := io.ReadAll(r.Body)
+		if err != nil || r.Method != http.MethodPost || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(srv.answer("https", query))
+	})}
+	go hs.Serve(doh)
+	t.Cleanup(func() { hs.Close() })
+	return srv
+}
+
+// serveStream answers the queries sent over c until it is closed.
+func (srv *dnsTestServer) serveStream(c net.Conn) {
+	defer c.Close()
+	for {
+		var l [2]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return
+		}
+		query := make([]byte, int(l[0])<<8|int(l[1]))
+		if _, err := io.ReadFull(c, query); err != nil {
+			return
+		}
+		resp := srv.answer("tls", query)
+		c.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+	}
+}
+
+func (srv *dnsTestServer) answer(transport string, query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	srv.mu.Lock()
+	srv.queries[transport] = append(srv.queries[transport], q.Name.String())
+	srv.mu.Unlock()
+
+	addr, ok := srv.records[q.Name.String()]
+	h.Response, h.RecursionAvailable = true, true
+	if !ok {
+		h.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if ok && q.Type == dnsmessage.TypeA {
+		b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: addr.As4()})
+	}
+	resp, _ := b.Finish()
+	return resp
+}
+
+func (srv *dnsTestServer) queried(transport string) []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return slices.Clone(srv.queries[transport])
+}
+
+func TestEncryptedDNS(t *testing.T) {
+	want := netip.MustParseAddr("192.0.2.1")
+	records := map[string]netip.Addr{
+		"a.test.":   want,
+		"doh.test.": spliceAddrB,
+	}
+	cert, pool := testCertificate(t, spliceAddrB, "doh.test")
+
+	// client returns a Net with opts and spliceAddrB as its bootstrap
+	// server, spliced to a dnsTestServer.
+	client := func(t *testing.T, opts DNSOptions) (*Net, *dnsTestServer) {
+		t.Helper()
+		devA, a, err := CreateNetTUNWithOptions([]netip.Addr{spliceAddrA}, []netip.Addr{spliceAddrB}, 1420, Options{DNS: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { devA.Close() })
+		devB, b, err := CreateNetTUN([]netip.Addr{spliceAddrB}, nil, 1420)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { devB.Close() })
+		t.Cleanup(Splice(a, b))
+		return a, startDNSTestServer(t, b, cert, records)
+	}
+	lookup := func(t *testing.T, a *Net) error {
+		t.Helper()
+		addrs, err := a.LookupHost("a.test")
+		if err == nil && !slices.Equal(addrs, []string{want.String()}) {
+			t.Errorf("a.test resolved to %v, want %v", addrs, want)
+		}
+		return err
+	}
+	checkQueried := func(t *testing.T, srv *dnsTestServer, transport string, want ...string) {
+		t.Helper()
+		if got := srv.queried(transport); !slices.Equal(got, want) {
+			t.Errorf("queried over %s: %q, want %q", transport, got, want)
+		}
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		a, srv := client(t, DNSOptions{
+			Upstreams: []string{"tls://" + spliceAddrB.String()},
+			TLSConfig: &tls.Config{RootCAs: pool},
+		})
+		for range 2 {
+			if err := lookup(t, a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkQueried(t, srv, "tls", "a.test.", "a.test.")
+		checkQueried(t, srv, "udp")
+		srv.mu.Lock()
+		conns := slices.Clone(srv.dotConns)
+		srv.mu.Unlock()
+		if len(conns) != 1 {
+			t.Fatalf("%d connections for two queries, want 1", len(conns))
+		}
+
+		// A connection closed by the server while idle is replaced.
+		conns[0].Close()
+		if err := lookup(t, a); err != nil {
+			t.Fatal(err)
+		}
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if len(srv.dotConns) != 2 {
+			t.Errorf("%d connections, want 2", len(srv.dotConns))
+		}
+	})
+
+	t.Run("https", func(t *testing.T) {
+		a, srv := client(t, DNSOptions{
+			Upstreams: []string{"https://doh.test/dns-query"},
+			TLSConfig: &tls.Config{RootCAs: pool},
+		})
+		if err := lookup(t, a); err != nil {
+			t.Fatal(err)
+		}
+		checkQueried(t, srv, "https", "a.test.")
+		// Only the name of the upstream was resolved in plaintext.
+		checkQueried(t, srv, "udp", "doh.test.")
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		a, srv := client(t, DNSOptions{
+			Upstreams: []string{
+				"tls://" + spliceAddrB.String() + ":854",
+				"https://doh.test/dns-query",
+				spliceAddrB.String(),
+			},
+			TLSConfig: &tls.Config{RootCAs: pool},
+		})
+		if err := lookup(t, a); err != nil {
+			t.Fatal(err)
+		}
+		checkQueried(t, srv, "https", "a.test.")
+		checkQueried(t, srv, "udp", "doh.test.")
+	})
+
+	t.Run("verification", func(t *testing.T) {
+		a, srv := client(t, DNSOptions{Upstreams: []string{"tls://" + spliceAddrB.String()}})
+		err := lookup(t, a)
+		if err == nil || !strings.Contains(err.Error(), "certificate") {
+			t.Errorf("lookup with an untrusted certificate returned %v", err)
+		}
+		checkQueried(t, srv, "tls")
+
+		a, _ = client(t, DNSOptions{
+			Upstreams: []string{"tls://" + spliceAddrB.String()},
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		})
+		if err := lookup(t, a); err != nil {
+			t.Errorf("lookup skipping verification: %v", err)
+		}
+	})
+
+	for _, upstream := range []string{"ftp://192.0.2.1", "tls://192.0.2.1/path", "192.0.2"} {
+		if _, _, err := CreateNetTUNWithOptions(nil, nil, 1420, Options{DNS: DNSOptions{Upstreams: []string{upstream}}}); err == nil {
+			t.Errorf("upstream %q accepted", upstream)
+		}
+	}
+}
+
+func TestDNSOptionsInvalidUpstream(t *testing.T) {
+	// The stack created before the upstreams are parsed is closed again,
+	// stopping its goroutines.
+	before := runtime.NumGoroutine()
+	for range 10 {
+		_, _, err := CreateNetTUNWithOptions([]netip.Addr{netip.MustParseAddr("192.168.4.29")}, nil, 1420, Options{
+			DNS: DNSOptions{Upstreams: []string{"192.168.4.1", "gopher://dns.test"}},
+		})
+		if err == nil {
+			t.Fatal("created a stack with an invalid DNS upstream")
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, %d before", runtime.NumGoroutine(), before)
+		}
+	}
+}
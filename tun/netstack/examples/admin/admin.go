@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package admin serves a read-only status page for a device over HTTPS,
+// listening on the device's tunnel address so that only its peers can reach
+// it.
+package admin
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"html/template"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/darkit/wireguard/device"
+	"github.com/darkit/wireguard/tun/netstack"
+)
+
+// Server serves the status page of Device on Addr of Net.
+type Server struct {
+	Device    *device.Device
+	Net       *netstack.Net
+	Addr      netip.AddrPort
+	TLSConfig *tls.Config // with the server's certificate; see SelfSignedConfig
+
+	// Logf, if set, logs each request, naming the tunnel address of the
+	// peer that made it.
+	Logf func(format string, args ...any)
+}
+
+// secretKeys are the UAPI keys left out of the status page.
+var secretKeys = map[string]bool{
+	"private_key":   true,
+	"preshared_key": true,
+}
+
+var page = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<title>WireGuard status</title>
+<p>Connected from {{.Remote}}.</p>
+{{range .Sections}}<table>
+{{range .}}<tr><th>{{.Key}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}`))
+
+type line struct {
+	Key, Value string
+}
+
+// Handler returns the handler of the status page, which lists the
+// configuration and statistics of the device and its peers, without keys
+// other than public ones.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Logf != nil {
+			s.Logf("%s %s %s from %s", r.Proto, r.Method, r.URL, r.RemoteAddr)
+		}
+		cfg, err := s.Device.IpcGet()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sections := [][]line{nil}
+		scanner := bufio.NewScanner(strings.NewReader(cfg))
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), "=")
+			if secretKeys[key] {
+				continue
+			}
+			if key == "public_key" {
+				sections = append(sections, nil)
+			}
+			sections[len(sections)-1] = append(sections[len(sections)-1], line{key, value})
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		page.Execute(w, struct {
+			Remote   string
+			Sections [][]line
+		}{r.RemoteAddr, sections})
+	})
+}
+
+// ListenAndServe serves the status page until ctx is done, then shuts the
+// server down, waiting for pending requests to complete.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	ln, err := s.Net.ListenTLS(s.Addr, s.TLSConfig)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:     s.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-done
+}
+
+// SelfSignedConfig returns a TLS configuration with a new self-signed
+// certificate for hosts, which are IP addresses or DNS names. Clients must
+// be told to trust it explicitly.
+func SelfSignedConfig(hosts ...string) (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "wireguard admin"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip, err := netip.ParseAddr(host); err == nil {
+			template.IPAddresses = append(template.IPAddresses, ip.AsSlice())
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}, nil
+}
@@ -0,0 +1,54 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package admin
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/darkit/wireguard/conn/bindtest"
+	"github.com/darkit/wireguard/device"
+	"github.com/darkit/wireguard/tun/netstack"
+)
+
+func TestHandlerHidesSecrets(t *testing.T) {
+	tun, _, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("192.168.4.29")}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewDevice(tun, bindtest.NewChannelBinds()[0], device.NewLogger(device.LogLevelError, ""))
+	defer dev.Close()
+	sk, err := device.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err := device.NewPresharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := device.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := peerKey.PublicKey()
+	if err := dev.IpcSet("private_key=" + sk.Hex() + "\npublic_key=" + peer.Hex() + "\npreshared_key=" + psk.Hex() + "\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.4.28:40000"
+	(&Server{Device: dev}).Handler().ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if strings.Contains(body, sk.Hex()) || strings.Contains(body, psk.Hex()) {
+		t.Errorf("status page shows secret keys:\n%s", body)
+	}
+	if !strings.Contains(body, peer.Hex()) || !strings.Contains(body, req.RemoteAddr) {
+		t.Errorf("status page lacks the peer or the client address:\n%s", body)
+	}
+}
@@ -8,20 +8,22 @@
 package main
 
 import (
-	"io"
+	"context"
 	"log"
-	"net"
-	"net/http"
 	"net/netip"
+	"os"
+	"os/signal"
 
 	"github.com/darkit/wireguard/conn"
 	"github.com/darkit/wireguard/device"
 	"github.com/darkit/wireguard/tun/netstack"
+	"github.com/darkit/wireguard/tun/netstack/examples/admin"
 )
 
 func main() {
+	local := netip.MustParseAddr("192.168.4.29")
 	tun, tnet, err := netstack.CreateNetTUN(
-		[]netip.Addr{netip.MustParseAddr("192.168.4.29")},
+		[]netip.Addr{local},
 		[]netip.Addr{netip.MustParseAddr("8.8.8.8"), netip.MustParseAddr("8.8.4.4")},
 		1420,
 	)
@@ -36,16 +38,21 @@ allowed_ip=192.168.4.28/32
 persistent_keepalive_interval=25
 `)
 	dev.Up()
-	listener, err := tnet.ListenTCP(&net.TCPAddr{Port: 80})
+
+	cfg, err := admin.SelfSignedConfig(local.String())
 	if err != nil {
 		log.Panicln(err)
 	}
-	http.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
-		log.Printf("> %s - %s - %s", request.RemoteAddr, request.URL.String(), request.UserAgent())
-		io.WriteString(writer, "Hello from userspace TCP!")
-	})
-	err = http.Serve(listener, nil)
-	if err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	server := admin.Server{
+		Device:    dev,
+		Net:       tnet,
+		Addr:      netip.AddrPortFrom(local, 443),
+		TLSConfig: cfg,
+		Logf:      log.Printf,
+	}
+	if err := server.ListenAndServe(ctx); err != nil {
 		log.Panicln(err)
 	}
 }
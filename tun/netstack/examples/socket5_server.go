@@ -45,9 +45,13 @@ func ServeSocks5(ipStack *netstack.Net, selfIp []byte, bindAddr, dnsServer strin
 	if bindAddr == "" {
 		bindAddr = ":1080"
 	}
-	resolver := socks5.DNSResolver{}
+	// Without a DNS server of its own, the proxy leaves domain names to the
+	// dialer, which resolves them with the DNS servers of the tunnel. Either
+	// way, names are never resolved on the host.
+	var resolver socks5.NameResolver = socks5.NetResolver{Net: ipStack}
+	policy := socks5.ResolveRemote
 	if dnsServer != "" {
-		resolver = socks5.DNSResolver{
+		resolver = &socks5.DNSResolver{
 			Resolver: net.Resolver{
 				PreferGo: true,
 				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
@@ -55,9 +59,11 @@ func ServeSocks5(ipStack *netstack.Net, selfIp []byte, bindAddr, dnsServer strin
 				},
 			},
 		}
+		policy = socks5.ResolveLocal
 	}
 	server := socks5.Server{
-		Resolver: &resolver,
+		Resolver:     resolver,
+		DomainPolicy: policy,
 		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			log.Printf("socks dial: %s", addr)
 
@@ -67,7 +73,18 @@ func ServeSocks5(ipStack *netstack.Net, selfIp []byte, bindAddr, dnsServer strin
 
 			addrPort, err := netip.ParseAddrPort(addr)
 			if err != nil {
-				return nil, errors.New("parse AddrPort failed: " + err.Error())
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, errors.New("parse AddrPort failed: " + err.Error())
+				}
+				_, ip, err := resolver.Resolve(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				addrPort, err = netip.ParseAddrPort(net.JoinHostPort(ip.String(), port))
+				if err != nil {
+					return nil, errors.New("parse AddrPort failed: " + err.Error())
+				}
 			}
 
 			addrTarget := tcpip.FullAddress{
@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/darkit/wireguard/tun/netstack"
+)
+
+// Authenticator checks the username and password a client provides.
+type Authenticator interface {
+	// Authenticate returns the identity the credentials belong to, or an
+	// error if they are not valid.
+	Authenticate(username, password string) (*Identity, error)
+}
+
+// Identity is an authenticated client and the rules it is subject to.
+type Identity struct {
+	// Name identifies the client in Usage records and shares the
+	// MaxConns limit between all of its connections.
+	Name string
+
+	Rules Rules
+}
+
+// Rules restrict the connections of an Identity. The zero value allows
+// everything.
+type Rules struct {
+	// Destinations, if not empty, are the prefixes connections may be
+	// made to. Requests naming a domain are refused unless the Server
+	// resolves them itself, with the ResolveLocal DomainPolicy.
+	Destinations []netip.Prefix
+
+	// Ports, if not empty, are the destination ports connections may be
+	// made to.
+	Ports []uint16
+
+	// MaxConns, if positive, is the number of connections the identity
+	// may have open at once.
+	MaxConns int
+
+	// BytesPerSecond, if positive, caps the rate at which each connection
+	// relays data, in each direction.
+	BytesPerSecond int64
+}
+
+// allows reports whether the rules allow connecting to port on the host
+// named destination, which is an address unless it was requested as a domain.
+func (r *Rules) allows(destination string, port uint16) bool {
+	if len(r.Ports) > 0 && !slices.Contains(r.Ports, port) {
+		return false
+	}
+	if len(r.Destinations) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(destination)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range r.Destinations {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Usage records the traffic of a connection, once it is closed.
+type Usage struct {
+	// Identity is the name of the client's Identity, or empty if the
+	// Server does not authenticate clients.
+	Identity string
+
+	// Destination is the host and port the client connected to.
+	Destination string
+
+	// Sent is the number of bytes relayed from the client to the
+	// destination, and Received the number relayed back.
+	Sent, Received int64
+
+	// Duration is how long the connection was relayed for.
+	Duration time.Duration
+}
+
+var errBadCredentials = errors.New("invalid username or password")
+
+// staticCredentials is the Authenticator of a Server with a single Username
+// and Password.
+type staticCredentials struct {
+	username, password string
+}
+
+func (c staticCredentials) Authenticate(username, password string) (*Identity, error) {
+	if username != c.username || password != c.password {
+		return nil, errBadCredentials
+	}
+	return &Identity{Name: username}, nil
+}
+
+// connLimiter counts the open connections of each identity.
+type connLimiter struct {
+	sync.Mutex
+	open map[string]int
+}
+
+// acquire takes one of max connections of name, reporting whether one was
+// free. A non-positive max is no limit.
+func (l *connLimiter) acquire(name string, max int) bool {
+	l.Lock()
+	defer l.Unlock()
+	if max > 0 && l.open[name] >= max {
+		return false
+	}
+	if l.open == nil {
+		l.open = make(map[string]int)
+	}
+	l.open[name]++
+	return true
+}
+
+func (l *connLimiter) release(name string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.open[name]--; l.open[name] <= 0 {
+		delete(l.open, name)
+	}
+}
+
+// ClientStats is the traffic relayed for the CONNECT requests of a client.
+type ClientStats struct {
+	// Conns is the number of connections the client has open.
+	Conns int
+
+	// Sent is the number of bytes relayed from the client to its
+	// destinations, and Received the number relayed back, over the
+	// connections open and closed.
+	Sent, Received uint64
+}
+
+// clientMeters aggregates the traffic of the connections of each client,
+// by identity name.
+type clientMeters struct {
+	sync.Mutex
+	clients map[string]*clientMeter
+}
+
+type clientMeter struct {
+	open           map[*netstack.MeteredConn]struct{}
+	sent, received uint64 // over the closed connections
+}
+
+func (m *clientMeters) add(name string, c *netstack.MeteredConn) {
+	m.Lock()
+	defer m.Unlock()
+	if m.clients == nil {
+		m.clients = make(map[string]*clientMeter)
+	}
+	client := m.clients[name]
+	if client == nil {
+		client = &clientMeter{open: make(map[*netstack.MeteredConn]struct{})}
+		m.clients[name] = client
+	}
+	client.open[c] = struct{}{}
+}
+
+// remove adds the traffic of c, once closed, to the totals of name.
+func (m *clientMeters) remove(name string, c *netstack.MeteredConn) {
+	m.Lock()
+	defer m.Unlock()
+	client := m.clients[name]
+	delete(client.open, c)
+	rx, tx := c.Stats()
+	client.sent += rx
+	client.received += tx
+}
+
+func (m *clientMeters) stats() map[string]ClientStats {
+	m.Lock()
+	defer m.Unlock()
+	stats := make(map[string]ClientStats, len(m.clients))
+	for name, client := range m.clients {
+		s := ClientStats{Conns: len(client.open), Sent: client.sent, Received: client.received}
+		for c := range client.open {
+			rx, tx := c.Stats()
+			s.Sent += rx
+			s.Received += tx
+		}
+		stats[name] = s
+	}
+	return stats
+}
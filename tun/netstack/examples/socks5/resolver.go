@@ -1,8 +1,11 @@
 package socks5
 
 import (
+	"fmt"
 	"net"
+	"net/netip"
 
+	"github.com/darkit/wireguard/tun/netstack"
 	"golang.org/x/net/context"
 )
 
@@ -11,15 +14,34 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
 }
 
-// DNSResolver uses the system DNS to resolve host names
+// DNSResolver uses the embedded net.Resolver, which defaults to the system
+// DNS, to resolve host names
 type DNSResolver struct {
 	net.Resolver
 }
 
-func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	addr, err := net.ResolveIPAddr("ip", name)
+func (d *DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	addrs, err := d.LookupIPAddr(ctx, name)
 	if err != nil {
 		return ctx, nil, err
 	}
-	return ctx, addr.IP, err
+	return ctx, addrs[0].IP, nil
+}
+
+// NetResolver resolves host names through the tunnel, with the hosts table
+// and DNS servers of a netstack Net
+type NetResolver struct {
+	Net *netstack.Net
+}
+
+func (r NetResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	addrs, err := r.Net.LookupContextHost(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	addr, err := netip.ParseAddr(addrs[0])
+	if err != nil {
+		return ctx, nil, fmt.Errorf("invalid address %q for %s: %w", addrs[0], name, err)
+	}
+	return ctx, addr.AsSlice(), nil
 }
@@ -7,8 +7,11 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"strconv"
 	"time"
+
+	"github.com/darkit/wireguard/tun/netstack"
 )
 
 // Authentication METHODs described in RFC 1928, section 3.
@@ -65,19 +68,70 @@ const (
 	addrTypeNotSupported replyCode = 8
 )
 
+// DomainPolicy decides how a Server handles requests that name their
+// destination by domain name rather than by address.
+type DomainPolicy int
+
+const (
+	// ResolveRemote passes the domain name to the Dialer unresolved, so
+	// that it is resolved wherever the Dialer connects, such as through
+	// a tunnel. The destinations of UDP datagrams, which are not dialed,
+	// are resolved with the Server's Resolver nonetheless.
+	ResolveRemote DomainPolicy = iota
+
+	// ResolveLocal resolves the domain name with the Server's Resolver
+	// and passes the resulting address to the Dialer.
+	ResolveLocal
+
+	// FailOnDomain refuses requests naming a domain.
+	FailOnDomain
+)
+
 // Server is a SOCKS5 proxy server.
 type Server struct {
 	// Resolver can be provided to do custom name resolution.
-	// Defaults to DNSResolver if not provided.
+	// Defaults to DNSResolver if not provided. It is only used
+	// with the ResolveLocal DomainPolicy.
 	Resolver NameResolver
 
+	// DomainPolicy decides how requests naming a domain are handled.
+	// Defaults to ResolveRemote.
+	DomainPolicy DomainPolicy
+
 	// Dialer optionally specifies the dialer to use for outgoing connections.
 	// If nil, the net package's standard dialer is used.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
 
+	// ListenPacket optionally specifies how to listen for the datagrams
+	// relayed for UDP ASSOCIATE requests, such as on a netstack Net. It is
+	// called once per association. If nil, net.ListenPacket is used.
+	ListenPacket func(ctx context.Context, network, addr string) (net.PacketConn, error)
+
 	// Username and Password, if set, are the credential clients must provide.
+	// They are ignored if Authenticator is set.
 	Username string
 	Password string
+
+	// Authenticator, if set, checks the credentials clients must provide,
+	// and decides the rules their connections are subject to.
+	Authenticator Authenticator
+
+	// Accounting, if set, is called with the usage of each connection
+	// relayed, when it is closed.
+	Accounting func(Usage)
+
+	conns   connLimiter
+	clients clientMeters
+}
+
+func (s *Server) authenticator() Authenticator {
+	if s.Authenticator != nil {
+		return s.Authenticator
+	}
+	if s.Username != "" || s.Password != "" {
+		return staticCredentials{s.Username, s.Password}
+	}
+	return nil
 }
 
 func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -89,6 +143,30 @@ func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, erro
 	return dial(ctx, network, addr)
 }
 
+func (s *Server) listenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	if s.ListenPacket != nil {
+		return s.ListenPacket(ctx, network, addr)
+	}
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, network, addr)
+}
+
+// ClientStats returns the traffic relayed for each client, by the name of
+// its Identity, or under the empty name if the Server does not
+// authenticate clients.
+func (s *Server) ClientStats() map[string]ClientStats {
+	return s.clients.stats()
+}
+
+func (s *Server) resolve(ctx context.Context, name string) (net.IP, error) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = &DNSResolver{}
+	}
+	_, ip, err := resolver.Resolve(ctx, name)
+	return ip, err
+}
+
 func (s *Server) logf(format string, args ...any) {
 	log.Printf(format, args...)
 }
@@ -121,11 +199,13 @@ type Conn struct {
 	srv        *Server
 	clientConn net.Conn
 	request    *request
+	identity   *Identity // nil if the Server does not authenticate clients
 }
 
 // Run starts the new connection.
 func (c *Conn) Run() error {
-	needAuth := c.srv.Username != "" || c.srv.Password != ""
+	auth := c.srv.authenticator()
+	needAuth := auth != nil
 	authMethod := noAuthRequired
 	if needAuth {
 		authMethod = passwordAuth
@@ -142,7 +222,10 @@ func (c *Conn) Run() error {
 	}
 
 	user, pwd, err := parseClientAuth(c.clientConn)
-	if err != nil || user != c.srv.Username || pwd != c.srv.Password {
+	if err == nil {
+		c.identity, err = auth.Authenticate(user, pwd)
+	}
+	if err != nil {
 		c.clientConn.Write([]byte{1, 1}) // auth error
 		return err
 	}
@@ -159,6 +242,10 @@ func (c *Conn) handleRequest() error {
 		c.clientConn.Write(buf)
 		return err
 	}
+	if req.command == udpAssociate {
+		c.request = req
+		return c.handleUDPAssociate()
+	}
 	if req.command != connect {
 		res := &response{reply: commandNotSupported}
 		buf, _ := res.marshal()
@@ -169,11 +256,40 @@ func (c *Conn) handleRequest() error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	srv, err := c.srv.dial(
-		ctx,
-		"tcp",
-		net.JoinHostPort(c.request.destination, strconv.Itoa(int(c.request.port))),
-	)
+	destination := c.request.destination
+	if c.request.destAddrType == domainName {
+		switch c.srv.DomainPolicy {
+		case FailOnDomain:
+			res := &response{reply: addrTypeNotSupported}
+			buf, _ := res.marshal()
+			c.clientConn.Write(buf)
+			return fmt.Errorf("refused request for domain %q", destination)
+		case ResolveLocal:
+			ip, err := c.srv.resolve(ctx, destination)
+			if err != nil {
+				res := &response{reply: hostUnreachable}
+				buf, _ := res.marshal()
+				c.clientConn.Write(buf)
+				return err
+			}
+			destination = ip.String()
+		}
+	}
+	var rules Rules
+	if c.identity != nil {
+		rules = c.identity.Rules
+		if !rules.allows(destination, c.request.port) {
+			c.writeReply(connectionNotAllowed)
+			return fmt.Errorf("%s: connection to %s port %d not allowed", c.identity.Name, destination, c.request.port)
+		}
+		if !c.srv.conns.acquire(c.identity.Name, rules.MaxConns) {
+			c.writeReply(connectionNotAllowed)
+			return fmt.Errorf("%s: too many connections", c.identity.Name)
+		}
+		defer c.srv.conns.release(c.identity.Name)
+	}
+	hostPort := net.JoinHostPort(destination, strconv.Itoa(int(c.request.port)))
+	srv, err := c.srv.dial(ctx, "tcp", hostPort)
 	if err != nil {
 		res := &response{reply: generalFailure}
 		buf, _ := res.marshal()
@@ -210,22 +326,54 @@ func (c *Conn) handleRequest() error {
 	}
 	c.clientConn.Write(buf)
 
+	var name string
+	if c.identity != nil {
+		name = c.identity.Name
+	}
+	start := time.Now()
+	client := netstack.NewMeteredConn(c.clientConn)
+	client.SetRateLimit(rules.BytesPerSecond)
+	c.srv.clients.add(name, client)
 	errc := make(chan error, 2)
 	go func() {
-		_, err := io.Copy(c.clientConn, srv)
+		_, err := io.Copy(client, srv)
 		if err != nil {
 			err = fmt.Errorf("from backend to client: %w", err)
 		}
 		errc <- err
 	}()
 	go func() {
-		_, err := io.Copy(srv, c.clientConn)
+		_, err := io.Copy(srv, client)
 		if err != nil {
 			err = fmt.Errorf("from client to backend: %w", err)
 		}
 		errc <- err
 	}()
-	return <-errc
+	err = <-errc
+
+	// Stop the other direction too, so that its count is final.
+	srv.Close()
+	client.Close()
+	<-errc
+	c.srv.clients.remove(name, client)
+	if c.srv.Accounting != nil {
+		sent, received := client.Stats()
+		c.srv.Accounting(Usage{
+			Identity:    name,
+			Destination: hostPort,
+			Sent:        int64(sent),
+			Received:    int64(received),
+			Duration:    time.Since(start),
+		})
+	}
+	return err
+}
+
+// writeReply sends the client a response refusing its request with code.
+func (c *Conn) writeReply(code replyCode) {
+	res := &response{reply: code}
+	buf, _ := res.marshal()
+	c.clientConn.Write(buf)
 }
 
 // parseClientGreeting parses a request initiation packet.
@@ -297,52 +445,72 @@ func parseClientRequest(r io.Reader) (*request, error) {
 	cmd := hdr[1]
 	destAddrType := addrType(hdr[3])
 
-	var destination string
-	var port uint16
+	destination, port, err := readAddr(r, destAddrType)
+	if err != nil {
+		return nil, err
+	}
 
-	if destAddrType == ipv4 {
+	return &request{
+		command:      commandType(cmd),
+		destination:  destination,
+		port:         port,
+		destAddrType: destAddrType,
+	}, nil
+}
+
+// readAddr reads an address of type t, followed by a port, in the form of
+// requests and replies.
+func readAddr(r io.Reader, t addrType) (host string, port uint16, err error) {
+	switch t {
+	case ipv4:
 		var ip [4]byte
-		_, err = io.ReadFull(r, ip[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read IPv4 address")
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", 0, fmt.Errorf("could not read IPv4 address")
 		}
-		destination = net.IP(ip[:]).String()
-	} else if destAddrType == domainName {
+		host = net.IP(ip[:]).String()
+	case domainName:
 		var dstSizeByte [1]byte
-		_, err = io.ReadFull(r, dstSizeByte[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read domain name size")
+		if _, err := io.ReadFull(r, dstSizeByte[:]); err != nil {
+			return "", 0, fmt.Errorf("could not read domain name size")
 		}
-		dstSize := int(dstSizeByte[0])
-		domainName := make([]byte, dstSize)
-		_, err = io.ReadFull(r, domainName)
-		if err != nil {
-			return nil, fmt.Errorf("could not read domain name")
+		domainName := make([]byte, int(dstSizeByte[0]))
+		if _, err := io.ReadFull(r, domainName); err != nil {
+			return "", 0, fmt.Errorf("could not read domain name")
 		}
-		destination = string(domainName)
-	} else if destAddrType == ipv6 {
+		host = string(domainName)
+	case ipv6:
 		var ip [16]byte
-		_, err = io.ReadFull(r, ip[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read IPv6 address")
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", 0, fmt.Errorf("could not read IPv6 address")
 		}
-		destination = net.IP(ip[:]).String()
-	} else {
-		return nil, fmt.Errorf("unsupported address type")
+		host = net.IP(ip[:]).String()
+	default:
+		return "", 0, fmt.Errorf("unsupported address type")
 	}
 	var portBytes [2]byte
-	_, err = io.ReadFull(r, portBytes[:])
-	if err != nil {
-		return nil, fmt.Errorf("could not read port")
+	if _, err := io.ReadFull(r, portBytes[:]); err != nil {
+		return "", 0, fmt.Errorf("could not read port")
 	}
-	port = binary.BigEndian.Uint16(portBytes[:])
+	return host, binary.BigEndian.Uint16(portBytes[:]), nil
+}
 
-	return &request{
-		command:      commandType(cmd),
-		destination:  destination,
-		port:         port,
-		destAddrType: destAddrType,
-	}, nil
+// appendAddr appends the type of host, an address or a domain name, the host
+// and port, in the form of requests and replies.
+func appendAddr(b []byte, host string, port uint16) ([]byte, error) {
+	if ip, err := netip.ParseAddr(host); err != nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name %q too long", host)
+		}
+		b = append(b, byte(domainName), byte(len(host)))
+		b = append(b, host...)
+	} else if ip = ip.Unmap(); ip.Is4() {
+		b = append(b, byte(ipv4))
+		b = append(b, ip.AsSlice()...)
+	} else {
+		b = append(b, byte(ipv6))
+		b = append(b, ip.AsSlice()...)
+	}
+	return binary.BigEndian.AppendUint16(b, port), nil
 }
 
 // response contains the contents of
@@ -1,11 +1,18 @@
 package socks5
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
@@ -149,3 +156,284 @@ func TestReadPassword(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// countingResolver resolves every name to the loopback address and counts
+// the names it was asked for.
+type countingResolver struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, name)
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+func TestDomainPolicy(t *testing.T) {
+	tests := []struct {
+		policy       DomainPolicy
+		wantResolved []string
+		wantDialed   string // host passed to the Dialer, empty if it must not be called
+	}{
+		{ResolveRemote, nil, "backend.test"},
+		{ResolveLocal, []string{"backend.test"}, "127.0.0.1"},
+		{FailOnDomain, nil, ""},
+	}
+	for _, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		backendPort := ln.Addr().(*net.TCPAddr).Port
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				conn.Write([]byte("Test"))
+				conn.Close()
+			}
+		}()
+
+		socks5ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolver := new(countingResolver)
+		dialed := make(chan string, 1)
+		s := Server{
+			Resolver:     resolver,
+			DomainPolicy: tt.policy,
+			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				dialed <- host
+				var d net.Dialer
+				return d.DialContext(ctx, network, ln.Addr().String())
+			},
+		}
+		go s.Serve(socks5ln)
+
+		socksDialer, err := proxy.SOCKS5("tcp", socks5ln.Addr().String(), nil, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := socksDialer.Dial("tcp", net.JoinHostPort("backend.test", strconv.Itoa(backendPort)))
+		if tt.wantDialed == "" {
+			if err == nil {
+				conn.Close()
+				t.Errorf("policy %d: dial succeeded, want refusal", tt.policy)
+			}
+		} else if err != nil {
+			t.Errorf("policy %d: %v", tt.policy, err)
+		} else {
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "Test" {
+				t.Errorf("policy %d: read %q, %v; want Test", tt.policy, buf, err)
+			}
+			conn.Close()
+		}
+		socks5ln.Close()
+		ln.Close()
+
+		resolver.mu.Lock()
+		resolved := resolver.names
+		resolver.mu.Unlock()
+		if fmt.Sprint(resolved) != fmt.Sprint(tt.wantResolved) {
+			t.Errorf("policy %d: resolved %q, want %q", tt.policy, resolved, tt.wantResolved)
+		}
+		select {
+		case host := <-dialed:
+			if host != tt.wantDialed {
+				t.Errorf("policy %d: dialed %q, want %q", tt.policy, host, tt.wantDialed)
+			}
+		default:
+			if tt.wantDialed != "" {
+				t.Errorf("policy %d: not dialed, want %q", tt.policy, tt.wantDialed)
+			}
+		}
+	}
+}
+
+// rawConnect authenticates to the SOCKS5 server at addr as user, requests a
+// connection to dst, and returns the connection and the reply code.
+func rawConnect(t *testing.T, addr, user, password string, dst netip.AddrPort) (net.Conn, replyCode) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	msg := []byte{socks5Version, 1, passwordAuth, passwordAuthVersion, byte(len(user))}
+	msg = append(msg, user...)
+	msg = append(msg, byte(len(password)))
+	msg = append(msg, password...)
+	msg = append(msg, socks5Version, byte(connect), 0, byte(ipv4))
+	msg = append(msg, dst.Addr().AsSlice()...)
+	msg = binary.BigEndian.AppendUint16(msg, dst.Port())
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	var reply [2 + 2 + 4]byte // method, auth status and response header
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != passwordAuth || reply[3] != 0 {
+		t.Fatalf("authentication as %q failed: %x", user, reply[:4])
+	}
+	if code := replyCode(reply[5]); code != success {
+		return c, code
+	}
+	var bind [4 + 2]byte // IPv4 bind address and port
+	if _, err := io.ReadFull(c, bind[:]); err != nil {
+		t.Fatal(err)
+	}
+	return c, success
+}
+
+type identities map[string]*Identity
+
+func (ids identities) Authenticate(username, password string) (*Identity, error) {
+	if id := ids[username]; id != nil && password == "secret" {
+		return id, nil
+	}
+	return nil, errBadCredentials
+}
+
+func TestRules(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	backendAddr := backend.Addr().(*net.TCPAddr).AddrPort()
+
+	socks5ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks5ln.Close()
+	s := Server{Authenticator: identities{
+		"any":       {Name: "any"},
+		"elsewhere": {Name: "elsewhere", Rules: Rules{Destinations: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}},
+		"otherport": {Name: "otherport", Rules: Rules{Ports: []uint16{backendAddr.Port() + 1}}},
+		"single":    {Name: "single", Rules: Rules{MaxConns: 1}},
+	}}
+	go s.Serve(socks5ln)
+	addr := socks5ln.Addr().String()
+
+	tests := []struct {
+		user string
+		want replyCode
+	}{
+		{"any", success},
+		{"elsewhere", connectionNotAllowed},
+		{"otherport", connectionNotAllowed},
+		{"single", success},
+		{"single", connectionNotAllowed},
+	}
+	for _, tt := range tests {
+		if _, code := rawConnect(t, addr, tt.user, "secret", backendAddr); code != tt.want {
+			t.Errorf("%s: reply %d, want %d", tt.user, code, tt.want)
+		}
+	}
+}
+
+func TestAccounting(t *testing.T) {
+	const sent, received = 3000, 70000
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		io.CopyN(io.Discard, c, sent)
+		c.Write(make([]byte, received))
+		c.Close()
+	}()
+
+	socks5ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks5ln.Close()
+	usages := make(chan Usage, 1)
+	s := Server{
+		Authenticator: identities{"alice": {Name: "alice"}},
+		Accounting:    func(u Usage) { usages <- u },
+	}
+	go s.Serve(socks5ln)
+
+	dst := backend.Addr().(*net.TCPAddr).AddrPort()
+	c, code := rawConnect(t, socks5ln.Addr().String(), "alice", "secret", dst)
+	if code != success {
+		t.Fatalf("reply %d, want success", code)
+	}
+	if _, err := c.Write(make([]byte, sent)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.Copy(io.Discard, c); err != nil || n != received {
+		t.Fatalf("received %d bytes, %v; want %d", n, err, received)
+	}
+
+	u := <-usages
+	if u.Identity != "alice" || u.Destination != dst.String() || u.Sent != sent || u.Received != received || u.Duration <= 0 {
+		t.Fatalf("usage %+v, want alice to %v with %d bytes sent and %d received", u, dst, sent, received)
+	}
+	want := map[string]ClientStats{"alice": {Sent: sent, Received: received}}
+	if got := s.ClientStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("client stats %+v, want %+v", got, want)
+	}
+}
+
+func TestBytesPerSecond(t *testing.T) {
+	const rate, size = 200000, 100000
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		if c, err := backend.Accept(); err == nil {
+			c.Write(make([]byte, size))
+			c.Close()
+		}
+	}()
+
+	socks5ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks5ln.Close()
+	s := Server{Authenticator: identities{"slow": {Name: "slow", Rules: Rules{BytesPerSecond: rate}}}}
+	go s.Serve(socks5ln)
+
+	c, code := rawConnect(t, socks5ln.Addr().String(), "slow", "secret", backend.Addr().(*net.TCPAddr).AddrPort())
+	if code != success {
+		t.Fatalf("reply %d, want success", code)
+	}
+	start := time.Now()
+	if n, err := io.Copy(io.Discard, c); err != nil || n != size {
+		t.Fatalf("received %d bytes, %v; want %d", n, err, size)
+	}
+	if elapsed, min := time.Since(start), time.Duration(size)*time.Second/rate/2; elapsed < min {
+		t.Fatalf("received %d bytes in %v at %d bytes per second, want at least %v", size, elapsed, rate, min)
+	}
+}
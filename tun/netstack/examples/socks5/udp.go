@@ -0,0 +1,468 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxUDPDatagram is the largest datagram relayed, with its header.
+const maxUDPDatagram = 65535
+
+// Timeouts and backoff of the association of a UDP client.
+const (
+	udpClientHandshakeTimeout = 10 * time.Second
+	udpClientMinBackoff       = 100 * time.Millisecond
+	udpClientMaxBackoff       = 5 * time.Second
+)
+
+var errFragmented = errors.New("fragmented datagram")
+
+// appendUDPHeader appends the header of a datagram from or to host and port,
+// as described in RFC 1928, section 7.
+func appendUDPHeader(b []byte, host string, port uint16) ([]byte, error) {
+	b = append(b, 0, 0, 0) // reserved, and fragment number 0 for a whole datagram
+	return appendAddr(b, host, port)
+}
+
+// parseUDPHeader splits a datagram into the host and port of its header and
+// its payload. Fragments are refused with errFragmented, as neither end
+// reassembles them.
+func parseUDPHeader(datagram []byte) (host string, port uint16, payload []byte, err error) {
+	if len(datagram) < 4 {
+		return "", 0, nil, fmt.Errorf("could not read datagram header")
+	}
+	if datagram[2] != 0 {
+		return "", 0, nil, errFragmented
+	}
+	r := bytes.NewReader(datagram[4:])
+	host, port, err = readAddr(r, addrType(datagram[3]))
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return host, port, datagram[len(datagram)-r.Len():], nil
+}
+
+// handleUDPAssociate relays datagrams between the client and their
+// destinations for as long as the client keeps the TCP connection of its
+// request open, as described in RFC 1928, section 7. Datagrams are only
+// accepted from the client's address, and replies go to the port the latest
+// came from. Fragmented datagrams are dropped, as are those to destinations
+// the client's rules do not allow. Domain names are resolved with the
+// Server's Resolver, unless the DomainPolicy is FailOnDomain.
+func (c *Conn) handleUDPAssociate() error {
+	var rules Rules
+	if c.identity != nil {
+		rules = c.identity.Rules
+		if !c.srv.conns.acquire(c.identity.Name, rules.MaxConns) {
+			c.writeReply(connectionNotAllowed)
+			return fmt.Errorf("%s: too many connections", c.identity.Name)
+		}
+		defer c.srv.conns.release(c.identity.Name)
+	}
+	clientAddr, err := netip.ParseAddrPort(c.clientConn.RemoteAddr().String())
+	if err != nil {
+		c.writeReply(generalFailure)
+		return err
+	}
+	localAddr, err := netip.ParseAddrPort(c.clientConn.LocalAddr().String())
+	if err != nil {
+		c.writeReply(generalFailure)
+		return err
+	}
+
+	relay, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(localAddr.Addr(), 0)))
+	if err != nil {
+		c.writeReply(generalFailure)
+		return err
+	}
+	defer relay.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	remote, err := c.srv.listenPacket(ctx, "udp", ":0")
+	if err != nil {
+		c.writeReply(generalFailure)
+		return err
+	}
+	defer remote.Close()
+
+	bind := relay.LocalAddr().(*net.UDPAddr).AddrPort()
+	bindAddrType := ipv4
+	if bind.Addr().Unmap().Is6() {
+		bindAddrType = ipv6
+	}
+	res := &response{
+		reply:        success,
+		bindAddrType: bindAddrType,
+		bindAddr:     bind.Addr().Unmap().String(),
+		bindPort:     bind.Port(),
+	}
+	buf, err := res.marshal()
+	if err != nil {
+		c.writeReply(generalFailure)
+		return err
+	}
+	c.clientConn.Write(buf)
+
+	var mu sync.Mutex
+	var client netip.AddrPort // where the latest datagram of the client came from
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, maxUDPDatagram)
+		for {
+			n, from, err := relay.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if from.Addr().Unmap() != clientAddr.Addr().Unmap() {
+				continue
+			}
+			host, port, payload, err := parseUDPHeader(buf[:n])
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			client = from
+			mu.Unlock()
+			dst, err := c.resolveDatagram(ctx, host, port)
+			if err != nil || !rules.allows(dst.Addr().String(), port) {
+				continue
+			}
+			remote.WriteTo(payload, net.UDPAddrFromAddrPort(dst))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, maxUDPDatagram)
+		for {
+			n, from, err := remote.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			src, err := netip.ParseAddrPort(from.String())
+			if err != nil {
+				continue
+			}
+			datagram, _ := appendUDPHeader(make([]byte, 0, n+22), src.Addr().Unmap().String(), src.Port())
+			datagram = append(datagram, buf[:n]...)
+			mu.Lock()
+			to := client
+			mu.Unlock()
+			if to.IsValid() {
+				relay.WriteToUDPAddrPort(datagram, to)
+			}
+		}
+	}()
+
+	// The association ends with the TCP connection of its request.
+	_, err = io.Copy(io.Discard, c.clientConn)
+	relay.Close()
+	remote.Close()
+	wg.Wait()
+	return err
+}
+
+// resolveDatagram returns the address of the destination of a datagram.
+func (c *Conn) resolveDatagram(ctx context.Context, host string, port uint16) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), port), nil
+	}
+	if c.srv.DomainPolicy == FailOnDomain {
+		return netip.AddrPort{}, fmt.Errorf("refused datagram for domain %q", host)
+	}
+	ip, err := c.srv.resolve(ctx, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %v for %s", ip, host)
+	}
+	return netip.AddrPortFrom(addr.Unmap(), port), nil
+}
+
+// Auth is the credential a client authenticates with, as described in
+// RFC 1929.
+type Auth struct {
+	Username, Password string
+}
+
+// clientHandshake greets the server on c, authenticating with auth if not
+// nil, and sends it a request of cmd for host and port, returning the bound
+// address of its reply.
+func clientHandshake(c net.Conn, auth *Auth, cmd commandType, host string, port uint16) (netip.AddrPort, error) {
+	method := noAuthRequired
+	if auth != nil {
+		method = passwordAuth
+	}
+	if _, err := c.Write([]byte{socks5Version, 1, method}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("could not read method selection: %w", err)
+	}
+	if hdr[0] != socks5Version || hdr[1] != method {
+		return netip.AddrPort{}, fmt.Errorf("server refused authentication method %d", method)
+	}
+	if auth != nil {
+		if len(auth.Username) > 255 || len(auth.Password) > 255 {
+			return netip.AddrPort{}, errors.New("username or password too long")
+		}
+		msg := []byte{passwordAuthVersion, byte(len(auth.Username))}
+		msg = append(msg, auth.Username...)
+		msg = append(msg, byte(len(auth.Password)))
+		msg = append(msg, auth.Password...)
+		if _, err := c.Write(msg); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.ReadFull(c, hdr[:]); err != nil {
+			return netip.AddrPort{}, fmt.Errorf("could not read authentication status: %w", err)
+		}
+		if hdr[1] != 0 {
+			return netip.AddrPort{}, errBadCredentials
+		}
+	}
+
+	msg, err := appendAddr([]byte{socks5Version, byte(cmd), 0}, host, port)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if _, err := c.Write(msg); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var reply [4]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("could not read reply: %w", err)
+	}
+	if code := replyCode(reply[1]); code != success {
+		return netip.AddrPort{}, fmt.Errorf("server refused request with reply %d", code)
+	}
+	bindHost, bindPort, err := readAddr(c, addrType(reply[3]))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	bind, err := netip.ParseAddr(bindHost)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("server bound a domain name %q", bindHost)
+	}
+	return netip.AddrPortFrom(bind.Unmap(), bindPort), nil
+}
+
+// udpClient is the PacketConn of NewUDPClient.
+type udpClient struct {
+	proxyAddr string
+	auth      *Auth
+	conn      *net.UDPConn // kept across associations
+	done      chan struct{}
+
+	mu     sync.Mutex
+	ctrl   net.Conn       // the TCP connection of the current association
+	relay  netip.AddrPort // where to send datagrams; invalid while reassociating
+	closed bool
+
+	readMu  sync.Mutex
+	readBuf []byte
+}
+
+// NewUDPClient returns a PacketConn whose datagrams are relayed by the
+// SOCKS5 server at proxyAddr, through a UDP ASSOCIATE request, authenticating
+// with auth if not nil. Its addresses are *net.UDPAddr; WriteTo also takes
+// any net.Addr whose String is a host and port, including domain names for
+// the server to resolve.
+//
+// If the TCP connection the association lives on drops, the client
+// associates again in the background, keeping its local socket. Datagrams
+// written meanwhile are dropped, as the network might drop any datagram.
+// Fragmented datagrams from the server are dropped too.
+func NewUDPClient(proxyAddr string, auth *Auth) (net.PacketConn, error) {
+	ctrl, err := net.DialTimeout("tcp", proxyAddr, udpClientHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	local := net.UDPAddrFromAddrPort(netip.AddrPortFrom(ctrl.LocalAddr().(*net.TCPAddr).AddrPort().Addr(), 0))
+	conn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	c := &udpClient{
+		proxyAddr: proxyAddr,
+		auth:      auth,
+		conn:      conn,
+		done:      make(chan struct{}),
+		readBuf:   make([]byte, maxUDPDatagram),
+	}
+	relay, err := c.associate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		conn.Close()
+		return nil, err
+	}
+	c.ctrl, c.relay = ctrl, relay
+	go c.maintain(ctrl)
+	return c, nil
+}
+
+// associate requests an association on ctrl for the local socket, returning
+// the address of the server's relay.
+func (c *udpClient) associate(ctrl net.Conn) (netip.AddrPort, error) {
+	ctrl.SetDeadline(time.Now().Add(udpClientHandshakeTimeout))
+	defer ctrl.SetDeadline(time.Time{})
+	local := c.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	relay, err := clientHandshake(ctrl, c.auth, udpAssociate, local.Addr().Unmap().String(), local.Port())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if relay.Addr().IsUnspecified() {
+		// The relay is on the address of the server.
+		relay = netip.AddrPortFrom(ctrl.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap(), relay.Port())
+	}
+	return relay, nil
+}
+
+// reassociate dials the server again and requests a new association.
+func (c *udpClient) reassociate() (net.Conn, netip.AddrPort, error) {
+	ctrl, err := net.DialTimeout("tcp", c.proxyAddr, udpClientHandshakeTimeout)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	relay, err := c.associate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, netip.AddrPort{}, err
+	}
+	return ctrl, relay, nil
+}
+
+// maintain waits for the association on ctrl to end, and replaces it, until
+// the client is closed.
+func (c *udpClient) maintain(ctrl net.Conn) {
+	for {
+		// The server ends the association by closing the connection.
+		io.Copy(io.Discard, ctrl)
+		c.mu.Lock()
+		c.relay = netip.AddrPort{}
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+
+		backoff := udpClientMinBackoff
+		for {
+			var relay netip.AddrPort
+			var err error
+			ctrl, relay, err = c.reassociate()
+			if err == nil {
+				c.mu.Lock()
+				if c.closed {
+					c.mu.Unlock()
+					ctrl.Close()
+					return
+				}
+				c.ctrl, c.relay = ctrl, relay
+				c.mu.Unlock()
+				break
+			}
+			select {
+			case <-c.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, udpClientMaxBackoff)
+		}
+	}
+}
+
+func (c *udpClient) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		n, from, err := c.conn.ReadFromUDPAddrPort(c.readBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.mu.Lock()
+		relay := c.relay
+		c.mu.Unlock()
+		if from.Addr().Unmap() != relay.Addr() || from.Port() != relay.Port() {
+			continue
+		}
+		host, port, payload, err := parseUDPHeader(c.readBuf[:n])
+		if err != nil {
+			continue
+		}
+		src, err := netip.ParseAddr(host)
+		if err != nil {
+			continue
+		}
+		return copy(p, payload), net.UDPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+	}
+}
+
+func (c *udpClient) WriteTo(p []byte, addr net.Addr) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+	datagram, err := appendUDPHeader(make([]byte, 0, len(p)+4+1+len(host)+2), host, uint16(port))
+	if err != nil {
+		return 0, err
+	}
+	datagram = append(datagram, p...)
+
+	c.mu.Lock()
+	relay := c.relay
+	c.mu.Unlock()
+	if !relay.IsValid() {
+		return len(p), nil
+	}
+	if _, err := c.conn.WriteToUDPAddrPort(datagram, relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *udpClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	ctrl := c.ctrl
+	c.mu.Unlock()
+	close(c.done)
+	ctrl.Close()
+	return c.conn.Close()
+}
+
+func (c *udpClient) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *udpClient) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *udpClient) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *udpClient) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
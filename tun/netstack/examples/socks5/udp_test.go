@@ -0,0 +1,181 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn/bindtest"
+	"github.com/darkit/wireguard/device"
+	"github.com/darkit/wireguard/tun/netstack"
+)
+
+// tunnelPair returns the Nets at either end of a tunnel between two devices
+// in memory, at 10.0.0.1 and 10.0.0.2.
+func tunnelPair(t *testing.T) (a, b *netstack.Net) {
+	t.Helper()
+	binds := bindtest.NewChannelBinds()
+	var keys [2]device.NoisePrivateKey
+	var nets [2]*netstack.Net
+	var devs [2]*device.Device
+	for i := range devs {
+		tun, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 1)})}, nil, 1420)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys[i], err = device.NewPrivateKey(); err != nil {
+			t.Fatal(err)
+		}
+		devs[i] = device.NewDevice(tun, binds[i], device.NewLogger(device.LogLevelError, ""))
+		t.Cleanup(devs[i].Close)
+		nets[i] = tnet
+	}
+	for i, dev := range devs {
+		// Each bindtest bind reaches the other as port i+1.
+		peer := keys[i^1].PublicKey()
+		cfg := fmt.Sprintf("private_key=%s\npublic_key=%s\nendpoint=127.0.0.1:%d\nallowed_ip=10.0.0.%d/32\n", keys[i].Hex(), peer.Hex(), i+1, i^1+1)
+		if err := dev.IpcSet(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nets[0], nets[1]
+}
+
+// trackingListener records the connections it accepts, so that tests can
+// drop them.
+type trackingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, c)
+		l.mu.Unlock()
+	}
+	return c, err
+}
+
+func (l *trackingListener) dropAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+}
+
+// exchange sends msg to dst through pc until a reply arrives, and returns it
+// and where it came from.
+func exchange(t *testing.T, pc net.PacketConn, dst netip.AddrPort, msg string) (string, net.Addr) {
+	t.Helper()
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := pc.WriteTo([]byte(msg), net.UDPAddrFromAddrPort(dst)); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, from, err := pc.ReadFrom(buf)
+		if err == nil {
+			return string(buf[:n]), from
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatal(err)
+		}
+	}
+	t.Fatalf("no reply from %v", dst)
+	return "", nil
+}
+
+func TestUDPClient(t *testing.T) {
+	host, remote := tunnelPair(t)
+	echo, err := remote.ListenUDPAddrPort(netip.MustParseAddrPort("10.0.0.2:7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := &trackingListener{Listener: ln}
+	defer tracked.Close()
+	s := Server{
+		Username: "alice",
+		Password: "secret",
+		ListenPacket: func(ctx context.Context, network, addr string) (net.PacketConn, error) {
+			return host.ListenUDPAddrPort(netip.MustParseAddrPort("10.0.0.1:0"))
+		},
+	}
+	go s.Serve(tracked)
+
+	if _, err := NewUDPClient(ln.Addr().String(), &Auth{Username: "alice", Password: "wrong"}); err == nil {
+		t.Error("NewUDPClient succeeded with a wrong password")
+	}
+	pc, err := NewUDPClient(ln.Addr().String(), &Auth{Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	dst := netip.MustParseAddrPort("10.0.0.2:7")
+	if reply, from := exchange(t, pc, dst, "first"); reply != "first" || from.String() != dst.String() {
+		t.Fatalf("reply %q from %v, want first from %v", reply, from, dst)
+	}
+
+	// When the association drops, the client associates again, keeping its
+	// local address.
+	local := pc.LocalAddr().String()
+	tracked.dropAll()
+	if reply, _ := exchange(t, pc, dst, "second"); reply != "second" {
+		t.Fatalf("reply %q after reassociating, want second", reply)
+	}
+	if pc.LocalAddr().String() != local {
+		t.Errorf("local address changed from %s to %v", local, pc.LocalAddr())
+	}
+}
+
+func TestUDPHeader(t *testing.T) {
+	datagram, err := appendUDPHeader(nil, "10.0.0.2", 53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagram = append(datagram, "query"...)
+	if host, port, payload, err := parseUDPHeader(datagram); err != nil || host != "10.0.0.2" || port != 53 || string(payload) != "query" {
+		t.Errorf("parseUDPHeader = %q, %d, %q, %v; want 10.0.0.2, 53, query", host, port, payload, err)
+	}
+	datagram, _ = appendUDPHeader(nil, "example.com", 53)
+	if host, _, _, err := parseUDPHeader(datagram); err != nil || host != "example.com" {
+		t.Errorf("parseUDPHeader = %q, %v; want example.com", host, err)
+	}
+	datagram[2] = 1
+	if _, _, _, err := parseUDPHeader(datagram); !errors.Is(err, errFragmented) {
+		t.Errorf("parseUDPHeader of a fragment = %v, want errFragmented", err)
+	}
+	if _, _, _, err := parseUDPHeader(datagram[:3]); err == nil {
+		t.Error("parseUDPHeader of a truncated header succeeded")
+	}
+}
@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// buildUDPv4 returns an unfragmented IPv4/UDP packet carrying payload.
+func buildUDPv4(src, dst netip.AddrPort, id uint16, payload []byte) []byte {
+	pkt := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		ID:          id,
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(src.Addr().As4()),
+		DstAddr:     tcpip.AddrFrom4(dst.Addr().As4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	udp := header.UDP(pkt[header.IPv4MinimumSize:])
+	udp.Encode(&header.UDPFields{
+		SrcPort: src.Port(),
+		DstPort: dst.Port(),
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(udp.Payload(), payload)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), udp.Length())
+	xsum = checksum.Checksum(payload, xsum)
+	udp.SetChecksum(^udp.CalculateChecksum(xsum))
+	return pkt
+}
+
+// fragmentIPv4 splits an IPv4 packet into fragments carrying at most size payload bytes.
+func fragmentIPv4(pkt []byte, size int) [][]byte {
+	ip := header.IPv4(pkt)
+	hdr := pkt[:ip.HeaderLength()]
+	payload := ip.Payload()
+	var frags [][]byte
+	for off := 0; off < len(payload); off += size {
+		end := min(off+size, len(payload))
+		frag := append(append([]byte(nil), hdr...), payload[off:end]...)
+		fip := header.IPv4(frag)
+		var flags uint8
+		if end < len(payload) {
+			flags = header.IPv4FlagMoreFragments
+		}
+		fip.SetFlagsFragmentOffset(flags, uint16(off))
+		fip.SetTotalLength(uint16(len(frag)))
+		fip.SetChecksum(0)
+		fip.SetChecksum(^fip.CalculateChecksum())
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	listener, err := tnet.ListenUDPAddrPort(netip.AddrPortFrom(local, 5060))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	pkt := buildUDPv4(netip.MustParseAddrPort("10.0.0.1:5060"), netip.AddrPortFrom(local, 5060), 0x1234, payload)
+	frags := fragmentIPv4(pkt, 1200)
+	if len(frags) != 3 {
+		t.Fatalf("expected 3 fragments, got %d", len(frags))
+	}
+	// Deliver out of order to exercise the offset bookkeeping.
+	frags[0], frags[2] = frags[2], frags[0]
+	if _, err := dev.Write(frags, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], payload) {
+		t.Fatalf("reassembled payload mismatch: got %d bytes, want %d", n, len(payload))
+	}
+
+	stats := tnet.Stats()
+	if stats.FragmentsReceived != 3 || stats.FragmentsDropped != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestFragmentDropped(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	// A fragment reaching past the largest datagram is dropped by the stack.
+	pkt := buildUDPv4(netip.MustParseAddrPort("10.0.0.1:5060"), netip.AddrPortFrom(local, 5060), 0x4321, make([]byte, 2000))
+	frag := fragmentIPv4(pkt, 1200)[1]
+	ip := header.IPv4(frag)
+	ip.SetFlagsFragmentOffset(0, 64992)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	if _, err := dev.Write([][]byte{frag}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if stats := tnet.Stats(); stats.FragmentsReceived != 1 || stats.FragmentsDropped != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
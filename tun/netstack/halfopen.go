@@ -0,0 +1,194 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// DefaultTCPListenBacklog is the backlog of TCP listeners unless
+// TCPListenOptions.Backlog sets another.
+const DefaultTCPListenBacklog = 4096
+
+const (
+	// halfOpenTimeout is how long a handshake counts as in progress after
+	// the peer's SYN or the stack's latest SYN-ACK, for those whose end
+	// went unseen.
+	halfOpenTimeout = time.Minute
+
+	// halfOpenSweepInterval is how often timed out handshakes are looked
+	// for, when the cap is reached.
+	halfOpenSweepInterval = time.Second
+)
+
+// TCPListenOptions protects the TCP servers of the stack from SYN floods
+// through the tunnel.
+type TCPListenOptions struct {
+	// Backlog is the backlog of TCP listeners created by the Net: how many
+	// connections may wait to be accepted, and how many handshakes each
+	// may have in progress before it answers SYNs with SYN cookies, which
+	// hold no state. Zero selects DefaultTCPListenBacklog.
+	Backlog int
+
+	// SYNCookies makes listeners answer every SYN with a SYN cookie, not
+	// only once their backlog is full. Connections opened so do without
+	// window scaling.
+	SYNCookies bool
+
+	// MaxHalfOpen caps the TCP handshakes peers have in progress with the
+	// stack, across listeners, from their SYN until their ACK or either
+	// side's reset. SYNs beyond it are dropped, and counted by
+	// Stats.SYNOverflows. Zero, or a negative value, leaves handshakes
+	// untracked, sparing the TCP packets crossing the tunnel the lookup;
+	// SYN cookies still protect the listeners.
+	MaxHalfOpen int
+}
+
+// SetTCPListenOptions changes the options set by Options.TCPListen. The
+// backlog applies to listeners created afterwards, the rest at once.
+func (net *Net) SetTCPListenOptions(opts TCPListenOptions) error {
+	if opts.Backlog == 0 {
+		opts.Backlog = DefaultTCPListenBacklog
+	}
+	synCookies := tcpip.TCPAlwaysUseSynCookies(opts.SYNCookies)
+	if tcpipErr := net.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &synCookies); tcpipErr != nil {
+		return errors.New(tcpipErr.String())
+	}
+	net.listenBacklog.Store(int64(opts.Backlog))
+	net.halfOpen.setLimit(opts.MaxHalfOpen)
+	return nil
+}
+
+type halfOpenKey struct {
+	local, remote netip.AddrPort
+}
+
+// halfOpenTracker counts the TCP handshakes peers have in progress with the
+// stack, by watching the packets crossing the tunnel, and drops SYNs beyond
+// its limit. Only SYNs, resets, and ACKs while handshakes are in progress,
+// take its lock.
+type halfOpenTracker struct {
+	limit     atomic.Int64 // zero or negative when lifted
+	overflows atomic.Uint64
+	pending   atomic.Int64 // len(flows)
+
+	mu        sync.Mutex
+	flows     map[halfOpenKey]time.Time // by flow, when last seen starting
+	lastSweep time.Time
+}
+
+func (h *halfOpenTracker) setLimit(limit int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.limit.Store(int64(limit))
+	if limit <= 0 {
+		h.flows = nil
+	} else if h.flows == nil {
+		h.flows = make(map[halfOpenKey]time.Time)
+	}
+	h.pending.Store(int64(len(h.flows)))
+}
+
+// inbound reports whether packet, arriving from the tunnel, may enter the
+// stack, tracking the handshakes it starts and ends.
+func (h *halfOpenTracker) inbound(packet []byte) bool {
+	if h.limit.Load() <= 0 {
+		return true
+	}
+	p, ok := parseSNATPacket(packet)
+	if !ok || p.flow.proto != header.TCPProtocolNumber {
+		return true
+	}
+	key := halfOpenKey{local: p.flow.dst, remote: p.flow.src}
+	flags := header.TCP(p.transport).Flags()
+	ends := flags.Contains(header.TCPFlagRst) || flags.Contains(header.TCPFlagAck)
+	if ends && h.pending.Load() == 0 || !ends && !flags.Contains(header.TCPFlagSyn) {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	limit := h.limit.Load()
+	if limit <= 0 {
+		return true
+	}
+	if ends {
+		h.deleteLocked(key)
+		return true
+	}
+	if _, ok := h.flows[key]; ok {
+		return true
+	}
+	now := time.Now()
+	if int64(len(h.flows)) >= limit {
+		h.sweepLocked(now)
+	}
+	if int64(len(h.flows)) >= limit {
+		h.overflows.Add(1)
+		return false
+	}
+	h.flows[key] = now
+	h.pending.Add(1)
+	return true
+}
+
+// outbound tracks the handshakes packet, leaving the stack for the tunnel,
+// continues or ends.
+func (h *halfOpenTracker) outbound(packet []byte) {
+	if h.limit.Load() <= 0 || h.pending.Load() == 0 {
+		return
+	}
+	p, ok := parseSNATPacket(packet)
+	if !ok || p.flow.proto != header.TCPProtocolNumber {
+		return
+	}
+	key := halfOpenKey{local: p.flow.src, remote: p.flow.dst}
+	flags := header.TCP(p.transport).Flags()
+	if !flags.Contains(header.TCPFlagRst) && !flags.Contains(header.TCPFlagSyn) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.flows[key]; !ok {
+		return
+	}
+	if flags.Contains(header.TCPFlagRst) {
+		h.deleteLocked(key)
+	} else {
+		h.flows[key] = time.Now()
+	}
+}
+
+// deleteLocked forgets the handshake of key, if it is in progress.
+func (h *halfOpenTracker) deleteLocked(key halfOpenKey) {
+	if _, ok := h.flows[key]; ok {
+		delete(h.flows, key)
+		h.pending.Add(-1)
+	}
+}
+
+// sweepLocked removes timed out handshakes, at most once per
+// halfOpenSweepInterval.
+func (h *halfOpenTracker) sweepLocked(now time.Time) {
+	if now.Sub(h.lastSweep) < halfOpenSweepInterval {
+		return
+	}
+	h.lastSweep = now
+	for key, seen := range h.flows {
+		if now.Sub(seen) > halfOpenTimeout {
+			h.deleteLocked(key)
+		}
+	}
+}
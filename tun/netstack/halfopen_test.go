@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// tcpSegment returns an IPv4 TCP segment from src to dst with flags set.
+func tcpSegment(src, dst netip.AddrPort, flags header.TCPFlags) []byte {
+	packet := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize)
+	ip := header.IPv4(packet)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(packet)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(src.Addr().As4()),
+		DstAddr:     tcpip.AddrFrom4(dst.Addr().As4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	tcp := header.TCP(ip.Payload())
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    src.Port(),
+		DstPort:    dst.Port(),
+		SeqNum:     1000,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(tcp)))
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum))
+	return packet
+}
+
+// readSegment reads the next packet the stack sends, expecting a TCP segment
+// to dst, and returns its flags.
+func readSegment(t *testing.T, dev tun.Device, dst netip.AddrPort) header.TCPFlags {
+	t.Helper()
+	type result struct {
+		packet []byte
+		err    error
+	}
+	c := make(chan result, 1)
+	go func() {
+		bufs, sizes := [][]byte{make([]byte, 1500)}, []int{0}
+		_, err := dev.Read(bufs, sizes, 0)
+		c <- result{bufs[0][:sizes[0]], err}
+	}()
+	select {
+	case r := <-c:
+		p, ok := parseSNATPacket(r.packet)
+		if r.err != nil || !ok || p.flow.proto != header.TCPProtocolNumber || p.flow.dst != dst {
+			t.Fatalf("read %x, %v; want a TCP segment to %v", r.packet, r.err, dst)
+		}
+		return header.TCP(p.transport).Flags()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no segment to %v", dst)
+	}
+	return 0
+}
+
+func TestMaxHalfOpen(t *testing.T) {
+	local := netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), 80)
+	dev, tnet, err := CreateNetTUNWithOptions([]netip.Addr{local.Addr()}, nil, 1420, Options{
+		TCPListen: TCPListenOptions{MaxHalfOpen: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	ln, err := tnet.ListenTCPAddrPort(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	remote := func(port uint16) netip.AddrPort {
+		return netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), port)
+	}
+	write := func(packets ...[]byte) {
+		t.Helper()
+		if _, err := dev.Write(packets, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two handshakes are answered, and the SYN of the third dropped.
+	write(tcpSegment(remote(1000), local, header.TCPFlagSyn), tcpSegment(remote(1001), local, header.TCPFlagSyn), tcpSegment(remote(1002), local, header.TCPFlagSyn))
+	for _, port := range []uint16{1000, 1001} {
+		if flags := readSegment(t, dev, remote(port)); flags != header.TCPFlagSyn|header.TCPFlagAck {
+			t.Errorf("answer to SYN from port %d has flags %v, want SYN-ACK", port, flags)
+		}
+	}
+	if stats := tnet.Stats(); stats.SYNOverflows != 1 {
+		t.Errorf("SYNOverflows = %d, want 1", stats.SYNOverflows)
+	}
+
+	// A retransmitted SYN is let through, and a reset frees the slot of its
+	// handshake.
+	write(tcpSegment(remote(1000), local, header.TCPFlagSyn))
+	readSegment(t, dev, remote(1000))
+	write(tcpSegment(remote(1000), local, header.TCPFlagRst), tcpSegment(remote(1003), local, header.TCPFlagSyn))
+	if flags := readSegment(t, dev, remote(1003)); flags != header.TCPFlagSyn|header.TCPFlagAck {
+		t.Errorf("answer to SYN from port 1003 has flags %v, want SYN-ACK", flags)
+	}
+	if stats := tnet.Stats(); stats.SYNOverflows != 1 {
+		t.Errorf("SYNOverflows = %d after a reset, want 1", stats.SYNOverflows)
+	}
+	if pending := tnet.halfOpen.pending.Load(); pending != 2 {
+		t.Errorf("%d handshakes in progress, want 2", pending)
+	}
+
+	// Without the cap and with SYN cookies, every SYN is answered with one.
+	if err := tnet.SetTCPListenOptions(TCPListenOptions{SYNCookies: true, MaxHalfOpen: -1}); err != nil {
+		t.Fatal(err)
+	}
+	write(tcpSegment(remote(1004), local, header.TCPFlagSyn))
+	readSegment(t, dev, remote(1004))
+	if stats := tnet.Stats(); stats.SYNOverflows != 1 || stats.SYNCookiesSent != 1 {
+		t.Errorf("Stats() = %+v, want 1 SYN overflow and 1 SYN cookie", stats)
+	}
+	if pending := tnet.halfOpen.pending.Load(); pending != 0 {
+		t.Errorf("%d handshakes tracked without the cap", pending)
+	}
+}
@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"strings"
+)
+
+type hostsTable map[string][]netip.Addr
+
+// SetHosts replaces the table of static host names consulted by
+// LookupContextHost, and therefore DialContext, before any DNS query, much
+// like /etc/hosts. Names are matched case-insensitively and without regard
+// to a trailing dot. Names not in the table are looked up in DNS, unless
+// Options.HostsOnly was set. A nil or empty map clears the table.
+func (net *Net) SetHosts(hosts map[string][]netip.Addr) {
+	if len(hosts) == 0 {
+		net.hosts.Store(nil)
+		return
+	}
+	table := make(hostsTable, len(hosts))
+	for name, addrs := range hosts {
+		if len(addrs) == 0 {
+			continue
+		}
+		name = canonicalHostName(name)
+		table[name] = append(table[name], addrs...)
+	}
+	net.hosts.Store(&table)
+}
+
+func canonicalHostName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// lookupStaticHost returns the addresses of host from the hosts table,
+// IPv6 first if the stack has an IPv6 address.
+func (net *Net) lookupStaticHost(host string) ([]string, bool) {
+	table := net.hosts.Load()
+	if table == nil {
+		return nil, false
+	}
+	addrs, ok := (*table)[canonicalHostName(host)]
+	if !ok {
+		return nil, false
+	}
+	var v4, v6 []string
+	for _, addr := range addrs {
+		if addr.Is4() || addr.Is4In6() {
+			v4 = append(v4, addr.Unmap().String())
+		} else {
+			v6 = append(v6, addr.String())
+		}
+	}
+	if net.hasV6 {
+		return append(v6, v4...), true
+	}
+	return append(v4, v6...), true
+}
@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestSetHosts(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUNWithOptions([]netip.Addr{local, netip.MustParseAddr("fd00::29")}, nil, 1420, Options{HostsOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	tnet.SetHosts(map[string][]netip.Addr{
+		"Internal-Service": {netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")},
+		"local.test.":      {local},
+	})
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{"internal-service", []string{"fd00::1", "10.0.0.1"}},
+		{"INTERNAL-SERVICE.", []string{"fd00::1", "10.0.0.1"}},
+		{"local.test", []string{"192.168.4.29"}},
+	}
+	for _, tt := range tests {
+		got, err := tnet.LookupContextHost(context.Background(), tt.host)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LookupContextHost(%q) = %v, %v; want %v", tt.host, got, err, tt.want)
+		}
+	}
+
+	var dnsErr *net.DNSError
+	if _, err := tnet.LookupContextHost(context.Background(), "unknown.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("unknown name with HostsOnly: got %v, want not found", err)
+	}
+
+	// The table is replaced as a whole.
+	tnet.SetHosts(map[string][]netip.Addr{"other.test": {local}})
+	if _, err := tnet.LookupContextHost(context.Background(), "local.test"); err == nil {
+		t.Error("name from the replaced table still resolves")
+	}
+
+	listener, err := tnet.ListenTCPAddrPort(netip.AddrPortFrom(local, 8080))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := tnet.DialContext(context.Background(), "tcp", "other.test:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// ICMPOptions configures the ICMP errors the stack sends about the packets
+// it receives through the tunnel, which end traceroutes at the stack, or
+// show it as a hop when it forwards.
+type ICMPOptions struct {
+	// DisableErrors stops the stack from sending destination-unreachable
+	// and time-exceeded messages, such as the port-unreachable ones that
+	// end UDP traceroutes at the stack. Fragmentation-needed and
+	// packet-too-big messages, which path MTU discovery relies on, are
+	// still sent.
+	DisableErrors bool
+
+	// Forward makes the stack a router: packets to addresses that are not
+	// its own are sent back into the tunnel with their TTL, or hop limit,
+	// decremented, and those whose TTL runs out are answered with
+	// time-exceeded messages.
+	Forward bool
+
+	// TunnelSource makes the ICMP errors come from the stack's tunnel
+	// address, the first address of their family it was created with,
+	// rather than from the address the packet was sent to, such as one
+	// added by AddAddress, or the one the route back selects.
+	TunnelSource bool
+}
+
+// icmpErrors applies ICMPOptions to the packets going through the stack.
+type icmpErrors struct {
+	opts             ICMPOptions
+	tunnel4, tunnel6 netip.Addr // the first addresses of each family
+	sent             atomic.Uint64
+}
+
+func (e *icmpErrors) init(s *stack.Stack, opts ICMPOptions, localAddresses []netip.Addr) error {
+	e.opts = opts
+	for _, ip := range localAddresses {
+		if ip.Is4() && !e.tunnel4.IsValid() {
+			e.tunnel4 = ip
+		} else if ip.Is6() && !e.tunnel6.IsValid() {
+			e.tunnel6 = ip
+		}
+	}
+	if !opts.Forward {
+		return nil
+	}
+	for _, protocol := range []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber} {
+		if tcpipErr := s.SetForwardingDefaultAndAllNICs(protocol, true); tcpipErr != nil {
+			return fmt.Errorf("could not enable forwarding: %v", tcpipErr)
+		}
+	}
+	return nil
+}
+
+// inbound prepares the IPv4 packet, arriving through the tunnel, for the
+// stack. The stack forwards a packet with a TTL of one with a TTL of zero,
+// rather than answer it with a time-exceeded message as it does when the TTL
+// is zero already, so inbound makes it zero for packets to addresses local
+// does not report as the stack's own.
+func (e *icmpErrors) inbound(packet header.IPv4, local func(tcpip.Address) bool) {
+	if !e.opts.Forward || len(packet) < header.IPv4MinimumSize || packet.TTL() != 1 {
+		return
+	}
+	dst := packet.DestinationAddress()
+	if header.IsV4MulticastAddress(dst) || dst == header.IPv4Broadcast || local(dst) {
+		return
+	}
+	packet.SetTTL(0)
+	packet.SetChecksum(0)
+	packet.SetChecksum(^packet.CalculateChecksum())
+}
+
+// outbound applies the options to the packet the stack sends, and reports
+// whether to drop it.
+func (e *icmpErrors) outbound(packet []byte) bool {
+	if len(packet) == 0 {
+		return false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		ip := header.IPv4(packet)
+		if len(packet) < header.IPv4MinimumSize || ip.TransportProtocol() != header.ICMPv4ProtocolNumber || len(ip.Payload()) < header.ICMPv4MinimumSize {
+			return false
+		}
+		icmp := header.ICMPv4(ip.Payload())
+		switch {
+		case icmp.Type() == header.ICMPv4DstUnreachable && icmp.Code() == header.ICMPv4FragmentationNeeded:
+			return false
+		case icmp.Type() != header.ICMPv4DstUnreachable && icmp.Type() != header.ICMPv4TimeExceeded:
+			return false
+		case e.opts.DisableErrors:
+			return true
+		}
+		if e.opts.TunnelSource && e.tunnel4.IsValid() {
+			ip.SetSourceAddress(tcpip.AddrFrom4(e.tunnel4.As4()))
+			ip.SetChecksum(0)
+			ip.SetChecksum(^ip.CalculateChecksum())
+		}
+	case 6:
+		ip := header.IPv6(packet)
+		if len(packet) < header.IPv6MinimumSize || ip.TransportProtocol() != header.ICMPv6ProtocolNumber || len(ip.Payload()) < header.ICMPv6MinimumSize {
+			return false
+		}
+		icmp := header.ICMPv6(ip.Payload())
+		switch {
+		case icmp.Type() != header.ICMPv6DstUnreachable && icmp.Type() != header.ICMPv6TimeExceeded:
+			return false
+		case e.opts.DisableErrors:
+			return true
+		}
+		if e.opts.TunnelSource && e.tunnel6.IsValid() {
+			ip.SetSourceAddress(tcpip.AddrFrom16(e.tunnel6.As16()))
+			icmp.SetChecksum(0)
+			xsum := header.PseudoHeaderChecksum(header.ICMPv6ProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(icmp)))
+			icmp.SetChecksum(^checksum.Checksum(icmp, xsum))
+		}
+	default:
+		return false
+	}
+	e.sent.Add(1)
+	return false
+}
@@ -0,0 +1,142 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// traceProbe returns a UDP traceroute probe from src to dst with ttl.
+func traceProbe(src, dst netip.AddrPort, ttl uint8) []byte {
+	packet := buildUDPv4(src, dst, 1, []byte("probe"))
+	ip := header.IPv4(packet)
+	ip.SetTTL(ttl)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	return packet
+}
+
+// readPacket returns the next packet the stack sends, or nil if it sends
+// none within timeout.
+func readPacket(t *testing.T, dev tun.Device, timeout time.Duration) header.IPv4 {
+	t.Helper()
+	c := make(chan []byte, 1)
+	go func() {
+		bufs, sizes := [][]byte{make([]byte, 1500)}, []int{0}
+		if _, err := dev.Read(bufs, sizes, 0); err == nil {
+			c <- bufs[0][:sizes[0]]
+		}
+	}()
+	select {
+	case packet := <-c:
+		return packet
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// checkICMPError checks that packet is an ICMP error of typ and code from
+// src, about probe.
+func checkICMPError(t *testing.T, packet header.IPv4, src netip.Addr, typ header.ICMPv4Type, code header.ICMPv4Code, probe []byte) {
+	t.Helper()
+	if packet == nil {
+		t.Fatalf("no ICMP error %d/%d", typ, code)
+	}
+	if !packet.IsChecksumValid() || packet.TransportProtocol() != header.ICMPv4ProtocolNumber {
+		t.Fatalf("sent %x, want an ICMP error", []byte(packet))
+	}
+	icmp := header.ICMPv4(packet.Payload())
+	if icmp.Type() != typ || icmp.Code() != code {
+		t.Errorf("ICMP message %d/%d, want %d/%d", icmp.Type(), icmp.Code(), typ, code)
+	}
+	if got := packet.SourceAddress(); got != tcpip.AddrFrom4(src.As4()) {
+		t.Errorf("ICMP error from %v, want %v", got, src)
+	}
+	quoted := header.IPv4(icmp.Payload())
+	if len(quoted) < header.IPv4MinimumSize || quoted.ID() != header.IPv4(probe).ID() || quoted.DestinationAddress() != header.IPv4(probe).DestinationAddress() {
+		t.Errorf("ICMP error quotes %x, not the probe", []byte(quoted))
+	}
+}
+
+func TestICMPErrors(t *testing.T) {
+	local := netip.MustParseAddr("10.0.0.1")
+	added := netip.MustParseAddr("10.0.0.5")
+	remote := netip.MustParseAddrPort("10.0.0.2:40000")
+	hop := netip.AddrPortFrom(netip.MustParseAddr("10.0.0.7"), 33434)
+	write := func(dev tun.Device, packet []byte) {
+		t.Helper()
+		if _, err := dev.Write([][]byte{packet}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A traceroute to the stack ends there, with a port-unreachable message
+	// from the address probed, and one to another address, which the stack
+	// does not forward by default, is dropped.
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if err := tnet.AddAddress(added); err != nil {
+		t.Fatal(err)
+	}
+	for _, dst := range []netip.Addr{local, added} {
+		probe := traceProbe(remote, netip.AddrPortFrom(dst, 33434), 1)
+		write(dev, probe)
+		checkICMPError(t, readPacket(t, dev, 5*time.Second), dst, header.ICMPv4DstUnreachable, header.ICMPv4PortUnreachable, probe)
+	}
+	write(dev, traceProbe(remote, hop, 1))
+	if packet := readPacket(t, dev, 100*time.Millisecond); packet != nil {
+		t.Errorf("sent %x about a packet not for the stack", []byte(packet))
+	}
+	if n := tnet.Stats().ICMPErrorsSent; n != 2 {
+		t.Errorf("%d ICMP errors counted, want 2", n)
+	}
+
+	// Forwarding, the stack is a hop, answering from its tunnel address.
+	dev, tnet, err = CreateNetTUNWithOptions([]netip.Addr{local}, nil, 1420, Options{
+		ICMP: ICMPOptions{Forward: true, TunnelSource: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if err := tnet.AddAddress(added); err != nil {
+		t.Fatal(err)
+	}
+	probe := traceProbe(remote, hop, 1)
+	write(dev, probe)
+	checkICMPError(t, readPacket(t, dev, 5*time.Second), local, header.ICMPv4TimeExceeded, header.ICMPv4TTLExceeded, probe)
+	write(dev, traceProbe(remote, hop, 2))
+	if packet := readPacket(t, dev, 5*time.Second); packet == nil || packet.DestinationAddress() != tcpip.AddrFrom4(hop.Addr().As4()) || packet.TTL() != 1 {
+		t.Errorf("forwarded %x, want the probe with a TTL of 1", []byte(packet))
+	}
+	probe = traceProbe(remote, netip.AddrPortFrom(added, 33434), 1)
+	write(dev, probe)
+	checkICMPError(t, readPacket(t, dev, 5*time.Second), local, header.ICMPv4DstUnreachable, header.ICMPv4PortUnreachable, probe)
+
+	// Without errors, traceroutes see nothing.
+	dev, _, err = CreateNetTUNWithOptions([]netip.Addr{local}, nil, 1420, Options{
+		ICMP: ICMPOptions{Forward: true, DisableErrors: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	write(dev, traceProbe(remote, netip.AddrPortFrom(local, 33434), 1))
+	write(dev, traceProbe(remote, hop, 1))
+	if packet := readPacket(t, dev, 100*time.Millisecond); packet != nil {
+		t.Errorf("sent %x with ICMP errors disabled", []byte(packet))
+	}
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// AddrInUseError is the error of a listener that could not bind its address
+// because other endpoints hold it. It wraps syscall.EADDRINUSE.
+type AddrInUseError struct {
+	Addr netip.AddrPort
+
+	// Lingering reports that the address is held only by closed
+	// connections waiting out TIME-WAIT or finishing their shutdown, as
+	// opposed to a live listener. Port reuse would have ignored them.
+	Lingering bool
+}
+
+func (e *AddrInUseError) Error() string {
+	if e.Lingering {
+		return fmt.Sprintf("address %v held by closed connections; enable port reuse to listen on it", e.Addr)
+	}
+	return fmt.Sprintf("address %v in use by a live listener", e.Addr)
+}
+
+func (e *AddrInUseError) Unwrap() error {
+	return syscall.EADDRINUSE
+}
+
+// SetPortReuse sets whether TCP listeners may bind addresses still held by
+// closed connections, like SO_REUSEADDR does on Unix. It is enabled by
+// default, as it is by the net package, so that a server can close its
+// listener and immediately listen on the same address again. Addresses of
+// live listeners can never be bound twice. It applies to listeners created
+// afterwards.
+func (net *Net) SetPortReuse(enabled bool) {
+	net.noPortReuse.Store(!enabled)
+}
+
+func (tnet *Net) listenTCP(addr tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*gonet.TCPListener, error) {
+	var wq waiter.Queue
+	ep, tcpipErr := tnet.stack.NewEndpoint(tcp.ProtocolNumber, pn, &wq)
+	if tcpipErr != nil {
+		return nil, errors.New(tcpipErr.String())
+	}
+	ep.SocketOptions().SetReuseAddress(!tnet.noPortReuse.Load())
+
+	if tcpipErr := ep.Bind(addr); tcpipErr != nil {
+		ep.Close()
+		var err error = errors.New(tcpipErr.String())
+		if _, ok := tcpipErr.(*tcpip.ErrPortInUse); ok {
+			err = tnet.addrInUse(addr)
+		}
+		return nil, &net.OpError{Op: "bind", Net: "tcp", Addr: tcpAddr(addr), Err: err}
+	}
+	if tcpipErr := ep.Listen(int(tnet.listenBacklog.Load())); tcpipErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr(addr), Err: errors.New(tcpipErr.String())}
+	}
+	return gonet.NewTCPListener(tnet.stack, &wq, ep), nil
+}
+
+// addrInUse explains why addr could not be bound, by looking at the TCP
+// endpoints using its port.
+func (tnet *Net) addrInUse(addr tcpip.FullAddress) *AddrInUseError {
+	ip, _ := netip.AddrFromSlice(addr.Addr.AsSlice())
+	e := &AddrInUseError{Addr: netip.AddrPortFrom(ip, addr.Port), Lingering: true}
+	for _, te := range tnet.stack.RegisteredEndpoints() {
+		ep, ok := te.(*tcp.Endpoint)
+		if !ok {
+			continue
+		}
+		local, err := ep.GetLocalAddress()
+		if err != nil || local.Port != addr.Port {
+			continue
+		}
+		switch tcp.EndpointState(ep.State()) {
+		case tcp.StateTimeWait, tcp.StateFinWait1, tcp.StateFinWait2, tcp.StateClosing, tcp.StateLastAck, tcp.StateClose:
+		default:
+			e.Lingering = false
+		}
+	}
+	return e
+}
+
+func tcpAddr(addr tcpip.FullAddress) *net.TCPAddr {
+	return &net.TCPAddr{IP: addr.Addr.AsSlice(), Port: int(addr.Port)}
+}
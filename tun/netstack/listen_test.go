@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"net/netip"
+	"syscall"
+	"testing"
+)
+
+// closedConnection listens on addr, completes one connection, and closes
+// both, leaving the accepted side of the connection in TIME-WAIT.
+func closedConnection(t *testing.T, tnet *Net, addr netip.AddrPort) {
+	t.Helper()
+	ln, err := tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := tnet.DialTCPAddrPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Read(make([]byte, 1)) // wait for the server to close first
+	c.Close()
+	ln.Close()
+}
+
+func TestListenPortReuse(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	addr := netip.AddrPortFrom(local, 80)
+	closedConnection(t, tnet, addr)
+	ln, err := tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		t.Fatalf("listening again after close: %v", err)
+	}
+
+	_, err = tnet.ListenTCPAddrPort(addr)
+	var inUse *AddrInUseError
+	if !errors.As(err, &inUse) || inUse.Lingering || inUse.Addr != addr {
+		t.Fatalf("listening twice: got %v, want a live listener holding %v", err, addr)
+	}
+	ln.Close()
+
+	tnet.SetPortReuse(false)
+	addr = netip.AddrPortFrom(local, 8080)
+	closedConnection(t, tnet, addr)
+	_, err = tnet.ListenTCPAddrPort(addr)
+	if !errors.As(err, &inUse) || !inUse.Lingering {
+		t.Fatalf("listening again without port reuse: got %v, want lingering connections", err)
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("%v does not match EADDRINUSE", err)
+	}
+}
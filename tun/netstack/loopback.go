@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// SpliceOptions configures the link Splice simulates between two Nets.
+// The zero value is the lossless link without added latency used by Splice.
+type SpliceOptions struct {
+	// Loss is the probability, from 0 to 1, that a packet is dropped.
+	Loss float64
+
+	// Latency delays each packet, in both directions, preserving their order.
+	Latency time.Duration
+
+	// SNAT, if not nil, translates the sources of the packets a sends to b,
+	// and restores the destinations of the replies, making b see a's flows
+	// as coming from the SNAT's addresses.
+	SNAT *SNAT
+}
+
+// Splice connects a and b directly, delivering the packets each sends to
+// the other as a tunnel between them would, without devices, keys or
+// sockets. The tun.Devices created with a and b must not be read while they
+// are spliced. stop disconnects them, discarding packets still in flight.
+func Splice(a, b *Net) (stop func()) {
+	return SpliceWithOptions(a, b, SpliceOptions{})
+}
+
+// SpliceWithOptions is like Splice but simulates the loss and latency set
+// by opts.
+func SpliceWithOptions(a, b *Net, opts SpliceOptions) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var outbound, inbound func(packet []byte) bool
+	if opts.SNAT != nil {
+		outbound = opts.SNAT.Outbound
+		inbound = func(packet []byte) bool {
+			opts.SNAT.Inbound(packet)
+			return true
+		}
+	}
+	go func() {
+		defer wg.Done()
+		forward(a, b, opts, outbound, done)
+	}()
+	go func() {
+		defer wg.Done()
+		forward(b, a, opts, inbound, done)
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+type delayedPacket struct {
+	due    time.Time
+	packet []byte
+}
+
+// forward moves the packets sent by from to to, until done is closed or
+// from is, passing them through translate, if not nil, which may drop them.
+func forward(from, to *Net, opts SpliceOptions, translate func(packet []byte) bool, done <-chan struct{}) {
+	var delayed chan delayedPacket
+	if opts.Latency > 0 {
+		delayed = make(chan delayedPacket, incomingQueueSize)
+		delivered := make(chan struct{})
+		go func() {
+			defer close(delivered)
+			deliverDelayed(to, delayed, done)
+		}()
+		defer func() {
+			close(delayed)
+			<-delivered
+		}()
+	}
+	for {
+		var packet []byte
+		select {
+		case view := <-from.incomingPacket:
+			packet = view.ToSlice()
+			view.Release()
+		case <-from.done:
+			return
+		case <-done:
+			return
+		}
+		if opts.Loss > 0 && rand.Float64() < opts.Loss {
+			continue
+		}
+		if translate != nil && !translate(packet) {
+			continue
+		}
+		if delayed == nil {
+			(*netTun)(to).Write([][]byte{packet}, 0)
+			continue
+		}
+		select {
+		case delayed <- delayedPacket{time.Now().Add(opts.Latency), packet}:
+		default:
+			// The link is saturated.
+		}
+	}
+}
+
+// deliverDelayed writes the packets of delayed to to once they are due.
+func deliverDelayed(to *Net, delayed <-chan delayedPacket, done <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for p := range delayed {
+		timer.Reset(time.Until(p.due))
+		select {
+		case <-timer.C:
+			(*netTun)(to).Write([][]byte{p.packet}, 0)
+		case <-done:
+			return
+		}
+	}
+}
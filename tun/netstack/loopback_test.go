@@ -0,0 +1,157 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var (
+	spliceAddrA = netip.MustParseAddr("10.0.0.1")
+	spliceAddrB = netip.MustParseAddr("10.0.0.2")
+)
+
+// splicedPair returns two Nets with the addresses spliceAddrA and
+// spliceAddrB, spliced with opts.
+func splicedPair(tb testing.TB, opts SpliceOptions) (a, b *Net, stop func()) {
+	tb.Helper()
+	devA, a, err := CreateNetTUN([]netip.Addr{spliceAddrA}, nil, 1420)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { devA.Close() })
+	devB, b, err := CreateNetTUN([]netip.Addr{spliceAddrB}, nil, 1420)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { devB.Close() })
+	stop = SpliceWithOptions(a, b, opts)
+	tb.Cleanup(stop)
+	return a, b, stop
+}
+
+func TestSpliceTCP(t *testing.T) {
+	a, b, _ := splicedPair(t, SpliceOptions{})
+	ln, err := b.ListenTCPAddrPort(netip.AddrPortFrom(spliceAddrB, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := a.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(spliceAddrB, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := bytes.Repeat([]byte("spliced"), 10000)
+	go c.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("echo differs from the message")
+	}
+}
+
+// udpRoundTrip sends a datagram from a to b and reports whether it
+// arrived, and how long it took.
+func udpRoundTrip(t *testing.T, a, b *Net, wait time.Duration) (time.Duration, bool) {
+	t.Helper()
+	ln, err := b.ListenUDPAddrPort(netip.AddrPortFrom(spliceAddrB, 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := a.DialUDPAddrPort(netip.AddrPort{}, netip.AddrPortFrom(spliceAddrB, 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	ln.SetReadDeadline(time.Now().Add(wait))
+	if _, _, err := ln.ReadFrom(make([]byte, 16)); err != nil {
+		return 0, false
+	}
+	return time.Since(start), true
+}
+
+func TestSpliceOptions(t *testing.T) {
+	a, b, _ := splicedPair(t, SpliceOptions{Latency: 50 * time.Millisecond})
+	if d, ok := udpRoundTrip(t, a, b, 5*time.Second); !ok || d < 50*time.Millisecond {
+		t.Errorf("datagram delivered after %v (%v), want at least the 50ms latency", d, ok)
+	}
+
+	a, b, _ = splicedPair(t, SpliceOptions{Loss: 1})
+	if _, ok := udpRoundTrip(t, a, b, 100*time.Millisecond); ok {
+		t.Error("datagram delivered despite a loss of 1")
+	}
+}
+
+func TestSpliceStop(t *testing.T) {
+	a, b, stop := splicedPair(t, SpliceOptions{})
+	if _, ok := udpRoundTrip(t, a, b, 5*time.Second); !ok {
+		t.Fatal("datagram not delivered")
+	}
+	stop()
+	stop()
+	if _, ok := udpRoundTrip(t, a, b, 100*time.Millisecond); ok {
+		t.Error("datagram delivered after stop")
+	}
+}
+
+// BenchmarkSpliceTCP measures the throughput of TCP through the stacks
+// alone, without WireGuard's cryptography.
+func BenchmarkSpliceTCP(b *testing.B) {
+	na, nb, _ := splicedPair(b, SpliceOptions{})
+	ln, err := nb.ListenTCPAddrPort(netip.AddrPortFrom(spliceAddrB, 80))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}()
+	c, err := na.DialContextTCPAddrPort(context.Background(), netip.AddrPortFrom(spliceAddrB, 80))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := make([]byte, 64<<10)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
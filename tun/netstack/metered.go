@@ -0,0 +1,240 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A MeteredConn is a net.Conn that counts the bytes read from and written to
+// it, and optionally caps the rate at which they are. The Net wraps the
+// conns it dials and accepts in one if Options.Metered is set. It passes on
+// half-closes, and lets its conn copy from readers and to writers itself
+// while it has no rate limit, so that io.Copy keeps its fast paths.
+type MeteredConn struct {
+	net.Conn
+	rx, tx         atomic.Uint64
+	rxRate, txRate tokenBucket
+	closeOnce      sync.Once
+	closed         chan struct{}
+}
+
+// NewMeteredConn returns c wrapped to meter it.
+func NewMeteredConn(c net.Conn) *MeteredConn {
+	return &MeteredConn{Conn: c, closed: make(chan struct{})}
+}
+
+// NetConn returns the underlying connection of c.
+func (c *MeteredConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Stats returns the number of bytes read from and written to c.
+func (c *MeteredConn) Stats() (rx, tx uint64) {
+	return c.rx.Load(), c.tx.Load()
+}
+
+// SetRateLimit caps the rate of reads and writes on c to bytesPerSec each,
+// allowing bursts of a tenth of a second. A non-positive bytesPerSec
+// removes the cap. Reads and writes waiting for the rate to allow them
+// ignore deadlines, but return once c is closed.
+func (c *MeteredConn) SetRateLimit(bytesPerSec int64) {
+	c.rxRate.setRate(bytesPerSec)
+	c.txRate.setRate(bytesPerSec)
+}
+
+func (c *MeteredConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return c.Conn.Read(b)
+	}
+	allowed, err := c.rxRate.take(len(b), c.closed)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b[:allowed])
+	c.rxRate.refund(allowed - n)
+	c.rx.Add(uint64(n))
+	return n, err
+}
+
+func (c *MeteredConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		allowed, err := c.txRate.take(len(b), c.closed)
+		if err != nil {
+			return n, err
+		}
+		written, err := c.Conn.Write(b[:allowed])
+		c.txRate.refund(allowed - written)
+		c.tx.Add(uint64(written))
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[written:]
+	}
+	return n, nil
+}
+
+// CloseWrite shuts down the writing side of c, if its conn can, as a
+// TCPConn can, and closes c otherwise.
+func (c *MeteredConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// CloseRead shuts down the reading side of c, if its conn can.
+func (c *MeteredConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return errors.ErrUnsupported
+}
+
+// ReadFrom writes what it reads from r to c until EOF, metering it as Write
+// does. Without a rate limit, the conn copies it if it can.
+func (c *MeteredConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok && !c.txRate.limited() {
+		n, err := rf.ReadFrom(r)
+		c.tx.Add(uint64(n))
+		return n, err
+	}
+	return io.Copy(struct{ io.Writer }{c}, r)
+}
+
+// WriteTo writes what it reads from c to w until EOF, metering it as Read
+// does. Without a rate limit, the conn copies it if it can.
+func (c *MeteredConn) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := c.Conn.(io.WriterTo); ok && !c.rxRate.limited() {
+		n, err := wt.WriteTo(w)
+		c.rx.Add(uint64(n))
+		return n, err
+	}
+	return io.Copy(w, struct{ io.Reader }{c})
+}
+
+func (c *MeteredConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// meter returns c in a MeteredConn if the Net meters its conns, and c
+// itself otherwise.
+func (tnet *Net) meter(c net.Conn) net.Conn {
+	if !tnet.metered {
+		return c
+	}
+	return NewMeteredConn(c)
+}
+
+// byteCounts counts the bytes read from and written to a TCPConn or UDPConn
+// of a metered Net. Its methods do nothing on a nil byteCounts.
+type byteCounts struct {
+	rx, tx atomic.Uint64
+}
+
+func (c *byteCounts) read(n int) {
+	if c != nil && n > 0 {
+		c.rx.Add(uint64(n))
+	}
+}
+
+func (c *byteCounts) written(n int) {
+	if c != nil && n > 0 {
+		c.tx.Add(uint64(n))
+	}
+}
+
+func (c *byteCounts) stats() (rx, tx uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.rx.Load(), c.tx.Load()
+}
+
+// counts returns new byteCounts if the Net meters its conns, and nil
+// otherwise.
+func (tnet *Net) counts() *byteCounts {
+	if !tnet.metered {
+		return nil
+	}
+	return new(byteCounts)
+}
+
+// tokenBucket caps a rate of bytes. Its zero value allows any rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64   // bytes per second, or zero for no cap
+	tokens float64 // bytes that may pass, up to burst
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = max(rate, 0)
+	b.tokens = float64(b.burst())
+	b.last = time.Now()
+}
+
+// limited reports whether b caps the rate.
+func (b *tokenBucket) limited() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate > 0
+}
+
+// burst returns the most bytes that may pass at once. b.mu must be held.
+func (b *tokenBucket) burst() int64 {
+	return max(b.rate/10, 1)
+}
+
+// take waits until the rate allows some of n bytes to pass, up to a burst,
+// and returns how many. It fails with net.ErrClosed once closed is.
+func (b *tokenBucket) take(n int, closed <-chan struct{}) (int, error) {
+	b.mu.Lock()
+	for b.rate > 0 {
+		now := time.Now()
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(b.rate), float64(b.burst()))
+		b.last = now
+		want := min(int64(n), b.burst())
+		if b.tokens >= float64(want) {
+			b.tokens -= float64(want)
+			b.mu.Unlock()
+			return int(want), nil
+		}
+		wait := time.Duration((float64(want) - b.tokens) / float64(b.rate) * float64(time.Second))
+		b.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-closed:
+			timer.Stop()
+			return 0, net.ErrClosed
+		}
+		b.mu.Lock()
+	}
+	b.mu.Unlock()
+	return n, nil
+}
+
+// refund returns n bytes taken but not passed to b.
+func (b *tokenBucket) refund(n int) {
+	if n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate > 0 {
+		b.tokens = min(b.tokens+float64(n), float64(b.burst()))
+	}
+}
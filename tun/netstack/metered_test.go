@@ -0,0 +1,230 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeteredConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := NewMeteredConn(a)
+	go func() {
+		io.Copy(io.Discard, b)
+	}()
+	go b.Write(make([]byte, 300))
+	if _, err := c.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if rx, tx := c.Stats(); rx != 300 || tx != 1000 {
+		t.Errorf("stats %d read, %d written, want 300 and 1000", rx, tx)
+	}
+
+	// At 20000 bytes per second, with a burst of 2000, writing 10000 bytes
+	// takes 0.4 seconds.
+	const rate, size = 20000, 10000
+	c.SetRateLimit(rate)
+	start := time.Now()
+	if _, err := c.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed, min := time.Since(start), time.Duration(size)*time.Second/rate/2; elapsed < min {
+		t.Errorf("wrote %d bytes in %v at %d bytes per second, want at least %v", size, elapsed, rate, min)
+	}
+
+	// Closing the conn ends writes waiting for the rate.
+	c.SetRateLimit(1)
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write(make([]byte, 10))
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-written:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("write ended with %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write waiting for the rate did not end on close")
+	}
+}
+
+func TestMeteredOption(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	for _, metered := range []bool{false, true} {
+		dev, tnet, err := CreateNetTUNWithOptions([]netip.Addr{local}, nil, 1420, Options{Metered: metered})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dev.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		accepted := make(chan net.Conn, 1)
+		addr := netip.AddrPortFrom(local, 80)
+		go tnet.ServeTCP(ctx, addr, func(ctx context.Context, c net.Conn) {
+			c.Write([]byte("hello"))
+			accepted <- c
+			<-ctx.Done()
+		})
+		var c net.Conn
+		for {
+			if c, err = tnet.DialContext(ctx, "tcp", addr.String()); err == nil || ctx.Err() != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+			t.Fatal(err)
+		}
+		served := <-accepted
+		dialed, ok := c.(*MeteredConn)
+		if ok != metered {
+			t.Errorf("dialed %T with Metered %v", c, metered)
+		} else if ok {
+			if rx, _ := dialed.Stats(); rx != 5 {
+				t.Errorf("%d bytes read on the dialed conn, want 5", rx)
+			}
+		}
+		acceptedConn, ok := served.(*MeteredConn)
+		if ok != metered {
+			t.Errorf("accepted %T with Metered %v", served, metered)
+		} else if ok {
+			if _, tx := acceptedConn.Stats(); tx != 5 {
+				t.Errorf("%d bytes written on the accepted conn, want 5", tx)
+			}
+		}
+		c.Close()
+		cancel()
+	}
+}
+
+func TestMeteredHalfClose(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUNWithOptions([]netip.Addr{local}, nil, 1420, Options{Metered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	front, err := tnet.ListenTCPConn(netip.AddrPortFrom(local, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	back, err := tnet.ListenTCPConn(netip.AddrPortFrom(local, 81))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+
+	// A proxy splices metered conns, which pass on the client's half-close
+	// to the server, and leave the server's reply to reach the client.
+	go func() {
+		a, err := front.Accept()
+		if err != nil {
+			return
+		}
+		b, err := tnet.DialContext(ctx, "tcp", netip.AddrPortFrom(local, 81).String())
+		if err != nil {
+			a.Close()
+			return
+		}
+		spliceConns(a, b)
+		a.Close()
+		b.Close()
+	}()
+	client, err := tnet.DialContextTCPConn(ctx, netip.AddrPortFrom(local, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client.CloseWrite()
+
+	server, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(server); err != nil || string(got) != "ping" {
+		t.Fatalf("server read %q, %v", got, err)
+	}
+	if _, err := io.Copy(server, strings.NewReader("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.(*MeteredConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(client); err != nil || string(got) != "pong" {
+		t.Fatalf("client read %q, %v", got, err)
+	}
+	if rx, tx := server.(*MeteredConn).Stats(); rx != 4 || tx != 4 {
+		t.Errorf("server stats %d read, %d written, want 4 and 4", rx, tx)
+	}
+	if rx, tx := client.Stats(); rx != 4 || tx != 4 {
+		t.Errorf("client stats %d read, %d written, want 4 and 4", rx, tx)
+	}
+}
+
+func TestMeteredUDPConn(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUNWithOptions([]netip.Addr{local}, nil, 1420, Options{Metered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	listener, err := tnet.ListenUDPConn(netip.AddrPortFrom(local, 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sender, err := tnet.DialUDPConn(netip.AddrPort{}, netip.AddrPortFrom(local, 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	if _, err := sender.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.WriteBatch([][]byte{make([]byte, 10), make([]byte, 20)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	for range 3 {
+		if _, _, err := listener.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, tx := sender.Stats(); tx != 130 {
+		t.Errorf("%d bytes written, want 130", tx)
+	}
+	if rx, _ := listener.Stats(); rx != 130 {
+		t.Errorf("%d bytes read, want 130", rx)
+	}
+}
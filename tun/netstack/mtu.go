@@ -0,0 +1,41 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/darkit/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// SetMTU changes the MTU of the stack's interface and signals the change to
+// the WireGuard device with a tun.EventMTUUpdate. The MSS advertised by TCP
+// connections started or accepted afterwards is derived from the new MTU,
+// while established connections keep the MSS they negotiated.
+func (net *Net) SetMTU(mtu int) error {
+	min := header.IPv4MinimumMTU
+	if net.hasV6 {
+		min = header.IPv6MinimumMTU
+	}
+	if mtu < min || mtu > 0xffff {
+		return fmt.Errorf("invalid MTU %d", mtu)
+	}
+	net.eventsMu.Lock()
+	defer net.eventsMu.Unlock()
+	if net.closed {
+		return os.ErrClosed
+	}
+	net.ep.SetMTU(uint32(mtu))
+	select {
+	case net.events <- tun.EventMTUUpdate:
+	default:
+		// The device has yet to read earlier events, and will read the
+		// MTU once it does.
+	}
+	return nil
+}
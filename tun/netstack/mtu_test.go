@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// buildSYNv4 returns an IPv4/TCP SYN advertising mss.
+func buildSYNv4(src, dst netip.AddrPort, mss uint16) []byte {
+	opts := make([]byte, 4)
+	header.EncodeMSSOption(uint32(mss), opts)
+	pkt := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize+len(opts))
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(src.Addr().As4()),
+		DstAddr:     tcpip.AddrFrom4(dst.Addr().As4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	tcp := header.TCP(pkt[header.IPv4MinimumSize:])
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    src.Port(),
+		DstPort:    dst.Port(),
+		SeqNum:     1,
+		DataOffset: uint8(header.TCPMinimumSize + len(opts)),
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	copy(tcp[header.TCPMinimumSize:], opts)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(tcp)))
+	tcp.SetChecksum(^checksum.Checksum(tcp, xsum))
+	return pkt
+}
+
+// synReader returns the MSS advertised by each SYN the stack sends through
+// dev, other packets being discarded.
+func synReader(t *testing.T, dev tun.Device) <-chan uint16 {
+	mss := make(chan uint16, 16)
+	go func() {
+		bufs := [][]byte{make([]byte, 0xffff)}
+		sizes := make([]int, 1)
+		for {
+			if _, err := dev.Read(bufs, sizes, 0); err != nil {
+				return
+			}
+			pkt := bufs[0][:sizes[0]]
+			var tcp header.TCP
+			switch header.IPVersion(pkt) {
+			case header.IPv4Version:
+				if ip := header.IPv4(pkt); ip.TransportProtocol() == header.TCPProtocolNumber {
+					tcp = ip.Payload()
+				}
+			case header.IPv6Version:
+				if ip := header.IPv6(pkt); ip.TransportProtocol() == header.TCPProtocolNumber {
+					tcp = ip.Payload()
+				}
+			}
+			if tcp == nil || tcp.Flags()&header.TCPFlagSyn == 0 {
+				continue
+			}
+			mss <- header.ParseSynOptions(tcp.Options(), tcp.Flags()&header.TCPFlagAck != 0).MSS
+		}
+	}()
+	t.Cleanup(func() { dev.Close() })
+	return mss
+}
+
+func expectMSS(t *testing.T, mss <-chan uint16, want uint16, what string) {
+	t.Helper()
+	select {
+	case got := <-mss:
+		if got != want {
+			t.Errorf("%s advertised MSS %d, want %d", what, got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s sent", what)
+	}
+}
+
+// dialSYN starts a TCP handshake with addr, which is never answered, so that
+// the stack sends a SYN.
+func dialSYN(t *testing.T, tnet *Net, addr string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go tnet.DialContextTCPAddrPort(ctx, netip.MustParseAddrPort(addr))
+}
+
+func TestMSS(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local, netip.MustParseAddr("fd00::29")}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mss := synReader(t, dev)
+
+	dialSYN(t, tnet, "192.168.4.1:80")
+	expectMSS(t, mss, 1280-header.IPv4MinimumSize-header.TCPMinimumSize, "IPv4 SYN")
+	dialSYN(t, tnet, "[fd00::1]:80")
+	expectMSS(t, mss, 1280-header.IPv6MinimumSize-header.TCPMinimumSize, "IPv6 SYN")
+
+	listener, err := tnet.ListenTCPAddrPort(netip.AddrPortFrom(local, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	syn := buildSYNv4(netip.MustParseAddrPort("192.168.4.1:40000"), netip.AddrPortFrom(local, 80), 1460)
+	if _, err := dev.Write([][]byte{syn}, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectMSS(t, mss, 1280-header.IPv4MinimumSize-header.TCPMinimumSize, "SYN-ACK")
+
+	if e := <-dev.Events(); e != tun.EventUp {
+		t.Fatalf("first event %v, want EventUp", e)
+	}
+	if err := tnet.SetMTU(1400); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-dev.Events(); e != tun.EventMTUUpdate {
+		t.Fatalf("event %v after SetMTU, want EventMTUUpdate", e)
+	}
+	if got, _ := dev.MTU(); got != 1400 {
+		t.Fatalf("MTU %d after SetMTU, want 1400", got)
+	}
+	dialSYN(t, tnet, "192.168.4.2:80")
+	expectMSS(t, mss, 1400-header.IPv4MinimumSize-header.TCPMinimumSize, "IPv4 SYN after SetMTU")
+
+	if err := tnet.SetMTU(1200); err == nil {
+		t.Error("SetMTU accepted an MTU below the IPv6 minimum")
+	}
+	dev.Close()
+	if err := tnet.SetMTU(1400); err == nil {
+		t.Error("SetMTU succeeded after Close")
+	}
+}
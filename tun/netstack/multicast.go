@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+)
+
+// JoinMulticastGroup subscribes the stack to the multicast group addr, so
+// that UDP sockets listening on the unspecified address, or on addr, receive
+// datagrams sent to the group. Broadcast datagrams are received without
+// joining anything.
+//
+// The stack only sees what the device writes to its TUN, so the remote peers
+// sending to the group must route it to this device, with an allowed IP
+// covering addr such as 224.0.0.0/4 or ff00::/8, and this device must accept
+// the sources of their datagrams through its allowed IPs for them. Likewise,
+// datagrams sent to a group or to a broadcast address only leave through
+// the tunnel if the peer they are meant for has an allowed IP covering the
+// destination; with several such peers, the device sends them to one.
+func (net *Net) JoinMulticastGroup(addr netip.Addr) error {
+	protocol, err := multicastProtocol(addr)
+	if err != nil {
+		return err
+	}
+	if tcpipErr := net.stack.JoinGroup(protocol, 1, tcpip.AddrFromSlice(addr.AsSlice())); tcpipErr != nil {
+		return fmt.Errorf("JoinGroup(%v): %v", addr, tcpipErr)
+	}
+	return nil
+}
+
+// LeaveMulticastGroup unsubscribes the stack from the multicast group addr.
+func (net *Net) LeaveMulticastGroup(addr netip.Addr) error {
+	protocol, err := multicastProtocol(addr)
+	if err != nil {
+		return err
+	}
+	if tcpipErr := net.stack.LeaveGroup(protocol, 1, tcpip.AddrFromSlice(addr.AsSlice())); tcpipErr != nil {
+		return fmt.Errorf("LeaveGroup(%v): %v", addr, tcpipErr)
+	}
+	return nil
+}
+
+func multicastProtocol(addr netip.Addr) (tcpip.NetworkProtocolNumber, error) {
+	if !addr.IsMulticast() {
+		return 0, fmt.Errorf("%v is not a multicast address", addr)
+	}
+	if addr.Is4() {
+		return ipv4.ProtocolNumber, nil
+	}
+	return ipv6.ProtocolNumber, nil
+}
+
+// SetBroadcast allows the socket to send to broadcast addresses, such as
+// 255.255.255.255, which it refuses to by default.
+func (c *UDPConn) SetBroadcast(enabled bool) {
+	c.ep.SocketOptions().SetBroadcast(enabled)
+}
+
+// SetMulticastHopLimit sets the TTL or hop limit of the multicast datagrams
+// the socket sends, which defaults to 1 and is decremented by each router on
+// the far side of the tunnel.
+func (c *UDPConn) SetMulticastHopLimit(hops int) error {
+	if hops < 0 || hops > 255 {
+		return errors.New("hop limit out of range")
+	}
+	if tcpipErr := c.ep.SetSockOptInt(tcpip.MulticastTTLOption, hops); tcpipErr != nil {
+		return errors.New(tcpipErr.String())
+	}
+	return nil
+}
+
+// SetMulticastLoopback sets whether the stack delivers the multicast
+// datagrams the socket sends to its own sockets in the group, as well as to
+// the tunnel. It is enabled by default.
+func (c *UDPConn) SetMulticastLoopback(enabled bool) {
+	c.ep.SocketOptions().SetMulticastLoop(enabled)
+}
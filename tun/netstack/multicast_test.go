@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/device/devicetest"
+)
+
+// TestMulticast passes an mDNS-style query to a multicast group and its
+// reply between two devices, then a broadcast datagram.
+func TestMulticast(t *testing.T) {
+	a, b := devicetest.NewPair(t)
+	for _, n := range []*devicetest.Node{a, b} {
+		other := a
+		if n == a {
+			other = b
+		}
+		if err := n.Device.IpcSet(fmt.Sprintf("public_key=%s\nallowed_ip=224.0.0.0/4\nallowed_ip=255.255.255.255/32\n", other.PublicKey.Hex())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	group := netip.MustParseAddrPort("224.0.0.251:5353")
+	if err := b.Net.JoinMulticastGroup(group.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	responder, err := b.Net.ListenUDPAddrPort(netip.AddrPortFrom(netip.IPv4Unspecified(), group.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	querier, err := a.Net.ListenUDPConn(netip.AddrPortFrom(a.Addr, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer querier.Close()
+	if err := querier.SetMulticastHopLimit(255); err != nil {
+		t.Fatal(err)
+	}
+
+	query := []byte("_services._dns-sd._udp.local")
+	if _, err := querier.WriteTo(query, net.UDPAddrFromAddrPort(group)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	responder.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := responder.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], query) {
+		t.Fatalf("got query %q, want %q", buf[:n], query)
+	}
+	if _, err := responder.WriteTo([]byte("answer"), from); err != nil {
+		t.Fatal(err)
+	}
+	querier.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err = querier.ReadFrom(buf); err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("got reply %q, %v", buf[:n], err)
+	}
+
+	broadcast := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("255.255.255.255:5353"))
+	if _, err := querier.WriteTo(query, broadcast); err == nil {
+		t.Error("broadcast sent without SetBroadcast")
+	}
+	querier.SetBroadcast(true)
+	if _, err := querier.WriteTo(query, broadcast); err != nil {
+		t.Fatal(err)
+	}
+	responder.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err = responder.ReadFrom(buf); err != nil || !bytes.Equal(buf[:n], query) {
+		t.Fatalf("got broadcast %q, %v", buf[:n], err)
+	}
+}
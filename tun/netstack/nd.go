@@ -0,0 +1,140 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// DefaultDADRetransmitTimer is the interval between the Neighbor
+// Solicitations of Duplicate Address Detection when NDOptions.DADTransmits
+// is set and NDOptions.DADRetransmitTimer is zero.
+const DefaultDADRetransmitTimer = time.Second
+
+// NDOptions configures IPv6 neighbor discovery on the stack's interface, for
+// addresses in a /64 shared with other on-link hosts, such as in bridged
+// setups. The zero value is the configuration used by CreateNetTUN: no
+// Duplicate Address Detection, Neighbor Solicitations answered only for the
+// stack's own addresses, and gVisor's default neighbor unreachability
+// detection timers.
+type NDOptions struct {
+	// DADTransmits is the number of Neighbor Solicitations sent for
+	// Duplicate Address Detection of each IPv6 address, which cannot be
+	// used until they go unanswered. Zero disables DAD.
+	DADTransmits uint8
+
+	// DADRetransmitTimer is the interval between those solicitations. Zero
+	// selects DefaultDADRetransmitTimer.
+	DADRetransmitTimer time.Duration
+
+	// Proxy lists prefixes whose addresses the stack answers Neighbor
+	// Solicitations for in addition to its own, so that on-link hosts send
+	// their traffic for them into the tunnel. Its advertisements do not set
+	// the override flag, leaving hosts that answer for themselves in charge.
+	Proxy []netip.Prefix
+
+	// NUDBaseReachableTime, NUDRetransmitTimer and NUDDelayFirstProbeTime
+	// are the neighbor unreachability detection timers of RFC 4861. Zero
+	// selects gVisor's default for each: 30s, 1s and 5s.
+	NUDBaseReachableTime   time.Duration
+	NUDRetransmitTimer     time.Duration
+	NUDDelayFirstProbeTime time.Duration
+
+	// NUDMaxProbes is the number of unanswered probes after which a
+	// neighbor is unreachable. Zero selects gVisor's default of 3.
+	NUDMaxProbes uint32
+}
+
+func (opts *NDOptions) dadConfigurations() stack.DADConfigurations {
+	dad := stack.DADConfigurations{DupAddrDetectTransmits: opts.DADTransmits, RetransmitTimer: opts.DADRetransmitTimer}
+	if dad.RetransmitTimer == 0 {
+		dad.RetransmitTimer = DefaultDADRetransmitTimer
+	}
+	return dad
+}
+
+// nudConfigurations returns the NUD configuration, leaving zero fields for
+// the stack to replace with its defaults.
+func (opts *NDOptions) nudConfigurations() stack.NUDConfigurations {
+	return stack.NUDConfigurations{
+		BaseReachableTime:   opts.NUDBaseReachableTime,
+		RetransmitTimer:     opts.NUDRetransmitTimer,
+		DelayFirstProbeTime: opts.NUDDelayFirstProbeTime,
+		MaxMulticastProbes:  opts.NUDMaxProbes,
+		MaxUnicastProbes:    opts.NUDMaxProbes,
+	}
+}
+
+// proxyNeighborSolicit answers packet if it is a Neighbor Solicitation for
+// an address in the ND proxy list that is not the stack's own, and reports
+// whether it did. The stack does not see such solicitations.
+func (tun *netTun) proxyNeighborSolicit(packet []byte) bool {
+	if len(tun.ndProxy) == 0 || len(packet) < header.IPv6MinimumSize+header.ICMPv6NeighborSolicitMinimumSize {
+		return false
+	}
+	ip := header.IPv6(packet)
+	if !ip.IsValid(len(packet)) {
+		return false
+	}
+	icmp := header.ICMPv6(ip.Payload())
+	if ip.TransportProtocol() != header.ICMPv6ProtocolNumber || ip.HopLimit() != header.NDPHopLimit ||
+		len(icmp) < header.ICMPv6NeighborSolicitMinimumSize || icmp.Type() != header.ICMPv6NeighborSolicit || icmp.Code() != 0 {
+		return false
+	}
+	target := header.NDPNeighborSolicit(icmp.MessageBody()).TargetAddress()
+	addr := netip.AddrFrom16(target.As16())
+	if !tun.proxiesNeighbor(addr) || tun.stack.CheckLocalAddress(1, header.IPv6ProtocolNumber, target) != 0 {
+		return false
+	}
+
+	// As per RFC 4861 section 7.2.4, solicitations from the unspecified
+	// address, sent during DAD, are answered to all nodes and unsolicited.
+	src := ip.SourceAddress()
+	solicited := src != header.IPv6Any
+	dst := src
+	if !solicited {
+		dst = header.IPv6AllNodesMulticastAddress
+	}
+	reply := make([]byte, header.IPv6MinimumSize+header.ICMPv6NeighborAdvertMinimumSize)
+	replyIP := header.IPv6(reply)
+	replyIP.Encode(&header.IPv6Fields{
+		PayloadLength:     header.ICMPv6NeighborAdvertMinimumSize,
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          header.NDPHopLimit,
+		SrcAddr:           target,
+		DstAddr:           dst,
+	})
+	na := header.ICMPv6(reply[header.IPv6MinimumSize:])
+	na.SetType(header.ICMPv6NeighborAdvert)
+	body := header.NDPNeighborAdvert(na.MessageBody())
+	body.SetSolicitedFlag(solicited)
+	body.SetTargetAddress(target)
+	na.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: na, Src: target, Dst: dst}))
+
+	// Neighbor discovery is best effort; drop the reply rather than wait
+	// for the reader.
+	view := buffer.NewViewWithData(reply)
+	select {
+	case tun.incomingPacket <- view:
+	default:
+		view.Release()
+	}
+	return true
+}
+
+func (tun *netTun) proxiesNeighbor(addr netip.Addr) bool {
+	for _, prefix := range tun.ndProxy {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
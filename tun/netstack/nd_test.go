@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/tun"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// neighborSolicit returns a Neighbor Solicitation for target from src.
+func neighborSolicit(src, target netip.Addr) []byte {
+	packet := make([]byte, header.IPv6MinimumSize+header.ICMPv6NeighborSolicitMinimumSize)
+	ip := header.IPv6(packet)
+	dst := header.SolicitedNodeAddr(tcpip.AddrFrom16(target.As16()))
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength:     header.ICMPv6NeighborSolicitMinimumSize,
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          header.NDPHopLimit,
+		SrcAddr:           tcpip.AddrFrom16(src.As16()),
+		DstAddr:           dst,
+	})
+	ns := header.ICMPv6(ip.Payload())
+	ns.SetType(header.ICMPv6NeighborSolicit)
+	header.NDPNeighborSolicit(ns.MessageBody()).SetTargetAddress(tcpip.AddrFrom16(target.As16()))
+	ns.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: ns, Src: ip.SourceAddress(), Dst: dst}))
+	return packet
+}
+
+// readPackets returns a channel of the packets the stack sends to dev.
+func readPackets(dev tun.Device) <-chan []byte {
+	packets := make(chan []byte, 16)
+	go func() {
+		defer close(packets)
+		bufs, sizes := [][]byte{make([]byte, 1500)}, make([]int, 1)
+		for {
+			if _, err := dev.Read(bufs, sizes, 0); err != nil {
+				return
+			}
+			packets <- append([]byte(nil), bufs[0][:sizes[0]]...)
+		}
+	}()
+	return packets
+}
+
+// nextICMPv6 returns the next ICMPv6 packet of type typ from packets, or nil
+// if none arrives within timeout.
+func nextICMPv6(packets <-chan []byte, typ header.ICMPv6Type, timeout time.Duration) header.IPv6 {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case packet := <-packets:
+			ip := header.IPv6(packet)
+			if len(packet) >= header.IPv6MinimumSize+header.ICMPv6MinimumSize && ip.TransportProtocol() == header.ICMPv6ProtocolNumber &&
+				header.ICMPv6(ip.Payload()).Type() == typ {
+				return ip
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+func TestNDProxy(t *testing.T) {
+	local := netip.MustParseAddr("2001:db8::1")
+	host := netip.MustParseAddr("2001:db8::2")
+	proxied := netip.MustParseAddr("2001:db8::100")
+	dev, _, err := CreateNetTUNWithOptions([]netip.Addr{local}, nil, 1420, Options{
+		ND: NDOptions{Proxy: []netip.Prefix{netip.MustParsePrefix("2001:db8::100/120")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	packets := readPackets(dev)
+
+	if _, err := dev.Write([][]byte{neighborSolicit(host, proxied)}, 0); err != nil {
+		t.Fatal(err)
+	}
+	ip := nextICMPv6(packets, header.ICMPv6NeighborAdvert, 5*time.Second)
+	if ip == nil {
+		t.Fatal("no neighbor advertisement for a proxied address")
+	}
+	src, dst := ip.SourceAddress(), ip.DestinationAddress()
+	if src != tcpip.AddrFrom16(proxied.As16()) || dst != tcpip.AddrFrom16(host.As16()) || ip.HopLimit() != header.NDPHopLimit {
+		t.Errorf("advertisement from %v to %v with hop limit %d, want from %v to %v with %d", src, dst, ip.HopLimit(), proxied, host, header.NDPHopLimit)
+	}
+	na := header.ICMPv6(ip.Payload())
+	if na.Checksum() != header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: na, Src: src, Dst: dst}) {
+		t.Error("invalid advertisement checksum")
+	}
+	body := header.NDPNeighborAdvert(na.MessageBody())
+	if body.TargetAddress() != src || !body.SolicitedFlag() || body.OverrideFlag() || body.RouterFlag() {
+		t.Errorf("advertisement for %v, solicited %v, override %v, router %v; want %v, solicited only",
+			body.TargetAddress(), body.SolicitedFlag(), body.OverrideFlag(), body.RouterFlag(), proxied)
+	}
+
+	// Addresses outside the proxy list go unanswered.
+	if _, err := dev.Write([][]byte{neighborSolicit(host, netip.MustParseAddr("2001:db8::3"))}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ip := nextICMPv6(packets, header.ICMPv6NeighborAdvert, 100*time.Millisecond); ip != nil {
+		t.Errorf("advertisement for %v, which is not proxied", header.NDPNeighborAdvert(header.ICMPv6(ip.Payload()).MessageBody()).TargetAddress())
+	}
+
+	// Solicitations claiming more payload than they carry are dropped.
+	short := neighborSolicit(host, proxied)
+	header.IPv6(short).SetPayloadLength(header.ICMPv6NeighborSolicitMinimumSize + 8)
+	dev.Write([][]byte{short}, 0)
+	if ip := nextICMPv6(packets, header.ICMPv6NeighborAdvert, 100*time.Millisecond); ip != nil {
+		t.Error("advertisement for a truncated solicitation")
+	}
+}
+
+func TestNDDuplicateAddressDetection(t *testing.T) {
+	local := netip.MustParseAddr("2001:db8::1")
+	dev, _, err := CreateNetTUNWithOptions([]netip.Addr{local}, nil, 1420, Options{
+		ND: NDOptions{DADTransmits: 1, DADRetransmitTimer: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	ip := nextICMPv6(readPackets(dev), header.ICMPv6NeighborSolicit, 5*time.Second)
+	if ip == nil {
+		t.Fatal("no neighbor solicitation for DAD")
+	}
+	target := header.NDPNeighborSolicit(header.ICMPv6(ip.Payload()).MessageBody()).TargetAddress()
+	if ip.SourceAddress() != header.IPv6Any || target != tcpip.AddrFrom16(local.As16()) {
+		t.Errorf("solicitation from %v for %v, want from %v for %v", ip.SourceAddress(), target, header.IPv6Any, local)
+	}
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+)
+
+// ServeOptions configures ServeTCPWithOptions.
+type ServeOptions struct {
+	// MaxConns, if positive, bounds the handlers running at once. Further
+	// connections wait in the accept queue, and once it is full, as
+	// half-open connections, until a handler returns.
+	MaxConns int
+
+	// Errorf, if set, logs the panics of handlers, instead of log.Printf.
+	Errorf func(format string, args ...any)
+}
+
+// ServeTCP listens on addr and calls handler in a goroutine of its own for
+// each connection accepted, closing the connection once handler returns.
+// A handler that panics is logged and its connection closed, without
+// affecting the others.
+//
+// Once ctx is done, ServeTCP stops listening and closes the connections of
+// the running handlers, whose ctx is done too, and returns ctx.Err() after
+// they have returned. It returns earlier only if listening fails, with the
+// error of the listener.
+func (tnet *Net) ServeTCP(ctx context.Context, addr netip.AddrPort, handler func(ctx context.Context, conn net.Conn)) error {
+	return tnet.ServeTCPWithOptions(ctx, addr, handler, ServeOptions{})
+}
+
+// ServeTCPWithOptions is like ServeTCP but with the limit and logging set
+// by opts.
+func (tnet *Net) ServeTCPWithOptions(ctx context.Context, addr netip.AddrPort, handler func(ctx context.Context, conn net.Conn), opts ServeOptions) error {
+	gl, err := tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		return err
+	}
+	ln := newTCPListener(gl, tnet.metered)
+	defer ln.Close()
+	if opts.Errorf == nil {
+		opts.Errorf = log.Printf
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var slots chan struct{}
+	if opts.MaxConns > 0 {
+		slots = make(chan struct{}, opts.MaxConns)
+	}
+	for {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			cancel()
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			serveConn(ctx, c, handler, opts.Errorf)
+		}()
+	}
+}
+
+// serveConn runs handler for c, closing c once it returns, panics or ctx is
+// done.
+func serveConn(ctx context.Context, c net.Conn, handler func(context.Context, net.Conn), errorf func(string, ...any)) {
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer func() {
+		if v := recover(); v != nil {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			errorf("netstack: panic serving %v: %v\n%s", c.RemoteAddr(), v, buf)
+		}
+		stop()
+		c.Close()
+	}()
+	handler(ctx, c)
+}
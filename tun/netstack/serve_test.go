@@ -0,0 +1,218 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveTest runs ServeTCPWithOptions on a stack of its own in the
+// background.
+type serveTest struct {
+	tnet   *Net
+	addr   netip.AddrPort
+	cancel context.CancelFunc
+	errc   chan error
+}
+
+func startServeTest(t *testing.T, handler func(context.Context, net.Conn), opts ServeOptions) *serveTest {
+	t.Helper()
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &serveTest{tnet, netip.AddrPortFrom(local, 80), cancel, make(chan error, 1)}
+	go func() { st.errc <- tnet.ServeTCPWithOptions(ctx, st.addr, handler, opts) }()
+	t.Cleanup(func() {
+		cancel()
+		st.wait(t)
+	})
+	return st
+}
+
+// dial connects to the server, retrying until it listens.
+func (st *serveTest) dial(t *testing.T) net.Conn {
+	t.Helper()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		c, err := st.tnet.DialTCPAddrPort(st.addr)
+		if err == nil {
+			t.Cleanup(func() { c.Close() })
+			return c
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal(err)
+		}
+	}
+}
+
+// wait returns the error ServeTCPWithOptions returned.
+func (st *serveTest) wait(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-st.errc:
+		st.errc <- err
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeTCP did not return")
+		return nil
+	}
+}
+
+func echo(ctx context.Context, c net.Conn) {
+	io.Copy(c, c)
+}
+
+func TestServeTCP(t *testing.T) {
+	var mu sync.Mutex
+	var handlerErr error
+	st := startServeTest(t, func(ctx context.Context, c net.Conn) {
+		// Blocks until the connection is closed by the cancellation.
+		_, err := io.Copy(c, c)
+		mu.Lock()
+		handlerErr = errors.Join(err, ctx.Err())
+		mu.Unlock()
+	}, ServeOptions{})
+
+	c := st.dial(t)
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echoed %q, %v", buf, err)
+	}
+
+	st.cancel()
+	if err := st.wait(t); !errors.Is(err, context.Canceled) {
+		t.Errorf("ServeTCP returned %v, want context.Canceled", err)
+	}
+	// The handler has returned, its ctx done, and the connection closed.
+	mu.Lock()
+	if !errors.Is(handlerErr, context.Canceled) {
+		t.Errorf("handler ended with %v, want its ctx canceled", handlerErr)
+	}
+	mu.Unlock()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(buf); err == nil {
+		t.Error("connection open after the cancellation")
+	}
+	if _, err := st.tnet.DialTCPAddrPort(st.addr); err == nil {
+		t.Error("listening after the cancellation")
+	}
+}
+
+func TestServeTCPMaxConns(t *testing.T) {
+	const maxConns = 2
+	var mu sync.Mutex
+	var running, peak int
+	release := make(chan struct{})
+	st := startServeTest(t, func(ctx context.Context, c net.Conn) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		c.Write([]byte("hi"))
+		<-release
+	}, ServeOptions{MaxConns: maxConns})
+
+	conns := make([]net.Conn, 2*maxConns)
+	for i := range conns {
+		conns[i] = st.dial(t)
+	}
+	served := func(c net.Conn, wait time.Duration) bool {
+		c.SetReadDeadline(time.Now().Add(wait))
+		_, err := io.ReadFull(c, make([]byte, 2))
+		return err == nil
+	}
+	// Only maxConns connections are served, the others wait.
+	var waiting []net.Conn
+	for _, c := range conns {
+		if !served(c, 200*time.Millisecond) {
+			waiting = append(waiting, c)
+		}
+	}
+	if n := len(conns) - len(waiting); n != maxConns {
+		t.Fatalf("%d connections served at once, want %d", n, maxConns)
+	}
+
+	close(release)
+	for _, c := range waiting {
+		if !served(c, 5*time.Second) {
+			t.Error("connection not served once others returned")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > maxConns {
+		t.Errorf("%d handlers ran at once, want at most %d", peak, maxConns)
+	}
+}
+
+func TestServeTCPPanic(t *testing.T) {
+	var mu sync.Mutex
+	var logged []string
+	st := startServeTest(t, func(ctx context.Context, c net.Conn) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		if string(buf) == "panic" {
+			panic("handler failed")
+		}
+		c.Write(buf)
+	}, ServeOptions{Errorf: func(format string, args ...any) {
+		mu.Lock()
+		logged = append(logged, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}})
+
+	c := st.dial(t)
+	c.Write([]byte("panic"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("connection of the panicking handler open")
+	}
+
+	// Other connections are still served.
+	c = st.dial(t)
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echoed %q, %v", buf, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(logged) != 1 || !strings.Contains(logged[0], "handler failed") {
+		t.Errorf("logged %q, want the panic", logged)
+	}
+}
+
+func TestServeTCPListenError(t *testing.T) {
+	st := startServeTest(t, echo, ServeOptions{})
+	st.dial(t)
+	err := st.tnet.ServeTCP(context.Background(), st.addr, echo)
+	var inUse *AddrInUseError
+	if !errors.As(err, &inUse) {
+		t.Errorf("serving twice: got %v, want AddrInUseError", err)
+	}
+}
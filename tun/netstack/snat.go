@@ -0,0 +1,463 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/darkit/wireguard/tun"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Defaults for the zero fields of SNATOptions.
+const (
+	DefaultSNATIdleTimeout    = 2 * time.Minute
+	DefaultSNATTCPIdleTimeout = 2 * time.Hour
+	DefaultSNATMinPort        = 32768
+	DefaultSNATMaxPort        = 60999
+)
+
+// snatSweepInterval is how often expired sessions are looked for.
+const snatSweepInterval = time.Second
+
+// SNATOptions configures an SNAT.
+type SNATOptions struct {
+	// Addr4 and Addr6 are the addresses the sources of forwarded flows are
+	// translated to, typically the addresses of the tunnel. Flows of a
+	// family without an address are not translated.
+	Addr4, Addr6 netip.Addr
+
+	// IdleTimeout expires UDP and ICMP sessions, and TCPIdleTimeout TCP
+	// sessions, once they have seen no packets for that long. Zero selects
+	// DefaultSNATIdleTimeout and DefaultSNATTCPIdleTimeout.
+	IdleTimeout    time.Duration
+	TCPIdleTimeout time.Duration
+
+	// MinPort and MaxPort bound the ports, and ICMP echo identifiers,
+	// translated flows are given. Zero selects DefaultSNATMinPort and
+	// DefaultSNATMaxPort.
+	MinPort, MaxPort uint16
+}
+
+// SNAT translates the source addresses of flows forwarded into a tunnel to
+// an address of the tunnel, so that replies find their way back, as a
+// masquerading router would. It handles TCP, UDP and ICMP echo, giving each
+// flow its own port or echo identifier, and rewrites the checksums. ICMP
+// errors about translated flows, and IPv4 fragments, are not translated.
+//
+// Use it with SpliceOptions, or Wrap the tun.Device of a WireGuard device.
+type SNAT struct {
+	opts SNATOptions
+
+	mu        sync.Mutex
+	flows     map[snatFlow]*snatSession // by original flow
+	ports     map[snatPort]*snatSession // by translated port
+	nextPort  uint16
+	lastSweep time.Time
+}
+
+// SNATSession is a flow translated by an SNAT.
+type SNATSession struct {
+	Network    string         // "tcp", "udp" or "icmp"
+	Original   netip.AddrPort // source of the flow
+	Translated netip.AddrPort // source it is translated to
+	Remote     netip.AddrPort // destination of the flow; its port is zero for ICMP
+	LastActive time.Time
+}
+
+type snatFlow struct {
+	proto    tcpip.TransportProtocolNumber
+	src, dst netip.AddrPort
+}
+
+type snatPort struct {
+	proto tcpip.TransportProtocolNumber
+	is6   bool
+	port  uint16
+}
+
+type snatSession struct {
+	flow       snatFlow
+	port       uint16
+	lastActive time.Time
+}
+
+// NewSNAT returns an SNAT configured by opts.
+func NewSNAT(opts SNATOptions) *SNAT {
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultSNATIdleTimeout
+	}
+	if opts.TCPIdleTimeout == 0 {
+		opts.TCPIdleTimeout = DefaultSNATTCPIdleTimeout
+	}
+	if opts.MinPort == 0 {
+		opts.MinPort = DefaultSNATMinPort
+	}
+	if opts.MaxPort == 0 {
+		opts.MaxPort = DefaultSNATMaxPort
+	}
+	opts.MaxPort = max(opts.MaxPort, opts.MinPort)
+	return &SNAT{
+		opts:     opts,
+		flows:    make(map[snatFlow]*snatSession),
+		ports:    make(map[snatPort]*snatSession),
+		nextPort: opts.MinPort,
+	}
+}
+
+// Outbound translates the source of packet, an IP packet about to enter the
+// tunnel, in place. Packets already from the address of their family, and
+// packets of families without an address, are left alone. It returns false
+// if packet needs translating but cannot be, such as when it is not TCP, UDP
+// or ICMP echo, or when the ports are exhausted; such packets are to be
+// dropped, as replies to them could not be delivered.
+func (s *SNAT) Outbound(packet []byte) bool {
+	src, ok := packetSource(packet)
+	if !ok {
+		return true
+	}
+	addr := s.address(src.Is6())
+	if !addr.IsValid() || src == addr {
+		return true
+	}
+	p, ok := parseSNATPacket(packet)
+	if !ok || !p.request {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweepLocked(now)
+	session := s.flows[p.flow]
+	if session == nil {
+		port, ok := s.allocatePortLocked(p.flow.proto, src.Is6(), now)
+		if !ok {
+			return false
+		}
+		session = &snatSession{flow: p.flow, port: port}
+		s.flows[p.flow] = session
+		s.ports[snatPort{p.flow.proto, src.Is6(), port}] = session
+	}
+	session.lastActive = now
+	p.rewrite(true, netip.AddrPortFrom(addr, session.port))
+	return true
+}
+
+// Inbound restores the destination of packet, an IP packet that left the
+// tunnel, in place, if it is a reply to a translated flow, and reports
+// whether it was.
+func (s *SNAT) Inbound(packet []byte) bool {
+	p, ok := parseSNATPacket(packet)
+	if !ok || p.request && (p.flow.proto == header.ICMPv4ProtocolNumber || p.flow.proto == header.ICMPv6ProtocolNumber) {
+		return false
+	}
+	is6 := p.flow.dst.Addr().Is6()
+	if p.flow.dst.Addr() != s.address(is6) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	session := s.ports[snatPort{p.flow.proto, is6, p.flow.dst.Port()}]
+	if session == nil || session.flow.dst != p.flow.src || s.expired(session, now) {
+		return false
+	}
+	session.lastActive = now
+	p.rewrite(false, session.flow.src)
+	return true
+}
+
+// Sessions returns the flows currently translated, ordered by translated
+// port.
+func (s *SNAT) Sessions() []SNATSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	sessions := make([]SNATSession, 0, len(s.flows))
+	for _, session := range s.flows {
+		if s.expired(session, now) {
+			continue
+		}
+		network := "icmp"
+		switch session.flow.proto {
+		case header.TCPProtocolNumber:
+			network = "tcp"
+		case header.UDPProtocolNumber:
+			network = "udp"
+		}
+		src := session.flow.src
+		sessions = append(sessions, SNATSession{
+			Network:    network,
+			Original:   src,
+			Translated: netip.AddrPortFrom(s.address(src.Addr().Is6()), session.port),
+			Remote:     session.flow.dst,
+			LastActive: session.lastActive,
+		})
+	}
+	slices.SortFunc(sessions, func(a, b SNATSession) int {
+		return int(a.Translated.Port()) - int(b.Translated.Port())
+	})
+	return sessions
+}
+
+func (s *SNAT) address(is6 bool) netip.Addr {
+	if is6 {
+		return s.opts.Addr6
+	}
+	return s.opts.Addr4
+}
+
+func (s *SNAT) expired(session *snatSession, now time.Time) bool {
+	timeout := s.opts.IdleTimeout
+	if session.flow.proto == header.TCPProtocolNumber {
+		timeout = s.opts.TCPIdleTimeout
+	}
+	return now.Sub(session.lastActive) > timeout
+}
+
+// sweepLocked removes expired sessions, at most once per snatSweepInterval.
+func (s *SNAT) sweepLocked(now time.Time) {
+	if now.Sub(s.lastSweep) < snatSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for flow, session := range s.flows {
+		if s.expired(session, now) {
+			delete(s.flows, flow)
+			delete(s.ports, snatPort{flow.proto, flow.src.Addr().Is6(), session.port})
+		}
+	}
+}
+
+// allocatePortLocked returns the next port of the range not used by a
+// session of the protocol and family, reusing those of expired sessions not
+// swept yet.
+func (s *SNAT) allocatePortLocked(proto tcpip.TransportProtocolNumber, is6 bool, now time.Time) (uint16, bool) {
+	n := int(s.opts.MaxPort-s.opts.MinPort) + 1
+	for range n {
+		port := s.nextPort
+		if s.nextPort == s.opts.MaxPort {
+			s.nextPort = s.opts.MinPort
+		} else {
+			s.nextPort++
+		}
+		key := snatPort{proto, is6, port}
+		session := s.ports[key]
+		if session == nil {
+			return port, true
+		}
+		if s.expired(session, now) {
+			delete(s.flows, session.flow)
+			delete(s.ports, key)
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// Wrap returns a tun.Device that translates the packets read from dev with
+// Outbound, dropping those it cannot translate, and those written to it with
+// Inbound. Wrapping the tun.Device of a WireGuard device translates the
+// flows it forwards into the tunnel.
+func (s *SNAT) Wrap(dev tun.Device) tun.Device {
+	return &snatDevice{Device: dev, snat: s}
+}
+
+type snatDevice struct {
+	tun.Device
+	snat *SNAT
+}
+
+func (dev *snatDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := dev.Device.Read(bufs, sizes, offset)
+	kept := 0
+	for i := range n {
+		if !dev.snat.Outbound(bufs[i][offset : offset+sizes[i]]) {
+			continue
+		}
+		if kept != i {
+			sizes[kept] = copy(bufs[kept][offset:], bufs[i][offset:offset+sizes[i]])
+		}
+		kept++
+	}
+	return kept, err
+}
+
+func (dev *snatDevice) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		dev.snat.Inbound(buf[offset:])
+	}
+	return dev.Device.Write(bufs, offset)
+}
+
+// packetSource returns the source address of an IP packet.
+func packetSource(packet []byte) (netip.Addr, bool) {
+	switch {
+	case len(packet) >= header.IPv4MinimumSize && packet[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(packet[12:16])), true
+	case len(packet) >= header.IPv6MinimumSize && packet[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(packet[8:24])), true
+	}
+	return netip.Addr{}, false
+}
+
+// snatPacket is an IP packet an SNAT can translate.
+type snatPacket struct {
+	ip4       header.IPv4
+	ip6       header.IPv6
+	transport []byte
+	flow      snatFlow
+
+	// request is false for ICMP echo replies, whose flow has the echo
+	// identifier as destination port, and true for requests, whose flow has
+	// it as source port, and for TCP and UDP.
+	request bool
+}
+
+func parseSNATPacket(packet []byte) (p snatPacket, ok bool) {
+	var src, dst tcpip.Address
+	switch {
+	case len(packet) >= header.IPv4MinimumSize && packet[0]>>4 == 4:
+		p.ip4 = header.IPv4(packet)
+		if !p.ip4.IsValid(len(packet)) || p.ip4.More() || p.ip4.FragmentOffset() != 0 {
+			return p, false
+		}
+		p.transport = packet[p.ip4.HeaderLength():p.ip4.TotalLength()]
+		p.flow.proto = p.ip4.TransportProtocol()
+		src, dst = p.ip4.SourceAddress(), p.ip4.DestinationAddress()
+	case len(packet) >= header.IPv6MinimumSize && packet[0]>>4 == 6:
+		p.ip6 = header.IPv6(packet)
+		if !p.ip6.IsValid(len(packet)) {
+			return p, false
+		}
+		p.transport = packet[header.IPv6MinimumSize : header.IPv6MinimumSize+int(p.ip6.PayloadLength())]
+		p.flow.proto = p.ip6.TransportProtocol()
+		src, dst = p.ip6.SourceAddress(), p.ip6.DestinationAddress()
+	default:
+		return p, false
+	}
+	srcAddr, _ := netip.AddrFromSlice(src.AsSlice())
+	dstAddr, _ := netip.AddrFromSlice(dst.AsSlice())
+
+	var srcPort, dstPort uint16
+	p.request = true
+	switch p.flow.proto {
+	case header.TCPProtocolNumber:
+		if len(p.transport) < header.TCPMinimumSize {
+			return p, false
+		}
+		tcp := header.TCP(p.transport)
+		srcPort, dstPort = tcp.SourcePort(), tcp.DestinationPort()
+	case header.UDPProtocolNumber:
+		if len(p.transport) < header.UDPMinimumSize {
+			return p, false
+		}
+		udp := header.UDP(p.transport)
+		srcPort, dstPort = udp.SourcePort(), udp.DestinationPort()
+	case header.ICMPv4ProtocolNumber:
+		if p.ip4 == nil || len(p.transport) < header.ICMPv4MinimumSize {
+			return p, false
+		}
+		icmp := header.ICMPv4(p.transport)
+		switch icmp.Type() {
+		case header.ICMPv4Echo:
+			srcPort = icmp.Ident()
+		case header.ICMPv4EchoReply:
+			dstPort, p.request = icmp.Ident(), false
+		default:
+			return p, false
+		}
+	case header.ICMPv6ProtocolNumber:
+		if p.ip6 == nil || len(p.transport) < header.ICMPv6EchoMinimumSize {
+			return p, false
+		}
+		icmp := header.ICMPv6(p.transport)
+		switch icmp.Type() {
+		case header.ICMPv6EchoRequest:
+			srcPort = icmp.Ident()
+		case header.ICMPv6EchoReply:
+			dstPort, p.request = icmp.Ident(), false
+		default:
+			return p, false
+		}
+	default:
+		return p, false
+	}
+	p.flow.src = netip.AddrPortFrom(srcAddr, srcPort)
+	p.flow.dst = netip.AddrPortFrom(dstAddr, dstPort)
+	return p, true
+}
+
+// rewrite replaces the source of the packet with ap, or its destination if
+// source is false, updating the checksums. For ICMP, the port of ap is the
+// echo identifier.
+func (p *snatPacket) rewrite(source bool, ap netip.AddrPort) {
+	old := p.flow.dst
+	if source {
+		old = p.flow.src
+	}
+	oldAddr, newAddr := tcpip.AddrFromSlice(old.Addr().AsSlice()), tcpip.AddrFromSlice(ap.Addr().AsSlice())
+
+	switch p.flow.proto {
+	case header.TCPProtocolNumber:
+		tcp := header.TCP(p.transport)
+		tcp.UpdateChecksumPseudoHeaderAddress(oldAddr, newAddr, true)
+		if source {
+			tcp.SetSourcePortWithChecksumUpdate(ap.Port())
+		} else {
+			tcp.SetDestinationPortWithChecksumUpdate(ap.Port())
+		}
+	case header.UDPProtocolNumber:
+		udp := header.UDP(p.transport)
+		if udp.Checksum() == 0 && p.ip4 != nil {
+			// IPv4 UDP without a checksum.
+			if source {
+				udp.SetSourcePort(ap.Port())
+			} else {
+				udp.SetDestinationPort(ap.Port())
+			}
+			break
+		}
+		udp.UpdateChecksumPseudoHeaderAddress(oldAddr, newAddr, true)
+		if source {
+			udp.SetSourcePortWithChecksumUpdate(ap.Port())
+		} else {
+			udp.SetDestinationPortWithChecksumUpdate(ap.Port())
+		}
+		if udp.Checksum() == 0 {
+			udp.SetChecksum(0xffff)
+		}
+	case header.ICMPv4ProtocolNumber:
+		header.ICMPv4(p.transport).SetIdentWithChecksumUpdate(ap.Port())
+	case header.ICMPv6ProtocolNumber:
+		icmp := header.ICMPv6(p.transport)
+		icmp.UpdateChecksumPseudoHeaderAddress(oldAddr, newAddr)
+		icmp.SetIdentWithChecksumUpdate(ap.Port())
+	}
+
+	switch {
+	case p.ip4 != nil && source:
+		p.ip4.SetSourceAddressWithChecksumUpdate(newAddr)
+	case p.ip4 != nil:
+		p.ip4.SetDestinationAddressWithChecksumUpdate(newAddr)
+	case source:
+		p.ip6.SetSourceAddress(newAddr)
+	default:
+		p.ip6.SetDestinationAddress(newAddr)
+	}
+	if source {
+		p.flow.src = ap
+	} else {
+		p.flow.dst = ap
+	}
+}
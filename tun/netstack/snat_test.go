@@ -0,0 +1,237 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+var (
+	snatHost4   = netip.MustParseAddr("192.168.1.2")
+	snatHost6   = netip.MustParseAddr("fd00:1::2")
+	snatTunnel4 = netip.MustParseAddr("10.0.0.1")
+	snatTunnel6 = netip.MustParseAddr("fd00:2::1")
+	snatRemote4 = netip.MustParseAddr("10.0.0.2")
+	snatRemote6 = netip.MustParseAddr("fd00:2::2")
+)
+
+func TestSNATSplice(t *testing.T) {
+	devHost, host, err := CreateNetTUN([]netip.Addr{snatHost4, snatHost6}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devHost.Close()
+	devRemote, remote, err := CreateNetTUN([]netip.Addr{snatRemote4, snatRemote6}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devRemote.Close()
+	snat := NewSNAT(SNATOptions{Addr4: snatTunnel4, Addr6: snatTunnel6})
+	defer SpliceWithOptions(host, remote, SpliceOptions{SNAT: snat})()
+
+	// TCP over IPv4: the remote sees the tunnel address, and replies reach
+	// the host.
+	ln, err := remote.ListenTCPAddrPort(netip.AddrPortFrom(snatRemote4, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peers := make(chan netip.AddrPort, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		peers <- c.RemoteAddr().(*net.TCPAddr).AddrPort()
+		io.Copy(c, c)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := host.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(snatRemote4, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("masqueraded")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 32)
+	if n, err := io.ReadAtLeast(c, buf, len("masqueraded")); err != nil || string(buf[:n]) != "masqueraded" {
+		t.Fatalf("echo = %q, %v", buf[:n], err)
+	}
+	if from := <-peers; from.Addr() != snatTunnel4 || from.Port() < DefaultSNATMinPort {
+		t.Errorf("remote saw a connection from %v, want %v and a translated port", from, snatTunnel4)
+	}
+
+	// UDP over IPv6.
+	ul, err := remote.ListenUDPAddrPort(netip.AddrPortFrom(snatRemote6, 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	uc, err := host.DialUDPAddrPort(netip.AddrPortFrom(snatHost6, 5353), netip.AddrPortFrom(snatRemote6, 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	if _, err := uc.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	ul.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := ul.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := from.(*net.UDPAddr).AddrPort().Addr(); addr != snatTunnel6 {
+		t.Errorf("remote saw a datagram from %v, want %v", from, snatTunnel6)
+	}
+	if _, err := ul.WriteTo(buf[:n], from); err != nil {
+		t.Fatal(err)
+	}
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := uc.Read(buf); err != nil || string(buf[:n]) != "query" {
+		t.Fatalf("reply = %q, %v", buf[:n], err)
+	}
+
+	// ICMP echo over IPv4.
+	pc, err := host.DialPingAddr(netip.Addr{}, snatRemote4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	echo := header.ICMPv4(make([]byte, header.ICMPv4MinimumSize+4))
+	echo.SetType(header.ICMPv4Echo)
+	copy(echo.Payload(), "ping")
+	if _, err := pc.Write(echo); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := pc.Read(buf); err != nil || n < header.ICMPv4MinimumSize || header.ICMPv4(buf).Type() != header.ICMPv4EchoReply {
+		t.Fatalf("echo reply = %x, %v", buf[:n], err)
+	}
+
+	sessions := snat.Sessions()
+	if len(sessions) != 3 {
+		t.Fatalf("Sessions() = %+v, want 3 sessions", sessions)
+	}
+	networks := map[string]SNATSession{}
+	for _, s := range sessions {
+		networks[s.Network] = s
+	}
+	if s := networks["tcp"]; s.Original.Addr() != snatHost4 || s.Translated.Addr() != snatTunnel4 || s.Remote != netip.AddrPortFrom(snatRemote4, 80) {
+		t.Errorf("TCP session = %+v", s)
+	}
+	if s := networks["udp"]; s.Original != netip.AddrPortFrom(snatHost6, 5353) || s.Translated.Addr() != snatTunnel6 || s.Remote != netip.AddrPortFrom(snatRemote6, 53) {
+		t.Errorf("UDP session = %+v", s)
+	}
+	if s := networks["icmp"]; s.Original.Addr() != snatHost4 || s.Remote != netip.AddrPortFrom(snatRemote4, 0) {
+		t.Errorf("ICMP session = %+v", s)
+	}
+}
+
+// snatUDPPacket returns an IPv4 UDP packet from src to dst.
+func snatUDPPacket(src, dst netip.AddrPort) []byte {
+	const payload = "data"
+	packet := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+	ip := header.IPv4(packet)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(packet)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(src.Addr().As4()),
+		DstAddr:     tcpip.AddrFrom4(dst.Addr().As4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	udp := header.UDP(ip.Payload())
+	udp.Encode(&header.UDPFields{SrcPort: src.Port(), DstPort: dst.Port(), Length: uint16(len(udp))})
+	copy(udp.Payload(), payload)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(udp)))
+	udp.SetChecksum(^udp.CalculateChecksum(checksum.Checksum(udp.Payload(), xsum)))
+	return packet
+}
+
+func checkUDPPacket(t *testing.T, packet []byte, src, dst netip.AddrPort) {
+	t.Helper()
+	ip := header.IPv4(packet)
+	udp := header.UDP(ip.Payload())
+	got := [2]netip.AddrPort{
+		netip.AddrPortFrom(netip.AddrFrom4(ip.SourceAddress().As4()), udp.SourcePort()),
+		netip.AddrPortFrom(netip.AddrFrom4(ip.DestinationAddress().As4()), udp.DestinationPort()),
+	}
+	if got != [2]netip.AddrPort{src, dst} {
+		t.Errorf("packet from %v to %v, want from %v to %v", got[0], got[1], src, dst)
+	}
+	if !ip.IsChecksumValid() || !udp.IsChecksumValid(ip.SourceAddress(), ip.DestinationAddress(), checksum.Checksum(udp.Payload(), 0)) {
+		t.Error("invalid checksum after translation")
+	}
+}
+
+func TestSNATTranslate(t *testing.T) {
+	snat := NewSNAT(SNATOptions{Addr4: snatTunnel4, MinPort: 40000, MaxPort: 40000, IdleTimeout: 50 * time.Millisecond})
+	host := netip.AddrPortFrom(snatHost4, 1234)
+	dst := netip.AddrPortFrom(snatRemote4, 53)
+	translated := netip.AddrPortFrom(snatTunnel4, 40000)
+
+	packet := snatUDPPacket(host, dst)
+	if !snat.Outbound(packet) {
+		t.Fatal("Outbound refused a UDP packet")
+	}
+	checkUDPPacket(t, packet, translated, dst)
+
+	reply := snatUDPPacket(dst, translated)
+	if !snat.Inbound(reply) {
+		t.Fatal("Inbound did not translate a reply")
+	}
+	checkUDPPacket(t, reply, dst, host)
+
+	// Replies from elsewhere, and packets from the tunnel address, are left
+	// alone.
+	stray := snatUDPPacket(netip.AddrPortFrom(snatRemote4, 54), translated)
+	if snat.Inbound(stray) {
+		t.Error("Inbound translated a packet from another remote")
+	}
+	checkUDPPacket(t, stray, netip.AddrPortFrom(snatRemote4, 54), translated)
+	local := snatUDPPacket(netip.AddrPortFrom(snatTunnel4, 1234), dst)
+	if !snat.Outbound(local) {
+		t.Error("Outbound refused a packet from the tunnel address")
+	}
+	checkUDPPacket(t, local, netip.AddrPortFrom(snatTunnel4, 1234), dst)
+
+	// With its single port taken, a second flow cannot be translated.
+	if snat.Outbound(snatUDPPacket(netip.AddrPortFrom(snatHost4, 1235), dst)) {
+		t.Error("Outbound translated a flow with the ports exhausted")
+	}
+
+	// Once idle for longer than the timeout, the session expires, and its
+	// port is given to the next flow.
+	time.Sleep(100 * time.Millisecond)
+	if sessions := snat.Sessions(); len(sessions) != 0 {
+		t.Errorf("Sessions() = %+v after the idle timeout, want none", sessions)
+	}
+	if snat.Inbound(snatUDPPacket(dst, translated)) {
+		t.Error("Inbound translated a reply to an expired session")
+	}
+	other := netip.AddrPortFrom(snatHost4, 1235)
+	packet = snatUDPPacket(other, dst)
+	if !snat.Outbound(packet) {
+		t.Fatal("Outbound refused a flow after the session expired")
+	}
+	checkUDPPacket(t, packet, translated, dst)
+	if sessions := snat.Sessions(); len(sessions) != 1 || sessions[0].Original != other || sessions[0].Translated != translated {
+		t.Errorf("Sessions() = %+v, want the flow from %v", sessions, other)
+	}
+}
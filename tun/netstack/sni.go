@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sniHelloTimeout bounds the wait for the ClientHello of a connection
+// accepted by ServeSNIRouter.
+const sniHelloTimeout = 10 * time.Second
+
+// sniTunnelPrefix marks the upstreams ServeSNIRouter dials through the tunnel.
+const sniTunnelPrefix = "tunnel:"
+
+// ServeSNIRouter accepts TCP connections on listen, which is usually the
+// device's own tunnel address, and forwards each to the upstream route
+// returns for the server name requested by its TLS ClientHello, without
+// terminating TLS. route is passed an empty name for clients that send no
+// server name. An upstream of the form "tunnel:host:port" is dialed through
+// the tunnel, and any other "host:port" on the host network. Connections
+// that do not begin with a ClientHello, or for which route returns an error,
+// are closed. ServeSNIRouter returns once accepting fails, such as when the
+// stack is closed.
+func ServeSNIRouter(tnet *Net, listen netip.AddrPort, route func(sni string) (upstream string, err error)) error {
+	ln, err := tnet.ListenTCPAddrPort(listen)
+	if err != nil {
+		return err
+	}
+	return serveSNIRouter(tnet, newTCPListener(ln, tnet.metered), route)
+}
+
+func serveSNIRouter(tnet *Net, ln net.Listener, route func(sni string) (string, error)) error {
+	defer ln.Close()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go routeSNI(tnet, c, route)
+	}
+}
+
+func routeSNI(tnet *Net, c net.Conn, route func(sni string) (string, error)) {
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(sniHelloTimeout))
+	sni, hello, err := peekServerName(c)
+	if err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	upstream, err := route(sni)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultConnectTimeout)
+	defer cancel()
+	var u net.Conn
+	if addr, ok := strings.CutPrefix(upstream, sniTunnelPrefix); ok {
+		u, err = tnet.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		u, err = d.DialContext(ctx, "tcp", upstream)
+	}
+	if err != nil {
+		return
+	}
+	defer u.Close()
+	if _, err := u.Write(hello); err != nil {
+		return
+	}
+	spliceConns(c, u)
+}
+
+// errHelloRead stops the TLS handshake peekServerName runs once it has read
+// the ClientHello.
+var errHelloRead = errors.New("ClientHello read")
+
+// peekServerName reads the TLS ClientHello from c, which may span several
+// records and segments, and returns the server name it requests and the
+// bytes read, to be replayed to the upstream.
+func peekServerName(c net.Conn) (sni string, read []byte, err error) {
+	var buf bytes.Buffer
+	server := tls.Server(helloConn{c, io.TeeReader(c, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errHelloRead
+		},
+	})
+	if err := server.Handshake(); !errors.Is(err, errHelloRead) {
+		if err == nil {
+			err = errors.New("TLS handshake unexpectedly completed")
+		}
+		return "", nil, err
+	}
+	return sni, buf.Bytes(), nil
+}
+
+// helloConn is the connection of the handshake peekServerName runs, which
+// records what it reads and must not write to the client.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c helloConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// spliceConns copies between a and b in both directions until both are done,
+// passing on half-closes.
+func spliceConns(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// serveName accepts TLS connections on ln, answering each with name.
+func serveName(ln net.Listener, name string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.WriteString(c, name)
+		}()
+	}
+}
+
+// choppedConn writes in small pieces, so that the ClientHello spans
+// several segments.
+type choppedConn struct {
+	net.Conn
+}
+
+func (c choppedConn) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), 7)]
+		written, err := c.Conn.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[written:]
+		time.Sleep(time.Millisecond)
+	}
+	return n, nil
+}
+
+func TestSNIRouter(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	cert, _ := testCertificate(t, local)
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	hostLn, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostLn.Close()
+	go serveName(hostLn, "host")
+	tunnelLn, err := tnet.ListenTLS(netip.AddrPortFrom(local, 8443), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnelLn.Close()
+	go serveName(tunnelLn, "tunnel")
+
+	routes := map[string]string{
+		"host.example":   hostLn.Addr().String(),
+		"tunnel.example": "tunnel:" + tunnelLn.Addr().String(),
+		"":               "tunnel:" + tunnelLn.Addr().String(),
+	}
+	addr := netip.AddrPortFrom(local, 443)
+	tcpLn, err := tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newTCPListener(tcpLn, false)
+	served := make(chan error, 1)
+	go func() {
+		served <- serveSNIRouter(tnet, ln, func(sni string) (string, error) {
+			if upstream, ok := routes[sni]; ok {
+				return upstream, nil
+			}
+			return "", errors.New("no route")
+		})
+	}()
+
+	dial := func(t *testing.T, chop bool) net.Conn {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := tnet.DialContextTCPAddrPort(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if chop {
+			return choppedConn{c}
+		}
+		return c
+	}
+	for _, tt := range []struct {
+		sni  string
+		chop bool
+		want string // empty if the connection is refused
+	}{
+		{"host.example", false, "host"},
+		{"tunnel.example", false, "tunnel"},
+		{"tunnel.example", true, "tunnel"},
+		{"", false, "tunnel"},
+		{"other.example", false, ""},
+	} {
+		c := tls.Client(dial(t, tt.chop), &tls.Config{ServerName: tt.sni, InsecureSkipVerify: true})
+		err := c.Handshake()
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("server name %q routed, want refused", tt.sni)
+			}
+			c.Close()
+			continue
+		}
+		var got []byte
+		if err == nil {
+			got, err = io.ReadAll(c)
+		}
+		c.Close()
+		if err != nil || string(got) != tt.want {
+			t.Errorf("server name %q (chopped %v) routed to %q, %v; want %q", tt.sni, tt.chop, got, err, tt.want)
+		}
+	}
+
+	// Connections that are not TLS are closed.
+	c := dial(t, false)
+	io.WriteString(c, "GET / HTTP/1.0\r\n\r\n")
+	if got, _ := io.ReadAll(c); len(got) != 0 {
+		t.Errorf("plain text connection answered with %q", got)
+	}
+	c.Close()
+
+	ln.Close()
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("serveSNIRouter returned %v, want %v", err, net.ErrClosed)
+	}
+}
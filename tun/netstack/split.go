@@ -0,0 +1,200 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// A Route is the network a SplitDialer uses for a destination.
+type Route int
+
+const (
+	RouteTunnel Route = iota // through the Net
+	RouteHost                // through the host's network, bypassing the tunnel
+)
+
+func (r Route) String() string {
+	switch r {
+	case RouteTunnel:
+		return "tunnel"
+	case RouteHost:
+		return "host"
+	default:
+		return "Route(" + strconv.Itoa(int(r)) + ")"
+	}
+}
+
+// A SplitRule routes the destinations it matches. Its zero fields match
+// any destination, so a rule matches if all of its set fields do.
+type SplitRule struct {
+	// Prefix matches destination addresses within it. It only applies to
+	// addresses given as IP literals, since names are resolved by the
+	// network they are dialed through.
+	Prefix netip.Prefix
+
+	// Port matches the destination port.
+	Port uint16
+
+	// Host matches destinations given as that name, compared like the
+	// names of Net.SetHosts. A leading "*." matches the subdomains of the
+	// rest of the name instead.
+	Host string
+
+	Route Route
+}
+
+func (rule *SplitRule) matches(host string, addr netip.Addr, port uint16) bool {
+	if rule.Prefix.IsValid() && (!addr.IsValid() || !rule.Prefix.Contains(addr)) {
+		return false
+	}
+	if rule.Port != 0 && rule.Port != port {
+		return false
+	}
+	if rule.Host != "" {
+		if addr.IsValid() {
+			return false
+		}
+		want, name := canonicalHostName(rule.Host), canonicalHostName(host)
+		if suffix, ok := strings.CutPrefix(want, "*."); ok {
+			return strings.HasSuffix(name, "."+suffix)
+		}
+		return name == want
+	}
+	return true
+}
+
+type splitRules struct {
+	defaultRoute Route
+	rules        []SplitRule
+}
+
+// A SplitDialer dials and listens either through a Net or through the
+// host's network, choosing for each destination by rules, so that callers
+// can use it everywhere while some connections, such as the control channel
+// to a coordination server, bypass the tunnel.
+type SplitDialer struct {
+	tnet  *Net
+	host  *net.Dialer
+	rules atomic.Pointer[splitRules]
+}
+
+// NewSplitDialer returns a SplitDialer dialing through tnet or with host,
+// which may be nil for the zero net.Dialer, as SetRules describes.
+func NewSplitDialer(tnet *Net, host *net.Dialer, defaultRoute Route, rules []SplitRule) *SplitDialer {
+	if host == nil {
+		host = new(net.Dialer)
+	}
+	d := &SplitDialer{tnet: tnet, host: host}
+	d.SetRules(defaultRoute, rules)
+	return d
+}
+
+// SetRules replaces the rules of d. Each destination takes the route of the
+// first rule matching it, or defaultRoute if none does. Connections already
+// established keep their route.
+func (d *SplitDialer) SetRules(defaultRoute Route, rules []SplitRule) {
+	d.rules.Store(&splitRules{defaultRoute, append([]SplitRule(nil), rules...)})
+}
+
+// RouteFor returns the route of address, as given to DialContext.
+func (d *SplitDialer) RouteFor(address string) Route {
+	host, sport, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address // ping addresses have no port
+	}
+	port, _ := strconv.ParseUint(sport, 10, 16)
+	addr, err := netip.ParseAddr(host)
+	if err == nil {
+		addr = addr.Unmap()
+	}
+	rules := d.rules.Load()
+	for i := range rules.rules {
+		if rules.rules[i].matches(host, addr, uint16(port)) {
+			return rules.rules[i].Route
+		}
+	}
+	return rules.defaultRoute
+}
+
+// DialContext connects to address on network through the route of address.
+// Through the tunnel, the networks are those of Net.DialContext.
+func (d *SplitDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.RouteFor(address) == RouteHost {
+		return d.host.DialContext(ctx, network, address)
+	}
+	return d.tnet.DialContext(ctx, network, address)
+}
+
+func (d *SplitDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// Listen listens for TCP connections on the local address, through its
+// route.
+func (d *SplitDialer) Listen(network, address string) (net.Listener, error) {
+	if d.RouteFor(address) == RouteHost {
+		return net.Listen(network, address)
+	}
+	addr, err := parseListenAddr(network, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := d.tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.tnet.metered {
+		return newTCPListener(ln, true), nil
+	}
+	return ln, nil
+}
+
+// ListenPacket listens for UDP datagrams on the local address, through its
+// route.
+func (d *SplitDialer) ListenPacket(network, address string) (net.PacketConn, error) {
+	if d.RouteFor(address) == RouteHost {
+		return net.ListenPacket(network, address)
+	}
+	addr, err := parseListenAddr(network, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.tnet.ListenUDPConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseListenAddr parses address, a local address on network, which must be
+// of the protocol proto, for listening through the tunnel.
+func parseListenAddr(network, proto, address string) (netip.AddrPort, error) {
+	matches := protoSplitter.FindStringSubmatch(network)
+	if matches == nil || matches[1] != proto {
+		return netip.AddrPort{}, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	host, sport, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, &net.OpError{Op: "listen", Net: network, Err: errNumericPort}
+	}
+	var addr netip.Addr
+	if host != "" {
+		if addr, err = netip.ParseAddr(host); err != nil {
+			return netip.AddrPort{}, &net.OpError{Op: "listen", Net: network, Err: err}
+		}
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
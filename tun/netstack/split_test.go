@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplitDialerRoutes(t *testing.T) {
+	d := NewSplitDialer(nil, nil, RouteTunnel, []SplitRule{
+		{Host: "control.example.com", Route: RouteHost},
+		{Host: "*.lan", Port: 443, Route: RouteHost},
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Route: RouteHost},
+	})
+	for address, want := range map[string]Route{
+		"control.example.com:443":  RouteHost,
+		"Control.Example.COM.:80":  RouteHost,
+		"other.example.com:443":    RouteTunnel,
+		"printer.lan:443":          RouteHost,
+		"printer.lan:80":           RouteTunnel,
+		"lan:443":                  RouteTunnel,
+		"198.51.100.7:22":          RouteHost,
+		"[::ffff:198.51.100.7]:22": RouteHost,
+		"198.51.101.7:22":          RouteTunnel,
+		"198.51.100.7":             RouteHost,
+	} {
+		if got := d.RouteFor(address); got != want {
+			t.Errorf("route for %s: %v, want %v", address, got, want)
+		}
+	}
+
+	d.SetRules(RouteHost, []SplitRule{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Route: RouteTunnel}})
+	if got := d.RouteFor("control.example.com:443"); got != RouteHost {
+		t.Errorf("route by default after replacing the rules: %v, want %v", got, RouteHost)
+	}
+	if got := d.RouteFor("10.1.2.3:443"); got != RouteTunnel {
+		t.Errorf("route by rule after replacing the rules: %v, want %v", got, RouteTunnel)
+	}
+}
+
+func TestSplitDialerControlChannel(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	var tunneled atomic.Int32
+	defer tnet.CaptureOutbound(func([]byte) { tunneled.Add(1) })()
+
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	go func() {
+		for {
+			c, err := control.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("control"))
+			c.Close()
+		}
+	}()
+	controlAddr := control.Addr().String()
+
+	d := NewSplitDialer(tnet, nil, RouteTunnel, []SplitRule{{Prefix: netip.MustParsePrefix("127.0.0.1/32"), Route: RouteHost}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialControl := func() {
+		t.Helper()
+		c, err := d.DialContext(ctx, "tcp", controlAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, ok := c.(*TCPConn); ok {
+			t.Fatal("control channel dialed through the tunnel")
+		}
+		b := make([]byte, 16)
+		n, _ := c.Read(b)
+		if string(b[:n]) != "control" {
+			t.Errorf("read %q from the control channel", b[:n])
+		}
+	}
+	dialControl()
+	if n := tunneled.Load(); n != 0 {
+		t.Errorf("%d packets sent through the tunnel for the control channel", n)
+	}
+
+	// Other destinations go through the tunnel, where the stack serves its
+	// own address.
+	ln, err := d.Listen("tcp", netip.AddrPortFrom(local, 80).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := d.DialContext(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, ok := c.(*TCPConn); !ok {
+		t.Errorf("%T dialed for a tunnel destination", c)
+	}
+	pc, err := d.ListenPacket("udp", netip.AddrPortFrom(local, 53).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+	if _, ok := pc.(*UDPConn); !ok {
+		t.Errorf("%T listening for a tunnel address", pc)
+	}
+
+	// Under a default via the host, with rules replaced meanwhile, the
+	// control channel still never reaches the Net.
+	d.SetRules(RouteHost, []SplitRule{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Route: RouteTunnel}})
+	before := tunneled.Load()
+	dialControl()
+	if n := tunneled.Load() - before; n != 0 {
+		t.Errorf("%d packets sent through the tunnel for the control channel", n)
+	}
+}
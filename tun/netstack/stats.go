@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+// Stats is a snapshot of counters maintained by a Net.
+type Stats struct {
+	// FragmentsReceived counts IPv4 fragments that arrived through the
+	// tunnel. The stack reassembles them within limits gvisor hard-codes
+	// and does not count against: an incomplete datagram is discarded after
+	// ipv4.ReassembleTimeout, and the oldest ones once 4 MiB are held.
+	FragmentsReceived uint64
+	// FragmentsDropped counts fragments the stack dropped as malformed,
+	// such as overlapping ones or those beyond the largest datagram.
+	FragmentsDropped uint64
+
+	// SYNOverflows counts TCP SYNs dropped with TCPListenOptions.MaxHalfOpen
+	// handshakes in progress.
+	SYNOverflows uint64
+	// SYNCookiesSent counts SYNs answered with a SYN cookie.
+	SYNCookiesSent uint64
+
+	// PacketsHeld counts outbound packets held by Options.WarmUp, and
+	// PacketsHeldTimedOut those of them sent after WarmUpOptions.Hold
+	// without their destination becoming ready.
+	PacketsHeld         uint64
+	PacketsHeldTimedOut uint64
+
+	// ICMPErrorsSent counts destination-unreachable and time-exceeded
+	// messages sent into the tunnel, as configured by Options.ICMP.
+	ICMPErrorsSent uint64
+}
+
+// Stats returns a snapshot of the Net's counters.
+func (net *Net) Stats() Stats {
+	return Stats{
+		FragmentsReceived:   net.fragments.Load(),
+		FragmentsDropped:    net.stack.Stats().IP.MalformedFragmentsReceived.Value(),
+		SYNOverflows:        net.halfOpen.overflows.Load(),
+		SYNCookiesSent:      net.stack.Stats().TCP.ListenOverflowSynCookieSent.Value(),
+		PacketsHeld:         net.warmUp.held.Load(),
+		PacketsHeldTimedOut: net.warmUp.timedOut.Load(),
+		ICMPErrorsSent:      net.icmpErrors.sent.Load(),
+	}
+}
@@ -0,0 +1,36 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// TCPConn is a TCP connection on a Net. It is a gonet.TCPConn whose reads
+// and writes fail with errors matching os.ErrDeadlineExceeded once their
+// deadline passes, as the net.Conn contract requires.
+type TCPConn struct {
+	*gonet.TCPConn
+	counts *byteCounts // nil unless the Net is metered
+}
+
+func (c *TCPConn) Read(b []byte) (int, error) {
+	n, err := c.TCPConn.Read(b)
+	c.counts.read(n)
+	return n, deadlineError(err)
+}
+
+func (c *TCPConn) Write(b []byte) (int, error) {
+	n, err := c.TCPConn.Write(b)
+	c.counts.written(n)
+	return n, deadlineError(err)
+}
+
+// Stats returns the number of bytes read from and written to c, which are
+// only counted if Options.Metered is set.
+func (c *TCPConn) Stats() (rx, tx uint64) {
+	return c.counts.stats()
+}
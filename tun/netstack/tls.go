@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// ListenTLS listens for TLS connections on addr, which is usually the
+// device's own tunnel address, so that only peers can connect.
+//
+// Unless cfg sets NextProtos, it offers HTTP/2 and HTTP/1.1 through ALPN, so
+// that net/http servers given the listener speak HTTP/2. Closing the listener
+// unblocks pending calls to Accept, which then fail with net.ErrClosed, so
+// that http.Server.Shutdown returns. The RemoteAddr of accepted connections
+// is the peer's tunnel address, and remains available after the connection
+// is closed or reset.
+//
+// To mint or obtain the certificates of the listener, selecting them by the
+// server name clients request, pass the TLSConfig of a TLSManager. cfg must
+// not be nil.
+func (net *Net) ListenTLS(addr netip.AddrPort, cfg *tls.Config) (net.Listener, error) {
+	if cfg == nil {
+		return nil, errors.New("netstack: nil TLS config")
+	}
+	ln, err := net.ListenTCPAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg = cfg.Clone()
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return tls.NewListener(newTCPListener(ln, net.metered), cfg), nil
+}
+
+// tcpListener is a gonet.TCPListener whose Close also cancels pending
+// Accept calls, which closing the endpoint alone does not.
+type tcpListener struct {
+	*gonet.TCPListener
+	addr      net.Addr
+	closeOnce sync.Once
+	closed    chan struct{}
+	metered   bool // whether accepted conns are wrapped in a MeteredConn
+}
+
+func newTCPListener(ln *gonet.TCPListener, metered bool) *tcpListener {
+	return &tcpListener{TCPListener: ln, addr: ln.Addr(), closed: make(chan struct{}), metered: metered}
+}
+
+func (l *tcpListener) Accept() (net.Conn, error) {
+	c, err := l.TCPListener.Accept()
+	if err != nil {
+		select {
+		case <-l.closed:
+			return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: net.ErrClosed}
+		default:
+			return nil, err
+		}
+	}
+	c = &tcpConn{TCPConn: &TCPConn{TCPConn: c.(*gonet.TCPConn)}, remote: c.RemoteAddr()}
+	if l.metered {
+		c = NewMeteredConn(c)
+	}
+	return c, nil
+}
+
+func (l *tcpListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.TCPListener.Shutdown()
+		l.TCPListener.Close()
+	})
+	return nil
+}
+
+func (l *tcpListener) Addr() net.Addr {
+	return l.addr
+}
+
+// tcpConn is a TCPConn that remembers its remote address, which the
+// endpoint forgets once the connection is reset.
+type tcpConn struct {
+	*TCPConn
+	remote net.Addr
+}
+
+func (c *tcpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,643 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// ErrKeyNotFound is returned by KeyStore.Get for names it does not hold.
+var ErrKeyNotFound = errors.New("netstack: key not found")
+
+// A KeyStore keeps the certificates and private keys of a TLSManager, such
+// as in files or a secrets service, so that they survive restarts. Data is
+// PEM encoded. Get returns ErrKeyNotFound for names never put, or deleted.
+type KeyStore interface {
+	Get(ctx context.Context, name string) ([]byte, error)
+	Put(ctx context.Context, name string, data []byte) error
+	Delete(ctx context.Context, name string) error
+}
+
+// DefaultLeafValidity is how long the certificates minted by a TLSManager
+// are valid. They are minted again once less than a third of it is left.
+const DefaultLeafValidity = 30 * 24 * time.Hour
+
+// TLSManagerOptions configures NewTLSManager.
+type TLSManagerOptions struct {
+	// Store keeps the certificate authority and the certificates. Nil
+	// keeps them in memory, so that a new authority is generated each time,
+	// which clients must then trust anew.
+	Store KeyStore
+
+	// Hosts are the DNS names and IP addresses certificates are minted for
+	// when clients ask for them as their server name. Clients that send no
+	// server name get a certificate for the address they connected to.
+	Hosts []string
+
+	// CAName is the common name of the authority generated if Store holds
+	// none. Empty selects "WireGuard netstack CA".
+	CAName string
+
+	// LeafValidity is how long minted certificates are valid. Zero selects
+	// DefaultLeafValidity.
+	LeafValidity time.Duration
+
+	// ACME, if set, obtains the certificates of its hosts from an ACME
+	// certificate authority instead of minting them.
+	ACME *ACMEOptions
+}
+
+// A DNSProvider publishes the TXT records that answer the DNS-01 challenges
+// of an ACME authority, in the zones of the names certificates are obtained
+// for. Names are fully qualified, without a trailing dot, such as
+// "_acme-challenge.svc.example.com".
+type DNSProvider interface {
+	// SetTXT adds value to the TXT records of name.
+	SetTXT(ctx context.Context, name, value string) error
+	// DeleteTXT removes value from the TXT records of name.
+	DeleteTXT(ctx context.Context, name, value string) error
+}
+
+// ACMEOptions configures the ACME client of a TLSManager. The client talks
+// to the authority through the tunnel, and answers its DNS-01 challenges
+// through DNS, so that neither the listeners nor the host network need be
+// reachable from the authority.
+type ACMEOptions struct {
+	// DirectoryURL is the directory of the authority. Empty selects Let's
+	// Encrypt.
+	DirectoryURL string
+
+	// DNS publishes the records of the challenges. It must be set.
+	DNS DNSProvider
+
+	// RootCAs, if set, are trusted for connections to the authority,
+	// instead of the roots of the host.
+	RootCAs *x509.CertPool
+
+	// Hosts are the DNS names to obtain certificates for.
+	Hosts []string
+
+	// Email is the contact address of the account, if any.
+	Email string
+
+	// AcceptTOS must be set to agree to the terms of service of the
+	// authority, without which it issues nothing.
+	AcceptTOS bool
+}
+
+// Names of the TLSManager material in its KeyStore.
+const (
+	tlsStoreCA      = "ca"
+	tlsStoreLeaf    = "leaf/"
+	tlsStoreACME    = "acme/" // followed by "account", or "cert/" and the host
+	defaultCAName   = "WireGuard netstack CA"
+	caValidity      = 10 * 365 * 24 * time.Hour
+	tlsStoreTimeout = 10 * time.Second
+	acmeTimeout     = 5 * time.Minute  // to obtain a certificate
+	acmeRenewRetry  = 10 * time.Minute // between renewals failing in the background
+)
+
+// A TLSManager serves certificates for the tunnel addresses and names of a
+// Net, minted by a certificate authority of its own or obtained through
+// ACME, selecting them by the server name each client requests. Give the
+// configuration of TLSConfig to ListenTLS, and have clients trust
+// CACertificate.
+type TLSManager struct {
+	store    KeyStore
+	hosts    map[string]bool
+	validity time.Duration
+	ca       *x509.Certificate
+	caKey    crypto.Signer
+	acme     *acmeIssuer // nil without ACME
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// NewTLSManager returns a manager for tnet, loading its authority from
+// opts.Store, or generating one and putting it there.
+func NewTLSManager(tnet *Net, opts TLSManagerOptions) (*TLSManager, error) {
+	m := &TLSManager{
+		store:    opts.Store,
+		hosts:    make(map[string]bool),
+		validity: opts.LeafValidity,
+		leaves:   make(map[string]*tls.Certificate),
+	}
+	if m.store == nil {
+		m.store = new(memoryKeyStore)
+	}
+	if m.validity <= 0 {
+		m.validity = DefaultLeafValidity
+	}
+	for _, host := range opts.Hosts {
+		m.hosts[normalizeHost(host)] = true
+	}
+	if opts.CAName == "" {
+		opts.CAName = defaultCAName
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsStoreTimeout)
+	defer cancel()
+	if err := m.loadCA(ctx, opts.CAName); err != nil {
+		return nil, err
+	}
+
+	if a := opts.ACME; a != nil {
+		if !a.AcceptTOS {
+			return nil, errors.New("netstack: ACME requires accepting the terms of service of the authority")
+		}
+		if a.DNS == nil {
+			return nil, errors.New("netstack: ACME requires a DNS provider")
+		}
+		key, err := m.loadACMEKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		m.acme = &acmeIssuer{
+			client: &acme.Client{
+				Key:          key,
+				DirectoryURL: a.DirectoryURL,
+				HTTPClient: &http.Client{Transport: &http.Transport{
+					DialContext:       tnet.DialContext,
+					TLSClientConfig:   &tls.Config{RootCAs: a.RootCAs},
+					ForceAttemptHTTP2: true,
+				}},
+			},
+			dns:    a.DNS,
+			hosts:  make(map[string]bool),
+			email:  a.Email,
+			store:  m.store,
+			certs:  make(map[string]*tls.Certificate),
+			orders: make(map[string]*acmeOrder),
+			failed: make(map[string]time.Time),
+		}
+		if a.DirectoryURL == "" {
+			m.acme.client.DirectoryURL = acme.LetsEncryptURL
+		}
+		for _, host := range a.Hosts {
+			m.acme.hosts[normalizeHost(host)] = true
+		}
+	}
+	return m, nil
+}
+
+// CACertificate returns the certificate of the authority that mints the
+// certificates of the manager, for clients to trust.
+func (m *TLSManager) CACertificate() *x509.Certificate {
+	return m.ca
+}
+
+// TLSConfig returns a server configuration whose certificates are selected
+// by GetCertificate, offering HTTP/2 and HTTP/1.1 through ALPN, for
+// ListenTLS.
+func (m *TLSManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// GetCertificate returns the certificate for the server name of hello, or
+// for the address the client connected to if it sent none, minting it if
+// needed. It fails for names that are not among the hosts of the manager.
+func (m *TLSManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ctx := hello.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	name := normalizeHost(hello.ServerName)
+	if m.acme != nil && m.acme.hosts[name] {
+		return m.acme.certificate(ctx, name)
+	}
+	if name == "" {
+		if hello.Conn == nil {
+			return nil, errors.New("netstack: no server name")
+		}
+		ap, err := netip.ParseAddrPort(hello.Conn.LocalAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		name = ap.Addr().Unmap().String()
+	} else if !m.hosts[name] {
+		return nil, fmt.Errorf("netstack: no certificate for %q", name)
+	}
+	return m.leaf(ctx, name)
+}
+
+// leaf returns the certificate for name, from memory, from the store, or
+// minted, whichever is first valid for long enough.
+func (m *TLSManager) leaf(ctx context.Context, name string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert := m.leaves[name]; cert != nil && m.fresh(cert.Leaf) {
+		return cert, nil
+	}
+	if data, err := m.store.Get(ctx, tlsStoreLeaf+name); err == nil {
+		if cert, err := parseKeyPair(data); err == nil && m.fresh(cert.Leaf) {
+			m.leaves[name] = cert
+			return cert, nil
+		}
+	} else if !errors.Is(err, ErrKeyNotFound) {
+		return nil, err
+	}
+	cert, data, err := m.mint(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.store.Put(ctx, tlsStoreLeaf+name, data); err != nil {
+		return nil, err
+	}
+	m.leaves[name] = cert
+	return cert, nil
+}
+
+// fresh reports whether cert was issued by the current authority and has
+// more than a third of the validity of minted certificates left.
+func (m *TLSManager) fresh(cert *x509.Certificate) bool {
+	return cert.CheckSignatureFrom(m.ca) == nil && time.Until(cert.NotAfter) > m.validity/3
+}
+
+func (m *TLSManager) mint(name string) (*tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(m.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip, err := netip.ParseAddr(name); err == nil {
+		template.IPAddresses = []net.IP{ip.AsSlice()}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca, &key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := encodeKeyPair(key, der, m.ca.Raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := parseKeyPair(data)
+	return cert, data, err
+}
+
+func (m *TLSManager) loadCA(ctx context.Context, name string) error {
+	data, err := m.store.Get(ctx, tlsStoreCA)
+	if err == nil {
+		cert, err := parseKeyPair(data)
+		if err != nil {
+			return fmt.Errorf("netstack: invalid certificate authority in store: %w", err)
+		}
+		m.ca, m.caKey = cert.Leaf, cert.PrivateKey.(crypto.Signer)
+		return nil
+	}
+	if !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if data, err = encodeKeyPair(key, der); err != nil {
+		return err
+	}
+	if err := m.store.Put(ctx, tlsStoreCA, data); err != nil {
+		return err
+	}
+	if m.ca, err = x509.ParseCertificate(der); err != nil {
+		return err
+	}
+	m.caKey = key
+	return nil
+}
+
+// loadACMEKey returns the key of the ACME account from the store, or
+// generates one and puts it there.
+func (m *TLSManager) loadACMEKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.store.Get(ctx, tlsStoreACME+"account")
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("netstack: invalid ACME account key in store")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("netstack: invalid ACME account key in store: %w", err)
+		}
+		return key.(crypto.Signer), nil
+	}
+	if !errors.Is(err, ErrKeyNotFound) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = encodeKeyPair(key); err != nil {
+		return nil, err
+	}
+	if err := m.store.Put(ctx, tlsStoreACME+"account", data); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
+
+// encodeKeyPair encodes key and the chain of certificates as PEM blocks.
+func encodeKeyPair(key *ecdsa.PrivateKey, chain ...[]byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, cert := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	}
+	pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return buf.Bytes(), nil
+}
+
+func parseKeyPair(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// normalizeHost returns host in the form certificates are keyed by.
+func normalizeHost(host string) string {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().String()
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// memoryKeyStore is the KeyStore of managers not given one.
+type memoryKeyStore struct {
+	m sync.Map // string to []byte
+}
+
+func (s *memoryKeyStore) Get(ctx context.Context, name string) ([]byte, error) {
+	if data, ok := s.m.Load(name); ok {
+		return data.([]byte), nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (s *memoryKeyStore) Put(ctx context.Context, name string, data []byte) error {
+	s.m.Store(name, bytes.Clone(data))
+	return nil
+}
+
+func (s *memoryKeyStore) Delete(ctx context.Context, name string) error {
+	s.m.Delete(name)
+	return nil
+}
+
+// acmeIssuer obtains the certificates of its hosts from an ACME authority,
+// answering its DNS-01 challenges through a DNSProvider.
+type acmeIssuer struct {
+	client *acme.Client
+	dns    DNSProvider
+	hosts  map[string]bool
+	email  string
+	store  KeyStore
+
+	registerMu sync.Mutex
+	registered bool
+
+	mu     sync.Mutex
+	certs  map[string]*tls.Certificate
+	orders map[string]*acmeOrder // in flight, by name
+	failed map[string]time.Time  // when the last order failed, by name
+}
+
+// An acmeOrder obtains a certificate for a name in the background.
+type acmeOrder struct {
+	done chan struct{}
+	cert *tls.Certificate // once done, nil if err is set
+	err  error
+}
+
+// certificate returns the certificate for name, from memory or from the
+// store. One in the last third of its validity is still returned while it is
+// renewed in the background, so that renewing it neither holds up handshakes
+// nor fails them while it is valid. Only if there is no valid certificate
+// does it wait for one to be obtained, or for ctx to be done.
+func (a *acmeIssuer) certificate(ctx context.Context, name string) (*tls.Certificate, error) {
+	a.mu.Lock()
+	cert := a.certs[name]
+	if cert == nil {
+		if data, err := a.store.Get(ctx, tlsStoreACME+"cert/"+name); err == nil {
+			if cert, err = parseKeyPair(data); err == nil {
+				a.certs[name] = cert
+			}
+		} else if !errors.Is(err, ErrKeyNotFound) {
+			a.mu.Unlock()
+			return nil, err
+		}
+	}
+	if cert != nil && time.Now().Before(cert.Leaf.NotAfter) {
+		if !acmeFresh(cert.Leaf) && time.Since(a.failed[name]) > acmeRenewRetry {
+			a.orderLocked(name)
+		}
+		a.mu.Unlock()
+		return cert, nil
+	}
+	order := a.orderLocked(name)
+	a.mu.Unlock()
+	select {
+	case <-order.done:
+		return order.cert, order.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acmeFresh reports whether cert has more than a third of its validity
+// left, as authorities recommend renewing within the last third.
+func acmeFresh(cert *x509.Certificate) bool {
+	return time.Until(cert.NotAfter) > cert.NotAfter.Sub(cert.NotBefore)/3
+}
+
+// orderLocked returns the order in flight for name, starting one if there is
+// none. a.mu must be held.
+func (a *acmeIssuer) orderLocked(name string) *acmeOrder {
+	if order := a.orders[name]; order != nil {
+		return order
+	}
+	order := &acmeOrder{done: make(chan struct{})}
+	a.orders[name] = order
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+		defer cancel()
+		cert, data, err := a.obtain(ctx, name)
+		if err == nil {
+			err = a.store.Put(ctx, tlsStoreACME+"cert/"+name, data)
+		}
+		a.mu.Lock()
+		if err != nil {
+			order.err = fmt.Errorf("netstack: obtaining a certificate for %q: %w", name, err)
+			a.failed[name] = time.Now()
+		} else {
+			order.cert = cert
+			a.certs[name] = cert
+			delete(a.failed, name)
+		}
+		delete(a.orders, name)
+		a.mu.Unlock()
+		close(order.done)
+	}()
+	return order
+}
+
+// register registers the account with the authority, unless done already.
+func (a *acmeIssuer) register(ctx context.Context) error {
+	a.registerMu.Lock()
+	defer a.registerMu.Unlock()
+	if a.registered {
+		return nil
+	}
+	account := new(acme.Account)
+	if a.email != "" {
+		account.Contact = []string{"mailto:" + a.email}
+	}
+	if _, err := a.client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+	a.registered = true
+	return nil
+}
+
+// obtain orders a certificate for name, registering the account first if
+// needed.
+func (a *acmeIssuer) obtain(ctx context.Context, name string) (*tls.Certificate, []byte, error) {
+	if err := a.register(ctx); err != nil {
+		return nil, nil, err
+	}
+	order, err := a.client.AuthorizeOrder(ctx, acme.DomainIDs(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, url := range order.AuthzURLs {
+		if err := a.authorize(ctx, url); err != nil {
+			return nil, nil, err
+		}
+	}
+	if order, err = a.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, _, err := a.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := encodeKeyPair(key, chain...)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := parseKeyPair(data)
+	return cert, data, err
+}
+
+// authorize answers the DNS-01 challenge of the authorization at url, unless
+// it is valid already, and waits for the authority to validate it. The TXT
+// record is deleted again once it has.
+func (a *acmeIssuer) authorize(ctx context.Context, url string) error {
+	authz, err := a.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %q", authz.Identifier.Value)
+	}
+	record, err := a.client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+	name := "_acme-challenge." + authz.Identifier.Value
+	if err := a.dns.SetTXT(ctx, name, record); err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tlsStoreTimeout)
+		defer cancel()
+		a.dns.DeleteTXT(ctx, name, record)
+	}()
+	if _, err := a.client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = a.client.WaitAuthorization(ctx, url)
+	return err
+}
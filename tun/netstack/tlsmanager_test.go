@@ -0,0 +1,402 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTLSManager(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	store := new(memoryKeyStore)
+	opts := TLSManagerOptions{Store: store, Hosts: []string{"Svc.WG.Internal."}}
+	m, err := NewTLSManager(tnet, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.AddrPortFrom(local, 443)
+	ln, err := tnet.ListenTLS(addr, m.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(m.CACertificate())
+	handshake := func(serverName string) (*x509.Certificate, error) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := tnet.DialContextTCPAddrPort(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		tc := tls.Client(c, &tls.Config{RootCAs: pool, ServerName: serverName})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		return tc.ConnectionState().PeerCertificates[0], nil
+	}
+
+	// A name among the hosts, and the address without a server name.
+	named, err := handshake("svc.wg.internal")
+	if err != nil {
+		t.Fatalf("handshake for a host: %v", err)
+	}
+	if _, err := handshake(local.String()); err != nil {
+		t.Fatalf("handshake for the tunnel address: %v", err)
+	}
+	if _, err := handshake("other.wg.internal"); err == nil {
+		t.Error("handshake for a name that is not a host succeeded")
+	}
+
+	// Another manager with the store reuses its authority and certificates.
+	m2, err := NewTLSManager(tnet, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m2.CACertificate().Equal(m.CACertificate()) {
+		t.Error("authority generated anew despite the store")
+	}
+	cert, err := m2.GetCertificate(&tls.ClientHelloInfo{ServerName: "svc.wg.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Leaf.Equal(named) {
+		t.Error("certificate minted anew despite the store")
+	}
+
+	// Certificates are minted again once less than a third of the validity
+	// is left, here as soon as it is tripled.
+	opts.LeafValidity = 3 * DefaultLeafValidity
+	m3, err := NewTLSManager(tnet, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = m3.GetCertificate(&tls.ClientHelloInfo{ServerName: "svc.wg.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.Equal(named) {
+		t.Error("certificate due for renewal served again")
+	}
+
+	if _, err := NewTLSManager(tnet, TLSManagerOptions{ACME: &ACMEOptions{Hosts: []string{"svc.example.com"}}}); err == nil {
+		t.Error("ACME enabled without accepting the terms of service")
+	}
+}
+
+// testDNS is a DNSProvider keeping its records in memory.
+type testDNS struct {
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func (d *testDNS) SetTXT(ctx context.Context, name, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.records[name] = value
+	return nil
+}
+
+func (d *testDNS) DeleteTXT(ctx context.Context, name, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.records, name)
+	return nil
+}
+
+func (d *testDNS) lookup(name string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.records[name]
+}
+
+// testAuthority is an ACME authority for one order at a time, issuing
+// certificates from the authority of a TLSManager once the DNS-01 challenge
+// is answered, as validate reports. It does not check signatures.
+type testAuthority struct {
+	base     string
+	issuer   *TLSManager
+	validate func(name, token string) bool
+
+	mu     sync.Mutex
+	age    time.Duration // of the certificates when issued
+	fail   bool          // refuses orders
+	orders int
+	name   string
+	status string // of the authorization
+	cert   []byte
+}
+
+func (a *testAuthority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", base64.RawURLEncoding.EncodeToString([]byte(time.Now().String())))
+	var payload []byte
+	if r.Method == http.MethodPost {
+		var jws struct{ Payload string }
+		if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	order := func() map[string]any {
+		o := map[string]any{
+			"status":         "pending",
+			"identifiers":    []map[string]string{{"type": "dns", "value": a.name}},
+			"authorizations": []string{a.base + "/authz"},
+			"finalize":       a.base + "/finalize",
+		}
+		if a.cert != nil {
+			o["status"], o["certificate"] = "valid", a.base+"/cert"
+		} else if a.status != "pending" {
+			o["status"] = map[string]string{"valid": "ready", "invalid": "invalid"}[a.status]
+		}
+		return o
+	}
+	challenge := func() map[string]any {
+		return map[string]any{"type": "dns-01", "url": a.base + "/challenge", "token": "token", "status": a.status}
+	}
+	var reply any
+	switch r.URL.Path {
+	case "/directory":
+		reply = map[string]any{
+			"newNonce":   a.base + "/nonce",
+			"newAccount": a.base + "/account",
+			"newOrder":   a.base + "/order",
+			"meta":       map[string]string{"termsOfService": a.base + "/terms"},
+		}
+	case "/nonce":
+		return
+	case "/account":
+		w.Header().Set("Location", a.base+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		reply = map[string]string{"status": "valid"}
+	case "/order":
+		var req struct{ Identifiers []struct{ Value string } }
+		json.Unmarshal(payload, &req)
+		a.orders++
+		if a.fail {
+			http.Error(w, "orders refused", http.StatusForbidden)
+			return
+		}
+		a.name, a.status, a.cert = req.Identifiers[0].Value, "pending", nil
+		w.Header().Set("Location", a.base+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		reply = order()
+	case "/order/1":
+		w.Header().Set("Location", a.base+"/order/1")
+		reply = order()
+	case "/authz":
+		reply = map[string]any{
+			"identifier": map[string]string{"type": "dns", "value": a.name},
+			"status":     a.status,
+			"challenges": []map[string]any{challenge()},
+		}
+	case "/challenge":
+		a.status = "invalid"
+		if a.validate(a.name, "token") {
+			a.status = "valid"
+		}
+		reply = challenge()
+	case "/finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || a.status != "valid" {
+			http.Error(w, "bad finalization", http.StatusForbidden)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: randomSerial(),
+			NotBefore:    time.Now().Add(-time.Hour - a.age),
+			NotAfter:     time.Now().Add(90*24*time.Hour - a.age),
+			DNSNames:     csr.DNSNames,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if a.cert, err = x509.CreateCertificate(rand.Reader, template, a.issuer.ca, csr.PublicKey, a.issuer.caKey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", a.base+"/order/1")
+		reply = order()
+	case "/cert":
+		var chain bytes.Buffer
+		pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: a.cert})
+		pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: a.issuer.ca.Raw})
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(chain.Bytes())
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+func TestTLSManagerACME(t *testing.T) {
+	local := netip.MustParseAddr("192.168.4.29")
+	dev, tnet, err := CreateNetTUN([]netip.Addr{local}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	// The authority is reached through the tunnel, and validates challenges
+	// by looking the records up in dns, not by connecting to the manager.
+	issuer, err := NewTLSManager(tnet, TLSManagerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := &testDNS{records: make(map[string]string)}
+	var m *TLSManager
+	authority := &testAuthority{base: "http://" + local.String(), issuer: issuer}
+	authority.validate = func(name, token string) bool {
+		record, err := m.acme.client.DNS01ChallengeRecord(token)
+		return err == nil && dns.lookup("_acme-challenge."+name) == record
+	}
+	ln, err := tnet.ListenTCPAddrPort(netip.AddrPortFrom(local, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: authority}
+	defer srv.Close()
+	go srv.Serve(ln)
+
+	store := new(memoryKeyStore)
+	opts := TLSManagerOptions{Store: store, ACME: &ACMEOptions{
+		DirectoryURL: authority.base + "/directory",
+		DNS:          dns,
+		Hosts:        []string{"svc.example.com"},
+		AcceptTOS:    true,
+	}}
+	if m, err = NewTLSManager(tnet, opts); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "Svc.Example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.CheckSignatureFrom(issuer.CACertificate()); err != nil || cert.Leaf.VerifyHostname("svc.example.com") != nil {
+		t.Errorf("certificate for %v not issued by the authority: %v", cert.Leaf.DNSNames, err)
+	}
+	if record := dns.lookup("_acme-challenge.svc.example.com"); record != "" {
+		t.Errorf("challenge record %q left behind", record)
+	}
+
+	// Another manager with the store reuses the account and certificate.
+	if m, err = NewTLSManager(tnet, opts); err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "svc.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := authority.orders; !again.Leaf.Equal(cert.Leaf) || n != 1 {
+		t.Errorf("certificate obtained anew despite the store, in %d orders", n)
+	}
+
+	// A certificate due for renewal is served while it is renewed in the
+	// background, and still served, without retrying at once, once renewing
+	// it fails.
+	authority.mu.Lock()
+	authority.age = 80 * 24 * time.Hour
+	authority.mu.Unlock()
+	opts.Store = new(memoryKeyStore)
+	if m, err = NewTLSManager(tnet, opts); err != nil {
+		t.Fatal(err)
+	}
+	due, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "svc.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := func() int {
+		authority.mu.Lock()
+		defer authority.mu.Unlock()
+		return authority.orders
+	}
+	renewing := func() bool {
+		m.acme.mu.Lock()
+		defer m.acme.mu.Unlock()
+		return len(m.acme.orders) != 0
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "svc.example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cert.Leaf.Equal(due.Leaf) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificate due for renewal not renewed")
+		}
+	}
+	for renewing() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	authority.mu.Lock()
+	authority.fail = true
+	authority.mu.Unlock()
+	m.acme.mu.Lock()
+	due = m.acme.certs["svc.example.com"]
+	m.acme.mu.Unlock()
+	before := orders()
+	for i := 0; i < 2; i++ {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "svc.example.com"})
+		if err != nil {
+			t.Fatalf("valid certificate not served while renewing it fails: %v", err)
+		}
+		if !cert.Leaf.Equal(due.Leaf) {
+			t.Error("certificate replaced while renewing it fails")
+		}
+		for renewing() {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if n := orders() - before; n != 1 {
+		t.Errorf("%d orders to renew a certificate, want 1 until the retry delay", n)
+	}
+
+	opts.ACME.DNS = nil
+	if _, err := NewTLSManager(tnet, opts); err == nil {
+		t.Error("ACME enabled without a DNS provider")
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -43,33 +45,128 @@ type netTun struct {
 	ep             *channel.Endpoint
 	stack          *stack.Stack
 	events         chan tun.Event
+	eventsMu       sync.Mutex // protects sends on events and closed
+	closed         bool
 	incomingPacket chan *buffer.View
-	mtu            int
-	dnsServers     []netip.Addr
+	pending        *buffer.View  // dequeued by a Read that could not hand it over, for the next
+	done           chan struct{} // closed by Close, instead of incomingPacket, which the stack may be sending on
+	dnsUpstreams   []dnsUpstream
+	dnsBootstrap   []dnsUpstream // to resolve the names of dnsUpstreams
 	hasV4, hasV6   bool
+	fragments      atomic.Uint64 // IPv4 fragments written, for the stack to reassemble
+	hosts          atomic.Pointer[hostsTable]
+	hostsOnly      bool
+	connectTimeout time.Duration
+	noPortReuse    atomic.Bool
+	ndProxy        []netip.Prefix
+	listenBacklog  atomic.Int64
+	halfOpen       halfOpenTracker
+	captures       outboundCaptures
+	metered        bool
+	warmUp         warmUp
+	dialTrace      dialTracer
+	icmpErrors     icmpErrors
 }
 
 type Net netTun
 
+// batchSize is the number of packets handed to the device per Read, and
+// incomingQueueSize how many outbound packets may be queued for it before
+// writers in the stack block.
+const (
+	batchSize         = 128
+	incomingQueueSize = 1024
+)
+
+// Options configures optional behavior of the userspace network stack.
+// The zero value is the configuration used by CreateNetTUN.
+// The reassembly of IPv4 fragments is not among it: gvisor hard-codes its
+// timeout and memory limits, see Stats.FragmentsReceived.
+type Options struct {
+	// HostsOnly makes names missing from the table set by Net.SetHosts fail
+	// to resolve, instead of being looked up in DNS.
+	HostsOnly bool
+
+	// ConnectTimeout bounds TCP handshakes started with a context that has
+	// no deadline. Zero selects DefaultConnectTimeout; a negative value
+	// lets them run until the stack gives up.
+	ConnectTimeout time.Duration
+
+	// ND configures IPv6 neighbor discovery.
+	ND NDOptions
+
+	// TCPListen protects TCP listeners from SYN floods; see
+	// Net.SetTCPListenOptions to change it later.
+	TCPListen TCPListenOptions
+
+	// DNS configures the resolvers, such as to use DNS over TLS or HTTPS.
+	DNS DNSOptions
+
+	// Metered wraps the conns returned by DialContext and Dial, and those
+	// accepted by ServeTCP, ListenTLS, ServeSNIRouter, ListenTCPConn and
+	// the listeners of a SplitDialer, in a MeteredConn. The TCPConns and
+	// UDPConns returned by DialContextTCPConn, DialUDPConn and
+	// ListenUDPConn count their bytes instead, see their Stats methods.
+	// Without it, conns are neither wrapped nor counted. The gonet conns
+	// and listeners returned by the other Dial and Listen methods are never
+	// metered.
+	Metered bool
+
+	// WarmUp holds the packets sent to destinations that are not ready,
+	// such as while the first handshake with their peer is in progress.
+	WarmUp WarmUpOptions
+
+	// ICMP configures the ICMP errors the stack sends, and whether it
+	// forwards packets that are not its own.
+	ICMP ICMPOptions
+}
+
 func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
+	return CreateNetTUNWithOptions(localAddresses, dnsServers, mtu, Options{})
+}
+
+// CreateNetTUNWithOptions is like CreateNetTUN but allows tuning the stack with opts.
+func CreateNetTUNWithOptions(localAddresses, dnsServers []netip.Addr, mtu int, options Options) (tun.Device, *Net, error) {
 	opts := stack.Options{
-		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		NetworkProtocols: []stack.NetworkProtocolFactory{
+			ipv4.NewProtocol,
+			ipv6.NewProtocolWithOptions(ipv6.Options{DADConfigs: options.ND.dadConfigurations()}),
+		},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4},
 		HandleLocal:        true,
+		NUDConfigs:         options.ND.nudConfigurations(),
 	}
 	dev := &netTun{
 		ep:             channel.New(1024, uint32(mtu), ""),
 		stack:          stack.New(opts),
 		events:         make(chan tun.Event, 10),
-		incomingPacket: make(chan *buffer.View),
-		dnsServers:     dnsServers,
-		mtu:            mtu,
+		incomingPacket: make(chan *buffer.View, incomingQueueSize),
+		done:           make(chan struct{}),
+		hostsOnly:      options.HostsOnly,
+		ndProxy:        options.ND.Proxy,
+		metered:        options.Metered,
+	}
+	if err := (*Net)(dev).setDNSOptions(dnsServers, options.DNS); err != nil {
+		for _, u := range dev.dnsUpstreams {
+			u.close()
+		}
+		dev.stack.Close()
+		dev.ep.Close()
+		return nil, nil, err
+	}
+	dev.warmUp.init(options.WarmUp, dev.incomingPacket, dev.done, &dev.dialTrace)
+	dev.connectTimeout = options.ConnectTimeout
+	if dev.connectTimeout == 0 {
+		dev.connectTimeout = DefaultConnectTimeout
 	}
 	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
 	tcpipErr := dev.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt)
 	if tcpipErr != nil {
 		return nil, nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
 	}
+	if err := (*Net)(dev).SetTCPListenOptions(options.TCPListen); err != nil {
+		return nil, nil, fmt.Errorf("could not set TCP listen options: %w", err)
+	}
 	dev.ep.AddNotify(dev)
 	tcpipErr = dev.stack.CreateNIC(1, dev.ep)
 	if tcpipErr != nil {
@@ -102,6 +199,9 @@ func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device,
 	if dev.hasV6 {
 		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: 1})
 	}
+	if err := dev.icmpErrors.init(dev.stack, options.ICMP, localAddresses); err != nil {
+		return nil, nil, err
+	}
 
 	dev.events <- tun.EventUp
 	return dev, (*Net)(dev), nil
@@ -120,17 +220,42 @@ func (tun *netTun) Events() <-chan tun.Event {
 }
 
 func (tun *netTun) Read(buf [][]byte, sizes []int, offset int) (int, error) {
-	view, ok := <-tun.incomingPacket
-	if !ok {
-		return 0, os.ErrClosed
+	view := tun.pending
+	tun.pending = nil
+	if view == nil {
+		select {
+		case view = <-tun.incomingPacket:
+		case <-tun.done:
+			return 0, os.ErrClosed
+		}
 	}
 
-	n, err := view.Read(buf[0][offset:])
-	if err != nil {
-		return 0, err
+	for i := 0; ; i++ {
+		n, err := view.Read(buf[i][offset:])
+		if err != nil {
+			if i == 0 {
+				return 0, err
+			}
+			// Return the packets read so far, and the error with the next Read.
+			tun.pending = view
+			return i, nil
+		}
+		sizes[i] = n
+		if i+1 == len(buf) {
+			return i + 1, nil
+		}
+		// Hand over whatever else is already queued without blocking.
+		select {
+		case view = <-tun.incomingPacket:
+		default:
+			return i + 1, nil
+		}
 	}
-	sizes[0] = n
-	return 1, nil
+}
+
+// isFragment reports whether the IPv4 packet is part of a fragmented datagram.
+func isFragment(packet header.IPv4) bool {
+	return packet.More() || packet.FragmentOffset() != 0
 }
 
 func (tun *netTun) Write(buf [][]byte, offset int) (int, error) {
@@ -140,11 +265,24 @@ func (tun *netTun) Write(buf [][]byte, offset int) (int, error) {
 			continue
 		}
 
-		pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
 		switch packet[0] >> 4 {
 		case 4:
+			if len(packet) >= header.IPv4MinimumSize && isFragment(header.IPv4(packet)) {
+				tun.fragments.Add(1)
+			}
+			tun.dialTrace.receive(packet)
+			if !tun.halfOpen.inbound(packet) {
+				continue
+			}
+			tun.icmpErrors.inbound(header.IPv4(packet), (*Net)(tun).hasAddress)
+			pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
 			tun.ep.InjectInbound(header.IPv4ProtocolNumber, pkb)
 		case 6:
+			tun.dialTrace.receive(packet)
+			if tun.proxyNeighborSolicit(packet) || !tun.halfOpen.inbound(packet) {
+				continue
+			}
+			pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
 			tun.ep.InjectInbound(header.IPv6ProtocolNumber, pkb)
 		default:
 			return 0, syscall.EAFNOSUPPORT
@@ -161,32 +299,55 @@ func (tun *netTun) WriteNotify() {
 
 	view := pkt.ToView()
 	pkt.DecRef()
+	if tun.icmpErrors.outbound(view.AsSlice()) {
+		view.Release()
+		return
+	}
+	tun.halfOpen.outbound(view.AsSlice())
+	tun.captures.capture(view.AsSlice())
+	if tun.warmUp.hold(view) {
+		return
+	}
+	tun.dialTrace.send(view.AsSlice())
 
-	tun.incomingPacket <- view
+	select {
+	case tun.incomingPacket <- view:
+	case <-tun.done:
+		view.Release()
+	}
 }
 
 func (tun *netTun) Close() error {
-	tun.stack.RemoveNIC(1)
-
+	tun.eventsMu.Lock()
+	if tun.closed {
+		tun.eventsMu.Unlock()
+		return nil
+	}
+	tun.closed = true
 	if tun.events != nil {
 		close(tun.events)
 	}
+	tun.eventsMu.Unlock()
+
+	tun.stack.RemoveNIC(1)
+	for _, u := range tun.dnsUpstreams {
+		u.close()
+	}
 
 	tun.ep.Close()
 
-	if tun.incomingPacket != nil {
-		close(tun.incomingPacket)
-	}
+	close(tun.done)
+	tun.warmUp.close()
 
 	return nil
 }
 
 func (tun *netTun) MTU() (int, error) {
-	return tun.mtu, nil
+	return int(tun.ep.MTU()), nil
 }
 
 func (tun *netTun) BatchSize() int {
-	return 1
+	return batchSize
 }
 
 func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
@@ -196,16 +357,26 @@ func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.Networ
 	} else {
 		protoNumber = ipv6.ProtocolNumber
 	}
+	// The stack only treats the empty address as a wildcard, so map the
+	// unspecified address to it, for sockets bound to 0.0.0.0 or :: to
+	// receive broadcast and multicast datagrams as well.
+	var addr tcpip.Address
+	if !endpoint.Addr().IsUnspecified() {
+		addr = tcpip.AddrFromSlice(endpoint.Addr().AsSlice())
+	}
 	return tcpip.FullAddress{
 		NIC:  1,
-		Addr: tcpip.AddrFromSlice(endpoint.Addr().AsSlice()),
+		Addr: addr,
 		Port: endpoint.Port(),
 	}, protoNumber
 }
 
 func (net *Net) DialContextTCPAddrPort(ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
-	fa, pn := convertToFullAddr(addr)
-	return gonet.DialContextTCP(ctx, net.stack, fa, pn)
+	c, err := net.dialTCPAddrPort(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.TCPConn, nil
 }
 
 func (net *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.TCPConn, error) {
@@ -217,8 +388,7 @@ func (net *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.T
 }
 
 func (net *Net) DialTCPAddrPort(addr netip.AddrPort) (*gonet.TCPConn, error) {
-	fa, pn := convertToFullAddr(addr)
-	return gonet.DialTCP(net.stack, fa, pn)
+	return net.DialContextTCPAddrPort(context.Background(), addr)
 }
 
 func (net *Net) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
@@ -229,9 +399,31 @@ func (net *Net) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
 	return net.DialTCPAddrPort(netip.AddrPortFrom(ip, uint16(addr.Port)))
 }
 
+// DialContextTCPConn connects to addr as DialContextTCPAddrPort does, but
+// returns a TCPConn, whose reads and writes fail with errors matching
+// os.ErrDeadlineExceeded once their deadline passes, and which counts its
+// bytes if Options.Metered is set.
+func (net *Net) DialContextTCPConn(ctx context.Context, addr netip.AddrPort) (*TCPConn, error) {
+	c, err := net.dialTCPAddrPort(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.counts = net.counts()
+	return c, nil
+}
+
+func (net *Net) dialTCPAddrPort(ctx context.Context, addr netip.AddrPort) (*TCPConn, error) {
+	fa, pn := convertToFullAddr(addr)
+	return net.dialTCP(ctx, tcpip.FullAddress{}, fa, pn)
+}
+
+// ListenTCPAddrPort listens for TCP connections on addr. Any port may be
+// used, including those below 1024, as the stack has no notion of privilege.
+// See SetPortReuse for when a port that was recently listened on can be
+// listened on again.
 func (net *Net) ListenTCPAddrPort(addr netip.AddrPort) (*gonet.TCPListener, error) {
 	fa, pn := convertToFullAddr(addr)
-	return gonet.ListenTCP(net.stack, fa, pn)
+	return net.listenTCP(fa, pn)
 }
 
 func (net *Net) ListenTCP(addr *net.TCPAddr) (*gonet.TCPListener, error) {
@@ -242,20 +434,23 @@ func (net *Net) ListenTCP(addr *net.TCPAddr) (*gonet.TCPListener, error) {
 	return net.ListenTCPAddrPort(netip.AddrPortFrom(ip, uint16(addr.Port)))
 }
 
-func (net *Net) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDPConn, error) {
-	var lfa, rfa *tcpip.FullAddress
-	var pn tcpip.NetworkProtocolNumber
-	if laddr.IsValid() || laddr.Port() > 0 {
-		var addr tcpip.FullAddress
-		addr, pn = convertToFullAddr(laddr)
-		lfa = &addr
+// ListenTCPConn listens for TCP connections on addr as ListenTCPAddrPort
+// does, but its Close also cancels pending Accept calls, and the conns it
+// accepts are TCPConns, wrapped in a MeteredConn if Options.Metered is set.
+func (net *Net) ListenTCPConn(addr netip.AddrPort) (net.Listener, error) {
+	ln, err := net.ListenTCPAddrPort(addr)
+	if err != nil {
+		return nil, err
 	}
-	if raddr.IsValid() || raddr.Port() > 0 {
-		var addr tcpip.FullAddress
-		addr, pn = convertToFullAddr(raddr)
-		rfa = &addr
+	return newTCPListener(ln, net.metered), nil
+}
+
+func (net *Net) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDPConn, error) {
+	c, err := net.dialUDPAddrPort(laddr, raddr)
+	if err != nil {
+		return nil, err
 	}
-	return gonet.DialUDP(net.stack, lfa, rfa, pn)
+	return c.UDPConn, nil
 }
 
 func (net *Net) ListenUDPAddrPort(laddr netip.AddrPort) (*gonet.UDPConn, error) {
@@ -279,12 +474,47 @@ func (net *Net) ListenUDP(laddr *net.UDPAddr) (*gonet.UDPConn, error) {
 	return net.DialUDP(laddr, nil)
 }
 
+// DialUDPConn opens a UDP socket as DialUDPAddrPort does, but returns a
+// UDPConn, which supports batched writes and buffer sizing, and counts its
+// bytes if Options.Metered is set.
+func (net *Net) DialUDPConn(laddr, raddr netip.AddrPort) (*UDPConn, error) {
+	c, err := net.dialUDPAddrPort(laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c.counts = net.counts()
+	return c, nil
+}
+
+func (net *Net) dialUDPAddrPort(laddr, raddr netip.AddrPort) (*UDPConn, error) {
+	var lfa, rfa *tcpip.FullAddress
+	var pn tcpip.NetworkProtocolNumber
+	if laddr.IsValid() || laddr.Port() > 0 {
+		var addr tcpip.FullAddress
+		addr, pn = convertToFullAddr(laddr)
+		lfa = &addr
+	}
+	if raddr.IsValid() || raddr.Port() > 0 {
+		var addr tcpip.FullAddress
+		addr, pn = convertToFullAddr(raddr)
+		rfa = &addr
+	}
+	return dialUDP(net, lfa, rfa, pn)
+}
+
+// ListenUDPConn opens a UDP socket on laddr as ListenUDPAddrPort does, but
+// returns a UDPConn.
+func (net *Net) ListenUDPConn(laddr netip.AddrPort) (*UDPConn, error) {
+	return net.DialUDPConn(laddr, netip.AddrPort{})
+}
+
 type PingConn struct {
-	laddr    PingAddr
-	raddr    PingAddr
-	wq       waiter.Queue
-	ep       tcpip.Endpoint
-	deadline *time.Timer
+	laddr         PingAddr
+	raddr         PingAddr
+	wq            waiter.Queue
+	ep            tcpip.Endpoint
+	readDeadline  deadline
+	writeDeadline deadline
 }
 
 type PingAddr struct{ addr netip.Addr }
@@ -332,10 +562,8 @@ func (net *Net) DialPingAddr(laddr, raddr netip.Addr) (*PingConn, error) {
 	}
 
 	pc := &PingConn{
-		laddr:    PingAddr{laddr},
-		deadline: time.NewTimer(time.Hour << 10),
+		laddr: PingAddr{laddr},
 	}
-	pc.deadline.Stop()
 
 	ep, tcpipErr := net.stack.NewEndpoint(tn, pn, &pc.wq)
 	if tcpipErr != nil {
@@ -397,15 +625,10 @@ func (pc *PingConn) RemoteAddr() net.Addr {
 }
 
 func (pc *PingConn) Close() error {
-	pc.deadline.Reset(0)
 	pc.ep.Close()
 	return nil
 }
 
-func (pc *PingConn) SetWriteDeadline(t time.Time) error {
-	return errors.New("not implemented")
-}
-
 func (pc *PingConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	var na netip.Addr
 	switch v := addr.(type) {
@@ -420,9 +643,13 @@ func (pc *PingConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		return 0, fmt.Errorf("ping write: mismatched protocols")
 	}
 
+	if pc.writeDeadline.exceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
 	buf := bytes.NewReader(p)
 	rfa, _ := convertToFullAddr(netip.AddrPortFrom(na, 0))
-	// won't block, no deadlines
+	// won't block, so the deadline need not be waited for
 	n64, tcpipErr := pc.ep.Write(buf, tcpip.WriteOptions{
 		To: &rfa,
 	})
@@ -438,23 +665,28 @@ func (pc *PingConn) Write(p []byte) (n int, err error) {
 }
 
 func (pc *PingConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	e, notifyCh := waiter.NewChannelEntry(waiter.EventIn)
+	e, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
 	pc.wq.EventRegister(&e)
 	defer pc.wq.EventUnregister(&e)
 
-	select {
-	case <-pc.deadline.C:
-		return 0, nil, os.ErrDeadlineExceeded
-	case <-notifyCh:
-	}
-
 	w := tcpip.SliceWriter(p)
-
-	res, tcpipErr := pc.ep.Read(&w, tcpip.ReadOptions{
-		NeedRemoteAddr: true,
-	})
-	if tcpipErr != nil {
-		return 0, nil, fmt.Errorf("ping read: %s", tcpipErr)
+	var res tcpip.ReadResult
+	for {
+		var tcpipErr tcpip.Error
+		res, tcpipErr = pc.ep.Read(&w, tcpip.ReadOptions{
+			NeedRemoteAddr: true,
+		})
+		if tcpipErr == nil {
+			break
+		}
+		if _, ok := tcpipErr.(*tcpip.ErrWouldBlock); !ok {
+			return 0, nil, fmt.Errorf("ping read: %s", tcpipErr)
+		}
+		select {
+		case <-pc.readDeadline.wait():
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-notifyCh:
+		}
 	}
 
 	remoteAddr, _ := netip.AddrFromSlice(res.RemoteAddr.Addr.AsSlice())
@@ -467,13 +699,18 @@ func (pc *PingConn) Read(p []byte) (n int, err error) {
 }
 
 func (pc *PingConn) SetDeadline(t time.Time) error {
-	// pc.SetWriteDeadline is unimplemented
-
-	return pc.SetReadDeadline(t)
+	pc.readDeadline.set(t)
+	pc.writeDeadline.set(t)
+	return nil
 }
 
 func (pc *PingConn) SetReadDeadline(t time.Time) error {
-	pc.deadline.Reset(time.Until(t))
+	pc.readDeadline.set(t)
+	return nil
+}
+
+func (pc *PingConn) SetWriteDeadline(t time.Time) error {
+	pc.writeDeadline.set(t)
 	return nil
 }
 
@@ -652,7 +889,7 @@ func dnsStreamRoundTrip(c net.Conn, id uint16, query dnsmessage.Question, b []by
 	return p, h, nil
 }
 
-func (tnet *Net) exchange(ctx context.Context, server netip.Addr, q dnsmessage.Question, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error) {
+func (tnet *Net) exchange(ctx context.Context, server netip.AddrPort, q dnsmessage.Question, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error) {
 	q.Class = dnsmessage.ClassINET
 	id, udpReq, tcpReq, err := newRequest(q)
 	if err != nil {
@@ -666,9 +903,9 @@ func (tnet *Net) exchange(ctx context.Context, server netip.Addr, q dnsmessage.Q
 		var c net.Conn
 		var err error
 		if useUDP {
-			c, err = tnet.DialUDPAddrPort(netip.AddrPort{}, netip.AddrPortFrom(server, 53))
+			c, err = tnet.DialUDPAddrPort(netip.AddrPort{}, server)
 		} else {
-			c, err = tnet.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(server, 53))
+			c, err = tnet.DialContextTCPAddrPort(ctx, server)
 		}
 
 		if err != nil {
@@ -759,8 +996,8 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 	}
 
 	for i := 0; i < 2; i++ {
-		for _, server := range tnet.dnsServers {
-			p, h, err := tnet.exchange(ctx, server, q, time.Second*5)
+		for _, server := range tnet.upstreamsFor(ctx) {
+			p, h, err := server.exchange(ctx, q)
 			if err != nil {
 				dnsErr := &net.DNSError{
 					Err:    err.Error(),
@@ -825,6 +1062,12 @@ func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string,
 	if ip, err := netip.ParseAddr(host[:zlen]); err == nil {
 		return []string{ip.String()}, nil
 	}
+	if addrs, ok := tnet.lookupStaticHost(host); ok {
+		return addrs, nil
+	}
+	if tnet.hostsOnly {
+		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
+	}
 
 	if !isDomainName(host) {
 		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
@@ -987,7 +1230,14 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 			return nil, &net.OpError{Op: "dial", Err: errNumericPort}
 		}
 	}
+	var dial *tracedDial
+	if matches[1] == "tcp" {
+		ctx, dial, _ = tnet.dialTrace.start(ctx)
+	}
+	resolveStart := time.Now()
+	dial.emit(DialTraceEvent{Type: DialResolveStart, Time: resolveStart, Host: host})
 	allAddr, err := tnet.LookupContextHost(ctx, host)
+	dial.resolved(host, resolveStart, allAddr, err)
 	if err != nil {
 		return nil, &net.OpError{Op: "dial", Err: err}
 	}
@@ -1001,6 +1251,14 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 	if len(addrs) == 0 && len(allAddr) != 0 {
 		return nil, &net.OpError{Op: "dial", Err: errNoSuitableAddress}
 	}
+	if matches[1] == "tcp" && len(addrs) > 1 && hasBothFamilies(addrs) {
+		c, err := tnet.dialHappyEyeballs(ctx, interleaveFamilies(addrs))
+		if err != nil {
+			return nil, err
+		}
+		dial.established()
+		return tnet.meter(c), nil
+	}
 
 	var firstErr error
 	for i, addr := range addrs {
@@ -1035,14 +1293,15 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 		var c net.Conn
 		switch matches[1] {
 		case "tcp":
-			c, err = tnet.DialContextTCPAddrPort(dialCtx, addr)
+			c, err = tnet.dialTCPAddrPort(dialCtx, addr)
 		case "udp":
-			c, err = tnet.DialUDPAddrPort(netip.AddrPort{}, addr)
+			c, err = tnet.dialUDPAddrPort(netip.AddrPort{}, addr)
 		case "ping":
 			c, err = tnet.DialPingAddr(netip.Addr{}, addr.Addr())
 		}
 		if err == nil {
-			return c, nil
+			dial.established()
+			return tnet.meter(c), nil
 		}
 		if firstErr == nil {
 			firstErr = err
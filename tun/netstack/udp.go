@@ -0,0 +1,166 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// UDPConn is a UDP socket on a Net. In addition to the methods of
+// gonet.UDPConn, it supports batched writes and buffer sizing, which QUIC
+// implementations probe for.
+type UDPConn struct {
+	*gonet.UDPConn
+	ep            tcpip.Endpoint
+	writeDeadline deadline    // a copy of the gonet.UDPConn's, for WriteBatch
+	counts        *byteCounts // nil unless the Net is metered
+}
+
+func dialUDP(net *Net, laddr, raddr *tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*UDPConn, error) {
+	wq := new(waiter.Queue)
+	ep, tcpipErr := net.stack.NewEndpoint(udp.ProtocolNumber, pn, wq)
+	if tcpipErr != nil {
+		return nil, errors.New(tcpipErr.String())
+	}
+	if laddr != nil {
+		if tcpipErr := ep.Bind(*laddr); tcpipErr != nil {
+			ep.Close()
+			return nil, udpOpError("bind", *laddr, tcpipErr)
+		}
+	}
+	if raddr != nil {
+		if tcpipErr := ep.Connect(*raddr); tcpipErr != nil {
+			ep.Close()
+			return nil, udpOpError("connect", *raddr, tcpipErr)
+		}
+	}
+	return &UDPConn{UDPConn: gonet.NewUDPConn(wq, ep), ep: ep}, nil
+}
+
+func udpOpError(op string, addr tcpip.FullAddress, err tcpip.Error) *net.OpError {
+	return &net.OpError{
+		Op:   op,
+		Net:  "udp",
+		Addr: &net.UDPAddr{IP: net.IP(addr.Addr.AsSlice()), Port: int(addr.Port)},
+		Err:  errors.New(err.String()),
+	}
+}
+
+// WriteBatch sends each of bufs as a datagram to addr, or to the connected
+// peer if addr is nil. It returns the number of datagrams sent. The
+// destination is resolved once for the whole batch, and datagrams are
+// injected into the stack back to back without per-write deadline
+// bookkeeping, falling back to WriteTo only when the stack pushes back.
+func (c *UDPConn) WriteBatch(bufs [][]byte, addr net.Addr) (int, error) {
+	var opts tcpip.WriteOptions
+	if addr != nil {
+		var ap netip.AddrPort
+		switch a := addr.(type) {
+		case *net.UDPAddr:
+			ap = a.AddrPort()
+		default:
+			var err error
+			if ap, err = netip.ParseAddrPort(addr.String()); err != nil {
+				return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: err}
+			}
+		}
+		opts.To = &tcpip.FullAddress{
+			Addr: tcpip.AddrFromSlice(ap.Addr().Unmap().AsSlice()),
+			Port: ap.Port(),
+		}
+	}
+
+	var r bytes.Reader
+	for i, buf := range bufs {
+		if c.writeDeadline.exceeded() {
+			return i, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: os.ErrDeadlineExceeded}
+		}
+		r.Reset(buf)
+		_, tcpipErr := c.ep.Write(&r, opts)
+		if tcpipErr == nil {
+			c.counts.written(len(buf))
+			continue
+		}
+		if _, ok := tcpipErr.(*tcpip.ErrWouldBlock); !ok {
+			return i, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: errors.New(tcpipErr.String())}
+		}
+		// The send buffer is full; let WriteTo wait for room, honoring the write deadline.
+		if addr == nil {
+			_, err := c.Write(buf)
+			if err != nil {
+				return i, err
+			}
+		} else if _, err := c.WriteTo(buf, &net.UDPAddr{IP: net.IP(opts.To.Addr.AsSlice()), Port: int(opts.To.Port)}); err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
+func (c *UDPConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	c.counts.read(n)
+	return n, deadlineError(err)
+}
+
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	c.counts.read(n)
+	return n, addr, deadlineError(err)
+}
+
+func (c *UDPConn) Write(b []byte) (int, error) {
+	n, err := c.UDPConn.Write(b)
+	c.counts.written(n)
+	return n, deadlineError(err)
+}
+
+func (c *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.UDPConn.WriteTo(b, addr)
+	c.counts.written(n)
+	return n, deadlineError(err)
+}
+
+// Stats returns the number of bytes read from and written to c, which are
+// only counted if Options.Metered is set.
+func (c *UDPConn) Stats() (rx, tx uint64) {
+	return c.counts.stats()
+}
+
+// SetDeadline sets the read and write deadlines of the conn.
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return c.UDPConn.SetDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the conn, which also applies
+// to WriteBatch.
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return c.UDPConn.SetWriteDeadline(t)
+}
+
+// SetReadBuffer sets the size of the socket's receive buffer.
+func (c *UDPConn) SetReadBuffer(bytes int) error {
+	c.ep.SocketOptions().SetReceiveBufferSize(int64(bytes), true)
+	return nil
+}
+
+// SetWriteBuffer sets the size of the socket's send buffer.
+func (c *UDPConn) SetWriteBuffer(bytes int) error {
+	c.ep.SocketOptions().SetSendBufferSize(int64(bytes), true)
+	return nil
+}
@@ -0,0 +1,265 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+)
+
+const (
+	DefaultWarmUpHold           = 500 * time.Millisecond
+	DefaultWarmUpPacketsPerFlow = 4
+	DefaultWarmUpMaxPackets     = 256
+
+	// warmUpPollInterval is how often held packets are checked for whether
+	// their destination became ready.
+	warmUpPollInterval = 10 * time.Millisecond
+)
+
+// WarmUpOptions configures holding the first packets the stack sends to a
+// destination that cannot be reached yet, such as because the peer it is
+// routed to has no session, until it can. A device drops or delays the
+// packets that race its first handshake, and the stack then waits a whole
+// retransmission timeout, a second or more, before resending them; holding
+// them instead sends them as soon as the handshake completes.
+//
+// With a device, Ready is typically
+//
+//	func(dst netip.Addr) bool {
+//		peer := dev.LookupAllowedIP(dst)
+//		return peer == nil || peer.State() == device.PeerConnected || peer.State() == device.PeerStale
+//	}
+//
+// and an event handler set with Device.SetEventHandler calls Net.ReleaseHeld
+// on every EventPeerStateChanged to PeerConnected, so that held packets need
+// not wait for the next poll of Ready.
+type WarmUpOptions struct {
+	// Ready reports whether packets to dst can be sent at once. Without
+	// it, no packets are held. It is called without the locks of the Net
+	// held, and may be called concurrently.
+	Ready func(dst netip.Addr) bool
+
+	// Hold is the longest a packet is held, after which it is sent even if
+	// its destination is not ready. Zero selects DefaultWarmUpHold.
+	Hold time.Duration
+
+	// PacketsPerFlow bounds the packets held per flow, and MaxPackets
+	// those held in all. Packets beyond them are sent at once. Zero
+	// selects DefaultWarmUpPacketsPerFlow and DefaultWarmUpMaxPackets.
+	PacketsPerFlow int
+	MaxPackets     int
+}
+
+// warmUp holds the packets sent to destinations that are not ready.
+type warmUp struct {
+	opts     WarmUpOptions
+	incoming chan<- *buffer.View
+	done     <-chan struct{}
+	trace    *dialTracer
+
+	held     atomic.Uint64
+	timedOut atomic.Uint64
+
+	mu      sync.Mutex
+	flows   map[snatFlow]*heldFlow
+	packets int
+	polling bool
+	closed  bool
+}
+
+type heldFlow struct {
+	dst      netip.Addr
+	packets  []*buffer.View
+	deadline time.Time
+}
+
+func (w *warmUp) init(opts WarmUpOptions, incoming chan<- *buffer.View, done <-chan struct{}, trace *dialTracer) {
+	if opts.Hold == 0 {
+		opts.Hold = DefaultWarmUpHold
+	}
+	if opts.PacketsPerFlow == 0 {
+		opts.PacketsPerFlow = DefaultWarmUpPacketsPerFlow
+	}
+	if opts.MaxPackets == 0 {
+		opts.MaxPackets = DefaultWarmUpMaxPackets
+	}
+	w.opts = opts
+	w.incoming = incoming
+	w.done = done
+	w.trace = trace
+	w.flows = make(map[snatFlow]*heldFlow)
+}
+
+// hold holds view, an outbound packet, if its destination is not ready,
+// and reports whether it did. Otherwise, it first sends the packets of its
+// flow that were held, so that the caller sends view after them. Ready is
+// called, and packets are sent, without w.mu held.
+func (w *warmUp) hold(view *buffer.View) bool {
+	if w.opts.Ready == nil {
+		return false
+	}
+	key, ok := warmUpFlow(view.AsSlice())
+	if !ok {
+		return false
+	}
+	ready := w.opts.Ready(key.dst.Addr())
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return false
+	}
+	flow := w.flows[key]
+	if ready {
+		var release []*buffer.View
+		if flow != nil {
+			release = w.removeLocked(key, flow)
+		}
+		w.mu.Unlock()
+		w.send(release)
+		return false
+	}
+	defer w.mu.Unlock()
+	if flow == nil {
+		if w.packets >= w.opts.MaxPackets {
+			return false
+		}
+		flow = &heldFlow{dst: key.dst.Addr(), deadline: time.Now().Add(w.opts.Hold)}
+		w.flows[key] = flow
+	} else if len(flow.packets) >= w.opts.PacketsPerFlow || w.packets >= w.opts.MaxPackets {
+		return false
+	}
+	w.trace.hold(view.AsSlice())
+	flow.packets = append(flow.packets, view)
+	w.packets++
+	w.held.Add(1)
+	if !w.polling {
+		w.polling = true
+		time.AfterFunc(warmUpPollInterval, w.poll)
+	}
+	return true
+}
+
+// poll sends the held packets whose destination became ready, or that were
+// held for long enough.
+func (w *warmUp) poll() {
+	w.release()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.flows) > 0 && !w.closed {
+		time.AfterFunc(warmUpPollInterval, w.poll)
+	} else {
+		w.polling = false
+	}
+}
+
+// release sends the held packets whose destination became ready, or that
+// were held for long enough. It collects the flows under w.mu, and asks
+// Ready about them and sends their packets without it.
+func (w *warmUp) release() {
+	type candidate struct {
+		key  snatFlow
+		flow *heldFlow
+	}
+	w.mu.Lock()
+	candidates := make([]candidate, 0, len(w.flows))
+	for key, flow := range w.flows {
+		candidates = append(candidates, candidate{key, flow})
+	}
+	w.mu.Unlock()
+
+	now := time.Now()
+	var release []*buffer.View
+	for _, c := range candidates {
+		ready := w.opts.Ready(c.flow.dst)
+		if !ready && now.Before(c.flow.deadline) {
+			continue
+		}
+		w.mu.Lock()
+		// The flow may have been released meanwhile, by hold or another
+		// release.
+		if w.flows[c.key] == c.flow {
+			if !ready {
+				w.timedOut.Add(uint64(len(c.flow.packets)))
+			}
+			release = append(release, w.removeLocked(c.key, c.flow)...)
+		}
+		w.mu.Unlock()
+	}
+	w.send(release)
+}
+
+// removeLocked stops holding flow, of key, and returns its packets for the
+// caller to send. w.mu must be held.
+func (w *warmUp) removeLocked(key snatFlow, flow *heldFlow) []*buffer.View {
+	delete(w.flows, key)
+	packets := flow.packets
+	w.packets -= len(packets)
+	flow.packets = nil
+	return packets
+}
+
+// send hands packets to the device, which has not read them yet if the Net
+// is closed meanwhile.
+func (w *warmUp) send(packets []*buffer.View) {
+	for _, view := range packets {
+		w.trace.send(view.AsSlice())
+		select {
+		case w.incoming <- view:
+		case <-w.done:
+			view.Release()
+		}
+	}
+}
+
+// close drops the held packets.
+func (w *warmUp) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	for key, flow := range w.flows {
+		for _, view := range flow.packets {
+			view.Release()
+		}
+		w.packets -= len(flow.packets)
+		delete(w.flows, key)
+	}
+}
+
+// warmUpFlow returns the flow of an outbound packet, which for protocols
+// without ports is identified by its addresses alone.
+func warmUpFlow(packet []byte) (snatFlow, bool) {
+	if p, ok := parseSNATPacket(packet); ok {
+		return p.flow, true
+	}
+	var src, dst []byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		src, dst = packet[12:16], packet[16:20]
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		src, dst = packet[8:24], packet[24:40]
+	default:
+		return snatFlow{}, false
+	}
+	srcAddr, _ := netip.AddrFromSlice(src)
+	dstAddr, _ := netip.AddrFromSlice(dst)
+	return snatFlow{src: netip.AddrPortFrom(srcAddr, 0), dst: netip.AddrPortFrom(dstAddr, 0)}, true
+}
+
+// ReleaseHeld sends the packets held by Options.WarmUp whose destination
+// became ready at once, rather than at the next poll. It is meant to be
+// called when a handshake completes.
+func (net *Net) ReleaseHeld() {
+	w := &net.warmUp
+	if w.opts.Ready == nil {
+		return
+	}
+	w.release()
+}
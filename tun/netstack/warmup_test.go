@@ -0,0 +1,157 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestWarmUp(t *testing.T) {
+	local := netip.MustParseAddrPort("192.168.4.29:5300")
+	ready, unready := netip.MustParseAddrPort("10.0.0.1:4000"), netip.MustParseAddrPort("10.0.0.2:4000")
+	var handshaken atomic.Bool
+	dev, tnet, err := CreateNetTUNWithOptions([]netip.Addr{local.Addr()}, nil, 1420, Options{
+		WarmUp: WarmUpOptions{
+			Ready: func(dst netip.Addr) bool {
+				return dst == ready.Addr() || handshaken.Load()
+			},
+			Hold:           time.Hour,
+			PacketsPerFlow: 2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	conn, err := tnet.ListenUDPAddrPort(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packets := readPackets(dev)
+	send := func(dst netip.AddrPort, payload string) {
+		t.Helper()
+		if _, err := conn.WriteTo([]byte(payload), net.UDPAddrFromAddrPort(dst)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func(timeout time.Duration) string {
+		select {
+		case packet := <-packets:
+			return string(header.UDP(header.IPv4(packet).Payload()).Payload())
+		case <-time.After(timeout):
+			return ""
+		}
+	}
+
+	// Packets to a ready destination are never held.
+	send(ready, "ready")
+	if got := next(5 * time.Second); got != "ready" {
+		t.Fatalf("read %q, want the packet to the ready destination", got)
+	}
+
+	// Packets beyond PacketsPerFlow are sent at once.
+	send(unready, "1")
+	send(unready, "2")
+	send(unready, "3")
+	if got := next(5 * time.Second); got != "3" {
+		t.Fatalf("read %q, want the packet beyond the held ones", got)
+	}
+	if got := next(50 * time.Millisecond); got != "" {
+		t.Fatalf("read held packet %q", got)
+	}
+
+	handshaken.Store(true)
+	tnet.ReleaseHeld()
+	for _, want := range []string{"1", "2"} {
+		if got := next(time.Second); got != want {
+			t.Fatalf("read %q after the handshake, want %q", got, want)
+		}
+	}
+	if stats := tnet.Stats(); stats.PacketsHeld != 2 || stats.PacketsHeldTimedOut != 0 {
+		t.Errorf("%d packets held, %d timed out; want 2 and 0", stats.PacketsHeld, stats.PacketsHeldTimedOut)
+	}
+}
+
+func TestWarmUpTimeout(t *testing.T) {
+	local := netip.MustParseAddrPort("192.168.4.29:5300")
+	remote := netip.MustParseAddrPort("10.0.0.1:4000")
+	dev, tnet, err := CreateNetTUNWithOptions([]netip.Addr{local.Addr()}, nil, 1420, Options{
+		WarmUp: WarmUpOptions{
+			Ready: func(netip.Addr) bool { return false },
+			Hold:  100 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	conn, err := tnet.ListenUDPAddrPort(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packets := readPackets(dev)
+
+	start := time.Now()
+	if _, err := conn.WriteTo([]byte("ping"), net.UDPAddrFromAddrPort(remote)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-packets:
+		if held := time.Since(start); held < 100*time.Millisecond {
+			t.Errorf("packet held for %v, want at least 100ms", held)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("held packet not sent after Hold")
+	}
+	if stats := tnet.Stats(); stats.PacketsHeld != 1 || stats.PacketsHeldTimedOut != 1 {
+		t.Errorf("%d packets held, %d timed out; want 1 and 1", stats.PacketsHeld, stats.PacketsHeldTimedOut)
+	}
+}
+
+func TestWarmUpReadyUnlocked(t *testing.T) {
+	local := netip.MustParseAddrPort("192.168.4.29:5300")
+	slow, fast := netip.MustParseAddrPort("10.0.0.1:4000"), netip.MustParseAddrPort("10.0.0.2:4000")
+	asked, unblock := make(chan struct{}), make(chan struct{})
+	var w warmUp
+	w.init(WarmUpOptions{
+		Ready: func(dst netip.Addr) bool {
+			if dst == slow.Addr() {
+				close(asked)
+				<-unblock
+			}
+			return false
+		},
+		Hold: time.Hour,
+	}, make(chan *buffer.View, 4), make(chan struct{}), new(dialTracer))
+	defer w.close()
+
+	// While Ready is slow to answer about one destination, packets to
+	// another are held regardless.
+	go w.hold(buffer.NewViewWithData(buildUDPv4(local, slow, 1, []byte("slow"))))
+	<-asked
+	held := make(chan bool)
+	go func() {
+		held <- w.hold(buffer.NewViewWithData(buildUDPv4(local, fast, 2, []byte("fast"))))
+	}()
+	select {
+	case ok := <-held:
+		if !ok {
+			t.Error("packet to an unready destination not held")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ready about one destination held up packets to another")
+	}
+	close(unblock)
+}
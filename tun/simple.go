@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// simpleQueueSize is the number of packets queued in each direction of a
+// SimpleDevice, which is also its batch size.
+const simpleQueueSize = 128
+
+// ErrPacketTooLarge is returned by SimpleDevice.InjectInbound for packets
+// larger than the device's MTU.
+var ErrPacketTooLarge = errors.New("packet larger than MTU")
+
+// SimpleDevice is a Device whose packets are exchanged with the program one
+// at a time, without the offset and batching conventions of the Device
+// interface. Packets passed to InjectInbound are read by the WireGuard device
+// and sent to peers; packets the WireGuard device receives from peers are
+// returned by ReadOutbound.
+type SimpleDevice struct {
+	mtu       int
+	inbound   chan []byte
+	outbound  chan []byte
+	events    chan Event
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSimpleDevice returns a SimpleDevice with the given MTU, which is up.
+func NewSimpleDevice(mtu int) *SimpleDevice {
+	d := &SimpleDevice{
+		mtu:      mtu,
+		inbound:  make(chan []byte, simpleQueueSize),
+		outbound: make(chan []byte, simpleQueueSize),
+		events:   make(chan Event, 1),
+		closed:   make(chan struct{}),
+	}
+	d.events <- EventUp
+	return d
+}
+
+// InjectInbound queues packet, an IP packet, to be sent through the tunnel,
+// blocking while the queue is full. The packet is copied, so the caller may
+// reuse it. InjectInbound returns os.ErrClosed once the device is closed.
+func (d *SimpleDevice) InjectInbound(packet []byte) error {
+	if len(packet) > d.mtu {
+		return ErrPacketTooLarge
+	}
+	packet = append([]byte(nil), packet...)
+	select {
+	case <-d.closed:
+		return os.ErrClosed
+	default:
+	}
+	select {
+	case <-d.closed:
+		return os.ErrClosed
+	case d.inbound <- packet:
+		return nil
+	}
+}
+
+// ReadOutbound returns the next IP packet received through the tunnel,
+// blocking until there is one. It returns nil once the device is closed.
+func (d *SimpleDevice) ReadOutbound() []byte {
+	select {
+	case <-d.closed:
+		return nil
+	case packet := <-d.outbound:
+		return packet
+	}
+}
+
+func (d *SimpleDevice) File() *os.File { return nil }
+
+func (d *SimpleDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	var packet []byte
+	select {
+	case <-d.closed:
+		return 0, os.ErrClosed
+	case packet = <-d.inbound:
+	}
+	n := 0
+	for {
+		sizes[n] = copy(bufs[n][offset:], packet)
+		n++
+		if n == len(bufs) {
+			return n, nil
+		}
+		select {
+		case packet = <-d.inbound:
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (d *SimpleDevice) Write(bufs [][]byte, offset int) (int, error) {
+	for i, buf := range bufs {
+		packet := append([]byte(nil), buf[offset:]...)
+		select {
+		case <-d.closed:
+			return i, os.ErrClosed
+		case d.outbound <- packet:
+		}
+	}
+	return len(bufs), nil
+}
+
+func (d *SimpleDevice) MTU() (int, error)     { return d.mtu, nil }
+func (d *SimpleDevice) Name() (string, error) { return "simple", nil }
+func (d *SimpleDevice) Events() <-chan Event  { return d.events }
+func (d *SimpleDevice) BatchSize() int        { return simpleQueueSize }
+
+func (d *SimpleDevice) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		close(d.events)
+	})
+	return nil
+}
@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestSimpleDevice(t *testing.T) {
+	const offset = 16
+	d := NewSimpleDevice(1420)
+	if e := <-d.Events(); e != EventUp {
+		t.Fatalf("first event %v, want EventUp", e)
+	}
+
+	// Packets injected are read in a batch, at the offset.
+	packets := [][]byte{{0x45, 1}, {0x45, 2, 2}, {0x60, 3, 3, 3}}
+	for _, p := range packets {
+		if err := d.InjectInbound(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.InjectInbound(make([]byte, 1421)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("injecting a packet larger than the MTU: %v, want %v", err, ErrPacketTooLarge)
+	}
+	bufs := make([][]byte, d.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, offset+1420)
+	}
+	sizes := make([]int, len(bufs))
+	n, err := d.Read(bufs, sizes, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(packets) {
+		t.Fatalf("read %d packets, want %d", n, len(packets))
+	}
+	for i, p := range packets {
+		if got := bufs[i][offset : offset+sizes[i]]; !bytes.Equal(got, p) {
+			t.Errorf("packet %d read as %x, want %x", i, got, p)
+		}
+	}
+
+	// Packets written are returned one at a time, without the offset.
+	for i, p := range packets {
+		copy(bufs[i][offset:], p)
+		bufs[i] = bufs[i][:offset+len(p)]
+	}
+	if n, err := d.Write(bufs[:len(packets)], offset); n != len(packets) || err != nil {
+		t.Fatalf("wrote %d packets, %v; want %d", n, err, len(packets))
+	}
+	bufs[0][offset] = 0 // the packets returned must not share the buffers written
+	for i, p := range packets {
+		if got := d.ReadOutbound(); !bytes.Equal(got, p) {
+			t.Errorf("packet %d written as %x, want %x", i, got, p)
+		}
+	}
+
+	d.Close()
+	if err := d.InjectInbound(packets[0]); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("injecting after close: %v, want %v", err, os.ErrClosed)
+	}
+	if p := d.ReadOutbound(); p != nil {
+		t.Fatalf("ReadOutbound after close returned %x, want nil", p)
+	}
+	if _, err := d.Read(bufs, sizes, offset); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("reading after close: %v, want %v", err, os.ErrClosed)
+	}
+	if _, ok := <-d.Events(); ok {
+		t.Fatal("events channel open after close")
+	}
+	d.Close()
+}
@@ -17,6 +17,22 @@ const (
 	EventMTUUpdate
 )
 
+// Offloads describes the segmentation offloads a Device negotiated with the
+// operating system.
+type Offloads struct {
+	TSO      bool // Read splits TCP segments larger than the MTU
+	USO      bool // Read splits UDP segments larger than the MTU
+	GRO      bool // Write coalesces TCP segments
+	UDPGRO   bool // Write coalesces UDP datagrams
+	Disabled bool // offloads were turned off on request
+}
+
+// OffloadReporter is implemented by Devices that report the offloads they
+// negotiated, such as the Linux TUN device.
+type OffloadReporter interface {
+	Offloads() Offloads
+}
+
 type Device interface {
 	// File returns the file descriptor of the device.
 	File() *os.File
@@ -26,12 +42,21 @@ type Device interface {
 	// packet lengths within the sizes slice. len(sizes) must be >= len(bufs).
 	// A nonzero offset can be used to instruct the Device on where to begin
 	// reading into each element of the bufs slice.
+	//
+	// The WireGuard device passes an offset leaving room to prepend the
+	// transport header in place. The Linux Device, when offloads are
+	// enabled, reads packets prefixed by a virtio-net header, which carries
+	// their segmentation metadata, and splits segmented packets across
+	// several bufs. Programs that only need to exchange single packets can
+	// use SimpleDevice instead of implementing Device.
 	Read(bufs [][]byte, sizes []int, offset int) (n int, err error)
 
 	// Write one or more packets to the device (without any additional headers).
 	// On a successful write it returns the number of packets written. A nonzero
 	// offset can be used to instruct the Device on where to begin writing from
-	// each packet contained within the bufs slice.
+	// each packet contained within the bufs slice. The Linux Device writes
+	// the virtio-net header into the bytes before offset, and may coalesce
+	// packets, so the contents of bufs are not preserved.
 	Write(bufs [][]byte, offset int) (int, error)
 
 	// MTU returns the MTU of the Device.
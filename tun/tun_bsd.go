@@ -0,0 +1,199 @@
+//go:build freebsd || openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bsdBatchSize is the most packets Read returns at once. tun(4) has no way
+// of reading several packets in one syscall, so Read drains the packets
+// queued on the device with non-blocking reads after the first, waking up
+// once per batch instead of once per packet.
+const bsdBatchSize = 32
+
+// initBatching enables batched reads if the file of the device is
+// non-blocking, as it is unless it was passed to CreateTUNFromFile in
+// blocking mode, where draining it would wait for further packets.
+func (tun *NativeTun) initBatching() {
+	rawConn, err := tun.tunFile.SyscallConn()
+	if err != nil {
+		return
+	}
+	var flags int
+	err = rawConn.Control(func(fd uintptr) {
+		flags, err = unix.FcntlInt(fd, unix.F_GETFL, 0)
+	})
+	if err != nil || flags&unix.O_NONBLOCK == 0 {
+		return
+	}
+	tun.rawConn = rawConn
+}
+
+func (tun *NativeTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case err := <-tun.errors:
+		return 0, err
+	default:
+	}
+	if offset < 4 {
+		return 0, io.ErrShortBuffer
+	}
+	n, err := tun.tunFile.Read(bufs[0][offset-4:])
+	if n < 4 {
+		return 0, err
+	}
+	sizes[0] = n - 4
+	if err != nil || tun.rawConn == nil {
+		return 1, err
+	}
+	return 1 + tun.drain(bufs[1:], sizes[1:], offset), nil
+}
+
+// drain reads the packets already queued on the device into bufs, without
+// waiting for more, and returns their number. Errors are left for the next
+// Read to report.
+func (tun *NativeTun) drain(bufs [][]byte, sizes []int, offset int) int {
+	count := 0
+	tun.rawConn.Read(func(fd uintptr) bool {
+		for count < len(bufs) && count < len(sizes) {
+			n, err := unix.Read(int(fd), bufs[count][offset-4:])
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil || n == 0 {
+				break
+			}
+			if n < 4 {
+				continue
+			}
+			sizes[count] = n - 4
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+func (tun *NativeTun) Write(bufs [][]byte, offset int) (int, error) {
+	if offset < 4 {
+		return 0, io.ErrShortBuffer
+	}
+	// Each write to tun(4) is one packet, so there is nothing to batch.
+	for i, buf := range bufs {
+		buf = buf[offset-4:]
+		if len(buf) < 5 {
+			return i, io.ErrShortBuffer
+		}
+		buf[0] = 0x00
+		buf[1] = 0x00
+		buf[2] = 0x00
+		switch buf[4] >> 4 {
+		case 4:
+			buf[3] = unix.AF_INET
+		case 6:
+			buf[3] = unix.AF_INET6
+		default:
+			return i, unix.EAFNOSUPPORT
+		}
+		if _, err := tun.tunFile.Write(buf); err != nil {
+			return i, err
+		}
+	}
+	return len(bufs), nil
+}
+
+func (tun *NativeTun) BatchSize() int {
+	if tun.rawConn == nil {
+		return 1
+	}
+	return bsdBatchSize
+}
+
+// ifInfoIndex returns the index of the interface a routing message is about,
+// if it is an RTM_IFINFO message, sent when the flags or the MTU of the
+// interface change.
+func ifInfoIndex(msg []byte) (int, bool) {
+	if len(msg) < ifmIndexOffset+2 || msg[3 /* type */] != unix.RTM_IFINFO {
+		return 0, false
+	}
+	return int(binary.NativeEndian.Uint16(msg[ifmIndexOffset:])), true
+}
+
+func (tun *NativeTun) routineRouteListener(tunIfindex int) {
+	var (
+		statusUp  bool
+		statusMTU int
+	)
+
+	defer close(tun.events)
+
+	check := func() bool {
+		iface, err := net.InterfaceByIndex(tunIfindex)
+		if err != nil {
+			tun.errors <- err
+			return true
+		}
+
+		// Up / Down event
+		up := (iface.Flags & net.FlagUp) != 0
+		if up != statusUp && up {
+			tun.events <- EventUp
+		}
+		if up != statusUp && !up {
+			tun.events <- EventDown
+		}
+		statusUp = up
+
+		// MTU changes
+		if iface.MTU != statusMTU {
+			tun.events <- EventMTUUpdate
+		}
+		statusMTU = iface.MTU
+		return false
+	}
+
+	if check() {
+		return
+	}
+
+	data := make([]byte, os.Getpagesize())
+	for {
+		n, err := unix.Read(tun.routeSocket, data)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			// The socket overflowed and messages were lost, possibly
+			// ours, which a busy routing table should not make fatal.
+			if errors.Is(err, syscall.ENOBUFS) {
+				if check() {
+					return
+				}
+				continue
+			}
+			tun.errors <- err
+			return
+		}
+
+		ifindex, ok := ifInfoIndex(data[:n])
+		if !ok || ifindex != tunIfindex {
+			continue
+		}
+		if check() {
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+//go:build freebsd || openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"encoding/binary"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// bsdTestOffset is the headroom of the packets, as the device leaves it.
+const bsdTestOffset = 16
+
+func TestReadBatch(t *testing.T) {
+	// A datagram socket keeps the boundaries of packets, like tun(4).
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, peer := os.NewFile(uintptr(fds[0]), "dev"), os.NewFile(uintptr(fds[1]), "peer")
+	defer dev.Close()
+	defer peer.Close()
+	tun := &NativeTun{tunFile: dev, errors: make(chan error, 1)}
+	tun.initBatching()
+	if tun.BatchSize() != bsdBatchSize {
+		t.Fatalf("batch size %d of a non-blocking file, want %d", tun.BatchSize(), bsdBatchSize)
+	}
+
+	const packets = 5
+	bufs := make([][]byte, bsdBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, bsdTestOffset+100)
+	}
+	for i := range packets {
+		bufs[i][bsdTestOffset] = 4 << 4
+		bufs[i][bsdTestOffset+1] = byte(i)
+	}
+	if n, err := tun.Write(bufs[:packets], bsdTestOffset); n != packets || err != nil {
+		t.Fatalf("wrote %d of %d packets: %v", n, packets, err)
+	}
+	// Echo the packets back to be read.
+	buf := make([]byte, 200)
+	for range packets {
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint32(buf) != unix.AF_INET {
+			t.Errorf("packet written behind header %x, want AF_INET", buf[:4])
+		}
+		peer.Write(buf[:n])
+	}
+
+	sizes := make([]int, len(bufs))
+	for i := range bufs {
+		clear(bufs[i])
+	}
+	n, err := tun.Read(bufs, sizes, bsdTestOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != packets {
+		t.Fatalf("read %d packets at once, want %d", n, packets)
+	}
+	for i := range n {
+		if sizes[i] != 100 || bufs[i][bsdTestOffset+1] != byte(i) {
+			t.Errorf("packet %d read as packet %d of %d bytes", i, bufs[i][bsdTestOffset+1], sizes[i])
+		}
+	}
+}
+
+func TestIfInfoIndex(t *testing.T) {
+	msg := make([]byte, ifmIndexOffset+16)
+	msg[3] = unix.RTM_IFINFO
+	binary.NativeEndian.PutUint16(msg[ifmIndexOffset:], 7)
+	if index, ok := ifInfoIndex(msg); !ok || index != 7 {
+		t.Errorf("RTM_IFINFO parsed as %d, %t, want interface 7", index, ok)
+	}
+	if _, ok := ifInfoIndex(msg[:ifmIndexOffset+1]); ok {
+		t.Error("truncated message parsed")
+	}
+	msg[3] = unix.RTM_ADD
+	if _, ok := ifInfoIndex(msg); ok {
+		t.Error("RTM_ADD parsed as RTM_IFINFO")
+	}
+}
+
+func TestMTUEvents(t *testing.T) {
+	name := ""
+	if runtime.GOOS == "openbsd" {
+		name = "tun"
+	}
+	dev, err := CreateTUN(name, 1420)
+	if err != nil {
+		t.Skipf("cannot create TUN device: %v", err)
+	}
+	defer dev.Close()
+	tun := dev.(*NativeTun)
+
+	waitMTU := func(mtu int) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case event := <-dev.Events():
+				if event&EventMTUUpdate == 0 {
+					continue
+				}
+				if got, err := dev.MTU(); err != nil || got == mtu {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no MTU update to %d", mtu)
+			}
+		}
+	}
+	waitMTU(1420)
+	if err := tun.setMTU(1300); err != nil {
+		t.Fatal(err)
+	}
+	waitMTU(1300)
+}
@@ -8,7 +8,6 @@ package tun
 import (
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"sync"
@@ -28,6 +27,9 @@ const (
 	_SIOCSIFINFO_IN6        = 0xc048696d
 	_ND6_IFF_AUTO_LINKLOCAL = 0x20
 	_ND6_IFF_NO_DAD         = 0x100
+
+	// ifmIndexOffset is the offset of ifm_index in struct if_msghdr.
+	ifmIndexOffset = 12
 )
 
 // Iface requests with just the name
@@ -73,65 +75,10 @@ type NativeTun struct {
 	events      chan Event
 	errors      chan error
 	routeSocket int
+	rawConn     syscall.RawConn // set if reads are batched
 	closeOnce   sync.Once
 }
 
-func (tun *NativeTun) routineRouteListener(tunIfindex int) {
-	var (
-		statusUp  bool
-		statusMTU int
-	)
-
-	defer close(tun.events)
-
-	data := make([]byte, os.Getpagesize())
-	for {
-	retry:
-		n, err := unix.Read(tun.routeSocket, data)
-		if err != nil {
-			if errors.Is(err, syscall.EINTR) {
-				goto retry
-			}
-			tun.errors <- err
-			return
-		}
-
-		if n < 14 {
-			continue
-		}
-
-		if data[3 /* type */] != unix.RTM_IFINFO {
-			continue
-		}
-		ifindex := int(*(*uint16)(unsafe.Pointer(&data[12 /* ifindex */])))
-		if ifindex != tunIfindex {
-			continue
-		}
-
-		iface, err := net.InterfaceByIndex(ifindex)
-		if err != nil {
-			tun.errors <- err
-			return
-		}
-
-		// Up / Down event
-		up := (iface.Flags & net.FlagUp) != 0
-		if up != statusUp && up {
-			tun.events <- EventUp
-		}
-		if up != statusUp && !up {
-			tun.events <- EventDown
-		}
-		statusUp = up
-
-		// MTU changes
-		if iface.MTU != statusMTU {
-			tun.events <- EventMTUUpdate
-		}
-		statusMTU = iface.MTU
-	}
-}
-
 func tunName(fd uintptr) (string, error) {
 	var ifreq ifreqName
 	_, _, err := unix.Syscall(unix.SYS_IOCTL, fd, _TUNGIFNAME, uintptr(unsafe.Pointer(&ifreq)))
@@ -301,6 +248,7 @@ func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
 		return nil, err
 	}
 
+	tun.initBatching()
 	go tun.routineRouteListener(tunIfindex)
 
 	err = tun.setMTU(mtu)
@@ -333,48 +281,6 @@ func (tun *NativeTun) Events() <-chan Event {
 	return tun.events
 }
 
-func (tun *NativeTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
-	select {
-	case err := <-tun.errors:
-		return 0, err
-	default:
-		buf := bufs[0][offset-4:]
-		n, err := tun.tunFile.Read(buf[:])
-		if n < 4 {
-			return 0, err
-		}
-		sizes[0] = n - 4
-		return 1, err
-	}
-}
-
-func (tun *NativeTun) Write(bufs [][]byte, offset int) (int, error) {
-	if offset < 4 {
-		return 0, io.ErrShortBuffer
-	}
-	for i, buf := range bufs {
-		buf = buf[offset-4:]
-		if len(buf) < 5 {
-			return i, io.ErrShortBuffer
-		}
-		buf[0] = 0x00
-		buf[1] = 0x00
-		buf[2] = 0x00
-		switch buf[4] >> 4 {
-		case 4:
-			buf[3] = unix.AF_INET
-		case 6:
-			buf[3] = unix.AF_INET6
-		default:
-			return i, unix.EAFNOSUPPORT
-		}
-		if _, err := tun.tunFile.Write(buf); err != nil {
-			return i, err
-		}
-	}
-	return len(bufs), nil
-}
-
 func (tun *NativeTun) Close() error {
 	var err1, err2, err3 error
 	tun.closeOnce.Do(func() {
@@ -429,7 +335,3 @@ func (tun *NativeTun) MTU() (int, error) {
 	}
 	return int(*(*int32)(unsafe.Pointer(&ifr.MTU))), nil
 }
-
-func (tun *NativeTun) BatchSize() int {
-	return 1
-}
@@ -38,7 +38,7 @@ type NativeTun struct {
 	statusListenersShutdown chan struct{}
 	batchSize               int
 	vnetHdr                 bool
-	udpGSO                  bool
+	offloads                Offloads
 
 	closeOnce sync.Once
 
@@ -344,13 +344,27 @@ func (tun *NativeTun) Write(bufs [][]byte, offset int) (int, error) {
 		total int
 	)
 	tun.toWrite = tun.toWrite[:0]
-	if tun.vnetHdr {
-		err := handleGRO(bufs, offset, tun.tcpGROTable, tun.udpGROTable, tun.udpGSO, &tun.toWrite)
+	switch {
+	case tun.vnetHdr && tun.offloads.GRO:
+		err := handleGRO(bufs, offset, tun.tcpGROTable, tun.udpGROTable, tun.offloads.UDPGRO, &tun.toWrite)
 		if err != nil {
 			return 0, err
 		}
 		offset -= virtioNetHdrLen
-	} else {
+	case tun.vnetHdr:
+		for i := range bufs {
+			if offset < virtioNetHdrLen || offset > len(bufs[i])-1 {
+				return 0, errors.New("invalid offset")
+			}
+			hdr := virtioNetHdr{}
+			err := hdr.encode(bufs[i][offset-virtioNetHdrLen:])
+			if err != nil {
+				return 0, err
+			}
+			tun.toWrite = append(tun.toWrite, i)
+		}
+		offset -= virtioNetHdrLen
+	default:
 		for i := range bufs {
 			tun.toWrite = append(tun.toWrite, i)
 		}
@@ -502,13 +516,41 @@ func (tun *NativeTun) BatchSize() int {
 	return tun.batchSize
 }
 
+// Offloads reports the virtio-net header offloads negotiated with the kernel.
+func (tun *NativeTun) Offloads() Offloads {
+	return tun.offloads
+}
+
 const (
 	// TODO: support TSO with ECN bits
 	tunTCPOffloads = unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6
 	tunUDPOffloads = unix.TUN_F_USO4 | unix.TUN_F_USO6
 )
 
-func (tun *NativeTun) initFromFlags(name string) error {
+// OffloadMode selects the virtio-net header offloads a TUN device negotiates
+// with the kernel.
+type OffloadMode int
+
+const (
+	// OffloadAuto enables TSO and GRO, and their UDP counterparts where the
+	// kernel supports them.
+	OffloadAuto OffloadMode = iota
+
+	// OffloadDisabled exchanges only packets that fit the MTU with the
+	// kernel. Use it where TSO is known to corrupt large segments.
+	OffloadDisabled
+
+	// OffloadGROOnly coalesces packets written to the kernel, but never
+	// accepts segments larger than the MTU from it.
+	OffloadGROOnly
+)
+
+// Options holds the settings of a TUN device created by CreateTUNWithOptions.
+type Options struct {
+	Offload OffloadMode
+}
+
+func (tun *NativeTun) initFromFlags(name string, mode OffloadMode) error {
 	sc, err := tun.tunFile.SyscallConn()
 	if err != nil {
 		return err
@@ -524,21 +566,41 @@ func (tun *NativeTun) initFromFlags(name string) error {
 			return
 		}
 		got := ifr.Uint16()
-		if got&unix.IFF_VNET_HDR != 0 {
-			// tunTCPOffloads were added in Linux v2.6. We require their support
-			// if IFF_VNET_HDR is set.
-			err = unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, tunTCPOffloads)
-			if err != nil {
-				return
-			}
-			tun.vnetHdr = true
-			tun.batchSize = conn.IdealBatchSize
-			// tunUDPOffloads were added in Linux v6.2. We do not return an
-			// error if they are unsupported at runtime.
-			tun.udpGSO = unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, tunTCPOffloads|tunUDPOffloads) == nil
-		} else {
+		tun.offloads.Disabled = mode == OffloadDisabled
+		if got&unix.IFF_VNET_HDR == 0 {
 			tun.batchSize = 1
+			return
+		}
+		tun.vnetHdr = true
+		if mode == OffloadDisabled {
+			// The header stays, as the status hack relies upon it, but
+			// the kernel no longer hands over oversized segments, and
+			// Write no longer coalesces.
+			err = unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, 0)
+			tun.batchSize = 1
+			return
 		}
+		// tunTCPOffloads were added in Linux v2.6. We require their support
+		// if IFF_VNET_HDR is set.
+		err = unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, tunTCPOffloads)
+		if err != nil {
+			return
+		}
+		tun.batchSize = conn.IdealBatchSize
+		// tunUDPOffloads were added in Linux v6.2. We do not return an
+		// error if they are unsupported at runtime.
+		udp := unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, tunTCPOffloads|tunUDPOffloads) == nil
+		tun.offloads.GRO = true
+		tun.offloads.UDPGRO = udp
+		if mode == OffloadGROOnly {
+			// Writing coalesced packets does not depend on the offloads
+			// set here, which only govern what the kernel sends us. The
+			// probe above tells whether it understands UDP segments.
+			err = unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, 0)
+			return
+		}
+		tun.offloads.TSO = true
+		tun.offloads.USO = udp
 	}); e != nil {
 		return e
 	}
@@ -547,6 +609,12 @@ func (tun *NativeTun) initFromFlags(name string) error {
 
 // CreateTUN creates a Device with the provided name and MTU.
 func CreateTUN(name string, mtu int) (Device, error) {
+	return CreateTUNWithOptions(name, mtu, Options{})
+}
+
+// CreateTUNWithOptions creates a Device with the provided name, MTU and
+// options.
+func CreateTUNWithOptions(name string, mtu int, opts Options) (Device, error) {
 	nfd, err := unix.Open(cloneDevicePath, unix.O_RDWR|unix.O_CLOEXEC, 0)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -576,11 +644,15 @@ func CreateTUN(name string, mtu int) (Device, error) {
 	// Note that the above -- open,ioctl,nonblock -- must happen prior to handing it to netpoll as below this line.
 
 	fd := os.NewFile(uintptr(nfd), cloneDevicePath)
-	return CreateTUNFromFile(fd, mtu)
+	return createTUNFromFile(fd, mtu, opts.Offload)
 }
 
 // CreateTUNFromFile creates a Device from an os.File with the provided MTU.
 func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
+	return createTUNFromFile(file, mtu, OffloadAuto)
+}
+
+func createTUNFromFile(file *os.File, mtu int, mode OffloadMode) (Device, error) {
 	tun := &NativeTun{
 		tunFile:                 file,
 		events:                  make(chan Event, 5),
@@ -596,7 +668,7 @@ func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
 		return nil, err
 	}
 
-	err = tun.initFromFlags(name)
+	err = tun.initFromFlags(name, mode)
 	if err != nil {
 		return nil, err
 	}
@@ -650,7 +722,7 @@ func CreateUnmonitoredTUNFromFD(fd int) (Device, string, error) {
 	if err != nil {
 		return nil, "", err
 	}
-	err = tun.initFromFlags(name)
+	err = tun.initFromFlags(name, OffloadAuto)
 	if err != nil {
 		return nil, "", err
 	}
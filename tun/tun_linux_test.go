@@ -0,0 +1,162 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/darkit/wireguard/conn"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestWriteWithoutOffloads(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	tun := &NativeTun{
+		tunFile:     w,
+		vnetHdr:     true,
+		offloads:    Offloads{Disabled: true},
+		tcpGROTable: newTCPGROTable(),
+		udpGROTable: newUDPGROTable(),
+		toWrite:     make([]int, 0, conn.IdealBatchSize),
+	}
+
+	// Both flows would be coalesced with offloads enabled.
+	pkts := [][]byte{
+		tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck, 100, 1),
+		tcp4Packet(ip4PortA, ip4PortB, header.TCPFlagAck, 100, 101),
+		udp4Packet(ip4PortA, ip4PortB, 100),
+		udp4Packet(ip4PortA, ip4PortB, 100),
+	}
+	var want []byte
+	for _, pkt := range pkts {
+		want = append(want, make([]byte, virtioNetHdrLen)...)
+		want = append(want, pkt[offset:]...)
+	}
+	if _, err := tun.Write(pkts, offset); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("wrote %d bytes, want %d packets written as is behind empty headers (%d bytes)", len(got), len(pkts), len(want))
+	}
+
+	if _, err := tun.Write([][]byte{pkts[0][offset:]}, 0); err == nil {
+		t.Error("Write without room for the virtio-net header succeeded")
+	}
+}
+
+func TestCreateTUNWithOptions(t *testing.T) {
+	tests := []struct {
+		mode      OffloadMode
+		batchSize int
+		check     func(Offloads) bool
+	}{
+		{OffloadAuto, conn.IdealBatchSize, func(o Offloads) bool { return o.TSO && o.GRO && !o.Disabled }},
+		{OffloadGROOnly, conn.IdealBatchSize, func(o Offloads) bool { return !o.TSO && !o.USO && o.GRO && !o.Disabled }},
+		{OffloadDisabled, 1, func(o Offloads) bool { return o == Offloads{Disabled: true} }},
+	}
+	for _, tt := range tests {
+		dev, err := CreateTUNWithOptions("", 1420, Options{Offload: tt.mode})
+		if err != nil {
+			t.Skipf("cannot create TUN device: %v", err)
+		}
+		offloads := dev.(OffloadReporter).Offloads()
+		if !tt.check(offloads) {
+			t.Errorf("mode %d: unexpected offloads %+v", tt.mode, offloads)
+		}
+		if n := dev.BatchSize(); n != tt.batchSize {
+			t.Errorf("mode %d: BatchSize() = %d, want %d", tt.mode, n, tt.batchSize)
+		}
+		dev.Close()
+	}
+}
+
+// TestReadWithoutOffloads sends a datagram through a TUN device with
+// offloads disabled and checks that it is read back as a plain packet.
+func TestReadWithoutOffloads(t *testing.T) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip(8) not found")
+	}
+	dev, err := CreateTUNWithOptions("", 1420, Options{Offload: OffloadDisabled})
+	if err != nil {
+		t.Skipf("cannot create TUN device: %v", err)
+	}
+	defer dev.Close()
+	name, err := dev.Name()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"address", "add", "198.51.100.1/24", "dev", name},
+		{"link", "set", name, "up"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Skipf("ip %v: %v: %s", args, err, out)
+		}
+	}
+
+	dst := netip.MustParseAddrPort("198.51.100.2:4242")
+	sock, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	payload := bytes.Repeat([]byte{0xa5}, 200)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			sock.Write(payload)
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	bufs := [][]byte{make([]byte, offset+65535)}
+	sizes := make([]int, 1)
+	timeout := time.AfterFunc(5*time.Second, func() { dev.Close() })
+	defer timeout.Stop()
+	for {
+		n, err := dev.Read(bufs, sizes, offset)
+		if err != nil {
+			t.Fatalf("datagram not read from TUN device: %v", err)
+		}
+		if n != 1 {
+			t.Fatalf("Read returned %d packets, want 1", n)
+		}
+		pkt := bufs[0][offset : offset+sizes[0]]
+		if header.IPVersion(pkt) != 4 {
+			continue
+		}
+		ip := header.IPv4(pkt)
+		if ip.Protocol() != uint8(header.UDPProtocolNumber) || ip.DestinationAddress().String() != dst.Addr().String() {
+			continue
+		}
+		if got := header.UDP(ip.Payload()).Payload(); !bytes.Equal(got, payload) {
+			t.Fatalf("read datagram with %d byte payload, want %d", len(got), len(payload))
+		}
+		return
+	}
+}
@@ -8,7 +8,6 @@ package tun
 import (
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"sync"
@@ -18,6 +17,13 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+const (
+	_ROUTE_MSGFILTER = 1
+
+	// ifmIndexOffset is the offset of ifm_index in struct if_msghdr.
+	ifmIndexOffset = 6
+)
+
 // Structure for iface mtu get/set ioctls
 type ifreq_mtu struct {
 	Name [unix.IFNAMSIZ]byte
@@ -33,74 +39,10 @@ type NativeTun struct {
 	events      chan Event
 	errors      chan error
 	routeSocket int
+	rawConn     syscall.RawConn // set if reads are batched
 	closeOnce   sync.Once
 }
 
-func (tun *NativeTun) routineRouteListener(tunIfindex int) {
-	var (
-		statusUp  bool
-		statusMTU int
-	)
-
-	defer close(tun.events)
-
-	check := func() bool {
-		iface, err := net.InterfaceByIndex(tunIfindex)
-		if err != nil {
-			tun.errors <- err
-			return true
-		}
-
-		// Up / Down event
-		up := (iface.Flags & net.FlagUp) != 0
-		if up != statusUp && up {
-			tun.events <- EventUp
-		}
-		if up != statusUp && !up {
-			tun.events <- EventDown
-		}
-		statusUp = up
-
-		// MTU changes
-		if iface.MTU != statusMTU {
-			tun.events <- EventMTUUpdate
-		}
-		statusMTU = iface.MTU
-		return false
-	}
-
-	if check() {
-		return
-	}
-
-	data := make([]byte, os.Getpagesize())
-	for {
-		n, err := unix.Read(tun.routeSocket, data)
-		if err != nil {
-			if errno, ok := err.(syscall.Errno); ok && errno == syscall.EINTR {
-				continue
-			}
-			tun.errors <- err
-			return
-		}
-
-		if n < 8 {
-			continue
-		}
-
-		if data[3 /* type */] != unix.RTM_IFINFO {
-			continue
-		}
-		ifindex := int(*(*uint16)(unsafe.Pointer(&data[6 /* ifindex */])))
-		if ifindex != tunIfindex {
-			continue
-		}
-		if check() {
-			return
-		}
-	}
-}
-
 func CreateTUN(name string, mtu int, _ ...string) (Device, error) {
 	ifIndex := -1
 	if name != "tun" {
@@ -170,7 +112,16 @@ func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
 		tun.tunFile.Close()
 		return nil, err
 	}
+	// Only listen for interface changes, rather than every route change,
+	// which keeps the socket from overflowing on busy routers.
+	err = unix.SetsockoptInt(tun.routeSocket, unix.AF_ROUTE, _ROUTE_MSGFILTER, 1<<unix.RTM_IFINFO)
+	if err != nil {
+		unix.Close(tun.routeSocket)
+		tun.tunFile.Close()
+		return nil, err
+	}
 
+	tun.initBatching()
 	go tun.routineRouteListener(tunIfindex)
 
 	currentMTU, err := tun.MTU()
@@ -204,45 +155,6 @@ func (tun *NativeTun) Events() <-chan Event {
 	return tun.events
 }
 
-func (tun *NativeTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
-	select {
-	case err := <-tun.errors:
-		return 0, err
-	default:
-		buf := bufs[0][offset-4:]
-		n, err := tun.tunFile.Read(buf[:])
-		if n < 4 {
-			return 0, err
-		}
-		sizes[0] = n - 4
-		return 1, err
-	}
-}
-
-func (tun *NativeTun) Write(bufs [][]byte, offset int) (int, error) {
-	if offset < 4 {
-		return 0, io.ErrShortBuffer
-	}
-	for i, buf := range bufs {
-		buf = buf[offset-4:]
-		buf[0] = 0x00
-		buf[1] = 0x00
-		buf[2] = 0x00
-		switch buf[4] >> 4 {
-		case 4:
-			buf[3] = unix.AF_INET
-		case 6:
-			buf[3] = unix.AF_INET6
-		default:
-			return i, unix.EAFNOSUPPORT
-		}
-		if _, err := tun.tunFile.Write(buf); err != nil {
-			return i, err
-		}
-	}
-	return len(bufs), nil
-}
-
 func (tun *NativeTun) Close() error {
 	var err1, err2 error
 	tun.closeOnce.Do(func() {
@@ -327,7 +239,3 @@ func (tun *NativeTun) MTU() (int, error) {
 
 	return int(*(*int32)(unsafe.Pointer(&ifr.MTU))), nil
 }
-
-func (tun *NativeTun) BatchSize() int {
-	return 1
-}
@@ -103,11 +103,25 @@ func CreateTUNWithStringGUID(ifname, guidStr string, mtu int) (Device, error) {
 
 // CreateTUNWithRequestedGUID creates a Wintun interface with the given name and
 // a requested GUID. Should a Wintun interface with the same name exist, it is reused.
+// If requestedGUID is nil, the GUID the interface was last created with is
+// requested again, so that Windows keeps using the same network profile for
+// it; see CleanupNetworkProfiles.
 func CreateTUNWithRequestedGUID(ifname string, requestedGUID *windows.GUID, mtu int) (Device, error) {
+	if requestedGUID == nil {
+		guid, err := persistentGUID(ifname)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading interface GUID: %w", err)
+		}
+		requestedGUID = guid
+	}
 	wt, err := wintun.CreateAdapter(ifname, WintunTunnelType, requestedGUID)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating interface: %w", err)
 	}
+	if err := keepGUID(ifname, wt); err != nil {
+		wt.Close()
+		return nil, fmt.Errorf("Error keeping interface GUID: %w", err)
+	}
 
 	forcedMTU := 1420
 	if mtu > 0 {
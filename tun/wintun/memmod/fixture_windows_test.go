@@ -0,0 +1,357 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package memmod
+
+import (
+	"encoding/binary"
+	"sort"
+	"unicode/utf16"
+	"unsafe"
+)
+
+// The helpers in this file synthesize minimal PE images for tests, so that
+// the loader can be exercised against images with precisely known contents
+// without checking compiled DLLs into the tree. The images contain no code
+// and no entry point, so they are safe to map into the test process.
+
+const (
+	fixtureFileAlignment    = 0x200
+	fixtureSectionAlignment = 0x1000
+)
+
+type fixtureSection struct {
+	name            string
+	characteristics uint32
+	data            []byte
+}
+
+type peFixture struct {
+	machine     uint16
+	sections    []fixtureSection
+	directories [IMAGE_NUMBEROF_DIRECTORY_ENTRIES]IMAGE_DATA_DIRECTORY
+}
+
+func newPEFixture() *peFixture {
+	return &peFixture{machine: imageFileProcess}
+}
+
+// nextRVA returns the RVA that the next added section will be mapped at.
+func (f *peFixture) nextRVA() uint32 {
+	return uint32(len(f.sections)+1) * fixtureSectionAlignment
+}
+
+// addSection appends a section and returns its RVA. Sections are limited to one page.
+func (f *peFixture) addSection(name string, characteristics uint32, data []byte) uint32 {
+	if len(data) > fixtureSectionAlignment {
+		panic("fixture section too large")
+	}
+	rva := f.nextRVA()
+	f.sections = append(f.sections, fixtureSection{name, characteristics, data})
+	return rva
+}
+
+func (f *peFixture) bytes() []byte {
+	is64 := unsafe.Sizeof(uintptr(0)) == 8
+	optionalHeaderSize := 224
+	if is64 {
+		optionalHeaderSize = 240
+	}
+	const ntOffset = 0x40
+	headersSize := ntOffset + 4 + IMAGE_SIZEOF_FILE_HEADER + optionalHeaderSize + 40*len(f.sections)
+	sizeOfHeaders := alignUp(uintptr(headersSize), fixtureFileAlignment)
+	image := make([]byte, sizeOfHeaders)
+	le := binary.LittleEndian
+
+	// DOS header.
+	le.PutUint16(image[0:], IMAGE_DOS_SIGNATURE)
+	le.PutUint32(image[0x3c:], ntOffset)
+
+	// NT headers.
+	le.PutUint32(image[ntOffset:], IMAGE_NT_SIGNATURE)
+	fh := image[ntOffset+4:]
+	le.PutUint16(fh[0:], f.machine)
+	le.PutUint16(fh[2:], uint16(len(f.sections)))
+	le.PutUint16(fh[16:], uint16(optionalHeaderSize))
+	characteristics := uint16(IMAGE_FILE_EXECUTABLE_IMAGE | IMAGE_FILE_DLL)
+	if !is64 {
+		characteristics |= IMAGE_FILE_32BIT_MACHINE
+	}
+	le.PutUint16(fh[18:], characteristics)
+
+	sizeOfImage := f.nextRVA()
+	oh := fh[IMAGE_SIZEOF_FILE_HEADER:]
+	var dirs []byte
+	if is64 {
+		le.PutUint16(oh[0:], 0x20b)
+		le.PutUint64(oh[24:], 0x180000000)
+		le.PutUint32(oh[32:], fixtureSectionAlignment)
+		le.PutUint32(oh[36:], fixtureFileAlignment)
+		le.PutUint16(oh[48:], 6) // MajorSubsystemVersion
+		le.PutUint32(oh[56:], sizeOfImage)
+		le.PutUint32(oh[60:], uint32(sizeOfHeaders))
+		le.PutUint16(oh[68:], 3) // IMAGE_SUBSYSTEM_WINDOWS_CUI
+		le.PutUint32(oh[108:], IMAGE_NUMBEROF_DIRECTORY_ENTRIES)
+		dirs = oh[112:]
+	} else {
+		le.PutUint16(oh[0:], 0x10b)
+		le.PutUint32(oh[28:], 0x10000000)
+		le.PutUint32(oh[32:], fixtureSectionAlignment)
+		le.PutUint32(oh[36:], fixtureFileAlignment)
+		le.PutUint16(oh[48:], 6) // MajorSubsystemVersion
+		le.PutUint32(oh[56:], sizeOfImage)
+		le.PutUint32(oh[60:], uint32(sizeOfHeaders))
+		le.PutUint16(oh[68:], 3) // IMAGE_SUBSYSTEM_WINDOWS_CUI
+		le.PutUint32(oh[92:], IMAGE_NUMBEROF_DIRECTORY_ENTRIES)
+		dirs = oh[96:]
+	}
+	for i, dir := range f.directories {
+		le.PutUint32(dirs[i*8:], dir.VirtualAddress)
+		le.PutUint32(dirs[i*8+4:], dir.Size)
+	}
+
+	// Section table, followed by the raw data of each section.
+	sh := oh[optionalHeaderSize:]
+	var raw []byte
+	for i, section := range f.sections {
+		hdr := sh[i*40:]
+		copy(hdr[:IMAGE_SIZEOF_SHORT_NAME], section.name)
+		rawSize := alignUp(uintptr(len(section.data)), fixtureFileAlignment)
+		le.PutUint32(hdr[8:], uint32(len(section.data)))
+		le.PutUint32(hdr[12:], uint32(i+1)*fixtureSectionAlignment)
+		le.PutUint32(hdr[16:], uint32(rawSize))
+		le.PutUint32(hdr[20:], uint32(len(image)+len(raw)))
+		le.PutUint32(hdr[36:], section.characteristics)
+		raw = append(raw, section.data...)
+		raw = append(raw, make([]byte, rawSize-uintptr(len(section.data)))...)
+	}
+	image = append(image, raw...)
+	return image
+}
+
+type fixtureExport struct {
+	name      string // empty for ordinal-only exports
+	rva       uint32 // ignored for forwarders
+	forwarder string
+}
+
+// addExports appends a read-only section holding an export directory with the
+// given exports, whose ordinals are assigned sequentially starting at base.
+func (f *peFixture) addExports(dllName string, base uint32, exports []fixtureExport) uint32 {
+	rva := f.nextRVA()
+	le := binary.LittleEndian
+
+	type named struct {
+		name  string
+		index uint16
+	}
+	var names []named
+	for i, export := range exports {
+		if export.name != "" {
+			names = append(names, named{export.name, uint16(i)})
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].name < names[j].name })
+
+	const directorySize = 40
+	functionsOffset := directorySize
+	namesOffset := functionsOffset + 4*len(exports)
+	ordinalsOffset := namesOffset + 4*len(names)
+	stringsOffset := ordinalsOffset + 2*len(names)
+
+	data := make([]byte, stringsOffset)
+	addString := func(s string) uint32 {
+		offset := len(data)
+		data = append(data, s...)
+		data = append(data, 0)
+		return rva + uint32(offset)
+	}
+
+	dllNameRVA := addString(dllName)
+	functionRVAs := make([]uint32, len(exports))
+	for i, export := range exports {
+		functionRVAs[i] = export.rva
+		if export.forwarder != "" {
+			functionRVAs[i] = addString(export.forwarder)
+		}
+	}
+	nameRVAs := make([]uint32, len(names))
+	for i, n := range names {
+		nameRVAs[i] = addString(n.name)
+	}
+
+	le.PutUint32(data[12:], dllNameRVA)
+	le.PutUint32(data[16:], base)
+	le.PutUint32(data[20:], uint32(len(exports)))
+	le.PutUint32(data[24:], uint32(len(names)))
+	le.PutUint32(data[28:], rva+uint32(functionsOffset))
+	le.PutUint32(data[32:], rva+uint32(namesOffset))
+	le.PutUint32(data[36:], rva+uint32(ordinalsOffset))
+	for i, functionRVA := range functionRVAs {
+		le.PutUint32(data[functionsOffset+4*i:], functionRVA)
+	}
+	for i, n := range names {
+		le.PutUint32(data[namesOffset+4*i:], nameRVAs[i])
+		le.PutUint16(data[ordinalsOffset+2*i:], n.index)
+	}
+
+	f.directories[IMAGE_DIRECTORY_ENTRY_EXPORT] = IMAGE_DATA_DIRECTORY{rva, uint32(len(data))}
+	return f.addSection(".edata", IMAGE_SCN_CNT_INITIALIZED_DATA|IMAGE_SCN_MEM_READ, data)
+}
+
+type fixtureResource struct {
+	typ, name interface{} // uint16 IDs or strings
+	lang      uint16
+	data      []byte
+}
+
+// addResources appends a read-only section holding a resource directory with
+// the given resources.
+func (f *peFixture) addResources(resources []fixtureResource) uint32 {
+	rva := f.nextRVA()
+	le := binary.LittleEndian
+
+	type node struct {
+		key      interface{}
+		children []*node
+		resource *fixtureResource
+	}
+	child := func(n *node, key interface{}) *node {
+		for _, c := range n.children {
+			if c.key == key {
+				return c
+			}
+		}
+		c := &node{key: key}
+		n.children = append(n.children, c)
+		return c
+	}
+	root := &node{}
+	for i := range resources {
+		r := &resources[i]
+		child(child(child(root, r.typ), r.name), r.lang).resource = r
+	}
+
+	// Directories come first, breadth first, with their named entries
+	// sorted before their ID entries.
+	var directories []*node
+	offsets := make(map[*node]int)
+	size := 0
+	for queue := []*node{root}; len(queue) > 0; queue = queue[1:] {
+		n := queue[0]
+		if n.resource != nil {
+			continue
+		}
+		sort.SliceStable(n.children, func(i, j int) bool {
+			a, aNamed := n.children[i].key.(string)
+			b, bNamed := n.children[j].key.(string)
+			if aNamed != bNamed {
+				return aNamed
+			}
+			if aNamed {
+				return a < b
+			}
+			return fixtureResourceID(n.children[i].key) < fixtureResourceID(n.children[j].key)
+		})
+		directories = append(directories, n)
+		offsets[n] = size
+		size += 16 + 8*len(n.children)
+		queue = append(queue, n.children...)
+	}
+
+	data := make([]byte, size)
+	align := func(n int) {
+		for len(data)%n != 0 {
+			data = append(data, 0)
+		}
+	}
+	type leaf struct {
+		entry    int
+		resource *fixtureResource
+	}
+	var leaves []leaf
+	for _, n := range directories {
+		offset := offsets[n]
+		for i, c := range n.children {
+			entry := offset + 16 + 8*i
+			if name, ok := c.key.(string); ok {
+				le.PutUint16(data[offset+12:], le.Uint16(data[offset+12:])+1)
+				align(2)
+				le.PutUint32(data[entry:], IMAGE_RESOURCE_NAME_IS_STRING|uint32(len(data)))
+				units := utf16.Encode([]rune(name))
+				data = le.AppendUint16(data, uint16(len(units)))
+				for _, u := range units {
+					data = le.AppendUint16(data, u)
+				}
+			} else {
+				le.PutUint16(data[offset+14:], le.Uint16(data[offset+14:])+1)
+				le.PutUint32(data[entry:], uint32(fixtureResourceID(c.key)))
+			}
+			if c.resource == nil {
+				le.PutUint32(data[entry+4:], IMAGE_RESOURCE_DATA_IS_DIRECTORY|uint32(offsets[c]))
+				continue
+			}
+			align(4)
+			le.PutUint32(data[entry+4:], uint32(len(data)))
+			leaves = append(leaves, leaf{len(data), c.resource})
+			data = append(data, make([]byte, 16)...)
+		}
+	}
+	for _, l := range leaves {
+		align(8)
+		le.PutUint32(data[l.entry:], rva+uint32(len(data)))
+		le.PutUint32(data[l.entry+4:], uint32(len(l.resource.data)))
+		data = append(data, l.resource.data...)
+	}
+
+	f.directories[IMAGE_DIRECTORY_ENTRY_RESOURCE] = IMAGE_DATA_DIRECTORY{rva, uint32(len(data))}
+	return f.addSection(".rsrc", IMAGE_SCN_CNT_INITIALIZED_DATA|IMAGE_SCN_MEM_READ, data)
+}
+
+func fixtureResourceID(key interface{}) uint16 {
+	switch key := key.(type) {
+	case uint16:
+		return key
+	case int:
+		return uint16(key)
+	}
+	panic("fixture resource key is neither a string nor an ID")
+}
+
+// fixtureVersionBlock returns a VS_VERSIONINFO block, whose value is text if
+// text is set.
+func fixtureVersionBlock(key string, value []byte, text bool, children ...[]byte) []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 6)
+	pad := func() {
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	b = append(b, fixtureUTF16(key)...)
+	pad()
+	b = append(b, value...)
+	for _, c := range children {
+		pad()
+		b = append(b, c...)
+	}
+	valueLength := len(value)
+	if text {
+		valueLength /= 2
+		le.PutUint16(b[4:], 1)
+	}
+	le.PutUint16(b[0:], uint16(len(b)))
+	le.PutUint16(b[2:], uint16(valueLength))
+	return b
+}
+
+// fixtureUTF16 returns s in little-endian UTF-16, terminated by a NUL.
+func fixtureUTF16(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return binary.LittleEndian.AppendUint16(b, 0)
+}
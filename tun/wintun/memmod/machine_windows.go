@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package memmod
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MachineName returns the name of a machine type from the image file header,
+// such as "AMD64", or its number in hex if it is not one Windows runs on.
+func MachineName(machine uint16) string {
+	switch machine {
+	case IMAGE_FILE_MACHINE_I386:
+		return "I386"
+	case IMAGE_FILE_MACHINE_AMD64:
+		return "AMD64"
+	case IMAGE_FILE_MACHINE_ARM64:
+		return "ARM64"
+	case IMAGE_FILE_MACHINE_ARMNT, IMAGE_FILE_MACHINE_ARM, IMAGE_FILE_MACHINE_THUMB:
+		return "ARM"
+	}
+	return fmt.Sprintf("%#x", machine)
+}
+
+func is64BitMachine(machine uint16) bool {
+	return machine == IMAGE_FILE_MACHINE_AMD64 || machine == IMAGE_FILE_MACHINE_ARM64
+}
+
+// ImageMachine returns the machine type of a PE image and its name, as
+// returned by MachineName, without loading the image.
+func ImageMachine(data []byte) (uint16, string, error) {
+	const fileHeaderOffset = 4 // past the NT signature
+	if len(data) < 0x40 {
+		return 0, "", errors.New("Incomplete IMAGE_DOS_HEADER")
+	}
+	if magic := binary.LittleEndian.Uint16(data); magic != IMAGE_DOS_SIGNATURE {
+		return 0, "", fmt.Errorf("Not an MS-DOS binary (provided: %x, expected: %x)", magic, IMAGE_DOS_SIGNATURE)
+	}
+	ntOffset := uint64(binary.LittleEndian.Uint32(data[0x3c:]))
+	if uint64(len(data)) < ntOffset+fileHeaderOffset+2 {
+		return 0, "", errors.New("Incomplete IMAGE_NT_HEADERS")
+	}
+	if signature := binary.LittleEndian.Uint32(data[ntOffset:]); signature != IMAGE_NT_SIGNATURE {
+		return 0, "", fmt.Errorf("Not an NT binary (provided: %x, expected: %x)", signature, IMAGE_NT_SIGNATURE)
+	}
+	machine := binary.LittleEndian.Uint16(data[ntOffset+fileHeaderOffset:])
+	return machine, MachineName(machine), nil
+}
+
+// ForeignPlatformError is returned by LoadLibrary for images built for a
+// machine other than the current process's.
+type ForeignPlatformError struct {
+	Provided uint16 // the machine type of the image
+	Expected uint16 // the machine type of the process
+}
+
+func (e *ForeignPlatformError) Error() string {
+	msg := fmt.Sprintf("Foreign platform (provided: %x %s, expected: %x %s)",
+		e.Provided, MachineName(e.Provided), e.Expected, MachineName(e.Expected))
+	switch {
+	case !is64BitMachine(e.Provided) && is64BitMachine(e.Expected):
+		msg += fmt.Sprintf(": a 32-bit DLL cannot be loaded into a 64-bit process; embed the %s build of the DLL instead", MachineName(e.Expected))
+	case is64BitMachine(e.Provided) && !is64BitMachine(e.Expected):
+		msg += fmt.Sprintf(": a 64-bit DLL cannot be loaded into a 32-bit process, even one running under WOW64 on a 64-bit system; embed the %s build of the DLL or build a 64-bit program", MachineName(e.Expected))
+	default:
+		msg += fmt.Sprintf(": embed the %s build of the DLL instead", MachineName(e.Expected))
+	}
+	return msg
+}
+
+// SelectImage returns the first of images that LoadLibrary can load into the
+// current process, judged by machine type, so that programs can embed a DLL
+// for each architecture they ship for and pick the right one at run time.
+func SelectImage(images ...[]byte) ([]byte, error) {
+	var found []string
+	for _, image := range images {
+		machine, name, err := ImageMachine(image)
+		if err != nil {
+			return nil, err
+		}
+		if machine == imageFileProcess {
+			return image, nil
+		}
+		found = append(found, name)
+	}
+	return nil, fmt.Errorf("no image for %s among %v", MachineName(imageFileProcess), found)
+}
@@ -37,6 +37,8 @@ type Module struct {
 	nameExports   map[string]uint16
 	entry         uintptr
 	blockedMemory *addressList
+	policy        Policy
+	sections      []SectionInfo
 }
 
 func (module *Module) BaseAddr() uintptr {
@@ -122,9 +124,31 @@ type sectionFinalizeData struct {
 	last            bool
 }
 
-func (module *Module) finalizeSection(sectionData *sectionFinalizeData) error {
+// sectionProtection returns the page protection of a section with the given characteristics.
+func sectionProtection(characteristics uint32) uint32 {
+	// determine protection flags based on characteristics
+	ProtectionFlags := [8]uint32{
+		windows.PAGE_NOACCESS,          // not writeable, not readable, not executable
+		windows.PAGE_EXECUTE,           // not writeable, not readable, executable
+		windows.PAGE_READONLY,          // not writeable, readable, not executable
+		windows.PAGE_EXECUTE_READ,      // not writeable, readable, executable
+		windows.PAGE_WRITECOPY,         // writeable, not readable, not executable
+		windows.PAGE_EXECUTE_WRITECOPY, // writeable, not readable, executable
+		windows.PAGE_READWRITE,         // writeable, readable, not executable
+		windows.PAGE_EXECUTE_READWRITE, // writeable, readable, executable
+	}
+	protect := ProtectionFlags[characteristics>>29]
+	if (characteristics & IMAGE_SCN_MEM_NOT_CACHED) != 0 {
+		protect |= windows.PAGE_NOCACHE
+	}
+	return protect
+}
+
+// finalizeSection sets the protection of the pages of sectionData, or
+// decommits them if discardable, and returns the resulting protection.
+func (module *Module) finalizeSection(sectionData *sectionFinalizeData) (uint32, error) {
 	if sectionData.size == 0 {
-		return nil
+		return windows.PAGE_READWRITE, nil
 	}
 
 	if (sectionData.characteristics & IMAGE_SCN_MEM_DISCARDABLE) != 0 {
@@ -134,33 +158,50 @@ func (module *Module) finalizeSection(sectionData *sectionFinalizeData) error {
 				(sectionData.size%uintptr(module.headers.OptionalHeader.SectionAlignment)) == 0) {
 			// Only allowed to decommit whole pages.
 			windows.VirtualFree(sectionData.address, sectionData.size, windows.MEM_DECOMMIT)
+			return 0, nil
 		}
-		return nil
+		return windows.PAGE_READWRITE, nil
 	}
 
-	// determine protection flags based on characteristics
-	ProtectionFlags := [8]uint32{
-		windows.PAGE_NOACCESS,          // not writeable, not readable, not executable
-		windows.PAGE_EXECUTE,           // not writeable, not readable, executable
-		windows.PAGE_READONLY,          // not writeable, readable, not executable
-		windows.PAGE_EXECUTE_READ,      // not writeable, readable, executable
-		windows.PAGE_WRITECOPY,         // writeable, not readable, not executable
-		windows.PAGE_EXECUTE_WRITECOPY, // writeable, not readable, executable
-		windows.PAGE_READWRITE,         // writeable, readable, not executable
-		windows.PAGE_EXECUTE_READWRITE, // writeable, readable, executable
-	}
-	protect := ProtectionFlags[sectionData.characteristics>>29]
-	if (sectionData.characteristics & IMAGE_SCN_MEM_NOT_CACHED) != 0 {
-		protect |= windows.PAGE_NOCACHE
+	protect := sectionProtection(sectionData.characteristics)
+	if module.policy.ForbidWritableExecutable && isWritableExecutable(protect) {
+		return 0, ErrWritableExecutable
 	}
 
 	// Change memory access flags.
 	var oldProtect uint32
 	err := windows.VirtualProtect(sectionData.address, sectionData.size, protect, &oldProtect)
 	if err != nil {
-		return fmt.Errorf("Error protecting memory page: %w", err)
+		return 0, fmt.Errorf("Error protecting memory page: %w", err)
 	}
 
+	return protect, nil
+}
+
+// finalizeSectionGroup finalizes sections, which share the pages of
+// sectionData, and records their protection.
+func (module *Module) finalizeSectionGroup(sectionData *sectionFinalizeData, sections []IMAGE_SECTION_HEADER) error {
+	protect, err := module.finalizeSection(sectionData)
+	if err != nil {
+		names := make([]string, len(sections))
+		for i := range sections {
+			names[i] = sectionName(&sections[i])
+		}
+		return fmt.Errorf("Error finalizing section %s: %w", strings.Join(names, ", "), err)
+	}
+	for i := range sections {
+		info := SectionInfo{
+			Name:            sectionName(&sections[i]),
+			VirtualAddress:  sections[i].VirtualAddress,
+			Size:            sections[i].VirtualSize(),
+			Characteristics: sections[i].Characteristics,
+			Protection:      protect,
+		}
+		module.sections = append(module.sections, info)
+		if module.policy.Audit != nil {
+			module.policy.Audit(info)
+		}
+	}
 	return nil
 }
 
@@ -175,6 +216,11 @@ func (module *Module) registerExceptionHandlers() {
 
 func (module *Module) finalizeSections() error {
 	sections := module.headers.Sections()
+	if override := module.policy.Characteristics; override != nil {
+		for i := range sections {
+			sections[i].Characteristics = override(sectionName(&sections[i]), sections[i].Characteristics)
+		}
+	}
 	imageOffset := module.headers.OptionalHeader.imageOffset()
 	sectionData := sectionFinalizeData{}
 	sectionData.address = uintptr(sections[0].PhysicalAddress()) | imageOffset
@@ -182,6 +228,7 @@ func (module *Module) finalizeSections() error {
 	sectionData.size = module.realSectionSize(&sections[0])
 	sections[0].SetVirtualSize(uint32(sectionData.size))
 	sectionData.characteristics = sections[0].Characteristics
+	first := 0
 
 	// Loop through all sections and change access flags.
 	for i := uint16(1); i < module.headers.FileHeader.NumberOfSections; i++ {
@@ -202,21 +249,18 @@ func (module *Module) finalizeSections() error {
 			continue
 		}
 
-		err := module.finalizeSection(&sectionData)
+		err := module.finalizeSectionGroup(&sectionData, sections[first:i])
 		if err != nil {
-			return fmt.Errorf("Error finalizing section: %w", err)
+			return err
 		}
 		sectionData.address = sectionAddress
 		sectionData.alignedAddress = alignedAddress
 		sectionData.size = sectionSize
 		sectionData.characteristics = sections[i].Characteristics
+		first = int(i)
 	}
 	sectionData.last = true
-	err := module.finalizeSection(&sectionData)
-	if err != nil {
-		return fmt.Errorf("Error finalizing section: %w", err)
-	}
-	return nil
+	return module.finalizeSectionGroup(&sectionData, sections[first:])
 }
 
 func (module *Module) executeTLS() {
@@ -360,12 +404,20 @@ func (module *Module) buildImportTable() error {
 	return nil
 }
 
-func (module *Module) buildNameExports() error {
+// exportDirectory returns the module's export directory.
+func (module *Module) exportDirectory() (*IMAGE_EXPORT_DIRECTORY, error) {
 	directory := module.headerDirectory(IMAGE_DIRECTORY_ENTRY_EXPORT)
 	if directory.Size == 0 {
-		return errors.New("No export table found")
+		return nil, errors.New("No export table found")
+	}
+	return (*IMAGE_EXPORT_DIRECTORY)(a2p(module.codeBase + uintptr(directory.VirtualAddress))), nil
+}
+
+func (module *Module) buildNameExports() error {
+	exports, err := module.exportDirectory()
+	if err != nil {
+		return err
 	}
-	exports := (*IMAGE_EXPORT_DIRECTORY)(a2p(module.codeBase + uintptr(directory.VirtualAddress)))
 	if exports.NumberOfNames == 0 || exports.NumberOfFunctions == 0 {
 		return errors.New("No functions exported")
 	}
@@ -382,6 +434,106 @@ func (module *Module) buildNameExports() error {
 	return nil
 }
 
+// Export describes an entry in a module's export table.
+type Export struct {
+	Name      string // empty if the function is only exported by ordinal
+	Ordinal   uint16
+	RVA       uint32 // address relative to BaseAddr
+	Forwarded bool   // whether the export forwards to a function of another module
+	Forwarder string // forwarder string, such as "NTDLL.RtlAllocateHeap", if Forwarded
+}
+
+// Exports lists every function exported by the module, including those only
+// exported by ordinal, in ordinal order.
+func (module *Module) Exports() []Export {
+	exports, err := module.exportDirectory()
+	if err != nil || exports.NumberOfFunctions == 0 {
+		return nil
+	}
+	directory := module.headerDirectory(IMAGE_DIRECTORY_ENTRY_EXPORT)
+	functions := unsafe.Slice((*uint32)(a2p(module.codeBase+uintptr(exports.AddressOfFunctions))), exports.NumberOfFunctions)
+	names := make([]string, exports.NumberOfFunctions)
+	if exports.NumberOfNames != 0 {
+		nameRefs := unsafe.Slice((*uint32)(a2p(module.codeBase+uintptr(exports.AddressOfNames))), exports.NumberOfNames)
+		ordinals := unsafe.Slice((*uint16)(a2p(module.codeBase+uintptr(exports.AddressOfNameOrdinals))), exports.NumberOfNames)
+		for i := range nameRefs {
+			if uint32(ordinals[i]) < exports.NumberOfFunctions {
+				names[ordinals[i]] = windows.BytePtrToString((*byte)(a2p(module.codeBase + uintptr(nameRefs[i]))))
+			}
+		}
+	}
+	list := make([]Export, 0, len(functions))
+	for i, rva := range functions {
+		if rva == 0 {
+			// Unused slot in the ordinal range.
+			continue
+		}
+		export := Export{
+			Name:    names[i],
+			Ordinal: uint16(exports.Base + uint32(i)),
+			RVA:     rva,
+		}
+		// An RVA pointing inside the export directory is a forwarder string rather than code.
+		if rva >= directory.VirtualAddress && rva < directory.VirtualAddress+directory.Size {
+			export.Forwarded = true
+			export.Forwarder = windows.BytePtrToString((*byte)(a2p(module.codeBase + uintptr(rva))))
+		}
+		list = append(list, export)
+	}
+	return list
+}
+
+// HasExport reports whether the module exports a function named name.
+func (module *Module) HasExport(name string) bool {
+	_, ok := module.nameExports[name]
+	return ok
+}
+
+// ErrWritableExecutable is returned by LoadLibraryWithPolicy when a policy
+// forbidding writable executable memory meets a section that requires it.
+var ErrWritableExecutable = errors.New("Section is both writable and executable")
+
+// Policy constrains how LoadLibraryWithPolicy maps the sections of an image.
+// The zero Policy maps them as their characteristics say, like LoadLibrary.
+type Policy struct {
+	// ForbidWritableExecutable fails the load if a section would be mapped
+	// both writable and executable, including sections combined with their
+	// neighbours because they share a page.
+	ForbidWritableExecutable bool
+
+	// Characteristics, if not nil, is called with the name and
+	// characteristics of each section, and returns the characteristics to
+	// map it with, such as to strip IMAGE_SCN_MEM_WRITE from code.
+	Characteristics func(name string, characteristics uint32) uint32
+
+	// Audit, if not nil, is called for each section once its protection is
+	// final, in section order.
+	Audit func(section SectionInfo)
+}
+
+// SectionInfo describes a section of a loaded module.
+type SectionInfo struct {
+	Name            string
+	VirtualAddress  uint32 // address relative to BaseAddr
+	Size            uint32
+	Characteristics uint32 // as mapped, after Policy.Characteristics
+	Protection      uint32 // PAGE_* flags of its pages, or 0 if they were discarded
+}
+
+// Sections lists the sections of the module, in section table order, with
+// their final protection.
+func (module *Module) Sections() []SectionInfo {
+	return append([]SectionInfo(nil), module.sections...)
+}
+
+func isWritableExecutable(protect uint32) bool {
+	return protect&(windows.PAGE_EXECUTE_READWRITE|windows.PAGE_EXECUTE_WRITECOPY) != 0
+}
+
+func sectionName(section *IMAGE_SECTION_HEADER) string {
+	return windows.ByteSliceToString(section.Name[:])
+}
+
 type addressRange struct {
 	start uintptr
 	end   uintptr
@@ -456,6 +608,12 @@ func hookRtlPcToFileHeader() error {
 
 // LoadLibrary loads module image to memory.
 func LoadLibrary(data []byte) (module *Module, err error) {
+	return LoadLibraryWithPolicy(data, Policy{})
+}
+
+// LoadLibraryWithPolicy loads module image to memory, mapping its sections
+// as policy requires.
+func LoadLibraryWithPolicy(data []byte, policy Policy) (module *Module, err error) {
 	addr := uintptr(unsafe.Pointer(&data[0]))
 	size := uintptr(len(data))
 	if size < unsafe.Sizeof(IMAGE_DOS_HEADER{}) {
@@ -473,7 +631,7 @@ func LoadLibrary(data []byte) (module *Module, err error) {
 		return nil, fmt.Errorf("Not an NT binary (provided: %x, expected: %x)", oldHeader.Signature, IMAGE_NT_SIGNATURE)
 	}
 	if oldHeader.FileHeader.Machine != imageFileProcess {
-		return nil, fmt.Errorf("Foreign platform (provided: %x, expected: %x)", oldHeader.FileHeader.Machine, imageFileProcess)
+		return nil, &ForeignPlatformError{Provided: oldHeader.FileHeader.Machine, Expected: imageFileProcess}
 	}
 	if (oldHeader.OptionalHeader.SectionAlignment & 1) != 0 {
 		return nil, errors.New("Unaligned section")
@@ -498,7 +656,7 @@ func LoadLibrary(data []byte) (module *Module, err error) {
 		return nil, errors.New("Section is not page-aligned")
 	}
 
-	module = &Module{isDLL: (oldHeader.FileHeader.Characteristics & IMAGE_FILE_DLL) != 0}
+	module = &Module{isDLL: (oldHeader.FileHeader.Characteristics & IMAGE_FILE_DLL) != 0, policy: policy}
 	defer func() {
 		if err != nil {
 			module.Free()
@@ -645,11 +803,10 @@ func (module *Module) Free() {
 
 // ProcAddressByName returns function address by exported name.
 func (module *Module) ProcAddressByName(name string) (uintptr, error) {
-	directory := module.headerDirectory(IMAGE_DIRECTORY_ENTRY_EXPORT)
-	if directory.Size == 0 {
-		return 0, errors.New("No export table found")
+	exports, err := module.exportDirectory()
+	if err != nil {
+		return 0, err
 	}
-	exports := (*IMAGE_EXPORT_DIRECTORY)(a2p(module.codeBase + uintptr(directory.VirtualAddress)))
 	if module.nameExports == nil {
 		return 0, errors.New("No functions exported by name")
 	}
@@ -665,11 +822,10 @@ func (module *Module) ProcAddressByName(name string) (uintptr, error) {
 
 // ProcAddressByOrdinal returns function address by exported ordinal.
 func (module *Module) ProcAddressByOrdinal(ordinal uint16) (uintptr, error) {
-	directory := module.headerDirectory(IMAGE_DIRECTORY_ENTRY_EXPORT)
-	if directory.Size == 0 {
-		return 0, errors.New("No export table found")
+	exports, err := module.exportDirectory()
+	if err != nil {
+		return 0, err
 	}
-	exports := (*IMAGE_EXPORT_DIRECTORY)(a2p(module.codeBase + uintptr(directory.VirtualAddress)))
 	if uint32(ordinal) < exports.Base {
 		return 0, errors.New("Ordinal number too low")
 	}
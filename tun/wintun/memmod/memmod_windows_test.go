@@ -0,0 +1,238 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package memmod
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestExports(t *testing.T) {
+	f := newPEFixture()
+	text := f.addSection(".text", IMAGE_SCN_CNT_CODE|IMAGE_SCN_MEM_EXECUTE|IMAGE_SCN_MEM_READ, []byte{0xc3, 0xc3})
+	edata := f.addExports("fixture.dll", 5, []fixtureExport{
+		{name: "Beta", rva: text},
+		{rva: text + 1},
+		{name: "Alpha", forwarder: "KERNEL32.GetTickCount"},
+	})
+	module, err := LoadLibrary(f.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Free()
+
+	exports := module.Exports()
+	for i := range exports {
+		if exports[i].Forwarded {
+			if exports[i].RVA < edata {
+				t.Errorf("forwarder %q has RVA %#x outside the export section", exports[i].Name, exports[i].RVA)
+			}
+			exports[i].RVA = 0
+		}
+	}
+	want := []Export{
+		{Name: "Beta", Ordinal: 5, RVA: text},
+		{Ordinal: 6, RVA: text + 1},
+		{Name: "Alpha", Ordinal: 7, Forwarded: true, Forwarder: "KERNEL32.GetTickCount"},
+	}
+	if !reflect.DeepEqual(exports, want) {
+		t.Errorf("Exports() = %+v, want %+v", exports, want)
+	}
+
+	for name, want := range map[string]bool{"Alpha": true, "Beta": true, "Gamma": false, "": false} {
+		if got := module.HasExport(name); got != want {
+			t.Errorf("HasExport(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { module.HasExport("Beta") }); allocs != 0 {
+		t.Errorf("HasExport allocated %v times per call", allocs)
+	}
+}
+
+func TestImageMachine(t *testing.T) {
+	foreign := uint16(IMAGE_FILE_MACHINE_I386)
+	if imageFileProcess == IMAGE_FILE_MACHINE_I386 {
+		foreign = IMAGE_FILE_MACHINE_AMD64
+	}
+	f := newPEFixture()
+	f.addSection(".text", IMAGE_SCN_CNT_CODE|IMAGE_SCN_MEM_EXECUTE|IMAGE_SCN_MEM_READ, []byte{0xc3})
+	native := f.bytes()
+	f.machine = foreign
+	other := f.bytes()
+
+	machine, name, err := ImageMachine(other)
+	if err != nil || machine != foreign || name != MachineName(foreign) {
+		t.Errorf("ImageMachine = %#x, %q, %v; want %#x, %q", machine, name, err, foreign, MachineName(foreign))
+	}
+	if _, _, err := ImageMachine(native[:0x20]); err == nil {
+		t.Error("ImageMachine of a truncated image succeeded")
+	}
+
+	_, err = LoadLibrary(other)
+	var foreignErr *ForeignPlatformError
+	if !errors.As(err, &foreignErr) || foreignErr.Provided != foreign || foreignErr.Expected != imageFileProcess {
+		t.Errorf("LoadLibrary of foreign image: got %v, want ForeignPlatformError", err)
+	}
+
+	if image, err := SelectImage(other, native); err != nil || &image[0] != &native[0] {
+		t.Errorf("SelectImage did not pick the native image: %v", err)
+	}
+	if _, err := SelectImage(other); err == nil {
+		t.Error("SelectImage without a native image succeeded")
+	}
+}
+
+func TestLoadLibraryWithPolicy(t *testing.T) {
+	f := newPEFixture()
+	text := f.addSection(".text", IMAGE_SCN_CNT_CODE|IMAGE_SCN_MEM_EXECUTE|IMAGE_SCN_MEM_READ, []byte{0xc3})
+	rwx := f.addSection(".rwx", IMAGE_SCN_CNT_CODE|IMAGE_SCN_MEM_EXECUTE|IMAGE_SCN_MEM_READ|IMAGE_SCN_MEM_WRITE, []byte{0xc3})
+	data := f.addSection(".data", IMAGE_SCN_CNT_INITIALIZED_DATA|IMAGE_SCN_MEM_READ|IMAGE_SCN_MEM_WRITE, []byte{1})
+	image := f.bytes()
+	want := []SectionInfo{
+		{".text", text, fixtureFileAlignment, IMAGE_SCN_CNT_CODE | IMAGE_SCN_MEM_EXECUTE | IMAGE_SCN_MEM_READ, windows.PAGE_EXECUTE_READ},
+		{".rwx", rwx, fixtureFileAlignment, IMAGE_SCN_CNT_CODE | IMAGE_SCN_MEM_EXECUTE | IMAGE_SCN_MEM_READ | IMAGE_SCN_MEM_WRITE, windows.PAGE_EXECUTE_READWRITE},
+		{".data", data, fixtureFileAlignment, IMAGE_SCN_CNT_INITIALIZED_DATA | IMAGE_SCN_MEM_READ | IMAGE_SCN_MEM_WRITE, windows.PAGE_READWRITE},
+	}
+
+	var audited []SectionInfo
+	module, err := LoadLibraryWithPolicy(image, Policy{Audit: func(section SectionInfo) {
+		audited = append(audited, section)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := module.Sections()
+	module.Free()
+	if !reflect.DeepEqual(sections, want) {
+		t.Errorf("Sections() = %+v, want %+v", sections, want)
+	}
+	if !reflect.DeepEqual(audited, want) {
+		t.Errorf("audited %+v, want %+v", audited, want)
+	}
+
+	_, err = LoadLibraryWithPolicy(image, Policy{ForbidWritableExecutable: true})
+	if !errors.Is(err, ErrWritableExecutable) || !strings.Contains(err.Error(), ".rwx") {
+		t.Errorf("LoadLibraryWithPolicy forbidding RWX: got %v, want ErrWritableExecutable naming .rwx", err)
+	}
+
+	module, err = LoadLibraryWithPolicy(image, Policy{
+		ForbidWritableExecutable: true,
+		Characteristics: func(name string, characteristics uint32) uint32 {
+			if characteristics&IMAGE_SCN_MEM_EXECUTE != 0 {
+				characteristics &^= IMAGE_SCN_MEM_WRITE
+			}
+			return characteristics
+		},
+	})
+	if err != nil {
+		t.Fatalf("LoadLibraryWithPolicy stripping write from code: %v", err)
+	}
+	defer module.Free()
+	if got := module.Sections()[1]; got.Protection != windows.PAGE_EXECUTE_READ || got.Characteristics&IMAGE_SCN_MEM_WRITE != 0 {
+		t.Errorf("overridden section = %+v, want it mapped PAGE_EXECUTE_READ", got)
+	}
+}
+
+func TestResources(t *testing.T) {
+	// A string table block holds the strings with IDs 16*(n-1) to 16*n-1.
+	var stringTable []byte
+	for _, s := range []string{"", "Hello", "World"} {
+		units := fixtureUTF16(s)
+		stringTable = binary.LittleEndian.AppendUint16(stringTable, uint16(len(units)/2-1))
+		stringTable = append(stringTable, units[:len(units)-2]...)
+	}
+	stringTable = append(stringTable, make([]byte, 2*13)...)
+
+	fixedFileInfo := make([]byte, 52)
+	for i, v := range []uint32{0xfeef04bd, 0x10000, 0x10002, 0x30004, 0x50006, 0x70008, 0x3f, 0x2} {
+		binary.LittleEndian.PutUint32(fixedFileInfo[4*i:], v)
+	}
+	version := fixtureVersionBlock("VS_VERSION_INFO", fixedFileInfo, false,
+		fixtureVersionBlock("StringFileInfo", nil, true,
+			fixtureVersionBlock("040904b0", nil, true,
+				fixtureVersionBlock("CompanyName", fixtureUTF16("WireGuard LLC"), true),
+				fixtureVersionBlock("FileDescription", fixtureUTF16("Fixture"), true),
+			),
+		),
+		fixtureVersionBlock("VarFileInfo", nil, true,
+			fixtureVersionBlock("Translation", []byte{0x09, 0x04, 0xb0, 0x04}, false),
+		),
+	)
+
+	f := newPEFixture()
+	f.addResources([]fixtureResource{
+		{typ: uint16(windows.RT_STRING), name: uint16(1), lang: 0x409, data: stringTable},
+		{typ: uint16(windows.RT_VERSION), name: uint16(1), lang: 0x409, data: version},
+		{typ: uint16(windows.RT_RCDATA), name: "CONFIG", lang: 0x409, data: []byte("english")},
+		{typ: uint16(windows.RT_RCDATA), name: "CONFIG", lang: 0, data: []byte("neutral")},
+		{typ: "BLOB", name: uint16(7), lang: 0x409, data: []byte{1, 2, 3}},
+	})
+	module, err := LoadLibrary(f.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Free()
+
+	for _, tt := range []struct {
+		typ, name interface{}
+		want      []byte
+	}{
+		{windows.RT_STRING, windows.ResourceID(1), stringTable},
+		{windows.RT_RCDATA, "config", []byte("neutral")},
+		{"#10", "CONFIG", []byte("neutral")},
+		{"blob", 7, []byte{1, 2, 3}},
+		{"BLOB", "#7", []byte{1, 2, 3}},
+	} {
+		got, err := module.Resource(tt.typ, tt.name)
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("Resource(%v, %v) = %q, %v; want %q", tt.typ, tt.name, got, err, tt.want)
+		}
+	}
+	for _, tt := range []struct{ typ, name interface{} }{
+		{windows.RT_STRING, windows.ResourceID(2)},
+		{windows.RT_ICON, windows.ResourceID(1)},
+		{windows.RT_RCDATA, "OTHER"},
+		{"BLOB", "7"},
+	} {
+		if _, err := module.Resource(tt.typ, tt.name); !errors.Is(err, ErrResourceNotFound) {
+			t.Errorf("Resource(%v, %v) = %v, want ErrResourceNotFound", tt.typ, tt.name, err)
+		}
+	}
+	if _, err := module.Resource(1.5, "CONFIG"); err == nil {
+		t.Error("Resource with a float type succeeded")
+	}
+
+	info, err := module.VersionInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &VersionInfo{
+		FileVersion:    [4]uint16{1, 2, 3, 4},
+		ProductVersion: [4]uint16{5, 6, 7, 8},
+		FileFlags:      0x2, // VS_FF_PRERELEASE
+		Strings:        map[string]string{"CompanyName": "WireGuard LLC", "FileDescription": "Fixture"},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("VersionInfo() = %+v, want %+v", info, want)
+	}
+
+	f = newPEFixture()
+	f.addSection(".text", IMAGE_SCN_CNT_CODE|IMAGE_SCN_MEM_EXECUTE|IMAGE_SCN_MEM_READ, []byte{0xc3})
+	bare, err := LoadLibrary(f.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bare.Free()
+	if _, err := bare.VersionInfo(); !errors.Is(err, ErrResourceNotFound) {
+		t.Errorf("VersionInfo() of a module without resources = %v, want ErrResourceNotFound", err)
+	}
+}
@@ -0,0 +1,323 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package memmod
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// ErrResourceNotFound is returned by Resource when the module has no
+// resource of the requested type and name.
+var ErrResourceNotFound = errors.New("Resource not found")
+
+// resourceKey identifies an entry of a resource directory, by ID or by name.
+type resourceKey struct {
+	id     uint16
+	name   string
+	byName bool
+}
+
+// makeResourceKey converts a windows.ResourceIDOrString, or an integer ID,
+// to a resourceKey. As with FindResource, a string of the form "#123" is the
+// ID 123.
+func makeResourceKey(v interface{}) (resourceKey, error) {
+	switch v := v.(type) {
+	case windows.ResourceID:
+		return resourceKey{id: uint16(v)}, nil
+	case uint16:
+		return resourceKey{id: v}, nil
+	case int:
+		if v < 0 || v > 0xffff {
+			return resourceKey{}, fmt.Errorf("Resource ID out of range: %d", v)
+		}
+		return resourceKey{id: uint16(v)}, nil
+	case string:
+		if id, ok := strings.CutPrefix(v, "#"); ok {
+			n, err := strconv.ParseUint(id, 10, 16)
+			if err != nil {
+				return resourceKey{}, fmt.Errorf("Invalid resource ID %q", v)
+			}
+			return resourceKey{id: uint16(n)}, nil
+		}
+		if v == "" {
+			return resourceKey{}, errors.New("Empty resource name")
+		}
+		return resourceKey{name: v, byName: true}, nil
+	}
+	return resourceKey{}, fmt.Errorf("Resource type or name must be a string or an ID, not %T", v)
+}
+
+// resourceTable returns the module's resource directory as a byte slice,
+// against which the offsets in it are checked.
+func (module *Module) resourceTable() ([]byte, error) {
+	directory := module.headerDirectory(IMAGE_DIRECTORY_ENTRY_RESOURCE)
+	if directory.Size == 0 {
+		return nil, ErrResourceNotFound
+	}
+	if uint64(directory.VirtualAddress)+uint64(directory.Size) > uint64(module.headers.OptionalHeader.SizeOfImage) {
+		return nil, errors.New("Resource directory out of bounds")
+	}
+	return unsafe.Slice((*byte)(a2p(module.codeBase+uintptr(directory.VirtualAddress))), directory.Size), nil
+}
+
+// resourceEntries returns the entries of the resource directory at offset.
+func resourceEntries(table []byte, offset uint32) ([]IMAGE_RESOURCE_DIRECTORY_ENTRY, error) {
+	headerSize := uint64(unsafe.Sizeof(IMAGE_RESOURCE_DIRECTORY{}))
+	if uint64(offset)+headerSize > uint64(len(table)) {
+		return nil, errors.New("Resource directory out of bounds")
+	}
+	directory := (*IMAGE_RESOURCE_DIRECTORY)(unsafe.Pointer(&table[offset]))
+	count := uint64(directory.NumberOfNamedEntries) + uint64(directory.NumberOfIdEntries)
+	entrySize := uint64(unsafe.Sizeof(IMAGE_RESOURCE_DIRECTORY_ENTRY{}))
+	if uint64(offset)+headerSize+count*entrySize > uint64(len(table)) {
+		return nil, errors.New("Resource directory entries out of bounds")
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	return unsafe.Slice((*IMAGE_RESOURCE_DIRECTORY_ENTRY)(unsafe.Pointer(&table[uint64(offset)+headerSize])), count), nil
+}
+
+// resourceName returns the name of a resource directory entry named by a
+// string at offset.
+func resourceName(table []byte, offset uint32) (string, error) {
+	if uint64(offset)+2 > uint64(len(table)) {
+		return "", errors.New("Resource name out of bounds")
+	}
+	length := uint64(binary.LittleEndian.Uint16(table[offset:]))
+	start := uint64(offset) + 2
+	if start+2*length > uint64(len(table)) {
+		return "", errors.New("Resource name out of bounds")
+	}
+	name := make([]uint16, length)
+	for i := range name {
+		name[i] = binary.LittleEndian.Uint16(table[start+2*uint64(i):])
+	}
+	return string(utf16.Decode(name)), nil
+}
+
+// findResourceEntry returns the entry matching key in the resource directory
+// at offset. Names are compared case-insensitively, like FindResource does.
+func findResourceEntry(table []byte, offset uint32, key resourceKey) (*IMAGE_RESOURCE_DIRECTORY_ENTRY, error) {
+	entries, err := resourceEntries(table, offset)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Name&IMAGE_RESOURCE_NAME_IS_STRING == 0 {
+			if !key.byName && uint16(entry.Name) == key.id {
+				return entry, nil
+			}
+			continue
+		}
+		if !key.byName {
+			continue
+		}
+		name, err := resourceName(table, entry.Name&^IMAGE_RESOURCE_NAME_IS_STRING)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(name, key.name) {
+			return entry, nil
+		}
+	}
+	return nil, ErrResourceNotFound
+}
+
+// Resource returns a copy of the data of the resource of type typ named
+// name, each either a string or an ID, such as windows.RT_VERSION or
+// windows.ResourceID(1), like FindResource and LoadResource would for a
+// module mapped by the system loader. If the resource exists in several
+// languages, the language-neutral one is preferred, and otherwise the first
+// in the directory is returned.
+func (module *Module) Resource(typ, name interface{}) ([]byte, error) {
+	typeKey, err := makeResourceKey(typ)
+	if err != nil {
+		return nil, err
+	}
+	nameKey, err := makeResourceKey(name)
+	if err != nil {
+		return nil, err
+	}
+	table, err := module.resourceTable()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := uint32(0)
+	for _, key := range [...]resourceKey{typeKey, nameKey} {
+		entry, err := findResourceEntry(table, offset, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry.OffsetToData&IMAGE_RESOURCE_DATA_IS_DIRECTORY == 0 {
+			return nil, errors.New("Resource directory entry is not a directory")
+		}
+		offset = entry.OffsetToData &^ IMAGE_RESOURCE_DATA_IS_DIRECTORY
+	}
+	languages, err := resourceEntries(table, offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(languages) == 0 {
+		return nil, ErrResourceNotFound
+	}
+	language := &languages[0]
+	for i := range languages {
+		if languages[i].Name == 0 { // LANG_NEUTRAL
+			language = &languages[i]
+			break
+		}
+	}
+	if language.OffsetToData&IMAGE_RESOURCE_DATA_IS_DIRECTORY != 0 {
+		return nil, errors.New("Resource language entry is a directory")
+	}
+
+	offset = language.OffsetToData
+	if uint64(offset)+uint64(unsafe.Sizeof(IMAGE_RESOURCE_DATA_ENTRY{})) > uint64(len(table)) {
+		return nil, errors.New("Resource data entry out of bounds")
+	}
+	data := (*IMAGE_RESOURCE_DATA_ENTRY)(unsafe.Pointer(&table[offset]))
+	if uint64(data.OffsetToData)+uint64(data.Size) > uint64(module.headers.OptionalHeader.SizeOfImage) {
+		return nil, errors.New("Resource data out of bounds")
+	}
+	if data.Size == 0 {
+		return []byte{}, nil
+	}
+	return append([]byte(nil), unsafe.Slice((*byte)(a2p(module.codeBase+uintptr(data.OffsetToData))), data.Size)...), nil
+}
+
+// VersionInfo is the version resource of a module.
+type VersionInfo struct {
+	FileVersion    [4]uint16 // major, minor, build and revision
+	ProductVersion [4]uint16 // major, minor, build and revision
+	FileFlags      uint32    // VS_FF_* flags, masked by the file flags mask
+
+	// Strings holds the strings of the first table of the StringFileInfo,
+	// such as "CompanyName" and "FileDescription", if there is one.
+	Strings map[string]string
+}
+
+// VersionInfo parses the module's VS_VERSION_INFO resource, like
+// GetFileVersionInfo and VerQueryValue would for a file on disk.
+func (module *Module) VersionInfo() (*VersionInfo, error) {
+	data, err := module.Resource(windows.RT_VERSION, windows.ResourceID(1))
+	if err != nil {
+		return nil, err
+	}
+	root, _, err := parseVersionBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	if root.key != "VS_VERSION_INFO" {
+		return nil, fmt.Errorf("Unexpected version resource key %q", root.key)
+	}
+	const fixedFileInfoSize = 52
+	le := binary.LittleEndian
+	if len(root.value) < fixedFileInfoSize || le.Uint32(root.value) != 0xfeef04bd {
+		return nil, errors.New("Invalid VS_FIXEDFILEINFO")
+	}
+	split := func(ms, ls uint32) [4]uint16 {
+		return [4]uint16{uint16(ms >> 16), uint16(ms), uint16(ls >> 16), uint16(ls)}
+	}
+	info := &VersionInfo{
+		FileVersion:    split(le.Uint32(root.value[8:]), le.Uint32(root.value[12:])),
+		ProductVersion: split(le.Uint32(root.value[16:]), le.Uint32(root.value[20:])),
+		FileFlags:      le.Uint32(root.value[28:]) & le.Uint32(root.value[24:]),
+	}
+
+	for children := root.children; len(children) > 0; {
+		var block versionBlock
+		block, children, err = parseVersionBlock(children)
+		if err != nil {
+			return nil, err
+		}
+		if block.key != "StringFileInfo" || len(block.children) == 0 {
+			continue
+		}
+		table, _, err := parseVersionBlock(block.children)
+		if err != nil {
+			return nil, err
+		}
+		info.Strings = make(map[string]string)
+		for strs := table.children; len(strs) > 0; {
+			var str versionBlock
+			str, strs, err = parseVersionBlock(strs)
+			if err != nil {
+				return nil, err
+			}
+			info.Strings[str.key] = decodeUTF16(str.value)
+		}
+		break
+	}
+	return info, nil
+}
+
+// versionBlock is a node of a VS_VERSIONINFO tree.
+type versionBlock struct {
+	key      string
+	value    []byte
+	children []byte
+}
+
+// parseVersionBlock parses the block at the start of b, and returns it and
+// the blocks following it.
+func parseVersionBlock(b []byte) (block versionBlock, rest []byte, err error) {
+	le := binary.LittleEndian
+	align := func(n int) int { return min((n+3)&^3, len(b)) }
+	if len(b) < 6 {
+		return block, nil, errors.New("Incomplete version block")
+	}
+	length, valueLength, valueType := int(le.Uint16(b)), int(le.Uint16(b[2:])), le.Uint16(b[4:])
+	if length < 6 || length > len(b) {
+		return block, nil, errors.New("Invalid version block length")
+	}
+	rest = b[align(length):]
+	b = b[:length]
+
+	offset := 6
+	for ; ; offset += 2 {
+		if offset+2 > len(b) {
+			return block, nil, errors.New("Unterminated version block key")
+		}
+		if le.Uint16(b[offset:]) == 0 {
+			break
+		}
+	}
+	block.key = decodeUTF16(b[6:offset])
+	offset = align(offset + 2)
+
+	if valueType == 1 {
+		valueLength *= 2 // in characters for text
+	}
+	// Some resource compilers count the length of text values in bytes.
+	valueLength = min(valueLength, len(b)-offset)
+	block.value = b[offset : offset+valueLength]
+	block.children = b[align(offset+valueLength):]
+	return block, rest, nil
+}
+
+// decodeUTF16 decodes little-endian UTF-16 up to its first NUL, if any.
+func decodeUTF16(b []byte) string {
+	s := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		s = append(s, c)
+	}
+	return string(utf16.Decode(s))
+}
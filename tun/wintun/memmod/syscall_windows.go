@@ -289,6 +289,33 @@ type IMAGE_EXPORT_DIRECTORY struct {
 	AddressOfNameOrdinals uint32 // RVA from base of image
 }
 
+// Resource Format
+const (
+	IMAGE_RESOURCE_NAME_IS_STRING    = 0x80000000
+	IMAGE_RESOURCE_DATA_IS_DIRECTORY = 0x80000000
+)
+
+type IMAGE_RESOURCE_DIRECTORY struct {
+	Characteristics      uint32
+	TimeDateStamp        uint32
+	MajorVersion         uint16
+	MinorVersion         uint16
+	NumberOfNamedEntries uint16
+	NumberOfIdEntries    uint16
+}
+
+type IMAGE_RESOURCE_DIRECTORY_ENTRY struct {
+	Name         uint32 // offset of the name if IMAGE_RESOURCE_NAME_IS_STRING, or the ID
+	OffsetToData uint32 // offset of a directory if IMAGE_RESOURCE_DATA_IS_DIRECTORY, or of a data entry
+}
+
+type IMAGE_RESOURCE_DATA_ENTRY struct {
+	OffsetToData uint32 // RVA from base of image
+	Size         uint32
+	CodePage     uint32
+	Reserved     uint32
+}
+
 type IMAGE_IMPORT_BY_NAME struct {
 	Hint uint16
 	Name [1]byte